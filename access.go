@@ -0,0 +1,229 @@
+// Blob access tracking for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blob temperatures, by time since the last read
+const (
+	TemperatureHot  = "hot"
+	TemperatureWarm = "warm"
+	TemperatureCold = "cold"
+)
+
+// hottestBlobsListed is how many blobs GET /admin/access ranks by read count
+const hottestBlobsListed = 20
+
+// BlobAccess - Read statistics for one blob
+type BlobAccess struct {
+	ID          string     `json:"id"`
+	AccessCount int64      `json:"access_count"`
+	LastAccess  *time.Time `json:"last_access,omitempty"`
+	Temperature string     `json:"temperature"`
+}
+
+// AccessSummary - Response of GET /admin/access
+type AccessSummary struct {
+	Hot     int          `json:"hot"`
+	Warm    int          `json:"warm"`
+	Cold    int          `json:"cold"`
+	Hottest []BlobAccess `json:"hottest"`
+	Cache   CacheStats   `json:"cache"`
+}
+
+// accessDelta - Reads of one blob since the last flush
+type accessDelta struct {
+	count int64
+	last  time.Time
+}
+
+// accessTracker - Counts reads in memory; they are folded into the blob
+// index and persisted every flushInterval
+type accessTracker struct {
+	hotWindow     time.Duration
+	warmWindow    time.Duration
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	pending map[string]accessDelta
+}
+
+// loadAccessTracker reads ACCESS_HOT_WINDOW, ACCESS_WARM_WINDOW and ACCESS_FLUSH_INTERVAL
+func loadAccessTracker() *accessTracker {
+	return &accessTracker{
+		hotWindow:     getEnvDuration("ACCESS_HOT_WINDOW", time.Hour),
+		warmWindow:    getEnvDuration("ACCESS_WARM_WINDOW", 7*24*time.Hour),
+		flushInterval: getEnvDuration("ACCESS_FLUSH_INTERVAL", time.Minute),
+		pending:       make(map[string]accessDelta),
+	}
+}
+
+// record notes one read of a blob
+func (t *accessTracker) record(blobID string) {
+	t.mu.Lock()
+	delta := t.pending[blobID]
+	delta.count++
+	delta.last = timeNow().UTC()
+	t.pending[blobID] = delta
+	t.mu.Unlock()
+}
+
+// take returns and clears the reads recorded since the last flush
+func (t *accessTracker) take() map[string]accessDelta {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pending := t.pending
+	t.pending = make(map[string]accessDelta)
+	return pending
+}
+
+// stats merges a blob's persisted statistics with reads not yet flushed
+func (t *accessTracker) stats(blob BlobInfo) BlobAccess {
+	access := BlobAccess{ID: blob.ID, AccessCount: blob.AccessCount, LastAccess: blob.LastAccess}
+
+	t.mu.Lock()
+	if delta, ok := t.pending[blob.ID]; ok {
+		access.AccessCount += delta.count
+		last := delta.last
+		access.LastAccess = &last
+	}
+	t.mu.Unlock()
+
+	access.Temperature = t.temperature(access.LastAccess)
+	return access
+}
+
+// temperature classifies a blob by how recently it was read
+func (t *accessTracker) temperature(lastAccess *time.Time) string {
+	switch {
+	case lastAccess == nil:
+		return TemperatureCold
+	case timeNow().Sub(*lastAccess) < t.hotWindow:
+		return TemperatureHot
+	case timeNow().Sub(*lastAccess) < t.warmWindow:
+		return TemperatureWarm
+	}
+	return TemperatureCold
+}
+
+// runAccessFlush periodically persists access statistics
+func (fb *FileBox) runAccessFlush() {
+	ticker := time.NewTicker(fb.access.flushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fb.flushAccessStats()
+	}
+}
+
+// flushAccessStats folds pending reads into the blob index and saves each
+// affected container once
+func (fb *FileBox) flushAccessStats() {
+	pending := fb.access.take()
+	if len(pending) == 0 {
+		return
+	}
+
+	updated := make(map[*ContainerFile][]int)
+	fb.fileLock.Lock()
+	for blobID, delta := range pending {
+		fileID, index, err := parseBlobID(blobID)
+		if err != nil {
+			continue
+		}
+		containerFile, exists := fb.files.get(fileID)
+		if !exists || index < 0 || index >= len(containerFile.Blobs) {
+			continue
+		}
+		blob := &containerFile.Blobs[index]
+		blob.AccessCount += delta.count
+		last := delta.last
+		blob.LastAccess = &last
+		updated[containerFile] = append(updated[containerFile], index)
+	}
+	fb.fileLock.Unlock()
+
+	for containerFile, indexes := range updated {
+		fb.saveBlobMetadata(containerFile, indexes...)
+	}
+	log.Printf("Persisted access statistics for %d blobs in %d containers", len(pending), len(updated))
+}
+
+// lastContainerAccess returns the most recent read of any blob in a container,
+// or its creation time if none was ever read. blobs are the container's
+// index entries. Callers must hold fb.fileLock.
+func lastContainerAccess(containerFile *ContainerFile, blobs []BlobInfo) time.Time {
+	last := containerFile.Created
+	for _, blob := range blobs {
+		if blob.LastAccess != nil && blob.LastAccess.After(last) {
+			last = *blob.LastAccess
+		}
+	}
+	return last
+}
+
+// handleAccess serves GET /admin/access and GET /admin/access/{blob_id}
+func (fb *FileBox) handleAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if blobID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/access"), "/"); blobID != "" {
+		fb.fileLock.RLock()
+		_, blob, exists := fb.lookupBlob(blobID)
+		fb.fileLock.RUnlock()
+		if !exists {
+			http.Error(w, "Blob not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fb.access.stats(blob))
+		return
+	}
+
+	var blobs []BlobInfo
+	fb.fileLock.RLock()
+	for _, file := range fb.files.all() {
+		blobs = append(blobs, fb.containerBlobs(file)...)
+	}
+	fb.fileLock.RUnlock()
+
+	summary := AccessSummary{Hottest: []BlobAccess{}, Cache: fb.cache.stats()}
+	for _, blob := range blobs {
+		if blob.DeletedAt != nil {
+			continue
+		}
+		access := fb.access.stats(blob)
+		switch access.Temperature {
+		case TemperatureHot:
+			summary.Hot++
+		case TemperatureWarm:
+			summary.Warm++
+		default:
+			summary.Cold++
+		}
+		if access.AccessCount > 0 {
+			summary.Hottest = append(summary.Hottest, access)
+		}
+	}
+	sort.Slice(summary.Hottest, func(i, j int) bool {
+		return summary.Hottest[i].AccessCount > summary.Hottest[j].AccessCount
+	})
+	if len(summary.Hottest) > hottestBlobsListed {
+		summary.Hottest = summary.Hottest[:hottestBlobsListed]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,55 @@
+// Admin and Unix socket listeners for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenAdmin listens on host:port, or on a Unix socket given as unix:/path
+func listenAdmin(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// Only the owning user may manage the node
+	return listenUnix(path, 0600)
+}
+
+// listenUnix listens on a Unix socket with the given permissions
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	// A socket left behind by an earlier run would make Listen fail
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// loadSocketMode reads SOCKET_MODE, the octal permissions of the API socket
+// (default 0660 so an application in the same group can connect)
+func loadSocketMode() os.FileMode {
+	value := os.Getenv("SOCKET_MODE")
+	if value == "" {
+		return 0660
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		log.Printf("Invalid SOCKET_MODE %q, using 0660", value)
+		return 0660
+	}
+	return os.FileMode(mode)
+}
@@ -0,0 +1,300 @@
+// Upload admission control for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons an upload is shed, used in responses and the "reason" metric label
+const (
+	ShedInflight    = "inflight"    // Too many upload bytes in memory and no room came free in time
+	ShedReplication = "replication" // Records queued for replicas are not draining
+	ShedS3Backlog   = "s3_backlog"  // Full containers are waiting for their S3 upload
+	ShedFsync       = "fsync"       // The disk is slow to flush appends
+)
+
+var shedReasons = []string{ShedInflight, ShedReplication, ShedS3Backlog, ShedFsync}
+
+const (
+	admissionSampleInterval = time.Second
+	fsyncLatencyWeight      = 0.2              // EWMA weight of the newest fsync
+	fsyncSampleStale        = 10 * time.Second // Older fsync averages no longer shed load
+)
+
+// AdmissionConfig - Limits past which uploads are refused with 429; 0 disables a limit
+type AdmissionConfig struct {
+	MaxInflightBytes    int64         `json:"max_inflight_bytes"`    // Upload bodies being received or stored at once
+	QueueTimeout        time.Duration `json:"queue_timeout"`         // How long an upload waits for in-flight room
+	MaxReplicationBytes int64         `json:"max_replication_bytes"` // Record bytes queued or in flight to replicas
+	MaxS3BacklogBytes   int64         `json:"max_s3_backlog_bytes"`  // Bytes of full containers not yet in S3
+	MaxFsyncLatency     time.Duration `json:"max_fsync_latency"`     // Moving average of fsyncs with FSYNC_WRITES
+}
+
+// loadAdmissionConfig reads ADMISSION_MAX_INFLIGHT_BYTES, ADMISSION_QUEUE_TIMEOUT,
+// ADMISSION_MAX_REPLICATION_BYTES, ADMISSION_MAX_S3_BACKLOG_BYTES and
+// ADMISSION_MAX_FSYNC_LATENCY
+func loadAdmissionConfig() AdmissionConfig {
+	return AdmissionConfig{
+		MaxInflightBytes:    getEnvInt("ADMISSION_MAX_INFLIGHT_BYTES", 256*1024*1024),
+		QueueTimeout:        getEnvDuration("ADMISSION_QUEUE_TIMEOUT", 5*time.Second),
+		MaxReplicationBytes: getEnvInt("ADMISSION_MAX_REPLICATION_BYTES", 256*1024*1024),
+		MaxS3BacklogBytes:   getEnvInt("ADMISSION_MAX_S3_BACKLOG_BYTES", 4*1024*1024*1024),
+		MaxFsyncLatency:     getEnvDuration("ADMISSION_MAX_FSYNC_LATENCY", 500*time.Millisecond),
+	}
+}
+
+// AdmissionError - Why an upload was refused
+type AdmissionError struct {
+	Reason     string
+	Detail     string
+	RetryAfter time.Duration
+}
+
+func (e *AdmissionError) Error() string {
+	return fmt.Sprintf("node is overloaded (%s): %s", e.Reason, e.Detail)
+}
+
+// AdmissionStatus - Response for GET /admin/admission
+type AdmissionStatus struct {
+	InflightBytes    int64            `json:"inflight_bytes"`
+	Waiting          int              `json:"waiting"`
+	ReplicationBytes int64            `json:"replication_bytes"`
+	S3BacklogBytes   int64            `json:"s3_backlog_bytes"`
+	FsyncLatencyMS   float64          `json:"fsync_latency_ms"`
+	Admitted         int64            `json:"admitted"`
+	Rejected         map[string]int64 `json:"rejected"` // By reason
+	Limits           AdmissionConfig  `json:"limits"`
+}
+
+// admissionController - Bounds upload work in memory and sheds uploads while background work is behind
+type admissionController struct {
+	config AdmissionConfig
+
+	mu       sync.Mutex
+	inflight int64
+	waiting  int
+	released chan struct{} // Closed and replaced whenever in-flight bytes are released
+
+	fsyncMS   float64 // Moving average, guarded by mu
+	lastFsync time.Time
+
+	s3Backlog atomic.Int64 // Refreshed by runAdmissionSampler
+	admitted  atomic.Int64
+	rejected  map[string]*atomic.Int64
+}
+
+func newAdmissionController(config AdmissionConfig) *admissionController {
+	a := &admissionController{
+		config:   config,
+		released: make(chan struct{}),
+		rejected: make(map[string]*atomic.Int64, len(shedReasons)),
+	}
+	for _, reason := range shedReasons {
+		a.rejected[reason] = &atomic.Int64{}
+	}
+	return a
+}
+
+// admit reserves room for an upload of size bytes, waiting up to the queue
+// timeout for in-flight uploads to finish. It refuses at once while
+// replication, S3 uploads or fsyncs are behind. The returned func releases
+// the reservation.
+func (fb *FileBox) admit(ctx context.Context, size int64) (func(), error) {
+	a := fb.admission
+	if a == nil {
+		return func() {}, nil
+	}
+	if err := fb.checkBacklog(); err != nil {
+		a.rejected[err.Reason].Add(1)
+		return nil, err
+	}
+
+	if a.config.MaxInflightBytes > 0 {
+		timeout := time.NewTimer(a.config.QueueTimeout)
+		defer timeout.Stop()
+
+		a.mu.Lock()
+		a.waiting++
+		// An upload larger than the whole budget still gets in once nothing else is in flight
+		for a.inflight > 0 && a.inflight+size > a.config.MaxInflightBytes {
+			released := a.released
+			a.mu.Unlock()
+			select {
+			case <-released:
+			case <-timeout.C:
+				a.mu.Lock()
+				a.waiting--
+				inflight := a.inflight
+				a.mu.Unlock()
+				a.rejected[ShedInflight].Add(1)
+				return nil, &AdmissionError{
+					Reason:     ShedInflight,
+					Detail:     fmt.Sprintf("%d upload bytes in flight, limit %d", inflight, a.config.MaxInflightBytes),
+					RetryAfter: time.Second,
+				}
+			case <-ctx.Done():
+				a.mu.Lock()
+				a.waiting--
+				a.mu.Unlock()
+				return nil, ctx.Err()
+			}
+			a.mu.Lock()
+		}
+		a.waiting--
+		a.inflight += size
+		a.mu.Unlock()
+	}
+
+	a.admitted.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if a.config.MaxInflightBytes <= 0 {
+				return
+			}
+			a.mu.Lock()
+			a.inflight -= size
+			close(a.released)
+			a.released = make(chan struct{})
+			a.mu.Unlock()
+		})
+	}, nil
+}
+
+// checkBacklog refuses uploads while background work is behind
+func (fb *FileBox) checkBacklog() *AdmissionError {
+	a := fb.admission
+	if limit := a.config.MaxReplicationBytes; limit > 0 && fb.replication != nil {
+		if queued := fb.replication.queuedBytes.Load(); queued > limit {
+			return &AdmissionError{
+				Reason:     ShedReplication,
+				Detail:     fmt.Sprintf("%d bytes waiting for replicas, limit %d", queued, limit),
+				RetryAfter: 5 * time.Second,
+			}
+		}
+	}
+	if limit := a.config.MaxS3BacklogBytes; limit > 0 {
+		if backlog := a.s3Backlog.Load(); backlog > limit {
+			return &AdmissionError{
+				Reason:     ShedS3Backlog,
+				Detail:     fmt.Sprintf("%d bytes of full containers waiting for S3, limit %d", backlog, limit),
+				RetryAfter: 30 * time.Second,
+			}
+		}
+	}
+	if limit := a.config.MaxFsyncLatency; limit > 0 {
+		a.mu.Lock()
+		latency, fresh := a.fsyncMS, timeNow().Sub(a.lastFsync) < fsyncSampleStale
+		a.mu.Unlock()
+		if fresh && latency > float64(limit.Milliseconds()) {
+			return &AdmissionError{
+				Reason:     ShedFsync,
+				Detail:     fmt.Sprintf("fsyncs average %.0fms, limit %s", latency, limit),
+				RetryAfter: 2 * time.Second,
+			}
+		}
+	}
+	return nil
+}
+
+// observeFsync folds an fsync duration into the moving average
+func (a *admissionController) observeFsync(d time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ms := millis(d)
+	if a.lastFsync.IsZero() || timeNow().Sub(a.lastFsync) > fsyncSampleStale {
+		a.fsyncMS = ms
+	} else {
+		a.fsyncMS = fsyncLatencyWeight*ms + (1-fsyncLatencyWeight)*a.fsyncMS
+	}
+	a.lastFsync = timeNow()
+}
+
+// runAdmissionSampler keeps the S3 backlog current: owned containers that
+// are full or being uploaded but not yet in S3
+func (fb *FileBox) runAdmissionSampler() {
+	if fb.admission == nil || fb.s3Client == nil {
+		return
+	}
+	ticker := time.NewTicker(admissionSampleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		limits := make(map[string]int64, len(fb.sizeClasses))
+		for _, class := range fb.sizeClasses {
+			limits[class.Name] = class.ContainerSize
+		}
+
+		var backlog int64
+		fb.fileLock.RLock()
+		for _, containerFile := range fb.files.all() {
+			if containerFile.Uploaded || containerFile.Quarantined || fb.isForeign(containerFile) {
+				continue
+			}
+			size := fb.containerSize(containerFile)
+			if limit, ok := limits[containerFile.SizeClass]; containerFile.Uploading || (ok && size >= limit) {
+				backlog += size
+			}
+		}
+		fb.fileLock.RUnlock()
+		fb.admission.s3Backlog.Store(backlog)
+	}
+}
+
+// writeAdmissionError answers a refused upload with 429 and Retry-After
+func writeAdmissionError(w http.ResponseWriter, err error) {
+	admissionErr, ok := err.(*AdmissionError)
+	if !ok {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable) // The client went away while queued
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(admissionErr.RetryAfter.Seconds())))
+	w.Header().Set("X-FileBox-Shed-Reason", admissionErr.Reason)
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// admissionStatus reports the controller's view of the node
+func (fb *FileBox) admissionStatus() AdmissionStatus {
+	a := fb.admission
+	if a == nil {
+		return AdmissionStatus{}
+	}
+	status := AdmissionStatus{
+		S3BacklogBytes: a.s3Backlog.Load(),
+		Admitted:       a.admitted.Load(),
+		Rejected:       make(map[string]int64, len(shedReasons)),
+		Limits:         a.config,
+	}
+	if fb.replication != nil {
+		status.ReplicationBytes = fb.replication.queuedBytes.Load()
+	}
+	a.mu.Lock()
+	status.InflightBytes, status.Waiting, status.FsyncLatencyMS = a.inflight, a.waiting, a.fsyncMS
+	a.mu.Unlock()
+	for reason, n := range a.rejected {
+		status.Rejected[reason] = n.Load()
+	}
+	return status
+}
+
+// handleAdmission serves GET /admin/admission
+func (fb *FileBox) handleAdmission(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.admissionStatus())
+}
@@ -0,0 +1,310 @@
+// Tuning recommendations for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GET /admin/advice looks at the blobs this node has taken and how they are
+// read, and suggests settings to match. Each recommendation names the
+// setting, its current and suggested values and the numbers behind it, so
+// it doubles as an explanation of what the setting trades off. Nothing is
+// changed; the settings are environment variables read at startup.
+//
+// The rules of thumb:
+//   - A container should hold a hundred typical blobs, so one S3 PUT and
+//     one object carry many blobs, and ten of the largest, so few are left
+//     stranded part full.
+//   - Containers reach S3 only once full. At the observed write rate a
+//     container should fill within adviceMaxFillTime, or its newest blobs
+//     wait that long with no copy in S3.
+//   - When blob sizes span orders of magnitude, a small class keeps small
+//     blobs packed while large blobs get containers of their own size.
+//   - The read cache should hold the blobs read recently that are only in
+//     S3, with some room to spare.
+
+const (
+	adviceMinBlobs        = 100                   // Fewer and sizes are not advised on
+	adviceBlobsPerBox     = 100                   // Typical blobs a container should hold
+	adviceLargestPerBox   = 10                    // Largest blobs a container should hold
+	adviceMaxFillTime     = 24 * time.Hour        // Longest a container should take to fill
+	adviceRateWindow      = 7 * 24 * time.Hour    // Writes in this window set the write rate
+	adviceMinContainer    = 1 << 20               // Smallest container size suggested
+	adviceMaxContainer    = 5 << 30               // Largest single S3 PUT
+	adviceClassSpread     = 64                    // p99/p50 above this suggests size classes
+	adviceCacheHeadroom   = 1.25                  // Cache size over the hot S3-only bytes
+	adviceMinCacheLookups = 100                   // Fewer and the hit rate is not judged
+	adviceHitRateLow      = 0.5                   // A cache hitting less than this misses the working set
+	adviceChangeFactor    = 2.0                   // Suggest a size only when it differs this much
+	adviceSmallClassSlack = 4                     // A small class's blobs are at most p90 times this
+	adviceMinWindow       = time.Hour             // Shortest history a write rate is taken from
+	adviceOpenTooLong     = 2 * adviceMaxFillTime // Open containers older than this are flagged
+)
+
+// Recommendation - One suggested setting and why
+type Recommendation struct {
+	Setting   string `json:"setting"` // Environment variable
+	Current   string `json:"current"`
+	Suggested string `json:"suggested"`
+	Reason    string `json:"reason"`
+}
+
+// AdviceObservations - What the recommendations are based on
+type AdviceObservations struct {
+	Blobs            int            `json:"blobs"` // Live blobs this node owns
+	BlobSizeP50      int64          `json:"blob_size_p50"`
+	BlobSizeP90      int64          `json:"blob_size_p90"`
+	BlobSizeP99      int64          `json:"blob_size_p99"`
+	WriteBytesPerDay int64          `json:"write_bytes_per_day"` // Over the last week, or since the first container
+	FillTime         string         `json:"fill_time,omitempty"` // For a container of the first size class at that rate
+	OldestOpen       string         `json:"oldest_open,omitempty"`
+	HotS3Bytes       int64          `json:"hot_s3_bytes"` // Blobs read within ACCESS_HOT_WINDOW that are only in S3
+	Cache            CacheStats     `json:"cache"`
+	SizeClasses      []SizeClass    `json:"size_classes"`
+	Reads            map[string]int `json:"reads"` // Blobs by temperature
+}
+
+// AdviceReport - Response of GET /admin/advice
+type AdviceReport struct {
+	GeneratedAt     time.Time          `json:"generated_at"`
+	Observed        AdviceObservations `json:"observed"`
+	Recommendations []Recommendation   `json:"recommendations"`
+	Notes           []string           `json:"notes"` // Settings left alone, and why
+}
+
+// adviceSize rounds a byte count up to a power of two and writes it the
+// way the settings are written
+func adviceSize(n int64) string {
+	return statsSizeLabel(float64(roundUpPow2(n)))
+}
+
+// roundUpPow2 returns the smallest power of two at least n
+func roundUpPow2(n int64) int64 {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len64(uint64(n-1))
+}
+
+// adviceDuration writes a duration in hours or days
+func adviceDuration(d time.Duration) string {
+	if d < 48*time.Hour {
+		return fmt.Sprintf("%.1fh", d.Hours())
+	}
+	return fmt.Sprintf("%.1fd", d.Hours()/24)
+}
+
+// adviceReport gathers observations and applies the rules of thumb
+func (fb *FileBox) adviceReport() *AdviceReport {
+	now := timeNow()
+	report := &AdviceReport{
+		GeneratedAt:     now.UTC(),
+		Recommendations: []Recommendation{},
+		Notes:           []string{},
+	}
+	observed := &report.Observed
+	observed.SizeClasses = fb.sizeClasses
+	observed.Reads = map[string]int{TemperatureHot: 0, TemperatureWarm: 0, TemperatureCold: 0}
+	if fb.cache != nil {
+		observed.Cache = fb.cache.stats()
+	}
+
+	sizes := newSizeHistogram()
+	var recentBytes int64
+	firstCreated := now
+	var oldestOpen time.Time
+	fb.fileLock.RLock()
+	for _, containerFile := range fb.files.all() {
+		if fb.isForeign(containerFile) {
+			continue
+		}
+		if containerFile.Created.Before(firstCreated) {
+			firstCreated = containerFile.Created
+		}
+		if !containerFile.Uploaded && !containerFile.Uploading && (oldestOpen.IsZero() || containerFile.Created.Before(oldestOpen)) {
+			oldestOpen = containerFile.Created
+		}
+		for _, blob := range fb.containerBlobs(containerFile) {
+			if len(blob.Segments) == 0 && blob.CopyOf == "" && now.Sub(blob.Created) < adviceRateWindow {
+				recentBytes += recordHeaderSize + blob.Length
+			}
+			if blob.Uncommitted || blob.DeletedAt != nil || blob.ChunkHash != "" || expired(containerFile, blob, now) {
+				continue
+			}
+			sizes.add(float64(blob.Size))
+			if fb.access == nil {
+				continue
+			}
+			access := fb.access.stats(blob)
+			observed.Reads[access.Temperature]++
+			if access.Temperature == TemperatureHot && containerFile.Evicted {
+				observed.HotS3Bytes += blob.Size
+			}
+		}
+	}
+	fb.fileLock.RUnlock()
+
+	histogram := sizes.histogram()
+	observed.Blobs = histogram.Count
+	observed.BlobSizeP50, observed.BlobSizeP90, observed.BlobSizeP99 = int64(histogram.P50), int64(histogram.P90), int64(histogram.P99)
+	if window := min(now.Sub(firstCreated), adviceRateWindow); window >= adviceMinWindow {
+		observed.WriteBytesPerDay = int64(float64(recentBytes) / window.Hours() * 24)
+	} else {
+		report.Notes = append(report.Notes, fmt.Sprintf("Less than %s of writes; how long containers take to fill is not estimated yet", adviceDuration(adviceMinWindow)))
+	}
+	var openFor time.Duration
+	if !oldestOpen.IsZero() {
+		openFor = now.Sub(oldestOpen)
+		observed.OldestOpen = adviceDuration(openFor)
+	}
+
+	fb.adviseContainerSize(report, openFor)
+	fb.adviseSizeClasses(report)
+	fb.adviseCache(report)
+	return report
+}
+
+// fillTime is how long a container of size takes to fill at the observed
+// write rate; 0 if there is no rate
+func (o *AdviceObservations) fillTime(size int64) time.Duration {
+	if o.WriteBytesPerDay <= 0 {
+		return 0
+	}
+	return time.Duration(float64(size) / float64(o.WriteBytesPerDay) * float64(24*time.Hour))
+}
+
+// adviseContainerSize suggests MAX_CONTAINER_SIZE from blob sizes and the write rate
+func (fb *FileBox) adviseContainerSize(report *AdviceReport, openFor time.Duration) {
+	observed := &report.Observed
+	if len(fb.sizeClasses) == 0 {
+		return
+	}
+	current := fb.sizeClasses[0].ContainerSize
+	if fill := observed.fillTime(current); fill > 0 {
+		observed.FillTime = adviceDuration(fill)
+	}
+	if len(fb.sizeClasses) > 1 {
+		report.Notes = append(report.Notes, "CONTAINER_SIZE_CLASSES is set, so MAX_CONTAINER_SIZE is not advised on; see the fill of each class in GET /admin/stats")
+		return
+	}
+	if observed.Blobs < adviceMinBlobs {
+		report.Notes = append(report.Notes, fmt.Sprintf("Only %d live blobs; container sizes are advised on from %d", observed.Blobs, adviceMinBlobs))
+		return
+	}
+
+	// Large enough for the blobs, small enough to fill in time
+	wanted := max(adviceBlobsPerBox*(observed.BlobSizeP50+recordHeaderSize), adviceLargestPerBox*(observed.BlobSizeP99+recordHeaderSize))
+	reasons := []string{fmt.Sprintf("%s holds %d blobs of the median %d bytes and %d of the p99 %d bytes",
+		adviceSize(wanted), adviceBlobsPerBox, observed.BlobSizeP50, adviceLargestPerBox, observed.BlobSizeP99)}
+	if observed.WriteBytesPerDay > 0 {
+		inTime := int64(float64(observed.WriteBytesPerDay) * adviceMaxFillTime.Hours() / 24)
+		if inTime < wanted {
+			reasons = append(reasons, fmt.Sprintf("but at %d bytes a day it would take %s to fill, and containers reach S3 only once full; %s fills within %s",
+				observed.WriteBytesPerDay, adviceDuration(observed.fillTime(wanted)), adviceSize(inTime), adviceDuration(adviceMaxFillTime)))
+			wanted = max(inTime, observed.BlobSizeP99+recordHeaderSize)
+		}
+	}
+	suggested := min(max(roundUpPow2(wanted), adviceMinContainer), adviceMaxContainer)
+
+	ratio := float64(suggested) / float64(current)
+	if ratio < adviceChangeFactor && ratio > 1/adviceChangeFactor {
+		note := fmt.Sprintf("MAX_CONTAINER_SIZE %s suits the blobs seen", statsSizeLabel(float64(current)))
+		if openFor > adviceOpenTooLong {
+			note += fmt.Sprintf(", though the oldest open container has waited %s to fill", adviceDuration(openFor))
+		}
+		report.Notes = append(report.Notes, note)
+		return
+	}
+	report.Recommendations = append(report.Recommendations, Recommendation{
+		Setting:   "MAX_CONTAINER_SIZE",
+		Current:   statsSizeLabel(float64(current)),
+		Suggested: statsSizeLabel(float64(suggested)),
+		Reason:    strings.Join(reasons, ", ") + ".",
+	})
+}
+
+// adviseSizeClasses suggests a small and a large class when blob sizes are spread wide
+func (fb *FileBox) adviseSizeClasses(report *AdviceReport) {
+	observed := &report.Observed
+	if len(fb.sizeClasses) != 1 || observed.Blobs < adviceMinBlobs || observed.BlobSizeP50 <= 0 {
+		return
+	}
+	spread := float64(observed.BlobSizeP99) / float64(observed.BlobSizeP50)
+	if spread <= adviceClassSpread {
+		return
+	}
+
+	smallMax := roundUpPow2(observed.BlobSizeP90 * adviceSmallClassSlack)
+	small := max(roundUpPow2(adviceBlobsPerBox*(observed.BlobSizeP50+recordHeaderSize)), adviceMinContainer)
+	large := min(max(roundUpPow2(adviceLargestPerBox*(observed.BlobSizeP99+recordHeaderSize)), adviceMinContainer), adviceMaxContainer)
+	if small >= large || smallMax >= large {
+		return
+	}
+	report.Recommendations = append(report.Recommendations, Recommendation{
+		Setting:   "CONTAINER_SIZE_CLASSES",
+		Current:   "",
+		Suggested: fmt.Sprintf("small:%s:%s;large:%s", statsSizeLabel(float64(small)), statsSizeLabel(float64(smallMax)), statsSizeLabel(float64(large))),
+		Reason: fmt.Sprintf("The p99 blob (%d bytes) is %.0f times the median (%d bytes). One container size either strands room that large blobs cannot use "+
+			"or packs few small blobs per S3 object; a small class for blobs up to %s keeps them together and large blobs get containers their own size.",
+			observed.BlobSizeP99, spread, observed.BlobSizeP50, statsSizeLabel(float64(smallMax))),
+	})
+}
+
+// adviseCache suggests BLOB_CACHE_BYTES from the hot blobs only S3 has
+func (fb *FileBox) adviseCache(report *AdviceReport) {
+	observed := &report.Observed
+	cache := observed.Cache
+	lookups := cache.Hits + cache.Misses
+	hitRate := 0.0
+	if lookups > 0 {
+		hitRate = float64(cache.Hits) / float64(lookups)
+	}
+
+	switch {
+	case observed.HotS3Bytes == 0 && cache.Capacity > 0:
+		report.Notes = append(report.Notes, "No recently read blob is S3-only, so the read cache has nothing to hold; BLOB_CACHE_BYTES could be 0")
+	case observed.HotS3Bytes == 0:
+		report.Notes = append(report.Notes, "Every recently read blob is on local disk; no read cache is needed")
+	case cache.Capacity == 0 || float64(cache.Capacity) < float64(observed.HotS3Bytes):
+		suggested := roundUpPow2(int64(math.Ceil(float64(observed.HotS3Bytes) * adviceCacheHeadroom)))
+		reason := fmt.Sprintf("%d bytes of blobs read within ACCESS_HOT_WINDOW are only in S3, so each read of them is an S3 GET", observed.HotS3Bytes)
+		if lookups >= adviceMinCacheLookups {
+			reason += fmt.Sprintf("; the cache answers %.0f%% of lookups", hitRate*100)
+		}
+		report.Recommendations = append(report.Recommendations, Recommendation{
+			Setting:   "BLOB_CACHE_BYTES",
+			Current:   fmt.Sprint(cache.Capacity),
+			Suggested: fmt.Sprint(suggested),
+			Reason:    reason + fmt.Sprintf(". A cache of %s holds them with room to spare.", statsSizeLabel(float64(suggested))),
+		})
+	case lookups >= adviceMinCacheLookups && hitRate < adviceHitRateLow && cache.Rejected > cache.Admitted && fb.cache.minAccesses > 0:
+		report.Recommendations = append(report.Recommendations, Recommendation{
+			Setting:   "CACHE_ADMIT_MIN_ACCESSES",
+			Current:   fmt.Sprint(fb.cache.minAccesses),
+			Suggested: fmt.Sprint(max(fb.cache.minAccesses-1, 0)),
+			Reason: fmt.Sprintf("The cache is large enough for the hot S3-only blobs but answers only %.0f%% of lookups, and turned away %d blobs for not being read often enough (admitted %d). "+
+				"Admitting blobs sooner lets it fill with them.", hitRate*100, cache.Rejected, cache.Admitted),
+		})
+	default:
+		report.Notes = append(report.Notes, fmt.Sprintf("BLOB_CACHE_BYTES %d holds the %d bytes of hot S3-only blobs", cache.Capacity, observed.HotS3Bytes))
+	}
+}
+
+// handleAdvice serves GET /admin/advice
+func (fb *FileBox) handleAdvice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.adviceReport())
+}
@@ -0,0 +1,187 @@
+// Audit log for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audited actions
+const (
+	AuditUpload    = "upload"
+	AuditDelete    = "delete"
+	AuditUndelete  = "undelete"
+	AuditHold      = "legal_hold"
+	AuditUpdate    = "update"
+	AuditCopy      = "copy"
+	AuditCompose   = "compose"
+	AuditReplicate = "replicate"
+	AuditPeerDeny  = "peer_denied"
+	AuditAdmin     = "admin"
+)
+
+// AuditEvent - One data-mutating operation
+type AuditEvent struct {
+	Time         time.Time `json:"time"`
+	Action       string    `json:"action"`
+	Outcome      string    `json:"outcome"` // "ok", "error" or "denied"
+	SourceIP     string    `json:"source_ip"`
+	ForwardedFor string    `json:"forwarded_for,omitempty"`
+	Token        string    `json:"token,omitempty"` // Fingerprint of the bearer token, never the token itself
+	Peer         string    `json:"peer,omitempty"`  // Host ID of the sending replica
+	Tenant       string    `json:"tenant,omitempty"`
+	BlobID       string    `json:"blob_id,omitempty"`
+	FileID       string    `json:"file_id,omitempty"`
+	Key          string    `json:"key,omitempty"`
+	Method       string    `json:"method,omitempty"`
+	Path         string    `json:"path,omitempty"`
+	Status       int       `json:"status,omitempty"`
+	Bytes        int64     `json:"bytes,omitempty"`
+	Detail       string    `json:"detail,omitempty"`
+}
+
+// auditLog - Append-only sink for audit events; a nil *auditLog discards them
+type auditLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// openAuditLog opens the sink named by AUDIT_LOG: a file path, "syslog" for
+// the local syslog daemon, or nothing to disable auditing. AUDIT_SYSLOG_ADDR
+// ("udp://host:514" or "tcp://host:514") sends syslog records to a remote server.
+func openAuditLog() (*auditLog, error) {
+	target := os.Getenv("AUDIT_LOG")
+	switch target {
+	case "":
+		return nil, nil
+	case "syslog":
+		writer, err := openAuditSyslog(os.Getenv("AUDIT_SYSLOG_ADDR"))
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to syslog: %v", err)
+		}
+		log.Printf("Audit log: syslog")
+		return &auditLog{out: writer}, nil
+	default:
+		// O_APPEND keeps earlier records intact even across restarts
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("error opening audit log: %v", err)
+		}
+		log.Printf("Audit log: %s", target)
+		return &auditLog{out: file}, nil
+	}
+}
+
+// record writes one event as a JSON line
+func (a *auditLog) record(event AuditEvent) {
+	if a == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = timeNow().UTC()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding audit event: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing audit event %s: %v", line, err)
+	}
+}
+
+// auditEventFor fills in who made a request
+func auditEventFor(r *http.Request, action string) AuditEvent {
+	event := AuditEvent{
+		Action:       action,
+		SourceIP:     r.RemoteAddr,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		Token:        tokenFingerprint(r.Header.Get("Authorization")),
+		Method:       r.Method,
+		Path:         r.URL.Path,
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		event.SourceIP = host
+	}
+	return event
+}
+
+// tokenFingerprint identifies a bearer token without recording it
+func tokenFingerprint(authorization string) string {
+	token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("sha256:%x", sum[:8])
+}
+
+// auditOutcome maps an HTTP status to an event outcome
+func auditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "denied"
+	case status >= 400:
+		return "error"
+	default:
+		return "ok"
+	}
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+// audited records every state-changing request to an admin handler
+func (fb *FileBox) audited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			next(w, r)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		event := auditEventFor(r, AuditAdmin)
+		event.Status = recorder.status
+		event.Outcome = auditOutcome(recorder.status)
+		fb.audit.record(event)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows && !plan9
+
+// Syslog audit sink for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+// openAuditSyslog connects to the local syslog daemon, or to addr if set
+func openAuditSyslog(addr string) (io.WriteCloser, error) {
+	network := ""
+	if addr != "" {
+		network = "udp"
+		if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+			network, addr = scheme, rest
+		}
+	}
+	return syslog.Dial(network, addr, syslog.LOG_NOTICE|syslog.LOG_AUTH, "filebox-audit")
+}
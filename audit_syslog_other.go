@@ -0,0 +1,17 @@
+//go:build windows || plan9
+
+// Syslog audit sink for FileBox (unsupported platforms)
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// openAuditSyslog reports that syslog is not available on this platform
+func openAuditSyslog(addr string) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog is not supported on this platform; set AUDIT_LOG to a file path")
+}
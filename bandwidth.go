@@ -0,0 +1,358 @@
+// Bandwidth schedules for background transfers in FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replication to peers and container uploads to S3 can be held to a
+// bandwidth schedule so they do not compete with clients during busy
+// hours. A schedule is a list of rules, each a cron-style time spec and a
+// rate; the first rule matching the current minute sets the rate. Outside
+// every rule transfers run at full speed.
+//
+//	TRANSFER_SCHEDULE="* 9-17 * * 1-5 10MB; * 0-6 * * * unlimited; * 22-23 * * * paused"
+
+const (
+	rateUnlimited = -1
+	ratePaused    = 0
+)
+
+// cronSpec - Minutes, hours, days of the month, months and weekdays a
+// rule applies to, as bit sets
+type cronSpec struct {
+	minutes, hours, days, months, weekdays uint64
+}
+
+// parseCronField parses one field: *, a number, a range a-b, any of
+// those with a /step, or a comma-separated list
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeSpec, stepSpec, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepSpec)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", field)
+			}
+			step = n
+		}
+		first, last := lo, hi
+		if rangeSpec != "*" {
+			from, to, isRange := strings.Cut(rangeSpec, "-")
+			var err error
+			if first, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", field)
+			}
+			last = first
+			if isRange {
+				if last, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid range in %q", field)
+				}
+			} else if hasStep {
+				last = hi
+			}
+		}
+		if first < lo || last > hi || first > last {
+			return 0, fmt.Errorf("%q is outside %d-%d", field, lo, hi)
+		}
+		for v := first; v <= last; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// parseCronSpec parses five fields: minute, hour, day of month, month and
+// day of week (0 or 7 is Sunday)
+func parseCronSpec(fields []string) (cronSpec, error) {
+	if len(fields) != 5 {
+		return cronSpec{}, fmt.Errorf("want 5 time fields, got %d", len(fields))
+	}
+	var spec cronSpec
+	var err error
+	bounds := []struct {
+		set    *uint64
+		lo, hi int
+	}{{&spec.minutes, 0, 59}, {&spec.hours, 0, 23}, {&spec.days, 1, 31}, {&spec.months, 1, 12}, {&spec.weekdays, 0, 7}}
+	for i, b := range bounds {
+		if *b.set, err = parseCronField(fields[i], b.lo, b.hi); err != nil {
+			return cronSpec{}, err
+		}
+	}
+	if spec.weekdays&(1<<7) != 0 {
+		spec.weekdays |= 1 // Sunday
+	}
+	return spec, nil
+}
+
+// matches reports whether t falls in the spec; every field must match
+func (s cronSpec) matches(t time.Time) bool {
+	return s.minutes&(1<<uint(t.Minute())) != 0 &&
+		s.hours&(1<<uint(t.Hour())) != 0 &&
+		s.days&(1<<uint(t.Day())) != 0 &&
+		s.months&(1<<uint(t.Month())) != 0 &&
+		s.weekdays&(1<<uint(t.Weekday())) != 0
+}
+
+// scheduleRule - A rate and when it applies
+type scheduleRule struct {
+	spec cronSpec
+	text string
+	rate int64 // Bytes per second, rateUnlimited or ratePaused
+}
+
+// parseSchedule parses rules separated by semicolons. Each rule is five
+// cron fields and a rate: "unlimited", "paused" or bytes per second such
+// as "10MB" (a trailing "/s" is allowed).
+func parseSchedule(text string) ([]scheduleRule, error) {
+	var rules []scheduleRule
+	for _, ruleText := range strings.Split(text, ";") {
+		fields := strings.Fields(ruleText)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("rule %q: want five time fields and a rate", strings.TrimSpace(ruleText))
+		}
+		spec, err := parseCronSpec(fields[:5])
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", strings.TrimSpace(ruleText), err)
+		}
+		rule := scheduleRule{spec: spec, text: strings.Join(fields, " ")}
+		switch rate := strings.TrimSuffix(strings.ToLower(fields[5]), "/s"); rate {
+		case "unlimited":
+			rule.rate = rateUnlimited
+		case "paused":
+			rule.rate = ratePaused
+		default:
+			if rule.rate, err = parseByteSize(rate); err != nil {
+				return nil, fmt.Errorf("rule %q: %v", strings.TrimSpace(ruleText), err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// bandwidthLimiter - Token bucket whose rate follows a schedule. A nil
+// limiter never waits.
+type bandwidthLimiter struct {
+	rules []scheduleRule
+
+	mu     sync.Mutex
+	tokens float64 // May go negative: a large transfer borrows ahead
+	last   time.Time
+
+	bytes  atomic.Int64
+	waited atomic.Int64 // Nanoseconds spent waiting for the schedule
+}
+
+// newBandwidthLimiter reads the schedule for one kind of transfer; nil
+// when there is none
+func newBandwidthLimiter(kind, envVar, fallback string) *bandwidthLimiter {
+	text := getEnvOrDefault(envVar, fallback)
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	rules, err := parseSchedule(text)
+	if err != nil {
+		log.Printf("Ignoring %s: %v", envVar, err)
+		return nil
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	log.Printf("Scheduling %s bandwidth with %d rules", kind, len(rules))
+	return &bandwidthLimiter{rules: rules, last: timeNow()}
+}
+
+// rule returns the rule in force at t, or nil
+func (l *bandwidthLimiter) rule(t time.Time) *scheduleRule {
+	for i := range l.rules {
+		if l.rules[i].spec.matches(t) {
+			return &l.rules[i]
+		}
+	}
+	return nil
+}
+
+// wait blocks until n more bytes may be sent. Paused windows are waited
+// out a minute at a time.
+func (l *bandwidthLimiter) wait(n int64) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.bytes.Add(n)
+	started := timeNow()
+	defer func() { l.waited.Add(int64(timeNow().Sub(started))) }()
+
+	for {
+		l.mu.Lock()
+		now := timeNow()
+		rate := int64(rateUnlimited)
+		if rule := l.rule(now); rule != nil {
+			rate = rule.rate
+		}
+		if rate == rateUnlimited {
+			l.tokens, l.last = 0, now
+			l.mu.Unlock()
+			return
+		}
+		if rate == ratePaused {
+			l.tokens, l.last = 0, now
+			l.mu.Unlock()
+			time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			continue
+		}
+
+		// Up to a second's worth of bytes can build up while idle
+		l.tokens = min(float64(rate), l.tokens+now.Sub(l.last).Seconds()*float64(rate))
+		l.last = now
+		l.tokens -= float64(n)
+		var delay time.Duration
+		if l.tokens < 0 {
+			delay = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+		}
+		l.mu.Unlock()
+		time.Sleep(delay)
+		return
+	}
+}
+
+// throttledFile - A container file read at the limiter's pace. Each byte
+// is charged once, so a client that reads the body twice (to sign it,
+// then to send it) is not slowed down twice.
+type throttledFile struct {
+	io.ReadSeeker
+	limiter *bandwidthLimiter
+	pos     int64
+	charged int64
+}
+
+// reader paces reads from a file; without a schedule it returns the file
+func (l *bandwidthLimiter) reader(file io.ReadSeeker) io.ReadSeeker {
+	if l == nil {
+		return file
+	}
+	return &throttledFile{ReadSeeker: file, limiter: l}
+}
+
+func (f *throttledFile) Read(p []byte) (int, error) {
+	n, err := f.ReadSeeker.Read(p)
+	f.pos += int64(n)
+	if f.pos > f.charged {
+		f.limiter.wait(f.pos - f.charged)
+		f.charged = f.pos
+	}
+	return n, err
+}
+
+func (f *throttledFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.ReadSeeker.Seek(offset, whence)
+	if err == nil {
+		f.pos = pos
+	}
+	return pos, err
+}
+
+// bandwidthSchedules - Limiters for each kind of background transfer
+type bandwidthSchedules struct {
+	replication *bandwidthLimiter
+	upload      *bandwidthLimiter
+}
+
+// loadBandwidthSchedules reads REPLICATION_SCHEDULE and UPLOAD_SCHEDULE,
+// both defaulting to TRANSFER_SCHEDULE
+func loadBandwidthSchedules() *bandwidthSchedules {
+	shared := getEnvOrDefault("TRANSFER_SCHEDULE", "")
+	return &bandwidthSchedules{
+		replication: newBandwidthLimiter("replication", "REPLICATION_SCHEDULE", shared),
+		upload:      newBandwidthLimiter("upload", "UPLOAD_SCHEDULE", shared),
+	}
+}
+
+// BandwidthStatus - A transfer kind's schedule and where it stands now
+type BandwidthStatus struct {
+	Kind          string   `json:"kind"`
+	Scheduled     bool     `json:"scheduled"`
+	Rules         []string `json:"rules,omitempty"`
+	ActiveRule    string   `json:"active_rule,omitempty"`
+	Rate          string   `json:"rate"`                     // "unlimited", "paused" or bytes per second
+	BytesPerSec   int64    `json:"bytes_per_sec,omitempty"`  // Set while limited
+	Bytes         int64    `json:"bytes"`                    // Bytes sent under the schedule
+	WaitedSeconds float64  `json:"waited_seconds,omitempty"` // Time spent held back
+}
+
+// status describes the limiter at t
+func (l *bandwidthLimiter) status(kind string, t time.Time) BandwidthStatus {
+	status := BandwidthStatus{Kind: kind, Rate: "unlimited"}
+	if l == nil {
+		return status
+	}
+	status.Scheduled = true
+	for _, rule := range l.rules {
+		status.Rules = append(status.Rules, rule.text)
+	}
+	if rule := l.rule(t); rule != nil {
+		status.ActiveRule = rule.text
+		switch rule.rate {
+		case rateUnlimited:
+		case ratePaused:
+			status.Rate = "paused"
+		default:
+			status.Rate, status.BytesPerSec = strconv.FormatInt(rule.rate, 10), rule.rate
+		}
+	}
+	status.Bytes = l.bytes.Load()
+	status.WaitedSeconds = time.Duration(l.waited.Load()).Seconds()
+	return status
+}
+
+// bandwidthStatus lists every transfer kind
+func (fb *FileBox) bandwidthStatus() []BandwidthStatus {
+	now := timeNow()
+	return []BandwidthStatus{
+		fb.replicationLimiter().status("replication", now),
+		fb.uploadLimiter().status("upload", now),
+	}
+}
+
+// replicationLimiter returns the replication limiter, or nil
+func (fb *FileBox) replicationLimiter() *bandwidthLimiter {
+	if fb.bandwidth == nil {
+		return nil
+	}
+	return fb.bandwidth.replication
+}
+
+// uploadLimiter returns the S3 upload limiter, or nil
+func (fb *FileBox) uploadLimiter() *bandwidthLimiter {
+	if fb.bandwidth == nil {
+		return nil
+	}
+	return fb.bandwidth.upload
+}
+
+// handleBandwidth serves GET /admin/bandwidth
+func (fb *FileBox) handleBandwidth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.bandwidthStatus())
+}
@@ -0,0 +1,186 @@
+// Load generator for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchStats - Results collected by one kind of operation
+type benchStats struct {
+	latencies []time.Duration
+	bytes     int64
+	errors    int
+}
+
+func (s *benchStats) merge(other *benchStats) {
+	s.latencies = append(s.latencies, other.latencies...)
+	s.bytes += other.bytes
+	s.errors += other.errors
+}
+
+// report prints throughput and latency percentiles
+func (s *benchStats) report(name string, elapsed time.Duration) {
+	if len(s.latencies) == 0 && s.errors == 0 {
+		return
+	}
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if len(s.latencies) == 0 {
+			return 0
+		}
+		return s.latencies[int(float64(len(s.latencies)-1)*p)]
+	}
+
+	seconds := elapsed.Seconds()
+	fmt.Printf("%-6s %8d ops %10.1f ops/s %8.2f MB/s  p50 %-10s p90 %-10s p99 %-10s errors %d\n",
+		name, len(s.latencies), float64(len(s.latencies))/seconds, float64(s.bytes)/seconds/(1<<20),
+		percentile(0.50).Round(time.Microsecond), percentile(0.90).Round(time.Microsecond),
+		percentile(0.99).Round(time.Microsecond), s.errors)
+}
+
+// runBench implements `filebox bench`: concurrent uploads and downloads against a running node
+func runBench(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	server := flags.String("server", "localhost:"+getEnvOrDefault("PORT", "8080"), "FileBox node to load")
+	concurrency := flags.Int("concurrency", 8, "Concurrent clients")
+	size := flags.Int("size", 4096, "Blob size in bytes")
+	duration := flags.Duration("duration", 10*time.Second, "How long to run")
+	reads := flags.Float64("reads", 0, "Fraction of operations that download a blob written earlier (0-1)")
+	tenant := flags.String("tenant", "", "Tenant to write as")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: filebox bench [--server HOST:PORT] [--concurrency N] [--size BYTES] [--duration D] [--reads FRACTION]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 || *concurrency < 1 || *size < 0 || *reads < 0 || *reads > 1 {
+		flags.Usage()
+		return 2
+	}
+
+	baseURL := "http://" + *server
+	blob := make([]byte, *size)
+	rand.Read(blob)
+
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+	}
+
+	var mu sync.Mutex
+	var ids []string
+	writes, downloads := &benchStats{}, &benchStats{}
+
+	deadline := time.Now().Add(*duration)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := mathrand.New(mathrand.NewSource(seed))
+			localWrites, localReads := &benchStats{}, &benchStats{}
+
+			for time.Now().Before(deadline) {
+				mu.Lock()
+				var blobID string
+				if len(ids) > 0 && rng.Float64() < *reads {
+					blobID = ids[rng.Intn(len(ids))]
+				}
+				mu.Unlock()
+
+				opStart := time.Now()
+				if blobID != "" {
+					n, err := benchDownload(client, baseURL, blobID)
+					if err != nil {
+						localReads.errors++
+						continue
+					}
+					localReads.latencies = append(localReads.latencies, time.Since(opStart))
+					localReads.bytes += n
+					continue
+				}
+
+				id, err := benchUpload(client, baseURL, *tenant, blob)
+				if err != nil {
+					localWrites.errors++
+					continue
+				}
+				localWrites.latencies = append(localWrites.latencies, time.Since(opStart))
+				localWrites.bytes += int64(len(blob))
+				mu.Lock()
+				ids = append(ids, id)
+				mu.Unlock()
+			}
+
+			mu.Lock()
+			writes.merge(localWrites)
+			downloads.merge(localReads)
+			mu.Unlock()
+		}(time.Now().UnixNano() + int64(w))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Printf("%d clients, %d byte blobs, %s against %s\n", *concurrency, *size, elapsed.Round(time.Millisecond), *server)
+	writes.report("upload", elapsed)
+	downloads.report("read", elapsed)
+
+	if writes.errors+downloads.errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+func benchUpload(client *http.Client, baseURL, tenant string, blob []byte) (string, error) {
+	req, _ := http.NewRequest("POST", baseURL+"/upload", bytes.NewReader(blob))
+	if tenant != "" {
+		req.Header.Set("X-FileBox-Tenant", tenant)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("upload failed: %s", strings.TrimSpace(string(msg)))
+	}
+	var blobResponse BlobResponse
+	if err := json.NewDecoder(resp.Body).Decode(&blobResponse); err != nil {
+		return "", err
+	}
+	return blobResponse.ID, nil
+}
+
+func benchDownload(client *http.Client, baseURL, blobID string) (int64, error) {
+	resp, err := client.Get(baseURL + "/blob/" + blobID)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return n, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return n, fmt.Errorf("download failed: %s", resp.Status)
+	}
+	return n, nil
+}
@@ -0,0 +1,129 @@
+// Blob metadata updates for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// BlobUpdate - Changes requested with PATCH /blob/{id}
+type BlobUpdate struct {
+	SetTags bool
+	Tags    map[string]string // Replaces every tag; nil removes them all
+	SetTTL  bool
+	TTL     time.Duration // Counted from now; 0 removes the expiry
+}
+
+// BlobUpdateResponse - Response of PATCH /blob/{id}
+type BlobUpdateResponse struct {
+	ID        string            `json:"id"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+}
+
+// UpdateBlob replaces a blob's tags and resets or removes its expiry.
+// Deleted and expired blobs cannot be updated; undelete them first.
+func (fb *FileBox) UpdateBlob(blobID string, update BlobUpdate) (BlobUpdateResponse, error) {
+	containerFile, index, err := fb.findBlob(blobID)
+	if err != nil {
+		return BlobUpdateResponse{}, err
+	}
+	if fb.isForeign(containerFile) {
+		return BlobUpdateResponse{}, &ForeignError{BlobID: blobID, MachineID: containerFile.FID.MachineID}
+	}
+
+	now := timeNow()
+	fb.fileLock.Lock()
+	blob := &containerFile.Blobs[index]
+	switch {
+	case blob.DeletedAt != nil:
+		fb.fileLock.Unlock()
+		return BlobUpdateResponse{}, &DeletedError{BlobID: blobID, DeletedAt: *blob.DeletedAt}
+	case expired(containerFile, *blob, now):
+		fb.fileLock.Unlock()
+		return BlobUpdateResponse{}, &DeletedError{BlobID: blobID, DeletedAt: *blob.ExpiresAt, Expired: true}
+	}
+	if update.SetTags {
+		fb.tagIndex.remove(*blob)
+		blob.Tags = update.Tags
+		fb.tagIndex.add(*blob)
+	}
+	if update.SetTTL {
+		blob.ExpiresAt = nil
+		if update.TTL > 0 {
+			expiresAt := now.Add(update.TTL)
+			blob.ExpiresAt = &expiresAt
+		}
+	}
+	response := BlobUpdateResponse{ID: blob.ID, Tags: blob.Tags, ExpiresAt: blob.ExpiresAt}
+	fb.fileLock.Unlock()
+
+	fb.saveBlobMetadata(containerFile, index)
+	fb.logBlobChange(MetaOpUpdate, containerFile, index)
+	log.Printf("Updated metadata of blob %s", blobID)
+	return response, nil
+}
+
+// blobUpdateFromHeaders reads X-FileBox-Tag and X-FileBox-TTL, writing a
+// 400 if neither is set or the TTL is invalid. An empty X-FileBox-Tag
+// removes every tag; an X-FileBox-TTL of "none" removes the expiry.
+func blobUpdateFromHeaders(w http.ResponseWriter, r *http.Request) (BlobUpdate, bool) {
+	var update BlobUpdate
+	if values := r.Header.Values("X-FileBox-Tag"); len(values) > 0 {
+		update.SetTags, update.Tags = true, parseTagHeaders(values)
+	}
+	if values := r.Header.Values("X-FileBox-TTL"); len(values) > 0 {
+		update.SetTTL = true
+		if values[0] != "none" {
+			d, err := time.ParseDuration(values[0])
+			if err != nil || d <= 0 {
+				http.Error(w, `Invalid X-FileBox-TTL (want a positive duration such as 72h, or "none")`, http.StatusBadRequest)
+				return update, false
+			}
+			update.TTL = d
+		}
+	}
+	if !update.SetTags && !update.SetTTL {
+		http.Error(w, "X-FileBox-Tag or X-FileBox-TTL required", http.StatusBadRequest)
+		return update, false
+	}
+	return update, true
+}
+
+// handleUpdateBlob serves PATCH /blob/{id}
+func (fb *FileBox) handleUpdateBlob(w http.ResponseWriter, r *http.Request, blobID string) {
+	update, ok := blobUpdateFromHeaders(w, r)
+	if !ok {
+		return
+	}
+
+	response, err := fb.UpdateBlob(blobID, update)
+
+	event := auditEventFor(r, AuditUpdate)
+	event.BlobID = blobID
+	event.Detail = fmt.Sprintf("tags=%v ttl=%v", update.SetTags, update.SetTTL)
+	if err != nil {
+		event.Outcome = "error"
+		fb.audit.record(event)
+		switch err.(type) {
+		case *DeletedError:
+			http.Error(w, err.Error(), http.StatusGone)
+		case *ForeignError:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+		return
+	}
+	event.Outcome = "ok"
+	fb.audit.record(event)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
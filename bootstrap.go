@@ -0,0 +1,409 @@
+// Node bootstrap from a peer for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// adoptedMachinesFile lists, relative to the storage directory, the machine
+// IDs whose containers this node took over from a peer
+const adoptedMachinesFile = "node/adopted.json"
+
+// BootstrapRequest - Body of POST /admin/bootstrap
+type BootstrapRequest struct {
+	Peer      string  `json:"peer"`                 // host:port of a healthy peer
+	MachineID *uint32 `json:"machine_id,omitempty"` // Whose containers to pull; defaults to this node's
+}
+
+// BootstrapStatus - Progress of a bootstrap, served by GET /admin/bootstrap
+type BootstrapStatus struct {
+	State      string     `json:"state"` // "running", "done" or "failed"
+	Peer       string     `json:"peer"`
+	MachineID  uint32     `json:"machine_id"`
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Total      int        `json:"total"`   // Containers the peer holds for the machine
+	Skipped    int        `json:"skipped"` // Already present locally
+	Pulled     int        `json:"pulled"`
+	Failed     int        `json:"failed"`
+	TotalBytes int64      `json:"total_bytes"`
+	Bytes      int64      `json:"bytes"` // Pulled so far
+	Errors     []string   `json:"errors,omitempty"`
+}
+
+// bootstrapState - The current or last bootstrap and the adopted machine IDs
+type bootstrapState struct {
+	mu      sync.Mutex
+	status  *BootstrapStatus
+	adopted map[uint32]bool
+	path    string
+}
+
+// loadBootstrapState reads the machine IDs adopted by earlier bootstraps
+func loadBootstrapState(storageDir string) *bootstrapState {
+	state := &bootstrapState{adopted: make(map[uint32]bool), path: filepath.Join(storageDir, adoptedMachinesFile)}
+
+	data, err := os.ReadFile(state.path)
+	if err != nil {
+		return state
+	}
+	var ids []uint32
+	if err := json.Unmarshal(data, &ids); err != nil {
+		log.Printf("Ignoring invalid %s", state.path)
+		return state
+	}
+	for _, id := range ids {
+		state.adopted[id] = true
+	}
+	return state
+}
+
+// running reports whether a bootstrap is in progress
+func (b *bootstrapState) running() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status != nil && b.status.State == "running"
+}
+
+// snapshot returns a copy of the current status, or nil if none ran
+func (b *bootstrapState) snapshot() *BootstrapStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.status == nil {
+		return nil
+	}
+	status := *b.status
+	status.Errors = append([]string(nil), b.status.Errors...)
+	return &status
+}
+
+// update applies a change to the status under the lock
+func (b *bootstrapState) update(fn func(status *BootstrapStatus)) {
+	b.mu.Lock()
+	fn(b.status)
+	b.mu.Unlock()
+}
+
+// adopt records that this node now owns a machine's containers
+func (b *bootstrapState) adopt(machineID uint32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.adopted[machineID] {
+		return nil
+	}
+	b.adopted[machineID] = true
+
+	ids := make([]uint32, 0, len(b.adopted))
+	for id := range b.adopted {
+		ids = append(ids, id)
+	}
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(b.path, data, 0644)
+}
+
+// ownsMachine reports whether containers with this machine ID belong to the node
+func (fb *FileBox) ownsMachine(machineID uint32) bool {
+	if machineID == fb.machineID {
+		return true
+	}
+	fb.bootstrap.mu.Lock()
+	defer fb.bootstrap.mu.Unlock()
+	return fb.bootstrap.adopted[machineID]
+}
+
+// startBootstrap begins pulling a machine's containers from a peer in the background
+func (fb *FileBox) startBootstrap(peer string, machineID uint32) (*BootstrapStatus, error) {
+	fb.bootstrap.mu.Lock()
+	if fb.bootstrap.status != nil && fb.bootstrap.status.State == "running" {
+		fb.bootstrap.mu.Unlock()
+		return nil, fmt.Errorf("a bootstrap from %s is already running", fb.bootstrap.status.Peer)
+	}
+	fb.bootstrap.status = &BootstrapStatus{State: "running", Peer: peer, MachineID: machineID, Started: timeNow().UTC()}
+	fb.bootstrap.mu.Unlock()
+
+	log.Printf("Bootstrapping containers of machine %d from %s; data plane unavailable until done", machineID, peer)
+	go fb.runBootstrap(context.Background(), peer, machineID)
+	return fb.bootstrap.snapshot(), nil
+}
+
+// runBootstrap pulls every container the peer holds for the machine that is
+// missing locally
+func (fb *FileBox) runBootstrap(ctx context.Context, peer string, machineID uint32) {
+	state := "done"
+	defer func() {
+		finished := timeNow().UTC()
+		fb.bootstrap.update(func(status *BootstrapStatus) {
+			status.State, status.Finished = state, &finished
+		})
+		status := fb.bootstrap.snapshot()
+		log.Printf("Bootstrap from %s %s: %d pulled, %d skipped, %d failed (%d bytes)",
+			peer, state, status.Pulled, status.Skipped, status.Failed, status.Bytes)
+	}()
+
+	manifests, err := fb.fetchPeerManifests(ctx, peer, machineID)
+	if err != nil {
+		state = "failed"
+		fb.bootstrap.update(func(status *BootstrapStatus) { status.Errors = append(status.Errors, err.Error()) })
+		return
+	}
+
+	if machineID != fb.machineID {
+		if err := fb.bootstrap.adopt(machineID); err != nil {
+			log.Printf("Error recording adopted machine %d: %v", machineID, err)
+		}
+	}
+
+	var totalBytes int64
+	for _, manifest := range manifests {
+		totalBytes += manifest.Size
+	}
+	fb.bootstrap.update(func(status *BootstrapStatus) { status.Total, status.TotalBytes = len(manifests), totalBytes })
+
+	for _, manifest := range manifests {
+		fileID := manifest.FID.String()
+		fb.fileLock.RLock()
+		_, exists := fb.files.get(fileID)
+		fb.fileLock.RUnlock()
+		if exists {
+			fb.bootstrap.update(func(status *BootstrapStatus) { status.Skipped++ })
+			continue
+		}
+
+		size, err := fb.pullContainer(ctx, peer, manifest)
+		if err != nil {
+			fb.bootstrap.update(func(status *BootstrapStatus) {
+				status.Failed++
+				status.Errors = append(status.Errors, fmt.Sprintf("%s: %v", fileID, err))
+			})
+			continue
+		}
+		fb.bootstrap.update(func(status *BootstrapStatus) {
+			status.Pulled++
+			status.Bytes += size
+		})
+	}
+	if status := fb.bootstrap.snapshot(); status.Failed > 0 {
+		state = "failed"
+	}
+}
+
+// fetchPeerManifests asks a peer for the metadata of its copies of a machine's containers
+func (fb *FileBox) fetchPeerManifests(ctx context.Context, peer string, machineID uint32) ([]*ContainerFile, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/cluster/manifests?machine_id=%d", peer, machineID), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fb.replicaClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("peer %s unreachable: %v", peer, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error listing manifests on %s: status %s", peer, resp.Status)
+	}
+	var manifests []*ContainerFile
+	if err := json.NewDecoder(resp.Body).Decode(&manifests); err != nil {
+		return nil, fmt.Errorf("error decoding manifests from %s: %v", peer, err)
+	}
+	return manifests, nil
+}
+
+// pullContainer downloads one container file from the peer, verifies the
+// blobs the peer indexed, and registers it as a local container
+func (fb *FileBox) pullContainer(ctx context.Context, peer string, manifest *ContainerFile) (int64, error) {
+	fileID := manifest.FID.String()
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/container/%s", peer, fileID), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := fb.replicaClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("fetch failed: %s", body)
+	}
+
+	// Staged on the volume the container goes to so the swap is a rename
+	filePath := fb.newContainerPath(fileID, 0)
+	stagingDir := filepath.Join(fb.volumeRoot(filePath), "bootstrap")
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(stagingDir, fileID+"-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("error staging copy: %v", err)
+	}
+
+	// Blobs the peer indexed, from record headers or from metadata operations, must check out
+	var indexedEnd int64
+	for _, blob := range manifest.Blobs {
+		if blob.Uncommitted || len(blob.Segments) > 0 {
+			continue // Placeholders and composed blobs have no bytes of their own
+		}
+		data := make([]byte, blob.Length)
+		if _, err := tmp.ReadAt(data, blob.Offset); err != nil {
+			return 0, fmt.Errorf("error reading blob %s: %v", blob.ID, err)
+		}
+		if !verifyBlob(blob, data) {
+			return 0, fmt.Errorf("checksum mismatch on blob %s", blob.ID)
+		}
+		indexedEnd = max(indexedEnd, blob.Offset+blob.Length)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return 0, err
+	}
+	fb.mmap.forget(filePath)
+
+	containerFile := manifest
+	containerFile.FilePath = filePath
+	containerFile.Size = indexedEnd
+	containerFile.Uploading = false
+	containerFile.Evicted = false
+	containerFile.Replicated = nil
+	if s := containerFile.OpSequence; s != nil {
+		// Numbering carries on past everything the copy had applied
+		containerFile.OpSequence = &OpSequence{Base: s.Base, Issued: max(s.Issued, s.Applied)}
+	}
+	fb.recordProvenance(containerFile)
+	if containerFile.Blobs == nil {
+		containerFile.Blobs = make([]BlobInfo, 0)
+	}
+	if !containerFile.Encrypted {
+		fb.recoverKeyEscrow(containerFile)
+	}
+	if !fb.hasSizeClass(containerFile.SizeClass) {
+		containerFile.SizeClass = fb.sizeClasses[len(fb.sizeClasses)-1].Name
+	}
+
+	// Rebuild the index entries the peer did not have from record headers
+	fb.adoptTrailingRecords(containerFile, size)
+	if containerFile.Size != size {
+		log.Printf("Container %s has %d unindexed bytes after offset %d (torn write?)", fileID, size-containerFile.Size, containerFile.Size)
+		containerFile.Size = size
+	}
+
+	// Skip a re-upload if S3 already holds the whole container
+	if !containerFile.Uploaded && fb.s3Client != nil {
+		s3Key := fb.containerS3Key(containerFile)
+		head, err := fb.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(fb.bucket),
+			Key:    aws.String(s3Key),
+		})
+		if err == nil && aws.ToInt64(head.ContentLength) == size {
+			containerFile.Uploaded = true
+			containerFile.S3Key = s3Key
+			containerFile.UploadedAt = aws.ToTime(head.LastModified)
+		}
+	}
+
+	fb.fileLock.Lock()
+	fb.registerContainer(containerFile)
+	fb.fileLock.Unlock()
+	fb.saveManifest(containerFile)
+
+	if !containerFile.Uploaded {
+		go fb.uploadContainerFile(fileID, UploadTriggerBootstrap)
+	}
+	return size, nil
+}
+
+// handlePeerManifests serves GET /cluster/manifests?machine_id=N: metadata of
+// the local copies of one machine's containers, for a peer bootstrapping
+func (fb *FileBox) handlePeerManifests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	machineID, err := strconv.ParseUint(r.URL.Query().Get("machine_id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid machine_id", http.StatusBadRequest)
+		return
+	}
+
+	manifests := make([]*ContainerFile, 0)
+	fb.fileLock.RLock()
+	for _, file := range fb.files.all() {
+		// Only containers whose bytes are on disk here can be served
+		if file.FID.MachineID == uint32(machineID) && !file.Evicted && !file.Quarantined {
+			manifests = append(manifests, fb.snapshotContainer(file))
+		}
+	}
+	fb.fileLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifests)
+}
+
+// handleBootstrap serves GET /admin/bootstrap (progress) and POST /admin/bootstrap
+func (fb *FileBox) handleBootstrap(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		status := fb.bootstrap.snapshot()
+		if status == nil {
+			http.Error(w, "No bootstrap has run", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case "POST":
+		var req BootstrapRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Peer == "" {
+			http.Error(w, "Body must be {\"peer\": \"host:port\"}", http.StatusBadRequest)
+			return
+		}
+		machineID := fb.machineID
+		if req.MachineID != nil {
+			machineID = *req.MachineID
+		}
+
+		status, err := fb.startBootstrap(req.Peer, machineID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(status)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
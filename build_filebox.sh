@@ -4,7 +4,7 @@
 echo "Building FileBox (Educational Toy)..."
 
 # Build the binary
-go build -o filebox main.go filebox.go fid.go
+go build -o filebox .
 
 if [ $? -eq 0 ]; then
     echo "✅ FileBox (Educational Toy) built successfully!"
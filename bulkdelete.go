@@ -0,0 +1,174 @@
+// Asynchronous bulk delete for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// defaultBulkDeleteMaxIDs bounds the IDs one POST /blobs/delete may list
+const defaultBulkDeleteMaxIDs = 1000
+
+// bulkDeleteMaxErrors bounds the per-blob errors a job keeps; the rest are only counted
+const bulkDeleteMaxErrors = 100
+
+// BulkDeleteRequest - Body of POST /blobs/delete; exactly one field is set
+type BulkDeleteRequest struct {
+	IDs       []string `json:"ids,omitempty"`
+	KeyPrefix string   `json:"key_prefix,omitempty"` // Deletes the blobs every matching named key points to
+}
+
+// BulkDeleteJob - Progress of a bulk delete, served by GET /jobs/{id}
+type BulkDeleteJob struct {
+	JobInfo
+	KeyPrefix string   `json:"key_prefix,omitempty"`
+	Total     int      `json:"total"`
+	Processed int      `json:"processed"`
+	Deleted   int      `json:"deleted"` // Including blobs that already were
+	Failed    int      `json:"failed"`
+	Errors    []string `json:"errors,omitempty"` // The first bulkDeleteMaxErrors failures
+
+	blobIDs []string
+	audit   AuditEvent // Base event each deletion is audited with
+}
+
+func (j *BulkDeleteJob) progress() (int64, int64) {
+	return int64(j.Processed), int64(j.Total)
+}
+
+// keysWithPrefix returns the blobs named keys starting with prefix point
+// to, from the replicated namespace with consensus
+func (fb *FileBox) keysWithPrefix(prefix string) []string {
+	var blobIDs []string
+	if fb.raft != nil {
+		for _, entry := range fb.raft.fsm.withPrefix(prefix) {
+			blobIDs = append(blobIDs, entry.BlobID)
+		}
+	} else {
+		fb.fileLock.RLock()
+		for key, blobID := range fb.keys {
+			if strings.HasPrefix(key, prefix) {
+				blobIDs = append(blobIDs, blobID)
+			}
+		}
+		fb.fileLock.RUnlock()
+	}
+	sort.Strings(blobIDs)
+	return blobIDs
+}
+
+// startBulkDelete validates a request and deletes its blobs in the background
+func (fb *FileBox) startBulkDelete(req BulkDeleteRequest, audit AuditEvent) (*BulkDeleteJob, error) {
+	maxIDs := fb.maxBulkDelete
+	if maxIDs <= 0 {
+		maxIDs = defaultBulkDeleteMaxIDs
+	}
+
+	var blobIDs []string
+	switch {
+	case len(req.IDs) > 0 && req.KeyPrefix != "":
+		return nil, fmt.Errorf("set either ids or key_prefix, not both")
+	case len(req.IDs) > maxIDs:
+		return nil, fmt.Errorf("%d ids exceed the limit of %d per request", len(req.IDs), maxIDs)
+	case len(req.IDs) > 0:
+		seen := make(map[string]bool, len(req.IDs))
+		for _, blobID := range req.IDs {
+			if _, _, err := parseBlobID(blobID); err != nil {
+				return nil, err
+			}
+			if !seen[blobID] {
+				seen[blobID] = true
+				blobIDs = append(blobIDs, blobID)
+			}
+		}
+	case req.KeyPrefix != "":
+		blobIDs = fb.keysWithPrefix(req.KeyPrefix)
+	default:
+		return nil, fmt.Errorf("ids or key_prefix is required")
+	}
+
+	job := &BulkDeleteJob{KeyPrefix: req.KeyPrefix, Total: len(blobIDs), blobIDs: blobIDs, audit: audit}
+	fb.jobs.submit(JobBulkDelete, job, func(ctx context.Context) error {
+		return fb.runBulkDelete(ctx, job)
+	})
+	return job, nil
+}
+
+// runBulkDelete moves every blob of a job to the trash, one at a time
+func (fb *FileBox) runBulkDelete(ctx context.Context, job *BulkDeleteJob) error {
+	for _, blobID := range job.blobIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := fb.DeleteBlob(blobID)
+
+		event := job.audit
+		event.BlobID, event.Outcome = blobID, "ok"
+		if err != nil {
+			event.Outcome, event.Detail = "error", strings.TrimSpace(event.Detail+" "+err.Error())
+		}
+		fb.audit.record(event)
+
+		fb.jobs.mu.Lock()
+		job.Processed++
+		if err != nil {
+			job.Failed++
+			if len(job.Errors) < bulkDeleteMaxErrors {
+				job.Errors = append(job.Errors, fmt.Sprintf("%s: %v", blobID, err))
+			}
+		} else {
+			job.Deleted++
+		}
+		fb.jobs.mu.Unlock()
+	}
+
+	fb.jobs.mu.Lock()
+	defer fb.jobs.mu.Unlock()
+	log.Printf("Bulk delete %s finished: %d of %d blobs deleted, %d failed", job.ID, job.Deleted, job.Total, job.Failed)
+	if job.Failed > 0 {
+		return fmt.Errorf("%d of %d blobs failed to delete", job.Failed, job.Total)
+	}
+	return nil
+}
+
+// handleBulkDelete serves POST /blobs/delete
+func (fb *FileBox) handleBulkDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req BulkDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid bulk delete request", http.StatusBadRequest)
+		return
+	}
+
+	audit := auditEventFor(r, AuditDelete)
+	audit.Detail = "bulk delete"
+	if req.KeyPrefix != "" {
+		audit.Detail += " of key prefix " + req.KeyPrefix
+	}
+	job, err := fb.startBulkDelete(req, audit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	fb.jobs.writeJob(w, http.StatusAccepted, job)
+}
+
+// handleJobs serves GET (progress) and DELETE (cancel) /jobs/{id} for bulk
+// deletes; other jobs are only visible through /admin/jobs
+func (fb *FileBox) handleJobs(w http.ResponseWriter, r *http.Request) {
+	fb.jobs.serveJob(w, r, r.URL.Path[len("/jobs/"):], JobBulkDelete)
+}
@@ -0,0 +1,147 @@
+// Read cache for S3-served blobs in FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+)
+
+// CacheStats - Occupancy and effectiveness of the blob cache
+type CacheStats struct {
+	Capacity int64 `json:"capacity_bytes"`
+	Bytes    int64 `json:"bytes"`
+	Entries  int   `json:"entries"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	Admitted int64 `json:"admitted"`
+	Rejected int64 `json:"rejected"` // Misses not cached because the blob was not warm yet
+}
+
+// blobCache - LRU cache of blob data read from S3. Only blobs that have
+// already been read minAccesses times are admitted, so one-off reads (a
+// restore, an export) do not push out the working set.
+type blobCache struct {
+	capacity    int64
+	minAccesses int64
+
+	mu      sync.Mutex
+	lru     *list.List // Front is most recently used
+	entries map[string]*list.Element
+	stat    CacheStats
+}
+
+// cacheEntry - One cached blob
+type cacheEntry struct {
+	blobID string
+	data   []byte
+}
+
+// loadBlobCache reads BLOB_CACHE_BYTES (0 disables the cache) and CACHE_ADMIT_MIN_ACCESSES
+func loadBlobCache() *blobCache {
+	capacity := getEnvInt("BLOB_CACHE_BYTES", 0)
+	cache := &blobCache{
+		capacity:    capacity,
+		minAccesses: getEnvInt("CACHE_ADMIT_MIN_ACCESSES", 1),
+		lru:         list.New(),
+		entries:     make(map[string]*list.Element),
+		stat:        CacheStats{Capacity: capacity},
+	}
+	if capacity > 0 {
+		log.Printf("Caching warm S3 blobs: %d bytes, admitted after %d reads", capacity, cache.minAccesses)
+	}
+	return cache
+}
+
+// get returns a cached blob and marks it recently used
+func (c *blobCache) get(blobID string) ([]byte, bool) {
+	if c.capacity <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[blobID]
+	if !ok {
+		c.stat.Misses++
+		return nil, false
+	}
+	c.stat.Hits++
+	c.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry).data, true
+}
+
+// admit caches a blob if it has been read often enough, evicting the least
+// recently used entries to make room
+func (c *blobCache) admit(blobID string, data []byte, accesses int64) {
+	if c.capacity <= 0 || int64(len(data)) > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if accesses < c.minAccesses {
+		c.stat.Rejected++
+		return
+	}
+	c.insert(blobID, data)
+}
+
+// prefetched caches a blob read ahead of a sequential reader, bypassing
+// admission: the reader is expected to ask for it shortly
+func (c *blobCache) prefetched(blobID string, data []byte) {
+	if c.capacity <= 0 || int64(len(data)) > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.insert(blobID, data)
+}
+
+// insert adds an entry, evicting the least recently used ones to make room.
+// Callers must hold c.mu.
+func (c *blobCache) insert(blobID string, data []byte) {
+	if _, ok := c.entries[blobID]; ok {
+		return
+	}
+
+	for c.stat.Bytes+int64(len(data)) > c.capacity {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*cacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.blobID)
+		c.stat.Bytes -= int64(len(entry.data))
+	}
+	c.entries[blobID] = c.lru.PushFront(&cacheEntry{blobID: blobID, data: data})
+	c.stat.Bytes += int64(len(data))
+	c.stat.Admitted++
+}
+
+// stats returns a copy of the cache counters
+func (c *blobCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stat
+	stats.Entries = len(c.entries)
+	return stats
+}
+
+// readBlobThroughCache serves an S3 read from the cache, admitting the blob
+// on a miss if it is warm
+func (fb *FileBox) readBlobThroughCache(ctx context.Context, containerFile *ContainerFile, blobInfo BlobInfo) ([]byte, error) {
+	if data, ok := fb.cache.get(blobInfo.ID); ok {
+		return data, nil
+	}
+
+	data, err := fb.readBlobFromS3(ctx, containerFile, blobInfo)
+	if err != nil {
+		return nil, err
+	}
+	fb.cache.admit(blobInfo.ID, data, fb.access.stats(blobInfo).AccessCount)
+	return data, nil
+}
@@ -0,0 +1,252 @@
+// Background metadata checkpoints for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCheckpointInterval = 10 * time.Minute
+	checkpointDirName         = "checkpoint"
+	checkpointFileName        = "metadata.tar.gz"
+
+	// Manifests written this close to a checkpoint may hold changes it missed,
+	// given coarse file modification times
+	checkpointClockMargin = time.Second
+)
+
+// errCheckpointRunning is returned when a checkpoint is requested while one is being written
+var errCheckpointRunning = errors.New("checkpoint already running")
+
+// CheckpointReport - Outcome of one metadata checkpoint
+type CheckpointReport struct {
+	Started      time.Time     `json:"started"`
+	Duration     time.Duration `json:"duration"`
+	Containers   int           `json:"containers"`
+	Blobs        int           `json:"blobs"`
+	Bytes        int64         `json:"bytes"`               // Size of the checkpoint file
+	LogTruncated int64         `json:"log_bytes_truncated"` // Freed by the metadata store's Compact
+	LogError     string        `json:"log_error,omitempty"` // Compact failed; the checkpoint itself was written
+}
+
+// CheckpointStatus - Response of GET /admin/checkpoint
+type CheckpointStatus struct {
+	Interval time.Duration     `json:"interval"` // 0 when scheduled checkpoints are off
+	Path     string            `json:"path"`
+	Last     *CheckpointReport `json:"last,omitempty"`
+}
+
+// checkpointState - Serializes checkpoints and keeps the last report
+type checkpointState struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	running bool
+	last    *CheckpointReport
+}
+
+// loadCheckpointInterval reads CHECKPOINT_INTERVAL
+func loadCheckpointInterval() time.Duration {
+	interval := getEnvDuration("CHECKPOINT_INTERVAL", defaultCheckpointInterval)
+	if interval < 0 {
+		log.Printf("Invalid CHECKPOINT_INTERVAL %v, using %v", interval, defaultCheckpointInterval)
+		interval = defaultCheckpointInterval
+	}
+	return interval
+}
+
+// checkpointPath returns where a node's metadata checkpoint is kept
+func checkpointPath(storageDir string) string {
+	return filepath.Join(storageDir, checkpointDirName, checkpointFileName)
+}
+
+// runCheckpoints writes a checkpoint every CHECKPOINT_INTERVAL
+func (fb *FileBox) runCheckpoints() {
+	if fb.checkpoint.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(fb.checkpoint.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report, err := fb.writeCheckpoint()
+		if err != nil {
+			log.Printf("Error writing metadata checkpoint: %v", err)
+			continue
+		}
+		report.log()
+	}
+}
+
+// writeCheckpoint copies all container metadata into the checkpoint file,
+// replacing the previous one atomically, then lets the metadata store
+// truncate what the checkpoint now covers
+func (fb *FileBox) writeCheckpoint() (*CheckpointReport, error) {
+	fb.checkpoint.mu.Lock()
+	if fb.checkpoint.running {
+		fb.checkpoint.mu.Unlock()
+		return nil, errCheckpointRunning
+	}
+	fb.checkpoint.running = true
+	fb.checkpoint.mu.Unlock()
+	defer func() {
+		fb.checkpoint.mu.Lock()
+		fb.checkpoint.running = false
+		fb.checkpoint.mu.Unlock()
+	}()
+
+	report := &CheckpointReport{Started: timeNow().UTC()}
+	containers, copiedAt := fb.snapshotContainers()
+	report.Containers = len(containers)
+	for _, c := range containers {
+		report.Blobs += len(c.Blobs)
+	}
+
+	path := checkpointPath(fb.storageDir)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := fb.writeSnapshot(tmp, containers, copiedAt); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if info, err := tmp.Stat(); err == nil {
+		report.Bytes = info.Size()
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	// Only truncate once the checkpoint is durable
+	fb.manifestLock.Lock()
+	freed, err := fb.meta.Compact()
+	fb.manifestLock.Unlock()
+	report.LogTruncated = freed
+	if err != nil {
+		report.LogError = err.Error()
+	}
+
+	report.Duration = timeNow().Sub(report.Started)
+	fb.checkpoint.mu.Lock()
+	fb.checkpoint.last = report
+	fb.checkpoint.mu.Unlock()
+	return report, nil
+}
+
+// log summarizes a checkpoint
+func (r *CheckpointReport) log() {
+	log.Printf("Metadata checkpoint: %d containers, %d blobs, %d bytes in %s; %d log bytes truncated",
+		r.Containers, r.Blobs, r.Bytes, r.Duration, r.LogTruncated)
+	if r.LogError != "" {
+		log.Printf("Metadata checkpoint: error truncating the metadata store: %s", r.LogError)
+	}
+}
+
+// savedAtReporter - Implemented by metadata stores that can tell when a
+// container's metadata was last written
+type savedAtReporter interface {
+	SavedAt(fileID string) (time.Time, bool)
+}
+
+// checkpointedContainers returns, by file ID, the containers of the last
+// checkpoint whose stored metadata has not been written since, so recovery
+// can take them from the checkpoint instead of loading each one. Only stores
+// that can date their writes qualify; the database backends load quickly
+// anyway once their log is truncated.
+func (fb *FileBox) checkpointedContainers() map[string]*ContainerFile {
+	store, ok := fb.meta.(savedAtReporter)
+	if !ok {
+		return nil
+	}
+	file, err := os.Open(checkpointPath(fb.storageDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error opening metadata checkpoint: %v", err)
+		return nil
+	}
+	defer file.Close()
+
+	header, containers, err := readSnapshot(file)
+	if err != nil {
+		log.Printf("Ignoring unreadable metadata checkpoint: %v", err)
+		return nil
+	}
+	if header.CopiedAt.IsZero() {
+		return nil
+	}
+
+	cutoff := header.CopiedAt.Add(-checkpointClockMargin)
+	checkpointed := make(map[string]*ContainerFile, len(containers))
+	for _, c := range containers {
+		fileID := c.FID.String()
+		if savedAt, ok := store.SavedAt(fileID); ok && savedAt.Before(cutoff) {
+			checkpointed[fileID] = c
+		}
+	}
+	return checkpointed
+}
+
+// handleCheckpoint reports the last checkpoint (GET) or writes one now (POST /admin/checkpoint)
+func (fb *FileBox) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		fb.checkpoint.mu.Lock()
+		status := CheckpointStatus{
+			Interval: fb.checkpoint.interval,
+			Path:     checkpointPath(fb.storageDir),
+			Last:     fb.checkpoint.last,
+		}
+		fb.checkpoint.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case "POST":
+		report, err := fb.writeCheckpoint()
+		if err == errCheckpointRunning {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		report.log()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,273 @@
+// Clock skew detection and hybrid logical clock for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// timeNow reads the wall clock. `filebox simulate` swaps in a virtual clock
+// so that a simulated cluster's history does not depend on when it runs.
+var timeNow = time.Now
+
+// hybridClock - Hybrid logical clock for FID timestamps. The timestamp never
+// goes backwards, even if the wall clock does, and follows timestamps seen
+// from peers so FIDs created after a replicated container sort after it.
+type hybridClock struct {
+	mu       sync.Mutex
+	last     int64  // Unix seconds of the last timestamp handed out or observed
+	logical  uint32 // Counter within that second
+	maxAhead int64  // Observed timestamps further ahead of the wall clock are ignored
+	path     string // Where the high-water mark is persisted; empty keeps it in memory only
+}
+
+// fidClock issues the timestamp and sequence of every new FID
+var fidClock = &hybridClock{maxAhead: 3600}
+
+// fidClockFile keeps the last timestamp and sequence handed out, relative to
+// the storage directory, so a restart within the same second cannot reissue a FID
+const fidClockFile = "node/fid.json"
+
+// fidHighWater - The persisted state of the FID clock
+type fidHighWater struct {
+	Timestamp int64  `json:"timestamp"`
+	Sequence  uint32 `json:"sequence"`
+}
+
+// restore resumes the clock from the high-water mark saved in the storage
+// directory. Without one (first start, or lost with the node directory) the
+// timestamp is bumped a second past now, since FIDs from the current second
+// may already exist. The clock never moves back: nodes simulated in one
+// process share it.
+func (c *hybridClock) restore(storageDir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.path = filepath.Join(storageDir, fidClockFile)
+	data, err := os.ReadFile(c.path)
+	var saved fidHighWater
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Ignoring invalid %s: %v", c.path, err)
+		}
+		if bumped := timeNow().Unix() + 1; bumped > c.last {
+			c.last, c.logical = bumped, 0
+		}
+		return
+	}
+
+	if saved.Timestamp > c.last || (saved.Timestamp == c.last && saved.Sequence > c.logical) {
+		c.last, c.logical = saved.Timestamp, saved.Sequence
+	}
+}
+
+// advance moves the clock past a FID this machine issued before, such as one
+// found on disk at startup
+func (c *hybridClock) advance(timestamp int64, sequence uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if timestamp > timeNow().Unix()+c.maxAhead {
+		return
+	}
+	if timestamp > c.last || (timestamp == c.last && sequence > c.logical) {
+		c.last, c.logical = timestamp, sequence
+	}
+}
+
+// now returns the next (timestamp, sequence) pair, persisting it before it is used
+func (c *hybridClock) now() (int64, uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if physical := timeNow().Unix(); physical > c.last {
+		c.last, c.logical = physical, 0
+	}
+	c.logical++
+	if err := c.persist(); err != nil {
+		log.Printf("Error saving FID clock to %s: %v", c.path, err)
+	}
+	return c.last, c.logical
+}
+
+// persist writes the high-water mark; the caller must hold mu
+func (c *hybridClock) persist() error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(fidHighWater{Timestamp: c.last, Sequence: c.logical})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename so a crash never leaves a partial file
+	tmpPath := c.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.path)
+}
+
+// observe advances the clock to a timestamp seen from a peer
+func (c *hybridClock) observe(timestamp int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if timestamp > c.last && timestamp <= timeNow().Unix()+c.maxAhead {
+		c.last, c.logical = timestamp, 0
+	}
+}
+
+// PeerClock - Last clock comparison with one replica
+type PeerClock struct {
+	Host      string        `json:"host"`
+	Skew      time.Duration `json:"skew"` // Peer clock minus ours; positive means the peer is ahead
+	RTT       time.Duration `json:"rtt"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// ClockStatus - Response of GET /admin/clock
+type ClockStatus struct {
+	WarnSkew      time.Duration `json:"warn_skew"`
+	MaxSkew       time.Duration `json:"max_skew"` // 0 never refuses writes
+	RefusesWrites bool          `json:"refuses_writes"`
+	Peers         []PeerClock   `json:"peers"`
+}
+
+// clockMonitor - Periodically compares clocks with every replica
+type clockMonitor struct {
+	warn     time.Duration
+	max      time.Duration
+	interval time.Duration
+
+	mu    sync.Mutex
+	peers map[string]PeerClock
+}
+
+// loadClockMonitor reads CLOCK_SKEW_WARN, CLOCK_SKEW_MAX and CLOCK_SKEW_CHECK_INTERVAL
+func loadClockMonitor() *clockMonitor {
+	return &clockMonitor{
+		warn:     getEnvDuration("CLOCK_SKEW_WARN", time.Second),
+		max:      getEnvDuration("CLOCK_SKEW_MAX", 0),
+		interval: getEnvDuration("CLOCK_SKEW_CHECK_INTERVAL", time.Minute),
+		peers:    make(map[string]PeerClock),
+	}
+}
+
+// refusesWrites reports whether any reachable peer is skewed beyond the maximum
+func (m *clockMonitor) refusesWrites() bool {
+	if m.max <= 0 {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, peer := range m.peers {
+		if peer.Error == "" && peer.Skew.Abs() > m.max {
+			return true
+		}
+	}
+	return false
+}
+
+// runClockChecks compares clocks with the replicas at startup and then periodically
+func (fb *FileBox) runClockChecks() {
+	if len(fb.replicas) == 0 || fb.clock.interval <= 0 {
+		return
+	}
+
+	fb.checkClocks()
+	ticker := time.NewTicker(fb.clock.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fb.checkClocks()
+	}
+}
+
+// checkClocks measures the skew to every replica
+func (fb *FileBox) checkClocks() {
+	for _, replica := range fb.replicas {
+		peer := fb.measureSkew(replica)
+
+		fb.clock.mu.Lock()
+		previous, seen := fb.clock.peers[replica]
+		fb.clock.peers[replica] = peer
+		fb.clock.mu.Unlock()
+
+		if peer.Error != "" {
+			continue
+		}
+		wasSkewed := seen && previous.Error == "" && previous.Skew.Abs() > fb.clock.warn
+		switch {
+		case fb.clock.max > 0 && peer.Skew.Abs() > fb.clock.max:
+			log.Printf("ERROR: clock of %s is %v off ours (max %v); refusing writes", replica, peer.Skew, fb.clock.max)
+		case peer.Skew.Abs() > fb.clock.warn:
+			log.Printf("WARNING: clock of %s is %v off ours (warn at %v)", replica, peer.Skew, fb.clock.warn)
+		case wasSkewed:
+			log.Printf("Clock of %s is back within %v of ours", replica, fb.clock.warn)
+		}
+	}
+}
+
+// measureSkew asks a peer for its time and estimates the offset from the
+// midpoint of the round trip
+func (fb *FileBox) measureSkew(replica string) PeerClock {
+	peer := PeerClock{Host: replica, CheckedAt: timeNow().UTC()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sent := timeNow()
+	var identity NodeIdentity
+	if err := fb.getPeerJSON(ctx, replica, "/cluster/identity", &identity); err != nil {
+		peer.Error = err.Error()
+		return peer
+	}
+	received := timeNow()
+
+	peer.RTT = received.Sub(sent)
+	peer.Skew = identity.Time.Sub(sent.Add(peer.RTT/2 + fb.faults.clockSkew()))
+	fidClock.observe(identity.Time.Unix())
+	return peer
+}
+
+// handleClock serves GET /admin/clock
+func (fb *FileBox) handleClock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := ClockStatus{
+		WarnSkew:      fb.clock.warn,
+		MaxSkew:       fb.clock.max,
+		RefusesWrites: fb.clock.refusesWrites(),
+		Peers:         make([]PeerClock, 0, len(fb.replicas)),
+	}
+	fb.clock.mu.Lock()
+	for _, replica := range fb.replicas {
+		if peer, ok := fb.clock.peers[replica]; ok {
+			status.Peers = append(status.Peers, peer)
+		}
+	}
+	fb.clock.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
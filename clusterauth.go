@@ -0,0 +1,232 @@
+// Cluster peer authentication for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers carrying a peer request signature
+const (
+	clusterTimestampHeader = "X-FileBox-Timestamp"
+	clusterSignatureHeader = "X-FileBox-Signature"
+)
+
+// ClusterAuthConfig - Who may call peer-only endpoints such as /replicate
+type ClusterAuthConfig struct {
+	Secret       []byte       // Shared cluster secret; requests must be signed with it when set
+	AllowedNets  []*net.IPNet // Source networks allowed to call peer endpoints; empty allows any
+	MaxClockSkew time.Duration
+}
+
+// loadClusterAuthConfig reads CLUSTER_SECRET, CLUSTER_ALLOWED_CIDRS and CLUSTER_MAX_CLOCK_SKEW
+func loadClusterAuthConfig() (ClusterAuthConfig, error) {
+	config := ClusterAuthConfig{
+		Secret:       []byte(os.Getenv("CLUSTER_SECRET")),
+		MaxClockSkew: getEnvDuration("CLUSTER_MAX_CLOCK_SKEW", 5*time.Minute),
+	}
+
+	// An allowlist with a typo must not silently turn into "allow everyone"
+	for _, entry := range strings.Split(os.Getenv("CLUSTER_ALLOWED_CIDRS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cidr := entry
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return ClusterAuthConfig{}, fmt.Errorf("invalid CLUSTER_ALLOWED_CIDRS entry %q: %v", entry, err)
+		}
+		config.AllowedNets = append(config.AllowedNets, ipNet)
+	}
+
+	if len(config.Secret) == 0 && len(config.AllowedNets) == 0 {
+		log.Printf("WARNING: CLUSTER_SECRET and CLUSTER_ALLOWED_CIDRS are unset; /replicate accepts writes from anyone")
+	}
+	return config, nil
+}
+
+// signClusterRequest computes the signature over the request line, timestamp and body
+func signClusterRequest(secret []byte, method, target, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%x", method, target, timestamp, bodyHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedTarget is the part of a request URL a signature covers: the path
+// and the query, which several peer endpoints take parameters from
+func signedTarget(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	return u.Path + "?" + u.RawQuery
+}
+
+// clusterTransport signs outgoing peer requests with the cluster secret
+type clusterTransport struct {
+	secret []byte
+	base   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *clusterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.GetBody != nil {
+		reader, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		body, err = io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// RoundTrippers must not modify the caller's request
+	signed := req.Clone(req.Context())
+	if req.GetBody != nil {
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	timestamp := strconv.FormatInt(timeNow().Unix(), 10)
+	signed.Header.Set(clusterTimestampHeader, timestamp)
+	signed.Header.Set(clusterSignatureHeader, signClusterRequest(t.secret, req.Method, signedTarget(req.URL), timestamp, body))
+	return t.base.RoundTrip(signed)
+}
+
+// newReplicaClient builds the HTTP client used to talk to peers
+func newReplicaClient(auth ClusterAuthConfig) *http.Client {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if len(auth.Secret) > 0 {
+		client.Transport = &clusterTransport{secret: auth.Secret, base: http.DefaultTransport}
+	}
+	return client
+}
+
+// requireClusterPeer rejects requests that do not come from an allowed,
+// authenticated cluster member before passing them to next
+func (fb *FileBox) requireClusterPeer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !fb.clusterAuth.allowsAddr(r.RemoteAddr) {
+			log.Printf("Rejected peer request to %s from %s: source not allowed", r.URL.Path, r.RemoteAddr)
+			fb.auditPeerDenied(r, "source not allowed")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if len(fb.clusterAuth.Secret) > 0 {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "Error reading request", http.StatusBadRequest)
+				return
+			}
+			if err := fb.clusterAuth.verify(r, body); err != nil {
+				log.Printf("Rejected peer request to %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+				fb.auditPeerDenied(r, err.Error())
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		next(w, r)
+	}
+}
+
+// registerClusterHandlers adds the peer-only endpoints to mux
+func (fb *FileBox) registerClusterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/replicate", fb.requireClusterPeer(requireProtocol(fb.handleReplicate)))
+	mux.HandleFunc("/container/", fb.requireClusterPeer(fb.handleContainerData))
+	mux.HandleFunc("/cluster/containers", fb.requireClusterPeer(fb.handleClusterContainers))
+	mux.HandleFunc("/cluster/manifests", fb.requireClusterPeer(fb.handlePeerManifests))
+	mux.HandleFunc("/cluster/identity", fb.requireClusterPeer(fb.handleClusterIdentity))
+	mux.HandleFunc("/cluster/expired", fb.requireClusterPeer(fb.handleClusterExpired))
+	mux.HandleFunc("/cluster/hello", fb.requireClusterPeer(fb.handleClusterHello))
+	mux.HandleFunc("/cluster/metadata-ops", fb.requireClusterPeer(requireProtocol(fb.handleClusterMetadataOps)))
+	mux.HandleFunc("/cluster/op-sequence/", fb.requireClusterPeer(fb.handleClusterOpSequence))
+	mux.HandleFunc("/cluster/locate/", fb.requireClusterPeer(fb.handleClusterLocate))
+	mux.HandleFunc("/cluster/raft/apply", fb.requireClusterPeer(fb.handleClusterRaftApply))
+	mux.HandleFunc("/cluster/raft/key/", fb.requireClusterPeer(fb.handleClusterRaftKey))
+}
+
+// allowsAddr reports whether a request's remote address is in the allowlist
+func (c ClusterAuthConfig) allowsAddr(remoteAddr string) bool {
+	if len(c.AllowedNets) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range c.AllowedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks a peer request's timestamp and signature
+func (c ClusterAuthConfig) verify(r *http.Request, body []byte) error {
+	return c.verifySignature(r.Method, signedTarget(r.URL), r.Header.Get(clusterTimestampHeader), r.Header.Get(clusterSignatureHeader), body)
+}
+
+// verifySignature checks a signed timestamp and signature over a request line and body
+func (c ClusterAuthConfig) verifySignature(method, target, timestamp, signature string, body []byte) error {
+	if timestamp == "" || signature == "" {
+		return fmt.Errorf("missing signature")
+	}
+
+	// Bound how long a captured request can be replayed
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+	skew := timeNow().Sub(time.Unix(seconds, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > c.MaxClockSkew {
+		return fmt.Errorf("timestamp outside allowed clock skew (%v)", skew.Round(time.Second))
+	}
+
+	expected := signClusterRequest(c.Secret, method, target, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+// auditPeerDenied records a rejected peer request
+func (fb *FileBox) auditPeerDenied(r *http.Request, reason string) {
+	event := auditEventFor(r, AuditPeerDeny)
+	event.Outcome, event.Detail = "denied", reason
+	fb.audit.record(event)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestClusterSignatureCoversQuery replays a signed peer request with its
+// query changed and expects the signature to be refused
+func TestClusterSignatureCoversQuery(t *testing.T) {
+	auth := ClusterAuthConfig{Secret: []byte("test secret"), MaxClockSkew: time.Minute}
+
+	var captured *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := auth.verify(r, body); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		captured = r.Clone(r.Context())
+	}))
+	defer server.Close()
+
+	client := newReplicaClient(auth)
+	resp, err := client.Get(server.URL + "/cluster/manifests?machine_id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || captured == nil {
+		t.Fatalf("signed request got %d, want 200", resp.StatusCode)
+	}
+	if err := auth.verify(captured, nil); err != nil {
+		t.Fatalf("replaying the request unchanged: %v", err)
+	}
+
+	tampered := captured.Clone(captured.Context())
+	tampered.URL.RawQuery = "machine_id=2"
+	if err := auth.verify(tampered, nil); err == nil {
+		t.Error("a request whose query was changed after signing was accepted")
+	}
+	tampered.URL.RawQuery = ""
+	if err := auth.verify(tampered, nil); err == nil {
+		t.Error("a request whose query was dropped after signing was accepted")
+	}
+}
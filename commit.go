@@ -0,0 +1,110 @@
+// Atomic blob visibility for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"log"
+	"os"
+
+	"filebox/pkg/containerformat"
+)
+
+// An upload becomes visible in two steps. Its ID is reserved together with
+// its record's range, as an uncommitted index entry; once the record is
+// written (and fsynced, when configured) the entry is filled in. Readers
+// treat uncommitted entries as absent. Only after replicas have
+// acknowledged is the entry's index record written with the commit flag,
+// and only once that write returns does the blob become readable, keyed
+// and searchable. A reader therefore never sees a blob whose data or index
+// record could still be lost, and an upload that fails part way leaves
+// nothing readable behind.
+
+// reserveBlob fills in the uncommitted index entry reserved along with a
+// record just written, setting the blob's ID
+func (fb *FileBox) reserveBlob(containerFile *ContainerFile, index int, blobInfo *BlobInfo) {
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+	mu := fb.files.lock(containerFile)
+	mu.Lock()
+	defer mu.Unlock()
+	blobInfo.ID = formatBlobID(containerFile.FID.String(), index)
+	blobInfo.Uncommitted = true
+	containerFile.Blobs[index] = *blobInfo
+}
+
+// commitBlob writes a reserved entry's index record with the commit flag
+// set, then makes the blob visible. In sync mode a failed write leaves the
+// entry uncommitted and returns the error; in async mode it is logged.
+func (fb *FileBox) commitBlob(containerFile *ContainerFile, index int) error {
+	fb.manifestLock.Lock()
+	defer fb.manifestLock.Unlock()
+
+	fb.fileLock.RLock()
+	snapshot := fb.snapshotContainer(containerFile)
+	fb.fileLock.RUnlock()
+	snapshot.Blobs[index].Uncommitted = false
+	if err := fb.meta.SaveContainer(snapshot); err != nil {
+		if fb.durability.Mode == DurabilityModeSync {
+			return err
+		}
+		log.Printf("Error saving manifest for %s: %v", containerFile.FID.String(), err)
+	}
+
+	// Still under manifestLock, so no later save writes the entry back uncommitted
+	fb.fileLock.Lock()
+	blob := &containerFile.Blobs[index]
+	blob.Uncommitted = false
+	if blob.Key != "" {
+		fb.keys[blob.Key] = blob.ID
+	}
+	fb.tagIndex.add(*blob)
+	fb.noteChunk(containerFile, *blob)
+	fb.fileLock.Unlock()
+
+	fb.logBlobChange(MetaOpCommit, containerFile, index)
+	return nil
+}
+
+// recoverUncommitted settles the entries a crash left uncommitted. One
+// whose record is complete on disk is committed, like a record replayed
+// from past the manifest; the rest stay invisible. It returns how many were
+// committed and the IDs of the others. Callers must not hold fb.fileLock;
+// the container must not be receiving writes.
+func (fb *FileBox) recoverUncommitted(containerFile *ContainerFile, fileSize int64) (int, []string) {
+	var pending []int
+	for i, blob := range containerFile.Blobs {
+		if blob.Uncommitted {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	committed := 0
+	var aborted []string
+	file, err := os.Open(containerFile.FilePath)
+	if err != nil {
+		log.Printf("Error checking uncommitted blobs of %s: %v", containerFile.FID.String(), err)
+	} else {
+		defer file.Close()
+	}
+	reader := containerformat.NewReader(file, fileSize)
+
+	fb.fileLock.Lock()
+	defer fb.fileLock.Unlock()
+	for _, i := range pending {
+		blob := &containerFile.Blobs[i]
+		if err == nil {
+			if rec, _, recErr := reader.RecordAt(blob.Offset - recordHeaderSize); recErr == nil && rec.Length == blob.Length {
+				blob.Uncommitted = false
+				committed++
+				continue
+			}
+		}
+		aborted = append(aborted, blob.ID)
+	}
+	return committed, aborted
+}
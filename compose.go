@@ -0,0 +1,414 @@
+// Blob composition for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A composed blob is an index entry listing other blobs, its segments, in
+// order. It has no bytes of its own: reads fetch each segment and stream
+// them one after another. Composing is as cheap as a copy, so clients can
+// upload a large file as chunks in parallel and join them at the end.
+// Segments are read regardless of their own trash state, so the chunks
+// can be deleted once composed; a container holding a segment of a live
+// composed blob is not reclaimed.
+
+// ComposeRequest - Body of POST /compose
+type ComposeRequest struct {
+	Sources []string `json:"sources"` // Blob IDs, in order
+}
+
+// composeLimit reads COMPOSE_MAX_SEGMENTS
+func composeLimit() int {
+	return int(getEnvInt("COMPOSE_MAX_SEGMENTS", 1024))
+}
+
+// ComposeBlob adds a blob made of the sources in order. Composed sources
+// are flattened into their segments. The entry goes in the first source's
+// container, so every source must be in the same tenant. Key, ContentType,
+// Tags and TTL in opts apply to the new blob; a TTL of 0 takes the tenant
+// default.
+func (fb *FileBox) ComposeBlob(sources []string, opts BlobOptions) (*BlobResponse, error) {
+	fb.fileLock.Lock()
+	now := timeNow()
+	var first *ContainerFile
+	var segments []string
+	var size int64
+	customerKey := false
+	for _, sourceID := range sources {
+		containerFile, source, ok := fb.lookupBlob(sourceID)
+		if !ok {
+			fb.fileLock.Unlock()
+			return nil, fmt.Errorf("blob not found: %s", sourceID)
+		}
+		if first == nil {
+			first = containerFile
+		}
+		if err := composeRefusal(fb, first, containerFile, source, now); err != nil {
+			fb.fileLock.Unlock()
+			return nil, err
+		}
+		if len(source.Segments) > 0 {
+			segments = append(segments, source.Segments...)
+		} else {
+			segments = append(segments, sourceID)
+		}
+		size += source.Size
+		customerKey = customerKey || source.CustomerKey
+	}
+	if limit := composeLimit(); len(segments) > limit {
+		fb.fileLock.Unlock()
+		return nil, &CopyError{BlobID: sources[0], Reason: fmt.Sprintf("%d segments, more than the limit of %d", len(segments), limit)}
+	}
+	if opts.maxSize > 0 && size > opts.maxSize {
+		fb.fileLock.Unlock()
+		return nil, &BlobTooLargeError{Size: size, Limit: opts.maxSize}
+	}
+	if opts.Tenant != "" && opts.Tenant != first.Tenant {
+		fb.fileLock.Unlock()
+		return nil, &CopyError{BlobID: sources[0], Reason: "composed blobs stay in their sources' tenant"}
+	}
+	if opts.TTL == 0 {
+		opts.TTL = fb.tenantPolicies.policy(first.Tenant).ttl
+	}
+
+	_, head, _ := fb.lookupBlob(sources[0])
+	blobInfo := BlobInfo{
+		Size:        size,
+		Key:         opts.Key,
+		ContentType: head.ContentType,
+		Tags:        maps.Clone(opts.Tags),
+		Created:     now,
+		CustomerKey: customerKey,
+		Segments:    segments,
+	}
+	if opts.ContentType != "" {
+		blobInfo.ContentType = opts.ContentType
+	}
+	if opts.TTL > 0 {
+		expiresAt := now.Add(opts.TTL)
+		blobInfo.ExpiresAt = &expiresAt
+	}
+	blobInfo, err := fb.addComposed(first, blobInfo)
+	fb.fileLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	durability := Durability{Mode: fb.durability.Mode, Timings: &DurabilityTimings{}}
+	if err := fb.saveComposed(first, &durability); err != nil {
+		return nil, err
+	}
+	durability.finish()
+	if _, index, err := parseBlobID(blobInfo.ID); err == nil {
+		fb.logBlobChange(MetaOpCommit, first, index)
+	}
+
+	log.Printf("Composed blob %s from %d segments (%d bytes)", blobInfo.ID, len(segments), size)
+	return composedResponse(first, blobInfo, durability), nil
+}
+
+// addComposed appends a composed blob's index entry to a container and
+// returns it with its ID. Callers must hold fb.fileLock.
+func (fb *FileBox) addComposed(containerFile *ContainerFile, blobInfo BlobInfo) (BlobInfo, error) {
+	if err := fb.indexOnly.note(containerFile.FID.String()); err != nil {
+		return blobInfo, err
+	}
+	blobInfo.ID = formatBlobID(containerFile.FID.String(), len(containerFile.Blobs))
+	containerFile.Blobs = append(containerFile.Blobs, blobInfo)
+	if blobInfo.Key != "" {
+		fb.keys[blobInfo.Key] = blobInfo.ID
+	}
+	fb.tagIndex.add(blobInfo)
+	fb.addSegmentRefs(blobInfo)
+	return blobInfo, nil
+}
+
+// saveComposed writes the manifest holding a new composed blob, syncing
+// it in sync mode
+func (fb *FileBox) saveComposed(containerFile *ContainerFile, durability *Durability) error {
+	started := timeNow()
+	if fb.durability.Mode == DurabilityModeSync {
+		if err := fb.persistManifest(containerFile); err != nil {
+			return fmt.Errorf("%w: %v", errCopyNotDurable, err)
+		}
+	} else {
+		fb.saveManifest(containerFile)
+	}
+	durability.ManifestSynced = fb.meta.Durable()
+	durability.Timings.Manifest += millis(timeNow().Sub(started))
+	return nil
+}
+
+// composedResponse describes a new composed blob
+func composedResponse(containerFile *ContainerFile, blobInfo BlobInfo, durability Durability) *BlobResponse {
+	response := &BlobResponse{
+		ID:         blobInfo.ID,
+		Size:       blobInfo.Size,
+		Created:    blobInfo.Created.Format(time.RFC3339),
+		FileID:     containerFile.FID.String(),
+		Key:        blobInfo.Key,
+		Durability: durability,
+	}
+	if blobInfo.ExpiresAt != nil {
+		response.Expires = blobInfo.ExpiresAt.Format(time.RFC3339)
+	}
+	return response
+}
+
+// composeRefusal says why a blob cannot be a source, or returns nil.
+// Callers must hold fb.fileLock.
+func composeRefusal(fb *FileBox, first, containerFile *ContainerFile, source BlobInfo, now time.Time) error {
+	switch {
+	case fb.isForeign(containerFile):
+		return &ForeignError{BlobID: source.ID, MachineID: containerFile.FID.MachineID}
+	case containerFile.Tenant != first.Tenant:
+		return &CopyError{BlobID: source.ID, Reason: "sources must all be in one tenant"}
+	}
+	return copyRefusal(containerFile, source, BlobOptions{}, now)
+}
+
+// addSegmentRefs records which containers a composed blob reads from.
+// Callers must hold fb.fileLock.
+func (fb *FileBox) addSegmentRefs(blob BlobInfo) {
+	if len(blob.Segments) == 0 {
+		return
+	}
+	if fb.segmentRefs == nil {
+		fb.segmentRefs = make(map[string]map[string]bool)
+	}
+	for _, segment := range blob.Segments {
+		fileID, _, err := parseBlobID(segment)
+		if err != nil {
+			continue
+		}
+		if fb.segmentRefs[fileID] == nil {
+			fb.segmentRefs[fileID] = make(map[string]bool)
+		}
+		fb.segmentRefs[fileID][blob.ID] = true
+	}
+}
+
+// removeSegmentRefs forgets a composed blob whose container was dropped.
+// Callers must hold fb.fileLock.
+func (fb *FileBox) removeSegmentRefs(blob BlobInfo) {
+	for _, segment := range blob.Segments {
+		if fileID, _, err := parseBlobID(segment); err == nil {
+			delete(fb.segmentRefs[fileID], blob.ID)
+			if len(fb.segmentRefs[fileID]) == 0 {
+				delete(fb.segmentRefs, fileID)
+			}
+		}
+	}
+}
+
+// segmentsPinned reports whether a live composed blob in another container
+// reads from this one. Callers must hold fb.fileLock.
+func (fb *FileBox) segmentsPinned(containerFile *ContainerFile, now time.Time) bool {
+	fileID := containerFile.FID.String()
+	for composedID := range fb.segmentRefs[fileID] {
+		composedIn, composed, ok := fb.lookupBlob(composedID)
+		if !ok || composedIn == containerFile {
+			continue
+		}
+		if !expired(composedIn, composed, now) && !fb.purgeable(composedIn, composed, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// composedSegment - One segment of a composed blob, resolved for reading
+type composedSegment struct {
+	containerFile *ContainerFile
+	blob          BlobInfo
+}
+
+// resolveSegments looks up every segment of a composed blob. A missing or
+// quarantined segment fails the whole read.
+func (fb *FileBox) resolveSegments(composed BlobInfo) ([]composedSegment, error) {
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+	segments := make([]composedSegment, 0, len(composed.Segments))
+	for _, segmentID := range composed.Segments {
+		containerFile, blob, ok := fb.lookupBlob(segmentID)
+		if !ok {
+			return nil, fmt.Errorf("segment %s of blob %s is gone", segmentID, composed.ID)
+		}
+		if containerFile.Quarantined {
+			return nil, &QuarantinedError{FileID: containerFile.FID.String(), Reason: containerFile.QuarantineReason}
+		}
+		segments = append(segments, composedSegment{containerFile: containerFile, blob: blob})
+	}
+	return segments, nil
+}
+
+// readComposed reads a composed blob into memory
+func (fb *FileBox) readComposed(ctx context.Context, composed BlobInfo) ([]byte, error) {
+	segments, err := fb.resolveSegments(composed)
+	if err != nil {
+		return nil, err
+	}
+	blobData := make([]byte, 0, composed.Size)
+	for _, segment := range segments {
+		data, err := fb.readBlobPlaintext(ctx, segment.containerFile, segment.blob)
+		if err != nil {
+			return nil, err
+		}
+		blobData = append(blobData, data...)
+	}
+	return blobData, nil
+}
+
+// serveComposed streams a composed blob segment by segment, so only one
+// segment is in memory at a time. It reports false if blobID is not a
+// composed blob. Errors before the first byte get a status code; later
+// ones abort the response.
+func (fb *FileBox) serveComposed(w http.ResponseWriter, r *http.Request, blobID string) bool {
+	fb.fileLock.RLock()
+	containerFile, composed, ok := fb.lookupBlob(blobID)
+	fb.fileLock.RUnlock()
+	if !ok || len(composed.Segments) == 0 || r.Header.Get("Range") != "" {
+		return false // Ranges of composed blobs are cut from the whole blob
+	}
+
+	customerKey, err := customerKeyFrom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	ctx := withCustomerKey(r.Context(), customerKey)
+
+	fb.fileLock.RLock()
+	err = composeReadRefusal(containerFile, composed, timeNow())
+	fb.fileLock.RUnlock()
+	var segments []composedSegment
+	if err == nil {
+		segments, err = fb.resolveSegments(composed)
+	}
+	// The first segment is read before any header goes out
+	var first []byte
+	if err == nil {
+		first, err = fb.readBlobPlaintext(ctx, segments[0].containerFile, segments[0].blob)
+	}
+	if clientGone(err) {
+		fb.disconnects.download.Add(1)
+		w.WriteHeader(statusClientClosedRequest) // Only for the access log and SLO tracking
+		return true
+	}
+	if err != nil {
+		if !writeReadError(w, err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return true
+	}
+
+	contentType := composed.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatInt(composed.Size, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	setCustomerKeyHeaders(w, customerKey)
+	// Later segments are not read once the client stops taking the body
+	_, err = w.Write(first)
+	for _, segment := range segments[1:] {
+		if err != nil || ctx.Err() != nil {
+			fb.disconnects.download.Add(1)
+			return true
+		}
+		data, readErr := fb.readBlobPlaintext(ctx, segment.containerFile, segment.blob)
+		if clientGone(readErr) {
+			fb.disconnects.download.Add(1)
+			return true
+		}
+		if readErr != nil {
+			log.Printf("Error reading segment %s of composed blob %s: %v", segment.blob.ID, blobID, readErr)
+			panic(http.ErrAbortHandler) // The client sees a short body rather than a silently truncated one
+		}
+		_, err = w.Write(data)
+	}
+	fb.access.record(blobID)
+	return true
+}
+
+// composeReadRefusal applies GetBlob's checks to the composed entry itself.
+// Callers must hold fb.fileLock.
+func composeReadRefusal(containerFile *ContainerFile, composed BlobInfo, now time.Time) error {
+	switch {
+	case containerFile.Quarantined:
+		return &QuarantinedError{FileID: containerFile.FID.String(), Reason: containerFile.QuarantineReason}
+	case composed.DeletedAt != nil:
+		return &DeletedError{BlobID: composed.ID, DeletedAt: *composed.DeletedAt}
+	case expired(containerFile, composed, now):
+		return &DeletedError{BlobID: composed.ID, DeletedAt: *composed.ExpiresAt, Expired: true}
+	case composed.Scan != nil && composed.Scan.Status != ScanClean:
+		return &ScanError{BlobID: composed.ID, Result: *composed.Scan}
+	}
+	return nil
+}
+
+// handleCompose serves POST /compose
+func (fb *FileBox) handleCompose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req ComposeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid compose request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Sources) == 0 {
+		http.Error(w, "sources required", http.StatusBadRequest)
+		return
+	}
+	upload, ok := fb.copyRequest(w, r)
+	if !ok {
+		return
+	}
+	opts := upload.opts
+
+	// Composing uses up upload tokens like uploads do; a failed compose hands the token back
+	if !fb.claimUploadToken(w, upload) {
+		return
+	}
+	response, err := fb.ComposeBlob(req.Sources, opts)
+
+	event := auditEventFor(r, AuditCompose)
+	event.Tenant = opts.Tenant
+	event.Key = opts.Key
+	event.Detail = fmt.Sprintf("%d sources", len(req.Sources))
+	if upload.claims != nil {
+		event.Token = tokenFingerprint(upload.token)
+	}
+	if err != nil {
+		fb.releaseUploadToken(upload)
+		event.Outcome, event.Detail = "error", err.Error()
+		fb.audit.record(event)
+		writeCopyError(w, err)
+		return
+	}
+	event.Outcome, event.BlobID, event.FileID = "ok", response.ID, response.FileID
+	fb.audit.record(event)
+	if err := fb.publishKey(r, response); err != nil {
+		http.Error(w, fmt.Sprintf("Composed %s but key %q not set: %v", response.ID, response.Key, err), keyErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
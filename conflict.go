@@ -0,0 +1,207 @@
+// Same-FID write conflict detection for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Every container has exactly one writer: the node owning its machine ID.
+// Two nodes misconfigured with the same MACHINE_ID break that, and their
+// records for the same FID would land interleaved in one file on a replica.
+// Replicated writes are therefore checked before they touch the file:
+//
+//   - A sender claiming this node's own machine ID is refused outright.
+//   - A record already stored in full with the same bytes is
+//     acknowledged without being rewritten, so senders can retry a write
+//     whose answer they lost.
+//   - A record may not overwrite bytes already written with different ones.
+//     Holes not yet written read as zeros and may be filled.
+//   - A container this node owns and holds only accepts records identical
+//     to what it already has; only a container it lost can be returned.
+//
+// A refused write flags the container. Every later replicated write to it
+// is refused too, and metadata operations and catch-ups skip it, until an
+// operator has looked at both writers and clears the flag.
+
+// WriteConflict - Why replicated writes to a container are refused
+type WriteConflict struct {
+	DetectedAt time.Time `json:"detected_at"`
+	Host       string    `json:"host"` // Host ID of the writer refused first
+	Offset     int64     `json:"offset"`
+	Length     int64     `json:"length"`
+	Reason     string    `json:"reason"`
+}
+
+// WriteConflictError - A replicated write refused because of a conflict
+type WriteConflictError struct {
+	FileID   string
+	Conflict WriteConflict
+}
+
+func (e *WriteConflictError) Error() string {
+	return fmt.Sprintf("write conflict on container %s: %s", e.FileID, e.Conflict.Reason)
+}
+
+// ConflictEntry - One flagged container in GET /admin/conflicts
+type ConflictEntry struct {
+	FileID string `json:"file_id"`
+	WriteConflict
+}
+
+// checkSenderMachine refuses replication from a node sharing this node's machine ID
+func (fb *FileBox) checkSenderMachine(hostID, machineID string) error {
+	id, err := strconv.ParseUint(machineID, 10, 32)
+	if err != nil || uint32(id) != fb.machineID || hostID == fb.hostID {
+		return nil
+	}
+	return fmt.Errorf("host %s uses this node's machine ID %d; check MACHINE_ID on both nodes", hostID, id)
+}
+
+// replicaStored reports whether a record is already stored in full at its
+// offset with the same bytes, as when a sender retries a write whose
+// answer it lost. Callers must hold fb.fileLock for reading and the
+// container's lock.
+func (fb *FileBox) replicaStored(containerFile *ContainerFile, held bool, offset int64, data []byte) (bool, error) {
+	end := offset + int64(len(data))
+	if !held || containerFile.Conflict != nil || len(data) == 0 || end > containerFile.Size {
+		return false, nil
+	}
+
+	file, err := os.Open(containerFile.FilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+	existing := make([]byte, len(data))
+	if _, err := file.ReadAt(existing, offset); err != nil {
+		return false, nil // Shorter than its manifest says; let the write fill it
+	}
+	return bytes.Equal(existing, data), nil
+}
+
+// checkReplicaWrite refuses a record that would overwrite different bytes,
+// or reach a container this node owns and holds. held is false when the
+// record is the first to arrive for the container. Callers must hold
+// fb.fileLock for reading and the container's lock.
+func (fb *FileBox) checkReplicaWrite(containerFile *ContainerFile, held bool, hostID string, offset int64, data []byte) error {
+	fileID := containerFile.FID.String()
+	if containerFile.Conflict != nil {
+		return &WriteConflictError{FileID: fileID, Conflict: *containerFile.Conflict}
+	}
+	if !held {
+		return nil
+	}
+
+	conflict := func(reason string) error {
+		return &WriteConflictError{FileID: fileID, Conflict: WriteConflict{
+			DetectedAt: timeNow().UTC(),
+			Host:       hostID,
+			Offset:     offset,
+			Length:     int64(len(data)),
+			Reason:     reason,
+		}}
+	}
+
+	end := offset + int64(len(data))
+	owned := !fb.isForeign(containerFile)
+	if owned && end > containerFile.Size {
+		return conflict(fmt.Sprintf("host %s wrote past the end of a container this node owns and is writing", hostID))
+	}
+	overlap := min(end, containerFile.Size) - offset
+	if overlap <= 0 {
+		return nil
+	}
+
+	file, err := os.Open(containerFile.FilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	existing := make([]byte, overlap)
+	n, _ := file.ReadAt(existing, offset)
+	for i := range existing[:n] {
+		if existing[i] != data[i] && (owned || existing[i] != 0) {
+			return conflict(fmt.Sprintf("host %s sent bytes differing at offset %d from ones already written", hostID, offset+int64(i)))
+		}
+	}
+	return nil
+}
+
+// flagConflict records the first conflict on a container and audits the refused write
+func (fb *FileBox) flagConflict(event AuditEvent, containerFile *ContainerFile, conflictErr *WriteConflictError) {
+	fb.fileLock.Lock()
+	first := containerFile.Conflict == nil
+	if first {
+		conflict := conflictErr.Conflict
+		containerFile.Conflict = &conflict
+	}
+	fb.fileLock.Unlock()
+
+	if first {
+		fb.saveManifest(containerFile)
+		log.Printf("WARNING: Refusing replicated writes to container %s: %s", conflictErr.FileID, conflictErr.Conflict.Reason)
+	}
+
+	event.Outcome, event.Peer = "refused", conflictErr.Conflict.Host
+	event.FileID, event.Bytes = conflictErr.FileID, conflictErr.Conflict.Length
+	event.Detail = conflictErr.Conflict.Reason
+	fb.audit.record(event)
+}
+
+// handleConflicts serves GET /admin/conflicts
+func (fb *FileBox) handleConflicts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fb.fileLock.RLock()
+	conflicts := make([]ConflictEntry, 0)
+	for _, containerFile := range fb.files.all() {
+		if containerFile.Conflict != nil {
+			conflicts = append(conflicts, ConflictEntry{FileID: containerFile.FID.String(), WriteConflict: *containerFile.Conflict})
+		}
+	}
+	fb.fileLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conflicts)
+}
+
+// handleContainerConflict serves DELETE /admin/containers/{fid}/conflict,
+// accepting replicated writes to the container again
+func (fb *FileBox) handleContainerConflict(w http.ResponseWriter, r *http.Request, containerFile *ContainerFile) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fb.fileLock.Lock()
+	flagged := containerFile.Conflict != nil
+	containerFile.Conflict = nil
+	fb.fileLock.Unlock()
+
+	if !flagged {
+		http.Error(w, "Container has no write conflict", http.StatusNotFound)
+		return
+	}
+	fb.saveManifest(containerFile)
+	log.Printf("Cleared write conflict on container %s", containerFile.FID.String())
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,190 @@
+// Downloadable container manifests for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Binary manifest layout, all integers big-endian:
+//
+//	magic "FBMF", version uint16, flags uint16, file ID, tenant,
+//	container size int64, created unix nanoseconds int64, entry count uint32,
+//	then per entry: blob ID, offset int64, length int64, size int64,
+//	checksum uint32, flags uint8, hash algorithm, digest
+//
+// Strings are a uint16 length followed by their bytes.
+const (
+	containerManifestMagic   = "FBMF"
+	containerManifestVersion = 1
+	containerManifestType    = "application/vnd.filebox.manifest"
+)
+
+// Container flags of the binary manifest
+const (
+	manifestContainerEncrypted = 1 << iota
+	manifestContainerUploaded
+)
+
+// Entry flags of the binary manifest
+const (
+	manifestEntryDeleted = 1 << iota
+	manifestEntryCompressed
+	manifestEntryCustomerKey
+)
+
+// ManifestEntry - Where one blob's record lies in its container file
+type ManifestEntry struct {
+	ID            string `json:"id"`
+	Offset        int64  `json:"offset"` // Of the data, past the record header
+	Length        int64  `json:"length"` // Stored bytes, after compression and encryption
+	Size          int64  `json:"size"`   // Bytes the blob reads back as
+	Checksum      uint32 `json:"checksum"`
+	HashAlgorithm string `json:"hash_algorithm,omitempty"`
+	Digest        string `json:"digest,omitempty"`
+	Compression   string `json:"compression,omitempty"`
+	CustomerKey   bool   `json:"customer_key,omitempty"`
+	Deleted       bool   `json:"deleted,omitempty"` // In the trash; the bytes are still there
+}
+
+// ContainerManifest - Response of GET /admin/containers/{fid}/manifest
+type ContainerManifest struct {
+	FileID    string          `json:"file_id"`
+	Tenant    string          `json:"tenant,omitempty"`
+	Size      int64           `json:"size"`
+	Created   time.Time       `json:"created"`
+	Encrypted bool            `json:"encrypted,omitempty"`
+	Uploaded  bool            `json:"uploaded"`
+	S3Key     string          `json:"s3_key,omitempty"`
+	Blobs     []ManifestEntry `json:"blobs"`
+}
+
+// containerManifest copies the record index of a container. Uncommitted
+// blobs and composed blobs, which have no bytes of their own, are left out.
+func (fb *FileBox) containerManifest(containerFile *ContainerFile) *ContainerManifest {
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+
+	size, blobs := fb.containerContents(containerFile)
+	manifest := &ContainerManifest{
+		FileID:    containerFile.FID.String(),
+		Tenant:    containerFile.Tenant,
+		Size:      size,
+		Created:   containerFile.Created,
+		Encrypted: containerFile.Encrypted,
+		Uploaded:  containerFile.Uploaded,
+		Blobs:     make([]ManifestEntry, 0, len(blobs)),
+	}
+	if containerFile.Uploaded {
+		manifest.S3Key = fb.containerS3Key(containerFile)
+	}
+	for _, blob := range blobs {
+		if blob.Uncommitted || len(blob.Segments) > 0 {
+			continue
+		}
+		manifest.Blobs = append(manifest.Blobs, ManifestEntry{
+			ID:            blob.ID,
+			Offset:        blob.Offset,
+			Length:        blob.Length,
+			Size:          blob.Size,
+			Checksum:      blob.Checksum,
+			HashAlgorithm: blob.HashAlgorithm,
+			Digest:        blob.Digest,
+			Compression:   blob.Compression,
+			CustomerKey:   blob.CustomerKey,
+			Deleted:       blob.DeletedAt != nil,
+		})
+	}
+	return manifest
+}
+
+// encodeBinary writes the manifest in the binary layout described above
+func (m *ContainerManifest) encodeBinary() []byte {
+	var buf bytes.Buffer
+	putString := func(s string) {
+		if len(s) > 0xFFFF {
+			s = s[:0xFFFF]
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(len(s)))
+		buf.WriteString(s)
+	}
+
+	var flags uint16
+	if m.Encrypted {
+		flags |= manifestContainerEncrypted
+	}
+	if m.Uploaded {
+		flags |= manifestContainerUploaded
+	}
+	buf.WriteString(containerManifestMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(containerManifestVersion))
+	binary.Write(&buf, binary.BigEndian, flags)
+	putString(m.FileID)
+	putString(m.Tenant)
+	binary.Write(&buf, binary.BigEndian, m.Size)
+	binary.Write(&buf, binary.BigEndian, m.Created.UnixNano())
+	binary.Write(&buf, binary.BigEndian, uint32(len(m.Blobs)))
+
+	for _, entry := range m.Blobs {
+		var entryFlags uint8
+		if entry.Deleted {
+			entryFlags |= manifestEntryDeleted
+		}
+		if entry.Compression != "" {
+			entryFlags |= manifestEntryCompressed
+		}
+		if entry.CustomerKey {
+			entryFlags |= manifestEntryCustomerKey
+		}
+		putString(entry.ID)
+		binary.Write(&buf, binary.BigEndian, entry.Offset)
+		binary.Write(&buf, binary.BigEndian, entry.Length)
+		binary.Write(&buf, binary.BigEndian, entry.Size)
+		binary.Write(&buf, binary.BigEndian, entry.Checksum)
+		buf.WriteByte(entryFlags)
+		putString(entry.HashAlgorithm)
+		putString(entry.Digest)
+	}
+	return buf.Bytes()
+}
+
+// wantsBinaryManifest picks the binary layout for ?format=binary or an
+// Accept header naming it or application/octet-stream
+func wantsBinaryManifest(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "binary":
+		return true
+	case "json":
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, containerManifestType) || strings.Contains(accept, "application/octet-stream")
+}
+
+// handleContainerManifest serves GET /admin/containers/{fid}/manifest
+func (fb *FileBox) handleContainerManifest(w http.ResponseWriter, r *http.Request, containerFile *ContainerFile) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	manifest := fb.containerManifest(containerFile)
+	if wantsBinaryManifest(r) {
+		data := manifest.encodeBinary()
+		w.Header().Set("Content-Type", containerManifestType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
@@ -0,0 +1,277 @@
+// Instant blob copies for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"time"
+)
+
+// A copy is a new index entry in the source blob's container pointing at
+// the same bytes, so copying takes the same time for any size. The bytes
+// are only reclaimed with the whole container, which happens once every
+// entry in it is gone, so each entry sharing a range counts as a
+// reference to it. Copies keep the source's tenant, checksum, encryption
+// and compression; they get their own ID, key, tags, TTL, trash state and
+// legal hold.
+
+// errCopyNotDurable - The copy was made but its index entry is not on disk
+var errCopyNotDurable = errors.New("error syncing manifest")
+
+// CopyError - The source blob cannot be copied in its current state
+type CopyError struct {
+	BlobID string
+	Reason string
+}
+
+func (e *CopyError) Error() string {
+	return fmt.Sprintf("cannot copy blob %s: %s", e.BlobID, e.Reason)
+}
+
+// CopyBlob adds an index entry for a blob's bytes under a new ID. Key,
+// ContentType, Tags and TTL in opts override the source's; a TTL of 0
+// takes the tenant default.
+func (fb *FileBox) CopyBlob(sourceID string, opts BlobOptions) (*BlobResponse, error) {
+	containerFile, index, err := fb.findBlob(sourceID)
+	if err != nil {
+		return nil, err
+	}
+	if fb.isForeign(containerFile) {
+		return nil, &ForeignError{BlobID: sourceID, MachineID: containerFile.FID.MachineID}
+	}
+
+	fb.fileLock.Lock()
+	source := containerFile.Blobs[index]
+	if err := copyRefusal(containerFile, source, opts, timeNow()); err != nil {
+		fb.fileLock.Unlock()
+		return nil, err
+	}
+	if opts.maxSize > 0 && source.Size > opts.maxSize {
+		fb.fileLock.Unlock()
+		return nil, &BlobTooLargeError{Size: source.Size, Limit: opts.maxSize}
+	}
+	if opts.TTL == 0 {
+		opts.TTL = fb.tenantPolicies.policy(containerFile.Tenant).ttl
+	}
+
+	blobInfo := BlobInfo{
+		Offset:        source.Offset,
+		Length:        source.Length,
+		Size:          source.Size,
+		Checksum:      source.Checksum,
+		Key:           opts.Key,
+		RemoteID:      source.RemoteID,
+		HashAlgorithm: source.HashAlgorithm,
+		Digest:        source.Digest,
+		ContentType:   source.ContentType,
+		Tags:          maps.Clone(source.Tags),
+		Created:       timeNow(),
+		Scan:          source.Scan,
+		CustomerKey:   source.CustomerKey,
+		Compression:   source.Compression,
+		CopyOf:        sourceID,
+	}
+	if opts.ContentType != "" {
+		blobInfo.ContentType = opts.ContentType
+	}
+	if opts.Tags != nil {
+		blobInfo.Tags = opts.Tags
+	}
+	if opts.TTL > 0 {
+		expiresAt := blobInfo.Created.Add(opts.TTL)
+		blobInfo.ExpiresAt = &expiresAt
+	}
+	if err := fb.indexOnly.note(containerFile.FID.String()); err != nil {
+		fb.fileLock.Unlock()
+		return nil, err
+	}
+	blobInfo.ID = formatBlobID(containerFile.FID.String(), len(containerFile.Blobs))
+	containerFile.Blobs = append(containerFile.Blobs, blobInfo)
+	if opts.Key != "" {
+		fb.keys[opts.Key] = blobInfo.ID
+	}
+	fb.tagIndex.add(blobInfo)
+	fb.fileLock.Unlock()
+
+	durability := Durability{Mode: fb.durability.Mode, Timings: &DurabilityTimings{}}
+	started := timeNow()
+	if fb.durability.Mode == DurabilityModeSync {
+		if err := fb.persistManifest(containerFile); err != nil {
+			return nil, fmt.Errorf("%w: %v", errCopyNotDurable, err)
+		}
+	} else {
+		fb.saveManifest(containerFile)
+	}
+	durability.ManifestSynced = fb.meta.Durable()
+	durability.Timings.Manifest = millis(timeNow().Sub(started))
+	durability.finish()
+	if _, index, err := parseBlobID(blobInfo.ID); err == nil {
+		fb.logBlobChange(MetaOpCommit, containerFile, index)
+	}
+
+	log.Printf("Copied blob %s to %s", sourceID, blobInfo.ID)
+	response := &BlobResponse{
+		ID:         blobInfo.ID,
+		Size:       blobInfo.Size,
+		Created:    blobInfo.Created.Format(time.RFC3339),
+		FileID:     containerFile.FID.String(),
+		Key:        opts.Key,
+		Durability: durability,
+	}
+	if blobInfo.ExpiresAt != nil {
+		response.Expires = blobInfo.ExpiresAt.Format(time.RFC3339)
+	}
+	return response, nil
+}
+
+// copyRefusal says why a blob cannot be copied, or returns nil.
+// Callers must hold fb.fileLock.
+func copyRefusal(containerFile *ContainerFile, source BlobInfo, opts BlobOptions, now time.Time) error {
+	refuse := func(reason string) error {
+		return &CopyError{BlobID: source.ID, Reason: reason}
+	}
+	switch {
+	case containerFile.Quarantined:
+		return &QuarantinedError{FileID: containerFile.FID.String(), Reason: containerFile.QuarantineReason}
+	case source.DeletedAt != nil:
+		return &DeletedError{BlobID: source.ID, DeletedAt: *source.DeletedAt}
+	case expired(containerFile, source, now):
+		return &DeletedError{BlobID: source.ID, DeletedAt: *source.ExpiresAt, Expired: true}
+	case source.Scan != nil && source.Scan.Status != ScanClean:
+		return refuse("its content scan is " + source.Scan.Status)
+	case source.VariantOf != "":
+		return refuse("it is a variant of " + source.VariantOf)
+	case opts.Tenant != "" && opts.Tenant != containerFile.Tenant:
+		return refuse("copies stay in the source blob's tenant")
+	}
+	return nil
+}
+
+// blobRefs counts the live index entries sharing a blob's bytes, itself
+// included. Callers must hold fb.fileLock.
+func (fb *FileBox) blobRefs(containerFile *ContainerFile, blob BlobInfo) int {
+	if len(blob.Segments) > 0 {
+		return 1 // Composed blobs have no bytes of their own
+	}
+	refs := 0
+	for _, other := range fb.containerBlobs(containerFile) {
+		if other.Offset == blob.Offset && len(other.Segments) == 0 && other.DeletedAt == nil {
+			refs++
+		}
+	}
+	return refs
+}
+
+// handleCopy serves POST /blob/{id}/copy and POST /key/{key}/copy
+func (fb *FileBox) handleCopy(w http.ResponseWriter, r *http.Request, sourceID string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, ok := fb.copyRequest(w, r)
+	if !ok {
+		return
+	}
+	opts := req.opts
+
+	// Copies use up upload tokens like uploads do; a failed copy hands the token back
+	if !fb.claimUploadToken(w, req) {
+		return
+	}
+	response, err := fb.CopyBlob(sourceID, opts)
+
+	event := auditEventFor(r, AuditCopy)
+	event.BlobID = sourceID
+	event.Tenant = opts.Tenant
+	event.Key = opts.Key
+	if req.claims != nil {
+		event.Token = tokenFingerprint(req.token)
+	}
+	if err != nil {
+		fb.releaseUploadToken(req)
+		event.Outcome, event.Detail = "error", err.Error()
+		fb.audit.record(event)
+		writeCopyError(w, err)
+		return
+	}
+	event.Outcome, event.FileID, event.Detail = "ok", response.FileID, "copied to "+response.ID
+	fb.audit.record(event)
+	if err := fb.publishKey(r, response); err != nil {
+		http.Error(w, fmt.Sprintf("Copied to %s but key %q not set: %v", response.ID, response.Key, err), keyErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// copyRequest reads the new blob's key, type, tags and TTL from the
+// request headers and checks its upload token as /upload does. The token's
+// size limit applies to the new blob, and a token limited to a content type
+// needs the type sent, since the new blob would otherwise keep its source's.
+// It writes an error response and returns false if the request is not
+// allowed.
+func (fb *FileBox) copyRequest(w http.ResponseWriter, r *http.Request) (*uploadRequest, bool) {
+	req := &uploadRequest{
+		opts: BlobOptions{
+			Tenant:      r.Header.Get("X-FileBox-Tenant"),
+			Key:         r.Header.Get("X-FileBox-Key"),
+			ContentType: r.Header.Get("Content-Type"),
+		},
+		token: uploadTokenFrom(r),
+	}
+	if values := r.Header.Values("X-FileBox-Tag"); len(values) > 0 {
+		req.opts.Tags = parseTagHeaders(values)
+	}
+	if ttl := r.Header.Get("X-FileBox-TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid X-FileBox-TTL (want a positive duration such as 72h)", http.StatusBadRequest)
+			return nil, false
+		}
+		req.opts.TTL = d
+	}
+
+	if !fb.checkUploadToken(w, req) {
+		return nil, false
+	}
+	if req.claims != nil {
+		if req.claims.ContentType != "" && req.opts.ContentType == "" {
+			http.Error(w, "Content-Type required by upload token", http.StatusForbidden)
+			return nil, false
+		}
+		req.opts.maxSize = req.claims.MaxSize
+	}
+	return req, true
+}
+
+// writeCopyError maps a copy or compose error to a status code
+func writeCopyError(w http.ResponseWriter, err error) {
+	var quarantinedErr *QuarantinedError
+	var deletedErr *DeletedError
+	var copyErr *CopyError
+	var foreignErr *ForeignError
+	var tooLarge *BlobTooLargeError
+	switch {
+	case errors.As(err, &quarantinedErr):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.As(err, &deletedErr):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.As(err, &tooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.As(err, &copyErr), errors.As(err, &foreignErr):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errCopyNotDurable):
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
@@ -0,0 +1,121 @@
+// Client-supplied blob encryption keys (SSE-C style) for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+)
+
+// A client may send its own AES-256 key with an upload. The blob is sealed
+// with it before anything else happens to it (container encryption,
+// framing, replication, S3), and only a flag is kept in the blob index: the
+// key itself is never written anywhere. Reads must send the same key.
+
+// Customer key headers, mirroring S3's x-amz-server-side-encryption-customer-*
+const (
+	customerKeyAlgorithmHeader = "X-FileBox-SSE-C-Algorithm"
+	customerKeyHeader          = "X-FileBox-SSE-C-Key"     // Base64 of the 32-byte key
+	customerKeyMD5Header       = "X-FileBox-SSE-C-Key-MD5" // Base64 MD5 of the key, to catch transport mangling
+	customerKeyAlgorithm       = "AES256"
+)
+
+// customerKeyAD binds sealed customer-key blobs to their purpose
+var customerKeyAD = []byte("filebox-sse-c")
+
+// CustomerKeyError - A customer-key blob was read without its key or with the wrong one
+type CustomerKeyError struct {
+	BlobID  string
+	Missing bool // No key was sent, as opposed to a key that does not match
+}
+
+func (e *CustomerKeyError) Error() string {
+	if e.Missing {
+		return fmt.Sprintf("blob %s is encrypted with a customer key; send it in %s", e.BlobID, customerKeyHeader)
+	}
+	return fmt.Sprintf("the customer key does not match blob %s", e.BlobID)
+}
+
+// StatusCode is 400 for a missing key and 403 for a wrong one, as S3 answers
+func (e *CustomerKeyError) StatusCode() int {
+	if e.Missing {
+		return http.StatusBadRequest
+	}
+	return http.StatusForbidden
+}
+
+// customerKeyFrom reads the customer key headers; it returns nil when the
+// request carries none
+func customerKeyFrom(r *http.Request) ([]byte, error) {
+	encoded := r.Header.Get(customerKeyHeader)
+	algorithm := r.Header.Get(customerKeyAlgorithmHeader)
+	if encoded == "" && algorithm == "" {
+		return nil, nil
+	}
+	if algorithm != customerKeyAlgorithm {
+		return nil, fmt.Errorf("%s must be %s", customerKeyAlgorithmHeader, customerKeyAlgorithm)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != dataKeySize {
+		return nil, fmt.Errorf("%s must be %d base64-encoded bytes", customerKeyHeader, dataKeySize)
+	}
+	if sum := r.Header.Get(customerKeyMD5Header); sum != "" && sum != customerKeyMD5(key) {
+		return nil, fmt.Errorf("%s does not match the key", customerKeyMD5Header)
+	}
+	return key, nil
+}
+
+// customerKeyMD5 is the digest echoed back so clients can confirm which key was used
+func customerKeyMD5(key []byte) string {
+	sum := md5.Sum(key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// setCustomerKeyHeaders echoes the algorithm and key digest, as S3 does
+func setCustomerKeyHeaders(w http.ResponseWriter, key []byte) {
+	if key != nil {
+		w.Header().Set(customerKeyAlgorithmHeader, customerKeyAlgorithm)
+		w.Header().Set(customerKeyMD5Header, customerKeyMD5(key))
+	}
+}
+
+type customerKeyContextKey struct{}
+
+// withCustomerKey carries a request's customer key to GetBlob
+func withCustomerKey(ctx context.Context, key []byte) context.Context {
+	if key == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, customerKeyContextKey{}, key)
+}
+
+// sealWithCustomerKey encrypts blob data with a client's key
+func sealWithCustomerKey(key, blobData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, blobData, customerKeyAD)
+}
+
+// openWithCustomerKey decrypts a customer-key blob with the key in ctx
+func openWithCustomerKey(ctx context.Context, blobID string, sealed []byte) ([]byte, error) {
+	key, _ := ctx.Value(customerKeyContextKey{}).([]byte)
+	if key == nil {
+		return nil, &CustomerKeyError{BlobID: blobID, Missing: true}
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	blobData, err := open(aead, sealed, customerKeyAD)
+	if err != nil {
+		return nil, &CustomerKeyError{BlobID: blobID}
+	}
+	return blobData, nil
+}
@@ -0,0 +1,85 @@
+// Runtime debug endpoints for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+)
+
+// registerDebugHandlers adds pprof, expvar, a contention dump and failure
+// injection to mux
+func (fb *FileBox) registerDebugHandlers(mux *http.ServeMux) {
+	// Sample lock contention and blocking so the profiles have something to show
+	runtime.SetMutexProfileFraction(5)
+	runtime.SetBlockProfileRate(10000) // Nanoseconds: one sample per 10µs spent blocked
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	expvar.Publish("filebox", expvar.Func(fb.debugVars))
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	mux.HandleFunc("/debug/dump", fb.handleDebugDump)
+	mux.HandleFunc("/debug/inject", fb.audited(fb.handleInject))
+	mux.HandleFunc("/debug/inject/", fb.audited(fb.handleInject))
+}
+
+// debugVars summarizes in-memory state for /debug/vars
+func (fb *FileBox) debugVars() interface{} {
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+
+	vars := map[string]int64{
+		"containers": int64(fb.files.len()),
+		"keys":       int64(len(fb.keys)),
+		"goroutines": int64(runtime.NumGoroutine()),
+	}
+	vars["readahead_triggered"] = fb.readahead.triggered.Load()
+	vars["readahead_blobs"] = fb.readahead.blobs.Load()
+	vars["readahead_bytes"] = fb.readahead.bytes.Load()
+	for _, file := range fb.files.all() {
+		mu := fb.files.lock(file)
+		mu.RLock()
+		vars["blobs"] += int64(len(file.Blobs))
+		vars["bytes"] += file.Size
+		vars["writers_in_flight"] += int64(file.writers)
+		mu.RUnlock()
+		switch {
+		case file.Quarantined:
+			vars["containers_quarantined"]++
+		case file.Uploading:
+			vars["containers_uploading"]++
+		case !file.Uploaded:
+			vars["containers_open"]++
+		}
+	}
+	return vars
+}
+
+// handleDebugDump writes all goroutine stacks followed by the mutex and block profiles
+func (fb *FileBox) handleDebugDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, profile := range []struct {
+		name  string
+		debug int
+	}{{"goroutine", 2}, {"mutex", 1}, {"block", 1}} {
+		fmt.Fprintf(w, "==== %s ====\n", profile.name)
+		runtimepprof.Lookup(profile.name).WriteTo(w, profile.debug)
+		fmt.Fprintln(w)
+	}
+}
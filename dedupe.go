@@ -0,0 +1,322 @@
+// Chunk deduplication for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// Large uploads can be split into chunks at content-defined boundaries
+// (FastCDC): a cut depends only on the bytes just before it, so an edit
+// early in a file moves one boundary instead of every later one. Each
+// chunk is stored once per tenant, as an internal blob named by its
+// SHA-256, and the upload becomes a composed blob listing its chunks.
+// Storing a second version of a large file only writes the chunks that
+// changed.
+//
+// Chunk blobs are only kept alive by the composed blobs reading them, so
+// a container holding nothing but chunks no longer in use is reclaimed
+// like an expired one.
+
+// Gear hash table; fixed so boundaries match across restarts and nodes
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker - Content-defined chunking settings
+type chunker struct {
+	minSize, avgSize, maxSize int
+	maskS, maskL              uint64 // Harder to match before avgSize, easier after
+}
+
+// newChunker derives chunk bounds from the average chunk size
+func newChunker(avgSize int) chunker {
+	avgBits := bits.Len(uint(avgSize)) - 1
+	return chunker{
+		minSize: avgSize / 4,
+		avgSize: avgSize,
+		maxSize: avgSize * 8,
+		maskS:   ^uint64(0) << (64 - avgBits - 1),
+		maskL:   ^uint64(0) << (64 - avgBits + 1),
+	}
+}
+
+// cut returns the length of the first chunk of data
+func (c chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	n = min(n, c.maxSize)
+	normal := min(c.avgSize, n)
+
+	var fp uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		fp = fp<<1 + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// split cuts data into chunks; they share its backing array
+func (c chunker) split(data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := c.cut(data)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+// dedupeStore - Chunk index and chunking settings
+type dedupeStore struct {
+	minBlob int64 // Uploads at least this large are chunked; 0 disables
+	chunker chunker
+
+	mu    sync.Mutex
+	index map[string]string // Tenant + "/" + chunk hash -> chunk blob ID
+
+	stored     atomic.Int64
+	reused     atomic.Int64
+	savedBytes atomic.Int64
+}
+
+// DedupeStatus - Chunk deduplication counters, as exported to metrics
+type DedupeStatus struct {
+	Chunks       int   `json:"chunks"` // Chunks in the index
+	StoredChunks int64 `json:"stored_chunks"`
+	ReusedChunks int64 `json:"reused_chunks"`
+	SavedBytes   int64 `json:"saved_bytes"` // Bytes not written thanks to reused chunks
+}
+
+// loadDedupeStore reads DEDUPE_MIN_SIZE and DEDUPE_AVG_CHUNK_SIZE
+func loadDedupeStore() *dedupeStore {
+	d := &dedupeStore{
+		minBlob: getEnvInt("DEDUPE_MIN_SIZE", 0),
+		index:   make(map[string]string),
+	}
+	avgSize := getEnvInt("DEDUPE_AVG_CHUNK_SIZE", 64*1024)
+	if avgSize < 1024 || avgSize&(avgSize-1) != 0 {
+		log.Printf("DEDUPE_AVG_CHUNK_SIZE must be a power of two of at least 1024; using 64KB")
+		avgSize = 64 * 1024
+	}
+	d.chunker = newChunker(int(avgSize))
+	if d.minBlob > 0 {
+		log.Printf("Deduplicating uploads of %d bytes or more in chunks of about %d bytes", d.minBlob, avgSize)
+	}
+	return d
+}
+
+// applies reports whether an upload is split into chunks. Blobs sealed
+// with a customer key cannot be shared, and variants are small.
+func (d *dedupeStore) applies(blobData []byte, opts BlobOptions) bool {
+	return d != nil && d.minBlob > 0 && int64(len(blobData)) >= d.minBlob &&
+		opts.customerKey == nil && opts.VariantOf == "" && opts.chunkHash == ""
+}
+
+// chunkKey names a chunk in the index; tenants never share chunks
+func chunkKey(tenant, hash string) string {
+	return tenant + "/" + hash
+}
+
+// noteChunk adds a stored chunk to the index. Callers must hold fb.fileLock.
+func (fb *FileBox) noteChunk(containerFile *ContainerFile, blob BlobInfo) {
+	if fb.dedupe == nil || blob.ChunkHash == "" {
+		return
+	}
+	fb.dedupe.mu.Lock()
+	fb.dedupe.index[chunkKey(containerFile.Tenant, blob.ChunkHash)] = blob.ID
+	fb.dedupe.mu.Unlock()
+}
+
+// forgetChunk drops a chunk whose container was reclaimed. Callers must
+// hold fb.fileLock.
+func (fb *FileBox) forgetChunk(containerFile *ContainerFile, blob BlobInfo) {
+	if fb.dedupe == nil || blob.ChunkHash == "" {
+		return
+	}
+	key := chunkKey(containerFile.Tenant, blob.ChunkHash)
+	fb.dedupe.mu.Lock()
+	if fb.dedupe.index[key] == blob.ID {
+		delete(fb.dedupe.index, key)
+	}
+	fb.dedupe.mu.Unlock()
+}
+
+// findChunk returns a stored chunk that can still be read, or "".
+// Callers must hold fb.fileLock.
+func (fb *FileBox) findChunk(tenant, hash string) string {
+	fb.dedupe.mu.Lock()
+	chunkID := fb.dedupe.index[chunkKey(tenant, hash)]
+	fb.dedupe.mu.Unlock()
+	containerFile, _, ok := fb.lookupBlob(chunkID)
+	if !ok || containerFile.Quarantined || fb.isForeign(containerFile) {
+		return ""
+	}
+	return chunkID
+}
+
+// addChunked stores a large upload as a composed blob of deduplicated
+// chunks. opts has its tenant defaults filled in.
+func (fb *FileBox) addChunked(blobData []byte, opts BlobOptions) (*BlobResponse, error) {
+	chunks := fb.dedupe.chunker.split(blobData)
+	hashes := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		sum := sha256.Sum256(chunk)
+		hashes[i] = hex.EncodeToString(sum[:])
+	}
+
+	durability := Durability{Mode: fb.durability.Mode, Timings: &DurabilityTimings{}, Fsynced: true, Replicas: -1}
+	segments := make([]string, len(chunks))
+	// A chunk found in the index can be reclaimed before the composed blob
+	// pins it; the chunks are looked up again under the write lock and
+	// any that went are stored afresh
+	for attempt := 0; attempt < 3; attempt++ {
+		fb.fileLock.RLock()
+		for i, hash := range hashes {
+			if segments[i] == "" {
+				segments[i] = fb.findChunk(opts.Tenant, hash)
+				if segments[i] != "" {
+					fb.dedupe.reused.Add(1)
+					fb.dedupe.savedBytes.Add(int64(len(chunks[i])))
+				}
+			}
+		}
+		fb.fileLock.RUnlock()
+
+		written := make(map[string]string) // Repeats within the upload are stored once
+		for i, chunk := range chunks {
+			if segments[i] != "" {
+				continue
+			}
+			if chunkID, ok := written[hashes[i]]; ok {
+				segments[i] = chunkID
+				fb.dedupe.reused.Add(1)
+				fb.dedupe.savedBytes.Add(int64(len(chunk)))
+				continue
+			}
+			response, err := fb.AddBlob(chunk, BlobOptions{
+				Tenant:      opts.Tenant,
+				ContentType: "application/octet-stream",
+				chunkHash:   hashes[i],
+				trace:       opts.trace,
+				ctx:         opts.ctx, // Chunks already stored stay for later uploads to reuse
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error storing chunk %d of %d: %w", i+1, len(chunks), err)
+			}
+			segments[i], written[hashes[i]] = response.ID, response.ID
+			fb.dedupe.stored.Add(1)
+
+			// The upload is only as durable as its least durable chunk
+			durability.Fsynced = durability.Fsynced && response.Durability.Fsynced
+			if durability.Replicas < 0 || response.Durability.Replicas < durability.Replicas {
+				durability.Replicas = response.Durability.Replicas
+			}
+			durability.Timings.Write += response.Durability.Timings.Write
+			durability.Timings.Fsync += response.Durability.Timings.Fsync
+			durability.Timings.Manifest += response.Durability.Timings.Manifest
+			durability.Timings.Replication += response.Durability.Timings.Replication
+		}
+
+		fb.fileLock.Lock()
+		missing := false
+		for i, segmentID := range segments {
+			if containerFile, _, ok := fb.lookupBlob(segmentID); !ok || containerFile.Quarantined {
+				segments[i], missing = "", true
+			}
+		}
+		if missing {
+			fb.fileLock.Unlock()
+			continue
+		}
+
+		containerFile, _, _ := fb.lookupBlob(segments[0])
+		blobInfo := BlobInfo{
+			Size:        int64(len(blobData)),
+			Key:         opts.Key,
+			ContentType: opts.ContentType,
+			Tags:        opts.Tags,
+			Created:     timeNow(),
+			Segments:    segments,
+		}
+		if opts.TTL > 0 {
+			expiresAt := blobInfo.Created.Add(opts.TTL)
+			blobInfo.ExpiresAt = &expiresAt
+		}
+		if fb.scanner != nil {
+			blobInfo.Scan = &ScanResult{Status: ScanPending}
+		}
+		blobInfo, err := fb.addComposed(containerFile, blobInfo)
+		fb.fileLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		// Chunks that were all reused were acknowledged by earlier uploads
+		if durability.Replicas < 0 {
+			durability.Fsynced, durability.Replicas = false, 0
+		}
+		if err := fb.saveComposed(containerFile, &durability); err != nil {
+			return nil, err
+		}
+		durability.finish()
+		if _, index, err := parseBlobID(blobInfo.ID); err == nil {
+			fb.logBlobChange(MetaOpCommit, containerFile, index)
+		}
+
+		switch {
+		case blobInfo.Scan != nil:
+			go fb.scanBlob(blobInfo, opts.Tenant, blobData)
+		case len(fb.uploadHooks) > 0:
+			go fb.runUploadHooks(blobInfo, opts.Tenant, blobData)
+		}
+		log.Printf("Stored blob %s as %d chunks", blobInfo.ID, len(segments))
+		return composedResponse(containerFile, blobInfo, durability), nil
+	}
+	return nil, fmt.Errorf("error storing chunked blob: chunks kept disappearing")
+}
+
+// status returns the chunk counters
+func (d *dedupeStore) status() DedupeStatus {
+	if d == nil {
+		return DedupeStatus{}
+	}
+	d.mu.Lock()
+	chunks := len(d.index)
+	d.mu.Unlock()
+	return DedupeStatus{
+		Chunks:       chunks,
+		StoredChunks: d.stored.Load(),
+		ReusedChunks: d.reused.Load(),
+		SavedBytes:   d.savedBytes.Load(),
+	}
+}
@@ -0,0 +1,1002 @@
+// Scenario runner for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// `filebox demo <scenario>` starts a small cluster on this machine, each
+// node a child process of this binary with its own storage directory and
+// machine ID, in front of an in-memory fake S3. A scenario then breaks the
+// cluster in some way and prints a timeline of what happened, merging the
+// runner's own steps, the events the nodes send to its webhook and the
+// notable lines of their logs, each with a note on what it means.
+
+// demoScenario - A scripted experiment
+type demoScenario struct {
+	name    string
+	summary string
+	run     func(d *demo) error
+}
+
+var demoScenarios = []demoScenario{
+	{"crash", "Kill a node mid-flight, keep writing to its peer, restart it and watch it recover and catch up", demoCrash},
+	{"partition", "Cut replication between two nodes, watch hints pile up, heal the partition and watch them replay", demoPartition},
+	{"compaction", "Let blobs expire and see which containers are reclaimed, and which one live blob keeps", demoCompaction},
+	{"rebalance", "Lose a node's disk for good and move its containers to a new node from a replica", demoRebalance},
+}
+
+// demoNotes - What notable log lines mean; only lines matching one are
+// shown unless --verbose is given
+var demoNotes = []struct {
+	pattern *regexp.Regexp
+	note    string
+}{
+	{regexp.MustCompile(`^FileBox initialized`), ""},
+	{regexp.MustCompile(`^Recovery:`), "Startup scans the storage directory: manifests, records written after the last manifest, torn writes."},
+	{regexp.MustCompile(`^Created new .* container file`), "Blobs are appended to an open container until it is full."},
+	{regexp.MustCompile(`^Successfully uploaded file`), "A full container is sealed and copied to S3 as one object."},
+	{regexp.MustCompile(`^Circuit breaker for replica .* opened`), "The replica failed too often. Writes still succeed; what it misses is kept as hints."},
+	{regexp.MustCompile(`^Circuit breaker for replica .* closed`), "A probe got through, so the hinted bytes can be replayed."},
+	{regexp.MustCompile(`^Replayed \d+ hinted bytes`), "The replica now has every record it missed."},
+	{regexp.MustCompile(`^Dropped expired container`), "Every blob in it expired, so the whole container goes, locally and in S3."},
+	{regexp.MustCompile(`^Bootstrapping containers`), "Container files are copied from the replica and indexed from their record headers."},
+	{regexp.MustCompile(`^Bootstrap from .* (done|failed)`), ""},
+	{regexp.MustCompile(`reading blob .* from S3 instead`), "The local copy is unusable; S3 has the sealed container."},
+	{regexp.MustCompile(`^WARNING: injected`), ""},
+	{regexp.MustCompile(`^Cleared \d+ injected faults`), ""},
+}
+
+// logTimestamp matches the date and time the log package prefixes lines with
+var logTimestamp = regexp.MustCompile(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d(\.\d+)? `)
+
+// demoEntry - One line of a timeline
+type demoEntry struct {
+	at     time.Duration
+	source string // "demo" or a node name
+	text   string
+	note   string
+}
+
+// demoNode - One FileBox child process
+type demoNode struct {
+	name      string
+	addr      string
+	machineID uint32
+	dir       string
+	replicas  []string
+	env       []string // Settings particular to this node
+
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+// demo - A running scenario: its cluster, fake S3 and timeline
+type demo struct {
+	dir      string
+	binary   string
+	basePort int
+	verbose  bool
+	client   *http.Client
+	s3       *fakeS3
+	s3URL    string
+	hookURL  string
+	nodes    []*demoNode
+	rng      *mathrand.Rand
+	started  time.Time
+	servers  []*http.Server
+
+	mu       sync.Mutex
+	timeline []demoEntry
+}
+
+// runDemo implements `filebox demo`: scripted failure scenarios on a local cluster
+func runDemo(args []string) int {
+	flags := flag.NewFlagSet("demo", flag.ExitOnError)
+	basePort := flags.Int("base-port", 19080, "Port of the first node; the others follow it")
+	keep := flags.Bool("keep", false, "Keep the nodes' storage directories and logs")
+	verbose := flags.Bool("verbose", false, "Put every node log line in the timeline")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: filebox demo [--base-port PORT] [--keep] [--verbose] <scenario|all|list>")
+		flags.PrintDefaults()
+		fmt.Fprintln(flags.Output(), "\nScenarios:")
+		for _, scenario := range demoScenarios {
+			fmt.Fprintf(flags.Output(), "  %-11s %s\n", scenario.name, scenario.summary)
+		}
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	var scenarios []demoScenario
+	switch name := flags.Arg(0); name {
+	case "list":
+		for _, scenario := range demoScenarios {
+			fmt.Printf("%-11s %s\n", scenario.name, scenario.summary)
+		}
+		return 0
+	case "all":
+		scenarios = demoScenarios
+	default:
+		for _, scenario := range demoScenarios {
+			if scenario.name == name {
+				scenarios = append(scenarios, scenario)
+			}
+		}
+		if len(scenarios) == 0 {
+			fmt.Fprintf(os.Stderr, "Unknown scenario %q\n", name)
+			flags.Usage()
+			return 2
+		}
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error finding the filebox binary: %v\n", err)
+		return 1
+	}
+	failed := 0
+	for _, scenario := range scenarios {
+		if err := runDemoScenario(scenario, binary, *basePort, *keep, *verbose); err != nil {
+			fmt.Fprintf(os.Stderr, "Scenario %s failed: %v\n", scenario.name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runDemoScenario runs one scenario on a fresh cluster and prints its timeline
+func runDemoScenario(scenario demoScenario, binary string, basePort int, keep, verbose bool) error {
+	dir, err := os.MkdirTemp("", "filebox-demo-"+scenario.name+"-")
+	if err != nil {
+		return err
+	}
+	d := &demo{
+		dir:      dir,
+		binary:   binary,
+		basePort: basePort,
+		verbose:  verbose,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		s3:       newFakeS3(),
+		rng:      mathrand.New(mathrand.NewSource(1)),
+		started:  time.Now(),
+	}
+	fmt.Printf("=== %s: %s\n", scenario.name, scenario.summary)
+	defer func() {
+		d.shutdown()
+		d.printTimeline(scenario.name)
+		if keep {
+			fmt.Printf("Storage directories and node logs kept in %s\n\n", dir)
+		} else {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	if d.s3URL, err = d.serve(d.s3); err != nil {
+		return err
+	}
+	hookURL, err := d.serve(http.HandlerFunc(d.handleEvent))
+	if err != nil {
+		return err
+	}
+	d.hookURL = hookURL + "/events"
+	return scenario.run(d)
+}
+
+// serve starts a loopback HTTP server for the runner and returns its URL
+func (d *demo) serve(handler http.Handler) (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	d.servers = append(d.servers, server)
+	return "http://" + listener.Addr().String(), nil
+}
+
+// record adds an entry to the timeline; steps taken by the runner are
+// also printed as they happen
+func (d *demo) record(source, text, note string) {
+	d.mu.Lock()
+	d.timeline = append(d.timeline, demoEntry{at: time.Since(d.started), source: source, text: text, note: note})
+	d.mu.Unlock()
+	if source == "demo" {
+		fmt.Printf("  %s\n", text)
+	}
+}
+
+// step records something the runner did or saw
+func (d *demo) step(note, format string, args ...any) {
+	d.record("demo", fmt.Sprintf(format, args...), note)
+}
+
+// observeLog records a node's log line if it is notable
+func (d *demo) observeLog(node *demoNode, line string) {
+	line = logTimestamp.ReplaceAllString(line, "")
+	for _, other := range d.nodeList() {
+		line = strings.ReplaceAll(line, other.addr, other.name)
+	}
+	for _, known := range demoNotes {
+		if known.pattern.MatchString(line) {
+			d.record(node.name, line, known.note)
+			return
+		}
+	}
+	if d.verbose {
+		d.record(node.name, line, "")
+	}
+}
+
+// handleEvent receives the nodes' event webhooks
+func (d *demo) handleEvent(w http.ResponseWriter, r *http.Request) {
+	var event Event
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	source := fmt.Sprintf("machine %d", event.MachineID)
+	for _, node := range d.nodeList() {
+		if node.machineID == event.MachineID {
+			source = node.name
+		}
+	}
+	details, _ := json.Marshal(event.Details)
+	d.record(source, fmt.Sprintf("event %s %s", event.Type, details), "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// printTimeline prints every entry in time order, then what S3 was asked to do
+func (d *demo) printTimeline(name string) {
+	d.mu.Lock()
+	timeline := append([]demoEntry(nil), d.timeline...)
+	d.mu.Unlock()
+	sort.SliceStable(timeline, func(i, j int) bool { return timeline[i].at < timeline[j].at })
+
+	fmt.Printf("\n--- Timeline of %s\n", name)
+	for _, entry := range timeline {
+		fmt.Printf("%8.2fs  %-5s %s\n", entry.at.Seconds(), entry.source, entry.text)
+		if entry.note != "" {
+			fmt.Printf("%16s%s\n", "", entry.note)
+		}
+	}
+	fmt.Printf("--- Fake S3: %s\n\n", d.s3.summary())
+}
+
+// addNode declares a node; it is started with startNode
+func (d *demo) addNode(name string, env ...string) *demoNode {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	node := &demoNode{
+		name:      name,
+		addr:      fmt.Sprintf("127.0.0.1:%d", d.basePort+len(d.nodes)),
+		machineID: uint32(len(d.nodes) + 1),
+		dir:       filepath.Join(d.dir, name),
+		env:       env,
+	}
+	d.nodes = append(d.nodes, node)
+	return node
+}
+
+// nodeList returns the nodes declared so far
+func (d *demo) nodeList() []*demoNode {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.nodes
+}
+
+// replicate makes every node replicate to every other one
+func (d *demo) replicate(nodes ...*demoNode) {
+	for _, node := range nodes {
+		node.replicas = nil
+		for _, peer := range nodes {
+			if peer != node {
+				node.replicas = append(node.replicas, peer.addr)
+			}
+		}
+	}
+}
+
+// demoEnvKeep - Variables passed through to the nodes. Nothing else is, so
+// settings in the runner's environment cannot change a scenario.
+var demoEnvKeep = []string{"PATH", "HOME", "TMPDIR", "TMP", "TEMP", "SYSTEMROOT", "USERPROFILE"}
+
+// startNode starts a node and waits until it serves requests
+func (d *demo) startNode(node *demoNode) error {
+	if err := os.MkdirAll(node.dir, 0755); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(filepath.Join(node.dir, "node.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	var env []string
+	for _, key := range demoEnvKeep {
+		if value, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+value)
+		}
+	}
+	_, port, _ := net.SplitHostPort(node.addr)
+	env = append(env,
+		"PORT="+port,
+		"STORAGE_DIR="+filepath.Join(node.dir, "data"),
+		"MACHINE_ID="+strconv.FormatUint(uint64(node.machineID), 10),
+		"REPLICAS="+strings.Join(node.replicas, ","),
+		"S3_BUCKET="+fakeS3Bucket,
+		"S3_ENDPOINT="+d.s3URL,
+		"S3_FORCE_PATH_STYLE=true",
+		"S3_ACCESS_KEY_ID=demo",
+		"S3_SECRET_ACCESS_KEY=demo",
+		"S3_MAX_ATTEMPTS=1",
+		"AWS_REGION=us-east-1",
+		"AWS_EC2_METADATA_DISABLED=true",
+		"EVENT_WEBHOOK_URLS="+d.hookURL,
+		"DEBUG_ENDPOINTS=true",
+		"REPLICATION_STREAM_ADDR=off",
+		"MAX_CONTAINER_SIZE=64KB",
+		"PEER_PROBE_INTERVAL=1s",
+		"PEER_BREAKER_FAILURES=3",
+	)
+	env = append(env, node.env...)
+
+	output, input, err := os.Pipe()
+	if err != nil {
+		logFile.Close()
+		return err
+	}
+	cmd := exec.Command(d.binary)
+	cmd.Env = env
+	cmd.Stdout, cmd.Stderr = input, input
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		output.Close()
+		input.Close()
+		return fmt.Errorf("error starting node %s: %v", node.name, err)
+	}
+	input.Close()
+	node.cmd, node.exited = cmd, make(chan struct{})
+
+	go func() {
+		defer logFile.Close()
+		scanner := bufio.NewScanner(output)
+		for scanner.Scan() {
+			fmt.Fprintln(logFile, scanner.Text())
+			d.observeLog(node, scanner.Text())
+		}
+		output.Close()
+	}()
+	go func() {
+		cmd.Wait()
+		close(node.exited)
+	}()
+
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case <-node.exited:
+			return fmt.Errorf("node %s exited during startup; see %s", node.name, filepath.Join(node.dir, "node.log"))
+		case <-time.After(100 * time.Millisecond):
+		}
+		if resp, err := d.client.Get("http://" + node.addr + "/admin/recovery"); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("node %s did not start within 20s", node.name)
+}
+
+// crashNode kills a node without letting it shut down
+func (d *demo) crashNode(node *demoNode) {
+	if node.cmd == nil {
+		return
+	}
+	node.cmd.Process.Kill()
+	<-node.exited
+	node.cmd = nil
+}
+
+// shutdown stops every node and the runner's servers
+func (d *demo) shutdown() {
+	for _, node := range d.nodes {
+		if node.cmd == nil {
+			continue
+		}
+		if err := node.cmd.Process.Signal(os.Interrupt); err != nil {
+			node.cmd.Process.Kill()
+		}
+		select {
+		case <-node.exited:
+		case <-time.After(5 * time.Second):
+			node.cmd.Process.Kill()
+			<-node.exited
+		}
+		node.cmd = nil
+	}
+	// Let the last events and log lines arrive
+	time.Sleep(200 * time.Millisecond)
+	for _, server := range d.servers {
+		server.Close()
+	}
+}
+
+// call sends a request to a node and decodes a JSON response into out,
+// when given
+func (d *demo) call(node *demoNode, method, path string, body []byte, header http.Header, out any) error {
+	req, err := http.NewRequest(method, "http://"+node.addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s on %s: %s: %s", method, path, node.name, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	if raw, ok := out.(*[]byte); ok {
+		*raw = data
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// upload stores count random blobs under key prefix-i and returns them by key
+func (d *demo) upload(node *demoNode, prefix string, count, size int, ttl string) (map[string][]byte, []BlobResponse, error) {
+	blobs := make(map[string][]byte, count)
+	var responses []BlobResponse
+	for i := 0; i < count; i++ {
+		key := fmt.Sprintf("%s-%03d", prefix, i)
+		data := make([]byte, size)
+		d.rng.Read(data)
+		header := http.Header{}
+		header.Set("X-FileBox-Key", key)
+		if ttl != "" {
+			header.Set("X-FileBox-TTL", ttl)
+		}
+		var response BlobResponse
+		if err := d.call(node, "POST", "/upload", data, header, &response); err != nil {
+			return blobs, responses, err
+		}
+		blobs[key] = data
+		responses = append(responses, response)
+	}
+	return blobs, responses, nil
+}
+
+// verify reads blobs back by key and returns how many match
+func (d *demo) verify(node *demoNode, blobs map[string][]byte) int {
+	matched := 0
+	for key, want := range blobs {
+		var got []byte
+		if err := d.call(node, "GET", "/key/"+url.PathEscape(key), nil, nil, &got); err == nil && bytes.Equal(got, want) {
+			matched++
+		}
+	}
+	return matched
+}
+
+// peerHealth returns a node's view of one replica
+func (d *demo) peerHealth(node, peer *demoNode) (PeerHealth, error) {
+	var status struct {
+		Peers []PeerStatus `json:"peers"`
+	}
+	if err := d.call(node, "GET", "/admin/peers", nil, nil, &status); err != nil {
+		return PeerHealth{}, err
+	}
+	for _, p := range status.Peers {
+		if p.PeerProtocol != nil && p.Peer == peer.addr {
+			return p.Health, nil
+		}
+	}
+	return PeerHealth{}, fmt.Errorf("%s does not replicate to %s", node.name, peer.name)
+}
+
+// waitFor polls until check returns true or the timeout passes
+func waitFor(timeout time.Duration, check func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if check() {
+			return true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return check()
+}
+
+// containers lists a node's containers
+func (d *demo) containers(node *demoNode) ([]ContainerFile, error) {
+	var files []ContainerFile
+	err := d.call(node, "GET", "/files", nil, nil, &files)
+	sort.Slice(files, func(i, j int) bool { return files[i].FID.String() < files[j].FID.String() })
+	return files, err
+}
+
+// demoCrash: a and b replicate to each other; a is killed, misses writes
+// to b, and comes back
+func demoCrash(d *demo) error {
+	a, b := d.addNode("a"), d.addNode("b")
+	d.replicate(a, b)
+	for _, node := range d.nodes {
+		if err := d.startNode(node); err != nil {
+			return err
+		}
+	}
+	d.step("Each node appends its uploads to its own containers and copies every record to the other.",
+		"Started a and b, replicating to each other")
+
+	before, _, err := d.upload(a, "before-crash", 20, 4096, "")
+	if err != nil {
+		return err
+	}
+	d.step("", "Uploaded %d blobs of 4KB to a", len(before))
+
+	d.crashNode(a)
+	d.step("No shutdown: the open container is not closed and the last writes may not be in a manifest.",
+		"Killed a (SIGKILL)")
+
+	during, _, err := d.upload(b, "during-crash", 20, 4096, "")
+	if err != nil {
+		return err
+	}
+	d.step("Writes to b still succeed: replication to a is asynchronous.", "Uploaded %d blobs to b while a is down", len(during))
+
+	var health PeerHealth
+	waitFor(5*time.Second, func() bool {
+		health, err = d.peerHealth(b, a)
+		return err == nil && health.State == BreakerOpen
+	})
+	d.step("b stops sending to a and remembers the byte ranges a missed.",
+		"b's breaker for a is %s after %d failures; %d bytes hinted", health.State, health.Failures, health.HintedBytes)
+
+	if err := d.startNode(a); err != nil {
+		return err
+	}
+	var report RecoveryReport
+	if err := d.call(a, "GET", "/admin/recovery", nil, nil, &report); err != nil {
+		return err
+	}
+	d.step("Records are framed and checksummed, so a write the crash cut off would show up as torn and be left out of the index.",
+		"Restarted a: %d containers found, %d records replayed, %d torn writes", report.ContainersFound, report.RecordsReplayed, len(report.TornWrites))
+
+	caughtUp := waitFor(15*time.Second, func() bool {
+		health, err = d.peerHealth(b, a)
+		return err == nil && health.State == BreakerClosed && health.HintedBytes == 0
+	})
+	if !caughtUp {
+		return fmt.Errorf("b did not replay its hints to a: %+v", health)
+	}
+	d.step("a now holds a copy of every container b wrote while it was down.", "b's breaker for a closed and every hint replayed")
+
+	d.step("", "a serves %d of %d blobs uploaded before the crash", d.verify(a, before), len(before))
+	return nil
+}
+
+// demoPartition: a cannot reach b for a while, then can again
+func demoPartition(d *demo) error {
+	a, b := d.addNode("a"), d.addNode("b")
+	d.replicate(a, b)
+	for _, node := range d.nodes {
+		if err := d.startNode(node); err != nil {
+			return err
+		}
+	}
+	d.step("", "Started a and b, replicating to each other")
+
+	if _, _, err := d.upload(a, "before", 10, 4096, ""); err != nil {
+		return err
+	}
+	d.step("", "Uploaded 10 blobs to a; b gets a copy of each")
+
+	if err := d.call(a, "POST", "/debug/inject/partition?peer="+b.addr, nil, nil, nil); err != nil {
+		return err
+	}
+	d.step("Only a's requests to b fail. Partitions are often one-sided like this.", "Partitioned a from b")
+
+	blobs, _, err := d.upload(a, "partitioned", 20, 4096, "")
+	if err != nil {
+		return err
+	}
+	var health PeerHealth
+	waitFor(5*time.Second, func() bool {
+		health, err = d.peerHealth(a, b)
+		return err == nil && health.State == BreakerOpen
+	})
+	d.step("Uploads are acknowledged once written locally; b's copies are owed.",
+		"Uploaded %d blobs to a during the partition: breaker %s, %d bytes in %d containers hinted",
+		len(blobs), health.State, health.HintedBytes, health.HintedContainers)
+
+	if reverse, err := d.peerHealth(b, a); err == nil {
+		d.step("", "Meanwhile b's breaker for a is %s", reverse.State)
+	}
+
+	if err := d.call(a, "DELETE", "/debug/inject/partition", nil, nil, nil); err != nil {
+		return err
+	}
+	d.step("", "Healed the partition")
+
+	if !waitFor(15*time.Second, func() bool {
+		health, err = d.peerHealth(a, b)
+		return err == nil && health.State == BreakerClosed && health.HintedBytes == 0
+	}) {
+		return fmt.Errorf("a did not replay its hints to b: %+v", health)
+	}
+	d.step("The next probe found b reachable; the missed ranges were read back from a's containers and sent.",
+		"a's breaker for b closed and every hint replayed")
+
+	copies, err := d.containers(b)
+	if err != nil {
+		return err
+	}
+	mine, err := d.containers(a)
+	if err != nil {
+		return err
+	}
+	sizes := make(map[string]int64)
+	for _, container := range copies {
+		sizes[container.FID.String()] = container.Size
+	}
+	same := 0
+	for _, container := range mine {
+		if sizes[container.FID.String()] == container.Size {
+			same++
+		}
+	}
+	d.step("", "b's copies of %d of a's %d containers are complete", same, len(mine))
+	return nil
+}
+
+// demoCompaction: short-lived blobs expire around one that does not
+func demoCompaction(d *demo) error {
+	a := d.addNode("a", "CLUSTER_LEADER=true", "S3_EXPIRY_INTERVAL=0")
+	if err := d.startNode(a); err != nil {
+		return err
+	}
+	d.step("Containers are 64KB here. Blobs of 8KB less a record header fill one exactly, so the write that fills it seals it.",
+		"Started a single node with a fake S3")
+
+	size := 8*1024 - recordHeaderSize
+	if _, _, err := d.upload(a, "short-lived", 14, size, "3s"); err != nil {
+		return err
+	}
+	if _, _, err := d.upload(a, "long-lived", 1, size, ""); err != nil {
+		return err
+	}
+	if _, _, err := d.upload(a, "short-lived-2", 20, size, "3s"); err != nil {
+		return err
+	}
+	d.step("", "Uploaded 34 blobs with a 3s TTL and, in the middle, 1 blob without one")
+
+	var files []ContainerFile
+	waitFor(10*time.Second, func() bool {
+		files, _ = d.containers(a)
+		uploading := false
+		for _, container := range files {
+			uploading = uploading || container.Uploading
+		}
+		return !uploading
+	})
+	uploaded := 0
+	for _, container := range files {
+		if container.Uploaded {
+			uploaded++
+		}
+	}
+	d.step("Only sealed containers can be reclaimed: the open one may still get blobs that outlive the rest.",
+		"a has %d containers, %d sealed and in S3; S3 holds %d objects", len(files), uploaded, d.s3.count())
+
+	time.Sleep(4 * time.Second)
+	d.step("", "Waited for the TTLs to pass")
+
+	var report ExpiryReport
+	if err := d.call(a, "POST", "/admin/expiry", nil, nil, &report); err != nil {
+		return err
+	}
+	d.step("", "Ran expiry: %d containers and %d bytes reclaimed; S3 holds %d objects",
+		len(report.Containers), report.BytesReclaimed, d.s3.count())
+
+	files, err := d.containers(a)
+	if err != nil {
+		return err
+	}
+	for _, container := range files {
+		live, dead := 0, int64(0)
+		for _, blob := range container.Blobs {
+			if blob.ExpiresAt == nil {
+				live++
+			} else {
+				dead += blob.Length
+			}
+		}
+		switch {
+		case live > 0:
+			d.step("FileBox never rewrites a container to squeeze out dead blobs; the space comes back when the last blob in it goes.",
+				"Container %s is kept: %d expired bytes are held by %d live blob(s)", container.FID, dead, live)
+		case !container.Uploaded:
+			d.step("", "Container %s is still open, so it is kept", container.FID)
+		}
+	}
+	return nil
+}
+
+// demoRebalance: a's disk is lost; c takes over a's containers from b
+func demoRebalance(d *demo) error {
+	a, b := d.addNode("a"), d.addNode("b")
+	d.replicate(a, b)
+	for _, node := range []*demoNode{a, b} {
+		if err := d.startNode(node); err != nil {
+			return err
+		}
+	}
+	d.step("", "Started a and b, replicating to each other")
+
+	blobs, responses, err := d.upload(a, "owned-by-a", 20, 4096, "")
+	if err != nil {
+		return err
+	}
+	d.step("b holds a copy of a's containers but does not serve them: they belong to machine 1.",
+		"Uploaded %d blobs to a", len(blobs))
+	time.Sleep(time.Second)
+
+	d.crashNode(a)
+	if err := os.RemoveAll(a.dir); err != nil {
+		return err
+	}
+	d.step("", "Killed a and deleted its storage directory")
+
+	c := d.addNode("c")
+	c.replicas = []string{b.addr}
+	if err := d.startNode(c); err != nil {
+		return err
+	}
+	d.step("", "Started c (machine 3), replicating to b")
+
+	body, _ := json.Marshal(BootstrapRequest{Peer: b.addr, MachineID: &a.machineID})
+	if err := d.call(c, "POST", "/admin/bootstrap", body, nil, nil); err != nil {
+		return err
+	}
+	var status BootstrapStatus
+	waitFor(30*time.Second, func() bool {
+		err = d.call(c, "GET", "/admin/bootstrap", nil, nil, &status)
+		return err == nil && status.State != "running"
+	})
+	if status.State != "done" {
+		return fmt.Errorf("bootstrap %s: %v", status.State, status.Errors)
+	}
+	d.step("c now owns machine 1 as well as its own: blob IDs and S3 keys made by a stay valid.",
+		"c bootstrapped from b: %d containers, %d bytes", status.Pulled, status.Bytes)
+
+	served := 0
+	for _, response := range responses {
+		var got []byte
+		if err := d.call(c, "GET", "/blob/"+response.ID, nil, nil, &got); err == nil && bytes.Equal(got, blobs[response.Key]) {
+			served++
+		}
+	}
+	d.step("", "c serves %d of a's %d blobs by their original IDs", served, len(responses))
+	return nil
+}
+
+// fakeS3Bucket is the only bucket the fake S3 serves
+const fakeS3Bucket = "filebox-demo"
+
+// fakeS3 - An in-memory, path-style S3 with just the calls FileBox makes
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeS3Object
+	calls   map[string]int
+}
+
+// fakeS3Object - A stored object and the headers it was stored with
+type fakeS3Object struct {
+	data     []byte
+	header   http.Header
+	modified time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string]*fakeS3Object), calls: make(map[string]int)}
+}
+
+// count returns the number of stored objects
+func (s *fakeS3) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.objects)
+}
+
+// summary lists the calls made, e.g. "3 PutObject, 1 DeleteObject"
+func (s *fakeS3) summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.calls))
+	for name := range s.calls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%d %s", s.calls[name], name))
+	}
+	parts = append(parts, fmt.Sprintf("%d objects left", len(s.objects)))
+	return strings.Join(parts, ", ")
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != fakeS3Bucket {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case key == "" && r.Method == "GET":
+		s.calls["ListObjectsV2"]++
+		s.list(w, query.Get("prefix"))
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.calls["CopyObject"]++
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		_, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+		object := s.objects[sourceKey]
+		if object == nil {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		copied := *object
+		copied.modified = time.Now().UTC()
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			copied.header = storedS3Header(r.Header)
+		}
+		s.objects[key] = &copied
+		xml.NewEncoder(w).Encode(struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: etag(copied.data), LastModified: copied.modified.Format(time.RFC3339)})
+	case r.Method == "PUT":
+		s.calls["PutObject"]++
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = &fakeS3Object{data: data, header: storedS3Header(r.Header), modified: time.Now().UTC()}
+		w.Header().Set("ETag", etag(data))
+	case r.Method == "GET" || r.Method == "HEAD":
+		if r.Method == "GET" {
+			s.calls["GetObject"]++
+		} else {
+			s.calls["HeadObject"]++
+		}
+		object := s.objects[key]
+		if object == nil {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for name, values := range object.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("ETag", etag(object.data))
+		http.ServeContent(w, r, "", object.modified, bytes.NewReader(object.data))
+	case r.Method == "DELETE":
+		s.calls["DeleteObject"]++
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && query.Has("restore"):
+		// Nothing is archived here, so there is nothing to restore
+		s.calls["RestoreObject"]++
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// list answers ListObjectsV2 with every matching key in one page
+func (s *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type entry struct {
+		Key          string
+		Size         int64
+		LastModified string
+		ETag         string
+		StorageClass string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		MaxKeys     int
+		IsTruncated bool
+		Contents    []entry
+	}{Name: fakeS3Bucket, Prefix: prefix, MaxKeys: 1000}
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		object := s.objects[key]
+		storageClass := object.header.Get("X-Amz-Storage-Class")
+		if storageClass == "" {
+			storageClass = "STANDARD"
+		}
+		result.Contents = append(result.Contents, entry{key, int64(len(object.data)), object.modified.Format(time.RFC3339), etag(object.data), storageClass})
+	}
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// storedS3Header keeps the request headers S3 returns with an object
+func storedS3Header(header http.Header) http.Header {
+	stored := make(http.Header)
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") || name == "Content-Type" || name == "X-Amz-Storage-Class" {
+			stored[name] = values
+		}
+	}
+	return stored
+}
+
+// etag is S3's ETag for a single-part object
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// writeS3Error sends an error in S3's XML format
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+}
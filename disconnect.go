@@ -0,0 +1,112 @@
+// Client disconnect handling for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// An upload follows its request's context until its index entry is
+// filled in. A client that goes away before the record's range in a
+// container is reserved costs no disk work at all. One that goes while the
+// record is being written has the range given back, so the record is
+// neither counted in the container's size nor left behind as a torn write,
+// unless later uploads have reserved ranges after it. Once the entry is
+// filled in, the upload is carried through to its commit: the client may
+// have gone away after the server stored the blob but before the response
+// reached it, and a retry must find the same blob. Waiting for replica
+// acknowledgments stops with the client, though the record still
+// replicates in the background.
+
+// statusClientClosedRequest - Logged for requests the client abandoned; the
+// client never sees it
+const statusClientClosedRequest = 499
+
+// Stages at which a request was abandoned
+const (
+	AbandonedBeforeWrite = "before_write" // Nothing was written yet
+	AbandonedRolledBack  = "rolled_back"  // The partial record was cut off the container
+	AbandonedLeftBehind  = "left_behind"  // Later records were reserved after it; the record stays as unindexed bytes
+	AbandonedReplication = "replication"  // Stored, but the client left while replicas were acknowledging
+	AbandonedDownload    = "download"     // The response stopped part way
+)
+
+// disconnectCounters - Requests abandoned by their clients, by stage
+type disconnectCounters struct {
+	beforeWrite atomic.Int64
+	rolledBack  atomic.Int64
+	leftBehind  atomic.Int64
+	replication atomic.Int64
+	download    atomic.Int64
+}
+
+// snapshot returns the counts keyed by stage
+func (d *disconnectCounters) snapshot() map[string]int64 {
+	return map[string]int64{
+		AbandonedBeforeWrite: d.beforeWrite.Load(),
+		AbandonedRolledBack:  d.rolledBack.Load(),
+		AbandonedLeftBehind:  d.leftBehind.Load(),
+		AbandonedReplication: d.replication.Load(),
+		AbandonedDownload:    d.download.Load(),
+	}
+}
+
+// errAbandoned wraps the reason an upload was given up before it was stored
+func errAbandoned(err error) error {
+	return fmt.Errorf("upload abandoned: %w", err)
+}
+
+// clientGone reports whether err comes from a request's context ending
+func clientGone(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// abortRecord gives back the range an uncommitted record of length bytes
+// was reserved at, with its index entry, and reports whether it could. Only
+// the last range and entry reserved in a container can be given back,
+// cutting off whatever of the record was written; an earlier one stays as
+// dead bytes behind an entry that is never committed, since later records
+// sit after it.
+func (fb *FileBox) abortRecord(containerFile *ContainerFile, filePath string, offset, length int64, index int) bool {
+	fb.fileLock.Lock()
+	defer fb.fileLock.Unlock()
+	fileID := containerFile.FID.String()
+	if containerFile.Size != offset+length || len(containerFile.Blobs) != index+1 {
+		log.Printf("Left an uncommitted record at offset %d of %s: later records were reserved after it", offset, fileID)
+		return false
+	}
+	info, err := os.Stat(filePath)
+	switch {
+	case err != nil && !os.IsNotExist(err), err == nil && info.Size() > offset+length:
+		log.Printf("Left an uncommitted record at offset %d of %s: the file does not end with it", offset, fileID)
+		return false
+	case err == nil && info.Size() > offset:
+		if err := os.Truncate(filePath, offset); err != nil {
+			fb.noteIOError(filePath, err)
+			log.Printf("Error removing uncommitted record from %s: %v", fileID, err)
+			return false
+		}
+	}
+	containerFile.Size = offset
+	containerFile.Blobs = containerFile.Blobs[:index]
+	return true
+}
+
+// abandonUpload rolls back an upload whose client went away after its record
+// was written
+func (fb *FileBox) abandonUpload(containerFile *ContainerFile, filePath string, offset, length int64, index int, err error) error {
+	if fb.abortRecord(containerFile, filePath, offset, length, index) {
+		fb.disconnects.rolledBack.Add(1)
+	} else {
+		fb.disconnects.leftBehind.Add(1)
+	}
+	log.Printf("Upload to %s abandoned before its index entry was filled in", containerFile.FID.String())
+	return errAbandoned(err)
+}
@@ -0,0 +1,363 @@
+// Cross-region disaster recovery replication for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// drManifestSuffix is appended to a container's key for its manifest copy in the DR bucket
+const drManifestSuffix = ".manifest.json"
+
+// DRConfig - Second bucket, usually in another region, that uploaded containers are copied to
+type DRConfig struct {
+	Bucket            string
+	Region            string
+	Endpoint          string
+	StorageClass      string
+	ReconcileInterval time.Duration // How often the DR bucket is checked for gaps; 0 disables it
+}
+
+// DRReport - Outcome of one reconciliation pass
+type DRReport struct {
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Checked    int       `json:"checked"`    // Uploaded containers compared against the DR bucket
+	Gaps       int       `json:"gaps"`       // Containers missing from the DR bucket
+	Replicated int       `json:"replicated"` // Gaps copied during this pass
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+// DRStatus - Response of GET /admin/dr
+type DRStatus struct {
+	Enabled       bool      `json:"enabled"`
+	Bucket        string    `json:"bucket,omitempty"`
+	Region        string    `json:"region,omitempty"`
+	Replicated    int       `json:"replicated"` // Uploaded containers with a DR copy
+	Pending       int       `json:"pending"`    // Uploaded containers still without one
+	InFlight      int       `json:"in_flight"`
+	LastReconcile *DRReport `json:"last_reconcile,omitempty"`
+}
+
+// drState - DR client, copies in flight and the last reconciliation report
+type drState struct {
+	config DRConfig
+	client *s3.Client
+
+	mu       sync.Mutex
+	inFlight map[string]bool // Keyed by container file ID
+	last     *DRReport
+}
+
+// loadDRConfig reads DR_BUCKET, DR_REGION, DR_S3_ENDPOINT, DR_STORAGE_CLASS and DR_RECONCILE_INTERVAL
+func loadDRConfig() DRConfig {
+	return DRConfig{
+		Bucket:            os.Getenv("DR_BUCKET"),
+		Region:            os.Getenv("DR_REGION"),
+		Endpoint:          os.Getenv("DR_S3_ENDPOINT"),
+		StorageClass:      getEnvOrDefault("DR_STORAGE_CLASS", string(types.StorageClassStandard)),
+		ReconcileInterval: getEnvDuration("DR_RECONCILE_INTERVAL", time.Hour),
+	}
+}
+
+// newDRState builds the DR client when a DR bucket is configured
+func newDRState(awsConfig aws.Config) *drState {
+	dr := &drState{config: loadDRConfig(), inFlight: make(map[string]bool)}
+	if dr.config.Bucket == "" {
+		return dr
+	}
+
+	dr.client = newS3Client(awsConfig, func(o *s3.Options) {
+		if dr.config.Region != "" {
+			o.Region = dr.config.Region
+		}
+		if dr.config.Endpoint != "" {
+			o.BaseEndpoint = aws.String(dr.config.Endpoint)
+		}
+	})
+	log.Printf("Replicating uploaded containers to DR bucket %s (region %s)", dr.config.Bucket, dr.config.Region)
+	return dr
+}
+
+// enabled reports whether containers are replicated to a DR bucket
+func (dr *drState) enabled() bool {
+	return dr.client != nil
+}
+
+// runDRReconcile periodically copies containers missing from the DR bucket
+func (fb *FileBox) runDRReconcile() {
+	if !fb.dr.enabled() || fb.s3Client == nil || fb.dr.config.ReconcileInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(fb.dr.config.ReconcileInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report := fb.reconcileDR(context.Background())
+		if report.Gaps > 0 || len(report.Errors) > 0 {
+			log.Printf("DR reconciliation: %d containers checked, %d gaps, %d replicated, %d errors",
+				report.Checked, report.Gaps, report.Replicated, len(report.Errors))
+		}
+	}
+}
+
+// replicateToDR copies an uploaded container, its manifest and (when
+// encrypted) its escrowed key to the DR bucket and records the copy
+func (fb *FileBox) replicateToDR(ctx context.Context, containerFile *ContainerFile) error {
+	fileID := containerFile.FID.String()
+
+	fb.dr.mu.Lock()
+	if fb.dr.inFlight[fileID] {
+		fb.dr.mu.Unlock()
+		return fmt.Errorf("container %s is already being replicated", fileID)
+	}
+	fb.dr.inFlight[fileID] = true
+	fb.dr.mu.Unlock()
+	defer func() {
+		fb.dr.mu.Lock()
+		delete(fb.dr.inFlight, fileID)
+		fb.dr.mu.Unlock()
+	}()
+
+	fb.fileLock.RLock()
+	uploaded, evicted, encrypted := containerFile.Uploaded, containerFile.Evicted, containerFile.Encrypted
+	fb.fileLock.RUnlock()
+	if !uploaded {
+		return fmt.Errorf("container %s is not uploaded", fileID)
+	}
+
+	// Evicted containers only exist in the primary bucket; stage a copy locally
+	path := fb.filePathOf(containerFile)
+	if evicted {
+		staged, err := fb.stageFromS3(ctx, containerFile)
+		if err != nil {
+			return fmt.Errorf("error fetching primary copy: %v", err)
+		}
+		defer os.Remove(staged)
+		path = staged
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	s3Key := fb.containerS3Key(containerFile)
+	fb.fileLock.RLock()
+	tagging := fb.containerTagging(containerFile)
+	fb.fileLock.RUnlock()
+	_, err = fb.dr.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(fb.dr.config.Bucket),
+		Key:          aws.String(s3Key),
+		Body:         file,
+		StorageClass: types.StorageClass(fb.dr.config.StorageClass),
+		Tagging:      tagging,
+	})
+	if err != nil {
+		return err
+	}
+
+	if encrypted {
+		escrow, err := fb.keyEscrowData(containerFile)
+		if err != nil {
+			return fmt.Errorf("error escrowing data key: %v", err)
+		}
+		if err := fb.putDRObject(ctx, fb.keyEscrowS3Key(containerFile), escrow); err != nil {
+			return fmt.Errorf("error escrowing data key: %v", err)
+		}
+	}
+
+	fb.fileLock.Lock()
+	containerFile.DRReplicatedAt = timeNow().UTC()
+	fb.fileLock.Unlock()
+
+	if err := fb.replicateManifestToDR(ctx, containerFile); err != nil {
+		return fmt.Errorf("error copying manifest: %v", err)
+	}
+	fb.saveManifest(containerFile)
+
+	log.Printf("Replicated container %s to DR bucket %s", fileID, fb.dr.config.Bucket)
+	return nil
+}
+
+// replicateManifestToDR writes the container's current metadata next to its DR copy
+func (fb *FileBox) replicateManifestToDR(ctx context.Context, containerFile *ContainerFile) error {
+	fb.fileLock.RLock()
+	snapshot := fb.snapshotContainer(containerFile)
+	fb.fileLock.RUnlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return fb.putDRObject(ctx, fb.containerS3Key(containerFile)+drManifestSuffix, data)
+}
+
+// putDRObject writes a small JSON object to the DR bucket
+func (fb *FileBox) putDRObject(ctx context.Context, key string, data []byte) error {
+	_, err := fb.dr.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(fb.dr.config.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// stageFromS3 downloads a container from the primary bucket to a temporary
+// file and returns its path
+func (fb *FileBox) stageFromS3(ctx context.Context, containerFile *ContainerFile) (string, error) {
+	resp, err := fb.s3Client.GetObject(withUsageTenant(ctx, containerFile.Tenant), &s3.GetObjectInput{
+		Bucket: aws.String(fb.bucket),
+		Key:    aws.String(fb.containerS3Key(containerFile)),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	stagingDir := filepath.Join(fb.storageDir, "dr-staging")
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(stagingDir, containerFile.FID.String()+"-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// reconcileDR lists the DR bucket and copies every uploaded container that is
+// missing from it. Manifests of containers already there are refreshed so the
+// DR copy tracks deletes and other metadata changes.
+func (fb *FileBox) reconcileDR(ctx context.Context) *DRReport {
+	report := &DRReport{Started: timeNow().UTC()}
+	defer func() {
+		report.Finished = timeNow().UTC()
+		fb.dr.mu.Lock()
+		fb.dr.last = report
+		fb.dr.mu.Unlock()
+	}()
+
+	present := make(map[string]bool)
+	paginator := s3.NewListObjectsV2Paginator(fb.dr.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(fb.dr.config.Bucket),
+		Prefix: aws.String(fb.s3ListPrefix()),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			return report // A partial listing would report false gaps
+		}
+		for _, obj := range page.Contents {
+			present[aws.ToString(obj.Key)] = true
+		}
+	}
+
+	var containers []*ContainerFile
+	fb.fileLock.RLock()
+	for _, file := range fb.files.all() {
+		if file.Uploaded && !file.Quarantined && !fb.isForeign(file) {
+			containers = append(containers, file)
+		}
+	}
+	fb.fileLock.RUnlock()
+
+	for _, containerFile := range containers {
+		report.Checked++
+		fileID := containerFile.FID.String()
+
+		fb.fileLock.RLock()
+		replicated := !containerFile.DRReplicatedAt.IsZero()
+		fb.fileLock.RUnlock()
+
+		if replicated && present[fb.containerS3Key(containerFile)] {
+			if err := fb.replicateManifestToDR(ctx, containerFile); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: error refreshing manifest: %v", fileID, err))
+			}
+			continue
+		}
+
+		report.Gaps++
+		if err := fb.replicateToDR(ctx, containerFile); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", fileID, err))
+			continue
+		}
+		report.Replicated++
+	}
+	return report
+}
+
+// drStatus summarizes DR coverage of the uploaded containers
+func (fb *FileBox) drStatus() DRStatus {
+	status := DRStatus{Enabled: fb.dr.enabled(), Bucket: fb.dr.config.Bucket, Region: fb.dr.config.Region}
+
+	fb.fileLock.RLock()
+	for _, file := range fb.files.all() {
+		if !file.Uploaded {
+			continue
+		}
+		if file.DRReplicatedAt.IsZero() {
+			status.Pending++
+		} else {
+			status.Replicated++
+		}
+	}
+	fb.fileLock.RUnlock()
+
+	fb.dr.mu.Lock()
+	status.InFlight = len(fb.dr.inFlight)
+	status.LastReconcile = fb.dr.last
+	fb.dr.mu.Unlock()
+	return status
+}
+
+// handleDR serves GET /admin/dr (replication status) and POST /admin/dr
+// (reconcile now)
+func (fb *FileBox) handleDR(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fb.drStatus())
+
+	case "POST":
+		if !fb.dr.enabled() || fb.s3Client == nil {
+			http.Error(w, "DR replication is not configured", http.StatusConflict)
+			return
+		}
+		report := fb.reconcileDR(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,283 @@
+// Upload durability reporting for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"filebox/pkg/containerformat"
+)
+
+// Durability levels, weakest first
+const (
+	DurabilityLocal      = "local"      // Written to the local page cache only
+	DurabilityFsynced    = "fsynced"    // Flushed to the local disk
+	DurabilityReplicated = "replicated" // Acknowledged by at least one replica
+)
+
+// Durability modes
+const (
+	DurabilityModeAsync = "async" // FSYNC_WRITES and FSYNC_MANIFESTS pick what is flushed
+	DurabilityModeSync  = "sync"  // The record and its manifest are fsynced before replication and the ack
+)
+
+// Guarantees an upload response can list
+const (
+	GuaranteeWritten        = "written"         // In the local container file (page cache)
+	GuaranteeFsynced        = "fsynced"         // Container file flushed to disk
+	GuaranteeManifestSynced = "manifest_synced" // Blob index entry on disk, so a crash cannot orphan the record
+	GuaranteeReplicated     = "replicated"      // Acknowledged by at least one replica
+)
+
+// DurabilityConfig - How much durability an upload waits for before it is acknowledged
+type DurabilityConfig struct {
+	Mode           string
+	FsyncWrites    bool          // Fsync the container file after every append
+	FsyncManifests bool          // Fsync manifest files when the manifest backend writes them
+	AckReplicas    int           // Replica acknowledgments to wait for before responding
+	AckTimeout     time.Duration // Longest time to wait for replica acknowledgments
+}
+
+// Durability - Guarantees met by a blob
+type Durability struct {
+	Level          string             `json:"level"`
+	Mode           string             `json:"mode,omitempty"`
+	Fsynced        bool               `json:"fsynced"`
+	ManifestSynced bool               `json:"manifest_synced"`
+	Replicas       int                `json:"replicas"`             // Replicas holding the blob
+	Guarantees     []string           `json:"guarantees,omitempty"` // Every guarantee met, weakest first
+	Timings        *DurabilityTimings `json:"timings,omitempty"`    // Where the upload spent its time
+}
+
+// DurabilityTimings - Milliseconds spent on each step of an upload, to
+// weigh durability against latency
+type DurabilityTimings struct {
+	Write       float64 `json:"write_ms"`
+	Fsync       float64 `json:"fsync_ms"`
+	Manifest    float64 `json:"manifest_ms"`
+	Replication float64 `json:"replication_ms"` // Waiting for ACK_REPLICAS
+}
+
+// millis converts a duration for DurabilityTimings
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// BlobStatus - Response for GET /blob/{id}/status: where a blob physically lives
+type BlobStatus struct {
+	ID           string            `json:"id"`
+	FileID       string            `json:"file_id"`
+	Offset       int64             `json:"offset"` // Start of the blob data in the container
+	Length       int64             `json:"length"`
+	Checksum     uint32            `json:"checksum"` // Frame checksum of the blob data
+	Hash         string            `json:"hash"`     // Algorithm the blob is verified with
+	Digest       string            `json:"digest,omitempty"`
+	Durability   Durability        `json:"durability"`
+	Replicas     []ReplicaStatus   `json:"replicas"`
+	Upload       string            `json:"upload"` // "pending", "uploading", "uploaded" or "evicted"
+	S3Key        string            `json:"s3_key,omitempty"`
+	UploadedAt   *time.Time        `json:"uploaded_at,omitempty"`
+	StorageClass string            `json:"storage_class,omitempty"`
+	DRReplicated *time.Time        `json:"dr_replicated_at,omitempty"` // When the container reached the DR bucket
+	Quarantined  bool              `json:"quarantined"`
+	Deleted      bool              `json:"deleted"`
+	DeletedAt    *time.Time        `json:"deleted_at,omitempty"`
+	PurgeAfter   *time.Time        `json:"purge_after,omitempty"`  // End of the undelete window
+	LegalHold    string            `json:"legal_hold,omitempty"`   // "blob" or "container" when held
+	Variants     map[string]string `json:"variants,omitempty"`     // Derived blobs such as thumbnails
+	Scan         *ScanResult       `json:"scan,omitempty"`         // Content scan state and verdict
+	CustomerKey  bool              `json:"customer_key,omitempty"` // Reads need the client's key
+	CopyOf       string            `json:"copy_of,omitempty"`      // Source of an instant copy
+	Segments     []string          `json:"segments,omitempty"`     // Blobs a composed blob is read from
+	Refs         int               `json:"refs"`                   // Live blobs sharing these bytes, this one included
+}
+
+// ReplicaStatus - How much of a blob's container a replica has acknowledged
+type ReplicaStatus struct {
+	Host    string `json:"host"`
+	Acked   int64  `json:"acked_bytes"`
+	HasBlob bool   `json:"has_blob"`
+}
+
+// loadDurabilityConfig reads DURABILITY_MODE, FSYNC_WRITES, FSYNC_MANIFESTS,
+// ACK_REPLICAS and ACK_TIMEOUT
+func loadDurabilityConfig() DurabilityConfig {
+	mode := getEnvOrDefault("DURABILITY_MODE", DurabilityModeAsync)
+	if mode != DurabilityModeAsync && mode != DurabilityModeSync {
+		log.Printf("Invalid DURABILITY_MODE %q, using %s", mode, DurabilityModeAsync)
+		mode = DurabilityModeAsync
+	}
+	sync := mode == DurabilityModeSync
+	return DurabilityConfig{
+		Mode:           mode,
+		FsyncWrites:    sync || getEnvBool("FSYNC_WRITES", false),
+		FsyncManifests: sync || getEnvBool("FSYNC_MANIFESTS", false),
+		AckReplicas:    int(getEnvInt("ACK_REPLICAS", 0)),
+		AckTimeout:     getEnvDuration("ACK_TIMEOUT", 5*time.Second),
+	}
+}
+
+// finish fills in the level and the list of guarantees met
+func (d *Durability) finish() {
+	d.Level = d.level()
+	d.Guarantees = []string{GuaranteeWritten}
+	if d.Fsynced {
+		d.Guarantees = append(d.Guarantees, GuaranteeFsynced)
+	}
+	if d.ManifestSynced {
+		d.Guarantees = append(d.Guarantees, GuaranteeManifestSynced)
+	}
+	if d.Replicas > 0 {
+		d.Guarantees = append(d.Guarantees, GuaranteeReplicated)
+	}
+}
+
+// level names the strongest guarantee met
+func (d Durability) level() string {
+	switch {
+	case d.Replicas > 0:
+		return DurabilityReplicated
+	case d.Fsynced:
+		return DurabilityFsynced
+	default:
+		return DurabilityLocal
+	}
+}
+
+// awaitReplicaAcks waits for the configured number of replica acknowledgments
+// and returns how many arrived, or as many as had when ctx ends. Replication
+// continues in the background.
+func (fb *FileBox) awaitReplicaAcks(ctx context.Context, acks <-chan error, sent int) int {
+	want := fb.durability.AckReplicas
+	if want > sent {
+		want = sent
+	}
+	if want <= 0 {
+		return 0
+	}
+
+	timeout := time.NewTimer(fb.durability.AckTimeout)
+	defer timeout.Stop()
+
+	succeeded := 0
+	for received := 0; received < sent && succeeded < want; received++ {
+		select {
+		case err := <-acks:
+			if err == nil {
+				succeeded++
+			}
+		case <-timeout.C:
+			return succeeded
+		case <-ctx.Done():
+			// Nobody is left to tell; the record keeps replicating in the background
+			fb.disconnects.replication.Add(1)
+			return succeeded
+		}
+	}
+	return succeeded
+}
+
+// recordReplicaAck notes that a replica holds a container up to size bytes
+func (fb *FileBox) recordReplicaAck(containerFile *ContainerFile, host string, size int64) {
+	fb.fileLock.Lock()
+	if containerFile.Replicated == nil {
+		containerFile.Replicated = make(map[string]int64)
+	}
+	if size > containerFile.Replicated[host] {
+		containerFile.Replicated[host] = size
+	}
+	fb.fileLock.Unlock()
+
+	if err := fb.meta.RecordReplication(containerFile.FID.String(), host, size); err != nil {
+		log.Printf("Error recording replication of %s to %s: %v", containerFile.FID.String(), host, err)
+	}
+}
+
+// blobStatus reports the current durability and upload progress of a blob
+func (fb *FileBox) blobStatus(blobID string) (*BlobStatus, bool) {
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+
+	containerFile, blobInfo, exists := fb.lookupBlob(blobID)
+	if !exists {
+		return nil, false
+	}
+
+	status := &BlobStatus{
+		ID:           blobID,
+		FileID:       containerFile.FID.String(),
+		Offset:       blobInfo.Offset,
+		Length:       blobInfo.Length,
+		Checksum:     blobInfo.Checksum,
+		Hash:         string(containerformat.CRC32C),
+		Digest:       blobInfo.Digest,
+		Replicas:     make([]ReplicaStatus, 0, len(fb.replicas)),
+		Upload:       "pending",
+		StorageClass: containerFile.StorageClass,
+		Quarantined:  containerFile.Quarantined,
+		CustomerKey:  blobInfo.CustomerKey,
+	}
+
+	if blobInfo.HashAlgorithm != "" {
+		status.Hash = blobInfo.HashAlgorithm
+	}
+	status.Durability.Mode = fb.durability.Mode
+	status.Durability.Fsynced = fb.durability.FsyncWrites || fb.writeMode.synced()
+	status.Durability.ManifestSynced = fb.meta.Durable()
+	blobEnd := blobInfo.Offset + blobInfo.Length
+	for _, host := range fb.replicas {
+		acked := containerFile.Replicated[host]
+		status.Replicas = append(status.Replicas, ReplicaStatus{Host: host, Acked: acked, HasBlob: acked >= blobEnd})
+		if acked >= blobEnd {
+			status.Durability.Replicas++
+		}
+	}
+	status.Durability.finish()
+
+	trash := fb.deleteResponse(blobInfo)
+	status.Deleted, status.DeletedAt, status.PurgeAfter = trash.Deleted, trash.DeletedAt, trash.PurgeAfter
+	status.LegalHold = heldBy(containerFile, blobInfo)
+	status.Variants = blobInfo.Variants
+	status.Scan = blobInfo.Scan
+	status.CopyOf = blobInfo.CopyOf
+	status.Segments = blobInfo.Segments
+	status.Refs = fb.blobRefs(containerFile, blobInfo)
+
+	switch {
+	case containerFile.Uploaded:
+		status.Upload = "uploaded"
+		if containerFile.Evicted {
+			status.Upload = "evicted" // Only the S3 copy is left
+		}
+		status.S3Key = fb.containerS3Key(containerFile)
+		if !containerFile.UploadedAt.IsZero() {
+			uploadedAt := containerFile.UploadedAt
+			status.UploadedAt = &uploadedAt
+		}
+		if !containerFile.DRReplicatedAt.IsZero() {
+			drReplicatedAt := containerFile.DRReplicatedAt
+			status.DRReplicated = &drReplicatedAt
+		}
+	case containerFile.Uploading:
+		status.Upload = "uploading"
+	}
+	return status, true
+}
+
+// handleBlobStatus serves GET /blob/{id}/status
+func (fb *FileBox) handleBlobStatus(w http.ResponseWriter, blobID string) {
+	status, exists := fb.blobStatus(blobID)
+	if !exists {
+		http.Error(w, "Blob not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
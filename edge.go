@@ -0,0 +1,605 @@
+// Edge cache mode for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An edge node holds no blobs of its own. It sits close to readers, far
+// from the cluster, and keeps copies of what they read: blob and key reads
+// are served from an on-disk cache and pulled from an upstream node on a
+// miss. Everything else, uploads and deletes included, is passed upstream
+// unchanged. When no upstream answers, blobs whose S3 location the edge has
+// already learned are read straight from the bucket.
+
+const (
+	edgeHeader         = "X-FileBox-Edge"        // Sent upstream by edge nodes
+	edgeLocationHeader = "X-FileBox-S3-Location" // Returned to edge nodes for plaintext uploaded blobs
+	edgeCacheHeader    = "X-FileBox-Cache"       // How an edge node served a read
+	edgeMaxLocations   = 1 << 20                 // S3 locations remembered after their data is evicted
+	edgeCacheDir       = "edge"                  // Under the storage directory
+)
+
+// How an edge node served a request, used in X-FileBox-Cache and the "result" metric label
+const (
+	edgeResultHit     = "hit"       // Served from the cache
+	edgeResultMiss    = "miss"      // Pulled from an upstream node
+	edgeResultStale   = "stale"     // Expired copy served while no upstream answered
+	edgeResultS3      = "s3"        // Read from S3 while no upstream answered
+	edgeResultForward = "forwarded" // Passed upstream uncached
+)
+
+var edgeResults = []string{edgeResultHit, edgeResultMiss, edgeResultStale, edgeResultS3, edgeResultForward}
+
+// EdgeConfig - Upstream nodes and how long pulled copies are kept
+type EdgeConfig struct {
+	Upstreams  []string      `json:"upstreams"`
+	CacheBytes int64         `json:"cache_bytes"` // On disk, least recently used copies go first
+	BlobTTL    time.Duration `json:"blob_ttl"`    // Blob IDs never change content; only deletes go unnoticed
+	KeyTTL     time.Duration `json:"key_ttl"`     // Named keys can be pointed at new blobs
+	Timeout    time.Duration `json:"timeout"`     // Per upstream request
+}
+
+// loadEdge reads EDGE_UPSTREAMS, EDGE_CACHE_BYTES, EDGE_BLOB_TTL,
+// EDGE_KEY_TTL and EDGE_TIMEOUT; nil unless upstreams are set. Copies left
+// by the last run are dropped, since their age is unknown.
+func loadEdge(storageDir string) *edgeCache {
+	var upstreams []string
+	for _, upstream := range strings.Split(getEnvOrDefault("EDGE_UPSTREAMS", ""), ",") {
+		if upstream = strings.TrimRight(strings.TrimSpace(upstream), "/"); upstream == "" {
+			continue
+		}
+		if !strings.Contains(upstream, "://") {
+			upstream = "http://" + upstream
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	if len(upstreams) == 0 {
+		return nil
+	}
+
+	config := EdgeConfig{
+		Upstreams:  upstreams,
+		CacheBytes: getEnvInt("EDGE_CACHE_BYTES", 10*1024*1024*1024),
+		BlobTTL:    getEnvDuration("EDGE_BLOB_TTL", 24*time.Hour),
+		KeyTTL:     getEnvDuration("EDGE_KEY_TTL", time.Minute),
+		Timeout:    getEnvDuration("EDGE_TIMEOUT", 30*time.Second),
+	}
+	dir := filepath.Join(storageDir, edgeCacheDir)
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Error clearing edge cache %s: %v", dir, err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Error creating edge cache %s: %v", dir, err)
+	}
+
+	e := &edgeCache{
+		config:    config,
+		dir:       dir,
+		client:    &http.Client{Timeout: config.Timeout},
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+		locations: make(map[string]url.Values),
+		results:   make(map[string]*atomic.Int64, len(edgeResults)),
+	}
+	for _, result := range edgeResults {
+		e.results[result] = &atomic.Int64{}
+	}
+	e.proxy = &httputil.ReverseProxy{
+		Rewrite:        e.rewrite,
+		ModifyResponse: e.afterWrite,
+		ErrorHandler:   e.forwardFailed,
+	}
+	log.Printf("Running as an edge cache in front of %s (%d bytes)", strings.Join(upstreams, ", "), config.CacheBytes)
+	return e
+}
+
+// edgeEntry - One cached response
+type edgeEntry struct {
+	path        string
+	file        string
+	size        int64
+	contentType string
+	fetched     time.Time
+	expires     time.Time
+	transient   bool // Larger than the whole cache; deleted once served
+}
+
+// edgeCache - Pulled copies on disk, indexed in memory
+type edgeCache struct {
+	config EdgeConfig
+	dir    string
+	client *http.Client
+	proxy  *httputil.ReverseProxy
+
+	preferred atomic.Int32 // Upstream tried first; moves on when it fails
+	sequence  atomic.Int64 // Names cache files
+
+	mu        sync.Mutex
+	lru       *list.List // Front is most recently used
+	entries   map[string]*list.Element
+	bytes     int64
+	locations map[string]url.Values // Cache key -> S3 location, kept after eviction
+
+	results        map[string]*atomic.Int64
+	upstreamErrors atomic.Int64
+}
+
+// edgeCacheKey returns the cache key of a read, or "" for reads that must
+// not be cached: blob sub-resources and reads with a customer key
+func edgeCacheKey(r *http.Request) string {
+	if (r.Method != "GET" && r.Method != "HEAD") || r.Header.Get(customerKeyHeader) != "" {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/key/") && len(r.URL.Path) > len("/key/"):
+		return r.URL.Path
+	case strings.HasPrefix(r.URL.Path, "/blob/") && len(r.URL.Path) > len("/blob/") &&
+		!strings.Contains(r.URL.Path[len("/blob/"):], "/"):
+		if variant := r.URL.Query().Get("variant"); variant != "" {
+			return r.URL.Path + "?variant=" + url.QueryEscape(variant)
+		}
+		return r.URL.Path
+	}
+	return ""
+}
+
+// edgeRouter puts the edge cache in front of the data plane. Admin, debug
+// and metrics endpoints stay local; peer endpoints are refused, since an
+// edge node is no one's replica.
+func (fb *FileBox) edgeRouter(next http.Handler) http.Handler {
+	if fb.edge == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/debug/") || path == "/metrics":
+			next.ServeHTTP(w, r)
+		case path == "/replicate" || strings.HasPrefix(path, "/cluster/") || strings.HasPrefix(path, "/container/"):
+			http.Error(w, "Edge nodes hold no data and replicate nothing", http.StatusForbidden)
+		default:
+			if key := edgeCacheKey(r); key != "" {
+				fb.serveEdgeRead(w, r, key)
+				return
+			}
+			fb.edge.results[edgeResultForward].Add(1)
+			fb.edge.proxy.ServeHTTP(w, r)
+		}
+	})
+}
+
+// serveEdgeRead serves a blob or key read from the cache, an upstream node,
+// a stale copy or S3, in that order
+func (fb *FileBox) serveEdgeRead(w http.ResponseWriter, r *http.Request, key string) {
+	e := fb.edge
+	entry, fresh := e.lookup(key)
+	if entry != nil && fresh {
+		e.serveEntry(w, r, entry, edgeResultHit)
+		return
+	}
+
+	resp, err := e.fetch(r.Context(), key)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if entry, err = e.store(key, resp); err == nil {
+				e.serveEntry(w, r, entry, edgeResultMiss)
+				return
+			}
+			log.Printf("Error caching %s: %v", key, err)
+			http.Error(w, "Error caching upstream response", http.StatusBadGateway)
+			return
+		}
+
+		// Missing, deleted, archived or blocked upstream: pass the answer on
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+			e.remove(key)
+		}
+		e.results[edgeResultForward].Add(1)
+		copyResponse(w, resp)
+		return
+	}
+
+	// No upstream answered
+	if entry != nil {
+		e.serveEntry(w, r, entry, edgeResultStale)
+		return
+	}
+	if blobData, ok := fb.readEdgeFromS3(r.Context(), key); ok {
+		e.results[edgeResultS3].Add(1)
+		w.Header().Set(edgeCacheHeader, edgeResultS3)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Write(blobData)
+		return
+	}
+	http.Error(w, fmt.Sprintf("No upstream node answered: %v", err), http.StatusBadGateway)
+}
+
+// lookup returns the cached copy for a key and whether it is still fresh
+func (e *edgeCache) lookup(key string) (*edgeEntry, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	element, ok := e.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e.lru.MoveToFront(element)
+	entry := element.Value.(*edgeEntry)
+	return entry, timeNow().Before(entry.expires)
+}
+
+// serveEntry answers a read from a cached file, with range support
+func (e *edgeCache) serveEntry(w http.ResponseWriter, r *http.Request, entry *edgeEntry, result string) {
+	file, err := os.Open(entry.file)
+	if err != nil {
+		// Evicted between lookup and open
+		e.remove(entry.path)
+		http.Error(w, "Cached copy went away; retry", http.StatusServiceUnavailable)
+		return
+	}
+	defer file.Close()
+	if entry.transient {
+		defer os.Remove(entry.file) // Open handles keep the data readable until then
+	}
+
+	e.results[result].Add(1)
+	w.Header().Set(edgeCacheHeader, result)
+	if entry.contentType != "" {
+		w.Header().Set("Content-Type", entry.contentType)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Age", strconv.Itoa(int(timeNow().Sub(entry.fetched).Seconds())))
+	http.ServeContent(w, r, "", entry.fetched, file)
+}
+
+// fetch asks each upstream in turn, starting with the last one that
+// answered. Transport errors and 5xx answers move on to the next one.
+func (e *edgeCache) fetch(ctx context.Context, key string) (*http.Response, error) {
+	var lastErr error
+	start := int(e.preferred.Load())
+	for i := range e.config.Upstreams {
+		index := (start + i) % len(e.config.Upstreams)
+		req, err := http.NewRequestWithContext(ctx, "GET", e.config.Upstreams[index]+key, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(edgeHeader, "true")
+		resp, err := e.client.Do(req)
+		if err == nil && resp.StatusCode < 500 {
+			e.preferred.Store(int32(index))
+			return resp, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%s answered %s", e.config.Upstreams[index], resp.Status)
+			resp.Body.Close()
+		}
+		e.upstreamErrors.Add(1)
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// store writes an upstream response to the cache, evicting the least
+// recently used copies to make room. Responses larger than the whole cache
+// are written, served once and deleted.
+func (e *edgeCache) store(key string, resp *http.Response) (*edgeEntry, error) {
+	temp, err := os.CreateTemp(e.dir, "fetch-")
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(temp, resp.Body)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return nil, err
+	}
+
+	ttl := e.config.BlobTTL
+	if strings.HasPrefix(key, "/key/") {
+		ttl = e.config.KeyTTL
+	}
+	now := timeNow()
+	entry := &edgeEntry{
+		path:        key,
+		file:        filepath.Join(e.dir, fmt.Sprintf("%s-%d", edgeFileName(key), e.sequence.Add(1))),
+		size:        size,
+		contentType: resp.Header.Get("Content-Type"),
+		fetched:     now,
+		expires:     now.Add(ttl),
+	}
+	if err := os.Rename(temp.Name(), entry.file); err != nil {
+		os.Remove(temp.Name())
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if location := resp.Header.Get(edgeLocationHeader); location != "" {
+		e.rememberLocationLocked(key, location)
+	}
+	e.removeLocked(key)
+	if size > e.config.CacheBytes {
+		entry.transient = true
+		return entry, nil
+	}
+	for e.bytes+size > e.config.CacheBytes && e.lru.Len() > 0 {
+		e.removeLocked(e.lru.Back().Value.(*edgeEntry).path)
+	}
+	e.entries[key] = e.lru.PushFront(entry)
+	e.bytes += size
+	return entry, nil
+}
+
+// warm pulls a blob or key into the cache ahead of its readers
+func (e *edgeCache) warm(ctx context.Context, key string) (int64, error) {
+	resp, err := e.fetch(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("upstream answered %s", resp.Status)
+	}
+	entry, err := e.store(key, resp)
+	if err != nil {
+		return 0, err
+	}
+	if entry.transient {
+		os.Remove(entry.file)
+		return 0, fmt.Errorf("%d bytes do not fit in EDGE_CACHE_BYTES", entry.size)
+	}
+	return entry.size, nil
+}
+
+// edgeFileName turns a cache key into a file name
+func edgeFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// remove drops a cached copy
+func (e *edgeCache) remove(key string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.removeLocked(key)
+}
+
+// removeLocked drops a cached copy. Callers must hold e.mu.
+func (e *edgeCache) removeLocked(key string) {
+	element, ok := e.entries[key]
+	if !ok {
+		return
+	}
+	entry := element.Value.(*edgeEntry)
+	e.lru.Remove(element)
+	delete(e.entries, key)
+	e.bytes -= entry.size
+	os.Remove(entry.file)
+}
+
+// invalidate drops every cached copy of a blob or key, variants included,
+// and forgets its S3 location
+func (e *edgeCache) invalidate(path string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key := range e.entries {
+		if key == path || strings.HasPrefix(key, path+"?") {
+			e.removeLocked(key)
+		}
+	}
+	for key := range e.locations {
+		if key == path || strings.HasPrefix(key, path+"?") {
+			delete(e.locations, key)
+		}
+	}
+}
+
+// rememberLocationLocked records where a blob lives in S3. When the table
+// is full an arbitrary location is forgotten. Callers must hold e.mu.
+func (e *edgeCache) rememberLocationLocked(key, header string) {
+	location, err := url.ParseQuery(header)
+	if err != nil {
+		return
+	}
+	if _, ok := e.locations[key]; !ok && len(e.locations) >= edgeMaxLocations {
+		for other := range e.locations {
+			delete(e.locations, other)
+			break
+		}
+	}
+	e.locations[key] = location
+}
+
+// readEdgeFromS3 reads a blob from its recorded S3 location and verifies it
+func (fb *FileBox) readEdgeFromS3(ctx context.Context, key string) ([]byte, bool) {
+	e := fb.edge
+	e.mu.Lock()
+	location, ok := e.locations[key]
+	e.mu.Unlock()
+	if !ok || fb.s3Client == nil {
+		return nil, false
+	}
+
+	offset, err1 := strconv.ParseInt(location.Get("offset"), 10, 64)
+	length, err2 := strconv.ParseInt(location.Get("length"), 10, 64)
+	checksum, err3 := strconv.ParseUint(location.Get("checksum"), 10, 32)
+	if err1 != nil || err2 != nil || err3 != nil || length < 0 {
+		return nil, false
+	}
+	blob := BlobInfo{
+		ID:            location.Get("id"),
+		Checksum:      uint32(checksum),
+		HashAlgorithm: location.Get("hash_algorithm"),
+		Digest:        location.Get("digest"),
+	}
+	blobData := make([]byte, length)
+	if err := fb.readS3Range(ctx, location.Get("key"), offset, blobData); err != nil {
+		log.Printf("Error reading %s from S3: %v", key, err)
+		return nil, false
+	}
+	if !verifyBlob(blob, blobData) {
+		log.Printf("Checksum mismatch reading %s from S3; dropping its location", key)
+		e.invalidate(key)
+		return nil, false
+	}
+	return blobData, true
+}
+
+// setEdgeLocation tells an edge node where a plaintext, uploaded blob lives
+// in S3, so it can read it there while no node answers. Blobs that need
+// decrypting or decompressing, and composed blobs, are left out.
+func (fb *FileBox) setEdgeLocation(w http.ResponseWriter, r *http.Request, blobID string) {
+	if r.Header.Get(edgeHeader) == "" {
+		return
+	}
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+	containerFile, blob, ok := fb.lookupBlob(blobID)
+	if !ok || !containerFile.Uploaded || containerFile.Encrypted || blob.CustomerKey || blob.Compression != "" || len(blob.Segments) > 0 {
+		return
+	}
+	location := url.Values{}
+	location.Set("key", fb.containerS3Key(containerFile))
+	location.Set("id", blob.ID)
+	location.Set("offset", strconv.FormatInt(blob.Offset, 10))
+	location.Set("length", strconv.FormatInt(blob.Length, 10))
+	location.Set("checksum", strconv.FormatUint(uint64(blob.Checksum), 10))
+	if blob.HashAlgorithm != "" {
+		location.Set("hash_algorithm", blob.HashAlgorithm)
+		location.Set("digest", blob.Digest)
+	}
+	w.Header().Set(edgeLocationHeader, location.Encode())
+}
+
+// rewrite sends a forwarded request to the preferred upstream
+func (e *edgeCache) rewrite(pr *httputil.ProxyRequest) {
+	target, _ := url.Parse(e.config.Upstreams[int(e.preferred.Load())%len(e.config.Upstreams)])
+	pr.SetURL(target)
+	pr.SetXForwarded()
+	pr.Out.Header.Set(edgeHeader, "true")
+}
+
+// afterWrite drops cached copies a successful forwarded write may have changed
+func (e *edgeCache) afterWrite(resp *http.Response) error {
+	req := resp.Request
+	if !isWrite(req) || resp.StatusCode >= 300 {
+		return nil
+	}
+	if strings.HasPrefix(req.URL.Path, "/blob/") {
+		blobID, _, _ := strings.Cut(req.URL.Path[len("/blob/"):], "/")
+		e.invalidate("/blob/" + blobID)
+	}
+	if strings.HasPrefix(req.URL.Path, "/key/") {
+		e.invalidate(req.URL.Path)
+	}
+	if key := req.Header.Get("X-FileBox-Key"); key != "" {
+		e.invalidate("/key/" + key)
+	}
+	return nil
+}
+
+// forwardFailed answers a forwarded request no upstream took and moves on
+// to the next upstream for later requests. Request bodies cannot be
+// replayed, so the client retries.
+func (e *edgeCache) forwardFailed(w http.ResponseWriter, r *http.Request, err error) {
+	e.upstreamErrors.Add(1)
+	current := e.preferred.Load()
+	e.preferred.CompareAndSwap(current, (current+1)%int32(len(e.config.Upstreams)))
+	log.Printf("Error forwarding %s %s upstream: %v", r.Method, r.URL.Path, err)
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Upstream unavailable", http.StatusBadGateway)
+}
+
+// copyResponse passes an upstream answer to the client
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// EdgeStatus - Response for GET /admin/edge
+type EdgeStatus struct {
+	Config         EdgeConfig       `json:"config"`
+	Preferred      string           `json:"preferred_upstream"`
+	Entries        int              `json:"entries"`
+	Bytes          int64            `json:"bytes"`
+	Locations      int              `json:"s3_locations"`
+	Requests       map[string]int64 `json:"requests"` // By result
+	UpstreamErrors int64            `json:"upstream_errors"`
+}
+
+// status reports the cache's occupancy and results
+func (e *edgeCache) status() EdgeStatus {
+	status := EdgeStatus{
+		Config:         e.config,
+		Preferred:      e.config.Upstreams[int(e.preferred.Load())%len(e.config.Upstreams)],
+		Requests:       make(map[string]int64, len(edgeResults)),
+		UpstreamErrors: e.upstreamErrors.Load(),
+	}
+	e.mu.Lock()
+	status.Entries, status.Bytes, status.Locations = len(e.entries), e.bytes, len(e.locations)
+	e.mu.Unlock()
+	for result, n := range e.results {
+		status.Requests[result] = n.Load()
+	}
+	return status
+}
+
+// purge drops every cached copy and remembered location
+func (e *edgeCache) purge() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key := range e.entries {
+		e.removeLocked(key)
+	}
+	clear(e.locations)
+}
+
+// handleEdge serves GET /admin/edge and DELETE /admin/edge (purge the cache)
+func (fb *FileBox) handleEdge(w http.ResponseWriter, r *http.Request) {
+	if fb.edge == nil {
+		http.Error(w, "Not an edge node (EDGE_UPSTREAMS)", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "DELETE":
+		fb.edge.purge()
+		log.Printf("Edge cache purged")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.edge.status())
+}
@@ -0,0 +1,333 @@
+// Container encryption and key escrow for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Every container gets its own AES-256 data key. The data key is stored
+// wrapped by a master key (a local key or a KMS key) in the container's
+// metadata and, once the container is uploaded, in an escrow object next to
+// it in S3, so any node holding the master key can decrypt the container.
+//
+// Each blob is stored as nonce || AES-GCM ciphertext. Checksums cover the
+// stored bytes, so fsck and repair work without the keys.
+
+const (
+	dataKeySize       = 32
+	encryptedOverhead = 12 + 16 // GCM nonce and tag
+	keyEscrowSuffix   = ".key"
+)
+
+// KeyWrapper - Wraps and unwraps per-container data keys with a master key
+type KeyWrapper interface {
+	Wrap(ctx context.Context, dataKey []byte) ([]byte, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+	KeyID() string // Identifies the master key
+}
+
+// KeyEscrow - Escrow object stored in S3 next to an encrypted container
+type KeyEscrow struct {
+	FileID     string    `json:"file_id"`
+	WrappedKey []byte    `json:"wrapped_key"`
+	KeyID      string    `json:"key_id"`
+	Created    time.Time `json:"created"`
+}
+
+// dataKeyCache holds unwrapped data keys by container ID
+type dataKeyCache struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+// loadKeyWrapper reads ENCRYPTION_KMS_KEY_ID or ENCRYPTION_MASTER_KEY (base64,
+// 32 bytes). It returns nil when neither is set and encryption is disabled.
+func loadKeyWrapper(awsConfig aws.Config) (KeyWrapper, error) {
+	if keyID := os.Getenv("ENCRYPTION_KMS_KEY_ID"); keyID != "" {
+		log.Printf("Encrypting new containers with data keys wrapped by KMS key %s", keyID)
+		return &kmsKeyWrapper{client: kms.NewFromConfig(awsConfig), keyID: keyID}, nil
+	}
+
+	encoded := os.Getenv("ENCRYPTION_MASTER_KEY")
+	if encoded == "" {
+		return nil, nil
+	}
+	masterKey, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(masterKey) != dataKeySize {
+		return nil, fmt.Errorf("ENCRYPTION_MASTER_KEY must be %d base64-encoded bytes", dataKeySize)
+	}
+	wrapper, err := newMasterKeyWrapper(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Encrypting new containers with data keys wrapped by master key %s", wrapper.KeyID())
+	return wrapper, nil
+}
+
+// masterKeyWrapper - Wraps data keys with a local AES-256-GCM master key
+type masterKeyWrapper struct {
+	aead  cipher.AEAD
+	keyID string
+}
+
+func newMasterKeyWrapper(masterKey []byte) (*masterKeyWrapper, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	// Fingerprint, so a wrong master key is reported as such rather than as corruption
+	sum := sha256.Sum256(masterKey)
+	return &masterKeyWrapper{aead: aead, keyID: "local:" + hex.EncodeToString(sum[:8])}, nil
+}
+
+func (m *masterKeyWrapper) Wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	return seal(m.aead, dataKey, []byte(m.keyID))
+}
+
+func (m *masterKeyWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return open(m.aead, wrapped, []byte(m.keyID))
+}
+
+func (m *masterKeyWrapper) KeyID() string {
+	return m.keyID
+}
+
+// kmsKeyWrapper - Wraps data keys with a KMS key
+type kmsKeyWrapper struct {
+	client *kms.Client
+	keyID  string
+}
+
+func (k *kmsKeyWrapper) Wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	resp, err := k.client.Encrypt(ctx, &kms.EncryptInput{KeyId: aws.String(k.keyID), Plaintext: dataKey})
+	if err != nil {
+		return nil, err
+	}
+	return resp.CiphertextBlob, nil
+}
+
+func (k *kmsKeyWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	resp, err := k.client.Decrypt(ctx, &kms.DecryptInput{KeyId: aws.String(k.keyID), CiphertextBlob: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+func (k *kmsKeyWrapper) KeyID() string {
+	return "kms:" + k.keyID
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext as nonce || ciphertext
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts nonce || ciphertext
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// containerKey returns a container's data key, creating it for a new
+// container or fetching it from the S3 escrow if the metadata lacks it
+func (fb *FileBox) containerKey(ctx context.Context, containerFile *ContainerFile) ([]byte, error) {
+	fileID := containerFile.FID.String()
+
+	fb.dataKeys.mu.Lock()
+	defer fb.dataKeys.mu.Unlock()
+
+	if key, ok := fb.dataKeys.keys[fileID]; ok {
+		return key, nil
+	}
+	if fb.keyWrapper == nil {
+		return nil, fmt.Errorf("container %s is encrypted but no master key is configured", fileID)
+	}
+
+	fb.fileLock.RLock()
+	wrapped, keyID, size := containerFile.WrappedKey, containerFile.KeyID, fb.containerSize(containerFile)
+	fb.fileLock.RUnlock()
+
+	if len(wrapped) == 0 && size > 0 {
+		escrow, err := fb.fetchKeyEscrow(ctx, containerFile)
+		if err != nil {
+			return nil, fmt.Errorf("data key for %s is missing: %v", fileID, err)
+		}
+		wrapped, keyID = escrow.WrappedKey, escrow.KeyID
+		fb.setWrappedKey(containerFile, wrapped, keyID)
+	}
+
+	var key []byte
+	var err error
+	if len(wrapped) == 0 {
+		// New container: generate its data key
+		key = make([]byte, dataKeySize)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		if wrapped, err = fb.keyWrapper.Wrap(ctx, key); err != nil {
+			return nil, fmt.Errorf("error wrapping data key: %v", err)
+		}
+		fb.setWrappedKey(containerFile, wrapped, fb.keyWrapper.KeyID())
+	} else {
+		if keyID != fb.keyWrapper.KeyID() {
+			return nil, fmt.Errorf("container %s was encrypted under master key %s, not %s", fileID, keyID, fb.keyWrapper.KeyID())
+		}
+		if key, err = fb.keyWrapper.Unwrap(ctx, wrapped); err != nil {
+			return nil, fmt.Errorf("error unwrapping data key for %s: %v", fileID, err)
+		}
+	}
+
+	fb.dataKeys.keys[fileID] = key
+	return key, nil
+}
+
+// setWrappedKey records a container's wrapped data key in its metadata
+func (fb *FileBox) setWrappedKey(containerFile *ContainerFile, wrapped []byte, keyID string) {
+	fb.fileLock.Lock()
+	containerFile.Encrypted = true
+	containerFile.WrappedKey = wrapped
+	containerFile.KeyID = keyID
+	fb.fileLock.Unlock()
+	fb.saveManifest(containerFile)
+}
+
+// encryptBlob seals a blob with its container's data key
+func (fb *FileBox) encryptBlob(containerFile *ContainerFile, blobData []byte) ([]byte, error) {
+	key, err := fb.containerKey(context.Background(), containerFile)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, blobData, []byte(containerFile.FID.String()))
+}
+
+// decryptBlob opens a blob sealed by encryptBlob
+func (fb *FileBox) decryptBlob(ctx context.Context, containerFile *ContainerFile, stored []byte) ([]byte, error) {
+	key, err := fb.containerKey(ctx, containerFile)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	blobData, err := open(aead, stored, []byte(containerFile.FID.String()))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting blob: %v", err)
+	}
+	return blobData, nil
+}
+
+// recoverKeyEscrow marks a container recovered without metadata as encrypted
+// if S3 holds an escrowed key for it
+func (fb *FileBox) recoverKeyEscrow(containerFile *ContainerFile) {
+	if fb.keyWrapper == nil || fb.s3Client == nil {
+		return
+	}
+	escrow, err := fb.fetchKeyEscrow(context.Background(), containerFile)
+	if err != nil {
+		return // Never uploaded, or not encrypted
+	}
+	containerFile.Encrypted = true
+	containerFile.WrappedKey = escrow.WrappedKey
+	containerFile.KeyID = escrow.KeyID
+	log.Printf("Recovered escrowed data key for %s", containerFile.FID.String())
+}
+
+// keyEscrowS3Key is where a container's wrapped data key is escrowed
+func (fb *FileBox) keyEscrowS3Key(containerFile *ContainerFile) string {
+	return fb.containerS3Key(containerFile) + keyEscrowSuffix
+}
+
+// escrowContainerKey uploads a container's wrapped data key next to the container
+func (fb *FileBox) escrowContainerKey(ctx context.Context, containerFile *ContainerFile) error {
+	data, err := fb.keyEscrowData(containerFile)
+	if err != nil {
+		return err
+	}
+	_, err = fb.s3Client.PutObject(withUsageTenant(ctx, containerFile.Tenant), &s3.PutObjectInput{
+		Bucket:      aws.String(fb.bucket),
+		Key:         aws.String(fb.keyEscrowS3Key(containerFile)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// keyEscrowData encodes a container's wrapped data key for escrow
+func (fb *FileBox) keyEscrowData(containerFile *ContainerFile) ([]byte, error) {
+	fb.fileLock.RLock()
+	escrow := KeyEscrow{
+		FileID:     containerFile.FID.String(),
+		WrappedKey: containerFile.WrappedKey,
+		KeyID:      containerFile.KeyID,
+		Created:    timeNow(),
+	}
+	fb.fileLock.RUnlock()
+
+	if len(escrow.WrappedKey) == 0 {
+		return nil, fmt.Errorf("container %s has no data key", escrow.FileID)
+	}
+	return json.Marshal(escrow)
+}
+
+// fetchKeyEscrow reads a container's escrowed data key from S3
+func (fb *FileBox) fetchKeyEscrow(ctx context.Context, containerFile *ContainerFile) (*KeyEscrow, error) {
+	if fb.s3Client == nil {
+		return nil, fmt.Errorf("S3 is not configured")
+	}
+	resp, err := fb.s3Client.GetObject(withUsageTenant(ctx, containerFile.Tenant), &s3.GetObjectInput{
+		Bucket: aws.String(fb.bucket),
+		Key:    aws.String(fb.keyEscrowS3Key(containerFile)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var escrow KeyEscrow
+	if err := json.NewDecoder(resp.Body).Decode(&escrow); err != nil {
+		return nil, fmt.Errorf("invalid key escrow: %v", err)
+	}
+	return &escrow, nil
+}
@@ -0,0 +1,149 @@
+// Event webhooks for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Events are things an operator should hear about without watching logs,
+// such as a disk being taken offline. Each is POSTed as JSON to every URL
+// in EVENT_WEBHOOK_URLS. Deliveries are queued and retried a few times; if
+// the queue is full, the event is dropped and logged.
+
+const (
+	eventQueueSize       = 256
+	eventDeliveryTries   = 3
+	eventSignatureHeader = "X-FileBox-Signature"
+)
+
+// Event - A notable change on this node, as sent to the webhooks
+type Event struct {
+	Type      string         `json:"type"` // e.g. "volume.offline"
+	Time      time.Time      `json:"time"`
+	MachineID uint32         `json:"machine_id"`
+	Details   map[string]any `json:"details,omitempty"`
+}
+
+// eventNotifier - Delivers events to the configured webhooks
+type eventNotifier struct {
+	urls   []string
+	secret []byte // HMAC key for the signature header; empty to skip signing
+	client *http.Client
+	queue  chan Event
+
+	delivered atomic.Int64
+	failed    atomic.Int64
+	dropped   atomic.Int64
+}
+
+// loadEventNotifier reads EVENT_WEBHOOK_URLS; nil when unset
+func loadEventNotifier() *eventNotifier {
+	var urls []string
+	for _, url := range strings.Split(getEnvOrDefault("EVENT_WEBHOOK_URLS", ""), ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+
+	n := &eventNotifier{
+		urls:   urls,
+		secret: []byte(getEnvOrDefault("EVENT_WEBHOOK_SECRET", "")),
+		client: &http.Client{Timeout: getEnvDuration("EVENT_WEBHOOK_TIMEOUT", 10*time.Second)},
+		queue:  make(chan Event, eventQueueSize),
+	}
+	go n.run()
+	log.Printf("Sending events to %d webhooks", len(urls))
+	return n
+}
+
+// emit queues an event for delivery
+func (fb *FileBox) emit(eventType string, details map[string]any) {
+	if fb.events == nil {
+		return
+	}
+	event := Event{Type: eventType, Time: timeNow().UTC(), MachineID: fb.machineID, Details: details}
+	select {
+	case fb.events.queue <- event:
+	default:
+		fb.events.dropped.Add(1)
+		log.Printf("Event queue is full; dropped %s event", eventType)
+	}
+}
+
+// run delivers queued events in order
+func (n *eventNotifier) run() {
+	for event := range n.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Error encoding %s event: %v", event.Type, err)
+			continue
+		}
+		for _, url := range n.urls {
+			if err := n.deliver(url, body); err != nil {
+				n.failed.Add(1)
+				log.Printf("Error sending %s event to %s: %v", event.Type, url, err)
+				continue
+			}
+			n.delivered.Add(1)
+		}
+	}
+}
+
+// deliver POSTs one event, retrying with backoff
+func (n *eventNotifier) deliver(url string, body []byte) error {
+	var lastErr error
+	for attempt := 0; attempt < eventDeliveryTries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<attempt) * time.Second)
+		}
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if len(n.secret) > 0 {
+			mac := hmac.New(sha256.New, n.secret)
+			mac.Write(body)
+			req.Header.Set(eventSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := n.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return lastErr
+}
+
+// stats returns deliveries by result
+func (n *eventNotifier) stats() map[string]int64 {
+	if n == nil {
+		return nil
+	}
+	return map[string]int64{
+		"delivered": n.delivered.Load(),
+		"failed":    n.failed.Load(),
+		"dropped":   n.dropped.Load(),
+	}
+}
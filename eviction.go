@@ -0,0 +1,205 @@
+// Local container eviction for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// md5ETag matches the ETag S3 returns for single-part uploads without SSE-KMS
+var md5ETag = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// EvictionPolicy - When a container's local file may be deleted in favour of S3
+type EvictionPolicy struct {
+	Enabled     bool
+	MinReplicas int           // Replicas that must hold the whole container
+	MinAge      time.Duration // Time since upload before the local copy goes
+	Interval    time.Duration // How often uploaded containers are checked
+}
+
+// loadEvictionPolicy reads EVICT_AFTER_UPLOAD, EVICT_MIN_REPLICAS, EVICT_MIN_AGE and EVICT_INTERVAL
+func loadEvictionPolicy() EvictionPolicy {
+	return EvictionPolicy{
+		Enabled:     getEnvBool("EVICT_AFTER_UPLOAD", false),
+		MinReplicas: int(getEnvInt("EVICT_MIN_REPLICAS", 1)),
+		MinAge:      getEnvDuration("EVICT_MIN_AGE", 0),
+		Interval:    getEnvDuration("EVICT_INTERVAL", 5*time.Minute),
+	}
+}
+
+// runEvictions periodically frees disk held by durably uploaded containers
+func (fb *FileBox) runEvictions() {
+	if !fb.eviction.Enabled || fb.s3Client == nil {
+		return
+	}
+	if fb.eviction.MinReplicas > len(fb.replicas) {
+		log.Printf("WARNING: EVICT_MIN_REPLICAS=%d but only %d replicas are configured; no container will be evicted",
+			fb.eviction.MinReplicas, len(fb.replicas))
+	}
+
+	ticker := time.NewTicker(fb.eviction.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fb.evictDurableContainers()
+	}
+}
+
+// evictDurableContainers evicts every container that meets the policy
+func (fb *FileBox) evictDurableContainers() {
+	var candidates []*ContainerFile
+	fb.fileLock.RLock()
+	for _, file := range fb.files.all() {
+		if fb.evictable(file) == nil {
+			candidates = append(candidates, file)
+		}
+	}
+	fb.fileLock.RUnlock()
+
+	for _, containerFile := range candidates {
+		if err := fb.evictContainer(context.Background(), containerFile); err != nil {
+			log.Printf("Not evicting container %s: %v", containerFile.FID.String(), err)
+		}
+	}
+}
+
+// evictable checks the parts of the policy that only need metadata.
+// Callers must hold fb.fileLock.
+func (fb *FileBox) evictable(containerFile *ContainerFile) error {
+	mu := fb.files.lock(containerFile)
+	mu.RLock()
+	size, writers := containerFile.Size, containerFile.writers
+	mu.RUnlock()
+
+	switch {
+	case containerFile.Evicted:
+		return fmt.Errorf("already evicted")
+	case fb.isForeign(containerFile):
+		return fmt.Errorf("owned by machine %d", containerFile.FID.MachineID)
+	case !containerFile.Uploaded || containerFile.Uploading:
+		return fmt.Errorf("not uploaded")
+	case containerFile.Quarantined || containerFile.repairing:
+		return fmt.Errorf("quarantined")
+	case writers > 0:
+		return fmt.Errorf("writes in flight")
+	case timeNow().Sub(containerFile.UploadedAt) < fb.eviction.MinAge:
+		return fmt.Errorf("uploaded less than %v ago", fb.eviction.MinAge)
+	case timeNow().Before(containerFile.warmUntil):
+		return fmt.Errorf("warmed until %s", containerFile.warmUntil.Format(time.RFC3339))
+	}
+
+	replicas := 0
+	for _, acked := range containerFile.Replicated {
+		if acked >= size {
+			replicas++
+		}
+	}
+	if replicas < fb.eviction.MinReplicas {
+		return fmt.Errorf("only %d of %d required replicas hold the whole container", replicas, fb.eviction.MinReplicas)
+	}
+	return nil
+}
+
+// evictContainer verifies the S3 copy against the local file, then deletes
+// the local file and switches the container to read-through from S3
+func (fb *FileBox) evictContainer(ctx context.Context, containerFile *ContainerFile) error {
+	head, err := fb.s3Client.HeadObject(withUsageTenant(ctx, containerFile.Tenant), &s3.HeadObjectInput{
+		Bucket: aws.String(fb.bucket),
+		Key:    aws.String(fb.containerS3Key(containerFile)),
+	})
+	if err != nil {
+		return fmt.Errorf("error checking S3 copy: %v", err)
+	}
+
+	file, err := os.Open(fb.filePathOf(containerFile))
+	if err != nil {
+		return err
+	}
+	hash := md5.New()
+	localSize, err := io.Copy(hash, file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	if aws.ToInt64(head.ContentLength) != localSize {
+		return fmt.Errorf("S3 copy is %d bytes, local file is %d", aws.ToInt64(head.ContentLength), localSize)
+	}
+	etag := strings.Trim(aws.ToString(head.ETag), `"`)
+	if md5ETag.MatchString(etag) && etag != hex.EncodeToString(hash.Sum(nil)) {
+		return fmt.Errorf("S3 copy does not match the local file (ETag %s)", etag)
+	}
+
+	// Re-check under the lock: the container may have changed while we hashed it
+	fb.fileLock.Lock()
+	if err := fb.evictable(containerFile); err != nil {
+		fb.fileLock.Unlock()
+		return err
+	}
+	if containerFile.Size != localSize {
+		fb.fileLock.Unlock()
+		return fmt.Errorf("container changed during verification")
+	}
+	containerFile.Evicted = true
+	fb.fileLock.Unlock()
+
+	// Record the eviction first so a crash never leaves metadata pointing at a deleted file
+	fb.saveManifest(containerFile)
+	filePath := fb.filePathOf(containerFile)
+	fb.mmap.forget(filePath)
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		fb.fileLock.Lock()
+		containerFile.Evicted = false
+		fb.fileLock.Unlock()
+		fb.saveManifest(containerFile)
+		return err
+	}
+
+	log.Printf("Evicted local copy of container %s (%d bytes); reads now go to S3", containerFile.FID.String(), localSize)
+	return nil
+}
+
+// recoverEvictedContainers registers containers whose local file was evicted
+// or offloaded to the federated cluster; they have metadata but nothing in
+// the storage directory. It returns how many it registered.
+func (fb *FileBox) recoverEvictedContainers() int {
+	fileIDs, err := fb.meta.ListContainers()
+	if err != nil {
+		log.Printf("Error listing containers: %v", err)
+		return 0
+	}
+
+	recovered := 0
+	for _, fileID := range fileIDs {
+		if _, exists := fb.files.get(fileID); exists {
+			continue
+		}
+		containerFile, err := fb.loadManifest(fileID)
+		if err != nil || containerFile == nil || !containerFile.Evicted || !(containerFile.Uploaded || containerFile.Federated) {
+			continue
+		}
+		fid, err := ParseFID(fileID)
+		if err != nil || !fb.ownsMachine(fid.MachineID) {
+			continue
+		}
+		containerFile.FID = fid
+		containerFile.FilePath = shardedPath(fb.pickVolume(0), fileID) // Where a repair or warm puts it back
+		fb.registerContainer(containerFile)
+		recovered++
+	}
+	return recovered
+}
@@ -0,0 +1,387 @@
+// Expired container cleanup for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// errExpiryRunning is returned when a cleanup is requested while one is in progress
+var errExpiryRunning = errors.New("expiry cleanup already running")
+
+// ExpiredContainer - An uploaded container none of whose blobs can be read again
+type ExpiredContainer struct {
+	FileID  string `json:"file_id"`
+	Key     string `json:"key"` // S3 key of the container object
+	Size    int64  `json:"size"`
+	Owner   string `json:"owner"` // Node that reported it; "local" for the leader itself
+	Deleted bool   `json:"deleted"`
+}
+
+// ExpiryReport - Outcome of one cleanup run
+type ExpiryReport struct {
+	Started        time.Time          `json:"started"`
+	Finished       time.Time          `json:"finished"`
+	Containers     []ExpiredContainer `json:"containers"`
+	BytesReclaimed int64              `json:"bytes_reclaimed"`
+	Errors         []string           `json:"errors,omitempty"`
+}
+
+// expiryState - Serializes cleanup runs, keeps the last report and the drops
+// peers have not yet acknowledged
+type expiryState struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	running bool
+	last    *ExpiryReport
+	pending map[string][]string // Replica -> file IDs it still has to drop
+}
+
+// loadExpiryState reads S3_EXPIRY_INTERVAL
+func loadExpiryState() *expiryState {
+	return &expiryState{
+		interval: getEnvDuration("S3_EXPIRY_INTERVAL", time.Hour),
+		pending:  make(map[string][]string),
+	}
+}
+
+// containerExpired reports whether every blob in an uploaded container this
+// node owns has expired or left the trash, so its S3 object serves nothing.
+// Segments of a live composed blob elsewhere keep it.
+// Callers must hold fb.fileLock.
+func (fb *FileBox) containerExpired(containerFile *ContainerFile, now time.Time) bool {
+	blobs := fb.containerBlobs(containerFile)
+	if !containerFile.Uploaded || containerFile.Uploading || containerFile.Quarantined ||
+		len(blobs) == 0 || fb.isForeign(containerFile) {
+		return false
+	}
+	for _, blob := range blobs {
+		if blob.ChunkHash != "" {
+			continue // Kept by the composed blobs reading it, if any
+		}
+		if blob.Uncommitted {
+			continue // Aborted uploads; in-flight ones keep the container open
+		}
+		if !expired(containerFile, blob, now) && !fb.purgeable(containerFile, blob, now) {
+			return false
+		}
+	}
+	return !fb.segmentsPinned(containerFile, now)
+}
+
+// localExpiredContainers lists this node's expired containers
+func (fb *FileBox) localExpiredContainers() []ExpiredContainer {
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+
+	now := timeNow()
+	containers := make([]ExpiredContainer, 0)
+	for _, containerFile := range fb.files.all() {
+		if fb.containerExpired(containerFile, now) {
+			containers = append(containers, ExpiredContainer{
+				FileID: containerFile.FID.String(),
+				Key:    fb.containerS3Key(containerFile),
+				Size:   fb.containerSize(containerFile),
+			})
+		}
+	}
+	return containers
+}
+
+// runExpiry removes expired containers from S3 on the configured interval (leader only)
+func (fb *FileBox) runExpiry() {
+	if fb.s3Client == nil || !fb.isLeader() || fb.expiry.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(fb.expiry.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report, err := fb.expireContainers(context.Background())
+		if err != nil {
+			log.Printf("Expiry cleanup skipped: %v", err)
+			continue
+		}
+		report.log()
+	}
+}
+
+// expireContainers gathers expired containers from this node and every
+// replica, deletes their S3 objects once, and tells every node to drop its
+// copy and metadata. Only the leader runs it, so each object is deleted by one node.
+func (fb *FileBox) expireContainers(ctx context.Context) (*ExpiryReport, error) {
+	fb.expiry.mu.Lock()
+	if fb.expiry.running {
+		fb.expiry.mu.Unlock()
+		return nil, errExpiryRunning
+	}
+	fb.expiry.running = true
+	fb.expiry.mu.Unlock()
+	defer func() {
+		fb.expiry.mu.Lock()
+		fb.expiry.running = false
+		fb.expiry.mu.Unlock()
+	}()
+
+	report := &ExpiryReport{Started: timeNow().UTC(), Containers: []ExpiredContainer{}}
+
+	// Owners judge their own containers; a replica's copy has no trash or TTL state
+	seen := make(map[string]bool)
+	collect := func(owner string, containers []ExpiredContainer) {
+		for _, container := range containers {
+			if !seen[container.FileID] {
+				seen[container.FileID] = true
+				container.Owner = owner
+				report.Containers = append(report.Containers, container)
+			}
+		}
+	}
+	collect("local", fb.localExpiredContainers())
+	for _, replica := range fb.replicas {
+		if protocol := fb.peerProtocol(ctx, replica); !protocol.supports(CapExpiry) {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s does not support expiry cleanup; its containers are skipped", replica))
+			continue
+		}
+		var containers []ExpiredContainer
+		if err := fb.getPeerJSON(ctx, replica, "/cluster/expired", &containers); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("listing expired containers on %s: %v", replica, err))
+			continue
+		}
+		collect(replica, containers)
+	}
+
+	var dropped []string
+	for i := range report.Containers {
+		container := &report.Containers[i]
+		if err := fb.deleteContainerObjects(ctx, container.Key); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", container.Key, err))
+			continue
+		}
+		container.Deleted = true
+		report.BytesReclaimed += container.Size
+		dropped = append(dropped, container.FileID)
+	}
+
+	// Every node may hold a copy; peers that miss the news get it on the next run
+	fb.dropContainers(dropped)
+	for _, replica := range fb.replicas {
+		fb.expiry.mu.Lock()
+		fileIDs := append(fb.expiry.pending[replica], dropped...)
+		fb.expiry.mu.Unlock()
+		if len(fileIDs) == 0 {
+			continue
+		}
+
+		err := fb.postPeerJSON(ctx, replica, "/cluster/expired", fileIDs)
+		fb.expiry.mu.Lock()
+		if err != nil {
+			fb.expiry.pending[replica] = fileIDs
+			report.Errors = append(report.Errors, fmt.Sprintf("dropping expired containers on %s: %v", replica, err))
+		} else {
+			delete(fb.expiry.pending, replica)
+		}
+		fb.expiry.mu.Unlock()
+	}
+
+	report.Finished = timeNow().UTC()
+	fb.expiry.mu.Lock()
+	fb.expiry.last = report
+	fb.expiry.mu.Unlock()
+	return report, nil
+}
+
+// deleteContainerObjects deletes a container object, its escrowed key and,
+// with cross-region replication on, its DR copy and manifest
+func (fb *FileBox) deleteContainerObjects(ctx context.Context, key string) error {
+	for _, objectKey := range []string{key, key + keyEscrowSuffix} {
+		_, err := fb.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(fb.bucket),
+			Key:    aws.String(objectKey),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !fb.dr.enabled() {
+		return nil
+	}
+	for _, objectKey := range []string{key, key + keyEscrowSuffix, key + drManifestSuffix} {
+		_, err := fb.dr.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(fb.dr.config.Bucket),
+			Key:    aws.String(objectKey),
+		})
+		if err != nil {
+			return fmt.Errorf("DR bucket: %v", err)
+		}
+	}
+	return nil
+}
+
+// dropContainers forgets containers whose S3 objects the leader deleted:
+// the local file, the metadata and every index entry go
+func (fb *FileBox) dropContainers(fileIDs []string) {
+	now := timeNow()
+	for _, fileID := range fileIDs {
+		fb.fileLock.Lock()
+		containerFile, exists := fb.files.get(fileID)
+		if !exists {
+			fb.fileLock.Unlock()
+			continue
+		}
+
+		// A legal hold placed since the leader looked keeps the container; put it back in S3
+		if !fb.isForeign(containerFile) && !fb.containerExpired(containerFile, now) {
+			reupload := !containerFile.Evicted
+			containerFile.Uploaded = false
+			fb.fileLock.Unlock()
+			log.Printf("WARNING: container %s is no longer expired but its S3 object was deleted", fileID)
+			fb.saveManifest(containerFile)
+			if reupload {
+				go fb.uploadContainerFile(fileID, UploadTriggerExpiry)
+			}
+			continue
+		}
+
+		fb.files.remove(fileID)
+		for _, blob := range containerFile.Blobs {
+			if blob.Key != "" && fb.keys[blob.Key] == blob.ID {
+				delete(fb.keys, blob.Key)
+			}
+			fb.tagIndex.remove(blob)
+			fb.removeSegmentRefs(blob)
+			fb.forgetChunk(containerFile, blob)
+		}
+		fb.fileLock.Unlock()
+
+		fb.manifestLock.Lock()
+		if err := fb.meta.DeleteContainer(fileID); err != nil {
+			log.Printf("Error deleting metadata of %s: %v", fileID, err)
+		}
+		fb.manifestLock.Unlock()
+		filePath := fb.filePathOf(containerFile)
+		fb.mmap.forget(filePath)
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing expired container %s: %v", fileID, err)
+		}
+		log.Printf("Dropped expired container %s", fileID)
+	}
+}
+
+// postPeerJSON sends a JSON document to a cluster peer
+func (fb *FileBox) postPeerJSON(ctx context.Context, peer, path string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://%s%s", peer, path), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := fb.replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// log summarizes a cleanup run
+func (r *ExpiryReport) log() {
+	deleted := 0
+	for _, container := range r.Containers {
+		if container.Deleted {
+			deleted++
+		}
+	}
+	log.Printf("Expiry cleanup: %d expired containers, %d deleted from S3 (%d bytes reclaimed), %d errors",
+		len(r.Containers), deleted, r.BytesReclaimed, len(r.Errors))
+}
+
+// handleClusterExpired serves the leader: GET lists this node's expired
+// containers, POST drops the listed containers after their objects are gone
+func (fb *FileBox) handleClusterExpired(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fb.localExpiredContainers())
+
+	case "POST":
+		var fileIDs []string
+		if err := json.NewDecoder(r.Body).Decode(&fileIDs); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		fb.dropContainers(fileIDs)
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleExpiry serves GET /admin/expiry (last report) and POST /admin/expiry (run now)
+func (fb *FileBox) handleExpiry(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		fb.expiry.mu.Lock()
+		last := fb.expiry.last
+		fb.expiry.mu.Unlock()
+		if last == nil {
+			http.Error(w, "No expiry cleanup has run yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(last)
+
+	case "POST":
+		if !fb.isLeader() {
+			http.Error(w, "Expiry cleanup only runs on the leader (CLUSTER_LEADER)", http.StatusConflict)
+			return
+		}
+		if fb.s3Client == nil {
+			http.Error(w, "S3 is not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		result, err := fb.runJob(r.Context(), JobExpiry, func(ctx context.Context) (any, error) {
+			return fb.expireContainers(ctx)
+		})
+		if err == errExpiryRunning {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		report := result.(*ExpiryReport)
+		report.log()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
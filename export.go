@@ -0,0 +1,164 @@
+// Export of containers back to plain S3 objects for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ExportRequest - Body of POST /admin/export
+type ExportRequest struct {
+	Containers []string `json:"containers,omitempty"` // FIDs to export; empty exports every container
+	Bucket     string   `json:"bucket,omitempty"`     // Defaults to the FileBox bucket
+	Prefix     string   `json:"prefix,omitempty"`     // Prepended to every object key
+	KeyBy      string   `json:"key_by,omitempty"`     // "id" (default) or "key" to use named keys where set
+}
+
+// ExportJob - Progress of an export
+type ExportJob struct {
+	JobInfo
+	ContainersTotal    int      `json:"containers_total"`
+	ContainersExported int      `json:"containers_exported"`
+	BlobsExported      int      `json:"blobs_exported"`
+	Bytes              int64    `json:"bytes"`
+	Errors             []string `json:"errors,omitempty"`
+
+	request ExportRequest
+}
+
+func (j *ExportJob) progress() (int64, int64) {
+	return int64(j.ContainersExported), int64(j.ContainersTotal)
+}
+
+// startExport validates a request and runs the export in the background
+func (fb *FileBox) startExport(req ExportRequest) (*ExportJob, error) {
+	if fb.s3Client == nil {
+		return nil, fmt.Errorf("S3 is not configured")
+	}
+	if req.KeyBy == "" {
+		req.KeyBy = "id"
+	}
+	if req.KeyBy != "id" && req.KeyBy != "key" {
+		return nil, fmt.Errorf("key_by must be \"id\" or \"key\"")
+	}
+	if req.Bucket == "" {
+		req.Bucket = fb.bucket
+	}
+
+	fb.fileLock.RLock()
+	if len(req.Containers) == 0 {
+		for _, containerFile := range fb.files.all() {
+			req.Containers = append(req.Containers, containerFile.FID.String())
+		}
+		sort.Strings(req.Containers)
+	}
+	for _, fileID := range req.Containers {
+		if _, exists := fb.files.get(fileID); !exists {
+			fb.fileLock.RUnlock()
+			return nil, fmt.Errorf("container file not found: %s", fileID)
+		}
+	}
+	fb.fileLock.RUnlock()
+
+	job := &ExportJob{ContainersTotal: len(req.Containers), request: req}
+	fb.jobs.submit(JobExport, job, func(ctx context.Context) error {
+		return fb.runExport(ctx, job)
+	})
+	return job, nil
+}
+
+// runExport writes one S3 object per blob of every selected container
+func (fb *FileBox) runExport(ctx context.Context, job *ExportJob) error {
+	req := job.request
+
+	for _, fileID := range req.Containers {
+		fb.fileLock.RLock()
+		containerFile, _ := fb.files.get(fileID)
+		blobs := append([]BlobInfo(nil), fb.containerBlobs(containerFile)...)
+		fb.fileLock.RUnlock()
+
+		for _, blob := range blobs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if blob.Uncommitted || blob.DeletedAt != nil || blob.ChunkHash != "" {
+				continue // Chunks are exported inside the blobs made of them
+			}
+			name := blob.ID
+			if req.KeyBy == "key" && blob.Key != "" {
+				name = blob.Key
+			}
+
+			data, err := fb.GetBlob(ctx, blob.ID)
+			if err == nil {
+				_, err = fb.s3Client.PutObject(ctx, &s3.PutObjectInput{
+					Bucket: aws.String(req.Bucket),
+					Key:    aws.String(req.Prefix + name),
+					Body:   bytes.NewReader(data),
+				})
+			}
+
+			fb.jobs.mu.Lock()
+			if err != nil {
+				job.Errors = append(job.Errors, fmt.Sprintf("%s: %v", blob.ID, err))
+			} else {
+				job.BlobsExported++
+				job.Bytes += int64(len(data))
+			}
+			fb.jobs.mu.Unlock()
+		}
+
+		fb.jobs.mu.Lock()
+		job.ContainersExported++
+		fb.jobs.mu.Unlock()
+	}
+
+	fb.jobs.mu.Lock()
+	defer fb.jobs.mu.Unlock()
+	log.Printf("Export %s finished: %d blobs (%d bytes) to s3://%s/%s, %d errors",
+		job.ID, job.BlobsExported, job.Bytes, req.Bucket, req.Prefix, len(job.Errors))
+	if len(job.Errors) > 0 {
+		return fmt.Errorf("%d blobs failed to export", len(job.Errors))
+	}
+	return nil
+}
+
+// handleExport starts an export (POST /admin/export), or reports (GET) or
+// cancels (DELETE) one at /admin/export/{id}
+func (fb *FileBox) handleExport(w http.ResponseWriter, r *http.Request) {
+	jobID := r.URL.Path[len("/admin/export"):]
+
+	switch {
+	case len(jobID) > 1:
+		fb.jobs.serveJob(w, r, jobID[1:], JobExport)
+
+	case r.Method == "POST":
+		var req ExportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid export request", http.StatusBadRequest)
+			return
+		}
+
+		job, err := fb.startExport(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fb.jobs.writeJob(w, http.StatusAccepted, job)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
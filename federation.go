@@ -0,0 +1,409 @@
+// Cross-cluster federation for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A federated cluster is another FileBox cluster used as a further tier,
+// for example a central hub behind several edge sites. Reads of blobs and
+// keys this node has never heard of are passed on to it, and containers
+// nobody has read for a while can be pushed to it blob by blob. Each pushed
+// blob records the ID the remote cluster gave it. Once every blob of a
+// container is on the remote, the local copy can be dropped; the blob
+// index stays here and reads go to the remote.
+
+var errFederationRunning = errors.New("a federation push is already running")
+
+// federatedHeader marks reads passed between federated clusters
+const federatedHeader = "X-FileBox-Federated"
+
+// FederationConfig - The remote cluster and when containers are pushed to it
+type FederationConfig struct {
+	Remote       string        `json:"remote"`        // Base URL of a node in the remote cluster
+	PushIdle     time.Duration `json:"push_idle"`     // Push containers nobody has read for this long; 0 never pushes
+	PushInterval time.Duration `json:"push_interval"` // Time between scheduled pushes
+	Offload      bool          `json:"offload"`       // Delete the local copy once every blob is on the remote
+	Timeout      time.Duration `json:"timeout"`       // Per request to the remote
+}
+
+// loadFederation reads FEDERATION_REMOTE, FEDERATION_PUSH_IDLE,
+// FEDERATION_PUSH_INTERVAL, FEDERATION_OFFLOAD and FEDERATION_TIMEOUT; nil
+// when no remote is configured
+func loadFederation() *federation {
+	remote := strings.TrimRight(getEnvOrDefault("FEDERATION_REMOTE", ""), "/")
+	if remote == "" {
+		return nil
+	}
+	if !strings.Contains(remote, "://") {
+		remote = "http://" + remote
+	}
+	config := FederationConfig{
+		Remote:       remote,
+		PushIdle:     getEnvDuration("FEDERATION_PUSH_IDLE", 0),
+		PushInterval: getEnvDuration("FEDERATION_PUSH_INTERVAL", time.Hour),
+		Offload:      getEnvBool("FEDERATION_OFFLOAD", false),
+		Timeout:      getEnvDuration("FEDERATION_TIMEOUT", 30*time.Second),
+	}
+	return &federation{config: config, client: &http.Client{Timeout: config.Timeout}}
+}
+
+// FederationReport - Result of one push to the remote cluster
+type FederationReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	Duration   string    `json:"duration"`
+	Containers int       `json:"containers"` // Idle containers looked at
+	Pushed     int       `json:"pushed"`     // Blobs copied to the remote
+	Bytes      int64     `json:"bytes"`
+	Offloaded  []string  `json:"offloaded"` // Containers whose local copy was dropped
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+// federation - Client for the remote cluster and the last push report
+type federation struct {
+	config FederationConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	running bool
+	last    *FederationReport
+}
+
+// get fetches a path from the remote cluster. The request is marked so a
+// remote federated back to this cluster does not pass it on again.
+func (f *federation) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", f.config.Remote+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(federatedHeader, "true")
+	return f.client.Do(req)
+}
+
+// read fetches a pushed blob by the ID the remote cluster gave it
+func (f *federation) read(ctx context.Context, blob BlobInfo) ([]byte, error) {
+	if f == nil {
+		return nil, fmt.Errorf("blob %s was offloaded to a federated cluster but FEDERATION_REMOTE is not set", blob.ID)
+	}
+	resp, err := f.get(ctx, "/blob/"+blob.RemoteID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading blob %s from the federated cluster: %v", blob.ID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("federated cluster answered %s for blob %s (remote ID %s)", resp.Status, blob.ID, blob.RemoteID)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// proxy serves a read this node knows nothing about from the remote
+// cluster. It returns false, having written nothing, when the remote does
+// not have it either.
+func (f *federation) proxy(w http.ResponseWriter, r *http.Request, path string) bool {
+	if f == nil || r.Header.Get(federatedHeader) != "" {
+		return false
+	}
+	resp, err := f.get(r.Context(), path)
+	if err != nil {
+		log.Printf("Error reading %s from the federated cluster: %v", path, err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false
+	}
+
+	for _, header := range []string{"Content-Type", "X-Content-Type-Options", "Retry-After", "X-FileBox-Scan-Status"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.Header().Set(federatedHeader, "true")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return true
+}
+
+// push uploads one blob to the remote cluster and returns the remote ID
+func (f *federation) push(ctx context.Context, tenant string, blob BlobInfo, blobData []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", f.config.Remote+"/upload", bytes.NewReader(blobData))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", blob.ContentType)
+	if tenant != "" {
+		req.Header.Set("X-FileBox-Tenant", tenant)
+	}
+	if blob.Key != "" {
+		req.Header.Set("X-FileBox-Key", blob.Key)
+	}
+	for k, v := range blob.Tags {
+		req.Header.Add("X-FileBox-Tag", k+"="+v)
+	}
+	if blob.ExpiresAt != nil {
+		req.Header.Set("X-FileBox-TTL", max(time.Until(*blob.ExpiresAt).Round(time.Second), time.Second).String())
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var response BlobResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", err
+	}
+	return response.ID, nil
+}
+
+// runFederationPush periodically pushes idle containers to the remote cluster
+func (fb *FileBox) runFederationPush() {
+	if fb.federation == nil || fb.federation.config.PushIdle <= 0 || fb.federation.config.PushInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(fb.federation.config.PushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if report, err := fb.pushIdleContainers(context.Background()); err == nil {
+			report.log()
+		}
+	}
+}
+
+func (r *FederationReport) log() {
+	log.Printf("Federation push: %d idle containers, %d blobs pushed (%d bytes), %d offloaded, %d errors (%s)",
+		r.Containers, r.Pushed, r.Bytes, len(r.Offloaded), len(r.Errors), r.Duration)
+}
+
+// pushable reports whether a container is one of this node's and has gone
+// unread for FEDERATION_PUSH_IDLE. Callers must hold fb.fileLock.
+func (fb *FileBox) pushable(containerFile *ContainerFile, now time.Time) bool {
+	return !fb.isForeign(containerFile) && !containerFile.Quarantined && !containerFile.repairing &&
+		!containerFile.Federated && now.Sub(lastContainerAccess(containerFile, fb.containerBlobs(containerFile))) >= fb.federation.config.PushIdle
+}
+
+// pushIdleContainers copies every unpushed blob of idle containers to the
+// remote cluster and, with FEDERATION_OFFLOAD, drops their local copies
+func (fb *FileBox) pushIdleContainers(ctx context.Context) (*FederationReport, error) {
+	f := fb.federation
+	f.mu.Lock()
+	if f.running {
+		f.mu.Unlock()
+		return nil, errFederationRunning
+	}
+	f.running = true
+	f.mu.Unlock()
+
+	report := &FederationReport{StartedAt: timeNow().UTC(), Offloaded: []string{}}
+	defer func() {
+		report.Duration = timeNow().Sub(report.StartedAt).Round(time.Millisecond).String()
+		f.mu.Lock()
+		f.running, f.last = false, report
+		f.mu.Unlock()
+	}()
+
+	now := timeNow()
+	var candidates []*ContainerFile
+	fb.fileLock.RLock()
+	for _, containerFile := range fb.files.all() {
+		if fb.pushable(containerFile, now) {
+			candidates = append(candidates, containerFile)
+		}
+	}
+	fb.fileLock.RUnlock()
+	report.Containers = len(candidates)
+
+	for _, containerFile := range candidates {
+		fileID := containerFile.FID.String()
+		if err := fb.pushContainer(ctx, containerFile, report); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", fileID, err))
+			continue
+		}
+		if !f.config.Offload {
+			continue
+		}
+		offloaded, err := fb.offloadContainer(containerFile)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", fileID, err))
+		} else if offloaded {
+			report.Offloaded = append(report.Offloaded, fileID)
+		}
+	}
+	return report, nil
+}
+
+// federable reports whether a blob should be on the remote: live, readable
+// and not encrypted with a key this node does not keep
+func federable(containerFile *ContainerFile, blob BlobInfo, now time.Time) bool {
+	return !blob.Uncommitted && blob.DeletedAt == nil && !expired(containerFile, blob, now) && !blob.CustomerKey &&
+		(blob.Scan == nil || blob.Scan.Status == ScanClean)
+}
+
+// pushContainer copies a container's blobs that are not on the remote yet
+func (fb *FileBox) pushContainer(ctx context.Context, containerFile *ContainerFile, report *FederationReport) error {
+	now := timeNow()
+	var pending []BlobInfo
+	fb.fileLock.RLock()
+	tenant := containerFile.Tenant
+	for _, blob := range fb.containerBlobs(containerFile) {
+		if blob.RemoteID == "" && federable(containerFile, blob, now) {
+			pending = append(pending, blob)
+		}
+	}
+	fb.fileLock.RUnlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	pushed := make(map[string]string, len(pending))
+	var pushErr error
+	for _, blob := range pending {
+		blobData, err := fb.readBlobPlaintext(ctx, containerFile, blob)
+		if err != nil {
+			pushErr = fmt.Errorf("error reading blob %s: %v", blob.ID, err)
+			break
+		}
+		remoteID, err := fb.federation.push(ctx, tenant, blob, blobData)
+		if err != nil {
+			pushErr = fmt.Errorf("error pushing blob %s: %v", blob.ID, err)
+			break
+		}
+		pushed[blob.ID] = remoteID
+		report.Pushed++
+		report.Bytes += int64(len(blobData))
+	}
+
+	// Record what did make it, even if a later blob failed
+	if len(pushed) > 0 {
+		fb.fileLock.Lock()
+		for i := range containerFile.Blobs {
+			if remoteID, ok := pushed[containerFile.Blobs[i].ID]; ok {
+				containerFile.Blobs[i].RemoteID = remoteID
+			}
+		}
+		fb.fileLock.Unlock()
+		fb.saveManifest(containerFile)
+	}
+	return pushErr
+}
+
+// offloadContainer deletes the local copy of a container whose blobs are
+// all on the remote. With S3 configured the container must be uploaded
+// first, so the bucket keeps a copy. It returns false when the container
+// does not qualify yet.
+func (fb *FileBox) offloadContainer(containerFile *ContainerFile) (bool, error) {
+	now := timeNow()
+	fb.fileLock.Lock()
+	switch {
+	case containerFile.Federated, containerFile.writers > 0, containerFile.Uploading, containerFile.Quarantined:
+		fb.fileLock.Unlock()
+		return false, nil
+	case fb.s3Client != nil && !containerFile.Uploaded:
+		fb.fileLock.Unlock()
+		return false, nil
+	}
+	for _, blob := range containerFile.Blobs {
+		if heldBy(containerFile, blob) != "" {
+			fb.fileLock.Unlock()
+			return false, nil
+		}
+		if !blob.Uncommitted && blob.DeletedAt == nil && !expired(containerFile, blob, now) && blob.RemoteID == "" {
+			fb.fileLock.Unlock()
+			return false, nil // Customer-key, unscanned or newly written blobs keep it here
+		}
+	}
+	containerFile.Federated = true
+	containerFile.Evicted = true
+	fb.fileLock.Unlock()
+
+	// Record the offload first so a crash never leaves metadata pointing at a deleted file
+	fb.saveManifest(containerFile)
+	filePath := fb.filePathOf(containerFile)
+	fb.mmap.forget(filePath)
+	fb.writeMode.forget(filePath)
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		fb.fileLock.Lock()
+		containerFile.Federated = false
+		containerFile.Evicted = false
+		fb.fileLock.Unlock()
+		fb.saveManifest(containerFile)
+		return false, err
+	}
+	log.Printf("Offloaded container %s to the federated cluster; reads now go to %s", containerFile.FID.String(), fb.federation.config.Remote)
+	return true, nil
+}
+
+// FederationStatus - Response for GET /admin/federation
+type FederationStatus struct {
+	Config     FederationConfig  `json:"config"`
+	Running    bool              `json:"running"`
+	Offloaded  int               `json:"offloaded_containers"`
+	PushedBlob int               `json:"pushed_blobs"`
+	Last       *FederationReport `json:"last_push,omitempty"`
+}
+
+// handleFederation serves GET /admin/federation and POST /admin/federation/push
+func (fb *FileBox) handleFederation(w http.ResponseWriter, r *http.Request) {
+	if fb.federation == nil {
+		http.Error(w, "No federated cluster is configured (FEDERATION_REMOTE)", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/admin/federation":
+		f := fb.federation
+		status := FederationStatus{Config: f.config}
+		f.mu.Lock()
+		status.Running, status.Last = f.running, f.last
+		f.mu.Unlock()
+		fb.fileLock.RLock()
+		for _, containerFile := range fb.files.all() {
+			if containerFile.Federated {
+				status.Offloaded++
+			}
+			for _, blob := range fb.containerBlobs(containerFile) {
+				if blob.RemoteID != "" {
+					status.PushedBlob++
+				}
+			}
+		}
+		fb.fileLock.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case r.Method == "POST" && r.URL.Path == "/admin/federation/push":
+		if fb.federation.config.PushIdle <= 0 {
+			http.Error(w, "Pushing is disabled (FEDERATION_PUSH_IDLE)", http.StatusConflict)
+			return
+		}
+		report, err := fb.pushIdleContainers(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		report.log()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
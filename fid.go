@@ -6,9 +6,10 @@ package main
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"sync/atomic"
+	"math"
 	"time"
 )
 
@@ -20,13 +21,10 @@ type FID struct {
 	Hash      [8]byte // Hash for integrity
 }
 
-// Global sequence counter for FID generation
-var sequenceCounter uint32
-
 // NewFID creates a new FID with current timestamp
 func NewFID() *FID {
 	// Generate random machine ID (in real system, this would be configured)
-	machineID := uint32(time.Now().UnixNano() % 1000000)
+	machineID := uint32(timeNow().UnixNano() % 1000000)
 	return NewFIDWithMachineID(machineID)
 }
 
@@ -37,10 +35,10 @@ func NewFIDWithMachineID(machineID uint32) *FID {
 	return fid
 }
 
-// GenerateWithMachineID generates FID with specific machine ID
+// GenerateWithMachineID generates FID with specific machine ID. The timestamp
+// and sequence come from a hybrid logical clock (see fidClock).
 func (f *FID) GenerateWithMachineID(machineID uint32) {
-	now := time.Now().Unix()
-	seq := atomic.AddUint32(&sequenceCounter, 1)
+	now, seq := fidClock.now()
 
 	f.Timestamp = now
 	f.Sequence = seq
@@ -52,17 +50,28 @@ func (f *FID) GenerateWithMachineID(machineID uint32) {
 	copy(f.Hash[:], h[:8])
 }
 
+// FID string lengths. Timestamps that do not fit in 32 bits (before 1970
+// or after 2106) get 16 hex digits instead of 8, so every FID round-trips.
+const (
+	fidLength     = 32
+	wideFIDLength = 40
+)
+
 // String returns the FID as a hex string
 func (f *FID) String() string {
-	return fmt.Sprintf("%08x%08x%08x%08x",
-		f.MachineID, f.Timestamp, f.Sequence,
-		uint32(f.Hash[0])<<24|uint32(f.Hash[1])<<16|uint32(f.Hash[2])<<8|uint32(f.Hash[3]))
+	hash := uint32(f.Hash[0])<<24 | uint32(f.Hash[1])<<16 | uint32(f.Hash[2])<<8 | uint32(f.Hash[3])
+	if f.Timestamp < 0 || f.Timestamp > math.MaxUint32 {
+		return fmt.Sprintf("%08x%016x%08x%08x", f.MachineID, uint64(f.Timestamp), f.Sequence, hash)
+	}
+	return fmt.Sprintf("%08x%08x%08x%08x", f.MachineID, f.Timestamp, f.Sequence, hash)
 }
 
-// ParseFID parses a hex string back into a FID
+// ParseFID parses a hex string back into a FID. The wide form is only
+// accepted when the timestamp needs it. Uppercase hex is accepted as it
+// always was; String gives back the lowercase form.
 func ParseFID(fidStr string) (*FID, error) {
-	if len(fidStr) != 32 {
-		return nil, fmt.Errorf("invalid FID length: expected 32, got %d", len(fidStr))
+	if len(fidStr) != fidLength && len(fidStr) != wideFIDLength {
+		return nil, fmt.Errorf("invalid FID length: expected %d or %d, got %d", fidLength, wideFIDLength, len(fidStr))
 	}
 
 	// Parse hex string
@@ -71,17 +80,22 @@ func ParseFID(fidStr string) (*FID, error) {
 		return nil, fmt.Errorf("invalid hex in FID: %v", err)
 	}
 
-	if len(bytes) != 16 {
-		return nil, fmt.Errorf("invalid FID byte length: expected 16, got %d", len(bytes))
-	}
-
+	// The timestamp takes up whatever the other fields leave
+	timestamp := bytes[4 : len(bytes)-8]
 	fid := &FID{
-		MachineID: uint32(bytes[0])<<24 | uint32(bytes[1])<<16 | uint32(bytes[2])<<8 | uint32(bytes[3]),
-		Timestamp: int64(uint32(bytes[4])<<24 | uint32(bytes[5])<<16 | uint32(bytes[6])<<8 | uint32(bytes[7])),
-		Sequence:  uint32(bytes[8])<<24 | uint32(bytes[9])<<16 | uint32(bytes[10])<<8 | uint32(bytes[11]),
+		MachineID: binary.BigEndian.Uint32(bytes[0:4]),
+		Sequence:  binary.BigEndian.Uint32(bytes[len(bytes)-8:]),
+	}
+	if len(timestamp) == 4 {
+		fid.Timestamp = int64(binary.BigEndian.Uint32(timestamp))
+	} else {
+		fid.Timestamp = int64(binary.BigEndian.Uint64(timestamp))
+		if fid.Timestamp >= 0 && fid.Timestamp <= math.MaxUint32 {
+			return nil, fmt.Errorf("invalid FID: timestamp %d fits in the %d-character form", fid.Timestamp, fidLength)
+		}
 	}
 
-	copy(fid.Hash[:], bytes[12:16])
+	copy(fid.Hash[:], bytes[len(bytes)-4:])
 
 	return fid, nil
 }
@@ -99,12 +113,6 @@ func (f *FID) Created() time.Time {
 // IsValid checks if the FID is valid
 func (f *FID) IsValid() bool {
 	// Check if timestamp is reasonable (not too old, not in future)
-	now := time.Now().Unix()
+	now := timeNow().Unix()
 	return f.Timestamp > now-86400*365 && f.Timestamp <= now+3600 // Within 1 year, not more than 1 hour in future
 }
-
-// S3Key returns the S3 key for this FID
-func (f *FID) S3Key() string {
-	// Use a hierarchical structure: machine/timestamp/sequence
-	return fmt.Sprintf("files/%d/%d/%s", f.MachineID, f.Timestamp, f.String())
-}
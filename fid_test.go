@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// fidTimestampEdges are the timestamps either side of where the string
+// form changes width, and the ends of the range
+var fidTimestampEdges = []int64{
+	0, 1, -1,
+	math.MaxUint32 - 1, math.MaxUint32, math.MaxUint32 + 1,
+	math.MaxInt32, math.MaxInt32 + 1,
+	math.MaxInt64, math.MinInt64, math.MinInt64 + 1,
+}
+
+// anyFID - A FID drawn from the whole value space, timestamps biased
+// towards the edges
+type anyFID struct{ FID }
+
+func (anyFID) Generate(r *rand.Rand, size int) reflect.Value {
+	var f anyFID
+	f.MachineID = r.Uint32()
+	f.Sequence = r.Uint32()
+	switch r.Intn(3) {
+	case 0:
+		f.Timestamp = fidTimestampEdges[r.Intn(len(fidTimestampEdges))]
+	case 1:
+		f.Timestamp = int64(r.Uint32())
+	default:
+		f.Timestamp = int64(r.Uint64())
+	}
+	// Only the first four bytes of the hash are in the string form
+	r.Read(f.Hash[:4])
+	return reflect.ValueOf(f)
+}
+
+// hexString - A lowercase hex string of a FID's length
+type hexString string
+
+func (hexString) Generate(r *rand.Rand, size int) reflect.Value {
+	length := fidLength
+	if r.Intn(2) == 0 {
+		length = wideFIDLength
+	}
+	const digits = "0123456789abcdef"
+	var b strings.Builder
+	for i := 0; i < length; i++ {
+		b.WriteByte(digits[r.Intn(len(digits))])
+	}
+	return reflect.ValueOf(hexString(b.String()))
+}
+
+// checkProperty runs a property over generated values with testing/quick
+// rather than rapid or gopter: the module has no test dependencies, and
+// FIDs are fixed-size values whose failures quick.Check already reports in
+// full. Shrinking would add little, because the generators above draw
+// timestamps from the edges where the string form changes, so a failing
+// input is usually already the boundary case.
+func checkProperty(t *testing.T, property any) {
+	t.Helper()
+	if err := quick.Check(property, &quick.Config{MaxCount: 20000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFIDRoundTrip(t *testing.T) {
+	checkProperty(t, func(f anyFID) bool {
+		s := f.String()
+		parsed, err := ParseFID(s)
+		return err == nil && *parsed == f.FID && parsed.String() == s
+	})
+}
+
+func TestFIDStringWidth(t *testing.T) {
+	checkProperty(t, func(f anyFID) bool {
+		want := wideFIDLength
+		if f.Timestamp >= 0 && f.Timestamp <= math.MaxUint32 {
+			want = fidLength
+		}
+		return len(f.String()) == want
+	})
+}
+
+func TestFIDTimestampEdges(t *testing.T) {
+	for _, timestamp := range fidTimestampEdges {
+		f := FID{MachineID: 7, Timestamp: timestamp, Sequence: 9}
+		parsed, err := ParseFID(f.String())
+		if err != nil {
+			t.Errorf("timestamp %d: %s: %v", timestamp, f.String(), err)
+		} else if parsed.Timestamp != timestamp {
+			t.Errorf("timestamp %d came back as %d", timestamp, parsed.Timestamp)
+		}
+	}
+}
+
+// Every string ParseFID accepts is, up to case, the one String gives for what it parsed
+func TestFIDParseIsCanonical(t *testing.T) {
+	checkProperty(t, func(s hexString) bool {
+		parsed, err := ParseFID(string(s))
+		return err != nil || parsed.String() == strings.ToLower(string(s))
+	})
+	for _, s := range []string{
+		"00000001" + "00000000ffffffff" + "0000000200000003", // Wide form of a timestamp that fits
+		"0000000100000000000000",
+	} {
+		if _, err := ParseFID(s); err == nil {
+			t.Errorf("ParseFID(%q) accepted a string String never produces", s)
+		}
+	}
+}
+
+// Uppercase FIDs from clients and stored references parse to the same FID
+func TestFIDParseUppercase(t *testing.T) {
+	checkProperty(t, func(f anyFID) bool {
+		parsed, err := ParseFID(strings.ToUpper(f.String()))
+		return err == nil && *parsed == f.FID && parsed.String() == f.String()
+	})
+}
+
+func TestBlobIDRoundTrip(t *testing.T) {
+	checkProperty(t, func(f anyFID, index uint32) bool {
+		fileID := f.String()
+		id := formatBlobID(fileID, int(index))
+		parsedFileID, parsedIndex, err := parseBlobID(id)
+		return err == nil && parsedFileID == fileID && parsedIndex == int(index)
+	})
+}
+
+// Every blob ID parseBlobID accepts is the one formatBlobID gives back
+func TestBlobIDParseIsCanonical(t *testing.T) {
+	checkProperty(t, func(fileID, suffix string) bool {
+		id := fileID + "-" + suffix
+		parsedFileID, parsedIndex, err := parseBlobID(id)
+		return err != nil || formatBlobID(parsedFileID, parsedIndex) == id
+	})
+	for _, id := range []string{"abc-+1", "abc-01", "abc- 1", "abc-1x", "abc-", "abc--", "abc"} {
+		if _, _, err := parseBlobID(id); err == nil {
+			t.Errorf("parseBlobID(%q) accepted a non-canonical blob ID", id)
+		}
+	}
+}
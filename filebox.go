@@ -9,54 +9,214 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"filebox/pkg/containerformat"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 // FileBox - File container approach
 type FileBox struct {
 	storageDir    string
-	s3Client      *s3.S3
+	s3Client      *s3.Client
 	bucket        string
-	maxFileSize   int64
-	files         map[string]*ContainerFile
+	sizeClasses   []SizeClass
+	files         containerRegistry
+	keys          map[string]string          // Named key -> blob ID, guarded by fileLock
+	tagIndex      tagIndex                   // Guarded by fileLock
+	segmentRefs   map[string]map[string]bool // Container file ID -> composed blobs reading from it, guarded by fileLock
 	fileLock      sync.RWMutex
 	replicas      []string
 	replicaClient *http.Client
-	hostID        string
-	machineID     uint32
+	clusterAuth   ClusterAuthConfig
+	audit         *auditLog
+
+	undeleteWindow time.Duration
+	uploadTokens   *uploadTokens
+	indexOnly      *indexOnlyContainers // Containers whose index cannot be rebuilt from records
+	uploads        *uploadSessions
+	uploadHooks    []UploadHook
+	scanner        Scanner
+	gcConfig       GCConfig
+	eviction       EvictionPolicy
+	access         *accessTracker
+	cache          *blobCache
+	readahead      *readahead
+	rangeReads     RangeReadConfig
+	dr             *drState
+	mode           *modeState
+	bootstrap      *bootstrapState
+	recovery       *RecoveryReport // Written once during startup
+	foreignPolicy  string          // What recovery does with other machines' files
+	clock          *clockMonitor
+	gc             gcState
+	s3Keys         *s3KeyLayout // S3_KEY_TEMPLATE
+	s3Tagging      bool         // Tag uploaded container objects (S3_OBJECT_TAGGING)
+	s3KeyMigration s3KeyMigrationState
+	uploadFlights  uploadFlights // Container uploads to S3 in flight
+	checkpoint     checkpointState
+	expiry         *expiryState
+	replication    *replicator
+	health         *peerHealthState
+	metaOps        *metaOpLog // Blob metadata changes for the replicas; nil without replicas
+	catchUp        *catchUpState
+	protocols      protocolState
+	usage          *usageMeter
+	hostID         string
+	machineID      uint32
+	region         string // NODE_REGION, matched by tenant replication scopes
+	tiering        *TieringPolicy
+	tenantPolicies *tenantPolicies
+	raft           *raftMeta // Replicated key namespace and tenant policies; nil without RAFT_ADDR
+	admission      *admissionController
+	slo            *sloTracker
+	preallocator   *preallocator
+	writeMode      *writeMode
+	mmap           *mmapReader
+	federation     *federation
+	edge           *edgeCache
+	volumes        []*volume                 // Storage directories; the first is storageDir
+	events         *eventNotifier            // Nil when no event webhooks are configured
+	dedupe         *dedupeStore              // Chunk index for deduplicated uploads
+	bandwidth      *bandwidthSchedules       // Paces replication and S3 uploads
+	faults         *faultInjector            // Failures injected through /debug/inject
+	restores       map[string]*RestoreStatus // Keyed by S3 key
+	restoreLock    sync.Mutex
+	manifestLock   sync.Mutex // Serializes manifest writes so older snapshots never win
+	jobs           *jobManager
+	maxBulkDelete  int // BULK_DELETE_MAX_IDS
+	meta           MetadataStore
+	durability     DurabilityConfig
+	integrity      containerformat.Algorithm // Hash algorithm new records are written with
+	placement      PlacementConfig
+	nextContainer  atomic.Int64 // Round-robin position
+	keyWrapper     KeyWrapper   // Nil when encryption is disabled
+	dataKeys       dataKeyCache
+	disconnects    disconnectCounters // Requests abandoned by their clients
 }
 
 // ContainerFile - A file that contains multiple blobs
 type ContainerFile struct {
-	FID       *FID       `json:"fid"`
-	FilePath  string     `json:"file_path"`
-	Size      int64      `json:"size"`
-	Created   time.Time  `json:"created"`
-	Uploaded  bool       `json:"uploaded"`
-	Uploading bool       `json:"uploading"`
-	Blobs     []BlobInfo `json:"blobs"` // Track individual blobs within the file
+	FID          *FID       `json:"fid"`
+	FilePath     string     `json:"file_path"`
+	Size         int64      `json:"size"`
+	Created      time.Time  `json:"created"`
+	Uploaded     bool       `json:"uploaded"`
+	Uploading    bool       `json:"uploading"`
+	Blobs        []BlobInfo `json:"blobs"` // Track individual blobs within the file
+	Tenant       string     `json:"tenant,omitempty"`
+	SizeClass    string     `json:"size_class,omitempty"`    // Container size class it was created for
+	StorageClass string     `json:"storage_class,omitempty"` // S3 storage class once uploaded
+	S3Key        string     `json:"s3_key,omitempty"`        // Key it was uploaded under; see containerS3Key
+
+	// Quarantined containers failed an integrity check and reject reads until repaired
+	Quarantined      bool   `json:"quarantined,omitempty"`
+	QuarantineReason string `json:"quarantine_reason,omitempty"`
+	repairing        bool
+	writers          int       // Writes in flight, guarded like Size (see registry.go)
+	warmUntil        time.Time // Downloaded by a warm request; not evicted before this
+
+	UploadedAt time.Time        `json:"uploaded_at,omitempty"`
+	Encrypted  bool             `json:"encrypted,omitempty"`
+	WrappedKey []byte           `json:"wrapped_key,omitempty"` // Data key wrapped by the master key
+	KeyID      string           `json:"key_id,omitempty"`      // Master key that wrapped it
+	Replicated map[string]int64 `json:"replicated,omitempty"`  // Bytes acknowledged per replica
+	LegalHold  bool             `json:"legal_hold,omitempty"`  // Protects every blob in the container
+	Evicted    bool             `json:"evicted,omitempty"`     // Local file deleted; blobs are read from S3
+	Federated  bool             `json:"federated,omitempty"`   // Local file deleted; blobs are read from the federated cluster
+
+	DRReplicatedAt time.Time      `json:"dr_replicated_at,omitempty"` // Copied to the DR bucket
+	Provenance     *Provenance    `json:"provenance,omitempty"`       // Set when adopted from another machine ID
+	Conflict       *WriteConflict `json:"conflict,omitempty"`         // Set when two hosts wrote to it; replicated writes are refused
+
+	OpSequence *OpSequence `json:"op_sequence,omitempty"` // Replicated operation numbering, guarded like Size (see opsequence.go)
 }
 
 // BlobInfo - Information about a blob within a container file
 type BlobInfo struct {
-	ID     string `json:"id"`
-	Offset int64  `json:"offset"`
-	Length int64  `json:"length"`
-	Size   int64  `json:"size"`
+	ID       string `json:"id"`
+	Offset   int64  `json:"offset"`
+	Length   int64  `json:"length"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"` // Frame checksum from the record header; CRC32-C unless HashAlgorithm says otherwise
+	Key      string `json:"key,omitempty"`
+	RemoteID string `json:"remote_id,omitempty"` // ID in the federated cluster once pushed there
+
+	// Set while the entry is reserved but its upload has not committed;
+	// readers treat it as absent
+	Uncommitted bool `json:"uncommitted,omitempty"`
+
+	// Set for blobs hashed with anything but CRC32-C (INTEGRITY_HASH)
+	HashAlgorithm string `json:"hash_algorithm,omitempty"`
+	Digest        string `json:"digest,omitempty"` // Hex digest of the blob data
+
+	// User-facing metadata, indexed for search
+	ContentType string            `json:"content_type,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Created     time.Time         `json:"created"`
+
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // Set while the blob is in the trash
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Set for uploads with a TTL; unreadable after it
+	LegalHold bool       `json:"legal_hold,omitempty"` // Held blobs cannot be deleted or compacted
+
+	// Derived blobs such as thumbnails link to their source and back
+	Variants  map[string]string `json:"variants,omitempty"` // Variant name -> blob ID
+	VariantOf string            `json:"variant_of,omitempty"`
+
+	CopyOf    string   `json:"copy_of,omitempty"`    // Source blob of an instant copy; both share the same bytes
+	Segments  []string `json:"segments,omitempty"`   // Blobs a composed blob is read from, in order; it has no bytes of its own
+	ChunkHash string   `json:"chunk_hash,omitempty"` // SHA-256 of a deduplicated chunk; chunks live as long as blobs reading them
+
+	Scan *ScanResult `json:"scan,omitempty"` // Content scan state; nil when scanning was off at upload
+
+	CustomerKey bool   `json:"customer_key,omitempty"` // Sealed with a client-supplied key the server does not keep
+	Compression string `json:"compression,omitempty"`  // Stored compressed by the tenant policy
+
+	// Read statistics, flushed from memory every ACCESS_FLUSH_INTERVAL
+	AccessCount int64      `json:"access_count,omitempty"`
+	LastAccess  *time.Time `json:"last_access,omitempty"`
+}
+
+// BlobOptions - Per-upload options supplied by the client
+type BlobOptions struct {
+	Tenant string
+	Key    string // Optional named key the blob can also be fetched by
+
+	ContentType string
+	Tags        map[string]string
+	TTL         time.Duration // The blob expires this long after upload; 0 never expires
+
+	VariantOf string // Source blob ID when storing a derived blob
+
+	chunkHash   string          // SHA-256 of a deduplicated chunk being stored
+	maxSize     int64           // Largest blob a copy or compose may create, from its upload token; 0 is unlimited
+	customerKey []byte          // Client-supplied key (SSE-C); unexported so it is never persisted
+	trace       *requestTrace   // Where the upload's request spent its time, if traced
+	ctx         context.Context // Ends when the client goes away; nil never ends
+}
+
+// context returns the upload's request context
+func (opts BlobOptions) context() context.Context {
+	if opts.ctx == nil {
+		return context.Background()
+	}
+	return opts.ctx
 }
 
 // BlobResponse - Response for blob operations
@@ -65,19 +225,65 @@ type BlobResponse struct {
 	Size    int64  `json:"size"`
 	Created string `json:"created"`
 	FileID  string `json:"file_id"`
+	Key     string `json:"key,omitempty"`
+	Expires string `json:"expires,omitempty"`
+
+	KeyVersion uint64 `json:"key_version,omitempty"` // Of the named key, with metadata consensus
+
+	Durability Durability `json:"durability"` // Guarantees met when the upload was acknowledged
+}
+
+// Config - Startup configuration for a FileBox instance
+type Config struct {
+	StorageDir string
+	Bucket     string
+	Replicas   []string
+	Fsck       *FsckOptions // Run a consistency check before serving traffic (nil to skip)
+	Simulated  bool         // Driven by `filebox simulate`: no S3 and no background work
 }
 
 // NewFileBox creates a new FileBox instance
-func NewFileBox(storageDir, bucket string, replicas []string) *FileBox {
+func NewFileBox(cfg Config) *FileBox {
+	storageDir := cfg.StorageDir
+
 	// Create storage directory
 	os.MkdirAll(storageDir, 0755)
 
+	// Open the metadata backend
+	meta, err := newMetadataStore(storageDir)
+	if err != nil {
+		log.Fatalf("Error opening metadata store: %v", err)
+	}
+
 	// Initialize S3 client
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-		Profile:           getEnvOrDefault("AWS_PROFILE", "stg-sso-admin"),
-	}))
-	s3Client := s3.New(sess)
+	awsConfig, err := loadAWSConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Error configuring S3: %v", err)
+	}
+	usage := newUsageMeter()
+	faults := newFaultInjector()
+	s3Client := newS3Client(awsConfig, usage.s3Option, faults.s3Option)
+	if cfg.Simulated {
+		s3Client = nil
+	}
+
+	// Encryption of new containers, if a master key is configured
+	keyWrapper, err := loadKeyWrapper(awsConfig)
+	if err != nil {
+		log.Fatalf("Error configuring encryption: %v", err)
+	}
+
+	// Authentication of replication traffic between cluster members
+	clusterAuth, err := loadClusterAuthConfig()
+	if err != nil {
+		log.Fatalf("Error configuring cluster authentication: %v", err)
+	}
+
+	// Audit trail of data-mutating operations, if configured
+	audit, err := openAuditLog()
+	if err != nil {
+		log.Fatalf("Error configuring audit log: %v", err)
+	}
 
 	// Generate unique host ID and machine ID
 	hostID := generateHostID()
@@ -86,18 +292,153 @@ func NewFileBox(storageDir, bucket string, replicas []string) *FileBox {
 	fb := &FileBox{
 		storageDir:    storageDir,
 		s3Client:      s3Client,
-		bucket:        bucket,
-		maxFileSize:   100 * 1024 * 1024, // 100MB
-		files:         make(map[string]*ContainerFile),
-		replicas:      replicas,
-		replicaClient: &http.Client{Timeout: 30 * time.Second},
-		hostID:        hostID,
-		machineID:     machineID,
+		bucket:        cfg.Bucket,
+		sizeClasses:   loadSizeClasses(),
+		keys:          make(map[string]string),
+		tagIndex:      make(tagIndex),
+		replicas:      cfg.Replicas,
+		replicaClient: faults.wrapClient(newReplicaClient(clusterAuth)),
+		clusterAuth:   clusterAuth,
+		audit:         audit,
+
+		undeleteWindow: loadUndeleteWindow(),
+		uploadTokens:   loadUploadTokens(storageDir),
+		indexOnly:      loadIndexOnlyContainers(storageDir),
+		uploads:        loadUploadSessions(storageDir),
+		uploadHooks:    loadUploadHooks(),
+		scanner:        loadScanner(),
+		gcConfig:       loadGCConfig(),
+		s3Keys:         loadS3KeyLayout(),
+		s3Tagging:      getEnvBool("S3_OBJECT_TAGGING", true),
+		checkpoint:     checkpointState{interval: loadCheckpointInterval()},
+		expiry:         loadExpiryState(),
+		replication:    newReplicator(loadReplicationConfig(), cfg.Replicas),
+		health:         loadPeerHealth(storageDir, cfg.Replicas),
+		metaOps:        loadMetaOpLog(storageDir, cfg.Replicas),
+		catchUp:        loadCatchUpState(),
+		protocols:      protocolState{peers: make(map[string]*PeerProtocol)},
+		usage:          usage,
+		eviction:       loadEvictionPolicy(),
+		access:         loadAccessTracker(),
+		cache:          loadBlobCache(),
+		readahead:      loadReadahead(),
+		rangeReads:     loadRangeReadConfig(),
+		dr:             newDRState(awsConfig),
+		mode:           loadModeState(storageDir),
+		bootstrap:      loadBootstrapState(storageDir),
+		recovery:       newRecoveryReport(),
+		foreignPolicy:  loadForeignPolicy(),
+		clock:          loadClockMonitor(),
+		hostID:         hostID,
+		region:         os.Getenv("NODE_REGION"),
+		machineID:      machineID,
+		tiering:        loadTieringPolicy(),
+		restores:       make(map[string]*RestoreStatus),
+		jobs:           loadJobManager(storageDir),
+		maxBulkDelete:  int(getEnvInt("BULK_DELETE_MAX_IDS", defaultBulkDeleteMaxIDs)),
+		meta:           meta,
+		durability:     loadDurabilityConfig(),
+		integrity:      loadIntegrityAlgorithm(),
+		placement:      loadPlacementConfig(),
+		keyWrapper:     keyWrapper,
+		tenantPolicies: loadTenantPolicies(storageDir, keyWrapper != nil),
+		admission:      newAdmissionController(loadAdmissionConfig()),
+		slo:            newSLOTracker(loadSLOConfig()),
+		preallocator:   loadPreallocator(),
+		writeMode:      loadWriteMode(),
+		mmap:           loadMmapReader(),
+		federation:     loadFederation(),
+		edge:           loadEdge(storageDir),
+		volumes:        loadVolumes(storageDir),
+		events:         loadEventNotifier(),
+		dedupe:         loadDedupeStore(),
+		bandwidth:      loadBandwidthSchedules(),
+		faults:         faults,
+		dataKeys:       dataKeyCache{keys: make(map[string][]byte)},
 	}
 
+	// Resume FID generation past anything issued before the restart
+	fidClock.restore(storageDir)
+
 	// Recover existing files
 	fb.recoverFiles()
 
+	// Pull containers missing locally from a healthy peer before serving
+	if peer := os.Getenv("BOOTSTRAP_PEER"); peer != "" {
+		fb.startBootstrap(peer, fb.machineID)
+	}
+
+	// Cross-check recovered containers before anything is served or uploaded
+	if cfg.Fsck != nil {
+		report := fb.runFsck(*cfg.Fsck)
+		report.log()
+		fb.recovery.Fsck = report
+	}
+
+	// Queue recovered containers for upload
+	fb.queuePendingUploads()
+	fb.recovery.Duration = timeNow().Sub(fb.recovery.Started)
+	fb.recovery.log()
+
+	// The simulator runs replication and peer probes itself, one step at a time
+	if cfg.Simulated {
+		log.Printf("FileBox initialized for simulation - Machine ID: %d", machineID)
+		return fb
+	}
+
+	// Join the metadata consensus group, if configured
+	fb.raft = fb.startRaft()
+
+	// Start storage-class transition job
+	go fb.runTieringTransitions()
+
+	// Track the S3 upload backlog for admission control
+	go fb.runAdmissionSampler()
+
+	// Clean up abandoned resumable uploads
+	go fb.runUploadSessionExpiry()
+
+	// Persist blob read statistics
+	go fb.runAccessFlush()
+
+	// Checkpoint metadata so the store's log stays short and restarts stay fast
+	go fb.runCheckpoints()
+
+	// Free disk held by durably uploaded containers
+	go fb.runEvictions()
+
+	// Watch the storage volumes for failing disks
+	go fb.runVolumeChecks()
+
+	// Push idle containers to the federated cluster
+	go fb.runFederationPush()
+
+	// Collect orphaned S3 objects (leader only)
+	go fb.runS3GC()
+
+	// Delete S3 objects of containers whose blobs all expired or were deleted (leader only)
+	go fb.runExpiry()
+
+	// Agree on a replication protocol version with each replica
+	go fb.helloPeers()
+	fb.startReplicationSenders()
+	fb.startMetaOpSenders()
+
+	// Catch up replica copies whose operations arrived with a gap
+	go fb.runGapChecks()
+
+	// Probe replicas behind an open circuit breaker and replay what they missed
+	go fb.runPeerProbes()
+
+	// Watch for clock skew against the replicas
+	go fb.runClockChecks()
+
+	// Copy uploaded containers missing from the DR bucket
+	go fb.runDRReconcile()
+
+	// Finish scans interrupted by the last shutdown
+	go fb.resumePendingScans()
+
 	log.Printf("FileBox initialized - Host ID: %s, Machine ID: %d", hostID, machineID)
 	return fb
 }
@@ -105,11 +446,20 @@ func NewFileBox(storageDir, bucket string, replicas []string) *FileBox {
 // generateHostID creates a unique host ID
 func generateHostID() string {
 	hostname, _ := os.Hostname()
-	return fmt.Sprintf("%s-%d", hostname, time.Now().Unix())
+	return fmt.Sprintf("%s-%d", hostname, timeNow().Unix())
 }
 
-// generateMachineID creates a unique machine ID for this host
+// generateMachineID creates a unique machine ID for this host. MACHINE_ID
+// overrides it, for running several nodes on one host.
 func generateMachineID() uint32 {
+	if value := os.Getenv("MACHINE_ID"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err == nil {
+			return uint32(id)
+		}
+		log.Printf("Invalid MACHINE_ID %q, using the hostname", value)
+	}
+
 	// Use hostname hash as machine ID
 	hostname, _ := os.Hostname()
 	hash := 0
@@ -119,140 +469,502 @@ func generateMachineID() uint32 {
 	return uint32(hash & 0xFFFFFFFF)
 }
 
-// getOrCreateContainerFile finds an existing container file or creates a new one
-func (fb *FileBox) getOrCreateContainerFile(requiredSpace int64) *ContainerFile {
+// reserve claims the next length bytes of a container, and the index entry
+// of the record written there, and returns their offset and index, or false
+// if they would take it past limit. The entry stays an uncommitted
+// placeholder until reserveBlob fills it in, so blob IDs follow record
+// order, as a rebuild from record headers numbers them, whatever order
+// uploads finish in. Callers must hold fb.fileLock exclusively, or for
+// reading along with the container's lock.
+func (c *ContainerFile) reserve(length, limit int64) (int64, int, bool) {
+	if c.Size+length > limit {
+		return 0, 0, false
+	}
+	offset := c.Size
+	c.Size += length
+	index := len(c.Blobs)
+	c.Blobs = append(c.Blobs, BlobInfo{
+		ID:          formatBlobID(c.FID.String(), index),
+		Offset:      offset + recordHeaderSize,
+		Uncommitted: true,
+	})
+	return offset, index, true
+}
+
+// reserveSpace finds an open container of the blob's size class, or creates
+// one, and reserves requiredSpace bytes and an index entry in it. Each
+// upload writes only inside its own range, so concurrent writes to a
+// container never overlap. The caller must pass the container to
+// releaseContainer once its write is done.
+func (fb *FileBox) reserveSpace(tenant string, class SizeClass, requiredSpace int64) (*ContainerFile, int64, int) {
+	encrypted := fb.encryptsTenant(tenant)
+
+	// Usually an open container has room, and only it needs locking
+	fb.fileLock.RLock()
+	containerFile, offset, index, ok := fb.reserveOpen(tenant, class, encrypted, requiredSpace)
+	fb.fileLock.RUnlock()
+	if ok {
+		return containerFile, offset, index
+	}
+
 	fb.fileLock.Lock()
 	defer fb.fileLock.Unlock()
 
-	// Find existing file that can accept this blob
-	for _, file := range fb.files {
-		if !file.Uploaded && !file.Uploading && (file.Size+requiredSpace) <= fb.maxFileSize {
-			return file
-		}
+	// Another upload may have created a container in the meantime
+	if containerFile, offset, index, ok := fb.reserveOpen(tenant, class, encrypted, requiredSpace); ok {
+		return containerFile, offset, index
 	}
 
 	// Create new container file
 	fid := NewFIDWithMachineID(fb.machineID)
 	fidStr := fid.String()
-	filePath := filepath.Join(fb.storageDir, fidStr)
+	filePath := fb.newContainerPath(fidStr, class.ContainerSize)
+
+	containerFile = &ContainerFile{
+		FID:       fid,
+		FilePath:  filePath,
+		Size:      0,
+		Created:   timeNow(),
+		Blobs:     make([]BlobInfo, 0),
+		Tenant:    tenant,
+		SizeClass: class.Name,
+		Encrypted: encrypted,
+		writers:   1,
+	}
 
-	containerFile := &ContainerFile{
-		FID:      fid,
-		FilePath: filePath,
-		Size:     0,
-		Created:  time.Now(),
-		Blobs:    make([]BlobInfo, 0),
+	offset, index, _ = containerFile.reserve(requiredSpace, max(class.ContainerSize, requiredSpace))
+
+	fb.files.put(containerFile)
+	fb.preallocator.reserve(filePath, class.ContainerSize)
+	log.Printf("Created new %s container file: %s (required space: %d bytes)", class.Name, fidStr, requiredSpace)
+	return containerFile, offset, index
+}
+
+// reserveOpen reserves requiredSpace bytes in one of the open containers
+// of a tenant and size class, once OPEN_CONTAINERS of them have room for it.
+// Callers must hold fb.fileLock.
+func (fb *FileBox) reserveOpen(tenant string, class SizeClass, encrypted bool, requiredSpace int64) (*ContainerFile, int64, int, bool) {
+	// Find existing files that can accept this blob (containers are never shared across tenants)
+	var candidates []*ContainerFile
+	for _, file := range fb.files.all() {
+		if file.Tenant != tenant || file.SizeClass != class.Name || file.Encrypted != encrypted ||
+			file.Uploaded || file.Uploading || file.Quarantined || file.Evicted || fb.isForeign(file) {
+			continue
+		}
+		mu := fb.files.lock(file)
+		mu.RLock()
+		fits := file.Size+requiredSpace <= class.ContainerSize
+		mu.RUnlock()
+		if fits {
+			candidates = append(candidates, file)
+		}
 	}
 
-	fb.files[fidStr] = containerFile
-	log.Printf("Created new container file: %s (required space: %d bytes)", fidStr, requiredSpace)
-	return containerFile
+	// Keep up to OPEN_CONTAINERS open so concurrent appends go to different files
+	if len(candidates) < fb.placement.OpenContainers {
+		return nil, 0, 0, false
+	}
+	containerFile := fb.pickContainer(candidates)
+	mu := fb.files.lock(containerFile)
+	mu.Lock()
+	defer mu.Unlock()
+	// Uploads holding only a read lock may have filled it since
+	offset, index, ok := containerFile.reserve(requiredSpace, class.ContainerSize)
+	if ok {
+		containerFile.writers++
+	}
+	return containerFile, offset, index, ok
 }
 
 // AddBlob adds a blob to a container file
-func (fb *FileBox) AddBlob(blobData []byte) (*BlobResponse, error) {
-	// Check if blob is too large for any container file
-	requiredSpace := int64(len(blobData))
-	if requiredSpace > fb.maxFileSize {
-		return nil, fmt.Errorf("blob size %d exceeds maximum file size %d", requiredSpace, fb.maxFileSize)
+func (fb *FileBox) AddBlob(blobData []byte, opts BlobOptions) (*BlobResponse, error) {
+	ctx := opts.context()
+	if err := ctx.Err(); err != nil {
+		fb.disconnects.beforeWrite.Add(1)
+		return nil, errAbandoned(err)
+	}
+
+	// Sniff a type for blobs uploaded without one (looks at the first 512 bytes)
+	if opts.ContentType == "" {
+		opts.ContentType = http.DetectContentType(blobData)
+	}
+
+	// Tenant defaults fill in what the upload left unset
+	policy := fb.tenantPolicies.policy(opts.Tenant)
+	if opts.TTL == 0 && opts.chunkHash == "" {
+		opts.TTL = policy.ttl
+	}
+	if policy.MaxBlobSize > 0 && int64(len(blobData)) > policy.MaxBlobSize {
+		return nil, &BlobTooLargeError{Size: int64(len(blobData)), Limit: policy.MaxBlobSize}
+	}
+	if fb.dedupe.applies(blobData, opts) {
+		return fb.addChunked(blobData, opts)
+	}
+	compressed, compression := compressBlob(policy, blobData)
+
+	// Check if blob (plus its record header) is too large for any container file
+	requiredSpace := int64(len(compressed)) + recordHeaderSize
+	maxSize := fb.maxBlobSize()
+	if fb.encryptsTenant(opts.Tenant) {
+		requiredSpace += encryptedOverhead
+		maxSize -= encryptedOverhead
+	}
+	if opts.customerKey != nil {
+		requiredSpace += encryptedOverhead
+		maxSize -= encryptedOverhead
+	}
+	class, ok := fb.sizeClassFor(requiredSpace)
+	if !ok {
+		return nil, &BlobTooLargeError{Size: int64(len(blobData)), Limit: maxSize}
+	}
+
+	// The client may have gone while its body was read or admitted
+	if err := ctx.Err(); err != nil {
+		fb.disconnects.beforeWrite.Add(1)
+		return nil, errAbandoned(err)
 	}
 
-	// Get or create container file with required space
-	containerFile := fb.getOrCreateContainerFile(requiredSpace)
+	// Reserve the record's range in a container
+	started := timeNow()
+	containerFile, recordOffset, index := fb.reserveSpace(opts.Tenant, class, requiredSpace)
+	defer fb.releaseContainer(containerFile)
+	opts.trace.since(phaseLockWait, timingLock, started)
 
-	// Double-check that the file can still accept this blob (race condition protection)
+	// Encrypted containers store the sealed blob; checksums cover what is stored
+	storedData := compressed
 	fb.fileLock.RLock()
-	currentSize := containerFile.Size
-	canFit := (currentSize + requiredSpace) <= fb.maxFileSize
+	encrypted := containerFile.Encrypted
 	fb.fileLock.RUnlock()
+	if opts.customerKey != nil {
+		// Sealed with the client's key first, so the container key wraps the client's ciphertext
+		sealed, err := sealWithCustomerKey(opts.customerKey, storedData)
+		if err != nil {
+			return nil, fmt.Errorf("error encrypting blob with customer key: %v", err)
+		}
+		storedData = sealed
+	}
+	if encrypted {
+		sealed, err := fb.encryptBlob(containerFile, storedData)
+		if err != nil {
+			return nil, fmt.Errorf("error encrypting blob: %v", err)
+		}
+		storedData = sealed
+	}
 
-	if !canFit {
-		// File became full between selection and writing, get a new one
-		containerFile = fb.getOrCreateContainerFile(requiredSpace)
+	fb.fileLock.RLock()
+	filePath := containerFile.FilePath // Changes when its volume goes offline
+	fb.fileLock.RUnlock()
+	record, algorithm, digest, err := fb.encodeRecord(storedData)
+	if err == nil && int64(len(record)) != requiredSpace {
+		err = fmt.Errorf("record is %d bytes, %d were reserved", len(record), requiredSpace)
+	}
+	if err != nil {
+		fb.abortRecord(containerFile, filePath, recordOffset, requiredSpace, index)
+		return nil, fmt.Errorf("error encoding blob record: %v", err)
 	}
 
-	// Open file for appending
-	file, err := os.OpenFile(containerFile.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	file, err := fb.writeMode.open(filePath)
 	if err != nil {
+		fb.noteIOError(filePath, err)
+		fb.abortRecord(containerFile, filePath, recordOffset, requiredSpace, index)
 		return nil, fmt.Errorf("error opening container file: %v", err)
 	}
 	defer file.Close()
 
-	// Write blob data
-	offset := containerFile.Size
-	length, err := file.Write(blobData)
-	if err != nil {
+	// Write the framed record (header + blob data) into its range
+	durability := Durability{Mode: fb.durability.Mode, Timings: &DurabilityTimings{}}
+	started = timeNow()
+	fb.faults.slowDisk()
+	if err := file.append(record, recordOffset); err != nil {
+		fb.noteIOError(filePath, err)
+		fb.abortRecord(containerFile, filePath, recordOffset, requiredSpace, index)
 		return nil, fmt.Errorf("error writing blob data: %v", err)
 	}
-
-	// Create blob info
-	blobID := fmt.Sprintf("%s-%d", containerFile.FID.String(), len(containerFile.Blobs))
-	blobInfo := BlobInfo{
-		ID:     blobID,
-		Offset: offset,
-		Length: int64(length),
-		Size:   int64(length),
+	durability.Timings.Write = millis(timeNow().Sub(started))
+	opts.trace.since(phaseDisk, timingWrite, started)
+
+	// O_DSYNC and O_DIRECT appends are on disk when the write returns
+	if fb.writeMode.synced() {
+		durability.Fsynced = true
+		fb.admission.observeFsync(timeNow().Sub(started))
+	} else if fb.durability.FsyncWrites {
+		started = timeNow()
+		if err := file.Sync(); err != nil {
+			fb.noteIOError(filePath, err)
+			fb.abortRecord(containerFile, filePath, recordOffset, requiredSpace, index)
+			return nil, fmt.Errorf("error syncing container file: %v", err)
+		}
+		durability.Fsynced = true
+		durability.Timings.Fsync = millis(timeNow().Sub(started))
+		fb.admission.observeFsync(timeNow().Sub(started))
+		opts.trace.since(phaseDisk, timingFsync, started)
 	}
 
-	// Update container file
-	fb.fileLock.Lock()
-	containerFile.Blobs = append(containerFile.Blobs, blobInfo)
-	containerFile.Size += int64(length)
-	fb.fileLock.Unlock()
+	// Reserving the index entry is the point of no return; a client gone
+	// before it leaves nothing behind
+	if err := ctx.Err(); err != nil {
+		return nil, fb.abandonUpload(containerFile, filePath, recordOffset, requiredSpace, index, err)
+	}
 
-	// Check if file should be uploaded
-	if containerFile.Size >= fb.maxFileSize {
-		go fb.uploadContainerFile(containerFile.FID.String())
+	// Create blob info (offset points at the data, past the record header);
+	// the ID is the index reserved with the record's range
+	blobInfo := BlobInfo{
+		Offset: recordOffset + recordHeaderSize,
+		Length: int64(len(storedData)),
+		Size:   int64(len(blobData)),
+		Key:    opts.Key,
+
+		ContentType: opts.ContentType,
+		Tags:        opts.Tags,
+		Created:     timeNow(),
+		VariantOf:   opts.VariantOf,
+		CustomerKey: opts.customerKey != nil,
+		Compression: compression,
+		ChunkHash:   opts.chunkHash,
+	}
+	setDigest(&blobInfo, algorithm, digest)
+	if opts.TTL > 0 {
+		expiresAt := blobInfo.Created.Add(opts.TTL)
+		blobInfo.ExpiresAt = &expiresAt
+	}
+	if fb.scanner != nil && opts.VariantOf == "" && opts.chunkHash == "" {
+		blobInfo.Scan = &ScanResult{Status: ScanPending}
 	}
 
-	// Replicate to peers
-	go fb.replicateBlob(containerFile.FID.String(), blobData, offset, int64(length))
+	// Fill in the entry; nobody can read the blob until it is committed
+	started = timeNow()
+	fb.reserveBlob(containerFile, index, &blobInfo)
+	blobID := blobInfo.ID
+	opts.trace.step(timingIndex, timeNow().Sub(started))
+
+	// Replicate the whole record so replicas can rebuild their index by scanning
+	started = timeNow()
+	acks, sent := fb.replicateBlob(containerFile, record, recordOffset, int64(len(record)))
+	durability.Replicas = fb.awaitReplicaAcks(ctx, acks, sent)
+	durability.Timings.Replication = millis(timeNow().Sub(started))
+	opts.trace.since(phaseReplication, timingReplication, started)
+
+	// The index record is written last, with the commit flag; in sync mode
+	// the blob is only acknowledged once it is on disk
+	started = timeNow()
+	if err := fb.commitBlob(containerFile, index); err != nil {
+		return nil, fmt.Errorf("error syncing manifest: %v", err)
+	}
+	blobInfo.Uncommitted = false
+	durability.ManifestSynced = fb.meta.Durable()
+	durability.Timings.Manifest = millis(timeNow().Sub(started))
+	opts.trace.since(phaseDisk, timingIndex, started)
+	durability.finish()
+
+	// New blobs stay unreadable until scanned; hooks only see clean content
+	switch {
+	case blobInfo.Scan != nil:
+		go fb.scanBlob(blobInfo, opts.Tenant, blobData)
+	case len(fb.uploadHooks) > 0 && opts.VariantOf == "" && opts.chunkHash == "" && !blobInfo.CustomerKey:
+		go fb.runUploadHooks(blobInfo, opts.Tenant, blobData)
+	}
 
-	return &BlobResponse{
+	response := &BlobResponse{
 		ID:      blobID,
-		Size:    int64(length),
-		Created: time.Now().Format(time.RFC3339),
+		Size:    int64(len(blobData)),
+		Created: blobInfo.Created.Format(time.RFC3339),
 		FileID:  containerFile.FID.String(),
-	}, nil
+		Key:     opts.Key,
+
+		Durability: durability,
+	}
+	if blobInfo.ExpiresAt != nil {
+		response.Expires = blobInfo.ExpiresAt.Format(time.RFC3339)
+	}
+	return response, nil
 }
 
 // GetBlob retrieves a blob from a container file
-func (fb *FileBox) GetBlob(blobID string) ([]byte, error) {
-	// Parse blob ID to get file ID and blob index
-	// Format: {fileID}-{blobIndex}
+func (fb *FileBox) GetBlob(ctx context.Context, blobID string) ([]byte, error) {
+	fileID, blobIndex, err := parseBlobID(blobID)
+	if err != nil {
+		return nil, err
+	}
+
+	containerFile, exists := fb.files.get(fileID)
+	if !exists {
+		return nil, fmt.Errorf("container file not found: %s", fileID)
+	}
+
+	fb.fileLock.RLock()
+	quarantined := containerFile.Quarantined
+	reason := containerFile.QuarantineReason
+	blobInfo, inRange := fb.blobEntry(containerFile, blobIndex)
+	var isExpired bool
+	if inRange {
+		isExpired = expired(containerFile, blobInfo, timeNow())
+	}
+	fb.fileLock.RUnlock()
+
+	// Fail fast on containers known to be corrupted
+	if quarantined {
+		return nil, &QuarantinedError{FileID: fileID, Reason: reason}
+	}
+
+	if !inRange {
+		return nil, fmt.Errorf("blob index out of range")
+	}
+	if blobInfo.DeletedAt != nil {
+		return nil, &DeletedError{BlobID: blobID, DeletedAt: *blobInfo.DeletedAt}
+	}
+	if isExpired {
+		return nil, &DeletedError{BlobID: blobID, DeletedAt: *blobInfo.ExpiresAt, Expired: true}
+	}
+	if blobInfo.Scan != nil && blobInfo.Scan.Status != ScanClean {
+		return nil, &ScanError{BlobID: blobID, Result: *blobInfo.Scan}
+	}
+
+	return fb.readBlobPlaintext(ctx, containerFile, blobInfo)
+}
+
+// readBlobPlaintext reads a blob, verifies its checksum and decrypts it
+func (fb *FileBox) readBlobPlaintext(ctx context.Context, containerFile *ContainerFile, blobInfo BlobInfo) ([]byte, error) {
+	if len(blobInfo.Segments) > 0 {
+		return fb.readComposed(ctx, blobInfo)
+	}
+
+	// Offloaded containers are read from the federated cluster, which
+	// returns plaintext; S3 is the fallback when the container was uploaded
+	fb.fileLock.RLock()
+	federated, uploaded := containerFile.Federated, containerFile.Uploaded
+	fb.fileLock.RUnlock()
+	if federated && blobInfo.RemoteID != "" {
+		started := timeNow()
+		blobData, err := fb.federation.read(ctx, blobInfo)
+		if err == nil {
+			traceFrom(ctx).step(timingRemote, timeNow().Sub(started))
+			return blobData, nil
+		}
+		if !uploaded {
+			return nil, err
+		}
+		log.Printf("%v; reading blob %s from S3 instead", err, blobInfo.ID)
+	}
+
+	blobData, err := fb.readBlobData(ctx, containerFile, blobInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify integrity before handing data to the client
+	trace := traceFrom(ctx)
+	started := timeNow()
+	verified := verifyBlob(blobInfo, blobData)
+	trace.step(timingVerify, timeNow().Sub(started))
+	if !verified {
+		reason := fmt.Sprintf("checksum mismatch on blob %s", blobInfo.ID)
+		fb.quarantineContainer(containerFile, reason)
+		return nil, &QuarantinedError{FileID: containerFile.FID.String(), Reason: reason}
+	}
+
+	fb.fileLock.RLock()
+	encrypted := containerFile.Encrypted
+	fb.fileLock.RUnlock()
+	started = timeNow()
+	if encrypted {
+		if blobData, err = fb.decryptBlob(ctx, containerFile, blobData); err != nil {
+			return nil, err
+		}
+	}
+	if blobInfo.CustomerKey {
+		if blobData, err = openWithCustomerKey(ctx, blobInfo.ID, blobData); err != nil {
+			return nil, err
+		}
+	}
+	if encrypted || blobInfo.CustomerKey {
+		trace.step(timingDecrypt, timeNow().Sub(started))
+	}
+
+	return decompressBlob(blobInfo, blobData)
+}
+
+// formatBlobID names the blob at an index of a container
+func formatBlobID(fileID string, blobIndex int) string {
+	return fileID + "-" + strconv.Itoa(blobIndex)
+}
+
+// parseBlobID splits a blob ID into its container file ID and blob index
+// Format: {fileID}-{blobIndex}. The index must be written as formatBlobID
+// writes it, so each blob has exactly one ID.
+func parseBlobID(blobID string) (string, int, error) {
 	lastDash := strings.LastIndex(blobID, "-")
 	if lastDash == -1 {
-		return nil, fmt.Errorf("invalid blob ID format")
+		return "", 0, fmt.Errorf("invalid blob ID format")
 	}
 
 	fileID := blobID[:lastDash]
 	blobIndexStr := blobID[lastDash+1:]
 
-	var blobIndex int
-	if _, err := fmt.Sscanf(blobIndexStr, "%d", &blobIndex); err != nil {
-		return nil, fmt.Errorf("invalid blob index: %v", err)
+	blobIndex, err := strconv.Atoi(blobIndexStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid blob index: %v", err)
+	}
+	if blobIndex < 0 || strconv.Itoa(blobIndex) != blobIndexStr {
+		return "", 0, fmt.Errorf("invalid blob index: %q", blobIndexStr)
 	}
 
-	fb.fileLock.RLock()
-	containerFile, exists := fb.files[fileID]
-	fb.fileLock.RUnlock()
+	return fileID, blobIndex, nil
+}
 
+// lookupBlob finds a blob's container and index entry
+// Callers must hold fb.fileLock.
+func (fb *FileBox) lookupBlob(blobID string) (*ContainerFile, BlobInfo, bool) {
+	fileID, blobIndex, err := parseBlobID(blobID)
+	if err != nil {
+		return nil, BlobInfo{}, false
+	}
+	containerFile, exists := fb.files.get(fileID)
 	if !exists {
-		return nil, fmt.Errorf("container file not found: %s", fileID)
+		return nil, BlobInfo{}, false
 	}
+	blobInfo, ok := fb.blobEntry(containerFile, blobIndex)
+	if !ok {
+		return nil, BlobInfo{}, false
+	}
+	return containerFile, blobInfo, true
+}
 
-	if blobIndex >= len(containerFile.Blobs) {
-		return nil, fmt.Errorf("blob index out of range")
+// readBlobData reads a blob's bytes from the local container file, falling back to S3
+func (fb *FileBox) readBlobData(ctx context.Context, containerFile *ContainerFile, blobInfo BlobInfo) ([]byte, error) {
+	fb.fileLock.RLock()
+	filePath := containerFile.FilePath // Changes when its volume goes offline
+	fb.fileLock.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	blobInfo := containerFile.Blobs[blobIndex]
+	// Hot containers are read from their mapping
+	started := timeNow()
+	if blobData, ok := fb.mmap.read(filePath, blobInfo.Offset, blobInfo.Length); ok {
+		traceFrom(ctx).since(phaseDisk, timingRead, started)
+		return blobData, nil
+	}
 
 	// Read blob data from file
-	file, err := os.Open(containerFile.FilePath)
+	fb.faults.slowDisk()
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		// Local copy is gone; fall back to the uploaded S3 object
+		fb.fileLock.RLock()
+		uploaded := containerFile.Uploaded
+		fb.fileLock.RUnlock()
+		if uploaded && fb.s3Client != nil {
+			defer func() { traceFrom(ctx).step(timingS3, timeNow().Sub(started)) }()
+			return fb.readBlobThroughCache(ctx, containerFile, blobInfo)
+		}
+	}
 	if err != nil {
+		fb.noteIOError(filePath, err)
 		return nil, fmt.Errorf("error opening container file: %v", err)
 	}
 	defer file.Close()
+	defer traceFrom(ctx).since(phaseDisk, timingRead, started)
 
 	// Seek to blob offset
 	_, err = file.Seek(blobInfo.Offset, 0)
@@ -264,32 +976,47 @@ func (fb *FileBox) GetBlob(blobID string) ([]byte, error) {
 	blobData := make([]byte, blobInfo.Length)
 	_, err = io.ReadFull(file, blobData)
 	if err != nil {
+		fb.noteIOError(filePath, err)
 		return nil, fmt.Errorf("error reading blob data: %v", err)
 	}
 
 	return blobData, nil
 }
 
-// replicateBlob replicates a blob to peer hosts
-func (fb *FileBox) replicateBlob(fileID string, blobData []byte, offset, length int64) {
-	if len(fb.replicas) == 0 {
-		return
+// replicateBlob queues a blob for every peer host. The returned channel
+// receives one result per replica.
+func (fb *FileBox) replicateBlob(containerFile *ContainerFile, blobData []byte, offset, length int64) (<-chan error, int) {
+	replicas := fb.replicasFor(containerFile)
+	acks := make(chan error, len(replicas))
+	var seq, seqBase uint64
+	if len(replicas) > 0 {
+		seq, seqBase = fb.nextOpSeq(containerFile)
 	}
 
-	for _, replica := range fb.replicas {
-		go func(host string) {
-			if err := fb.sendBlobToReplica(host, fileID, blobData, offset, length); err != nil {
-				log.Printf("Failed to replicate blob to %s: %v", host, err)
-			} else {
-				log.Printf("Successfully replicated blob to %s", host)
-			}
-		}(replica)
+	for _, replica := range replicas {
+		fb.replication.queuedBytes.Add(length)
+		fb.replication.queues[replica] <- &replicationItem{
+			containerFile: containerFile,
+			data:          blobData,
+			offset:        offset,
+			length:        length,
+			seq:           seq,
+			seqBase:       seqBase,
+			done:          acks,
+		}
 	}
+
+	return acks, len(replicas)
 }
 
 // sendBlobToReplica sends a blob to a specific replica
-func (fb *FileBox) sendBlobToReplica(host, fileID string, blobData []byte, offset, length int64) error {
-	url := fmt.Sprintf("http://%s/replicate", host)
+func (fb *FileBox) sendBlobToReplica(host string, containerFile *ContainerFile, blobData []byte, offset, length int64, seq, seqBase uint64) error {
+	protocol := fb.peerProtocol(context.Background(), host)
+	if protocol.Incompatible {
+		return fmt.Errorf("replica %s: %s", host, protocol.Error)
+	}
+
+	entry := fb.replicaEntryFor(containerFile, blobData, offset, length, seq, seqBase)
 
 	// Create multipart form
 	var buf bytes.Buffer
@@ -303,139 +1030,301 @@ func (fb *FileBox) sendBlobToReplica(host, fileID string, blobData []byte, offse
 	part.Write(blobData)
 
 	// Add metadata
-	writer.WriteField("file_id", fileID)
+	writer.WriteField("file_id", entry.FileID)
 	writer.WriteField("offset", fmt.Sprintf("%d", offset))
 	writer.WriteField("length", fmt.Sprintf("%d", length))
 	writer.WriteField("host_id", fb.hostID)
 	writer.WriteField("machine_id", fmt.Sprintf("%d", fb.machineID))
-
-	writer.Close()
-
-	// Send request
-	req, err := http.NewRequest("POST", url, &buf)
-	if err != nil {
-		return err
+	writer.WriteField("tenant", entry.Tenant)
+	writer.WriteField("checksum", entry.Checksum)
+	if seq > 0 {
+		writer.WriteField("seq", strconv.FormatUint(seq, 10))
+		writer.WriteField("seq_base", strconv.FormatUint(seqBase, 10))
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-	req = req.WithContext(ctx)
-
-	resp, err := fb.replicaClient.Do(req)
-	if err != nil {
-		return err
+	if len(entry.WrappedKey) > 0 {
+		// Replicas cannot decrypt without the data key; it only travels wrapped
+		writer.WriteField("wrapped_key", base64.StdEncoding.EncodeToString(entry.WrappedKey))
+		writer.WriteField("key_id", entry.KeyID)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("replication failed: %s", string(body))
-	}
+	writer.Close()
 
-	return nil
+	return fb.postReplicate(host, protocol, buf.Bytes(), writer.FormDataContentType(), 1)
 }
 
-// uploadContainerFile uploads a container file to S3
-func (fb *FileBox) uploadContainerFile(fileID string) {
-	fb.fileLock.RLock()
-	containerFile, exists := fb.files[fileID]
-	fb.fileLock.RUnlock()
+// uploadContainerFile uploads a container file to S3 unless it is already
+// there. Calls for a container whose upload is in flight wait for that
+// upload and share its result instead of starting another.
+func (fb *FileBox) uploadContainerFile(fileID, trigger string) error {
+	return fb.uploadFlights.do(fileID, trigger, func(flight *InflightUpload) error {
+		return fb.putContainerFile(fileID, flight)
+	})
+}
 
-	if !exists || containerFile.Uploaded || containerFile.Uploading || fb.s3Client == nil {
-		return
+// putContainerFile does the upload for uploadContainerFile, filling in the
+// flight's details once they are known. Containers that need no upload
+// return nil; ones that cannot be uploaded now return why.
+func (fb *FileBox) putContainerFile(fileID string, flight *InflightUpload) error {
+	if fb.s3Client == nil {
+		return &UploadBlockedError{FileID: fileID, Reason: "S3 is not configured"}
 	}
 
-	// Mark as uploading
+	// Mark as uploading and pick the storage class while the metadata is stable;
+	// a container still being written is uploaded when its last write ends
 	fb.fileLock.Lock()
+	containerFile, exists := fb.files.get(fileID)
+	switch {
+	case !exists:
+		fb.fileLock.Unlock()
+		return &UploadBlockedError{FileID: fileID, Reason: "container file not found"}
+	case containerFile.Uploaded || containerFile.Uploading:
+		fb.fileLock.Unlock()
+		return nil
+	case containerFile.Quarantined:
+		fb.fileLock.Unlock()
+		return &UploadBlockedError{FileID: fileID, Reason: "container is quarantined"}
+	case fb.isForeign(containerFile):
+		fb.fileLock.Unlock()
+		return &UploadBlockedError{FileID: fileID, Reason: fmt.Sprintf("container belongs to machine %d", containerFile.FID.MachineID)}
+	case containerFile.writers > 0:
+		fb.fileLock.Unlock()
+		return &UploadBlockedError{FileID: fileID, Reason: "container is still being written; it is uploaded when the last write ends"}
+	}
 	containerFile.Uploading = true
+	storageClass := fb.storageClassFor(containerFile)
+	tagging := fb.containerTagging(containerFile)
+	fb.uploadFlights.describe(flight, containerFile.Tenant, containerFile.Size, storageClass)
 	fb.fileLock.Unlock()
 
-	// Generate S3 key (includes machine ID to prevent duplicates)
-	s3Key := fmt.Sprintf("files/%d/%s", containerFile.FID.MachineID, fileID)
+	// Generate S3 key from S3_KEY_TEMPLATE (includes the FID, so hosts never collide)
+	s3Key := fb.containerS3Key(containerFile)
 
-	// Upload to S3
-	file, err := os.Open(containerFile.FilePath)
+	// Upload to S3, at the pace the bandwidth schedule allows
+	file, err := os.Open(fb.filePathOf(containerFile))
 	if err != nil {
 		log.Printf("Error opening file for upload: %v", err)
-		return
+		fb.fileLock.Lock()
+		containerFile.Uploading = false
+		fb.fileLock.Unlock()
+		return err
 	}
 	defer file.Close()
 
-	_, err = fb.s3Client.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(fb.bucket),
-		Key:    aws.String(s3Key),
-		Body:   file,
+	_, err = fb.s3Client.PutObject(withUsageTenant(context.Background(), containerFile.Tenant), &s3.PutObjectInput{
+		Bucket:       aws.String(fb.bucket),
+		Key:          aws.String(s3Key),
+		Body:         fb.uploadLimiter().reader(file),
+		StorageClass: types.StorageClass(storageClass),
+		Tagging:      tagging,
 	})
 
+	// Without its escrowed key an encrypted container is unreadable elsewhere
+	fb.fileLock.RLock()
+	encrypted := containerFile.Encrypted
+	fb.fileLock.RUnlock()
+	if err == nil && encrypted {
+		if err = fb.escrowContainerKey(context.Background(), containerFile); err != nil {
+			err = fmt.Errorf("error escrowing data key: %v", err)
+		}
+	}
+
 	if err != nil {
 		log.Printf("Error uploading file %s to S3: %v", fileID, err)
 		// Reset uploading flag on failure
 		fb.fileLock.Lock()
 		containerFile.Uploading = false
 		fb.fileLock.Unlock()
-		return
+		return err
 	}
 
 	// Mark as uploaded
 	fb.fileLock.Lock()
 	containerFile.Uploaded = true
+	containerFile.UploadedAt = timeNow()
+	containerFile.S3Key = s3Key
 	containerFile.Uploading = false
+	containerFile.StorageClass = storageClass
+	size, idle := containerFile.Size, containerFile.writers == 0
 	fb.fileLock.Unlock()
 
-	log.Printf("Successfully uploaded file %s to S3", fileID)
+	fb.saveManifest(containerFile)
+	fb.logContainerSeal(containerFile)
+
+	// Nothing appends to an uploaded container; give back the space it did not use
+	if idle {
+		fb.preallocator.release(containerFile, size, fb.classContainerSize(containerFile.SizeClass))
+		fb.writeMode.forget(containerFile.FilePath)
+	}
+
+	log.Printf("Successfully uploaded file %s to S3 (storage class %s)", fileID, storageClass)
+
+	if fb.dr.enabled() {
+		go func() {
+			if err := fb.replicateToDR(context.Background(), containerFile); err != nil {
+				log.Printf("Error replicating container %s to DR bucket: %v", fileID, err)
+			}
+		}()
+	}
+	return nil
 }
 
-// recoverFiles scans existing files on startup
+// recoverFiles scans existing files on startup, recording what it found in fb.recovery
 func (fb *FileBox) recoverFiles() {
-	entries, err := os.ReadDir(fb.storageDir)
+	report := fb.recovery
+	var returning []*ContainerFile // Foreign containers registered read-only
+	entries, err := fb.listContainerFiles()
 	if err != nil {
 		log.Printf("Error reading storage directory: %v", err)
 		return
 	}
+	checkpointed := fb.checkpointedContainers()
 
 	for _, entry := range entries {
-		if entry.IsDir() {
+		fidStr := entry.name
+		fid, err := ParseFID(fidStr)
+		if err != nil {
+			report.InvalidFiles = append(report.InvalidFiles, fidStr)
 			continue
 		}
 
-		fidStr := entry.Name()
-		fid, err := ParseFID(fidStr)
+		filePath := entry.path
+		stat, err := os.Stat(filePath)
 		if err != nil {
-			log.Printf("Invalid FID in storage directory: %s", fidStr)
 			continue
 		}
+		if fid.MachineID == fb.machineID {
+			fidClock.advance(fid.Timestamp, fid.Sequence)
+		}
 
-		// Check if this file was created by this host
-		if fid.MachineID != fb.machineID {
-			log.Printf("File %s was created by machine %d, not %d", fidStr, fid.MachineID, fb.machineID)
-			continue
+		// Files created by another machine are handled per FOREIGN_FILES
+		if !fb.ownsMachine(fid.MachineID) {
+			foreign := ForeignFile{FileID: fidStr, MachineID: fid.MachineID, Size: stat.Size(), Action: fb.foreignPolicy}
+			report.Foreign = append(report.Foreign, foreign)
+			switch fb.foreignPolicy {
+			case ForeignSkip:
+				continue
+			case ForeignReadOnly, ForeignReturn:
+				returning = append(returning, fb.registerForeignFile(fid, filePath, stat))
+				continue
+			case ForeignAdopt:
+				if err := fb.bootstrap.adopt(fid.MachineID); err != nil {
+					log.Printf("Error recording adopted machine %d: %v", fid.MachineID, err)
+				}
+			}
 		}
+		report.ContainersFound++
 
-		filePath := filepath.Join(fb.storageDir, fidStr)
-		stat, err := os.Stat(filePath)
-		if err != nil {
-			continue
+		containerFile, fromCheckpoint := checkpointed[fidStr]
+		if fromCheckpoint {
+			report.FromCheckpoint++
+		} else if containerFile, err = fb.loadManifest(fidStr); err != nil {
+			log.Printf("Error loading manifest for %s: %v", fidStr, err)
+		}
+		hadManifest := containerFile != nil
+		refused := !hadManifest && fb.indexOnly.has(fidStr)
+		if !hadManifest {
+			// No manifest yet - the blob index is rebuilt from record headers below
+			containerFile = &ContainerFile{
+				FID:      fid,
+				Size:     0,
+				Created:  stat.ModTime(),
+				Uploaded: false,
+				Blobs:    make([]BlobInfo, 0),
+			}
+			fb.recoverKeyEscrow(containerFile)
+			if refused {
+				// Records after a copy or composed blob would come back under the wrong IDs
+				containerFile.Quarantined, containerFile.QuarantineReason = true, indexOnlyRebuildReason
+				report.RebuildsRefused = append(report.RebuildsRefused, fidStr)
+			} else {
+				report.IndexesRebuilt = append(report.IndexesRebuilt, fidStr)
+			}
+		} else {
+			report.ManifestsLoaded++
+			fb.noteIndexOnly(containerFile)
+		}
+		containerFile.FID = fid
+		containerFile.FilePath = filePath
+		containerFile.Evicted = false   // Eviction did not finish; the local copy is still good
+		containerFile.Uploading = false // Any upload in flight ended with the process
+		if containerFile.Quarantined && strings.HasPrefix(containerFile.QuarantineReason, lostVolumeReason) {
+			containerFile.Quarantined, containerFile.QuarantineReason = false, "" // Its volume is back
+			log.Printf("Container %s is on an available volume again", fidStr)
+		}
+		adopted := fb.recordProvenance(containerFile)
+
+		// Commit what a crash left uncommitted if its record is intact, and
+		// adopt complete records written after the manifest was last saved
+		committed, aborted := fb.recoverUncommitted(containerFile, stat.Size())
+		report.AbortedUploads = append(report.AbortedUploads, aborted...)
+		replayed := 0
+		if !refused {
+			replayed = fb.adoptTrailingRecords(containerFile, stat.Size())
+		}
+		if hadManifest {
+			report.RecordsReplayed += replayed
+		}
+		report.RecordsReplayed += committed
+		if replayed > 0 || committed > 0 || adopted {
+			fb.saveManifest(containerFile)
+		}
+
+		// New records are reserved from the in-memory size, so it must track the real file size
+		if stat.Size() != containerFile.Size {
+			if !refused {
+				report.TornWrites = append(report.TornWrites, TornWrite{FileID: fidStr, ValidSize: containerFile.Size, FileSize: stat.Size()})
+			}
+			containerFile.Size = stat.Size()
 		}
 
-		containerFile := &ContainerFile{
-			FID:      fid,
-			FilePath: filePath,
-			Size:     stat.Size(),
-			Created:  stat.ModTime(),
-			Uploaded: false,
-			Blobs:    make([]BlobInfo, 0), // Will be reconstructed on demand
+		// Containers from before size classes, or from a class no longer configured,
+		// keep filling as part of the last (catch-all) class
+		if !fb.hasSizeClass(containerFile.SizeClass) {
+			containerFile.SizeClass = fb.sizeClasses[len(fb.sizeClasses)-1].Name
 		}
 
-		fb.files[fidStr] = containerFile
+		fb.registerContainer(containerFile)
+	}
+
+	report.EvictedRecovered = fb.recoverEvictedContainers()
+	report.LostContainers = append(report.LostContainers, fb.recoverLostContainers()...)
+
+	if fb.foreignPolicy == ForeignReturn && len(returning) > 0 {
+		go fb.returnForeignContainers(returning)
+	}
+}
 
-		// Queue for upload if not already uploaded and S3 client is available
-		if !containerFile.Uploaded && fb.s3Client != nil {
-			go fb.uploadContainerFile(fidStr)
+// registerContainer adds a recovered container and its blobs to the in-memory indexes
+func (fb *FileBox) registerContainer(containerFile *ContainerFile) {
+	fb.files.put(containerFile)
+	for _, blob := range containerFile.Blobs {
+		if blob.Uncommitted {
+			continue
 		}
+		if blob.Key != "" {
+			fb.keys[blob.Key] = blob.ID
+		}
+		fb.tagIndex.add(blob)
+		fb.addSegmentRefs(blob)
+		fb.noteChunk(containerFile, blob)
 	}
+}
 
-	log.Printf("Recovered %d container files", len(fb.files))
+// queuePendingUploads starts uploads for recovered containers not yet in S3
+func (fb *FileBox) queuePendingUploads() {
+	if fb.s3Client == nil {
+		return
+	}
+
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+
+	for _, containerFile := range fb.files.all() {
+		if !containerFile.Uploaded && !containerFile.Quarantined && !fb.isForeign(containerFile) {
+			fb.recovery.UploadsQueued++
+			go fb.uploadContainerFile(containerFile.FID.String(), UploadTriggerRecovery)
+		}
+	}
 }
 
 // HTTP handlers
@@ -445,44 +1334,366 @@ func (fb *FileBox) handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req, ok := fb.parseUploadRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.claims != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, req.claims.MaxSize)
+	}
+
+	// Bodies of unknown length are assumed to be as large as a blob can be
+	size := r.ContentLength
+	if size < 0 {
+		size = fb.maxBlobSize()
+	}
+	release, err := fb.admit(r.Context(), size)
+	if err != nil {
+		writeAdmissionError(w, err)
+		return
+	}
+	defer release()
+
 	// Read blob data
 	blobData, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Blob exceeds the upload token limit of %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error reading blob data", http.StatusBadRequest)
 		return
 	}
 
-	// Add blob to container file
-	response, err := fb.AddBlob(blobData)
+	if req.opts.ContentType == "" && req.claims != nil && !req.claims.allowsContentType(http.DetectContentType(blobData)) {
+		http.Error(w, "Content type not allowed by upload token", http.StatusForbidden)
+		return
+	}
+
+	// Tokens are single-use; a failed upload hands the token back
+	if !fb.claimUploadToken(w, req) {
+		return
+	}
+	response, err := fb.storeUpload(r, req, blobData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fb.releaseUploadToken(req)
+		http.Error(w, err.Error(), uploadErrorStatus(err))
 		return
 	}
 
+	setCustomerKeyHeaders(w, req.opts.customerKey)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// uploadErrorStatus maps an AddBlob error to a response status
+func uploadErrorStatus(err error) int {
+	var tooLarge *BlobTooLargeError
+	var keyConflict *KeyVersionError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.As(err, &keyConflict), errors.Is(err, errNoRaftLeader):
+		return keyErrorStatus(err)
+	}
+	if clientGone(err) {
+		return statusClientClosedRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// uploadRequest - Where an upload goes and which token, if any, allowed it
+type uploadRequest struct {
+	opts   BlobOptions
+	token  string
+	claims *UploadTokenClaims
+}
+
+// parseUploadRequest reads upload headers and checks the upload token.
+// It writes an error response and returns false if the upload is not allowed.
+func (fb *FileBox) parseUploadRequest(w http.ResponseWriter, r *http.Request) (*uploadRequest, bool) {
+	customerKey, err := customerKeyFrom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	req := &uploadRequest{
+		opts: BlobOptions{
+			Tenant: r.Header.Get("X-FileBox-Tenant"),
+			Key:    r.Header.Get("X-FileBox-Key"),
+
+			ContentType: r.Header.Get("Content-Type"),
+			Tags:        parseTagHeaders(r.Header.Values("X-FileBox-Tag")),
+
+			customerKey: customerKey,
+		},
+		token: uploadTokenFrom(r),
+	}
+	if ttl := r.Header.Get("X-FileBox-TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid X-FileBox-TTL (want a positive duration such as 72h)", http.StatusBadRequest)
+			return nil, false
+		}
+		req.opts.TTL = d
+	}
+	return req, fb.checkUploadToken(w, req)
+}
+
+// checkUploadToken verifies the request's upload token, if it has one,
+// without using it up. Tokens fix the tenant and key and bound what the
+// client may send. It writes an error response and returns false if the
+// request is not allowed.
+func (fb *FileBox) checkUploadToken(w http.ResponseWriter, req *uploadRequest) bool {
+	if req.token == "" {
+		if fb.uploadTokens.require {
+			http.Error(w, "Upload token required", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+
+	claims, err := fb.uploadTokens.parse(req.token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	// Without a Content-Type header the body is sniffed and checked once read
+	if req.opts.ContentType != "" && !claims.allowsContentType(req.opts.ContentType) {
+		http.Error(w, "Content type not allowed by upload token", http.StatusForbidden)
+		return false
+	}
+	req.opts.Tenant, req.opts.Key = claims.Tenant, claims.Key
+	req.claims = &claims
+	return true
+}
+
+// claimUploadToken uses up the request's token, if it has one
+func (fb *FileBox) claimUploadToken(w http.ResponseWriter, req *uploadRequest) bool {
+	if req.claims == nil {
+		return true
+	}
+	if err := fb.uploadTokens.claim(*req.claims); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// releaseUploadToken makes the request's token usable again
+func (fb *FileBox) releaseUploadToken(req *uploadRequest) {
+	if req.claims != nil {
+		fb.uploadTokens.release(*req.claims)
+	}
+}
+
+// storeUpload adds an uploaded blob and records it in the audit log
+func (fb *FileBox) storeUpload(r *http.Request, req *uploadRequest, blobData []byte) (*BlobResponse, error) {
+	req.opts.trace = traceFrom(r.Context())
+	req.opts.ctx = r.Context()
+	response, err := fb.AddBlob(blobData, req.opts)
+
+	event := auditEventFor(r, AuditUpload)
+	event.Tenant = req.opts.Tenant
+	event.Key = req.opts.Key
+	event.Bytes = int64(len(blobData))
+	if req.claims != nil {
+		event.Token = tokenFingerprint(req.token)
+		event.Detail = "upload token " + req.claims.ID
+	}
+	if err != nil {
+		event.Outcome, event.Detail = "error", strings.TrimSpace(event.Detail+" "+err.Error())
+		fb.audit.record(event)
+		return nil, err
+	}
+	event.Outcome, event.BlobID, event.FileID = "ok", response.ID, response.FileID
+	fb.audit.record(event)
+
+	if err := fb.publishKey(r, response); err != nil {
+		return nil, fmt.Errorf("blob stored as %s but key %q not set: %w", response.ID, response.Key, err)
+	}
+	return response, nil
+}
+
 func (fb *FileBox) handleDownload(w http.ResponseWriter, r *http.Request) {
+	blobID := r.URL.Path[len("/blob/"):]
+	if blobID == "" {
+		http.Error(w, "Blob ID required", http.StatusBadRequest)
+		return
+	}
+
+	if strings.HasSuffix(blobID, "/hold") {
+		fb.handleBlobHold(w, r, strings.TrimSuffix(blobID, "/hold"))
+		return
+	}
+	if strings.HasSuffix(blobID, "/copy") {
+		fb.handleCopy(w, r, strings.TrimSuffix(blobID, "/copy"))
+		return
+	}
+	if strings.HasSuffix(blobID, "/undelete") {
+		fb.handleUndeleteBlob(w, r, strings.TrimSuffix(blobID, "/undelete"))
+		return
+	}
+	if r.Method == "DELETE" {
+		fb.handleDeleteBlob(w, r, blobID)
+		return
+	}
+	if r.Method == "PATCH" {
+		fb.handleUpdateBlob(w, r, blobID)
+		return
+	}
+
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	blobID := r.URL.Path[len("/blob/"):]
-	if blobID == "" {
-		http.Error(w, "Blob ID required", http.StatusBadRequest)
+	if strings.HasSuffix(blobID, "/status") {
+		fb.handleBlobStatus(w, strings.TrimSuffix(blobID, "/status"))
+		return
+	}
+	if source, ok := strings.CutSuffix(blobID, "/signature"); ok {
+		fb.handleSignature(w, r, source)
+		return
+	}
+
+	if variant := r.URL.Query().Get("variant"); variant != "" {
+		fb.serveVariant(w, r, blobID, variant)
+		return
+	}
+
+	fb.serveBlob(w, r, blobID)
+}
+
+func (fb *FileBox) handleKeyDownload(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Path[len("/key/"):]
+	if key == "" {
+		http.Error(w, "Key required", http.StatusBadRequest)
 		return
 	}
 
-	blobData, err := fb.GetBlob(blobID)
+	if source, ok := strings.CutSuffix(key, "/copy"); ok && r.Method == "POST" {
+		blobID, exists, err := fb.resolveKey(r, source)
+		if err != nil {
+			http.Error(w, err.Error(), keyErrorStatus(err))
+			return
+		}
+		if !exists {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		fb.handleCopy(w, r, blobID)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	blobID, exists, err := fb.resolveKey(r, key)
 	if err != nil {
+		http.Error(w, err.Error(), keyErrorStatus(err))
+		return
+	}
+
+	// A key that itself ends in /signature is served as it is
+	if source, ok := strings.CutSuffix(key, "/signature"); ok && !exists {
+		sourceID, sourceExists, _ := fb.resolveKey(r, source)
+		if sourceExists {
+			fb.handleSignature(w, r, sourceID)
+			return
+		}
+	}
+
+	if !exists {
+		if fb.federation.proxy(w, r, "/key/"+key) {
+			return
+		}
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	if fb.proxyKeyRead(w, r, blobID) {
+		return
+	}
+	fb.serveBlob(w, r, blobID)
+}
+
+// serveBlob writes a blob to the response, mapping read errors to status codes
+func (fb *FileBox) serveBlob(w http.ResponseWriter, r *http.Request, blobID string) {
+	if fb.serveComposed(w, r, blobID) {
+		return
+	}
+
+	customerKey, err := customerKeyFrom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	blobData, err := fb.GetBlob(withCustomerKey(r.Context(), customerKey), blobID)
+	if clientGone(err) {
+		fb.disconnects.download.Add(1)
+		w.WriteHeader(statusClientClosedRequest) // Only for the access log and SLO tracking
+		return
+	}
+	if writeReadError(w, err) {
+		return
+	}
+	if err != nil {
+		fb.fileLock.RLock()
+		_, _, known := fb.lookupBlob(blobID)
+		fb.fileLock.RUnlock()
+		if !known && fb.federation.proxy(w, r, "/blob/"+blobID) {
+			return
+		}
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Write(blobData)
+	// Serve the recorded type; nosniff stops browsers second-guessing it
+	contentType := "application/octet-stream"
+	fb.fileLock.RLock()
+	if _, blobInfo, ok := fb.lookupBlob(blobID); ok && blobInfo.ContentType != "" {
+		contentType = blobInfo.ContentType
+	}
+	fb.fileLock.RUnlock()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Accept-Ranges", "bytes")
+	setCustomerKeyHeaders(w, customerKey)
+	fb.setEdgeLocation(w, r, blobID)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blobData)) // Handles Range requests
+	fb.access.record(blobID)
+	fb.noteRead(blobID)
+}
+
+// writeReadError writes the response for a blob that exists but cannot
+// be read. It returns false for other errors, such as unknown blobs.
+func writeReadError(w http.ResponseWriter, err error) bool {
+	var restoreErr *RestoreInProgressError
+	var quarantinedErr *QuarantinedError
+	var scanErr *ScanError
+	var deletedErr *DeletedError
+	var customerKeyErr *CustomerKeyError
+	switch {
+	case errors.As(err, &restoreErr):
+		writeRestoreInProgress(w, restoreErr)
+	case errors.As(err, &quarantinedErr):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.As(err, &scanErr):
+		w.Header().Set("X-FileBox-Scan-Status", scanErr.Result.Status)
+		http.Error(w, err.Error(), scanErr.StatusCode())
+	case errors.As(err, &deletedErr):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.As(err, &customerKeyErr):
+		http.Error(w, err.Error(), customerKeyErr.StatusCode())
+	default:
+		return false
+	}
+	return true
 }
 
 func (fb *FileBox) handleReplicate(w http.ResponseWriter, r *http.Request) {
@@ -491,12 +1702,24 @@ func (fb *FileBox) handleReplicate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Compressed bodies are decoded before the form is parsed
+	closeBody, err := decodeReplicateBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	defer closeBody()
+
 	// Parse multipart form
-	err := r.ParseMultipartForm(32 << 20)
+	err = r.ParseMultipartForm(32 << 20)
 	if err != nil {
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
 		return
 	}
+	if r.FormValue("batch") != "" {
+		fb.handleReplicateBatch(w, r)
+		return
+	}
 
 	// Get blob data
 	file, _, err := r.FormFile("blob")
@@ -517,58 +1740,150 @@ func (fb *FileBox) handleReplicate(w http.ResponseWriter, r *http.Request) {
 	offsetStr := r.FormValue("offset")
 	lengthStr := r.FormValue("length")
 	hostID := r.FormValue("host_id")
+	tenant := r.FormValue("tenant")
+	wrappedKey, err := base64.StdEncoding.DecodeString(r.FormValue("wrapped_key"))
+	if err != nil {
+		http.Error(w, "Invalid wrapped key", http.StatusBadRequest)
+		return
+	}
 
 	if fileID == "" || offsetStr == "" || lengthStr == "" {
 		http.Error(w, "Missing required fields", http.StatusBadRequest)
 		return
 	}
 
-	var offset, length int64
-	fmt.Sscanf(offsetStr, "%d", &offset)
-	fmt.Sscanf(lengthStr, "%d", &length)
+	if err := fb.checkSenderMachine(hostID, r.FormValue("machine_id")); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	entry := replicaEntry{FileID: fileID, Tenant: tenant, WrappedKey: wrappedKey, KeyID: r.FormValue("key_id"), Checksum: r.FormValue("checksum")}
+	fmt.Sscanf(offsetStr, "%d", &entry.Offset)
+	fmt.Sscanf(lengthStr, "%d", &entry.Length)
+	if seqStr := r.FormValue("seq"); seqStr != "" {
+		fmt.Sscanf(seqStr, "%d", &entry.Seq)
+		fmt.Sscanf(r.FormValue("seq_base"), "%d", &entry.SeqBase)
+	}
 
-	// Create or get container file
-	fb.fileLock.Lock()
-	containerFile, exists := fb.files[fileID]
-	if !exists {
-		// Create new container file for replication
-		fid, err := ParseFID(fileID)
-		if err != nil {
-			fb.fileLock.Unlock()
-			http.Error(w, "Invalid file ID", http.StatusBadRequest)
-			return
-		}
+	if status, err := fb.storeReplica(auditEventFor(r, AuditReplicate), hostID, entry, blobData); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// newReplicaContainer registers a container whose replicated records or
+// operations have just started to arrive. Callers must hold fb.fileLock exclusively.
+func (fb *FileBox) newReplicaContainer(fileID string) (*ContainerFile, error) {
+	fid, err := ParseFID(fileID)
+	if err != nil {
+		return nil, err
+	}
+	fidClock.observe(fid.Timestamp)
 
-		filePath := filepath.Join(fb.storageDir, fileID)
-		containerFile = &ContainerFile{
-			FID:      fid,
-			FilePath: filePath,
-			Size:     0,
-			Created:  time.Now(),
-			Blobs:    make([]BlobInfo, 0),
+	containerFile := &ContainerFile{
+		FID:      fid,
+		FilePath: fb.newContainerPath(fileID, 0),
+		Size:     0,
+		Created:  timeNow(),
+		Blobs:    make([]BlobInfo, 0),
+	}
+	fb.files.put(containerFile)
+	return containerFile, nil
+}
+
+// writeReplicaRecord writes a replicated record at its offset once
+// checkReplicaWrite has allowed it. Callers must hold fb.fileLock for
+// reading and the container's lock.
+func (fb *FileBox) writeReplicaRecord(containerFile *ContainerFile, held bool, hostID string, offset int64, blobData []byte) (int, error) {
+	if err := fb.checkReplicaWrite(containerFile, held, hostID, offset, blobData); err != nil {
+		if _, ok := err.(*WriteConflictError); ok {
+			return http.StatusConflict, err
 		}
-		fb.files[fileID] = containerFile
+		return http.StatusInternalServerError, errors.New("Error reading existing data")
 	}
-	fb.fileLock.Unlock()
 
 	// Write blob data to file at specified offset
 	fileHandle, err := os.OpenFile(containerFile.FilePath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		http.Error(w, "Error opening file", http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError, errors.New("Error opening file")
 	}
 	defer fileHandle.Close()
 
 	_, err = fileHandle.Seek(offset, 0)
 	if err != nil {
-		http.Error(w, "Error seeking to offset", http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError, errors.New("Error seeking to offset")
 	}
 
 	_, err = fileHandle.Write(blobData)
 	if err != nil {
-		http.Error(w, "Error writing blob data", http.StatusInternalServerError)
-		return
+		return http.StatusInternalServerError, errors.New("Error writing blob data")
+	}
+	return http.StatusOK, nil
+}
+
+// storeReplica writes one replicated record into the local copy of its
+// container and audits it, returning the HTTP status to fail the request with
+func (fb *FileBox) storeReplica(event AuditEvent, hostID string, entry replicaEntry, blobData []byte) (int, error) {
+	fileID, offset, length, tenant, wrappedKey := entry.FileID, entry.Offset, entry.Length, entry.Tenant, entry.WrappedKey
+
+	if err := verifyReplicaPayload(entry, blobData); err != nil {
+		event.Outcome, event.Peer, event.Tenant = "refused", hostID, tenant
+		event.FileID, event.Bytes, event.Detail = fileID, length, err.Error()
+		fb.audit.record(event)
+		log.Printf("Refused corrupt replica from %s of file %s at offset %d: %v", hostID, fileID, offset, err)
+		return http.StatusBadRequest, err
+	}
+	if err := fb.checkReplicaTenant(tenant); err != nil {
+		event.Outcome, event.Peer, event.Tenant = "refused", hostID, tenant
+		event.FileID, event.Bytes, event.Detail = fileID, length, err.Error()
+		fb.audit.record(event)
+		return http.StatusForbidden, err
+	}
+
+	// Create or get container file
+	fb.fileLock.Lock()
+	containerFile, exists := fb.files.get(fileID)
+	if !exists {
+		var err error
+		if containerFile, err = fb.newReplicaContainer(fileID); err != nil {
+			fb.fileLock.Unlock()
+			return http.StatusBadRequest, errors.New("Invalid file ID")
+		}
+	}
+	if containerFile.Tenant == "" {
+		containerFile.Tenant = tenant // Created by a metadata operation, which carries no tenant
+	}
+	if len(wrappedKey) > 0 && len(containerFile.WrappedKey) == 0 {
+		containerFile.Encrypted = true
+		containerFile.WrappedKey = wrappedKey
+		containerFile.KeyID = entry.KeyID
+	}
+	fb.fileLock.Unlock()
+
+	// Checked and written under the container's lock, so two conflicting
+	// writers cannot both pass the check (see conflict.go)
+	fb.fileLock.RLock()
+	mu := fb.files.lock(containerFile)
+	mu.Lock()
+	stored, err := fb.replicaStored(containerFile, exists, offset, blobData)
+	status := http.StatusInternalServerError
+	if err == nil && !stored {
+		status, err = fb.writeReplicaRecord(containerFile, exists, hostID, offset, blobData)
+	}
+	mu.Unlock()
+	fb.fileLock.RUnlock()
+	if conflictErr, ok := err.(*WriteConflictError); ok {
+		fb.flagConflict(event, containerFile, conflictErr)
+		return http.StatusConflict, err
+	}
+	if err != nil {
+		return status, err
+	}
+
+	// A container returned to its owner is indexed from its record headers
+	if !stored && !fb.isForeign(containerFile) {
+		fb.adoptTrailingRecords(containerFile, offset+length)
 	}
 
 	// Update container file size
@@ -576,10 +1891,24 @@ func (fb *FileBox) handleReplicate(w http.ResponseWriter, r *http.Request) {
 	if offset+length > containerFile.Size {
 		containerFile.Size = offset + length
 	}
+	if fb.isForeign(containerFile) {
+		fb.sequenceAppend(containerFile, entry.Seq, entry.SeqBase)
+	}
 	fb.fileLock.Unlock()
 
-	log.Printf("Replicated blob from %s to file %s at offset %d", hostID, fileID, offset)
-	w.WriteHeader(http.StatusOK)
+	fb.saveManifest(containerFile)
+
+	event.Outcome, event.Peer, event.Tenant = "ok", hostID, tenant
+	event.FileID, event.Bytes = fileID, length
+	event.Detail = fmt.Sprintf("offset %d", offset)
+	if stored {
+		log.Printf("Replica from %s of file %s at offset %d already stored", hostID, fileID, offset)
+		event.Detail += ", already stored"
+	} else {
+		log.Printf("Replicated blob from %s to file %s at offset %d", hostID, fileID, offset)
+	}
+	fb.audit.record(event)
+	return http.StatusOK, nil
 }
 
 func (fb *FileBox) handleListFiles(w http.ResponseWriter, r *http.Request) {
@@ -589,9 +1918,9 @@ func (fb *FileBox) handleListFiles(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fb.fileLock.RLock()
-	files := make([]*ContainerFile, 0, len(fb.files))
-	for _, file := range fb.files {
-		files = append(files, file)
+	files := make([]*ContainerFile, 0, fb.files.len())
+	for _, file := range fb.files.all() {
+		files = append(files, fb.snapshotContainer(file))
 	}
 	fb.fileLock.RUnlock()
 
@@ -606,3 +1935,59 @@ func getEnvOrDefault(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvInt reads an integer setting, logging and falling back on bad values
+func getEnvInt(key string, defaultValue int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// getEnvDuration reads a duration setting, logging and falling back on bad values
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+// getEnvFloat reads a decimal setting, logging and falling back on bad values
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return f
+}
+
+// getEnvBool reads a boolean setting, logging and falling back on bad values
+func getEnvBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return b
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+var benchBlobSizes = []int{1 << 10, 64 << 10, 1 << 20}
+
+var benchConcurrency = []int{1, 4, 16}
+
+// newBenchFileBox returns a FileBox on a temporary directory with no S3 or replicas
+func newBenchFileBox(b *testing.B) *FileBox {
+	b.Helper()
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(out) })
+
+	storageDir := b.TempDir()
+	meta, err := newManifestStore(storageDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return &FileBox{
+		storageDir:    storageDir,
+		sizeClasses:   []SizeClass{{Name: "default", ContainerSize: defaultContainerSize}},
+		keys:          make(map[string]string),
+		tagIndex:      make(tagIndex),
+		replicaClient: &http.Client{},
+		machineID:     generateMachineID(),
+		restores:      make(map[string]*RestoreStatus),
+		meta:          meta,
+		placement:     PlacementConfig{OpenContainers: 1, Selection: SelectRoundRobin},
+	}
+}
+
+func benchBlob(b *testing.B, size int) []byte {
+	b.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatal(err)
+	}
+	return data
+}
+
+// runConcurrently splits b.N operations across the given number of goroutines
+func runConcurrently(b *testing.B, concurrency int, op func(i int) error) {
+	var next int64
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := atomic.AddInt64(&next, 1) - 1
+				if i >= int64(b.N) {
+					return
+				}
+				if err := op(int(i)); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkAddBlob(b *testing.B) {
+	for _, size := range benchBlobSizes {
+		for _, concurrency := range benchConcurrency {
+			b.Run(fmt.Sprintf("size=%d/concurrency=%d", size, concurrency), func(b *testing.B) {
+				fb := newBenchFileBox(b)
+				data := benchBlob(b, size)
+
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				runConcurrently(b, concurrency, func(int) error {
+					_, err := fb.AddBlob(data, BlobOptions{})
+					return err
+				})
+			})
+		}
+	}
+}
+
+// benchReaders are the local read paths GetBlob is benchmarked with
+var benchReaders = []string{"pread", "mmap"}
+
+func BenchmarkGetBlob(b *testing.B) {
+	const blobsPerRun = 64
+
+	for _, reader := range benchReaders {
+		for _, size := range benchBlobSizes {
+			for _, concurrency := range benchConcurrency {
+				b.Run(fmt.Sprintf("reader=%s/size=%d/concurrency=%d", reader, size, concurrency), func(b *testing.B) {
+					fb := newBenchFileBox(b)
+					if reader == "mmap" {
+						fb.mmap = newMmapReader(MmapConfig{HotReads: 1, MaxBytes: 1 << 30})
+					}
+					data := benchBlob(b, size)
+
+					ids := make([]string, blobsPerRun)
+					for i := range ids {
+						resp, err := fb.AddBlob(data, BlobOptions{})
+						if err != nil {
+							b.Fatal(err)
+						}
+						ids[i] = resp.ID
+					}
+
+					b.SetBytes(int64(size))
+					b.ResetTimer()
+					runConcurrently(b, concurrency, func(i int) error {
+						_, err := fb.GetBlob(context.Background(), ids[i%len(ids)])
+						return err
+					})
+				})
+			}
+		}
+	}
+}
+
+// benchReadRatios are the shares of reads in BenchmarkMixed; the rest are uploads
+var benchReadRatios = []int{50, 90}
+
+func BenchmarkMixed(b *testing.B) {
+	const (
+		blobsPerRun = 64
+		size        = 4 << 10
+	)
+
+	for _, reads := range benchReadRatios {
+		for _, concurrency := range []int{4, 16, 64} {
+			b.Run(fmt.Sprintf("reads=%d%%/concurrency=%d", reads, concurrency), func(b *testing.B) {
+				fb := newBenchFileBox(b)
+				fb.placement.OpenContainers = 4
+				data := benchBlob(b, size)
+
+				ids := make([]string, blobsPerRun)
+				for i := range ids {
+					resp, err := fb.AddBlob(data, BlobOptions{})
+					if err != nil {
+						b.Fatal(err)
+					}
+					ids[i] = resp.ID
+				}
+
+				b.SetBytes(size)
+				b.ResetTimer()
+				runConcurrently(b, concurrency, func(i int) error {
+					if i%100 < reads {
+						_, err := fb.GetBlob(context.Background(), ids[i%len(ids)])
+						return err
+					}
+					_, err := fb.AddBlob(data, BlobOptions{})
+					return err
+				})
+			})
+		}
+	}
+}
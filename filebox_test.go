@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+)
+
+// newTestFileBox starts a node on dir with no S3, replicas or background
+// work, as the simulator does; calling it again on the same directory
+// restarts the node
+func newTestFileBox(t *testing.T, dir string) *FileBox {
+	t.Helper()
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(out) })
+
+	settings := map[string]string{
+		"METADATA_BACKEND":          "manifest",
+		"MACHINE_ID":                "1",
+		"REPLICATION_STREAM_ADDR":   "off",
+		"AWS_REGION":                "us-east-1",
+		"AWS_EC2_METADATA_DISABLED": "true",
+	}
+	for key, value := range settings {
+		t.Setenv(key, value)
+	}
+
+	fb := NewFileBox(Config{StorageDir: dir, Bucket: "test", Simulated: true})
+	t.Cleanup(func() { fb.meta.Close() })
+	return fb
+}
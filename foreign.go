@@ -0,0 +1,191 @@
+// Handling of other machines' container files for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+)
+
+// Policies for container files found on disk that another machine created
+const (
+	ForeignSkip     = "skip"      // Leave them on disk, unused
+	ForeignReadOnly = "read-only" // Serve their blobs; never append, upload or delete
+	ForeignAdopt    = "adopt"     // Take over their machine ID and treat them as our own
+	ForeignReturn   = "return"    // Serve them read-only and push them back to their owner
+)
+
+// Provenance - Where an adopted container came from
+type Provenance struct {
+	OriginalMachineID uint32    `json:"original_machine_id"`
+	AdoptedBy         string    `json:"adopted_by"` // Host ID of the adopting node
+	AdoptedAt         time.Time `json:"adopted_at"`
+}
+
+// ForeignError - The blob belongs to a container another machine owns
+type ForeignError struct {
+	BlobID    string
+	MachineID uint32
+}
+
+func (e *ForeignError) Error() string {
+	return fmt.Sprintf("blob %s belongs to machine %d and is read-only here", e.BlobID, e.MachineID)
+}
+
+// NodeIdentity - Response of GET /cluster/identity
+type NodeIdentity struct {
+	HostID    string    `json:"host_id"`
+	MachineID uint32    `json:"machine_id"`
+	Time      time.Time `json:"time"` // Wall clock when the response was built, for skew checks
+}
+
+// loadForeignPolicy reads FOREIGN_FILES
+func loadForeignPolicy() string {
+	policy := getEnvOrDefault("FOREIGN_FILES", ForeignSkip)
+	switch policy {
+	case ForeignSkip, ForeignReadOnly, ForeignAdopt, ForeignReturn:
+		return policy
+	}
+	log.Printf("Invalid FOREIGN_FILES %q, using %s", policy, ForeignSkip)
+	return ForeignSkip
+}
+
+// isForeign reports whether a container belongs to another machine, either
+// as a replica copy or as a file recovered read-only
+func (fb *FileBox) isForeign(containerFile *ContainerFile) bool {
+	return !fb.ownsMachine(containerFile.FID.MachineID)
+}
+
+// recordProvenance marks an owned container created by another machine
+// ID as adopted, unless it already carries a provenance
+func (fb *FileBox) recordProvenance(containerFile *ContainerFile) bool {
+	if containerFile.FID.MachineID == fb.machineID || containerFile.Provenance != nil {
+		return false
+	}
+	containerFile.Provenance = &Provenance{
+		OriginalMachineID: containerFile.FID.MachineID,
+		AdoptedBy:         fb.hostID,
+		AdoptedAt:         timeNow().UTC(),
+	}
+	return true
+}
+
+// registerForeignFile indexes another machine's container file so its blobs
+// can be served read-only
+func (fb *FileBox) registerForeignFile(fid *FID, filePath string, stat os.FileInfo) *ContainerFile {
+	fidStr := fid.String()
+	containerFile, err := fb.loadManifest(fidStr)
+	if err != nil {
+		log.Printf("Error loading manifest for %s: %v", fidStr, err)
+	}
+	if containerFile == nil {
+		containerFile = &ContainerFile{Created: stat.ModTime()}
+	}
+	containerFile.FID = fid
+	containerFile.FilePath = filePath
+	containerFile.Evicted = false
+
+	// Replica copies only track bytes; index blobs from the record headers
+	var indexedEnd int64
+	for _, blob := range containerFile.Blobs {
+		indexedEnd = max(indexedEnd, blob.Offset+blob.Length)
+	}
+	if containerFile.Blobs == nil {
+		containerFile.Blobs = make([]BlobInfo, 0)
+	}
+	containerFile.Size = indexedEnd
+	fb.adoptTrailingRecords(containerFile, stat.Size())
+	containerFile.Size = stat.Size()
+
+	fb.registerContainer(containerFile)
+	fb.saveManifest(containerFile)
+	return containerFile
+}
+
+// returnForeignContainers pushes recovered foreign containers back to their
+// owners among the configured replicas, if the owner no longer has them
+func (fb *FileBox) returnForeignContainers(containers []*ContainerFile) {
+	ctx := context.Background()
+
+	owners := make(map[uint32]string) // Machine ID -> replica address
+	for _, replica := range fb.replicas {
+		var identity NodeIdentity
+		if err := fb.getPeerJSON(ctx, replica, "/cluster/identity", &identity); err != nil {
+			log.Printf("Cannot identify replica %s: %v", replica, err)
+			continue
+		}
+		owners[identity.MachineID] = replica
+	}
+
+	held := make(map[string][]string) // Owner address -> its container keys
+	for _, containerFile := range containers {
+		fileID := containerFile.FID.String()
+		owner, ok := owners[containerFile.FID.MachineID]
+		if !ok {
+			log.Printf("Owner of foreign container %s (machine %d) is not a configured replica; keeping it read-only",
+				fileID, containerFile.FID.MachineID)
+			continue
+		}
+
+		if _, listed := held[owner]; !listed {
+			var keys []string
+			if err := fb.getPeerJSON(ctx, owner, "/cluster/containers", &keys); err != nil {
+				log.Printf("Error listing containers on %s: %v", owner, err)
+				continue
+			}
+			held[owner] = keys
+		}
+		if slices.Contains(held[owner], fb.containerS3Key(containerFile)) {
+			continue // The owner still has it
+		}
+
+		data, err := os.ReadFile(containerFile.FilePath)
+		if err != nil {
+			log.Printf("Error reading foreign container %s: %v", fileID, err)
+			continue
+		}
+		if err := fb.sendBlobToReplica(owner, containerFile, data, 0, int64(len(data)), 0, 0); err != nil {
+			log.Printf("Error returning container %s to %s: %v", fileID, owner, err)
+			continue
+		}
+		log.Printf("Returned container %s (%d bytes) to its owner %s", fileID, len(data), owner)
+	}
+}
+
+// getPeerJSON fetches and decodes a JSON document from a cluster peer
+func (fb *FileBox) getPeerJSON(ctx context.Context, peer, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s%s", peer, path), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := fb.replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// handleClusterIdentity serves GET /cluster/identity so peers can map machine
+// IDs to hosts and compare clocks
+func (fb *FileBox) handleClusterIdentity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NodeIdentity{HostID: fb.hostID, MachineID: fb.machineID, Time: timeNow().Add(fb.faults.clockSkew()).UTC()})
+}
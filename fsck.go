@@ -0,0 +1,170 @@
+// Startup consistency check for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"filebox/pkg/containerformat"
+)
+
+// FsckOptions - Options for the startup consistency check
+type FsckOptions struct {
+	TruncateTornWrites bool // Cut container files back to the end of their last complete record
+}
+
+// TornWrite - A container file with bytes beyond its last complete record
+type TornWrite struct {
+	FileID    string `json:"file_id"`
+	ValidSize int64  `json:"valid_size"`
+	FileSize  int64  `json:"file_size"`
+	Truncated bool   `json:"truncated"`
+}
+
+// FsckReport - Result of a consistency check
+type FsckReport struct {
+	Checked            int           `json:"checked"`
+	MissingManifests   []string      `json:"missing_manifests"`  // Containers with no blob index
+	MissingContainers  []string      `json:"missing_containers"` // Manifests whose container file is gone
+	TornWrites         []TornWrite   `json:"torn_writes"`
+	UnrecoverableBlobs []string      `json:"unrecoverable_blobs"`
+	Duration           time.Duration `json:"duration"`
+}
+
+// runFsck cross-checks manifests, container file sizes and blob checksums
+func (fb *FileBox) runFsck(opts FsckOptions) *FsckReport {
+	start := timeNow()
+	report := &FsckReport{}
+
+	containers := fb.files.all()
+
+	for _, containerFile := range containers {
+		if containerFile.Evicted {
+			continue // Only the S3 copy is left
+		}
+		report.Checked++
+		fb.fsckContainer(containerFile, opts, report)
+	}
+
+	// Manifests left behind by container files that no longer exist
+	fileIDs, err := fb.meta.ListContainers()
+	if err != nil {
+		log.Printf("Error listing manifests: %v", err)
+	}
+	for _, fileID := range fileIDs {
+		if fb.containerFileExists(fileID) {
+			continue
+		}
+
+		manifest, err := fb.loadManifest(fileID)
+		if err == nil && manifest != nil && manifest.Evicted {
+			continue // Deleted on purpose after a durable upload
+		}
+
+		report.MissingContainers = append(report.MissingContainers, fileID)
+		if err != nil || manifest == nil || manifest.Uploaded {
+			continue // Uploaded blobs are still readable from S3
+		}
+		for _, blob := range manifest.Blobs {
+			report.UnrecoverableBlobs = append(report.UnrecoverableBlobs, blob.ID)
+		}
+	}
+
+	report.Duration = timeNow().Sub(start)
+	return report
+}
+
+// fsckContainer checks a single container against its manifest and record framing
+func (fb *FileBox) fsckContainer(containerFile *ContainerFile, opts FsckOptions, report *FsckReport) {
+	fileID := containerFile.FID.String()
+
+	manifest, err := fb.loadManifest(fileID)
+	if err != nil || manifest == nil {
+		report.MissingManifests = append(report.MissingManifests, fileID)
+	}
+
+	stat, err := os.Stat(containerFile.FilePath)
+	if err != nil {
+		log.Printf("fsck: cannot stat %s: %v", fileID, err)
+		return
+	}
+
+	file, err := os.Open(containerFile.FilePath)
+	if err != nil {
+		log.Printf("fsck: cannot open %s: %v", fileID, err)
+		return
+	}
+	defer file.Close()
+
+	fb.fileLock.RLock()
+	blobs := append([]BlobInfo(nil), fb.containerBlobs(containerFile)...)
+	fb.fileLock.RUnlock()
+
+	// The valid end of the container is just past the last indexed record;
+	// anything after it is a partial append that never completed
+	var indexedEnd int64
+	if len(blobs) > 0 {
+		last := blobs[len(blobs)-1]
+		indexedEnd = last.Offset + last.Length
+	}
+	_, validEnd := containerformat.NewReader(file, stat.Size()).Scan(indexedEnd)
+
+	if len(blobs) == 0 && validEnd == 0 && stat.Size() > 0 {
+		// Written before record framing existed; there is nothing to scan
+		log.Printf("fsck: container %s is unframed and has no index, skipping", fileID)
+	} else if stat.Size() > validEnd {
+		torn := TornWrite{FileID: fileID, ValidSize: validEnd, FileSize: stat.Size()}
+		if opts.TruncateTornWrites {
+			if err := os.Truncate(containerFile.FilePath, validEnd); err != nil {
+				log.Printf("fsck: error truncating %s: %v", fileID, err)
+			} else {
+				torn.Truncated = true
+				fb.fileLock.Lock()
+				containerFile.Size = validEnd
+				fb.fileLock.Unlock()
+				fb.saveManifest(containerFile)
+			}
+		}
+		report.TornWrites = append(report.TornWrites, torn)
+	}
+
+	var corrupted []string
+	for _, blob := range blobs {
+		if blob.Offset+blob.Length > stat.Size() {
+			corrupted = append(corrupted, blob.ID)
+			continue
+		}
+		data := make([]byte, blob.Length)
+		if _, err := file.ReadAt(data, blob.Offset); err != nil || !verifyBlob(blob, data) {
+			corrupted = append(corrupted, blob.ID)
+		}
+	}
+
+	if len(corrupted) > 0 {
+		report.UnrecoverableBlobs = append(report.UnrecoverableBlobs, corrupted...)
+		fb.quarantineContainer(containerFile, fmt.Sprintf("fsck found %d damaged blobs", len(corrupted)))
+	}
+}
+
+// log prints a human-readable summary of the report
+func (r *FsckReport) log() {
+	log.Printf("fsck: checked %d containers in %s", r.Checked, r.Duration)
+	for _, fileID := range r.MissingManifests {
+		log.Printf("fsck: container %s has no manifest", fileID)
+	}
+	for _, fileID := range r.MissingContainers {
+		log.Printf("fsck: manifest %s has no container file", fileID)
+	}
+	for _, torn := range r.TornWrites {
+		log.Printf("fsck: torn write in %s (%d bytes on disk, last complete record ends at %d, truncated: %v)",
+			torn.FileID, torn.FileSize, torn.ValidSize, torn.Truncated)
+	}
+	for _, blobID := range r.UnrecoverableBlobs {
+		log.Printf("fsck: unrecoverable blob %s", blobID)
+	}
+}
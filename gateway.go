@@ -0,0 +1,288 @@
+// Stateless gateway mode for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"filebox/pkg/client"
+)
+
+// `filebox gateway` runs an API tier with no storage of its own. It learns
+// the cluster from GET /topology through the smart client and forwards each
+// data plane request to the node that should serve it:
+//
+//   - Blob reads go to the blob's owner, then its replicas, then any node.
+//   - Changes to a blob (delete, copy, hold, PATCH) go to its owner.
+//   - Compose goes to the owner of the first source, whose container takes
+//     the new entry.
+//   - Uploads rotate over the nodes accepting writes.
+//   - Key reads, resumable upload chunks and everything else are tried on
+//     each node in turn until one knows the key or session.
+//
+// A node that cannot be reached or answers 5xx or 429 is skipped and the
+// request replayed on the next one, as long as its body fit in
+// GATEWAY_RETRY_BODY_BYTES; larger bodies are streamed to one node only.
+// Admin and cluster endpoints are not forwarded.
+
+// gatewayNodeHeader tells the client which node served a forwarded request
+const gatewayNodeHeader = "X-FileBox-Node"
+
+// hopHeaders are connection-scoped and never forwarded
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// gateway - Forwards client requests to storage nodes
+type gateway struct {
+	client       *client.Client
+	http         *http.Client
+	maxRetryBody int64
+
+	forwarded atomic.Int64 // Requests a node answered
+	failovers atomic.Int64 // Attempts moved on to another node
+	failed    atomic.Int64 // Requests no node answered
+}
+
+// GatewayStatus - Response of GET /gateway/status
+type GatewayStatus struct {
+	Topology  client.Topology `json:"topology"`
+	Forwarded int64           `json:"forwarded"`
+	Failovers int64           `json:"failovers"`
+	Failed    int64           `json:"failed"`
+}
+
+// retryPolicy decides whether a status from a node sends the request on to the next one
+type retryPolicy func(node string, status int) bool
+
+// retryUnavailable moves on from nodes that are failing or overloaded
+func retryUnavailable(node string, status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// retryUnknown also moves on from nodes that do not know the resource
+func retryUnknown(node string, status int) bool {
+	return retryUnavailable(node, status) || status == http.StatusNotFound
+}
+
+// runGateway runs `filebox gateway`
+func runGateway(args []string) int {
+	flags := flag.NewFlagSet("gateway", flag.ExitOnError)
+	nodes := flags.String("nodes", os.Getenv("GATEWAY_NODES"), "Comma-separated storage nodes to discover the cluster from")
+	addr := flags.String("addr", ":"+getEnvOrDefault("PORT", "8080"), "Address to listen on")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: filebox gateway [--nodes host:port,...] [--addr :8080]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var seeds []string
+	for _, node := range strings.Split(*nodes, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			seeds = append(seeds, node)
+		}
+	}
+	if flags.NArg() != 0 || len(seeds) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	c, err := client.New(client.Config{Nodes: seeds, RefreshInterval: getEnvDuration("GATEWAY_REFRESH_INTERVAL", client.DefaultRefreshInterval)})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	maxRetryBody := int64(64 << 20)
+	if value := os.Getenv("GATEWAY_RETRY_BODY_BYTES"); value != "" {
+		if maxRetryBody, err = parseByteSize(value); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid GATEWAY_RETRY_BODY_BYTES: %v\n", err)
+			return 2
+		}
+	}
+	g := &gateway{client: c, http: &http.Client{}, maxRetryBody: maxRetryBody}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := c.Refresh(ctx); err != nil {
+		log.Printf("WARNING: %v; retrying on the first request", err)
+	}
+	cancel()
+	topology := c.Topology()
+	log.Printf("Gateway listening on %s in front of %d nodes (%d machine IDs)", *addr, len(topology.Nodes), len(topology.Owners))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", g.handle)
+	mux.HandleFunc("/gateway/status", g.handleStatus)
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if err := http.Serve(listener, mux); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// route picks the nodes to try for a request, in order, and when to move on.
+// The body is passed for compose, which is routed by its first source.
+func (g *gateway) route(r *http.Request, body []byte) ([]string, retryPolicy, error) {
+	ctx, path := r.Context(), r.URL.Path
+	switch {
+	case path == "/upload" || path == "/upload/start":
+		nodes, err := g.client.WriteNodes(ctx)
+		return nodes, retryUnavailable, err
+
+	case strings.HasPrefix(path, "/blob/"):
+		blobID, _, _ := strings.Cut(path[len("/blob/"):], "/")
+		if r.Method == "GET" || r.Method == "HEAD" {
+			owner, nodes, err := g.client.ReadNodes(ctx, blobID)
+			retry := func(node string, status int) bool {
+				return retryUnavailable(node, status) || (status == http.StatusNotFound && node != owner)
+			}
+			return nodes, retry, err
+		}
+		// Copies land in the source's container too
+		owner, err := g.client.Owner(ctx, blobID)
+		return []string{owner}, retryUnavailable, err
+
+	case path == "/compose":
+		var req ComposeRequest
+		if err := json.Unmarshal(body, &req); err != nil || len(req.Sources) == 0 {
+			break // Let a node explain what is wrong
+		}
+		owner, err := g.client.Owner(ctx, req.Sources[0])
+		return []string{owner}, retryUnavailable, err
+
+	case strings.HasPrefix(path, "/upload/") || strings.HasPrefix(path, "/key/"):
+		nodes, err := g.client.Nodes(ctx)
+		return nodes, retryUnknown, err
+
+	case path == "/files" || path == "/search" || path == "/topology" || strings.HasPrefix(path, "/locate/"):
+	default:
+		return nil, nil, errGatewayNotServed
+	}
+	nodes, err := g.client.Nodes(ctx)
+	return nodes, retryUnavailable, err
+}
+
+// errGatewayNotServed is returned for paths the gateway does not forward
+var errGatewayNotServed = errors.New("not served by the gateway; ask a storage node")
+
+// handle forwards a data plane request
+func (g *gateway) handle(w http.ResponseWriter, r *http.Request) {
+	// Bodies that fit are kept so the request can be replayed on another node
+	var body []byte
+	replayable := r.ContentLength == 0 || (r.ContentLength > 0 && r.ContentLength <= g.maxRetryBody)
+	if replayable && r.ContentLength > 0 {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	nodes, retry, err := g.route(r, body)
+	switch {
+	case errors.Is(err, errGatewayNotServed):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, client.ErrNoNodes):
+		g.failed.Add(1)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !replayable && len(nodes) > 1 {
+		nodes = nodes[:1]
+	}
+
+	for i, node := range nodes {
+		last := i == len(nodes)-1
+		resp, err := g.forward(r, node, body, replayable)
+		if err != nil {
+			if r.Context().Err() != nil {
+				return // The client went away
+			}
+			g.client.MarkDown(node)
+			log.Printf("Gateway: %s %s on %s failed: %v", r.Method, r.URL.Path, node, err)
+			if !last {
+				g.failovers.Add(1)
+			}
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			g.client.MarkDown(node)
+		}
+		if !last && retry(node, resp.StatusCode) {
+			resp.Body.Close()
+			g.failovers.Add(1)
+			continue
+		}
+
+		g.forwarded.Add(1)
+		resp.Header.Set(gatewayNodeHeader, node)
+		copyResponse(w, resp)
+		resp.Body.Close()
+		return
+	}
+
+	g.failed.Add(1)
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "No storage node answered", http.StatusBadGateway)
+}
+
+// forward sends a request to one node
+func (g *gateway) forward(r *http.Request, node string, body []byte, replayable bool) (*http.Response, error) {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.URL.Scheme, out.URL.Host, out.Host = "http", node, node
+	for _, name := range hopHeaders {
+		out.Header.Del(name)
+	}
+	if replayable {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+		if len(body) == 0 {
+			out.Body = http.NoBody
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+			host = prior + ", " + host
+		}
+		out.Header.Set("X-Forwarded-For", host)
+	}
+	return g.http.Do(out)
+}
+
+// handleStatus serves GET /gateway/status
+func (g *gateway) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GatewayStatus{
+		Topology:  g.client.Topology(),
+		Forwarded: g.forwarded.Load(),
+		Failovers: g.failovers.Load(),
+		Failed:    g.failed.Load(),
+	})
+}
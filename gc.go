@@ -0,0 +1,290 @@
+// Orphaned S3 object garbage collection for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// errGCRunning is returned when a collection is requested while one is in progress
+var errGCRunning = errors.New("garbage collection already running")
+
+// GCConfig - Settings for the orphaned S3 object collector
+type GCConfig struct {
+	Leader      bool          // Only the leader lists the bucket and deletes
+	Interval    time.Duration // Time between scheduled runs; 0 disables them
+	GracePeriod time.Duration // Objects younger than this are never collected
+	DryRun      bool          // Scheduled runs only report what they would delete
+}
+
+// loadGCConfig reads CLUSTER_LEADER, S3_GC_INTERVAL, S3_GC_GRACE_PERIOD and S3_GC_DRY_RUN
+func loadGCConfig() GCConfig {
+	return GCConfig{
+		Leader:      getEnvBool("CLUSTER_LEADER", false),
+		Interval:    getEnvDuration("S3_GC_INTERVAL", 24*time.Hour),
+		GracePeriod: getEnvDuration("S3_GC_GRACE_PERIOD", 72*time.Hour),
+		DryRun:      getEnvBool("S3_GC_DRY_RUN", true),
+	}
+}
+
+// GCObject - An S3 object no node has metadata for
+type GCObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	Deleted      bool      `json:"deleted"`
+}
+
+// GCReport - Outcome of one collection run
+type GCReport struct {
+	Started        time.Time  `json:"started"`
+	Finished       time.Time  `json:"finished"`
+	DryRun         bool       `json:"dry_run"`
+	LiveContainers int        `json:"live_containers"` // Containers known across the cluster
+	Scanned        int        `json:"scanned"`         // Objects listed under the FileBox prefix
+	TooRecent      int        `json:"too_recent"`      // Orphans still inside the grace period
+	Orphans        []GCObject `json:"orphans"`
+	BytesReclaimed int64      `json:"bytes_reclaimed"`
+	Errors         []string   `json:"errors,omitempty"`
+}
+
+// gcState - Serializes collection runs and keeps the last report
+type gcState struct {
+	mu      sync.Mutex
+	running bool
+	last    *GCReport
+}
+
+// isLeader reports whether this node runs cluster-wide maintenance jobs
+func (fb *FileBox) isLeader() bool {
+	return fb.gcConfig.Leader
+}
+
+// runS3GC collects orphaned objects on the configured interval
+func (fb *FileBox) runS3GC() {
+	if fb.s3Client == nil || !fb.isLeader() || fb.gcConfig.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(fb.gcConfig.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report, err := fb.collectOrphans(context.Background(), fb.gcConfig.DryRun)
+		if err != nil {
+			log.Printf("S3 garbage collection skipped: %v", err)
+			continue
+		}
+		report.log()
+	}
+}
+
+// collectOrphans lists the bucket and deletes (or, in a dry run, reports)
+// container objects that no node in the cluster has metadata for
+func (fb *FileBox) collectOrphans(ctx context.Context, dryRun bool) (*GCReport, error) {
+	fb.gc.mu.Lock()
+	if fb.gc.running {
+		fb.gc.mu.Unlock()
+		return nil, errGCRunning
+	}
+	fb.gc.running = true
+	fb.gc.mu.Unlock()
+	defer func() {
+		fb.gc.mu.Lock()
+		fb.gc.running = false
+		fb.gc.mu.Unlock()
+	}()
+
+	report := &GCReport{Started: timeNow().UTC(), DryRun: dryRun, Orphans: []GCObject{}}
+
+	// Every peer must answer: a missing node's containers would look orphaned
+	live, err := fb.clusterLiveKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.LiveContainers = len(live)
+
+	cutoff := timeNow().Add(-fb.gcConfig.GracePeriod)
+	paginator := s3.NewListObjectsV2Paginator(fb.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(fb.bucket),
+		Prefix: aws.String(fb.s3ListPrefix()),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			break
+		}
+
+		for _, obj := range page.Contents {
+			objectKey := aws.ToString(obj.Key)
+			containerKey, ok := fb.containerKeyForObject(objectKey)
+			if !ok {
+				continue // Not written by FileBox
+			}
+			report.Scanned++
+			if live[containerKey] {
+				continue
+			}
+			if aws.ToTime(obj.LastModified).After(cutoff) {
+				report.TooRecent++
+				continue
+			}
+
+			orphan := GCObject{Key: objectKey, Size: aws.ToInt64(obj.Size), LastModified: aws.ToTime(obj.LastModified)}
+			if !dryRun {
+				_, err := fb.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+					Bucket: aws.String(fb.bucket),
+					Key:    aws.String(objectKey),
+				})
+				if err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", objectKey, err))
+				} else {
+					orphan.Deleted = true
+					report.BytesReclaimed += orphan.Size
+				}
+			}
+			report.Orphans = append(report.Orphans, orphan)
+		}
+	}
+
+	report.Finished = timeNow().UTC()
+	fb.gc.mu.Lock()
+	fb.gc.last = report
+	fb.gc.mu.Unlock()
+	return report, nil
+}
+
+// containerKeyForObject maps a container object or its escrowed key to the
+// container's S3 key. Objects whose names FileBox never generates are ignored.
+func (fb *FileBox) containerKeyForObject(objectKey string) (string, bool) {
+	containerKey := strings.TrimSuffix(objectKey, keyEscrowSuffix)
+	if !fb.isContainerKey(containerKey) {
+		return "", false
+	}
+	return containerKey, true
+}
+
+// localLiveKeys returns the S3 keys of every container this node has metadata for
+func (fb *FileBox) localLiveKeys() []string {
+	files := fb.files.all()
+	keys := make([]string, 0, len(files))
+	for _, file := range files {
+		keys = append(keys, fb.containerS3Key(file))
+	}
+	return keys
+}
+
+// clusterLiveKeys merges the live container keys of this node and every replica
+func (fb *FileBox) clusterLiveKeys(ctx context.Context) (map[string]bool, error) {
+	live := make(map[string]bool)
+	for _, key := range fb.localLiveKeys() {
+		live[key] = true
+	}
+
+	for _, replica := range fb.replicas {
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/cluster/containers", replica), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := fb.replicaClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("replica %s unreachable: %v", replica, err)
+		}
+		var keys []string
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&keys)
+		} else {
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error listing containers on %s: %v", replica, err)
+		}
+		for _, key := range keys {
+			live[key] = true
+		}
+	}
+	return live, nil
+}
+
+// log summarizes a collection run
+func (r *GCReport) log() {
+	action := "deleted"
+	if r.DryRun {
+		action = "would delete"
+	}
+	log.Printf("S3 garbage collection: %d objects scanned, %s %d orphans (%d bytes reclaimed), %d within grace period, %d errors",
+		r.Scanned, action, len(r.Orphans), r.BytesReclaimed, r.TooRecent, len(r.Errors))
+}
+
+// handleClusterContainers serves GET /cluster/containers to the leader
+func (fb *FileBox) handleClusterContainers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.localLiveKeys())
+}
+
+// handleGC serves GET /admin/gc (last report) and POST /admin/gc[?dry_run=false]
+func (fb *FileBox) handleGC(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		fb.gc.mu.Lock()
+		last := fb.gc.last
+		fb.gc.mu.Unlock()
+		if last == nil {
+			http.Error(w, "No garbage collection has run yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(last)
+
+	case "POST":
+		if !fb.isLeader() {
+			http.Error(w, "Garbage collection only runs on the leader (CLUSTER_LEADER)", http.StatusConflict)
+			return
+		}
+		if fb.s3Client == nil {
+			http.Error(w, "S3 is not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		// Manual runs are dry runs unless explicitly asked to delete
+		dryRun := r.URL.Query().Get("dry_run") != "false"
+		result, err := fb.runJob(r.Context(), JobGC, func(ctx context.Context) (any, error) {
+			return fb.collectOrphans(ctx, dryRun)
+		})
+		if err == errGCRunning {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		report := result.(*GCReport)
+		report.log()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
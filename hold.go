@@ -0,0 +1,185 @@
+// Legal holds for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// HeldError - The blob is under a legal hold and cannot be deleted
+type HeldError struct {
+	BlobID string
+	Scope  string // "blob" or "container"
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("blob %s is under a %s legal hold", e.BlobID, e.Scope)
+}
+
+// HoldResponse - Response for legal hold changes
+type HoldResponse struct {
+	ID        string `json:"id"`
+	LegalHold bool   `json:"legal_hold"`
+}
+
+// heldBy returns the scope of the hold protecting a blob, or "" if none does.
+// Callers must hold fb.fileLock.
+func heldBy(containerFile *ContainerFile, blob BlobInfo) string {
+	switch {
+	case blob.LegalHold:
+		return "blob"
+	case containerFile.LegalHold:
+		return "container"
+	}
+	return ""
+}
+
+// SetBlobHold places or releases a legal hold on one blob
+func (fb *FileBox) SetBlobHold(blobID string, hold bool) (HoldResponse, error) {
+	containerFile, index, err := fb.findBlob(blobID)
+	if err != nil {
+		return HoldResponse{}, err
+	}
+
+	fb.fileLock.Lock()
+	blob := &containerFile.Blobs[index]
+	changed := blob.LegalHold != hold
+	blob.LegalHold = hold
+	fb.fileLock.Unlock()
+
+	if changed {
+		fb.saveBlobMetadata(containerFile, index)
+		fb.logBlobChange(MetaOpHold, containerFile, index)
+		log.Printf("Legal hold on blob %s set to %v", blobID, hold)
+	}
+	return HoldResponse{ID: blobID, LegalHold: hold}, nil
+}
+
+// SetContainerHold places or releases a legal hold covering every blob in a container
+func (fb *FileBox) SetContainerHold(containerFile *ContainerFile, hold bool) HoldResponse {
+	fb.fileLock.Lock()
+	changed := containerFile.LegalHold != hold
+	containerFile.LegalHold = hold
+	fb.fileLock.Unlock()
+
+	fileID := containerFile.FID.String()
+	if changed {
+		fb.saveManifest(containerFile)
+		fb.logContainerHold(containerFile)
+		log.Printf("Legal hold on container %s set to %v", fileID, hold)
+	}
+	return HoldResponse{ID: fileID, LegalHold: hold}
+}
+
+// logContainerHold appends a container's hold to the metadata operation
+// log, numbered along with the container's other operations
+func (fb *FileBox) logContainerHold(containerFile *ContainerFile) {
+	if fb.metaOps == nil || fb.isForeign(containerFile) {
+		return
+	}
+	replicas := fb.replicasFor(containerFile)
+	if len(replicas) == 0 {
+		return
+	}
+
+	// The hold is read and numbered together, so a later number never carries an older hold
+	fb.fileLock.RLock()
+	mu := fb.files.lock(containerFile)
+	mu.Lock()
+	hold := containerFile.LegalHold
+	seq, base := fb.issueOpSeq(containerFile)
+	mu.Unlock()
+	fb.fileLock.RUnlock()
+
+	fb.metaOps.append(metadataOp{
+		Kind:         MetaOpContainerHold,
+		FileID:       containerFile.FID.String(),
+		Index:        -1,
+		LegalHold:    hold,
+		ContainerSeq: seq,
+		SeqBase:      base,
+		Replicas:     replicas,
+		At:           timeNow().UTC(),
+	})
+}
+
+// holdRequested maps the request method to the desired hold state
+func holdRequested(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	switch r.Method {
+	case "POST":
+		return true, true
+	case "DELETE":
+		return false, true
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false, false
+}
+
+// handleBlobHold serves POST /blob/{id}/hold. Releasing a hold is an
+// admin action, served only by handleAdminBlobs.
+func (fb *FileBox) handleBlobHold(w http.ResponseWriter, r *http.Request, blobID string) {
+	if r.Method == "DELETE" {
+		http.Error(w, "Legal holds are released with DELETE /admin/blobs/{id}/hold", http.StatusMethodNotAllowed)
+		return
+	}
+	fb.setBlobHold(w, r, blobID)
+}
+
+// handleAdminBlobs serves POST (place) and DELETE (release) /admin/blobs/{id}/hold
+func (fb *FileBox) handleAdminBlobs(w http.ResponseWriter, r *http.Request) {
+	blobID, action, ok := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/blobs/"), "/"), "/")
+	if !ok || blobID == "" || action != "hold" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	fb.setBlobHold(w, r, blobID)
+}
+
+// setBlobHold places or releases a blob's hold as the request's method asks
+func (fb *FileBox) setBlobHold(w http.ResponseWriter, r *http.Request, blobID string) {
+	hold, ok := holdRequested(w, r)
+	if !ok {
+		return
+	}
+
+	response, err := fb.SetBlobHold(blobID, hold)
+
+	event := auditEventFor(r, AuditHold)
+	event.BlobID = blobID
+	event.Detail = fmt.Sprintf("legal_hold=%v", hold)
+	if err != nil {
+		event.Outcome = "error"
+		fb.audit.record(event)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	event.Outcome = "ok"
+	fb.audit.record(event)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleContainerHold serves POST (place) and DELETE (release) /admin/containers/{fid}/hold
+func (fb *FileBox) handleContainerHold(w http.ResponseWriter, r *http.Request, containerFile *ContainerFile) {
+	hold, ok := holdRequested(w, r)
+	if !ok {
+		return
+	}
+	response := fb.SetContainerHold(containerFile, hold)
+
+	event := auditEventFor(r, AuditHold)
+	event.FileID = response.ID
+	event.Detail = fmt.Sprintf("legal_hold=%v", hold)
+	event.Outcome = "ok"
+	fb.audit.record(event)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestBlobHoldReleasedOnlyByAdmin checks that the data plane can place a
+// hold but not release one, and that the admin route releases it
+func TestBlobHoldReleasedOnlyByAdmin(t *testing.T) {
+	fb := newTestFileBox(t, t.TempDir())
+	blob, err := fb.AddBlob([]byte("evidence"), BlobOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := func() bool {
+		containerFile, index, err := fb.findBlob(blob.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fb.fileLock.RLock()
+		defer fb.fileLock.RUnlock()
+		return containerFile.Blobs[index].LegalHold
+	}
+
+	steps := []struct {
+		method, path string
+		admin        bool
+		status       int
+		held         bool
+	}{
+		{"POST", "/blob/" + blob.ID + "/hold", false, http.StatusOK, true},
+		{"DELETE", "/blob/" + blob.ID + "/hold", false, http.StatusMethodNotAllowed, true},
+		{"DELETE", "/admin/blobs/" + blob.ID + "/hold", true, http.StatusOK, false},
+	}
+	for _, step := range steps {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(step.method, step.path, nil)
+		if step.admin {
+			fb.handleAdminBlobs(w, r)
+		} else {
+			fb.handleDownload(w, r)
+		}
+		if w.Code != step.status {
+			t.Errorf("%s %s: status %d, want %d", step.method, step.path, w.Code, step.status)
+		}
+		if held() != step.held {
+			t.Errorf("after %s %s the blob's hold is %v, want %v", step.method, step.path, !step.held, step.held)
+		}
+	}
+}
+
+// TestContainerHoldReachesReplica applies a container hold operation, as
+// the owner's log sends it, to a replica copy
+func TestContainerHoldReachesReplica(t *testing.T) {
+	fb := newTestFileBox(t, t.TempDir())
+	if rec := postReplica(t, fb, testForeignFID, 0, []byte("replicated record"), ""); rec.Code != http.StatusOK {
+		t.Fatalf("replicating a record got %d: %s", rec.Code, rec.Body)
+	}
+	containerFile, ok := fb.files.get(testForeignFID)
+	if !ok {
+		t.Fatal("replica container not registered")
+	}
+
+	for _, hold := range []bool{true, false} {
+		response := fb.applyMetaOps([]metadataOp{{Kind: MetaOpContainerHold, FileID: testForeignFID, Index: -1, LegalHold: hold}})
+		if response.Applied != 1 {
+			t.Fatalf("container hold %v: %+v, want it applied", hold, response)
+		}
+		fb.fileLock.RLock()
+		got := containerFile.LegalHold
+		fb.fileLock.RUnlock()
+		if got != hold {
+			t.Errorf("replica's container hold is %v, want %v", got, hold)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Post-upload processing hooks for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// UploadHook - A processing step run in the background after each new blob is stored
+type UploadHook interface {
+	// Name identifies the hook in logs
+	Name() string
+	// Process handles one new blob; data is the plaintext blob content
+	Process(fb *FileBox, blob BlobInfo, tenant string, data []byte) error
+}
+
+// loadUploadHooks builds the hooks enabled by configuration
+func loadUploadHooks() []UploadHook {
+	var hooks []UploadHook
+	if thumbnailer := loadThumbnailer(); thumbnailer != nil {
+		hooks = append(hooks, thumbnailer)
+	}
+	return hooks
+}
+
+// runUploadHooks passes a new blob to every hook. Derived blobs (variants)
+// are not processed again.
+func (fb *FileBox) runUploadHooks(blob BlobInfo, tenant string, data []byte) {
+	for _, hook := range fb.uploadHooks {
+		if err := hook.Process(fb, blob, tenant, data); err != nil {
+			log.Printf("Upload hook %s failed for blob %s: %v", hook.Name(), blob.ID, err)
+		}
+	}
+}
+
+// linkVariant records a derived blob under its source blob
+func (fb *FileBox) linkVariant(blobID, variant, variantID string) error {
+	containerFile, index, err := fb.findBlob(blobID)
+	if err != nil {
+		return err
+	}
+
+	fb.fileLock.Lock()
+	blob := &containerFile.Blobs[index]
+	variants := make(map[string]string, len(blob.Variants)+1)
+	for name, id := range blob.Variants {
+		variants[name] = id
+	}
+	variants[variant] = variantID
+	blob.Variants = variants
+	fb.fileLock.Unlock()
+
+	fb.saveBlobMetadata(containerFile, index)
+	fb.logBlobChange(MetaOpVariant, containerFile, index)
+	return nil
+}
+
+// variantID resolves GET /blob/{id}?variant=name to the derived blob
+func (fb *FileBox) variantID(blobID, variant string) (string, error) {
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+
+	containerFile, blob, exists := fb.lookupBlob(blobID)
+	if !exists {
+		return "", fmt.Errorf("blob not found: %s", blobID)
+	}
+	if blob.DeletedAt != nil {
+		return "", &DeletedError{BlobID: blobID, DeletedAt: *blob.DeletedAt}
+	}
+	if expired(containerFile, blob, timeNow()) {
+		return "", &DeletedError{BlobID: blobID, DeletedAt: *blob.ExpiresAt, Expired: true}
+	}
+	id, exists := blob.Variants[variant]
+	if !exists {
+		return "", fmt.Errorf("blob %s has no %q variant", blobID, variant)
+	}
+	return id, nil
+}
+
+// serveVariant writes a derived blob, or the error that prevents it
+func (fb *FileBox) serveVariant(w http.ResponseWriter, r *http.Request, blobID, variant string) {
+	id, err := fb.variantID(blobID, variant)
+	if _, deleted := err.(*DeletedError); deleted {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	fb.serveBlob(w, r, id)
+}
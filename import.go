@@ -0,0 +1,285 @@
+// Import of existing files into FileBox containers
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ImportRequest - Body of POST /admin/import
+type ImportRequest struct {
+	Dir       string `json:"dir,omitempty"`       // Directory on the FileBox host
+	S3Bucket  string `json:"s3_bucket,omitempty"` // Defaults to the FileBox bucket
+	S3Prefix  string `json:"s3_prefix,omitempty"`
+	KeyPrefix string `json:"key_prefix,omitempty"` // Prepended to every named key
+	Tenant    string `json:"tenant,omitempty"`
+}
+
+// ImportResult - Summary of an import
+type ImportResult struct {
+	Imported int      `json:"imported"`
+	Bytes    int64    `json:"bytes"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// importDirectory ingests every regular file under dir, keyed by its slash-separated relative path
+func (fb *FileBox) importDirectory(ctx context.Context, dir, keyPrefix, tenant string) ImportResult {
+	var result ImportResult
+
+	err := filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", filePath, err))
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", filePath, err))
+			return nil
+		}
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", filePath, err))
+			return nil
+		}
+
+		fb.importBlob(&result, data, keyPrefix+filepath.ToSlash(rel), tenant)
+		return nil
+	})
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
+	return result
+}
+
+// importS3Prefix ingests every object under an S3 prefix, keyed by its key relative to the prefix
+func (fb *FileBox) importS3Prefix(ctx context.Context, bucket, prefix, keyPrefix, tenant string) ImportResult {
+	var result ImportResult
+
+	paginator := s3.NewListObjectsV2Paginator(fb.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			break
+		}
+
+		for _, obj := range page.Contents {
+			if ctx.Err() != nil {
+				return result
+			}
+			objectKey := aws.ToString(obj.Key)
+			if strings.HasSuffix(objectKey, "/") {
+				continue // Folder placeholder
+			}
+
+			resp, err := fb.s3Client.GetObject(ctx, &s3.GetObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(objectKey),
+			})
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("s3://%s/%s: %v", bucket, objectKey, err))
+				continue
+			}
+			data, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("s3://%s/%s: %v", bucket, objectKey, err))
+				continue
+			}
+
+			fb.importBlob(&result, data, keyPrefix+strings.TrimPrefix(objectKey, prefix), tenant)
+		}
+	}
+
+	return result
+}
+
+// importBlob stores one imported file under its named key
+func (fb *FileBox) importBlob(result *ImportResult, data []byte, key, tenant string) {
+	if _, err := fb.AddBlob(data, BlobOptions{Tenant: tenant, Key: key}); err != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", key, err))
+		return
+	}
+	result.Imported++
+	result.Bytes += int64(len(data))
+}
+
+func (fb *FileBox) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid import request", http.StatusBadRequest)
+		return
+	}
+
+	var run func(ctx context.Context) (any, error)
+	switch {
+	case req.Dir != "" && req.S3Prefix == "":
+		run = func(ctx context.Context) (any, error) {
+			return fb.importDirectory(ctx, req.Dir, req.KeyPrefix, req.Tenant), ctx.Err()
+		}
+	case req.Dir == "" && (req.S3Prefix != "" || req.S3Bucket != ""):
+		if fb.s3Client == nil {
+			http.Error(w, "S3 is not configured", http.StatusServiceUnavailable)
+			return
+		}
+		bucket := req.S3Bucket
+		if bucket == "" {
+			bucket = fb.bucket
+		}
+		run = func(ctx context.Context) (any, error) {
+			return fb.importS3Prefix(ctx, bucket, req.S3Prefix, req.KeyPrefix, req.Tenant), ctx.Err()
+		}
+	default:
+		http.Error(w, "Exactly one of dir or s3_prefix/s3_bucket is required", http.StatusBadRequest)
+		return
+	}
+
+	value, err := fb.runJob(r.Context(), JobImport, run)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	result := value.(ImportResult)
+	log.Printf("Imported %d files (%d bytes, %d errors)", result.Imported, result.Bytes, len(result.Errors))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// runImport implements `filebox import [--server HOST:PORT] [--tenant T] [--key-prefix P] <dir | s3://bucket/prefix>`
+//
+// Local directories are uploaded from the machine running the command; S3
+// prefixes are handed to the server, which reads them with its own credentials.
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	server := flags.String("server", "localhost:"+getEnvOrDefault("PORT", "8080"), "FileBox node to import into")
+	tenant := flags.String("tenant", "", "Tenant to import into")
+	keyPrefix := flags.String("key-prefix", "", "Prefix added to every named key")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: filebox import [--server HOST:PORT] [--tenant T] [--key-prefix P] <dir | s3://bucket/prefix>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	source := flags.Arg(0)
+
+	var result ImportResult
+	if rest, ok := strings.CutPrefix(source, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		body, _ := json.Marshal(ImportRequest{S3Bucket: bucket, S3Prefix: prefix, KeyPrefix: *keyPrefix, Tenant: *tenant})
+		resp, err := http.Post("http://"+*server+"/admin/import", "application/json", bytes.NewReader(body))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import: %v\n", err)
+			return 1
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(resp.Body)
+			fmt.Fprintf(os.Stderr, "import: %s\n", strings.TrimSpace(string(msg)))
+			return 1
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+	} else {
+		result = uploadDirectory("http://"+*server, source, *keyPrefix, *tenant)
+	}
+
+	for _, e := range result.Errors {
+		fmt.Fprintf(os.Stderr, "import: %s\n", e)
+	}
+	fmt.Printf("Imported %d files (%d bytes)\n", result.Imported, result.Bytes)
+	if len(result.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// uploadDirectory uploads a local directory tree through a node's /upload endpoint
+func uploadDirectory(baseURL, dir, keyPrefix, tenant string) ImportResult {
+	var result ImportResult
+
+	err := filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", filePath, err))
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", filePath, err))
+			return nil
+		}
+		key := keyPrefix + filepath.ToSlash(rel)
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", filePath, err))
+			return nil
+		}
+
+		req, _ := http.NewRequest("POST", baseURL+"/upload", bytes.NewReader(data))
+		req.Header.Set("X-FileBox-Key", key)
+		if tenant != "" {
+			req.Header.Set("X-FileBox-Tenant", tenant)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", key, err))
+			return nil
+		}
+		msg, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", key, strings.TrimSpace(string(msg))))
+			return nil
+		}
+
+		result.Imported++
+		result.Bytes += int64(len(data))
+		return nil
+	})
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	}
+
+	return result
+}
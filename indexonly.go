@@ -0,0 +1,122 @@
+// Index-only blob entries for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Blob IDs are "<container FID>-<record index>" only while every entry in
+// a container's index has a record of its own, which is what lets a lost
+// manifest be rebuilt from record headers. Copies and composed blobs
+// (including chunked uploads) are index-only entries: they take the next
+// index without writing a record, since their container may already be
+// sealed and uploaded. A container holding one cannot be rebuilt from its
+// records, because every record after the entry would come back under the
+// wrong ID. Before such an entry is first added, its container is noted in
+// node/index-only-containers.json; a restart that finds a noted container
+// without a manifest quarantines it instead of rebuilding its index. Put
+// its manifest back (from a snapshot or a replica) and restart to serve it
+// again.
+
+// indexOnlyFile lists the containers holding index-only entries
+const indexOnlyFile = "node/index-only-containers.json"
+
+// indexOnlyRebuildReason is the quarantine reason of a noted container found without a manifest
+const indexOnlyRebuildReason = "manifest missing: the container holds copies or composed blobs, so its index cannot be rebuilt from records"
+
+// indexOnlyContainers - Containers whose index cannot be rebuilt from records
+type indexOnlyContainers struct {
+	mu      sync.Mutex
+	fileIDs map[string]bool
+	path    string
+}
+
+// loadIndexOnlyContainers reads the containers noted before the last restart
+func loadIndexOnlyContainers(storageDir string) *indexOnlyContainers {
+	noted := &indexOnlyContainers{
+		fileIDs: make(map[string]bool),
+		path:    filepath.Join(storageDir, indexOnlyFile),
+	}
+	if data, err := os.ReadFile(noted.path); err == nil {
+		var fileIDs []string
+		if err := json.Unmarshal(data, &fileIDs); err != nil {
+			log.Printf("Ignoring index-only containers in %s: %v", noted.path, err)
+		}
+		for _, fileID := range fileIDs {
+			noted.fileIDs[fileID] = true
+		}
+	}
+	return noted
+}
+
+// isIndexOnly reports whether an entry has no record of its own
+func isIndexOnly(blob BlobInfo) bool {
+	return blob.CopyOf != "" || len(blob.Segments) > 0
+}
+
+// noteIndexOnly notes a container loaded from a manifest that already holds
+// index-only entries, as ones added before these notes were kept do
+func (fb *FileBox) noteIndexOnly(containerFile *ContainerFile) {
+	for _, blob := range containerFile.Blobs {
+		if isIndexOnly(blob) {
+			fb.indexOnly.note(containerFile.FID.String())
+			return
+		}
+	}
+}
+
+// has reports whether a container was noted
+func (n *indexOnlyContainers) has(fileID string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.fileIDs[fileID]
+}
+
+// note records that a container is about to hold an index-only entry. It
+// fails if the note cannot be saved, so the entry must not be added.
+func (n *indexOnlyContainers) note(fileID string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.fileIDs[fileID] {
+		return nil
+	}
+	n.fileIDs[fileID] = true
+	if err := n.save(); err != nil {
+		delete(n.fileIDs, fileID)
+		log.Printf("Error saving index-only containers: %v", err)
+		return fmt.Errorf("container %s could not be marked as holding index-only entries", fileID)
+	}
+	return nil
+}
+
+// save writes the noted containers to node/index-only-containers.json.
+// Callers must hold n.mu.
+func (n *indexOnlyContainers) save() error {
+	fileIDs := make([]string, 0, len(n.fileIDs))
+	for fileID := range n.fileIDs {
+		fileIDs = append(fileIDs, fileID)
+	}
+	sort.Strings(fileIDs)
+	data, err := json.Marshal(fileIDs)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(n.path), 0755); err != nil {
+		return err
+	}
+	tmpPath := n.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, n.path)
+}
@@ -0,0 +1,241 @@
+// Failure injection for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// Faults can be injected into a running node to watch how it degrades and
+// recovers: S3 going away, a slow disk, a replica that cannot be reached
+// and a clock that has drifted. Each lasts until cleared or for a set
+// duration. They are served under /debug/, so only with --debug.
+
+// Injectable faults
+const (
+	FaultS3        = "s3"        // Every S3 request fails
+	FaultDisk      = "disk"      // Container reads and writes are delayed
+	FaultPartition = "partition" // Requests to a peer fail
+	FaultClock     = "clock"     // This node's clock is reported shifted
+)
+
+// errInjected marks failures caused by an injected fault
+var errInjected = errors.New("injected fault")
+
+// InjectedFault - One active fault
+type InjectedFault struct {
+	Kind    string        `json:"kind"`
+	Peer    string        `json:"peer,omitempty"`  // Partitions: the peer cut off
+	Delay   time.Duration `json:"delay,omitempty"` // Slow disk: added to each container read and write
+	Skew    time.Duration `json:"skew,omitempty"`  // Clock: how far this node's time is shifted
+	Since   time.Time     `json:"since"`
+	Until   *time.Time    `json:"until,omitempty"` // Unset until cleared
+	Tripped int64         `json:"tripped"`         // Operations it has failed or delayed
+}
+
+// faultInjector - The faults active on this node. A nil injector has none.
+type faultInjector struct {
+	mu     sync.Mutex
+	faults map[string]*InjectedFault // Kind, or "partition:" + peer
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{faults: make(map[string]*InjectedFault)}
+}
+
+// active returns a fault and counts it as tripped, or nil
+func (f *faultInjector) active(name string) *InjectedFault {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fault := f.faults[name]
+	if fault == nil {
+		return nil
+	}
+	if fault.Until != nil && timeNow().After(*fault.Until) {
+		delete(f.faults, name)
+		log.Printf("Injected %s fault expired", fault.Kind)
+		return nil
+	}
+	fault.Tripped++
+	copied := *fault
+	return &copied
+}
+
+// s3Option adds a middleware to an S3 client failing every request while
+// an S3 outage is injected
+func (f *faultInjector) s3Option(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("FileBoxFaults",
+			func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (
+				middleware.InitializeOutput, middleware.Metadata, error) {
+				if f.active(FaultS3) != nil {
+					return middleware.InitializeOutput{}, middleware.Metadata{}, fmt.Errorf("%w: S3 outage", errInjected)
+				}
+				return next.HandleInitialize(ctx, in)
+			}), middleware.Before)
+	})
+}
+
+// faultTransport - Fails requests to partitioned peers
+type faultTransport struct {
+	faults *faultInjector
+	base   http.RoundTripper
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.faults.active(FaultPartition+":"+req.URL.Host) != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("%w: partitioned from %s", errInjected, req.URL.Host)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// wrapClient routes a peer client through the partition check
+func (f *faultInjector) wrapClient(client *http.Client) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &faultTransport{faults: f, base: base}
+	return client
+}
+
+// partitioned reports whether a peer is cut off, for paths that do not
+// go through the peer client
+func (f *faultInjector) partitioned(peer string) bool {
+	return f.active(FaultPartition+":"+peer) != nil
+}
+
+// slowDisk sleeps while a slow disk is injected
+func (f *faultInjector) slowDisk() {
+	if fault := f.active(FaultDisk); fault != nil {
+		time.Sleep(fault.Delay)
+	}
+}
+
+// clockSkew returns how far this node's reported time is shifted
+func (f *faultInjector) clockSkew() time.Duration {
+	if fault := f.active(FaultClock); fault != nil {
+		return fault.Skew
+	}
+	return 0
+}
+
+// list returns the active faults
+func (f *faultInjector) list() []InjectedFault {
+	if f == nil {
+		return []InjectedFault{}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := timeNow()
+	faults := make([]InjectedFault, 0, len(f.faults))
+	for name, fault := range f.faults {
+		if fault.Until != nil && now.After(*fault.Until) {
+			delete(f.faults, name)
+			continue
+		}
+		faults = append(faults, *fault)
+	}
+	return faults
+}
+
+// handleInject serves /debug/inject and /debug/inject/{kind}:
+//
+//	GET    /debug/inject                                  active faults
+//	POST   /debug/inject/s3?duration=2m                   fail every S3 request
+//	POST   /debug/inject/disk?delay=200ms                 delay container reads and writes
+//	POST   /debug/inject/partition?peer=host2:8080        fail requests to a peer
+//	POST   /debug/inject/clock?skew=-45s                  shift the time reported to peers
+//	DELETE /debug/inject[/{kind}][?peer=host2:8080]       clear faults
+func (fb *FileBox) handleInject(w http.ResponseWriter, r *http.Request) {
+	if fb.faults == nil {
+		http.Error(w, "Failure injection unavailable", http.StatusNotFound)
+		return
+	}
+	kind := strings.Trim(strings.TrimPrefix(r.URL.Path, "/debug/inject"), "/")
+	query := r.URL.Query()
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		fault := InjectedFault{Kind: kind, Since: timeNow().UTC()}
+		name := kind
+		var err error
+		switch kind {
+		case FaultS3:
+		case FaultDisk:
+			fault.Delay, err = time.ParseDuration(query.Get("delay"))
+			if err != nil || fault.Delay <= 0 {
+				http.Error(w, "delay must be a positive duration such as 200ms", http.StatusBadRequest)
+				return
+			}
+		case FaultPartition:
+			fault.Peer = query.Get("peer")
+			if fault.Peer == "" {
+				http.Error(w, "peer required (host:port as in REPLICAS)", http.StatusBadRequest)
+				return
+			}
+			name += ":" + fault.Peer
+		case FaultClock:
+			fault.Skew, err = time.ParseDuration(query.Get("skew"))
+			if err != nil || fault.Skew == 0 {
+				http.Error(w, "skew must be a non-zero duration such as -45s", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Unknown fault (want s3, disk, partition or clock)", http.StatusNotFound)
+			return
+		}
+		if value := query.Get("duration"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				http.Error(w, "duration must be a positive duration such as 2m", http.StatusBadRequest)
+				return
+			}
+			until := fault.Since.Add(d)
+			fault.Until = &until
+		}
+		fb.faults.mu.Lock()
+		fb.faults.faults[name] = &fault
+		fb.faults.mu.Unlock()
+		log.Printf("WARNING: injected %s fault %s", kind, strings.TrimPrefix(r.URL.RawQuery, "?"))
+		fb.emit("fault.injected", map[string]any{"kind": kind, "query": r.URL.RawQuery})
+	case "DELETE":
+		fb.faults.mu.Lock()
+		cleared := 0
+		for name, fault := range fb.faults.faults {
+			if (kind == "" || fault.Kind == kind) && (query.Get("peer") == "" || fault.Peer == query.Get("peer")) {
+				delete(fb.faults.faults, name)
+				cleared++
+			}
+		}
+		fb.faults.mu.Unlock()
+		log.Printf("Cleared %d injected faults", cleared)
+		fb.emit("fault.cleared", map[string]any{"kind": kind, "cleared": cleared})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.faults.list())
+}
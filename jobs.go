@@ -0,0 +1,473 @@
+// Background job manager for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Long-running operations (exports, warming, bulk deletes, imports and
+// manual maintenance runs) are jobs. Every job is listed by GET /admin/jobs,
+// waits in a FIFO queue for one of JOBS_MAX_RUNNING slots, can be canceled,
+// and is saved to node/jobs.json on every state change. Jobs that were
+// queued or running when the node stopped come back as "interrupted"; none
+// are resumed.
+
+const (
+	jobsFile              = "node/jobs.json"
+	defaultJobsMaxRunning = 4
+	defaultJobsRetain     = 500 // Finished jobs kept for GET /admin/jobs
+)
+
+// Job kinds
+const (
+	JobExport          = "export"
+	JobWarm            = "warm"
+	JobBulkDelete      = "bulk-delete"
+	JobImport          = "import"
+	JobNamespaceExport = "namespace-export"
+	JobNamespaceImport = "namespace-import"
+	JobGC              = "gc"
+	JobExpiry          = "expiry"
+)
+
+// Job states
+const (
+	JobQueued      = "queued"
+	JobRunning     = "running"
+	JobDone        = "done"
+	JobFailed      = "failed"
+	JobCanceled    = "canceled"
+	JobInterrupted = "interrupted" // Queued or running when the node stopped
+)
+
+// errJobCanceled is returned by jobs that were canceled before finishing
+var errJobCanceled = errors.New("job canceled")
+
+// JobInfo - What every job reports, embedded in each kind's status
+type JobInfo struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	State    string    `json:"state"`
+	Queued   time.Time `json:"queued"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+	Error    string    `json:"error,omitempty"`
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{} // Closed once the job ends
+	err    error         // What the job returned
+}
+
+// info returns the embedded JobInfo; every job type gets it by embedding
+func (info *JobInfo) info() *JobInfo {
+	return info
+}
+
+// finished reports whether the job has ended
+func (info *JobInfo) finished() bool {
+	return info.State != JobQueued && info.State != JobRunning
+}
+
+// backgroundJob - The status of one job, guarded by jobManager.mu
+type backgroundJob interface {
+	info() *JobInfo
+	progress() (done, total int64) // Items processed so far, for listings
+}
+
+// TaskJob - A job with no progress of its own, reporting its result when done
+type TaskJob struct {
+	JobInfo
+	Result any `json:"result,omitempty"`
+}
+
+func (j *TaskJob) progress() (int64, int64) { return 0, 0 }
+
+// jobKinds decodes saved jobs of kinds with their own status type; the rest are TaskJobs
+var jobKinds = map[string]func() backgroundJob{
+	JobExport:     func() backgroundJob { return &ExportJob{} },
+	JobWarm:       func() backgroundJob { return &WarmJob{} },
+	JobBulkDelete: func() backgroundJob { return &BulkDeleteJob{} },
+}
+
+// JobSummary - One entry of GET /admin/jobs
+type JobSummary struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	State    string    `json:"state"`
+	Queued   time.Time `json:"queued"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+	Done     int64     `json:"done"`
+	Total    int64     `json:"total"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// JobsStatus - Response of GET /admin/jobs
+type JobsStatus struct {
+	MaxRunning int          `json:"max_running"`
+	Running    int          `json:"running"`
+	Queued     int          `json:"queued"`
+	Jobs       []JobSummary `json:"jobs"` // Newest first
+}
+
+// jobFunc runs a job; it should return ctx.Err() promptly once ctx ends
+type jobFunc func(ctx context.Context) error
+
+// queuedJob - A job waiting for a slot
+type queuedJob struct {
+	job backgroundJob
+	run jobFunc
+}
+
+// jobManager - Queues, runs, tracks and saves background jobs
+type jobManager struct {
+	mu         sync.Mutex // Guards every job's status as well as the manager
+	jobs       map[string]backgroundJob
+	next       map[string]int // Last ID number handed out per kind
+	queue      []queuedJob
+	running    int
+	maxRunning int
+	retain     int
+
+	path   string
+	saveMu sync.Mutex // Serializes saves so an older snapshot never wins
+}
+
+// loadJobManager reads JOBS_MAX_RUNNING and JOBS_RETAIN and the jobs saved
+// by the last run
+func loadJobManager(storageDir string) *jobManager {
+	m := &jobManager{
+		jobs:       make(map[string]backgroundJob),
+		next:       make(map[string]int),
+		maxRunning: int(getEnvInt("JOBS_MAX_RUNNING", defaultJobsMaxRunning)),
+		retain:     int(getEnvInt("JOBS_RETAIN", defaultJobsRetain)),
+		path:       filepath.Join(storageDir, jobsFile),
+	}
+	if m.maxRunning < 1 {
+		log.Printf("Invalid JOBS_MAX_RUNNING %d, using %d", m.maxRunning, defaultJobsMaxRunning)
+		m.maxRunning = defaultJobsMaxRunning
+	}
+
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return m
+	}
+	var saved struct {
+		Next map[string]int    `json:"next"`
+		Jobs []json.RawMessage `json:"jobs"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Ignoring saved jobs in %s: %v", m.path, err)
+		return m
+	}
+	for kind, n := range saved.Next {
+		m.next[kind] = n
+	}
+	interrupted := 0
+	for _, raw := range saved.Jobs {
+		var header JobInfo
+		if err := json.Unmarshal(raw, &header); err != nil || header.ID == "" {
+			continue
+		}
+		var job backgroundJob = &TaskJob{}
+		if decode, ok := jobKinds[header.Kind]; ok {
+			job = decode()
+		}
+		if err := json.Unmarshal(raw, job); err != nil {
+			continue
+		}
+		info := job.info()
+		if !info.finished() {
+			info.State, info.Finished, info.Error = JobInterrupted, timeNow(), "node restarted"
+			interrupted++
+		}
+		info.done = make(chan struct{})
+		close(info.done)
+		m.jobs[info.ID] = job
+	}
+	log.Printf("Loaded %d jobs (%d interrupted by the restart)", len(m.jobs), interrupted)
+	if interrupted > 0 {
+		m.save()
+	}
+	return m
+}
+
+// submit queues a job and starts it once a slot is free
+func (m *jobManager) submit(kind string, job backgroundJob, run jobFunc) {
+	m.mu.Lock()
+	m.next[kind]++
+	info := job.info()
+	info.ID = fmt.Sprintf("%s-%d", kind, m.next[kind])
+	info.Kind, info.State, info.Queued = kind, JobQueued, timeNow()
+	info.ctx, info.cancel = context.WithCancel(context.Background())
+	info.done = make(chan struct{})
+	m.jobs[info.ID] = job
+	m.queue = append(m.queue, queuedJob{job: job, run: run})
+	m.startQueued()
+	m.prune()
+	m.mu.Unlock()
+
+	m.save()
+}
+
+// startQueued starts queued jobs while slots are free; callers must hold m.mu
+func (m *jobManager) startQueued() {
+	for m.running < m.maxRunning && len(m.queue) > 0 {
+		next := m.queue[0]
+		m.queue = m.queue[1:]
+		info := next.job.info()
+		info.State, info.Started = JobRunning, timeNow()
+		m.running++
+		go m.execute(next)
+	}
+}
+
+// execute runs one job and records how it ended
+func (m *jobManager) execute(q queuedJob) {
+	err := q.run(q.job.info().ctx)
+
+	m.mu.Lock()
+	info := q.job.info()
+	m.running--
+	m.end(info, err)
+	m.startQueued()
+	m.mu.Unlock()
+
+	m.save()
+	if err != nil {
+		log.Printf("Job %s ended %s: %v", info.ID, info.State, err)
+	}
+}
+
+// end records a job's outcome; callers must hold m.mu
+func (m *jobManager) end(info *JobInfo, err error) {
+	info.Finished = timeNow()
+	switch {
+	case err != nil && info.ctx.Err() != nil:
+		info.State, info.err = JobCanceled, errJobCanceled
+	case err != nil:
+		info.State, info.err = JobFailed, err
+	default:
+		info.State = JobDone
+	}
+	if info.err != nil {
+		info.Error = info.err.Error()
+	}
+	info.cancel()
+	close(info.done)
+}
+
+// cancel stops a job: queued jobs never start, running ones are told to stop
+func (m *jobManager) cancel(id string) (backgroundJob, error) {
+	m.mu.Lock()
+	job, exists := m.jobs[id]
+	if !exists {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("job not found: %s", id)
+	}
+	info := job.info()
+	switch info.State {
+	case JobQueued:
+		for i, q := range m.queue {
+			if q.job == job {
+				m.queue = append(m.queue[:i], m.queue[i+1:]...)
+				break
+			}
+		}
+		info.cancel()
+		m.end(info, context.Canceled)
+	case JobRunning:
+		info.cancel() // execute records the outcome once the job returns
+	default:
+		m.mu.Unlock()
+		return nil, fmt.Errorf("job %s already %s", id, info.State)
+	}
+	m.mu.Unlock()
+
+	m.save()
+	log.Printf("Job %s canceled", id)
+	return job, nil
+}
+
+// wait blocks until a job ends or ctx does, returning what the job returned
+func (m *jobManager) wait(ctx context.Context, job backgroundJob) error {
+	info := job.info()
+	select {
+	case <-info.done:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return info.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// prune drops the oldest finished jobs beyond the retention limit; callers must hold m.mu
+func (m *jobManager) prune() {
+	var finished []*JobInfo
+	for _, job := range m.jobs {
+		if info := job.info(); info.finished() {
+			finished = append(finished, info)
+		}
+	}
+	if len(finished) <= m.retain {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Queued.Before(finished[j].Queued) })
+	for _, info := range finished[:len(finished)-m.retain] {
+		delete(m.jobs, info.ID)
+	}
+}
+
+// save writes every job to disk
+func (m *jobManager) save() {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+
+	m.mu.Lock()
+	saved := struct {
+		Next map[string]int  `json:"next"`
+		Jobs []backgroundJob `json:"jobs"`
+	}{Next: m.next, Jobs: make([]backgroundJob, 0, len(m.jobs))}
+	for _, job := range m.jobs {
+		saved.Jobs = append(saved.Jobs, job)
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	m.mu.Unlock()
+
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(m.path), 0755)
+	}
+	if err == nil {
+		tmpPath := m.path + ".tmp"
+		if err = os.WriteFile(tmpPath, data, 0644); err == nil {
+			err = os.Rename(tmpPath, m.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Error saving jobs: %v", err)
+	}
+}
+
+// status lists jobs, newest first, optionally of one kind or state
+func (m *jobManager) status(kind, state string) JobsStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := JobsStatus{MaxRunning: m.maxRunning, Running: m.running, Queued: len(m.queue), Jobs: make([]JobSummary, 0)}
+	for _, job := range m.jobs {
+		info := job.info()
+		if (kind != "" && info.Kind != kind) || (state != "" && info.State != state) {
+			continue
+		}
+		done, total := job.progress()
+		status.Jobs = append(status.Jobs, JobSummary{
+			ID:       info.ID,
+			Kind:     info.Kind,
+			State:    info.State,
+			Queued:   info.Queued,
+			Started:  info.Started,
+			Finished: info.Finished,
+			Done:     done,
+			Total:    total,
+			Error:    info.Error,
+		})
+	}
+	sort.Slice(status.Jobs, func(i, j int) bool {
+		if !status.Jobs[i].Queued.Equal(status.Jobs[j].Queued) {
+			return status.Jobs[i].Queued.After(status.Jobs[j].Queued)
+		}
+		return status.Jobs[i].ID > status.Jobs[j].ID
+	})
+	return status
+}
+
+// writeJob writes a job as JSON; the status is read under m.mu
+func (m *jobManager) writeJob(w http.ResponseWriter, status int, job backgroundJob) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(job)
+}
+
+// serveJob answers GET (status) and DELETE (cancel) for one job, if it is of one of kinds
+func (m *jobManager) serveJob(w http.ResponseWriter, r *http.Request, id string, kinds ...string) {
+	m.mu.Lock()
+	job, exists := m.jobs[id]
+	if exists && len(kinds) > 0 && !slices.Contains(kinds, job.info().Kind) {
+		exists = false
+	}
+	m.mu.Unlock()
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		m.writeJob(w, http.StatusOK, job)
+	case "DELETE":
+		if _, err := m.cancel(id); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		m.writeJob(w, http.StatusAccepted, job)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runJob runs fn as a job and waits for it, so synchronous admin calls are
+// listed, limited and cancelable like other jobs. If ctx ends first the job
+// keeps running and ctx's error is returned.
+func (fb *FileBox) runJob(ctx context.Context, kind string, fn func(ctx context.Context) (any, error)) (any, error) {
+	job := &TaskJob{}
+	fb.jobs.submit(kind, job, func(ctx context.Context) error {
+		result, err := fn(ctx)
+		fb.jobs.mu.Lock()
+		job.Result = result
+		fb.jobs.mu.Unlock()
+		return err
+	})
+	if err := fb.jobs.wait(ctx, job); err != nil {
+		return nil, err
+	}
+	fb.jobs.mu.Lock()
+	defer fb.jobs.mu.Unlock()
+	return job.Result, nil
+}
+
+// handleAdminJobs serves GET /admin/jobs (?kind= and ?state= filter it) and
+// GET and DELETE /admin/jobs/{id}
+func (fb *FileBox) handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/jobs"), "/")
+	if id != "" {
+		fb.jobs.serveJob(w, r, id)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.jobs.status(query.Get("kind"), query.Get("state")))
+}
@@ -0,0 +1,253 @@
+// Cluster-wide blob lookup for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"filebox/pkg/containerformat"
+)
+
+// locateTimeout bounds how long GET /locate waits for peers
+const locateTimeout = 5 * time.Second
+
+// NodeLocation - What one node knows about a blob's container
+type NodeLocation struct {
+	Node      string `json:"node"` // Peer address as configured in REPLICAS, or "self"
+	HostID    string `json:"host_id"`
+	MachineID uint32 `json:"machine_id"`
+	Role      string `json:"role"`  // "owner" or "replica"
+	State     string `json:"state"` // "local", "evicted", "federated" or "quarantined"
+	Size      int64  `json:"size"`  // Container bytes held
+
+	Indexed  bool   `json:"indexed"`             // The blob's entry is known here
+	Readable bool   `json:"readable"`            // GET /blob/{id} on this node returns it
+	Status   string `json:"status,omitempty"`    // "deleted", "expired" or "uncommitted" when not readable
+	RemoteID string `json:"remote_id,omitempty"` // ID in the federated cluster
+	Offset   int64  `json:"offset,omitempty"`    // Of the blob's record in the container
+	Length   int64  `json:"length,omitempty"`    // Of the record, header included
+
+	Uploaded     bool     `json:"uploaded"`
+	S3Key        string   `json:"s3_key,omitempty"`
+	StorageClass string   `json:"storage_class,omitempty"`
+	DRReplicated bool     `json:"dr_replicated,omitempty"`
+	Replicas     []string `json:"replicas,omitempty"` // Where the owner places the container
+}
+
+// S3Location - The S3 object holding a blob's record
+type S3Location struct {
+	Bucket       string `json:"bucket"`
+	Key          string `json:"key"`
+	StorageClass string `json:"storage_class,omitempty"`
+	Offset       int64  `json:"offset,omitempty"` // Of the record, when the entry is known
+	Length       int64  `json:"length,omitempty"`
+	DRBucket     string `json:"dr_bucket,omitempty"` // Also copied here
+}
+
+// BlobLocation - Response of GET /locate/{blobID}
+type BlobLocation struct {
+	BlobID       string         `json:"blob_id"`
+	FileID       string         `json:"file_id"`
+	OwnerMachine uint32         `json:"owner_machine_id"`
+	Owner        string         `json:"owner,omitempty"` // Node owning the machine ID, if it answered
+	Nodes        []NodeLocation `json:"nodes"`
+	Placement    []string       `json:"placement,omitempty"` // Replicas the owner sends the container to
+	S3           *S3Location    `json:"s3,omitempty"`
+	Errors       []string       `json:"errors,omitempty"` // Peers that could not be asked
+}
+
+// locateLocal describes the local copy of a blob's container, or returns
+// nil if this node does not hold it
+func (fb *FileBox) locateLocal(fileID string, index int) *NodeLocation {
+	fb.fileLock.RLock()
+	containerFile, exists := fb.files.get(fileID)
+	if !exists {
+		fb.fileLock.RUnlock()
+		return nil
+	}
+	size, blobs := fb.containerContents(containerFile)
+	location := &NodeLocation{
+		Node:         "self",
+		HostID:       fb.hostID,
+		MachineID:    fb.machineID,
+		Role:         "owner",
+		State:        "local",
+		Size:         size,
+		Uploaded:     containerFile.Uploaded,
+		StorageClass: containerFile.StorageClass,
+		DRReplicated: !containerFile.DRReplicatedAt.IsZero(),
+	}
+	if containerFile.Uploaded {
+		location.S3Key = fb.containerS3Key(containerFile)
+	}
+	foreign := fb.isForeign(containerFile)
+	if foreign {
+		location.Role = "replica"
+	}
+	switch {
+	case containerFile.Quarantined:
+		location.State = "quarantined"
+	case containerFile.Federated:
+		location.State = "federated"
+	case containerFile.Evicted:
+		location.State = "evicted"
+	}
+
+	if index < len(blobs) {
+		blob := blobs[index]
+		location.Indexed = !blob.Uncommitted
+		location.RemoteID = blob.RemoteID
+		if location.Indexed && len(blob.Segments) == 0 {
+			location.Offset = blob.Offset - containerformat.HeaderSize
+			location.Length = blob.Length + containerformat.HeaderSize
+		}
+		switch {
+		case blob.Uncommitted:
+			location.Status = "uncommitted"
+		case blob.DeletedAt != nil:
+			location.Status = "deleted"
+		case expired(containerFile, blob, timeNow()):
+			location.Status = "expired"
+		default:
+			location.Readable = !containerFile.Quarantined
+		}
+	}
+	fb.fileLock.RUnlock()
+
+	if !foreign {
+		location.Replicas = fb.replicasFor(containerFile)
+	}
+	return location
+}
+
+// locatePeers asks every replica that can answer what it holds of a
+// container, returning the answers and the peers that could not be asked
+func (fb *FileBox) locatePeers(ctx context.Context, blobID string) ([]NodeLocation, []string) {
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		locations []NodeLocation
+		errs      []string
+	)
+	for _, peer := range fb.replicas {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			var location *NodeLocation
+			err := fmt.Errorf("does not support %s", CapLocate)
+			if fb.peerProtocol(ctx, peer).supports(CapLocate) {
+				err = fb.getPeerJSON(ctx, peer, "/cluster/locate/"+url.PathEscape(blobID), &location)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				errs = append(errs, fmt.Sprintf("%s: %v", peer, err))
+			case location != nil:
+				location.Node = peer
+				locations = append(locations, *location)
+			}
+		}(peer)
+	}
+	wg.Wait()
+	sort.Strings(errs)
+	return locations, errs
+}
+
+// Locate answers which nodes and S3 objects hold a blob, from local state,
+// the owner's placement and, if askPeers, every replica
+func (fb *FileBox) Locate(ctx context.Context, blobID string, askPeers bool) (*BlobLocation, error) {
+	fileID, index, err := parseBlobID(blobID)
+	if err != nil {
+		return nil, err
+	}
+	fid, err := ParseFID(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BlobLocation{BlobID: blobID, FileID: fileID, OwnerMachine: fid.MachineID, Nodes: make([]NodeLocation, 0)}
+	if local := fb.locateLocal(fileID, index); local != nil {
+		result.Nodes = append(result.Nodes, *local)
+	}
+	if askPeers {
+		ctx, cancel := context.WithTimeout(ctx, locateTimeout)
+		defer cancel()
+		peers, errs := fb.locatePeers(ctx, blobID)
+		result.Nodes = append(result.Nodes, peers...)
+		result.Errors = errs
+	}
+
+	var offset, length int64 // Of the record, from whichever node indexed the blob
+	dr := false
+	for _, node := range result.Nodes {
+		if node.Role == "owner" {
+			result.Owner, result.Placement = node.Node, node.Replicas
+		}
+		if node.Uploaded && result.S3 == nil {
+			result.S3 = &S3Location{Bucket: fb.bucket, Key: node.S3Key, StorageClass: node.StorageClass}
+		}
+		if node.Length > 0 {
+			offset, length = node.Offset, node.Length
+		}
+		dr = dr || node.DRReplicated
+	}
+	if result.S3 != nil {
+		result.S3.Offset, result.S3.Length = offset, length
+		if dr && fb.dr.enabled() {
+			result.S3.DRBucket = fb.dr.config.Bucket
+		}
+	}
+	return result, nil
+}
+
+// handleLocate serves GET /locate/{blobID}; ?peers=false answers from this node alone
+func (fb *FileBox) handleLocate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	blobID := r.URL.Path[len("/locate/"):]
+	result, err := fb.Locate(r.Context(), blobID, r.URL.Query().Get("peers") != "false")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	if len(result.Nodes) == 0 {
+		status = http.StatusNotFound
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleClusterLocate serves GET /cluster/locate/{blobID}: this node's copy
+// of the blob's container, or null if it holds none
+func (fb *FileBox) handleClusterLocate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileID, index, err := parseBlobID(r.URL.Path[len("/cluster/locate/"):])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.locateLocal(fileID, index))
+}
@@ -7,13 +7,45 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "inspect":
+			os.Exit(runInspect(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "restore-snapshot":
+			os.Exit(runRestoreSnapshot(os.Args[2:]))
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		case "demo":
+			os.Exit(runDemo(os.Args[2:]))
+		case "simulate":
+			os.Exit(runSimulate(os.Args[2:]))
+		case "gateway":
+			os.Exit(runGateway(os.Args[2:]))
+		case "namespace":
+			os.Exit(runNamespace(os.Args[2:]))
+		}
+	}
+
+	// Flags
+	fsck := flag.Bool("fsck", false, "Check manifests, container sizes and checksums before serving traffic")
+	fsckTruncate := flag.Bool("fsck-truncate", false, "With --fsck, truncate torn writes at the end of container files")
+	adminAddr := flag.String("admin-addr", os.Getenv("ADMIN_ADDR"), "Serve /admin/ and /debug/ on this host:port or unix:/path socket instead of the data port")
+	socket := flag.String("socket", os.Getenv("LISTEN_SOCKET"), "Also serve the API on this Unix socket path")
+	debug := flag.Bool("debug", getEnvBool("DEBUG_ENDPOINTS", false), "Serve pprof, expvar and lock-contention dumps under /debug/")
+	flag.Parse()
+
 	// Configuration
 	storageDir := os.Getenv("STORAGE_DIR")
 	if storageDir == "" {
@@ -29,6 +61,9 @@ func main() {
 	if port == "" {
 		port = "8080"
 	}
+	if port == "off" && *socket == "" {
+		log.Fatal("PORT=off requires LISTEN_SOCKET (or --socket)")
+	}
 
 	// Parse replicas
 	replicasStr := os.Getenv("REPLICAS")
@@ -40,17 +75,106 @@ func main() {
 		}
 	}
 
+	cfg := Config{
+		StorageDir: storageDir,
+		Bucket:     bucket,
+		Replicas:   replicas,
+	}
+	if *fsck {
+		cfg.Fsck = &FsckOptions{TruncateTornWrites: *fsckTruncate}
+	}
+
 	// Create FileBox instance
-	filebox := NewFileBox(storageDir, bucket, replicas)
+	filebox := NewFileBox(cfg)
+
+	// Register HTTP handlers. Use private muxes: net/http/pprof and expvar
+	// register themselves on the default one when imported.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", filebox.handleUpload)
+	mux.HandleFunc("/upload/", filebox.handleUploadSessions)
+	mux.HandleFunc("/blob/", filebox.handleDownload)
+	mux.HandleFunc("/blobs/delete", filebox.handleBulkDelete)
+	mux.HandleFunc("/jobs/", filebox.handleJobs)
+	mux.HandleFunc("/key/", filebox.handleKeyDownload)
+	mux.HandleFunc("/files", filebox.handleListFiles)
+	mux.HandleFunc("/search", filebox.handleSearch)
+	mux.HandleFunc("/compose", filebox.handleCompose)
+	mux.HandleFunc("/locate/", filebox.handleLocate)
+	mux.HandleFunc("/topology", filebox.handleTopology)
+	filebox.registerClusterHandlers(mux)
+
+	// Management endpoints share the data port unless an admin address is set
+	adminMux := mux
+	if *adminAddr != "" {
+		adminMux = http.NewServeMux()
+	}
+	adminMux.HandleFunc("/admin/restores", filebox.audited(filebox.handleRestores))
+	adminMux.HandleFunc("/admin/containers/", filebox.audited(filebox.handleAdminContainers))
+	adminMux.HandleFunc("/admin/blobs/", filebox.audited(filebox.handleAdminBlobs))
+	adminMux.HandleFunc("/admin/import", filebox.audited(filebox.handleImport))
+	adminMux.HandleFunc("/admin/namespaces/", filebox.audited(filebox.handleNamespaces))
+	adminMux.HandleFunc("/admin/snapshot", filebox.audited(filebox.handleSnapshot))
+	adminMux.HandleFunc("/admin/checkpoint", filebox.audited(filebox.handleCheckpoint))
+	adminMux.HandleFunc("/admin/export", filebox.audited(filebox.handleExport))
+	adminMux.HandleFunc("/admin/export/", filebox.audited(filebox.handleExport))
+	adminMux.HandleFunc("/admin/upload-tokens", filebox.audited(filebox.handleUploadTokens))
+	adminMux.HandleFunc("/admin/gc", filebox.audited(filebox.handleGC))
+	adminMux.HandleFunc("/admin/s3-keys", filebox.audited(filebox.handleS3Keys))
+	adminMux.HandleFunc("/admin/expiry", filebox.audited(filebox.handleExpiry))
+	adminMux.HandleFunc("/admin/uploads", filebox.handleInflightUploads)
+	adminMux.HandleFunc("/admin/metadata-ops", filebox.handleMetadataOps)
+	adminMux.HandleFunc("/admin/replication-gaps", filebox.handleReplicationGaps)
+	adminMux.HandleFunc("/admin/conflicts", filebox.handleConflicts)
+	adminMux.HandleFunc("/admin/usage", filebox.handleUsage)
+	adminMux.HandleFunc("/admin/stats", filebox.handleStats)
+	adminMux.HandleFunc("/admin/advice", filebox.handleAdvice)
+	adminMux.HandleFunc("/admin/admission", filebox.handleAdmission)
+	adminMux.HandleFunc("/admin/bandwidth", filebox.handleBandwidth)
+	adminMux.HandleFunc("/admin/slo", filebox.handleSLO)
+	adminMux.HandleFunc("/admin/federation", filebox.handleFederation)
+	adminMux.HandleFunc("/admin/federation/push", filebox.audited(filebox.handleFederation))
+	adminMux.HandleFunc("/admin/jobs", filebox.handleAdminJobs)
+	adminMux.HandleFunc("/admin/jobs/", filebox.audited(filebox.handleAdminJobs))
+	adminMux.HandleFunc("/admin/warm", filebox.audited(filebox.handleWarm))
+	adminMux.HandleFunc("/admin/warm/", filebox.audited(filebox.handleWarm))
+	adminMux.HandleFunc("/admin/edge", filebox.audited(filebox.handleEdge))
+	adminMux.HandleFunc("/admin/volumes", filebox.audited(filebox.handleVolumes))
+	adminMux.HandleFunc("/admin/tenants", filebox.audited(filebox.handleTenantPolicies))
+	adminMux.HandleFunc("/admin/tenants/", filebox.audited(filebox.handleTenantPolicies))
+	adminMux.HandleFunc("/admin/dashboard.json", filebox.handleDashboard)
+	adminMux.HandleFunc("/metrics", filebox.handleMetrics)
+	adminMux.HandleFunc("/admin/dr", filebox.audited(filebox.handleDR))
+	adminMux.HandleFunc("/admin/mode", filebox.audited(filebox.handleMode))
+	adminMux.HandleFunc("/admin/bootstrap", filebox.audited(filebox.handleBootstrap))
+	adminMux.HandleFunc("/admin/recovery", filebox.handleRecovery)
+	adminMux.HandleFunc("/admin/clock", filebox.handleClock)
+	adminMux.HandleFunc("/admin/peers", filebox.handlePeers)
+	adminMux.HandleFunc("/admin/raft", filebox.audited(filebox.handleRaft))
+	adminMux.HandleFunc("/admin/raft/", filebox.audited(filebox.handleRaft))
+	adminMux.HandleFunc("/admin/access", filebox.handleAccess)
+	adminMux.HandleFunc("/admin/access/", filebox.handleAccess)
+	if *debug {
+		filebox.registerDebugHandlers(adminMux)
+		log.Printf("Debug endpoints enabled under /debug/")
+	}
 
-	// Register HTTP handlers
-	http.HandleFunc("/upload", filebox.handleUpload)
-	http.HandleFunc("/blob/", filebox.handleDownload)
-	http.HandleFunc("/files", filebox.handleListFiles)
-	http.HandleFunc("/replicate", filebox.handleReplicate)
+	serverConfig := loadServerConfig()
+
+	if *adminAddr != "" {
+		adminListener, err := listenAdmin(*adminAddr)
+		if err != nil {
+			log.Fatalf("Error listening on admin address %s: %v", *adminAddr, err)
+		}
+		log.Printf("Admin endpoints on %s", *adminAddr)
+		go func() {
+			log.Fatal(serve(serverConfig, newHTTPServer(serverConfig, filebox.trackLatency(adminMux)), adminListener))
+		}()
+	}
 
 	// Start server
-	log.Printf("FileBox (Educational Toy) starting on port %s", port)
+	if port != "off" {
+		log.Printf("FileBox (Educational Toy) starting on port %s", port)
+	}
 	log.Printf("Storage directory: %s", storageDir)
 	log.Printf("S3 bucket: %s", bucket)
 	log.Printf("Host ID: %s", filebox.hostID)
@@ -60,5 +184,37 @@ func main() {
 		log.Printf("No replicas configured")
 	}
 
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	var listeners []net.Listener
+	if *socket != "" {
+		listener, err := listenUnix(*socket, loadSocketMode())
+		if err != nil {
+			log.Fatalf("Error listening on socket %s: %v", *socket, err)
+		}
+		log.Printf("Serving API on Unix socket %s", *socket)
+		listeners = append(listeners, listener)
+	}
+	if port != "off" {
+		listener, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			log.Fatalf("Error listening on port %s: %v", port, err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	// The socket is local-only, so it is served without TLS
+	server := newHTTPServer(serverConfig, filebox.trackLatency(filebox.enforceMode(filebox.edgeRouter(mux))))
+	errs := make(chan error, len(listeners)+1)
+	if addr := filebox.replication.config.StreamAddr; addr != "" {
+		go func() { errs <- filebox.serveReplicationStreams(addr) }()
+	}
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if listener.Addr().Network() == "unix" {
+				errs <- server.Serve(listener)
+				return
+			}
+			errs <- serve(serverConfig, server, listener)
+		}(listener)
+	}
+	log.Fatal(<-errs)
 }
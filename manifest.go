@@ -0,0 +1,258 @@
+// Container metadata persistence for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MetadataStore - Persists container metadata and blob indexes across restarts
+type MetadataStore interface {
+	// SaveContainer persists a snapshot of a container; the snapshot is not shared
+	SaveContainer(containerFile *ContainerFile) error
+	// LoadContainer returns a container's metadata, or nil if none is stored
+	LoadContainer(fileID string) (*ContainerFile, error)
+	// ListContainers returns the IDs of every container with stored metadata
+	ListContainers() ([]string, error)
+	// UpdateBlobs persists changes to existing blob entries of the snapshot
+	UpdateBlobs(containerFile *ContainerFile, indexes ...int) error
+	// RecordReplication notes how many bytes of a container a replica has acknowledged
+	RecordReplication(fileID, replica string, size int64) error
+	// DeleteContainer removes a container and its blob index; deleting a missing one is not an error
+	DeleteContainer(fileID string) error
+	// Durable reports whether saves are on disk when they return
+	Durable() bool
+	// Compact truncates logs whose contents a metadata checkpoint now holds,
+	// returning the bytes freed. Callers must hold fb.manifestLock.
+	Compact() (int64, error)
+	Close() error
+}
+
+// newMetadataStore opens the backend selected by METADATA_BACKEND
+func newMetadataStore(storageDir string) (MetadataStore, error) {
+	switch backend := getEnvOrDefault("METADATA_BACKEND", "manifest"); backend {
+	case "manifest":
+		return newManifestStore(storageDir)
+	case "sqlite":
+		return newSQLiteStore(getEnvOrDefault("METADATA_DB", filepath.Join(storageDir, "db", "metadata.db")))
+	case "pebble":
+		return newPebbleStore(getEnvOrDefault("METADATA_DB", filepath.Join(storageDir, "db", "pebble")))
+	default:
+		return nil, fmt.Errorf("unknown METADATA_BACKEND %q", backend)
+	}
+}
+
+// saveManifest persists a container's metadata and blob index
+func (fb *FileBox) saveManifest(containerFile *ContainerFile) {
+	if err := fb.persistManifest(containerFile); err != nil {
+		log.Printf("Error saving manifest for %s: %v", containerFile.FID.String(), err)
+	}
+}
+
+// persistManifest saves a container's metadata and returns any error
+func (fb *FileBox) persistManifest(containerFile *ContainerFile) error {
+	fb.manifestLock.Lock()
+	defer fb.manifestLock.Unlock()
+
+	// Snapshot under the lock so the store never sees a half-updated container
+	fb.fileLock.RLock()
+	snapshot := fb.snapshotContainer(containerFile)
+	fb.fileLock.RUnlock()
+
+	return fb.meta.SaveContainer(snapshot)
+}
+
+// cloneContainer copies a container's metadata so it can be used outside the lock.
+// Callers must hold fb.fileLock exclusively, or use snapshotContainer.
+func cloneContainer(containerFile *ContainerFile) *ContainerFile {
+	snapshot := *containerFile
+	snapshot.Blobs = append([]BlobInfo(nil), containerFile.Blobs...)
+	if containerFile.Replicated != nil {
+		snapshot.Replicated = make(map[string]int64, len(containerFile.Replicated))
+		for host, size := range containerFile.Replicated {
+			snapshot.Replicated[host] = size
+		}
+	}
+	if containerFile.OpSequence != nil {
+		snapshot.OpSequence = containerFile.OpSequence.clone()
+	}
+	return &snapshot
+}
+
+// snapshotContainer clones a container under its own lock, so uploads
+// appending to it are not caught half way. Callers must hold fb.fileLock.
+func (fb *FileBox) snapshotContainer(containerFile *ContainerFile) *ContainerFile {
+	mu := fb.files.lock(containerFile)
+	mu.RLock()
+	defer mu.RUnlock()
+	return cloneContainer(containerFile)
+}
+
+// loadManifest reads a container's metadata, returning nil if none exists
+func (fb *FileBox) loadManifest(fileID string) (*ContainerFile, error) {
+	return fb.meta.LoadContainer(fileID)
+}
+
+// Manifests live in a subdirectory so recovery never mistakes them for containers
+const manifestDirName = "manifests"
+
+// manifestStore - Default backend: one JSON manifest file per container
+type manifestStore struct {
+	dir  string
+	sync bool // Fsync each manifest and the directory entry before returning
+}
+
+func newManifestStore(storageDir string) (*manifestStore, error) {
+	dir := filepath.Join(storageDir, manifestDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &manifestStore{dir: dir, sync: loadDurabilityConfig().FsyncManifests}, nil
+}
+
+// manifestPath returns where the manifest for a container is stored
+func (m *manifestStore) manifestPath(fileID string) string {
+	return filepath.Join(m.dir, fileID+".json")
+}
+
+func (m *manifestStore) SaveContainer(containerFile *ContainerFile) error {
+	data, err := json.Marshal(containerFile)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename so a crash never leaves a partial manifest
+	path := m.manifestPath(containerFile.FID.String())
+	tmpPath := path + ".tmp"
+	if !m.sync {
+		if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmpPath, path)
+	}
+
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// The rename is only durable once the directory is flushed
+	dir, err := os.Open(m.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (m *manifestStore) Durable() bool {
+	return m.sync
+}
+
+func (m *manifestStore) LoadContainer(fileID string) (*ContainerFile, error) {
+	data, err := os.ReadFile(m.manifestPath(fileID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var containerFile ContainerFile
+	if err := json.Unmarshal(data, &containerFile); err != nil {
+		return nil, err
+	}
+	return &containerFile, nil
+}
+
+func (m *manifestStore) ListContainers() ([]string, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileIDs []string
+	for _, entry := range entries {
+		if fileID, ok := strings.CutSuffix(entry.Name(), ".json"); ok {
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	return fileIDs, nil
+}
+
+// UpdateBlobs rewrites the whole manifest
+func (m *manifestStore) UpdateBlobs(containerFile *ContainerFile, indexes ...int) error {
+	return m.SaveContainer(containerFile)
+}
+
+// RecordReplication is a no-op; manifests do not track replica progress
+func (m *manifestStore) RecordReplication(fileID, replica string, size int64) error {
+	return nil
+}
+
+func (m *manifestStore) DeleteContainer(fileID string) error {
+	if err := os.Remove(m.manifestPath(fileID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Compact removes temporary files left behind by saves a crash interrupted;
+// each manifest is rewritten whole, so there is no log to truncate
+func (m *manifestStore) Compact() (int64, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var freed int64
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(filepath.Join(m.dir, entry.Name())); err != nil {
+			return freed, err
+		}
+		freed += info.Size()
+	}
+	return freed, nil
+}
+
+// SavedAt returns when a container's manifest was last written
+func (m *manifestStore) SavedAt(fileID string) (time.Time, bool) {
+	info, err := os.Stat(m.manifestPath(fileID))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
+
+func (m *manifestStore) Close() error {
+	return nil
+}
@@ -0,0 +1,556 @@
+// Replication of blob metadata changes for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Records carry only container bytes. Every change to a blob's index entry
+// on its owner (a commit, a delete or undelete, a legal hold, new tags or
+// TTL, a scan verdict or a new variant) is also appended to an operation
+// log. Each operation carries the whole entry as it is after the change, so
+// applying it twice does no harm and a replica that applies the log in
+// order ends up with the owner's index. The log is kept on disk until every
+// replica has applied it.
+
+const (
+	metaOpLogFile     = "node/metadata-ops.jsonl"
+	metaOpAckedFile   = "node/metadata-ops-acked.json"
+	metaOpBatch       = 256             // Most operations sent in one request
+	metaOpRetry       = 5 * time.Second // How often a replica behind the log is retried
+	metaOpRewriteAt   = 4096            // Applied operations left in the log file before it is rewritten
+	metaOpSendTimeout = 30 * time.Second
+)
+
+// Kinds of blob metadata change
+const (
+	MetaOpCommit   = "commit" // A new blob, copy or composed blob became readable
+	MetaOpDelete   = "delete"
+	MetaOpUndelete = "undelete"
+	MetaOpHold     = "hold"
+	MetaOpUpdate   = "update" // Tags or TTL changed with PATCH /blob/{id}
+	MetaOpScan     = "scan"
+	MetaOpVariant  = "variant"
+	MetaOpSeal     = "seal" // The container was uploaded; carries its size instead of an entry
+
+	MetaOpContainerHold = "container_hold" // A container's legal hold changed; carries it instead of an entry
+)
+
+// metadataOp - One change to a blob's index entry
+type metadataOp struct {
+	Seq      uint64    `json:"seq"`
+	Kind     string    `json:"kind"`
+	FileID   string    `json:"file_id"`
+	Index    int       `json:"index"`
+	Blob     BlobInfo  `json:"blob"`     // The entry after the change
+	Replicas []string  `json:"replicas"` // Replicas of the container when it changed
+	At       time.Time `json:"at"`
+
+	ContainerSeq uint64 `json:"container_seq,omitempty"` // Operation number within the container (see opsequence.go)
+	SeqBase      uint64 `json:"seq_base,omitempty"`      // The container's first operation number
+	Size         int64  `json:"size,omitempty"`          // Container size, for seals
+	LegalHold    bool   `json:"legal_hold,omitempty"`    // The container's hold, for container holds
+}
+
+// MetadataOpsRequest - Body of POST /cluster/metadata-ops
+type MetadataOpsRequest struct {
+	HostID string       `json:"host_id"`
+	Ops    []metadataOp `json:"ops"`
+}
+
+// MetadataOpsResponse - Response of POST /cluster/metadata-ops
+type MetadataOpsResponse struct {
+	Applied  int `json:"applied"`
+	Deferred int `json:"deferred,omitempty"` // Held back until the operations before them arrive
+	Skipped  int `json:"skipped"`            // Already applied, or for containers the replica does not hold or owns itself
+}
+
+// MetadataOpsReplica - How far one replica is behind the operation log
+type MetadataOpsReplica struct {
+	Replica   string     `json:"replica"`
+	Applied   uint64     `json:"applied"` // Sequence number the replica has applied up to
+	Pending   int        `json:"pending"` // Operations for it not yet applied
+	LastSent  *time.Time `json:"last_sent,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// MetadataOpsStatus - Response of GET /admin/metadata-ops
+type MetadataOpsStatus struct {
+	Next     uint64               `json:"next"`   // Sequence number of the next operation
+	Logged   int                  `json:"logged"` // Kept until every replica has applied them
+	Replicas []MetadataOpsReplica `json:"replicas"`
+}
+
+// metaOpLog - Metadata operations not yet applied by every replica
+type metaOpLog struct {
+	path      string
+	ackedPath string
+	replicas  []string
+	wake      map[string]chan struct{} // Nudges a replica's sender after an append
+	epoch     uint64                   // This startup's operation epoch (see opsequence.go)
+
+	mu       sync.Mutex
+	file     *os.File // Nil when the log could not be opened; operations are then kept in memory only
+	ops      []metadataOp
+	next     uint64
+	written  int               // Lines in the log file, including applied ones
+	acked    map[string]uint64 // Replica -> sequence number applied up to
+	lastSent map[string]time.Time
+	lastErr  map[string]string
+}
+
+// loadMetaOpLog reopens the operation log, or returns nil without replicas
+func loadMetaOpLog(storageDir string, replicas []string) *metaOpLog {
+	if len(replicas) == 0 {
+		return nil
+	}
+	l := &metaOpLog{
+		path:      filepath.Join(storageDir, metaOpLogFile),
+		ackedPath: filepath.Join(storageDir, metaOpAckedFile),
+		replicas:  replicas,
+		wake:      make(map[string]chan struct{}, len(replicas)),
+		epoch:     loadOpEpoch(storageDir),
+		next:      1,
+		acked:     make(map[string]uint64, len(replicas)),
+		lastSent:  make(map[string]time.Time),
+		lastErr:   make(map[string]string),
+	}
+	for _, replica := range replicas {
+		l.wake[replica] = make(chan struct{}, 1)
+	}
+
+	if data, err := os.ReadFile(l.ackedPath); err == nil {
+		if err := json.Unmarshal(data, &l.acked); err != nil {
+			log.Printf("Error parsing metadata operation progress: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Error reading metadata operation progress: %v", err)
+	}
+
+	if file, err := os.Open(l.path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 16<<20)
+		for scanner.Scan() {
+			l.written++
+			var op metadataOp
+			if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+				continue // A line torn by a crash
+			}
+			l.ops = append(l.ops, op)
+			l.next = max(l.next, op.Seq+1)
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		log.Printf("Error reading metadata operation log: %v", err)
+	}
+	for _, seq := range l.acked {
+		l.next = max(l.next, seq+1) // Never reuse a number a replica has applied
+	}
+	l.trim()
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		log.Printf("Error creating metadata operation log: %v", err)
+		return l
+	}
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Error opening metadata operation log: %v", err)
+		return l
+	}
+	l.file = file
+	if len(l.ops) > 0 {
+		log.Printf("Loaded %d metadata operations not yet applied by every replica", len(l.ops))
+	}
+	return l
+}
+
+// append numbers operations, writes them to the log and wakes their replicas' senders
+func (l *metaOpLog) append(ops ...metadataOp) {
+	l.mu.Lock()
+	var buf bytes.Buffer
+	for i := range ops {
+		ops[i].Seq = l.next
+		l.next++
+		line, _ := json.Marshal(ops[i])
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if l.file != nil {
+		if _, err := l.file.Write(buf.Bytes()); err != nil {
+			log.Printf("Error writing metadata operation log: %v", err)
+		}
+		l.written += len(ops)
+	}
+	l.ops = append(l.ops, ops...)
+	l.mu.Unlock()
+
+	for _, op := range ops {
+		for _, replica := range op.Replicas {
+			select {
+			case l.wake[replica] <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// pending returns the next operations a replica has not applied, and the
+// sequence number the replica will have applied up to once they are
+func (l *metaOpLog) pending(replica string) ([]metadataOp, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	upTo := l.acked[replica]
+	var batch []metadataOp
+	for _, op := range l.ops {
+		if op.Seq <= upTo {
+			continue
+		}
+		if len(batch) == metaOpBatch {
+			break
+		}
+		upTo = op.Seq
+		if slices.Contains(op.Replicas, replica) {
+			batch = append(batch, op)
+		}
+	}
+	return batch, upTo
+}
+
+// ack records that a replica applied the log up to seq
+func (l *metaOpLog) ack(replica string, seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.acked[replica] = seq
+	delete(l.lastErr, replica)
+	if data, err := json.Marshal(l.acked); err == nil {
+		tmp := l.ackedPath + ".tmp"
+		if err := os.WriteFile(tmp, data, 0644); err == nil {
+			os.Rename(tmp, l.ackedPath)
+		}
+	}
+	l.trim()
+	if l.file != nil && l.written-len(l.ops) >= metaOpRewriteAt {
+		l.rewrite()
+	}
+}
+
+// fail records why a replica could not be sent its operations
+func (l *metaOpLog) fail(replica string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastErr[replica] = err.Error()
+}
+
+// trim drops the operations every replica has applied. Callers must hold l.mu.
+func (l *metaOpLog) trim() {
+	applied := l.next
+	for _, replica := range l.replicas {
+		applied = min(applied, l.acked[replica])
+	}
+	drop := 0
+	for drop < len(l.ops) && l.ops[drop].Seq <= applied {
+		drop++
+	}
+	l.ops = slices.Delete(l.ops, 0, drop)
+}
+
+// rewrite replaces the log file with the operations still pending. Callers must hold l.mu.
+func (l *metaOpLog) rewrite() {
+	tmp := l.path + ".tmp"
+	var buf bytes.Buffer
+	for _, op := range l.ops {
+		line, _ := json.Marshal(op)
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		log.Printf("Error rewriting metadata operation log: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		log.Printf("Error rewriting metadata operation log: %v", err)
+		return
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Error reopening metadata operation log: %v", err)
+		return
+	}
+	l.file.Close()
+	l.file, l.written = file, len(l.ops)
+}
+
+// status reports the log and each replica's progress through it
+func (l *metaOpLog) status() MetadataOpsStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := MetadataOpsStatus{Next: l.next, Logged: len(l.ops), Replicas: make([]MetadataOpsReplica, 0, len(l.replicas))}
+	for _, replica := range l.replicas {
+		progress := MetadataOpsReplica{Replica: replica, Applied: l.acked[replica], LastError: l.lastErr[replica]}
+		if sent, ok := l.lastSent[replica]; ok {
+			progress.LastSent = &sent
+		}
+		for _, op := range l.ops {
+			if op.Seq > progress.Applied && slices.Contains(op.Replicas, replica) {
+				progress.Pending++
+			}
+		}
+		status.Replicas = append(status.Replicas, progress)
+	}
+	return status
+}
+
+// logBlobChange appends the current state of a blob's index entry to the
+// operation log for the container's replicas
+func (fb *FileBox) logBlobChange(kind string, containerFile *ContainerFile, index int) {
+	if fb.metaOps == nil || fb.isForeign(containerFile) {
+		return
+	}
+	replicas := fb.replicasFor(containerFile)
+	if len(replicas) == 0 {
+		return
+	}
+
+	// The entry is read and numbered together, so a later number never carries an older entry
+	fb.fileLock.RLock()
+	mu := fb.files.lock(containerFile)
+	mu.Lock()
+	if index < 0 || index >= len(containerFile.Blobs) || containerFile.Blobs[index].Uncommitted {
+		mu.Unlock()
+		fb.fileLock.RUnlock()
+		return
+	}
+	op := metadataOp{
+		Kind:     kind,
+		FileID:   containerFile.FID.String(),
+		Index:    index,
+		Blob:     containerFile.Blobs[index],
+		Replicas: replicas,
+		At:       timeNow().UTC(),
+	}
+	op.ContainerSeq, op.SeqBase = fb.issueOpSeq(containerFile)
+	mu.Unlock()
+	fb.fileLock.RUnlock()
+
+	fb.metaOps.append(op)
+}
+
+// startMetaOpSenders starts one sender per replica
+func (fb *FileBox) startMetaOpSenders() {
+	if fb.metaOps == nil {
+		return
+	}
+	for _, replica := range fb.replicas {
+		go fb.runMetaOpSender(replica)
+	}
+}
+
+// runMetaOpSender sends a replica the operations it has not applied, as
+// soon as they are logged and again every metaOpRetry while it is behind
+func (fb *FileBox) runMetaOpSender(replica string) {
+	ticker := time.NewTicker(metaOpRetry)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fb.metaOps.wake[replica]:
+		case <-ticker.C:
+		}
+		fb.sendMetaOps(replica)
+	}
+}
+
+// sendMetaOps sends batches until the replica has applied the whole log or a send fails
+func (fb *FileBox) sendMetaOps(replica string) {
+	for {
+		batch, upTo := fb.metaOps.pending(replica)
+		fb.metaOps.mu.Lock()
+		applied := fb.metaOps.acked[replica]
+		fb.metaOps.mu.Unlock()
+		if upTo <= applied {
+			return
+		}
+		if len(batch) > 0 {
+			if !fb.health.allow(replica) {
+				return // Retried once a probe closes the breaker
+			}
+			if err := fb.postMetaOps(replica, batch); err != nil {
+				fb.metaOps.fail(replica, err)
+				log.Printf("Failed to send metadata operations to %s: %v", replica, err)
+				return
+			}
+		}
+		fb.metaOps.ack(replica, upTo)
+	}
+}
+
+// postMetaOps sends one batch of operations to a replica
+func (fb *FileBox) postMetaOps(replica string, batch []metadataOp) error {
+	ctx, cancel := context.WithTimeout(context.Background(), metaOpSendTimeout)
+	defer cancel()
+
+	protocol := fb.peerProtocol(ctx, replica)
+	if !protocol.supports(CapMetadataOps) {
+		return fmt.Errorf("replica does not apply metadata operations (%s)", CapMetadataOps)
+	}
+	body, err := json.Marshal(MetadataOpsRequest{HostID: fb.hostID, Ops: batch})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://%s/cluster/metadata-ops", replica), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(protocolHeader, strconv.Itoa(protocol.sendVersion()))
+
+	fb.metaOps.mu.Lock()
+	fb.metaOps.lastSent[replica] = timeNow().UTC()
+	fb.metaOps.mu.Unlock()
+
+	resp, err := fb.replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// applyMetaOps sets the index entries of the local copies of other
+// machines' containers to the owner's, in the order the owner numbered
+// them. A numbered operation can outrun the container's first record, so
+// it registers the container; unnumbered ones for containers this node
+// does not hold are skipped, and the node indexes those containers from
+// record headers if their records arrive.
+func (fb *FileBox) applyMetaOps(ops []metadataOp) MetadataOpsResponse {
+	var response MetadataOpsResponse
+	touched := make(map[*ContainerFile]bool)
+
+	fb.fileLock.Lock()
+	for _, op := range ops {
+		containerFile, exists := fb.files.get(op.FileID)
+		if !exists && op.ContainerSeq > 0 {
+			if fid, err := ParseFID(op.FileID); err == nil && !fb.ownsMachine(fid.MachineID) {
+				containerFile, err = fb.newReplicaContainer(op.FileID)
+				exists = err == nil
+			}
+		}
+		valid := op.Kind == MetaOpSeal || op.Kind == MetaOpContainerHold || (op.Index >= 0 && op.Blob.ID == formatBlobID(op.FileID, op.Index))
+		if !exists || !fb.isForeign(containerFile) || containerFile.Conflict != nil || !valid {
+			response.Skipped++
+			continue
+		}
+		touched[containerFile] = true
+		if op.ContainerSeq == 0 {
+			// From an owner that does not number its operations
+			fb.applyMetaOp(containerFile, op)
+			response.Applied++
+			continue
+		}
+		switch applied, deferred := fb.sequenceMetaOp(containerFile, op); {
+		case applied:
+			response.Applied++
+		case deferred:
+			response.Deferred++
+		default:
+			response.Skipped++
+		}
+	}
+	fb.fileLock.Unlock()
+
+	for containerFile := range touched {
+		fb.saveManifest(containerFile)
+	}
+	return response
+}
+
+// setReplicaEntry replaces one index entry of a replica copy, adding
+// uncommitted placeholders for entries whose operations have not arrived.
+// Callers must hold fb.fileLock exclusively.
+func (fb *FileBox) setReplicaEntry(containerFile *ContainerFile, index int, blob BlobInfo) {
+	fileID := containerFile.FID.String()
+	for len(containerFile.Blobs) <= index {
+		containerFile.Blobs = append(containerFile.Blobs, BlobInfo{ID: formatBlobID(fileID, len(containerFile.Blobs)), Uncommitted: true})
+	}
+
+	old := containerFile.Blobs[index]
+	if !old.Uncommitted {
+		if old.Key != "" && fb.keys[old.Key] == old.ID {
+			delete(fb.keys, old.Key)
+		}
+		fb.tagIndex.remove(old)
+	}
+	blob.Uncommitted = false
+	if isIndexOnly(blob) {
+		fb.indexOnly.note(fileID)
+	}
+	containerFile.Blobs[index] = blob
+	if blob.Key != "" {
+		fb.keys[blob.Key] = blob.ID
+	}
+	fb.tagIndex.add(blob)
+	if old.Uncommitted {
+		fb.addSegmentRefs(blob)
+		fb.noteChunk(containerFile, blob)
+	}
+}
+
+// handleClusterMetadataOps serves POST /cluster/metadata-ops
+func (fb *FileBox) handleClusterMetadataOps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req MetadataOpsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	response := fb.applyMetaOps(req.Ops)
+	if response.Applied > 0 || response.Deferred > 0 {
+		log.Printf("Applied %d metadata operations from %s (%d held back, %d skipped)",
+			response.Applied, req.HostID, response.Deferred, response.Skipped)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleMetadataOps serves GET /admin/metadata-ops
+func (fb *FileBox) handleMetadataOps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if fb.metaOps == nil {
+		http.Error(w, "No replicas configured", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.metaOps.status())
+}
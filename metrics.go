@@ -0,0 +1,470 @@
+// Prometheus metrics and Grafana dashboard export for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Container states used as the "state" label
+const (
+	ContainerStateOpen        = "open"
+	ContainerStateUploading   = "uploading"
+	ContainerStateUploaded    = "uploaded"
+	ContainerStateEvicted     = "evicted"
+	ContainerStateFederated   = "federated" // Offloaded to the federated cluster
+	ContainerStateQuarantined = "quarantined"
+	ContainerStateReplica     = "replica" // Another machine's container held here
+)
+
+// Label values for requests without a tenant
+const (
+	metricsDefaultTenant = "default" // Blobs uploaded without X-FileBox-Tenant
+	metricsClusterTenant = "cluster" // S3 requests made by cluster jobs
+)
+
+// metricDesc - One exported metric. /metrics and the generated dashboard both
+// read metricDescs, so panels always match the names and labels served.
+type metricDesc struct {
+	Name   string
+	Help   string
+	Type   string   // "gauge" or "counter"
+	Labels []string // Label names, in the order samples list their values
+	Unit   string   // Grafana unit of the panel
+	Row    string   // Dashboard row the panel is placed in
+}
+
+var metricDescs = []metricDesc{
+	{"filebox_containers", "Container files by tenant and state", "gauge", []string{"tenant", "state"}, "short", "Storage"},
+	{"filebox_container_bytes", "Bytes in container files by tenant and state", "gauge", []string{"tenant", "state"}, "bytes", "Storage"},
+	{"filebox_blobs", "Readable blobs by tenant", "gauge", []string{"tenant"}, "short", "Storage"},
+	{"filebox_blob_bytes", "Bytes of readable blobs by tenant", "gauge", []string{"tenant"}, "bytes", "Storage"},
+	{"filebox_s3_requests_total", "S3 requests by tenant and operation", "counter", []string{"tenant", "operation"}, "reqps", "S3"},
+	{"filebox_cache_requests_total", "Blob cache lookups by result", "counter", []string{"result"}, "reqps", "S3"},
+	{"filebox_cache_bytes", "Bytes held in the blob cache", "gauge", nil, "bytes", "S3"},
+	{"filebox_readahead_bytes_total", "Bytes prefetched by readahead", "counter", nil, "Bps", "S3"},
+	{"filebox_replica_lag_bytes", "Bytes of containers awaiting upload not yet acknowledged by each peer", "gauge", []string{"peer"}, "bytes", "Cluster"},
+	{"filebox_replication_requests_total", "Replication HTTP requests sent to each peer; streamed records only count as blobs", "counter", []string{"peer"}, "reqps", "Cluster"},
+	{"filebox_replication_blobs_total", "Records replicated to each peer", "counter", []string{"peer"}, "ops", "Cluster"},
+	{"filebox_replication_bytes_total", "Replication bytes sent to each peer, before (payload) and after (wire) compression", "counter", []string{"peer", "encoding"}, "Bps", "Cluster"},
+	{"filebox_peer_circuit_open", "1 while replication to the peer is stopped by its circuit breaker", "gauge", []string{"peer"}, "short", "Cluster"},
+	{"filebox_peer_latency_seconds", "Moving average of successful replication sends to the peer", "gauge", []string{"peer"}, "s", "Cluster"},
+	{"filebox_peer_hinted_bytes", "Bytes the peer missed, waiting to be replayed", "gauge", []string{"peer"}, "bytes", "Cluster"},
+	{"filebox_peer_up", "Whether the last clock check reached the peer", "gauge", []string{"peer"}, "short", "Cluster"},
+	{"filebox_peer_clock_skew_seconds", "Peer clock minus ours at the last check", "gauge", []string{"peer"}, "s", "Cluster"},
+	{"filebox_admission_inflight_bytes", "Upload bytes admitted and not yet stored", "gauge", nil, "bytes", "Node"},
+	{"filebox_admission_rejected_total", "Uploads refused with 429 by reason", "counter", []string{"reason"}, "reqps", "Node"},
+	{"filebox_abandoned_requests_total", "Uploads and downloads whose client went away, by the stage they were stopped at", "counter", []string{"stage"}, "reqps", "Node"},
+	{"filebox_replication_queued_bytes", "Record bytes queued or in flight to replicas", "gauge", nil, "bytes", "Cluster"},
+	{"filebox_s3_backlog_bytes", "Bytes of full containers waiting for their S3 upload", "gauge", nil, "bytes", "S3"},
+	{"filebox_request_latency_seconds", "Request latency percentiles over the last 5 minutes by endpoint class", "gauge", []string{"endpoint", "quantile"}, "s", "Requests"},
+	{"filebox_requests_total", "Finished requests by endpoint class and whether they met the SLO target", "counter", []string{"endpoint", "slo"}, "reqps", "Requests"},
+	{"filebox_slo_target_seconds", "Latency target of each endpoint class", "gauge", []string{"endpoint"}, "s", "Requests"},
+	{"filebox_slo_burn_rate", "Rate the latency error budget is spent at by window; above 1 misses the objective", "gauge", []string{"endpoint", "window"}, "short", "Requests"},
+	{"filebox_mmap_bytes", "Bytes of hot containers mapped into memory", "gauge", nil, "bytes", "Node"},
+	{"filebox_local_reads_total", "Local blob reads by path: copied from a mapping or read with pread", "counter", []string{"path"}, "reqps", "Node"},
+	{"filebox_edge_requests_total", "Edge node reads and forwarded requests by result", "counter", []string{"result"}, "reqps", "Node"},
+	{"filebox_edge_cache_bytes", "Bytes of pulled copies cached by an edge node", "gauge", nil, "bytes", "Node"},
+	{"filebox_volume_healthy", "1 if a storage volume passed its last check", "gauge", []string{"volume"}, "short", "Node"},
+	{"filebox_volume_free_bytes", "Free bytes on a storage volume", "gauge", []string{"volume"}, "bytes", "Node"},
+	{"filebox_volume_containers", "Local container files on a storage volume", "gauge", []string{"volume"}, "short", "Node"},
+	{"filebox_volume_online", "1 unless a storage volume was taken offline", "gauge", []string{"volume"}, "short", "Node"},
+	{"filebox_volume_io_errors_total", "Disk errors on a storage volume", "counter", []string{"volume"}, "short", "Node"},
+	{"filebox_event_deliveries_total", "Event webhook deliveries by result", "counter", []string{"result"}, "short", "Node"},
+	{"filebox_transfer_rate_limit_bytes", "Bytes per second background transfers are held to now, by kind; 0 while paused", "gauge", []string{"kind"}, "Bps", "Node"},
+	{"filebox_transfer_scheduled_bytes_total", "Bytes sent under a bandwidth schedule, by kind", "counter", []string{"kind"}, "bytes", "Node"},
+	{"filebox_transfer_wait_seconds_total", "Time background transfers waited for their bandwidth schedule, by kind", "counter", []string{"kind"}, "s", "Node"},
+	{"filebox_dedupe_chunks", "Deduplicated chunks in the chunk index", "gauge", nil, "short", "Storage"},
+	{"filebox_dedupe_chunk_writes_total", "Chunks of deduplicated uploads by whether they were stored or reused", "counter", []string{"result"}, "short", "Storage"},
+	{"filebox_dedupe_saved_bytes_total", "Bytes not written because their chunk was already stored", "counter", nil, "bytes", "Storage"},
+	{"filebox_node_mode", "1 for the node's current mode", "gauge", []string{"mode"}, "short", "Node"},
+	{"filebox_goroutines", "Running goroutines", "gauge", nil, "short", "Node"},
+}
+
+// metricSample - One value of a metric with its label values
+type metricSample struct {
+	labels []string
+	value  float64
+}
+
+// containerState classifies a container for the "state" label.
+// Callers must hold fb.fileLock.
+func (fb *FileBox) containerState(containerFile *ContainerFile) string {
+	switch {
+	case fb.isForeign(containerFile):
+		return ContainerStateReplica
+	case containerFile.Quarantined:
+		return ContainerStateQuarantined
+	case containerFile.Federated:
+		return ContainerStateFederated
+	case containerFile.Evicted:
+		return ContainerStateEvicted
+	case containerFile.Uploaded:
+		return ContainerStateUploaded
+	case containerFile.Uploading:
+		return ContainerStateUploading
+	}
+	return ContainerStateOpen
+}
+
+// metricsTenant maps the default tenant to a non-empty label value
+func metricsTenant(tenant string) string {
+	if tenant == "" {
+		return metricsDefaultTenant
+	}
+	return tenant
+}
+
+// collectMetrics gathers the current value of every metric
+func (fb *FileBox) collectMetrics() map[string][]metricSample {
+	samples := make(map[string][]metricSample)
+	sums := make(map[string]map[string]float64) // Metric -> joined label values -> value
+	add := func(name string, value float64, labels ...string) {
+		if sums[name] == nil {
+			sums[name] = make(map[string]float64)
+		}
+		sums[name][strings.Join(labels, "\x00")] += value
+	}
+
+	now := timeNow()
+	fb.fileLock.RLock()
+	for _, containerFile := range fb.files.all() {
+		tenant, state := metricsTenant(containerFile.Tenant), fb.containerState(containerFile)
+		size := fb.containerSize(containerFile)
+		add("filebox_containers", 1, tenant, state)
+		add("filebox_container_bytes", float64(size), tenant, state)
+		if state == ContainerStateReplica {
+			continue
+		}
+		for _, blob := range fb.containerBlobs(containerFile) {
+			if !blob.Uncommitted && blob.DeletedAt == nil && blob.ChunkHash == "" && !expired(containerFile, blob, now) {
+				add("filebox_blobs", 1, tenant)
+				add("filebox_blob_bytes", float64(blob.Size), tenant)
+			}
+		}
+		if !containerFile.Uploaded {
+			for _, replica := range fb.replicas {
+				add("filebox_replica_lag_bytes", float64(max(size-containerFile.Replicated[replica], 0)), replica)
+			}
+		}
+	}
+	fb.fileLock.RUnlock()
+
+	for _, replica := range fb.replicas {
+		add("filebox_replica_lag_bytes", 0, replica) // Report peers with nothing pending too
+		stats := fb.replication.stats[replica]
+		add("filebox_replication_requests_total", float64(stats.requests.Load()), replica)
+		add("filebox_replication_blobs_total", float64(stats.blobs.Load()), replica)
+		add("filebox_replication_bytes_total", float64(stats.payloadBytes.Load()), replica, "payload")
+		add("filebox_replication_bytes_total", float64(stats.wireBytes.Load()), replica, "wire")
+
+		health := fb.health.snapshot(replica)
+		open := 0.0
+		if health.State == BreakerOpen {
+			open = 1
+		}
+		add("filebox_peer_circuit_open", open, replica)
+		add("filebox_peer_latency_seconds", health.LatencyMS/1000, replica)
+		add("filebox_peer_hinted_bytes", float64(health.HintedBytes), replica)
+	}
+
+	fb.usage.mu.Lock()
+	for tenant, requests := range fb.usage.requests {
+		for operation, n := range requests {
+			add("filebox_s3_requests_total", float64(n), metricsTenant(tenant), operation)
+		}
+	}
+	for operation, n := range fb.usage.unattributed {
+		add("filebox_s3_requests_total", float64(n), metricsClusterTenant, operation)
+	}
+	fb.usage.mu.Unlock()
+
+	cache := fb.cache.stats()
+	add("filebox_cache_requests_total", float64(cache.Hits), "hit")
+	add("filebox_cache_requests_total", float64(cache.Misses), "miss")
+	add("filebox_cache_bytes", float64(cache.Bytes))
+	add("filebox_readahead_bytes_total", float64(fb.readahead.bytes.Load()))
+
+	fb.clock.mu.Lock()
+	for _, replica := range fb.replicas {
+		peer, checked := fb.clock.peers[replica]
+		if !checked {
+			continue
+		}
+		up := 0.0
+		if peer.Error == "" {
+			up = 1
+			add("filebox_peer_clock_skew_seconds", peer.Skew.Seconds(), replica)
+		}
+		add("filebox_peer_up", up, replica)
+	}
+	fb.clock.mu.Unlock()
+
+	current := fb.mode.get().Mode
+	for _, mode := range []string{ModeNormal, ModeReadOnly, ModeMaintenance} {
+		value := 0.0
+		if mode == current {
+			value = 1
+		}
+		add("filebox_node_mode", value, mode)
+	}
+	add("filebox_goroutines", float64(runtime.NumGoroutine()))
+
+	mmap := fb.mmap.stats()
+	add("filebox_mmap_bytes", float64(mmap.Bytes))
+	add("filebox_local_reads_total", float64(mmap.MappedReads), "mmap")
+	add("filebox_local_reads_total", float64(mmap.Preads), "pread")
+
+	if fb.edge != nil {
+		edge := fb.edge.status()
+		for result, n := range edge.Requests {
+			add("filebox_edge_requests_total", float64(n), result)
+		}
+		add("filebox_edge_cache_bytes", float64(edge.Bytes))
+	}
+
+	for _, volume := range fb.volumeStatus() {
+		healthy := 0.0
+		if volume.Healthy {
+			healthy = 1
+		}
+		add("filebox_volume_healthy", healthy, volume.Path)
+		add("filebox_volume_free_bytes", float64(volume.FreeBytes), volume.Path)
+		add("filebox_volume_containers", float64(volume.Containers), volume.Path)
+		online := 0.0
+		if volume.Online {
+			online = 1
+		}
+		add("filebox_volume_online", online, volume.Path)
+		add("filebox_volume_io_errors_total", float64(volume.IOErrors), volume.Path)
+	}
+	for result, n := range fb.events.stats() {
+		add("filebox_event_deliveries_total", float64(n), result)
+	}
+	for _, bandwidth := range fb.bandwidthStatus() {
+		if !bandwidth.Scheduled {
+			continue
+		}
+		if bandwidth.Rate != "unlimited" {
+			add("filebox_transfer_rate_limit_bytes", float64(bandwidth.BytesPerSec), bandwidth.Kind)
+		}
+		add("filebox_transfer_scheduled_bytes_total", float64(bandwidth.Bytes), bandwidth.Kind)
+		add("filebox_transfer_wait_seconds_total", bandwidth.WaitedSeconds, bandwidth.Kind)
+	}
+	dedupe := fb.dedupe.status()
+	add("filebox_dedupe_chunks", float64(dedupe.Chunks))
+	add("filebox_dedupe_chunk_writes_total", float64(dedupe.StoredChunks), "stored")
+	add("filebox_dedupe_chunk_writes_total", float64(dedupe.ReusedChunks), "reused")
+	add("filebox_dedupe_saved_bytes_total", float64(dedupe.SavedBytes))
+
+	admission := fb.admissionStatus()
+	add("filebox_admission_inflight_bytes", float64(admission.InflightBytes))
+	for reason, n := range admission.Rejected {
+		add("filebox_admission_rejected_total", float64(n), reason)
+	}
+	for stage, n := range fb.disconnects.snapshot() {
+		add("filebox_abandoned_requests_total", float64(n), stage)
+	}
+	add("filebox_replication_queued_bytes", float64(admission.ReplicationBytes))
+	add("filebox_s3_backlog_bytes", float64(admission.S3BacklogBytes))
+
+	if fb.slo != nil {
+		for _, endpoint := range fb.slo.status(now).Endpoints {
+			add("filebox_request_latency_seconds", endpoint.P50MS/1000, endpoint.Endpoint, "0.5")
+			add("filebox_request_latency_seconds", endpoint.P95MS/1000, endpoint.Endpoint, "0.95")
+			add("filebox_request_latency_seconds", endpoint.P99MS/1000, endpoint.Endpoint, "0.99")
+			add("filebox_requests_total", float64(endpoint.Requests-endpoint.Missed), endpoint.Endpoint, "met")
+			add("filebox_requests_total", float64(endpoint.Missed), endpoint.Endpoint, "missed")
+			add("filebox_slo_target_seconds", endpoint.TargetMS/1000, endpoint.Endpoint)
+			for window, burn := range endpoint.Burn {
+				add("filebox_slo_burn_rate", burn, endpoint.Endpoint, window)
+			}
+		}
+	}
+
+	for name, values := range sums {
+		for key, value := range values {
+			var labels []string
+			if key != "" {
+				labels = strings.Split(key, "\x00")
+			}
+			samples[name] = append(samples[name], metricSample{labels: labels, value: value})
+		}
+		sort.Slice(samples[name], func(i, j int) bool {
+			return strings.Join(samples[name][i].labels, "\x00") < strings.Join(samples[name][j].labels, "\x00")
+		})
+	}
+	return samples
+}
+
+// escapeLabelValue escapes a label value for the Prometheus text format
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// handleMetrics serves GET /metrics in the Prometheus text exposition format
+func (fb *FileBox) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	samples := fb.collectMetrics()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, desc := range metricDescs {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", desc.Name, desc.Help, desc.Name, desc.Type)
+		for _, sample := range samples[desc.Name] {
+			pairs := make([]string, len(sample.labels))
+			for i, value := range sample.labels {
+				pairs[i] = fmt.Sprintf(`%s="%s"`, desc.Labels[i], escapeLabelValue(value))
+			}
+			labels := ""
+			if len(pairs) > 0 {
+				labels = "{" + strings.Join(pairs, ",") + "}"
+			}
+			fmt.Fprintf(w, "%s%s %g\n", desc.Name, labels, sample.value)
+		}
+	}
+}
+
+// dashboardVariables are the template variables panels filter on, by label
+var dashboardVariables = []struct {
+	Label  string
+	Metric string // Metric whose label values populate the variable
+}{
+	{"tenant", "filebox_containers"},
+	{"peer", "filebox_replica_lag_bytes"},
+}
+
+// dashboardQuery builds the PromQL expression and legend of a metric's panel
+func dashboardQuery(desc metricDesc) (string, string) {
+	var filters []string
+	for _, variable := range dashboardVariables {
+		for _, label := range desc.Labels {
+			if label == variable.Label {
+				filters = append(filters, fmt.Sprintf(`%s=~"$%s"`, label, label))
+			}
+		}
+	}
+	selector := fmt.Sprintf(`%s{instance=~"$instance"`, desc.Name)
+	for _, filter := range filters {
+		selector += "," + filter
+	}
+	selector += "}"
+	if desc.Type == "counter" {
+		selector = fmt.Sprintf("rate(%s[$__rate_interval])", selector)
+	}
+
+	// Keep nodes apart: peer and mode values only mean something per node
+	by := append([]string{"instance"}, desc.Labels...)
+	legend := make([]string, len(by))
+	for i, label := range by {
+		legend[i] = "{{" + label + "}}"
+	}
+	return fmt.Sprintf("sum by (%s) (%s)", strings.Join(by, ", "), selector), strings.Join(legend, " ")
+}
+
+// dashboard builds a Grafana dashboard with one time series panel per metric,
+// grouped in rows, for the Prometheus data source with the given UID
+func dashboard(datasourceUID string) map[string]any {
+	datasource := map[string]any{"type": "prometheus", "uid": datasourceUID}
+
+	variables := []any{map[string]any{
+		"name": "instance", "label": "Node", "type": "query", "datasource": datasource,
+		"query":   "label_values(filebox_goroutines, instance)",
+		"refresh": 2, "multi": true, "includeAll": true,
+		"current": map[string]any{"text": "All", "value": "$__all"},
+	}}
+	for _, variable := range dashboardVariables {
+		variables = append(variables, map[string]any{
+			"name": variable.Label, "label": strings.ToUpper(variable.Label[:1]) + variable.Label[1:], "type": "query",
+			"datasource": datasource,
+			"query":      fmt.Sprintf("label_values(%s, %s)", variable.Metric, variable.Label),
+			"refresh":    2, "multi": true, "includeAll": true, "allValue": ".*",
+			"current": map[string]any{"text": "All", "value": "$__all"},
+		})
+	}
+
+	var panels []any
+	id, y, x := 1, 0, 0
+	row := ""
+	for _, desc := range metricDescs {
+		if desc.Row != row {
+			if x > 0 {
+				y += 8
+				x = 0
+			}
+			row = desc.Row
+			panels = append(panels, map[string]any{
+				"id": id, "type": "row", "title": row, "collapsed": false,
+				"gridPos": map[string]int{"h": 1, "w": 24, "x": 0, "y": y},
+			})
+			id++
+			y++
+		}
+
+		expr, legend := dashboardQuery(desc)
+		panels = append(panels, map[string]any{
+			"id": id, "type": "timeseries", "title": desc.Help, "datasource": datasource,
+			"gridPos":     map[string]int{"h": 8, "w": 12, "x": x, "y": y},
+			"fieldConfig": map[string]any{"defaults": map[string]any{"unit": desc.Unit}, "overrides": []any{}},
+			"targets": []any{map[string]any{
+				"refId": "A", "datasource": datasource, "expr": expr, "legendFormat": legend,
+			}},
+		})
+		id++
+		if x == 0 {
+			x = 12
+		} else {
+			x = 0
+			y += 8
+		}
+	}
+
+	return map[string]any{
+		"uid":           "filebox",
+		"title":         "FileBox",
+		"tags":          []string{"filebox"},
+		"timezone":      "browser",
+		"schemaVersion": 39,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating":    map[string]any{"list": variables},
+		"panels":        panels,
+	}
+}
+
+// handleDashboard serves GET /admin/dashboard.json[?datasource=uid], a
+// Grafana dashboard for the metrics served at /metrics
+func (fb *FileBox) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	datasourceUID := r.URL.Query().Get("datasource")
+	if datasourceUID == "" {
+		datasourceUID = "${DS_PROMETHEUS}"
+	}
+	d := dashboard(datasourceUID)
+	if datasourceUID == "${DS_PROMETHEUS}" {
+		// Grafana asks for the data source on import
+		d["__inputs"] = []any{map[string]string{
+			"name": "DS_PROMETHEUS", "label": "Prometheus", "type": "datasource",
+			"pluginId": "prometheus", "pluginName": "Prometheus",
+		}}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="filebox-dashboard.json"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(d)
+}
@@ -0,0 +1,210 @@
+// Memory-mapped reads of hot containers for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every local read normally costs an open, a seek, a read and a close. A
+// container that keeps being read is mapped into memory instead, after
+// which a read is a copy out of the mapping. The kernel is told access is
+// random so it does not read ahead past the small blobs asked for.
+// Mappings are dropped least recently used first once MMAP_MAX_BYTES is
+// mapped, and whenever the container file is removed or replaced.
+
+// errMmapUnsupported - The platform cannot map files
+var errMmapUnsupported = errors.New("memory-mapped reads are not supported on this platform")
+
+// MmapConfig - When containers are mapped and how much may be mapped at once
+type MmapConfig struct {
+	HotReads int   // Reads of a container before it is mapped
+	MaxBytes int64 // Bytes mapped across all containers
+}
+
+// loadMmapReader reads MMAP_READS, MMAP_HOT_READS and MMAP_MAX_BYTES; nil when off
+func loadMmapReader() *mmapReader {
+	if !getEnvBool("MMAP_READS", false) {
+		return nil
+	}
+	config := MmapConfig{
+		HotReads: int(getEnvInt("MMAP_HOT_READS", 8)),
+		MaxBytes: getEnvInt("MMAP_MAX_BYTES", 1024*1024*1024),
+	}
+	return newMmapReader(config)
+}
+
+// mappedContainer - One container file mapped into memory
+type mappedContainer struct {
+	data     []byte
+	refs     int  // Reads copying out of the mapping
+	retired  bool // Unmapped once the last read finishes
+	lastUsed time.Time
+}
+
+// mmapReader - Mappings of hot containers, keyed by file path
+type mmapReader struct {
+	config MmapConfig
+
+	mu     sync.Mutex
+	reads  map[string]int // Unmapped reads per container, to find hot ones
+	maps   map[string]*mappedContainer
+	mapped int64
+
+	mappedReads atomic.Int64
+	preads      atomic.Int64
+}
+
+func newMmapReader(config MmapConfig) *mmapReader {
+	return &mmapReader{config: config, reads: make(map[string]int), maps: make(map[string]*mappedContainer)}
+}
+
+// read copies a blob out of its container's mapping. It returns false when
+// the read should go through pread instead: the container is not hot yet,
+// does not fit in MMAP_MAX_BYTES, or has grown past its mapping.
+func (m *mmapReader) read(path string, offset, length int64) ([]byte, bool) {
+	if m == nil {
+		return nil, false
+	}
+
+	m.mu.Lock()
+	mapping := m.maps[path]
+	if mapping == nil || offset+length > int64(len(mapping.data)) {
+		m.reads[path]++
+		if m.reads[path] < m.config.HotReads {
+			m.mu.Unlock()
+			m.preads.Add(1)
+			return nil, false
+		}
+		if mapping = m.mapLocked(path, offset+length); mapping == nil {
+			m.mu.Unlock()
+			m.preads.Add(1)
+			return nil, false
+		}
+	}
+	mapping.refs++
+	mapping.lastUsed = timeNow()
+	m.mu.Unlock()
+
+	blobData := make([]byte, length)
+	copy(blobData, mapping.data[offset:offset+length])
+	m.mappedReads.Add(1)
+
+	m.mu.Lock()
+	mapping.refs--
+	if mapping.retired && mapping.refs == 0 {
+		m.unmapLocked(mapping)
+	}
+	m.mu.Unlock()
+	return blobData, true
+}
+
+// mapLocked maps a container as it is now, replacing a mapping that has
+// become too short, and makes room under MMAP_MAX_BYTES. Callers must hold m.mu.
+func (m *mmapReader) mapLocked(path string, need int64) *mappedContainer {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.Size() < need || info.Size() > m.config.MaxBytes {
+		return nil
+	}
+
+	m.retireLocked(path)
+	for m.mapped+info.Size() > m.config.MaxBytes {
+		if !m.evictLocked() {
+			return nil // Everything mapped is being read from
+		}
+	}
+
+	data, err := mmapFile(file, int(info.Size()))
+	if err != nil {
+		if !errors.Is(err, errMmapUnsupported) {
+			log.Printf("Error mapping container %s: %v", path, err)
+		}
+		return nil
+	}
+	mapping := &mappedContainer{data: data}
+	m.maps[path] = mapping
+	m.mapped += int64(len(data))
+	delete(m.reads, path)
+	return mapping
+}
+
+// evictLocked retires the least recently used mapping no read is using.
+// Callers must hold m.mu.
+func (m *mmapReader) evictLocked() bool {
+	var oldest string
+	for path, mapping := range m.maps {
+		if mapping.refs == 0 && (oldest == "" || mapping.lastUsed.Before(m.maps[oldest].lastUsed)) {
+			oldest = path
+		}
+	}
+	if oldest == "" {
+		return false
+	}
+	m.retireLocked(oldest)
+	return true
+}
+
+// retireLocked drops a container's mapping, unmapping it now or after its
+// last read. Callers must hold m.mu.
+func (m *mmapReader) retireLocked(path string) {
+	mapping, ok := m.maps[path]
+	if !ok {
+		return
+	}
+	delete(m.maps, path)
+	mapping.retired = true
+	if mapping.refs == 0 {
+		m.unmapLocked(mapping)
+	}
+}
+
+// unmapLocked releases a retired mapping. Callers must hold m.mu.
+func (m *mmapReader) unmapLocked(mapping *mappedContainer) {
+	if err := munmapFile(mapping.data); err != nil {
+		log.Printf("Error unmapping container: %v", err)
+	}
+	m.mapped -= int64(len(mapping.data))
+	mapping.data = nil
+}
+
+// forget drops a container's mapping and read count; called before its file
+// is removed or replaced so reads never see the old contents
+func (m *mmapReader) forget(path string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retireLocked(path)
+	delete(m.reads, path)
+}
+
+// MmapStats - Mapped containers and how local reads were served
+type MmapStats struct {
+	Containers  int   `json:"containers"`
+	Bytes       int64 `json:"bytes"`
+	MappedReads int64 `json:"mapped_reads"`
+	Preads      int64 `json:"preads"`
+}
+
+// stats reports the mappings; zero when mmap reads are off
+func (m *mmapReader) stats() MmapStats {
+	if m == nil {
+		return MmapStats{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return MmapStats{Containers: len(m.maps), Bytes: m.mapped, MappedReads: m.mappedReads.Load(), Preads: m.preads.Load()}
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+// Memory-mapped reads of hot containers for FileBox (unsupported platforms)
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import "os"
+
+// mmapFile reports that this platform cannot map files; reads use pread
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+// munmapFile has nothing to release on this platform
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+// Memory-mapped reads of hot containers for FileBox (Unix)
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapFile maps size bytes of a file read-only and hints that access is random
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	data, err := unix.Mmap(int(file.Fd()), 0, size, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	// Blobs are small and scattered; read-ahead would only evict other pages
+	_ = unix.Madvise(data, unix.MADV_RANDOM)
+	return data, nil
+}
+
+// munmapFile releases a mapping made by mmapFile
+func munmapFile(data []byte) error {
+	return unix.Munmap(data)
+}
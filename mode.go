@@ -0,0 +1,197 @@
+// Read-only and maintenance modes for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Node modes
+const (
+	ModeNormal      = "normal"
+	ModeReadOnly    = "read-only"   // Uploads and other writes are rejected, reads are served
+	ModeMaintenance = "maintenance" // The whole data plane answers 503; admin endpoints stay up
+)
+
+// modeFile is where the current mode is kept, relative to the storage
+// directory, so it survives a restart
+const modeFile = "node/mode.json"
+
+// NodeMode - Response and request body of /admin/mode
+type NodeMode struct {
+	Mode   string    `json:"mode"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// modeState - The node's current mode, guarded by mu
+type modeState struct {
+	mu      sync.RWMutex
+	current NodeMode
+	path    string
+}
+
+// loadModeState restores the mode saved in the storage directory; nodes
+// start in normal mode if none was saved
+func loadModeState(storageDir string) *modeState {
+	state := &modeState{
+		current: NodeMode{Mode: ModeNormal, Since: timeNow().UTC()},
+		path:    filepath.Join(storageDir, modeFile),
+	}
+
+	data, err := os.ReadFile(state.path)
+	if err != nil {
+		return state
+	}
+	var saved NodeMode
+	if err := json.Unmarshal(data, &saved); err != nil || validateMode(saved.Mode) != nil {
+		log.Printf("Ignoring invalid %s", state.path)
+		return state
+	}
+	state.current = saved
+	if saved.Mode != ModeNormal {
+		log.Printf("Starting in %s mode (since %s): %s", saved.Mode, saved.Since.Format(time.RFC3339), saved.Reason)
+	}
+	return state
+}
+
+// validateMode rejects unknown mode names
+func validateMode(mode string) error {
+	switch mode {
+	case ModeNormal, ModeReadOnly, ModeMaintenance:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q (want %s, %s or %s)", mode, ModeNormal, ModeReadOnly, ModeMaintenance)
+}
+
+// get returns the current mode
+func (m *modeState) get() NodeMode {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.current
+}
+
+// set switches to a validated mode and saves it; the switch takes effect
+// even if saving fails
+func (m *modeState) set(mode, reason string) (NodeMode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current.Mode != mode || m.current.Reason != reason {
+		m.current = NodeMode{Mode: mode, Reason: reason, Since: timeNow().UTC()}
+	}
+
+	data, err := json.Marshal(m.current)
+	if err != nil {
+		return m.current, err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return m.current, err
+	}
+	return m.current, os.WriteFile(m.path, data, 0644)
+}
+
+// isWrite reports whether a data plane request changes stored data
+func isWrite(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return false
+	}
+	return true
+}
+
+// enforceMode wraps the data plane: in maintenance mode every request is
+// refused, in read-only mode (or with too much clock skew) every write is.
+// Admin, debug and metrics endpoints are always let through so the node can
+// be watched and switched back.
+func (fb *FileBox) enforceMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/debug/") || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if fb.bootstrap.running() {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "Node is bootstrapping from a peer", http.StatusServiceUnavailable)
+			return
+		}
+
+		mode := fb.mode.get()
+		switch {
+		case mode.Mode == ModeMaintenance:
+			w.Header().Set("X-FileBox-Mode", mode.Mode)
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "Node is in maintenance mode", http.StatusServiceUnavailable)
+			return
+		case mode.Mode == ModeReadOnly && isWrite(r):
+			w.Header().Set("X-FileBox-Mode", mode.Mode)
+			http.Error(w, "Node is read-only", http.StatusServiceUnavailable)
+			return
+		case isWrite(r) && fb.clock.refusesWrites():
+			http.Error(w, "Clock skew against a replica exceeds CLOCK_SKEW_MAX; writes refused", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeRefusal applies enforceMode's write checks to peer writes that do
+// not arrive over HTTP, such as replication streams
+func (fb *FileBox) writeRefusal() error {
+	mode := fb.mode.get()
+	switch {
+	case fb.edge != nil:
+		return errors.New("Edge nodes hold no data and replicate nothing")
+	case fb.bootstrap.running():
+		return errors.New("Node is bootstrapping from a peer")
+	case mode.Mode == ModeMaintenance:
+		return errors.New("Node is in maintenance mode")
+	case mode.Mode == ModeReadOnly:
+		return errors.New("Node is read-only")
+	case fb.clock.refusesWrites():
+		return errors.New("Clock skew against a replica exceeds CLOCK_SKEW_MAX; writes refused")
+	}
+	return nil
+}
+
+// handleMode serves GET /admin/mode and POST /admin/mode
+func (fb *FileBox) handleMode(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fb.mode.get())
+
+	case "POST":
+		var req NodeMode
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := validateMode(req.Mode); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mode, err := fb.mode.set(req.Mode, req.Reason)
+		if err != nil {
+			log.Printf("Error saving node mode: %v", err)
+		}
+		log.Printf("Node mode set to %s: %s", mode.Mode, mode.Reason)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mode)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,483 @@
+// Namespace bundles for promoting a tenant between FileBox clusters
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"filebox/pkg/containerformat"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// A bundle is a directory of S3 objects under one prefix:
+//
+//	bundle.json               NamespaceBundle: the tenant's policy and every blob's metadata
+//	containers/<fid>.dat      One container per source container, in the container record
+//	                          format, holding the plaintext of its live blobs
+//
+// Records are decrypted and decompressed on export, so the importing
+// cluster applies its own encryption and compression. Import re-uploads
+// every blob under the target tenant; blobs get new IDs, reported in the
+// result, and named keys point at the new blobs.
+const (
+	bundleFormat        = "filebox-namespace"
+	bundleVersion       = 1
+	bundleManifestName  = "bundle.json"
+	bundleContainersDir = "containers/"
+)
+
+// BundleBlob - One blob of a namespace bundle
+type BundleBlob struct {
+	ID          string            `json:"id"`            // In the exporting cluster
+	Key         string            `json:"key,omitempty"` // Set only if the key pointed at this blob
+	ContentType string            `json:"content_type,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Created     time.Time         `json:"created"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
+	Offset      int64             `json:"offset"` // Of the data in the bundle container, past the record header
+	Length      int64             `json:"length"`
+}
+
+// BundleContainer - One container object of a namespace bundle
+type BundleContainer struct {
+	Object string       `json:"object"` // Relative to the bundle prefix
+	Size   int64        `json:"size"`
+	Blobs  []BundleBlob `json:"blobs"`
+}
+
+// NamespaceBundle - The bundle.json of a namespace bundle
+type NamespaceBundle struct {
+	Format     string            `json:"format"`
+	Version    int               `json:"version"`
+	Tenant     string            `json:"tenant"`
+	SourceHost string            `json:"source_host"`
+	Created    time.Time         `json:"created"`
+	Policy     *TenantPolicy     `json:"policy,omitempty"` // The tenant's effective policy, if it had one
+	Containers []BundleContainer `json:"containers"`
+}
+
+// NamespaceExportRequest - Body of POST /admin/namespaces/export
+type NamespaceExportRequest struct {
+	Tenant string `json:"tenant"`           // "" is the default tenant
+	Bucket string `json:"bucket,omitempty"` // Defaults to the FileBox bucket
+	Prefix string `json:"prefix"`           // Where the bundle is written
+}
+
+// NamespaceImportRequest - Body of POST /admin/namespaces/import
+type NamespaceImportRequest struct {
+	Bucket     string  `json:"bucket,omitempty"` // Defaults to the FileBox bucket
+	Prefix     string  `json:"prefix"`           // Where the bundle was written
+	Tenant     *string `json:"tenant,omitempty"` // Target tenant; defaults to the bundle's
+	KeyPrefix  string  `json:"key_prefix,omitempty"`
+	SkipPolicy bool    `json:"skip_policy,omitempty"` // Keep the target tenant's policy
+}
+
+// NamespaceTransferResult - Summary of a namespace export or import
+type NamespaceTransferResult struct {
+	Tenant     string            `json:"tenant"`
+	Bucket     string            `json:"bucket"`
+	Prefix     string            `json:"prefix"`
+	Containers int               `json:"containers"`
+	Blobs      int               `json:"blobs"`
+	Keys       int               `json:"keys"`
+	Bytes      int64             `json:"bytes"`
+	Skipped    int               `json:"skipped,omitempty"` // Expired since export, or not readable
+	Policy     bool              `json:"policy,omitempty"`  // The tenant policy was exported or applied
+	IDs        map[string]string `json:"ids,omitempty"`     // Exported blob ID -> imported blob ID
+	Errors     []string          `json:"errors,omitempty"`
+}
+
+// bundlePrefix normalizes a bundle prefix to end in a slash
+func bundlePrefix(prefix string) string {
+	prefix = strings.TrimPrefix(prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// currentKey reports whether a blob's named key still points at it
+func (fb *FileBox) currentKey(blob BlobInfo) bool {
+	if blob.Key == "" {
+		return false
+	}
+	if fb.raft != nil {
+		entry, exists := fb.raft.fsm.lookup(blob.Key)
+		return exists && entry.BlobID == blob.ID
+	}
+	return fb.keys[blob.Key] == blob.ID // Caller holds fileLock
+}
+
+// ExportNamespace writes a tenant's policy and live blobs to a bundle in
+// S3. It covers the containers this node holds, its own and replicas.
+func (fb *FileBox) ExportNamespace(ctx context.Context, req NamespaceExportRequest) (*NamespaceTransferResult, error) {
+	if fb.s3Client == nil {
+		return nil, fmt.Errorf("S3 is not configured")
+	}
+	if req.Bucket == "" {
+		req.Bucket = fb.bucket
+	}
+	req.Prefix = bundlePrefix(req.Prefix)
+	if req.Prefix == "" {
+		return nil, fmt.Errorf("prefix is required")
+	}
+
+	// Snapshot the tenant's live blobs; variants are regenerated on import
+	// and chunks are read through the blobs made of them
+	type source struct {
+		fileID string
+		blobs  []BundleBlob
+	}
+	var sources []source
+	now := timeNow()
+	fb.fileLock.RLock()
+	for _, containerFile := range fb.files.all() {
+		if containerFile.Tenant != req.Tenant {
+			continue
+		}
+		src := source{fileID: containerFile.FID.String()}
+		for _, blob := range fb.containerBlobs(containerFile) {
+			if blob.Uncommitted || blob.DeletedAt != nil || blob.ChunkHash != "" || blob.VariantOf != "" || expired(containerFile, blob, now) {
+				continue
+			}
+			entry := BundleBlob{ID: blob.ID, ContentType: blob.ContentType, Tags: blob.Tags, Created: blob.Created, ExpiresAt: blob.ExpiresAt}
+			if fb.currentKey(blob) {
+				entry.Key = blob.Key
+			}
+			src.blobs = append(src.blobs, entry)
+		}
+		if len(src.blobs) > 0 {
+			sources = append(sources, src)
+		}
+	}
+	fb.fileLock.RUnlock()
+	sort.Slice(sources, func(i, j int) bool { return sources[i].fileID < sources[j].fileID })
+
+	result := &NamespaceTransferResult{Tenant: req.Tenant, Bucket: req.Bucket, Prefix: req.Prefix}
+	bundle := NamespaceBundle{
+		Format:     bundleFormat,
+		Version:    bundleVersion,
+		Tenant:     req.Tenant,
+		SourceHost: fb.hostID,
+		Created:    timeNow().UTC(),
+		Containers: make([]BundleContainer, 0, len(sources)),
+	}
+	if policy, policySource := fb.tenantPolicies.get(req.Tenant); policySource != "" {
+		bundle.Policy = &policy
+		result.Policy = true
+	}
+
+	for _, src := range sources {
+		var buf bytes.Buffer
+		writer := containerformat.NewWriter(&buf, 0)
+		if fb.integrity != "" {
+			writer.SetAlgorithm(fb.integrity)
+		}
+		container := BundleContainer{Object: bundleContainersDir + src.fileID + ".dat"}
+		for _, entry := range src.blobs {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			data, err := fb.GetBlob(ctx, entry.ID)
+			if err != nil {
+				result.Skipped++
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", entry.ID, err))
+				continue
+			}
+			rec, err := writer.Append(data)
+			if err != nil {
+				return nil, err
+			}
+			entry.Offset, entry.Length = rec.Offset, rec.Length
+			container.Blobs = append(container.Blobs, entry)
+			result.Blobs++
+			result.Bytes += rec.Length
+			if entry.Key != "" {
+				result.Keys++
+			}
+		}
+		if len(container.Blobs) == 0 {
+			continue
+		}
+
+		container.Size = int64(buf.Len())
+		if _, err := fb.s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(req.Bucket),
+			Key:    aws.String(req.Prefix + container.Object),
+			Body:   bytes.NewReader(buf.Bytes()),
+		}); err != nil {
+			return nil, fmt.Errorf("writing %s: %w", container.Object, err)
+		}
+		bundle.Containers = append(bundle.Containers, container)
+		result.Containers++
+	}
+
+	// The manifest goes last, so a bundle without one is incomplete
+	manifest, _ := json.MarshalIndent(bundle, "", "  ")
+	if _, err := fb.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(req.Bucket),
+		Key:         aws.String(req.Prefix + bundleManifestName),
+		Body:        bytes.NewReader(manifest),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		return nil, fmt.Errorf("writing %s: %w", bundleManifestName, err)
+	}
+
+	log.Printf("Exported namespace %q to s3://%s/%s: %d blobs (%d bytes) in %d containers, %d keys",
+		req.Tenant, req.Bucket, req.Prefix, result.Blobs, result.Bytes, result.Containers, result.Keys)
+	return result, nil
+}
+
+// readBundleObject reads one object of a bundle
+func (fb *FileBox) readBundleObject(ctx context.Context, bucket, key string) ([]byte, error) {
+	resp, err := fb.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// ImportNamespace uploads the blobs of a bundle into a tenant, applying the
+// bundle's tenant policy first so imported blobs are stored under it. r
+// carries the context named keys are committed with.
+func (fb *FileBox) ImportNamespace(r *http.Request, req NamespaceImportRequest) (*NamespaceTransferResult, error) {
+	ctx := r.Context()
+	if fb.s3Client == nil {
+		return nil, fmt.Errorf("S3 is not configured")
+	}
+	if req.Bucket == "" {
+		req.Bucket = fb.bucket
+	}
+	req.Prefix = bundlePrefix(req.Prefix)
+	if req.Prefix == "" {
+		return nil, fmt.Errorf("prefix is required")
+	}
+
+	data, err := fb.readBundleObject(ctx, req.Bucket, req.Prefix+bundleManifestName)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", bundleManifestName, err)
+	}
+	var bundle NamespaceBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", bundleManifestName, err)
+	}
+	if bundle.Format != bundleFormat || bundle.Version != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle %s version %d", bundle.Format, bundle.Version)
+	}
+
+	tenant := bundle.Tenant
+	if req.Tenant != nil {
+		tenant = *req.Tenant
+	}
+	result := &NamespaceTransferResult{Tenant: tenant, Bucket: req.Bucket, Prefix: req.Prefix, IDs: make(map[string]string)}
+	if bundle.Policy != nil && !req.SkipPolicy {
+		policy := *bundle.Policy
+		if err := policy.validate(fb.keyWrapper != nil); err != nil {
+			return nil, fmt.Errorf("bundle policy: %w", err)
+		}
+		if err := fb.setTenantPolicy(ctx, tenant, policy); err != nil {
+			return nil, err
+		}
+		result.Policy = true
+	}
+
+	for _, container := range bundle.Containers {
+		data, err := fb.readBundleObject(ctx, req.Bucket, req.Prefix+container.Object)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", container.Object, err))
+			continue
+		}
+		if int64(len(data)) != container.Size {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %d bytes, bundle says %d", container.Object, len(data), container.Size))
+			continue
+		}
+		reader := containerformat.NewReader(bytes.NewReader(data), int64(len(data)))
+
+		for _, entry := range container.Blobs {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			rec, blobData, err := reader.RecordAt(entry.Offset - containerformat.HeaderSize)
+			if err == nil && rec.Length != entry.Length {
+				err = fmt.Errorf("%w: length %d, bundle says %d", containerformat.ErrBadRecord, rec.Length, entry.Length)
+			}
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", entry.ID, err))
+				continue
+			}
+
+			opts := BlobOptions{Tenant: tenant, ContentType: entry.ContentType, Tags: entry.Tags, ctx: ctx}
+			if entry.Key != "" {
+				opts.Key = req.KeyPrefix + entry.Key
+			}
+			if entry.ExpiresAt != nil {
+				if opts.TTL = entry.ExpiresAt.Sub(timeNow()); opts.TTL <= 0 {
+					result.Skipped++
+					continue
+				}
+			}
+
+			response, err := fb.AddBlob(blobData, opts)
+			if err == nil {
+				err = fb.publishKey(r, response)
+			}
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", entry.ID, err))
+				continue
+			}
+			result.IDs[entry.ID] = response.ID
+			result.Blobs++
+			result.Bytes += int64(len(blobData))
+			if opts.Key != "" {
+				result.Keys++
+			}
+		}
+		result.Containers++
+	}
+
+	log.Printf("Imported namespace %q from s3://%s/%s into %q: %d blobs (%d bytes), %d keys, %d skipped, %d errors",
+		bundle.Tenant, req.Bucket, req.Prefix, tenant, result.Blobs, result.Bytes, result.Keys, result.Skipped, len(result.Errors))
+	return result, nil
+}
+
+// handleNamespaces serves POST /admin/namespaces/export and POST /admin/namespaces/import
+func (fb *FileBox) handleNamespaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var run func(ctx context.Context) (any, error)
+	switch r.URL.Path {
+	case "/admin/namespaces/export":
+		var req NamespaceExportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid export request", http.StatusBadRequest)
+			return
+		}
+		run = func(ctx context.Context) (any, error) {
+			return fb.ExportNamespace(ctx, req)
+		}
+	case "/admin/namespaces/import":
+		var req NamespaceImportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid import request", http.StatusBadRequest)
+			return
+		}
+		run = func(ctx context.Context) (any, error) {
+			return fb.ImportNamespace(r.WithContext(ctx), req)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	kind := JobNamespaceExport
+	if strings.HasSuffix(r.URL.Path, "/import") {
+		kind = JobNamespaceImport
+	}
+	result, err := fb.runJob(r.Context(), kind, run)
+	if err != nil {
+		status := http.StatusBadRequest
+		if fb.s3Client == nil {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// runNamespace implements `filebox namespace export|import [flags] s3://bucket/prefix`
+//
+// The node named by --server reads or writes the bundle with its own S3
+// credentials, so exporting from staging and importing into production only
+// needs both clusters to reach the bucket.
+func runNamespace(args []string) int {
+	usage := "Usage: filebox namespace export [--server HOST:PORT] [--tenant T] s3://bucket/prefix\n" +
+		"       filebox namespace import [--server HOST:PORT] [--tenant T] [--key-prefix P] [--skip-policy] s3://bucket/prefix"
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	command := args[0]
+
+	flags := flag.NewFlagSet("namespace "+command, flag.ExitOnError)
+	server := flags.String("server", "localhost:"+getEnvOrDefault("PORT", "8080"), "FileBox node to run on")
+	tenant := flags.String("tenant", "", "Tenant to export, or to import into (default: the bundle's)")
+	keyPrefix := flags.String("key-prefix", "", "Prefix added to every imported named key")
+	skipPolicy := flags.Bool("skip-policy", false, "Keep the target tenant's policy on import")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args[1:])
+
+	rest, ok := strings.CutPrefix(flags.Arg(0), "s3://")
+	if flags.NArg() != 1 || !ok {
+		flags.Usage()
+		return 2
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+
+	var body []byte
+	if command == "export" {
+		body, _ = json.Marshal(NamespaceExportRequest{Tenant: *tenant, Bucket: bucket, Prefix: prefix})
+	} else {
+		req := NamespaceImportRequest{Bucket: bucket, Prefix: prefix, KeyPrefix: *keyPrefix, SkipPolicy: *skipPolicy}
+		flags.Visit(func(f *flag.Flag) {
+			if f.Name == "tenant" {
+				req.Tenant = tenant
+			}
+		})
+		body, _ = json.Marshal(req)
+	}
+
+	resp, err := http.Post("http://"+*server+"/admin/namespaces/"+command, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "namespace %s: %v\n", command, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "namespace %s: %s\n", command, strings.TrimSpace(string(msg)))
+		return 1
+	}
+	var result NamespaceTransferResult
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	for _, e := range result.Errors {
+		fmt.Fprintf(os.Stderr, "namespace %s: %s\n", command, e)
+	}
+	verb := "Exported"
+	if command == "import" {
+		verb = "Imported"
+	}
+	fmt.Printf("%s %d blobs (%d bytes, %d keys) in %d containers, s3://%s/%s\n",
+		verb, result.Blobs, result.Bytes, result.Keys, result.Containers, result.Bucket, result.Prefix)
+	if len(result.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,641 @@
+// Causal ordering of replicated operations for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"filebox/pkg/containerformat"
+)
+
+// Records and metadata operations reach a replica by different routes, so a
+// delete can arrive before the commit it undoes, or an old update after a
+// newer one. The owner therefore numbers every operation on a container -
+// each replicated append, each metadata operation and the seal after its
+// upload - from one counter, and replicas apply them in that order: an
+// operation that arrives early is held back until those before it arrive.
+//
+// A gap that stays open for REPLICATION_GAP_TIMEOUT, or a seal showing bytes
+// the replica never received, is closed by catching up: the replica fetches
+// the owner's index and position, re-fetches the byte ranges that do not
+// verify and carries on from there.
+//
+// Numbers carry the owner's startup epoch in their high 32 bits, so numbers
+// handed out but not yet saved when a node crashed are never handed out
+// again. The first operation after a restart opens a gap instead, which the
+// replica closes by catching up.
+
+const (
+	opEpochFile       = "node/op-epoch"
+	gapCheckInterval  = 10 * time.Second
+	catchUpTimeout    = 5 * time.Minute
+	maxCatchUpReports = 32
+)
+
+// OpSequence - Where a container stands in its numbered operations. The
+// owner uses Base and Issued; replicas the rest.
+type OpSequence struct {
+	Base   uint64 `json:"base,omitempty"`   // First number issued for the container
+	Issued uint64 `json:"issued,omitempty"` // Last number issued
+
+	Applied    uint64       `json:"applied,omitempty"`     // Every operation up to this one has been applied
+	Ahead      []uint64     `json:"ahead,omitempty"`       // Appends received past a gap, ascending
+	Deferred   []metadataOp `json:"deferred,omitempty"`    // Metadata operations held back by a gap, ascending
+	SealedSize int64        `json:"sealed_size,omitempty"` // Size of the container when its owner uploaded it
+	GapSince   *time.Time   `json:"gap_since,omitempty"`   // When the replica fell out of order
+}
+
+// clone copies the sequence for a container snapshot
+func (s *OpSequence) clone() *OpSequence {
+	clone := *s
+	clone.Ahead = slices.Clone(s.Ahead)
+	clone.Deferred = slices.Clone(s.Deferred)
+	if s.GapSince != nil {
+		since := *s.GapSince
+		clone.GapSince = &since
+	}
+	return &clone
+}
+
+// ContainerSyncState - Response of GET /cluster/op-sequence/{fid}: an owned
+// container's index and the last operation number it reflects
+type ContainerSyncState struct {
+	FileID string     `json:"file_id"`
+	Tenant string     `json:"tenant,omitempty"`
+	Size   int64      `json:"size"`
+	Base   uint64     `json:"base"`
+	Issued uint64     `json:"issued"`
+	Blobs  []BlobInfo `json:"blobs"`
+
+	LegalHold bool `json:"legal_hold,omitempty"` // The container's own hold
+}
+
+// CatchUpReport - One catch-up of a replica copy with its owner
+type CatchUpReport struct {
+	FileID       string    `json:"file_id"`
+	Owner        string    `json:"owner,omitempty"`
+	At           time.Time `json:"at"`
+	From         uint64    `json:"from"` // Applied before the catch-up
+	To           uint64    `json:"to"`   // Applied after it
+	Ranges       int       `json:"ranges"`
+	FetchedBytes int64     `json:"fetched_bytes"`
+	Skipped      bool      `json:"skipped,omitempty"` // The owner is not a configured replica; held-back operations were applied past the gap
+	Error        string    `json:"error,omitempty"`
+}
+
+// ReplicationGap - A replica copy whose operations arrived out of order
+type ReplicationGap struct {
+	FileID     string    `json:"file_id"`
+	Applied    uint64    `json:"applied"`
+	Ahead      int       `json:"ahead"`    // Appends received past the gap
+	Deferred   int       `json:"deferred"` // Metadata operations held back
+	Size       int64     `json:"size"`
+	SealedSize int64     `json:"sealed_size,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// ReplicationGapsStatus - Response of GET /admin/replication-gaps
+type ReplicationGapsStatus struct {
+	GapTimeout string           `json:"gap_timeout"`
+	Gaps       []ReplicationGap `json:"gaps"`
+	CatchUps   []CatchUpReport  `json:"catch_ups"` // Most recent first
+}
+
+// catchUpState - Gap detection settings and recent catch-ups
+type catchUpState struct {
+	gapTimeout time.Duration // REPLICATION_GAP_TIMEOUT
+
+	mu      sync.Mutex
+	reports []CatchUpReport
+}
+
+// loadCatchUpState reads REPLICATION_GAP_TIMEOUT
+func loadCatchUpState() *catchUpState {
+	return &catchUpState{gapTimeout: getEnvDuration("REPLICATION_GAP_TIMEOUT", 30*time.Second)}
+}
+
+// record keeps a catch-up for /admin/replication-gaps
+func (s *catchUpState) record(report CatchUpReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reports = append([]CatchUpReport{report}, s.reports...)
+	if len(s.reports) > maxCatchUpReports {
+		s.reports = s.reports[:maxCatchUpReports]
+	}
+}
+
+// loadOpEpoch picks this startup's epoch: the current Unix time, or one
+// past the last epoch if the clock has not moved on since
+func loadOpEpoch(storageDir string) uint64 {
+	path := filepath.Join(storageDir, opEpochFile)
+	epoch := uint64(timeNow().Unix())
+	if data, err := os.ReadFile(path); err == nil {
+		if last, err := strconv.ParseUint(string(data), 10, 64); err == nil {
+			epoch = max(epoch, last+1)
+		}
+	}
+
+	tmp := path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("Error saving operation epoch: %v", err)
+	} else if err := os.WriteFile(tmp, []byte(strconv.FormatUint(epoch, 10)), 0644); err != nil {
+		log.Printf("Error saving operation epoch: %v", err)
+	} else if err := os.Rename(tmp, path); err != nil {
+		log.Printf("Error saving operation epoch: %v", err)
+	}
+	return epoch
+}
+
+// issueOpSeq numbers the next replicated operation on an owned container,
+// returning it and the container's first number, or zeros without
+// replicas. Callers must hold fb.fileLock for reading and the container's lock.
+func (fb *FileBox) issueOpSeq(containerFile *ContainerFile) (uint64, uint64) {
+	if fb.metaOps == nil {
+		return 0, 0
+	}
+	seq := containerFile.OpSequence
+	if seq == nil {
+		seq = &OpSequence{}
+		containerFile.OpSequence = seq
+	}
+	if seq.Issued>>32 < fb.metaOps.epoch {
+		seq.Issued = fb.metaOps.epoch << 32
+	}
+	seq.Issued++
+	if seq.Base == 0 {
+		seq.Base = seq.Issued
+	}
+	return seq.Issued, seq.Base
+}
+
+// nextOpSeq is issueOpSeq for callers holding no locks
+func (fb *FileBox) nextOpSeq(containerFile *ContainerFile) (uint64, uint64) {
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+	mu := fb.files.lock(containerFile)
+	mu.Lock()
+	defer mu.Unlock()
+	return fb.issueOpSeq(containerFile)
+}
+
+// logContainerSeal tells the replicas how large an uploaded container is,
+// so one that missed its last records notices
+func (fb *FileBox) logContainerSeal(containerFile *ContainerFile) {
+	if fb.metaOps == nil || fb.isForeign(containerFile) {
+		return
+	}
+	replicas := fb.replicasFor(containerFile)
+	if len(replicas) == 0 {
+		return
+	}
+
+	fb.fileLock.RLock()
+	mu := fb.files.lock(containerFile)
+	mu.Lock()
+	size := containerFile.Size
+	seq, base := fb.issueOpSeq(containerFile)
+	mu.Unlock()
+	fb.fileLock.RUnlock()
+
+	fb.metaOps.append(metadataOp{
+		Kind:         MetaOpSeal,
+		FileID:       containerFile.FID.String(),
+		Index:        -1,
+		Size:         size,
+		ContainerSeq: seq,
+		SeqBase:      base,
+		Replicas:     replicas,
+		At:           timeNow().UTC(),
+	})
+}
+
+// replicaSequence returns a replica copy's sequence, starting it just before
+// base if the copy has none. It returns nil for unnumbered operations on a
+// copy that has never seen a numbered one. Callers must hold fb.fileLock exclusively.
+func replicaSequence(containerFile *ContainerFile, base uint64) *OpSequence {
+	if containerFile.OpSequence == nil {
+		if base == 0 {
+			return nil
+		}
+		containerFile.OpSequence = &OpSequence{Base: base, Applied: base - 1}
+	}
+	return containerFile.OpSequence
+}
+
+// sequenceAppend records a replicated append by its number. Callers must
+// hold fb.fileLock exclusively.
+func (fb *FileBox) sequenceAppend(containerFile *ContainerFile, seq, base uint64) {
+	s := replicaSequence(containerFile, base)
+	if s == nil {
+		return
+	}
+	if seq > s.Applied+1 {
+		if i, found := slices.BinarySearch(s.Ahead, seq); !found {
+			s.Ahead = slices.Insert(s.Ahead, i, seq)
+		}
+	} else if seq == s.Applied+1 {
+		s.Applied = seq
+	}
+	fb.advanceSequence(containerFile)
+}
+
+// sequenceMetaOp applies a numbered metadata operation if every operation
+// before it has been, or holds it back. It reports whether the operation
+// was applied, held back, or already seen. Callers must hold fb.fileLock exclusively.
+func (fb *FileBox) sequenceMetaOp(containerFile *ContainerFile, op metadataOp) (applied, deferred bool) {
+	s := replicaSequence(containerFile, op.SeqBase)
+	switch {
+	case s == nil:
+		fb.applyMetaOp(containerFile, op)
+		return true, false
+	case op.ContainerSeq <= s.Applied || slices.Contains(s.Ahead, op.ContainerSeq):
+		return false, false
+	case op.ContainerSeq == s.Applied+1:
+		fb.applyMetaOp(containerFile, op)
+		s.Applied = op.ContainerSeq
+		fb.advanceSequence(containerFile)
+		return true, false
+	}
+
+	i, found := slices.BinarySearchFunc(s.Deferred, op.ContainerSeq, func(held metadataOp, seq uint64) int {
+		return compareUint64(held.ContainerSeq, seq)
+	})
+	if found {
+		return false, false
+	}
+	s.Deferred = slices.Insert(s.Deferred, i, op)
+	fb.advanceSequence(containerFile)
+	return false, true
+}
+
+// compareUint64 orders two operation numbers
+func compareUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// applyMetaOp applies one metadata operation to a replica copy. Callers
+// must hold fb.fileLock exclusively.
+func (fb *FileBox) applyMetaOp(containerFile *ContainerFile, op metadataOp) {
+	if op.Kind == MetaOpSeal {
+		if s := replicaSequence(containerFile, op.SeqBase); s != nil {
+			s.SealedSize = max(s.SealedSize, op.Size)
+		}
+		return
+	}
+	if op.Kind == MetaOpContainerHold {
+		containerFile.LegalHold = op.LegalHold
+		return
+	}
+	fb.setReplicaEntry(containerFile, op.Index, op.Blob)
+}
+
+// advanceSequence applies the appends and held-back operations that follow
+// on from the applied position, then opens or closes the copy's gap.
+// Callers must hold fb.fileLock exclusively.
+func (fb *FileBox) advanceSequence(containerFile *ContainerFile) {
+	s := containerFile.OpSequence
+	for {
+		next := s.Applied + 1
+		if len(s.Ahead) > 0 && s.Ahead[0] == next {
+			s.Ahead = s.Ahead[1:]
+		} else if len(s.Deferred) > 0 && s.Deferred[0].ContainerSeq == next {
+			op := s.Deferred[0]
+			s.Deferred = s.Deferred[1:]
+			fb.applyMetaOp(containerFile, op)
+		} else {
+			break
+		}
+		s.Applied = next
+	}
+
+	if len(s.Ahead) > 0 || len(s.Deferred) > 0 || s.SealedSize > containerFile.Size {
+		if s.GapSince == nil {
+			since := timeNow().UTC()
+			s.GapSince = &since
+		}
+	} else {
+		s.GapSince = nil
+	}
+}
+
+// skipGap gives up on the operations a copy is missing and applies what it
+// holds back in order. Callers must hold fb.fileLock exclusively.
+func (fb *FileBox) skipGap(containerFile *ContainerFile) {
+	s := containerFile.OpSequence
+	for len(s.Ahead) > 0 || len(s.Deferred) > 0 {
+		next := uint64(0)
+		if len(s.Ahead) > 0 {
+			next = s.Ahead[0]
+		}
+		if len(s.Deferred) > 0 && (next == 0 || s.Deferred[0].ContainerSeq < next) {
+			next = s.Deferred[0].ContainerSeq
+		}
+		s.Applied = next - 1
+		fb.advanceSequence(containerFile)
+	}
+	s.SealedSize = min(s.SealedSize, containerFile.Size)
+	s.GapSince = nil
+}
+
+// runGapChecks catches up replica copies whose gaps outlast REPLICATION_GAP_TIMEOUT
+func (fb *FileBox) runGapChecks() {
+	ticker := time.NewTicker(gapCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fb.checkGaps()
+	}
+}
+
+// checkGaps catches up every copy whose gap has been open too long, one at a time
+func (fb *FileBox) checkGaps() {
+	cutoff := timeNow().Add(-fb.catchUp.gapTimeout)
+	var stale []*ContainerFile
+	for _, gap := range fb.replicationGaps() {
+		if gap.Since.Before(cutoff) {
+			fb.fileLock.RLock()
+			containerFile, exists := fb.files.get(gap.FileID)
+			conflicted := exists && containerFile.Conflict != nil
+			fb.fileLock.RUnlock()
+			if exists && !conflicted { // Which writer to catch up with is for an operator to decide
+				stale = append(stale, containerFile)
+			}
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	owners := fb.replicaOwners(context.Background())
+	for _, containerFile := range stale {
+		report := fb.catchUpContainer(containerFile, owners)
+		fb.catchUp.record(report)
+		if report.Error != "" {
+			log.Printf("Error catching up container %s: %s", report.FileID, report.Error)
+		}
+	}
+}
+
+// replicationGaps lists the replica copies with an open gap
+func (fb *FileBox) replicationGaps() []ReplicationGap {
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+
+	gaps := make([]ReplicationGap, 0)
+	for _, containerFile := range fb.files.all() {
+		if !fb.isForeign(containerFile) {
+			continue
+		}
+		mu := fb.files.lock(containerFile)
+		mu.RLock()
+		if s := containerFile.OpSequence; s != nil && s.GapSince != nil {
+			gaps = append(gaps, ReplicationGap{
+				FileID:     containerFile.FID.String(),
+				Applied:    s.Applied,
+				Ahead:      len(s.Ahead),
+				Deferred:   len(s.Deferred),
+				Size:       containerFile.Size,
+				SealedSize: s.SealedSize,
+				Since:      *s.GapSince,
+			})
+		}
+		mu.RUnlock()
+	}
+	return gaps
+}
+
+// replicaOwners maps the machine IDs of the configured replicas to their addresses
+func (fb *FileBox) replicaOwners(ctx context.Context) map[uint32]string {
+	owners := make(map[uint32]string)
+	for _, replica := range fb.replicas {
+		var identity NodeIdentity
+		if err := fb.getPeerJSON(ctx, replica, "/cluster/identity", &identity); err != nil {
+			log.Printf("Cannot identify replica %s: %v", replica, err)
+			continue
+		}
+		owners[identity.MachineID] = replica
+	}
+	return owners
+}
+
+// catchUpContainer brings a replica copy level with its owner: missing or
+// corrupt records are fetched again, the index is replaced by the owner's
+// and the copy resumes after the owner's last operation number
+func (fb *FileBox) catchUpContainer(containerFile *ContainerFile, owners map[uint32]string) CatchUpReport {
+	fileID := containerFile.FID.String()
+	report := CatchUpReport{FileID: fileID, At: timeNow().UTC()}
+
+	fb.fileLock.RLock()
+	mu := fb.files.lock(containerFile)
+	mu.RLock()
+	if containerFile.OpSequence != nil {
+		report.From = containerFile.OpSequence.Applied
+	}
+	mu.RUnlock()
+	fb.fileLock.RUnlock()
+
+	owner, ok := owners[containerFile.FID.MachineID]
+	if !ok {
+		// Nowhere to catch up from; better the operations held than none
+		fb.fileLock.Lock()
+		fb.skipGap(containerFile)
+		report.To, report.Skipped = containerFile.OpSequence.Applied, true
+		fb.fileLock.Unlock()
+		fb.saveManifest(containerFile)
+		log.Printf("Owner of container %s (machine %d) is not a configured replica; skipped its replication gap",
+			fileID, containerFile.FID.MachineID)
+		return report
+	}
+	report.Owner = owner
+
+	ctx, cancel := context.WithTimeout(context.Background(), catchUpTimeout)
+	defer cancel()
+
+	var state ContainerSyncState
+	if err := fb.getPeerJSON(ctx, owner, "/cluster/op-sequence/"+fileID, &state); err != nil {
+		report.Error = fmt.Sprintf("error fetching owner state: %v", err)
+		return report
+	}
+	if err := fb.checkReplicaTenant(state.Tenant); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	ranges, err := fb.missingRanges(containerFile, state)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	for _, r := range ranges {
+		if err := fb.fetchContainerRange(ctx, owner, containerFile, r); err != nil {
+			report.Error = fmt.Sprintf("error fetching bytes %d-%d: %v", r.Offset, r.Offset+r.Length, err)
+			return report
+		}
+		report.Ranges++
+		report.FetchedBytes += r.Length
+	}
+
+	fb.fileLock.Lock()
+	containerFile.Size = max(containerFile.Size, state.Size)
+	containerFile.LegalHold = state.LegalHold
+	for len(containerFile.Blobs) < len(state.Blobs) {
+		containerFile.Blobs = append(containerFile.Blobs, BlobInfo{ID: formatBlobID(fileID, len(containerFile.Blobs)), Uncommitted: true})
+	}
+	for i, blob := range state.Blobs {
+		if !blob.Uncommitted {
+			fb.setReplicaEntry(containerFile, i, blob)
+		}
+	}
+	s := replicaSequence(containerFile, state.Base)
+	if s == nil {
+		s = &OpSequence{}
+		containerFile.OpSequence = s
+	}
+	s.Applied = max(s.Applied, state.Issued)
+	s.Ahead = slices.DeleteFunc(s.Ahead, func(seq uint64) bool { return seq <= s.Applied })
+	s.Deferred = slices.DeleteFunc(s.Deferred, func(op metadataOp) bool { return op.ContainerSeq <= s.Applied })
+	s.GapSince = nil
+	fb.advanceSequence(containerFile)
+	report.To = s.Applied
+	fb.fileLock.Unlock()
+
+	fb.saveManifest(containerFile)
+	log.Printf("Caught up container %s with %s: operations %d to %d, %d bytes fetched",
+		fileID, owner, report.From, report.To, report.FetchedBytes)
+	return report
+}
+
+// missingRanges lists the record ranges of the owner's index that do not
+// verify in the local copy, and the bytes the copy is short of
+func (fb *FileBox) missingRanges(containerFile *ContainerFile, state ContainerSyncState) ([]hintRange, error) {
+	file, err := os.OpenFile(fb.filePathOf(containerFile), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges []hintRange
+	for _, blob := range state.Blobs {
+		if blob.Uncommitted || len(blob.Segments) > 0 || blob.Offset+blob.Length > stat.Size() {
+			continue // Nothing to verify, or within the tail fetched below
+		}
+		data := make([]byte, blob.Length)
+		if _, err := file.ReadAt(data, blob.Offset); err == nil && verifyBlob(blob, data) {
+			continue
+		}
+		start := blob.Offset - containerformat.HeaderSize
+		ranges = append(ranges, hintRange{Offset: start, Length: blob.Offset + blob.Length - start})
+	}
+	if state.Size > stat.Size() {
+		ranges = append(ranges, hintRange{Offset: stat.Size(), Length: state.Size - stat.Size()})
+	}
+	return ranges, nil
+}
+
+// fetchContainerRange copies a byte range of the owner's container into the local copy
+func (fb *FileBox) fetchContainerRange(ctx context.Context, owner string, containerFile *ContainerFile, r hintRange) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/container/%s", owner, containerFile.FID.String()), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.Offset, r.Offset+r.Length-1))
+	resp, err := fb.replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, r.Length))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != r.Length {
+		return fmt.Errorf("short range: %d of %d bytes", len(data), r.Length)
+	}
+
+	file, err := os.OpenFile(fb.filePathOf(containerFile), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteAt(data, r.Offset)
+	return err
+}
+
+// handleClusterOpSequence serves GET /cluster/op-sequence/{fid} to replicas catching up
+func (fb *FileBox) handleClusterOpSequence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileID := r.URL.Path[len("/cluster/op-sequence/"):]
+	fb.fileLock.RLock()
+	containerFile, exists := fb.files.get(fileID)
+	if !exists || fb.isForeign(containerFile) {
+		fb.fileLock.RUnlock()
+		http.Error(w, "Container file not found", http.StatusNotFound)
+		return
+	}
+	mu := fb.files.lock(containerFile)
+	mu.RLock()
+	state := ContainerSyncState{
+		FileID: fileID,
+		Tenant: containerFile.Tenant,
+		Size:   containerFile.Size,
+		Blobs:  append([]BlobInfo(nil), containerFile.Blobs...),
+
+		LegalHold: containerFile.LegalHold,
+	}
+	if s := containerFile.OpSequence; s != nil {
+		state.Base, state.Issued = s.Base, s.Issued
+	}
+	mu.RUnlock()
+	fb.fileLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// handleReplicationGaps serves GET /admin/replication-gaps
+func (fb *FileBox) handleReplicationGaps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := ReplicationGapsStatus{
+		GapTimeout: fb.catchUp.gapTimeout.String(),
+		Gaps:       fb.replicationGaps(),
+	}
+	fb.catchUp.mu.Lock()
+	status.CatchUps = append([]CatchUpReport{}, fb.catchUp.reports...)
+	fb.catchUp.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,335 @@
+// Pebble (embedded LSM KV) metadata backend for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Key layout (all keys are ordered, so a container's blobs form one contiguous range):
+//
+//	c/<fid>                 container metadata (JSON, without blobs)
+//	b/<fid>/<index:8 bytes> blob index entry (JSON)
+//	r/<fid>/<replica>       replicated bytes (8-byte big-endian)
+const (
+	pebbleContainerPrefix   = "c/"
+	pebbleBlobPrefix        = "b/"
+	pebbleReplicationPrefix = "r/"
+)
+
+// pebbleWrite - A save waiting to be committed by the group-commit loop
+type pebbleWrite struct {
+	apply func(batch *pebble.Batch) error
+	done  chan error
+}
+
+// pebbleStore - LSM-backed store for nodes with hundreds of thousands of blob index entries
+//
+// Concurrent saves are coalesced into a single synced batch, and only blob
+// entries past the last persisted index are written; blob entries are append-only.
+type pebbleStore struct {
+	db     *pebble.DB
+	writes chan pebbleWrite
+
+	mu        sync.Mutex
+	persisted map[string]int // Blob entries already written per container
+}
+
+func newPebbleStore(dir string) (*pebbleStore, error) {
+	db, err := pebble.Open(dir, &pebble.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &pebbleStore{
+		db:        db,
+		writes:    make(chan pebbleWrite, 1024),
+		persisted: make(map[string]int),
+	}
+	go s.commitLoop()
+	return s, nil
+}
+
+// commitLoop drains every queued write into one batch and commits it with a single sync
+func (s *pebbleStore) commitLoop() {
+	for first := range s.writes {
+		pending := []pebbleWrite{first}
+	drain:
+		for {
+			select {
+			case w, ok := <-s.writes:
+				if !ok {
+					break drain
+				}
+				pending = append(pending, w)
+			default:
+				break drain
+			}
+		}
+
+		batch := s.db.NewIndexedBatch()
+		errs := make([]error, len(pending))
+		for i, w := range pending {
+			errs[i] = w.apply(batch)
+		}
+		commitErr := batch.Commit(pebble.Sync)
+		batch.Close()
+
+		for i, w := range pending {
+			if errs[i] == nil {
+				errs[i] = commitErr
+			}
+			w.done <- errs[i]
+		}
+	}
+}
+
+// write queues a batch mutation and waits for it to be committed
+func (s *pebbleStore) write(apply func(batch *pebble.Batch) error) error {
+	done := make(chan error, 1)
+	s.writes <- pebbleWrite{apply: apply, done: done}
+	return <-done
+}
+
+func pebbleBlobKey(fileID string, index int) []byte {
+	key := make([]byte, 0, len(pebbleBlobPrefix)+len(fileID)+1+8)
+	key = append(key, pebbleBlobPrefix+fileID+"/"...)
+	return binary.BigEndian.AppendUint64(key, uint64(index))
+}
+
+// prefixUpperBound returns the smallest key greater than every key with the prefix
+func prefixUpperBound(prefix string) []byte {
+	end := []byte(prefix)
+	end[len(end)-1]++
+	return end
+}
+
+func (s *pebbleStore) SaveContainer(containerFile *ContainerFile) error {
+	fileID := containerFile.FID.String()
+
+	header := *containerFile
+	header.Blobs = nil
+	headerData, err := json.Marshal(&header)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	from := s.persisted[fileID]
+	s.mu.Unlock()
+	if from > len(containerFile.Blobs) {
+		from = 0 // Index shrank (e.g. a repair); rewrite it
+	}
+
+	blobData := make([][]byte, 0, len(containerFile.Blobs)-from)
+	for _, blob := range containerFile.Blobs[from:] {
+		data, err := json.Marshal(&blob)
+		if err != nil {
+			return err
+		}
+		blobData = append(blobData, data)
+	}
+
+	err = s.write(func(batch *pebble.Batch) error {
+		if err := batch.Set([]byte(pebbleContainerPrefix+fileID), headerData, nil); err != nil {
+			return err
+		}
+		for i, data := range blobData {
+			if err := batch.Set(pebbleBlobKey(fileID, from+i), data, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.persisted[fileID] = settledBlobs(containerFile, from)
+	s.mu.Unlock()
+	return nil
+}
+
+// settledBlobs returns how many index entries, from the start, later saves
+// need not write again. Uncommitted entries are written again with the save
+// that commits them.
+func settledBlobs(containerFile *ContainerFile, from int) int {
+	for i := from; i < len(containerFile.Blobs); i++ {
+		if containerFile.Blobs[i].Uncommitted {
+			return i
+		}
+	}
+	return len(containerFile.Blobs)
+}
+
+func (s *pebbleStore) LoadContainer(fileID string) (*ContainerFile, error) {
+	headerData, closer, err := s.db.Get([]byte(pebbleContainerPrefix + fileID))
+	if err == pebble.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var containerFile ContainerFile
+	err = json.Unmarshal(headerData, &containerFile)
+	closer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Range scan over the container's blob entries, in index order
+	prefix := pebbleBlobPrefix + fileID + "/"
+	iter, err := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(prefix),
+		UpperBound: prefixUpperBound(prefix),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	containerFile.Blobs = make([]BlobInfo, 0)
+	for iter.First(); iter.Valid(); iter.Next() {
+		var blob BlobInfo
+		if err := json.Unmarshal(iter.Value(), &blob); err != nil {
+			return nil, fmt.Errorf("blob entry %q: %v", iter.Key(), err)
+		}
+		containerFile.Blobs = append(containerFile.Blobs, blob)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	// Replica progress is written separately and may be ahead of the header
+	replicaPrefix := pebbleReplicationPrefix + fileID + "/"
+	replicaIter, err := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(replicaPrefix),
+		UpperBound: prefixUpperBound(replicaPrefix),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer replicaIter.Close()
+
+	for replicaIter.First(); replicaIter.Valid(); replicaIter.Next() {
+		if containerFile.Replicated == nil {
+			containerFile.Replicated = make(map[string]int64)
+		}
+		replica := strings.TrimPrefix(string(replicaIter.Key()), replicaPrefix)
+		if size := int64(binary.BigEndian.Uint64(replicaIter.Value())); size > containerFile.Replicated[replica] {
+			containerFile.Replicated[replica] = size
+		}
+	}
+	if err := replicaIter.Error(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.persisted[fileID] = settledBlobs(&containerFile, 0)
+	s.mu.Unlock()
+
+	return &containerFile, nil
+}
+
+func (s *pebbleStore) ListContainers() ([]string, error) {
+	iter, err := s.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(pebbleContainerPrefix),
+		UpperBound: prefixUpperBound(pebbleContainerPrefix),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var fileIDs []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		fileIDs = append(fileIDs, strings.TrimPrefix(string(iter.Key()), pebbleContainerPrefix))
+	}
+	return fileIDs, iter.Error()
+}
+
+// UpdateBlobs rewrites blob entries in place; SaveContainer only appends new ones
+func (s *pebbleStore) UpdateBlobs(containerFile *ContainerFile, indexes ...int) error {
+	fileID := containerFile.FID.String()
+	blobData := make([][]byte, len(indexes))
+	for i, index := range indexes {
+		data, err := json.Marshal(&containerFile.Blobs[index])
+		if err != nil {
+			return err
+		}
+		blobData[i] = data
+	}
+	return s.write(func(batch *pebble.Batch) error {
+		for i, index := range indexes {
+			if err := batch.Set(pebbleBlobKey(fileID, index), blobData[i], nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *pebbleStore) RecordReplication(fileID, replica string, size int64) error {
+	key := []byte(pebbleReplicationPrefix + fileID + "/" + replica)
+	return s.write(func(batch *pebble.Batch) error {
+		// Replica progress only moves forward; the indexed batch also sees earlier writes in it
+		if current, closer, err := batch.Get(key); err == nil {
+			stored := int64(binary.BigEndian.Uint64(current))
+			closer.Close()
+			if stored >= size {
+				return nil
+			}
+		}
+		return batch.Set(key, binary.BigEndian.AppendUint64(nil, uint64(size)), nil)
+	})
+}
+
+func (s *pebbleStore) DeleteContainer(fileID string) error {
+	err := s.write(func(batch *pebble.Batch) error {
+		for _, prefix := range []string{pebbleBlobPrefix + fileID + "/", pebbleReplicationPrefix + fileID + "/"} {
+			if err := batch.DeleteRange([]byte(prefix), prefixUpperBound(prefix), nil); err != nil {
+				return err
+			}
+		}
+		return batch.Delete([]byte(pebbleContainerPrefix+fileID), nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.persisted, fileID)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *pebbleStore) Durable() bool {
+	return true
+}
+
+// Compact flushes the memtable to an sstable so the write-ahead log behind it can be recycled
+func (s *pebbleStore) Compact() (int64, error) {
+	before := s.db.Metrics().WAL.Size
+	if err := s.db.Flush(); err != nil {
+		return 0, err
+	}
+	after := s.db.Metrics().WAL.Size
+	if after >= before {
+		return 0, nil
+	}
+	return int64(before - after), nil
+}
+
+func (s *pebbleStore) Close() error {
+	close(s.writes)
+	return s.db.Close()
+}
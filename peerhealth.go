@@ -0,0 +1,515 @@
+// Peer health checking and circuit breaking for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed = "closed" // Records are sent to the peer
+	BreakerOpen   = "open"   // Records are hinted until a probe reaches the peer
+)
+
+const (
+	hintsFile       = "node/hints.json"
+	hintLogFile     = "node/hints.log" // Hints added since hints.json was last written, one per line
+	hintReplayChunk = 8 << 20          // Largest range read and sent at once when replaying hints
+	latencyWeight   = 0.2              // Weight of the newest sample in the moving latency average
+)
+
+// errCircuitOpen is the replication result for records hinted instead of sent
+var errCircuitOpen = errors.New("circuit breaker open; record hinted for later")
+
+// BreakerConfig - When a failing replica stops receiving records
+type BreakerConfig struct {
+	Failures      int           // Consecutive failures that trip the breaker
+	ErrorRate     float64       // Failure ratio over the window that trips it
+	Window        int           // Recent results the error rate is computed over
+	ProbeInterval time.Duration // How often open peers are probed and hints replayed
+	MaxHintBytes  int64         // Hinted bytes kept per peer; beyond it the replica needs a repair
+}
+
+// loadBreakerConfig reads PEER_BREAKER_FAILURES, PEER_BREAKER_ERROR_RATE,
+// PEER_BREAKER_WINDOW, PEER_PROBE_INTERVAL and PEER_MAX_HINT_BYTES
+func loadBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		Failures:      int(max(getEnvInt("PEER_BREAKER_FAILURES", 5), 1)),
+		ErrorRate:     getEnvFloat("PEER_BREAKER_ERROR_RATE", 0.5),
+		Window:        int(max(getEnvInt("PEER_BREAKER_WINDOW", 20), 1)),
+		ProbeInterval: getEnvDuration("PEER_PROBE_INTERVAL", 10*time.Second),
+		MaxHintBytes:  getEnvInt("PEER_MAX_HINT_BYTES", 1<<30),
+	}
+}
+
+// hintRange - Bytes of a container a replica missed
+type hintRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// PeerHealth - Replication health of one replica, as shown by /admin/peers
+type PeerHealth struct {
+	State               string     `json:"state"`
+	Requests            int64      `json:"requests"` // Replication results since startup
+	Failures            int64      `json:"failures"`
+	ErrorRate           float64    `json:"error_rate"` // Over the last PEER_BREAKER_WINDOW results
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LatencyMS           float64    `json:"latency_ms"` // Moving average of successful sends
+	LastError           string     `json:"last_error,omitempty"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	LastProbe           *time.Time `json:"last_probe,omitempty"`
+	HintedContainers    int        `json:"hinted_containers"`
+	HintedBytes         int64      `json:"hinted_bytes"`
+	DroppedHintBytes    int64      `json:"dropped_hint_bytes"` // Over PEER_MAX_HINT_BYTES; repair the replica
+}
+
+// peerHealth - Breaker state and hints for one replica
+type peerHealth struct {
+	PeerHealth
+	results   []bool // Recent results, true for failures, used as a ring
+	next      int
+	hints     map[string][]hintRange // File ID -> missed ranges, sorted and merged
+	replaying bool
+}
+
+// hintLogEntry - One hint appended to node/hints.log
+type hintLogEntry struct {
+	Peer   string `json:"peer"`
+	FileID string `json:"file_id"`
+	hintRange
+}
+
+// peerHealthState - Health of every replica, guarded by mu. logMu orders
+// appends to the hint log against saves that replace it, and is taken
+// before mu.
+type peerHealthState struct {
+	config  BreakerConfig
+	path    string
+	logPath string
+
+	logMu sync.Mutex
+	mu    sync.Mutex
+	peers map[string]*peerHealth
+	dirty bool // Hints changed since they were last saved
+}
+
+// loadPeerHealth sets up health tracking and reloads hints saved before a restart
+func loadPeerHealth(storageDir string, replicas []string) *peerHealthState {
+	s := &peerHealthState{
+		config:  loadBreakerConfig(),
+		path:    filepath.Join(storageDir, hintsFile),
+		logPath: filepath.Join(storageDir, hintLogFile),
+		peers:   make(map[string]*peerHealth, len(replicas)),
+	}
+	for _, replica := range replicas {
+		s.peers[replica] = &peerHealth{PeerHealth: PeerHealth{State: BreakerClosed}, hints: make(map[string][]hintRange)}
+	}
+
+	data, err := os.ReadFile(s.path)
+	switch {
+	case err == nil:
+		var saved map[string]map[string][]hintRange
+		if err := json.Unmarshal(data, &saved); err != nil {
+			log.Printf("Error parsing replication hints: %v", err)
+			break
+		}
+		for replica, hints := range saved {
+			peer, ok := s.peers[replica]
+			if !ok {
+				continue // No longer a replica
+			}
+			for fileID, ranges := range hints {
+				for _, r := range ranges {
+					peer.addHint(fileID, r, s.config.MaxHintBytes)
+				}
+			}
+		}
+	case !os.IsNotExist(err):
+		log.Printf("Error reading replication hints: %v", err)
+	}
+	s.loadHintLog()
+
+	for replica, peer := range s.peers {
+		if peer.HintedBytes > 0 {
+			log.Printf("Loaded %d hinted bytes for replica %s", peer.HintedBytes, replica)
+		}
+	}
+	return s
+}
+
+// loadHintLog adds the hints appended after hints.json was last written.
+// A line torn by a crash is skipped; its record was never acknowledged.
+func (s *peerHealthState) loadHintLog() {
+	file, err := os.Open(s.logPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading replication hint log: %v", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry hintLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if peer, ok := s.peers[entry.Peer]; ok {
+			peer.addHint(entry.FileID, entry.hintRange, s.config.MaxHintBytes)
+			s.dirty = true // Fold the log into hints.json at the next save
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading replication hint log: %v", err)
+	}
+}
+
+// allow reports whether records may be sent to a peer
+func (s *peerHealthState) allow(peer string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	health, ok := s.peers[peer]
+	return !ok || health.State != BreakerOpen
+}
+
+// record counts a replication result and trips the breaker when the peer
+// fails too often
+func (s *peerHealthState) record(peer string, err error, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	health, ok := s.peers[peer]
+	if !ok {
+		return
+	}
+
+	failed := err != nil
+	health.Requests++
+	if len(health.results) < s.config.Window {
+		health.results = append(health.results, failed)
+	} else {
+		health.results[health.next] = failed
+		health.next = (health.next + 1) % s.config.Window
+	}
+	failures := 0
+	for _, result := range health.results {
+		if result {
+			failures++
+		}
+	}
+	health.ErrorRate = float64(failures) / float64(len(health.results))
+
+	if !failed {
+		health.ConsecutiveFailures = 0
+		ms := float64(latency) / float64(time.Millisecond)
+		if health.LatencyMS == 0 {
+			health.LatencyMS = ms
+		} else {
+			health.LatencyMS += latencyWeight * (ms - health.LatencyMS)
+		}
+		return
+	}
+
+	health.Failures++
+	health.ConsecutiveFailures++
+	health.LastError = err.Error()
+	tripped := health.ConsecutiveFailures >= s.config.Failures ||
+		(len(health.results) >= s.config.Window && health.ErrorRate >= s.config.ErrorRate)
+	if health.State == BreakerClosed && tripped {
+		now := timeNow().UTC()
+		health.State, health.OpenedAt = BreakerOpen, &now
+		log.Printf("Circuit breaker for replica %s opened (%d consecutive failures, %.0f%% errors): %v",
+			peer, health.ConsecutiveFailures, health.ErrorRate*100, err)
+	}
+}
+
+// hint remembers a record a peer did not get. The hint is appended to
+// node/hints.log straight away: the writer has its answer, and a crash
+// before the next save would leave the peer without the record for good.
+// Rewriting every hint here would make each one cost as much as all of
+// them; the log is folded into hints.json by the next save instead.
+func (s *peerHealthState) hint(peer, fileID string, offset, length int64) {
+	entry := hintLogEntry{Peer: peer, FileID: fileID, hintRange: hintRange{Offset: offset, Length: length}}
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.mu.Lock()
+	health, ok := s.peers[peer]
+	if ok {
+		health.addHint(fileID, entry.hintRange, s.config.MaxHintBytes)
+		s.dirty = true
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding replication hint: %v", err)
+		return
+	}
+	os.MkdirAll(filepath.Dir(s.logPath), 0755)
+	file, err := os.OpenFile(s.logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Error saving replication hint: %v", err)
+		return
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error saving replication hint: %v", err)
+	}
+	file.Close()
+}
+
+// addHint merges a range into a container's hints, dropping it when the
+// peer already has too many hinted bytes
+func (h *peerHealth) addHint(fileID string, r hintRange, maxBytes int64) {
+	if maxBytes > 0 && h.HintedBytes+r.Length > maxBytes {
+		h.DroppedHintBytes += r.Length
+		return
+	}
+
+	ranges := append(h.hints[fileID], r)
+	slices.SortFunc(ranges, func(a, b hintRange) int { return cmp.Compare(a.Offset, b.Offset) })
+	merged := ranges[:1]
+	for _, next := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if next.Offset <= last.Offset+last.Length {
+			last.Length = max(last.Length, next.Offset+next.Length-last.Offset)
+		} else {
+			merged = append(merged, next)
+		}
+	}
+	h.hints[fileID] = merged
+	h.recount()
+}
+
+// removeHint drops replayed bytes from a container's hints
+func (h *peerHealth) removeHint(fileID string, done hintRange) {
+	var left []hintRange
+	for _, r := range h.hints[fileID] {
+		end, doneEnd := r.Offset+r.Length, done.Offset+done.Length
+		if doneEnd <= r.Offset || done.Offset >= end {
+			left = append(left, r)
+			continue
+		}
+		if r.Offset < done.Offset {
+			left = append(left, hintRange{Offset: r.Offset, Length: done.Offset - r.Offset})
+		}
+		if doneEnd < end {
+			left = append(left, hintRange{Offset: doneEnd, Length: end - doneEnd})
+		}
+	}
+	if len(left) == 0 {
+		delete(h.hints, fileID)
+	} else {
+		h.hints[fileID] = left
+	}
+	h.recount()
+}
+
+// recount refreshes the hint totals
+func (h *peerHealth) recount() {
+	h.HintedContainers, h.HintedBytes = len(h.hints), 0
+	for _, ranges := range h.hints {
+		for _, r := range ranges {
+			h.HintedBytes += r.Length
+		}
+	}
+}
+
+// snapshot returns a peer's health for reporting
+func (s *peerHealthState) snapshot(peer string) PeerHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if health, ok := s.peers[peer]; ok {
+		return health.PeerHealth
+	}
+	return PeerHealth{State: BreakerClosed}
+}
+
+// save writes the hints if they changed since the last save, then empties
+// the hint log they now include
+func (s *peerHealthState) save() {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return
+	}
+	saved := make(map[string]map[string][]hintRange, len(s.peers))
+	for replica, health := range s.peers {
+		if len(health.hints) > 0 {
+			saved[replica] = health.hints
+		}
+	}
+	data, err := json.Marshal(saved)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("Error encoding replication hints: %v", err)
+		return
+	}
+
+	os.MkdirAll(filepath.Dir(s.path), 0755)
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Error saving replication hints: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		log.Printf("Error saving replication hints: %v", err)
+		return
+	}
+	if err := os.Remove(s.logPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error clearing replication hint log: %v", err)
+	}
+}
+
+// runPeerProbes probes replicas behind an open breaker, closes the breaker
+// once they answer, and replays hints to healthy replicas
+func (fb *FileBox) runPeerProbes() {
+	if len(fb.replicas) == 0 || fb.health.config.ProbeInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(fb.health.config.ProbeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fb.probePeers(func(peer string) { go fb.replayHints(peer) })
+	}
+}
+
+// probePeers probes each replica behind an open breaker and passes each
+// healthy replica with hints to replay
+func (fb *FileBox) probePeers(replay func(peer string)) {
+	for _, replica := range fb.replicas {
+		if !fb.health.allow(replica) {
+			fb.probePeer(replica)
+		}
+		fb.health.mu.Lock()
+		health := fb.health.peers[replica]
+		start := health.State == BreakerClosed && len(health.hints) > 0 && !health.replaying
+		if start {
+			health.replaying = true
+		}
+		fb.health.mu.Unlock()
+		if start {
+			replay(replica)
+		}
+	}
+	fb.health.save()
+}
+
+// probePeer checks an open peer with a handshake and closes its breaker if it answers
+func (fb *FileBox) probePeer(peer string) {
+	ctx, cancel := context.WithTimeout(context.Background(), helloTimeout)
+	defer cancel()
+	result := fb.hello(ctx, peer)
+
+	fb.health.mu.Lock()
+	defer fb.health.mu.Unlock()
+	health := fb.health.peers[peer]
+	now := timeNow().UTC()
+	health.LastProbe = &now
+	if result.Error != "" || result.Incompatible {
+		health.LastError = result.Error
+		return
+	}
+
+	health.State, health.OpenedAt = BreakerClosed, nil
+	health.ConsecutiveFailures, health.results, health.next = 0, nil, 0
+	log.Printf("Circuit breaker for replica %s closed; %d hinted bytes to replay", peer, health.HintedBytes)
+	fb.forgetPeerProtocol(peer) // Renegotiate; the peer may have been upgraded while down
+}
+
+// replayHints sends a replica the bytes it missed, read back from the local
+// container files. Containers that are gone or evicted are dropped: their
+// data is in S3 and the replica can be repaired from there.
+func (fb *FileBox) replayHints(peer string) {
+	defer func() {
+		fb.health.mu.Lock()
+		fb.health.peers[peer].replaying = false
+		fb.health.mu.Unlock()
+		fb.health.save()
+	}()
+
+	fb.health.mu.Lock()
+	pending := make(map[string][]hintRange, len(fb.health.peers[peer].hints))
+	for fileID, ranges := range fb.health.peers[peer].hints {
+		pending[fileID] = slices.Clone(ranges)
+	}
+	fb.health.mu.Unlock()
+
+	// Oldest containers first, and in the same order every time
+	fileIDs := make([]string, 0, len(pending))
+	for fileID := range pending {
+		fileIDs = append(fileIDs, fileID)
+	}
+	slices.Sort(fileIDs)
+
+	replayed := int64(0)
+	for _, fileID := range fileIDs {
+		ranges := pending[fileID]
+		fb.fileLock.RLock()
+		containerFile, exists := fb.files.get(fileID)
+		available := exists && !containerFile.Evicted
+		fb.fileLock.RUnlock()
+
+		for _, r := range ranges {
+			for offset := r.Offset; offset < r.Offset+r.Length; offset += hintReplayChunk {
+				chunk := hintRange{Offset: offset, Length: min(hintReplayChunk, r.Offset+r.Length-offset)}
+				if available {
+					started := timeNow()
+					err := fb.replayRange(peer, containerFile, chunk)
+					fb.health.record(peer, err, timeNow().Sub(started))
+					if err != nil {
+						log.Printf("Replaying hints to %s stopped at %s offset %d: %v", peer, fileID, chunk.Offset, err)
+						return
+					}
+					replayed += chunk.Length
+				}
+
+				fb.health.mu.Lock()
+				fb.health.peers[peer].removeHint(fileID, chunk)
+				fb.health.dirty = true
+				fb.health.mu.Unlock()
+			}
+		}
+	}
+	log.Printf("Replayed %d hinted bytes to %s", replayed, peer)
+}
+
+// replayRange sends one range of a local container file to a replica
+func (fb *FileBox) replayRange(peer string, containerFile *ContainerFile, r hintRange) error {
+	file, err := os.Open(fb.filePathOf(containerFile))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data := make([]byte, r.Length)
+	if n, err := file.ReadAt(data, r.Offset); n < len(data) {
+		return err
+	}
+	if err := fb.sendBlobToReplica(peer, containerFile, data, r.Offset, r.Length, 0, 0); err != nil {
+		return err
+	}
+	fb.recordReplicaAck(containerFile, peer, r.Offset+r.Length)
+	return nil
+}
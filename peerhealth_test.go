@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHintsSurviveRestartBeforeSave hints records and reloads the node state
+// without a save in between: the hint log alone must bring them back, and
+// the next save must fold it into hints.json
+func TestHintsSurviveRestartBeforeSave(t *testing.T) {
+	dir := t.TempDir()
+	const peer = "replica:8080"
+	health := loadPeerHealth(dir, []string{peer})
+	health.hint(peer, testForeignFID, 0, 100)
+	health.hint(peer, testForeignFID, 100, 50)
+	health.hint("removed:8080", testForeignFID, 0, 10)
+
+	reloaded := loadPeerHealth(dir, []string{peer})
+	if got := reloaded.snapshot(peer).HintedBytes; got != 150 {
+		t.Fatalf("hinted bytes after a restart: %d, want 150", got)
+	}
+
+	reloaded.save()
+	if _, err := os.Stat(filepath.Join(dir, hintLogFile)); !os.IsNotExist(err) {
+		t.Errorf("hint log still present after a save: %v", err)
+	}
+	if got := loadPeerHealth(dir, []string{peer}).snapshot(peer).HintedBytes; got != 150 {
+		t.Errorf("hinted bytes after a save and restart: %d, want 150", got)
+	}
+}
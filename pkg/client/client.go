@@ -0,0 +1,575 @@
+// Package client is a Go client for FileBox clusters that sends each
+// request straight to a node able to serve it.
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+//
+// # Routing
+//
+// Every blob ID starts with the FID of its container, and every FID starts
+// with the machine ID of the node writing it. The client learns which node
+// owns which machine ID from GET /topology, starting at the configured
+// nodes and following the replicas each node reports, so no request needs
+// a proxy hop:
+//
+//   - Reads go to the owner first, then to the replicas the owner sends its
+//     containers to, then to any other node.
+//   - Deletes go to the owner, the only node allowed to change a container.
+//   - Uploads are spread over the nodes that accept writes; the node taking
+//     an upload owns the new blob.
+//
+// A node that cannot be reached or answers with a server error is skipped
+// for the next RefreshInterval and the topology is fetched again, so a
+// machine ID adopted by another node is followed.
+//
+// Nodes report their replicas by the addresses configured in REPLICAS; the
+// client must be able to reach them there.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRefreshInterval is how long a fetched topology is trusted
+const DefaultRefreshInterval = 30 * time.Second
+
+// ErrNoNodes is returned when no known node can take a request
+var ErrNoNodes = errors.New("client: no FileBox node available")
+
+// Config - Settings for a Client
+type Config struct {
+	Nodes           []string      // Addresses ("host:port") to discover the cluster from
+	HTTPClient      *http.Client  // Defaults to http.DefaultClient
+	RefreshInterval time.Duration // Defaults to DefaultRefreshInterval
+	Header          http.Header   // Sent with every request, e.g. X-FileBox-Tenant
+}
+
+// Node - One FileBox node in the topology
+type Node struct {
+	Address    string   `json:"address"`
+	HostID     string   `json:"host_id,omitempty"`
+	MachineIDs []uint32 `json:"machine_ids,omitempty"` // Machine IDs whose containers it writes
+	Region     string   `json:"region,omitempty"`
+	Mode       string   `json:"mode,omitempty"` // "normal", "read-only" or "maintenance"
+	Replicas   []string `json:"replicas,omitempty"`
+	Reachable  bool     `json:"reachable"` // Answered GET /topology on the last refresh
+	Error      string   `json:"error,omitempty"`
+}
+
+// Topology - The nodes of a cluster and who owns each machine ID
+type Topology struct {
+	Nodes       []Node            `json:"nodes"`
+	Owners      map[uint32]string `json:"owners"` // Machine ID to node address
+	RefreshedAt time.Time         `json:"refreshed_at"`
+}
+
+// node returns the node at an address
+func (t *Topology) node(address string) *Node {
+	for i := range t.Nodes {
+		if t.Nodes[i].Address == address {
+			return &t.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// nodeTopology - Response of a node's GET /topology
+type nodeTopology struct {
+	HostID     string   `json:"host_id"`
+	MachineIDs []uint32 `json:"machine_ids"`
+	Region     string   `json:"region"`
+	Mode       string   `json:"mode"`
+	Peers      []struct {
+		Address   string `json:"address"`
+		MachineID uint32 `json:"machine_id"`
+		Reachable bool   `json:"reachable"`
+	} `json:"peers"`
+}
+
+// UploadOptions - Optional settings for an upload
+type UploadOptions struct {
+	ContentType string
+	Key         string   // Named key, as X-FileBox-Key
+	Tags        []string // "key=value" pairs, as X-FileBox-Tag
+	TTL         string   // As X-FileBox-TTL, e.g. "24h"
+}
+
+// BlobResponse - Response of an upload or delete
+type BlobResponse struct {
+	ID      string `json:"id"`
+	Size    int64  `json:"size"`
+	Created string `json:"created"`
+	FileID  string `json:"file_id"`
+	Key     string `json:"key,omitempty"`
+	Expires string `json:"expires,omitempty"`
+}
+
+// Error - A request a node answered with an error status
+type Error struct {
+	Node       string
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("filebox %s: %d %s", e.Node, e.StatusCode, e.Message)
+}
+
+// Client - Routes requests to FileBox nodes; safe for concurrent use
+type Client struct {
+	config     Config
+	httpClient *http.Client
+
+	refreshMu sync.Mutex // Serializes refreshes
+
+	mu       sync.Mutex
+	topology Topology
+	down     map[string]time.Time // Nodes skipped since a failure
+	stale    bool                 // Refresh before the next request
+	next     int                  // Round-robin position for uploads
+}
+
+// New creates a client; the topology is fetched on the first request
+func New(config Config) (*Client, error) {
+	if len(config.Nodes) == 0 {
+		return nil, errors.New("client: at least one node address is required")
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultRefreshInterval
+	}
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{config: config, httpClient: httpClient, down: make(map[string]time.Time)}, nil
+}
+
+// Topology returns the topology last fetched
+func (c *Client) Topology() Topology {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topology := c.topology
+	topology.Nodes = slices.Clone(topology.Nodes)
+	return topology
+}
+
+// Refresh fetches the topology from every node it can find, starting at the
+// configured nodes and following the replicas each one reports
+func (c *Client) Refresh(ctx context.Context) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	c.mu.Lock()
+	queue := slices.Clone(c.config.Nodes)
+	for _, node := range c.topology.Nodes {
+		queue = append(queue, node.Address)
+	}
+	c.mu.Unlock()
+
+	var (
+		nodes    []Node
+		seen     = make(map[string]bool)
+		reported = make(map[string]uint32) // Peers' machine IDs as their replicas see them
+		lastErr  error
+	)
+	for len(queue) > 0 {
+		address := queue[0]
+		queue = queue[1:]
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+
+		node := Node{Address: address}
+		var answer nodeTopology
+		if err := c.getJSON(ctx, address, "/topology", &answer); err != nil {
+			node.Error, lastErr = err.Error(), err
+			nodes = append(nodes, node)
+			continue
+		}
+		node.HostID, node.MachineIDs, node.Region, node.Mode = answer.HostID, answer.MachineIDs, answer.Region, answer.Mode
+		node.Reachable = true
+		for _, peer := range answer.Peers {
+			node.Replicas = append(node.Replicas, peer.Address)
+			if peer.Reachable {
+				reported[peer.Address] = peer.MachineID
+			}
+			queue = append(queue, peer.Address)
+		}
+		nodes = append(nodes, node)
+	}
+
+	// A node's own answer wins over what its replicas report about it
+	owners := make(map[uint32]string)
+	for _, node := range nodes {
+		for _, id := range node.MachineIDs {
+			owners[id] = node.Address
+		}
+	}
+	for i := range nodes {
+		if id, ok := reported[nodes[i].Address]; ok && !nodes[i].Reachable {
+			if _, known := owners[id]; !known {
+				owners[id] = nodes[i].Address
+				nodes[i].MachineIDs = []uint32{id}
+			}
+		}
+	}
+
+	if !slices.ContainsFunc(nodes, func(n Node) bool { return n.Reachable }) {
+		return fmt.Errorf("%w: %v", ErrNoNodes, lastErr)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.topology = Topology{Nodes: nodes, Owners: owners, RefreshedAt: time.Now()}
+	c.stale = false
+	for _, node := range nodes {
+		if node.Reachable {
+			delete(c.down, node.Address)
+		}
+	}
+	return nil
+}
+
+// ensureTopology refreshes a missing, stale or expired topology; a failed
+// refresh only matters if there is no topology at all
+func (c *Client) ensureTopology(ctx context.Context) error {
+	c.mu.Lock()
+	needed := c.stale || time.Since(c.topology.RefreshedAt) > c.config.RefreshInterval
+	known := !c.topology.RefreshedAt.IsZero()
+	c.mu.Unlock()
+	if !needed {
+		return nil
+	}
+	if err := c.Refresh(ctx); err != nil && !known {
+		return err
+	}
+	return nil
+}
+
+// usable reports whether a node is reachable and has not failed recently.
+// Callers must hold c.mu.
+func (c *Client) usable(address string) bool {
+	if node := c.topology.node(address); node != nil && !node.Reachable {
+		return false
+	}
+	failed, ok := c.down[address]
+	return !ok || time.Since(failed) > c.config.RefreshInterval
+}
+
+// order puts usable nodes first, keeping the rest as a last resort
+func (c *Client) order(addresses []string) []string {
+	var first, last []string
+	for _, address := range addresses {
+		if slices.Contains(first, address) || slices.Contains(last, address) {
+			continue
+		}
+		if c.usable(address) {
+			first = append(first, address)
+		} else {
+			last = append(last, address)
+		}
+	}
+	return append(first, last...)
+}
+
+// readOrder lists where to read a machine's blobs: its owner, the owner's
+// replicas, then every other node
+func (c *Client) readOrder(machineID uint32) (owner string, addresses []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	owner = c.topology.Owners[machineID]
+	if owner != "" {
+		addresses = append(addresses, owner)
+		if node := c.topology.node(owner); node != nil {
+			addresses = append(addresses, node.Replicas...)
+		}
+	}
+	for _, node := range c.topology.Nodes {
+		addresses = append(addresses, node.Address)
+	}
+	return owner, c.order(addresses)
+}
+
+// writeOrder lists the nodes accepting writes, rotating the first one
+func (c *Client) writeOrder() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var addresses []string
+	for _, node := range c.topology.Nodes {
+		if node.Reachable && (node.Mode == "" || node.Mode == "normal") {
+			addresses = append(addresses, node.Address)
+		}
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	c.next++
+	start := c.next % len(addresses)
+	return c.order(append(slices.Clone(addresses[start:]), addresses[:start]...))
+}
+
+// ReadNodes lists the nodes to read a blob from, best first, and its
+// owner if known. A 404 from the owner is final; from others it is not.
+func (c *Client) ReadNodes(ctx context.Context, blobID string) (owner string, nodes []string, err error) {
+	machineID, err := machineOf(blobID)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := c.ensureTopology(ctx); err != nil {
+		return "", nil, err
+	}
+	owner, nodes = c.readOrder(machineID)
+	return owner, nodes, nil
+}
+
+// WriteNodes lists the nodes accepting writes, rotating the first one
+func (c *Client) WriteNodes(ctx context.Context) ([]string, error) {
+	if err := c.ensureTopology(ctx); err != nil {
+		return nil, err
+	}
+	return c.writeOrder(), nil
+}
+
+// Nodes lists every known node, usable ones first
+func (c *Client) Nodes(ctx context.Context) ([]string, error) {
+	if err := c.ensureTopology(ctx); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var addresses []string
+	for _, node := range c.topology.Nodes {
+		addresses = append(addresses, node.Address)
+	}
+	return c.order(addresses), nil
+}
+
+// Owner returns the node owning a blob's container, the only one that may change it
+func (c *Client) Owner(ctx context.Context, blobID string) (string, error) {
+	machineID, err := machineOf(blobID)
+	if err != nil {
+		return "", err
+	}
+	if err := c.ensureTopology(ctx); err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	owner, ok := c.topology.Owners[machineID]
+	if !ok {
+		return "", fmt.Errorf("%w: no node owns machine ID %d", ErrNoNodes, machineID)
+	}
+	return owner, nil
+}
+
+// MarkDown reports a node as failing: it is tried last until the next
+// refresh interval, and the topology is fetched again before the next request
+func (c *Client) MarkDown(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down[address] = time.Now()
+	c.stale = true
+}
+
+// machineOf extracts the machine ID from a blob ID
+func machineOf(blobID string) (uint32, error) {
+	if len(blobID) < 8 || !strings.Contains(blobID, "-") {
+		return 0, fmt.Errorf("client: invalid blob ID %q", blobID)
+	}
+	prefix, err := hex.DecodeString(blobID[:8])
+	if err != nil {
+		return 0, fmt.Errorf("client: invalid blob ID %q", blobID)
+	}
+	return binary.BigEndian.Uint32(prefix), nil
+}
+
+// request builds a request to a node with the configured headers
+func (c *Client) request(ctx context.Context, method, address, path string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+address+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.config.Header {
+		req.Header[name] = slices.Clone(values)
+	}
+	return req, nil
+}
+
+// try sends a request to each address in turn until one answers with a
+// success or a status retry does not accept. Unreachable nodes and server
+// errors mark the node down.
+func (c *Client) try(ctx context.Context, addresses []string, build func(address string) (*http.Request, error), retry func(address string, status int) bool) (*http.Response, error) {
+	lastErr := ErrNoNodes
+	for _, address := range addresses {
+		req, err := build(address)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			c.MarkDown(address)
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		lastErr = &Error{Node: address, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+		if resp.StatusCode >= 500 {
+			c.MarkDown(address)
+		}
+		if !retry(address, resp.StatusCode) {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// getJSON decodes the response of a GET from one node
+func (c *Client) getJSON(ctx context.Context, address, path string, v any) error {
+	req, err := c.request(ctx, "GET", address, path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &Error{Node: address, StatusCode: resp.StatusCode, Message: resp.Status}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Upload stores a blob on the next node accepting writes, trying the others
+// if it is unavailable, overloaded or out of space
+func (c *Client) Upload(ctx context.Context, data []byte, opts *UploadOptions) (*BlobResponse, error) {
+	nodes, err := c.WriteNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+
+	build := func(address string) (*http.Request, error) {
+		req, err := c.request(ctx, "POST", address, "/upload", data)
+		if err != nil {
+			return nil, err
+		}
+		if opts.ContentType != "" {
+			req.Header.Set("Content-Type", opts.ContentType)
+		}
+		if opts.Key != "" {
+			req.Header.Set("X-FileBox-Key", opts.Key)
+		}
+		for _, tag := range opts.Tags {
+			req.Header.Add("X-FileBox-Tag", tag)
+		}
+		if opts.TTL != "" {
+			req.Header.Set("X-FileBox-TTL", opts.TTL)
+		}
+		return req, nil
+	}
+	retry := func(address string, status int) bool {
+		return status >= 500 || status == http.StatusTooManyRequests
+	}
+
+	resp, err := c.try(ctx, nodes, build, retry)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result BlobResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Get opens a blob for reading from its owner, falling back to nodes
+// holding a replica. A 404 from the owner is final; from others it is not.
+func (c *Client) Get(ctx context.Context, blobID string) (io.ReadCloser, error) {
+	owner, nodes, err := c.ReadNodes(ctx, blobID)
+	if err != nil {
+		return nil, err
+	}
+
+	build := func(address string) (*http.Request, error) {
+		return c.request(ctx, "GET", address, "/blob/"+url.PathEscape(blobID), nil)
+	}
+	retry := func(address string, status int) bool {
+		return status >= 500 || status == http.StatusTooManyRequests || (status == http.StatusNotFound && address != owner)
+	}
+
+	resp, err := c.try(ctx, nodes, build, retry)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete moves a blob to the trash on its owner. If the owner cannot be
+// reached, the topology is refreshed once in case another node adopted it.
+func (c *Client) Delete(ctx context.Context, blobID string) (*BlobResponse, error) {
+	if _, err := machineOf(blobID); err != nil {
+		return nil, err
+	}
+
+	build := func(address string) (*http.Request, error) {
+		return c.request(ctx, "DELETE", address, "/blob/"+url.PathEscape(blobID), nil)
+	}
+	never := func(string, int) bool { return false }
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var owner string
+		if owner, err = c.Owner(ctx, blobID); err == nil {
+			if resp, err = c.try(ctx, []string{owner}, build, never); err == nil {
+				break
+			}
+		}
+		var status *Error
+		if errors.As(err, &status) && status.StatusCode < 500 {
+			return nil, err
+		}
+		if refreshErr := c.Refresh(ctx); refreshErr != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result BlobResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
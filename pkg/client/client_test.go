@@ -0,0 +1,269 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"filebox/pkg/client"
+)
+
+// fakeNode - A FileBox node answering GET /topology and the blob routes
+// from memory
+type fakeNode struct {
+	server  *httptest.Server
+	address string
+
+	mu         sync.Mutex
+	machineIDs []uint32
+	peers      []*fakeNode
+	blobs      map[string][]byte
+	fail       map[string]int // Method -> status answered instead of serving it
+	message    string         // Body of a failure
+	requests   []string       // "METHOD path" of every blob request
+}
+
+// newFakeNode starts a node writing containers under a machine ID
+func newFakeNode(t *testing.T, machineID uint32) *fakeNode {
+	node := &fakeNode{machineIDs: []uint32{machineID}, blobs: make(map[string][]byte), fail: make(map[string]int)}
+	node.server = httptest.NewServer(http.HandlerFunc(node.serve))
+	node.address = strings.TrimPrefix(node.server.URL, "http://")
+	t.Cleanup(node.server.Close)
+	return node
+}
+
+func (n *fakeNode) serve(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if r.URL.Path == "/topology" {
+		answer := map[string]any{"host_id": n.address, "machine_ids": n.machineIDs, "mode": "normal"}
+		var peers []map[string]any
+		for _, peer := range n.peers {
+			peers = append(peers, map[string]any{"address": peer.address, "machine_id": peer.machineIDs[0], "reachable": true})
+		}
+		answer["peers"] = peers
+		json.NewEncoder(w).Encode(answer)
+		return
+	}
+
+	n.requests = append(n.requests, r.Method+" "+r.URL.Path)
+	if status := n.fail[r.Method]; status != 0 {
+		http.Error(w, n.message, status)
+		return
+	}
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/upload":
+		data, _ := io.ReadAll(r.Body)
+		blobID := fmt.Sprintf("%08x000000000000000000000001-%d", n.machineIDs[0], len(n.blobs))
+		n.blobs[blobID] = data
+		json.NewEncoder(w).Encode(client.BlobResponse{ID: blobID, Size: int64(len(data))})
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/blob/"):
+		data, ok := n.blobs[strings.TrimPrefix(r.URL.Path, "/blob/")]
+		if !ok {
+			http.Error(w, "Blob not found", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/blob/"):
+		blobID := strings.TrimPrefix(r.URL.Path, "/blob/")
+		if _, ok := n.blobs[blobID]; !ok {
+			http.Error(w, "Blob not found", http.StatusNotFound)
+			return
+		}
+		delete(n.blobs, blobID)
+		json.NewEncoder(w).Encode(client.BlobResponse{ID: blobID})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// failWith makes the node answer every request of a method with an error
+func (n *fakeNode) failWith(method string, status int, message string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if status == 0 {
+		delete(n.fail, method)
+	} else {
+		n.fail[method] = status
+	}
+	n.message = message
+}
+
+// store puts a blob on the node, as replication would
+func (n *fakeNode) store(blobID string, data []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.blobs[blobID] = data
+}
+
+// seen returns the blob requests the node received
+func (n *fakeNode) seen() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.requests...)
+}
+
+// newCluster starts a node with machine ID 1 replicating to one with
+// machine ID 2, and a client that only knows the first
+func newCluster(t *testing.T) (owner, replica *fakeNode, c *client.Client) {
+	owner, replica = newFakeNode(t, 1), newFakeNode(t, 2)
+	owner.peers = []*fakeNode{replica}
+	c, err := client.New(client.Config{Nodes: []string{owner.address}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return owner, replica, c
+}
+
+// TestUploadAndGet discovers the replica through the owner's topology and
+// reads every uploaded blob back from the node that took it
+func TestUploadAndGet(t *testing.T) {
+	owner, replica, c := newCluster(t)
+	ctx := context.Background()
+
+	takers := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		data := fmt.Sprintf("blob %d", i)
+		resp, err := c.Upload(ctx, []byte(data), &client.UploadOptions{ContentType: "text/plain"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		takenBy, err := c.Owner(ctx, resp.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		takers[takenBy] = true
+
+		body, err := c.Get(ctx, resp.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(body)
+		body.Close()
+		if string(got) != data {
+			t.Errorf("%s read back as %q, want %q", resp.ID, got, data)
+		}
+	}
+	if !takers[owner.address] || !takers[replica.address] {
+		t.Errorf("uploads were taken by %v, want both nodes", takers)
+	}
+	for _, node := range []*fakeNode{owner, replica} {
+		for _, request := range node.seen() {
+			if strings.HasPrefix(request, "GET") && !strings.HasPrefix(request, fmt.Sprintf("GET /blob/%08x", node.machineIDs[0])) {
+				t.Errorf("%s was asked for a blob it does not own: %s", node.address, request)
+			}
+		}
+	}
+}
+
+// TestRetries skips overloaded and failing nodes, but takes a 404 from a
+// blob's owner as final
+func TestRetries(t *testing.T) {
+	owner, replica, c := newCluster(t)
+	ctx := context.Background()
+
+	owner.failWith("POST", http.StatusTooManyRequests, "Too many requests")
+	for i := 0; i < 2; i++ {
+		resp, err := c.Upload(ctx, []byte("retried"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if takenBy, _ := c.Owner(ctx, resp.ID); takenBy != replica.address {
+			t.Errorf("upload taken by %s, want the node that was not overloaded", takenBy)
+		}
+	}
+
+	// A failing owner falls back to its replica
+	const blobID = "00000001000000000000000000000001-7"
+	replica.store(blobID, []byte("replicated"))
+	owner.failWith("GET", http.StatusInternalServerError, "Disk error")
+	body, err := c.Get(ctx, blobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(body)
+	body.Close()
+	if string(got) != "replicated" {
+		t.Errorf("read %q from the replica, want %q", got, "replicated")
+	}
+
+	// A 404 from the owner is not retried on the replica. A client that has
+	// not seen the owner fail asks it first.
+	owner.failWith("GET", 0, "")
+	fresh, err := client.New(client.Config{Nodes: []string{owner.address}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := len(replica.seen())
+	var status *client.Error
+	if _, err := fresh.Get(ctx, blobID); !errors.As(err, &status) || status.StatusCode != http.StatusNotFound {
+		t.Errorf("reading a blob its owner lacks returned %v, want a 404", err)
+	}
+	if after := replica.seen(); len(after) != before {
+		t.Errorf("the replica was asked after the owner's 404: %v", after[before:])
+	}
+}
+
+// TestDeleteFollowsAdoption deletes a blob whose owner went away after
+// another node adopted its machine ID
+func TestDeleteFollowsAdoption(t *testing.T) {
+	owner, replica, c := newCluster(t)
+	ctx := context.Background()
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	const blobID = "00000001000000000000000000000001-0"
+	replica.store(blobID, []byte("adopted"))
+	replica.mu.Lock()
+	replica.machineIDs = []uint32{2, 1}
+	replica.mu.Unlock()
+	owner.server.Close()
+
+	resp, err := c.Delete(ctx, blobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != blobID {
+		t.Errorf("deleted %s, want %s", resp.ID, blobID)
+	}
+	if takenBy, _ := c.Owner(ctx, blobID); takenBy != replica.address {
+		t.Errorf("owner after the refresh is %s, want %s", takenBy, replica.address)
+	}
+}
+
+// TestErrors returns a client error as an *Error naming the node, without
+// trying another node
+func TestErrors(t *testing.T) {
+	owner, replica, c := newCluster(t)
+	ctx := context.Background()
+	owner.failWith("POST", http.StatusBadRequest, "Invalid tag")
+	replica.failWith("POST", http.StatusBadRequest, "Invalid tag")
+
+	_, err := c.Upload(ctx, []byte("data"), &client.UploadOptions{Tags: []string{"bad"}})
+	var status *client.Error
+	if !errors.As(err, &status) {
+		t.Fatalf("upload returned %v, want an *Error", err)
+	}
+	if status.StatusCode != http.StatusBadRequest || status.Message != "Invalid tag" {
+		t.Errorf("error %d %q, want 400 %q", status.StatusCode, status.Message, "Invalid tag")
+	}
+	if tried := len(owner.seen()) + len(replica.seen()); tried != 1 {
+		t.Errorf("a 400 was sent to %d nodes, want 1", tried)
+	}
+
+	if _, err := c.Get(ctx, "not-a-blob-id"); err == nil {
+		t.Error("reading a malformed blob ID succeeded")
+	}
+	if _, err := client.New(client.Config{}); err == nil {
+		t.Error("a client without nodes was created")
+	}
+}
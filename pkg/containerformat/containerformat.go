@@ -0,0 +1,293 @@
+// Package containerformat reads and writes FileBox container files.
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+//
+// # Layout
+//
+// A container file is a plain concatenation of records with no file header.
+// Each record frames one blob:
+//
+//	offset  size  field
+//	0       4     magic, "FBLB" (0x46424c42), big-endian
+//	4       8     data length in bytes, big-endian uint64
+//	12      4     frame checksum of the data, big-endian
+//	16      n     blob data
+//
+// The magic also names the hash algorithm behind the frame checksum, so a
+// container can mix records written with different algorithms:
+//
+//	magic   algorithm  frame checksum
+//	FBLB    crc32c     CRC32-C (Castagnoli)
+//	FBLX    xxh64      first 4 bytes of the big-endian XXH64
+//	FBLS    sha256     first 4 bytes of the SHA-256 digest
+//	FBL3    blake3     first 4 bytes of the 256-bit BLAKE3 digest
+//
+// The frame checksum only detects torn and corrupt records; callers wanting
+// cryptographic integrity keep the full Digest alongside their blob index.
+//
+// Records are only ever appended. A crash can leave a partial record at the
+// end of the file; readers stop at the first record whose header is
+// incomplete, whose magic does not match, whose data runs past the end of the
+// file or whose checksum does not match, and report everything after it as a
+// torn tail. Blob IDs are "<container FID>-<record index>", counting from 0,
+// in containers holding only records; FileBox copies and composed blobs take
+// an index without writing a record, so containers holding them cannot be
+// re-indexed from their records alone.
+package containerformat
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/cespare/xxhash/v2"
+	"lukechampine.com/blake3"
+)
+
+// Record framing constants
+const (
+	Magic       uint32 = 0x46424c42 // "FBLB", CRC32-C records
+	MagicXXH64  uint32 = 0x46424c58 // "FBLX"
+	MagicSHA256 uint32 = 0x46424c53 // "FBLS"
+	MagicBLAKE3 uint32 = 0x46424c33 // "FBL3"
+	HeaderSize         = 16
+)
+
+// Algorithm - Hash algorithm protecting a record
+type Algorithm string
+
+// Supported hash algorithms
+const (
+	CRC32C Algorithm = "crc32c" // Fastest; detects corruption but not tampering
+	XXH64  Algorithm = "xxh64"  // Fast 64-bit non-cryptographic hash
+	SHA256 Algorithm = "sha256" // Cryptographic
+	BLAKE3 Algorithm = "blake3" // Cryptographic and faster than SHA-256 in software
+)
+
+// Algorithms lists every supported algorithm, fastest first
+var Algorithms = []Algorithm{CRC32C, XXH64, BLAKE3, SHA256}
+
+var algorithmMagic = map[Algorithm]uint32{
+	CRC32C: Magic,
+	XXH64:  MagicXXH64,
+	SHA256: MagicSHA256,
+	BLAKE3: MagicBLAKE3,
+}
+
+// ErrBadRecord is returned when a record header or checksum is invalid
+var ErrBadRecord = errors.New("containerformat: bad record")
+
+// ErrUnknownAlgorithm is returned for hash algorithms this package does not implement
+var ErrUnknownAlgorithm = errors.New("containerformat: unknown hash algorithm")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum returns the CRC32-C checksum stored in CRC32-C record headers
+func Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crc32cTable)
+}
+
+// ParseAlgorithm checks an algorithm name
+func ParseAlgorithm(name string) (Algorithm, error) {
+	if _, ok := algorithmMagic[Algorithm(name)]; !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownAlgorithm, name)
+	}
+	return Algorithm(name), nil
+}
+
+// Digest returns the full digest of data under an algorithm; CRC32-C and
+// XXH64 digests are their big-endian sums
+func Digest(algorithm Algorithm, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CRC32C:
+		return binary.BigEndian.AppendUint32(nil, Checksum(data)), nil
+	case XXH64:
+		return binary.BigEndian.AppendUint64(nil, xxhash.Sum64(data)), nil
+	case SHA256:
+		sum := sha256.Sum256(data)
+		return sum[:], nil
+	case BLAKE3:
+		sum := blake3.Sum256(data)
+		return sum[:], nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownAlgorithm, algorithm)
+}
+
+// frameChecksum is the 32-bit header checksum for a digest
+func frameChecksum(digest []byte) uint32 {
+	return binary.BigEndian.Uint32(digest[:4])
+}
+
+// algorithmFor returns the algorithm a record magic stands for
+func algorithmFor(magic uint32) (Algorithm, bool) {
+	for algorithm, m := range algorithmMagic {
+		if m == magic {
+			return algorithm, true
+		}
+	}
+	return "", false
+}
+
+// Record - Location of one blob inside a container file
+type Record struct {
+	Offset    int64     // Offset of the data, past the header
+	Length    int64     // Data length
+	Checksum  uint32    // Frame checksum of the data
+	Algorithm Algorithm // Hash algorithm named by the record magic
+	Digest    []byte    // Full digest of the data; set by RecordAt and Scan
+}
+
+// RecordOffset returns the offset of the record header
+func (r Record) RecordOffset() int64 {
+	return r.Offset - HeaderSize
+}
+
+// End returns the offset just past the record
+func (r Record) End() int64 {
+	return r.Offset + r.Length
+}
+
+// EncodeRecord frames blob data with a CRC32-C record header
+func EncodeRecord(data []byte) []byte {
+	record, _, _ := EncodeRecordWith(CRC32C, data)
+	return record
+}
+
+// EncodeRecordWith frames blob data with a record header for an algorithm
+// and returns the record and the full digest of the data
+func EncodeRecordWith(algorithm Algorithm, data []byte) ([]byte, []byte, error) {
+	digest, err := Digest(algorithm, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	record := make([]byte, HeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], algorithmMagic[algorithm])
+	binary.BigEndian.PutUint64(record[4:12], uint64(len(data)))
+	binary.BigEndian.PutUint32(record[12:16], frameChecksum(digest))
+	copy(record[HeaderSize:], data)
+	return record, digest, nil
+}
+
+// Writer - Appends records to a container file
+type Writer struct {
+	w         io.Writer
+	offset    int64
+	algorithm Algorithm
+}
+
+// NewWriter returns a writer appending CRC32-C records to w, which is positioned at offset
+func NewWriter(w io.Writer, offset int64) *Writer {
+	return &Writer{w: w, offset: offset, algorithm: CRC32C}
+}
+
+// SetAlgorithm changes the hash algorithm of records appended from now on
+func (w *Writer) SetAlgorithm(algorithm Algorithm) error {
+	if _, ok := algorithmMagic[algorithm]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownAlgorithm, algorithm)
+	}
+	w.algorithm = algorithm
+	return nil
+}
+
+// Append writes one record in a single Write call and returns its location
+func (w *Writer) Append(data []byte) (Record, error) {
+	record, digest, err := EncodeRecordWith(w.algorithm, data)
+	if err != nil {
+		return Record{}, err
+	}
+	rec := Record{
+		Offset:    w.offset + HeaderSize,
+		Length:    int64(len(data)),
+		Checksum:  frameChecksum(digest),
+		Algorithm: w.algorithm,
+		Digest:    digest,
+	}
+	n, err := w.w.Write(record)
+	w.offset += int64(n)
+	if err != nil {
+		return Record{}, err
+	}
+	return rec, nil
+}
+
+// Offset returns the offset the next record will be written at
+func (w *Writer) Offset() int64 {
+	return w.offset
+}
+
+// Reader - Reads records from a container file
+type Reader struct {
+	r    io.ReaderAt
+	size int64
+}
+
+// NewReader returns a reader over a container of the given size
+func NewReader(r io.ReaderAt, size int64) *Reader {
+	return &Reader{r: r, size: size}
+}
+
+// Size returns the container size the reader was created with
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// RecordAt reads and validates the record whose header starts at offset
+func (r *Reader) RecordAt(offset int64) (Record, []byte, error) {
+	if offset+HeaderSize > r.size {
+		return Record{}, nil, fmt.Errorf("%w: header at %d runs past end of file", ErrBadRecord, offset)
+	}
+
+	header := make([]byte, HeaderSize)
+	if _, err := r.r.ReadAt(header, offset); err != nil {
+		return Record{}, nil, err
+	}
+	algorithm, ok := algorithmFor(binary.BigEndian.Uint32(header[0:4]))
+	if !ok {
+		return Record{}, nil, fmt.Errorf("%w: bad magic at %d", ErrBadRecord, offset)
+	}
+
+	rec := Record{
+		Offset:    offset + HeaderSize,
+		Length:    int64(binary.BigEndian.Uint64(header[4:12])),
+		Checksum:  binary.BigEndian.Uint32(header[12:16]),
+		Algorithm: algorithm,
+	}
+	if rec.Length < 0 || rec.End() > r.size {
+		return Record{}, nil, fmt.Errorf("%w: data at %d runs past end of file", ErrBadRecord, offset)
+	}
+
+	data := make([]byte, rec.Length)
+	if _, err := r.r.ReadAt(data, rec.Offset); err != nil {
+		return Record{}, nil, err
+	}
+	digest, err := Digest(algorithm, data)
+	if err != nil {
+		return Record{}, nil, err
+	}
+	if frameChecksum(digest) != rec.Checksum {
+		return Record{}, nil, fmt.Errorf("%w: checksum mismatch at %d", ErrBadRecord, offset)
+	}
+	rec.Digest = digest
+
+	return rec, data, nil
+}
+
+// Scan walks records starting at offset `from` and returns every complete
+// record plus the offset just past the last one. Anything between that
+// offset and Size() is a torn or foreign write.
+func (r *Reader) Scan(from int64) ([]Record, int64) {
+	var records []Record
+	pos := from
+	for {
+		rec, _, err := r.RecordAt(pos)
+		if err != nil {
+			return records, pos
+		}
+		records = append(records, rec)
+		pos = rec.End()
+	}
+}
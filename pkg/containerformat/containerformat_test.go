@@ -0,0 +1,96 @@
+package containerformat_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"filebox/pkg/containerformat"
+)
+
+// writeContainer appends one record per blob, cycling through the hash
+// algorithms, and returns the file and the records written
+func writeContainer(t *testing.T, blobs [][]byte) ([]byte, []containerformat.Record) {
+	t.Helper()
+	var file bytes.Buffer
+	writer := containerformat.NewWriter(&file, 0)
+	var records []containerformat.Record
+	for i, blob := range blobs {
+		algorithm := containerformat.Algorithms[i%len(containerformat.Algorithms)]
+		if err := writer.SetAlgorithm(algorithm); err != nil {
+			t.Fatal(err)
+		}
+		record, err := writer.Append(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if writer.Offset() != int64(file.Len()) {
+		t.Fatalf("writer is at offset %d, file has %d bytes", writer.Offset(), file.Len())
+	}
+	return file.Bytes(), records
+}
+
+func testBlobs() [][]byte {
+	blobs := [][]byte{{}, []byte("x")}
+	for i := 0; i < 6; i++ {
+		blobs = append(blobs, bytes.Repeat([]byte(fmt.Sprintf("blob %d ", i)), 100*i+1))
+	}
+	return blobs
+}
+
+func TestWriteAndReadBack(t *testing.T) {
+	blobs := testBlobs()
+	file, written := writeContainer(t, blobs)
+	reader := containerformat.NewReader(bytes.NewReader(file), int64(len(file)))
+
+	for i, want := range written {
+		record, data, err := reader.RecordAt(want.RecordOffset())
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if !bytes.Equal(data, blobs[i]) {
+			t.Errorf("record %d holds %d bytes, want the %d written", i, len(data), len(blobs[i]))
+		}
+		if record.Offset != want.Offset || record.Length != want.Length || record.Checksum != want.Checksum ||
+			record.Algorithm != want.Algorithm || !bytes.Equal(record.Digest, want.Digest) {
+			t.Errorf("record %d reads back as %+v, was written as %+v", i, record, want)
+		}
+	}
+
+	scanned, end := reader.Scan(0)
+	if len(scanned) != len(blobs) || end != int64(len(file)) {
+		t.Errorf("scan found %d records ending at %d, want %d ending at %d", len(scanned), end, len(blobs), len(file))
+	}
+}
+
+func TestTruncatedLastRecord(t *testing.T) {
+	blobs := testBlobs()
+	file, written := writeContainer(t, blobs)
+	last := written[len(written)-1]
+
+	cuts := map[string]int64{
+		"mid-header": last.RecordOffset() + containerformat.HeaderSize/2,
+		"mid-data":   last.Offset + last.Length/2,
+		"last byte":  last.End() - 1,
+	}
+	for name, size := range cuts {
+		t.Run(name, func(t *testing.T) {
+			reader := containerformat.NewReader(bytes.NewReader(file[:size]), size)
+
+			if _, _, err := reader.RecordAt(last.RecordOffset()); !errors.Is(err, containerformat.ErrBadRecord) {
+				t.Errorf("reading the cut record returned %v, want ErrBadRecord", err)
+			}
+			if _, data, err := reader.RecordAt(written[0].RecordOffset()); err != nil || !bytes.Equal(data, blobs[0]) {
+				t.Errorf("reading an intact record returned %v", err)
+			}
+
+			scanned, end := reader.Scan(0)
+			if len(scanned) != len(blobs)-1 || end != last.RecordOffset() {
+				t.Errorf("scan found %d records ending at %d, want %d ending at %d", len(scanned), end, len(blobs)-1, last.RecordOffset())
+			}
+		})
+	}
+}
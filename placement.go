@@ -0,0 +1,81 @@
+// Container placement for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// Container selection policies
+const (
+	SelectRoundRobin  = "round-robin"  // Rotate through the open containers
+	SelectLeastLoaded = "least-loaded" // Pick the container with the fewest writes in flight
+)
+
+// PlacementConfig - How many containers accept writes at once and how one is chosen
+type PlacementConfig struct {
+	OpenContainers int    // Open containers per tenant and size class
+	Selection      string // SelectRoundRobin or SelectLeastLoaded
+}
+
+// loadPlacementConfig reads OPEN_CONTAINERS and CONTAINER_SELECTION
+func loadPlacementConfig() PlacementConfig {
+	config := PlacementConfig{
+		OpenContainers: int(getEnvInt("OPEN_CONTAINERS", 1)),
+		Selection:      getEnvOrDefault("CONTAINER_SELECTION", SelectRoundRobin),
+	}
+	if config.OpenContainers < 1 {
+		log.Printf("Invalid OPEN_CONTAINERS %d, using 1", config.OpenContainers)
+		config.OpenContainers = 1
+	}
+	if config.Selection != SelectRoundRobin && config.Selection != SelectLeastLoaded {
+		log.Printf("Invalid CONTAINER_SELECTION %q, using %s", config.Selection, SelectRoundRobin)
+		config.Selection = SelectRoundRobin
+	}
+	return config
+}
+
+// pickContainer chooses among open containers that can take the blob.
+// Callers must hold fb.fileLock, for reading or exclusively.
+func (fb *FileBox) pickContainer(candidates []*ContainerFile) *ContainerFile {
+	// Map iteration order is random; sort so round-robin actually rotates
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].FID.String() < candidates[j].FID.String()
+	})
+
+	if fb.placement.Selection == SelectLeastLoaded {
+		var best *ContainerFile
+		bestWriters := 0
+		for _, candidate := range candidates {
+			mu := fb.files.lock(candidate)
+			mu.RLock()
+			writers := candidate.writers
+			mu.RUnlock()
+			if best == nil || writers < bestWriters {
+				best, bestWriters = candidate, writers
+			}
+		}
+		return best
+	}
+
+	return candidates[fb.nextContainer.Add(1)%int64(len(candidates))]
+}
+
+// releaseContainer ends a write started by reserveSpace. The last write
+// into a full container sends it to S3, since earlier reservations may
+// still be writing their ranges until then.
+func (fb *FileBox) releaseContainer(containerFile *ContainerFile) {
+	fb.fileLock.RLock()
+	mu := fb.files.lock(containerFile)
+	mu.Lock()
+	containerFile.writers--
+	full := containerFile.writers == 0 && containerFile.Size >= fb.classContainerSize(containerFile.SizeClass)
+	mu.Unlock()
+	fb.fileLock.RUnlock()
+	if full {
+		go fb.uploadContainerFile(containerFile.FID.String(), UploadTriggerFull)
+	}
+}
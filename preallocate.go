@@ -0,0 +1,80 @@
+// Container file preallocation for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// A container grows one append at a time, so the filesystem hands out its
+// blocks piecemeal and a full disk shows up halfway through some upload.
+// With CONTAINER_PREALLOCATE a new container reserves its whole size class
+// up front. The reservation does not change the file's length, so appends,
+// recovery scans and fsck see the same file as before; only the blocks are
+// already there. Whatever a container does not use is given back once it
+// stops taking writes.
+
+// errPreallocateUnsupported - The platform or filesystem cannot reserve space
+var errPreallocateUnsupported = errors.New("preallocation is not supported here")
+
+// preallocator - Reserves disk space for new containers until the filesystem refuses
+type preallocator struct {
+	enabled atomic.Bool
+}
+
+// loadPreallocator reads CONTAINER_PREALLOCATE; nil when it is off
+func loadPreallocator() *preallocator {
+	if !getEnvBool("CONTAINER_PREALLOCATE", false) {
+		return nil
+	}
+	p := &preallocator{}
+	p.enabled.Store(true)
+	return p
+}
+
+// reserve creates a new container file with size bytes allocated. On
+// filesystems without support it turns preallocation off and logs once;
+// the container then grows as it is appended to.
+func (p *preallocator) reserve(path string, size int64) {
+	if p == nil || !p.enabled.Load() {
+		return
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error creating container file %s for preallocation: %v", path, err)
+		return
+	}
+	defer file.Close()
+
+	err = preallocate(file, size)
+	switch {
+	case err == nil:
+	case errors.Is(err, errPreallocateUnsupported):
+		if p.enabled.CompareAndSwap(true, false) {
+			log.Printf("Container preallocation is not supported by this filesystem; containers grow as they are written")
+		}
+	default:
+		// Most often ENOSPC: the container is still usable while appends fit
+		log.Printf("Warning: could not preallocate %d bytes for container %s: %v", size, path, err)
+	}
+}
+
+// release gives back the space a container reserved past its data
+func (p *preallocator) release(containerFile *ContainerFile, size, reserved int64) {
+	if p == nil || !p.enabled.Load() || reserved <= size {
+		return
+	}
+	file, err := os.OpenFile(containerFile.FilePath, os.O_WRONLY, 0)
+	if err != nil {
+		return // Already evicted or removed
+	}
+	defer file.Close()
+	if err := releasePreallocated(file, size, reserved); err != nil && !errors.Is(err, errPreallocateUnsupported) {
+		log.Printf("Warning: could not release preallocated space of container %s: %v", containerFile.FID.String(), err)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+// Container file preallocation for FileBox (Linux fallocate)
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves size bytes for a file without changing its length
+func preallocate(file *os.File, size int64) error {
+	return fallocateErr(unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size))
+}
+
+// releasePreallocated frees the reserved blocks between from and to
+func releasePreallocated(file *os.File, from, to int64) error {
+	return fallocateErr(unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, from, to-from))
+}
+
+// fallocateErr maps the errors of filesystems without fallocate (tmpfs on old kernels, NFS, FUSE)
+func fallocateErr(err error) error {
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return errPreallocateUnsupported
+	}
+	return err
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+// Container file preallocation for FileBox (unsupported platforms)
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import "os"
+
+// preallocate reports that this platform cannot reserve space
+func preallocate(file *os.File, size int64) error {
+	return errPreallocateUnsupported
+}
+
+// releasePreallocated has nothing to release on this platform
+func releasePreallocated(file *os.File, from, to int64) error {
+	return errPreallocateUnsupported
+}
@@ -0,0 +1,312 @@
+// Replication protocol versioning and capability negotiation for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"filebox/pkg/containerformat"
+)
+
+// Replication protocol versions this build speaks. Nodes that predate the
+// handshake speak version 1 and answer 404 to /cluster/hello.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+	protocolHeader     = "X-FileBox-Protocol" // Version a peer request is sent with
+)
+
+// Capabilities are optional features a peer may support independently of the
+// version. A payload change such as compression or container-level sync adds
+// a capability first and is only used with peers that advertise it.
+const (
+	CapRecordFraming = "record-framing" // /replicate payloads are whole framed records
+	CapWrappedKeys   = "wrapped-keys"   // Encrypted containers replicate their wrapped data key
+	CapContainerData = "container-data" // GET /container/{fid} serves raw container files
+	CapManifests     = "manifests"      // GET /cluster/manifests serves manifests for bootstraps
+	CapExpiry        = "expiry"         // /cluster/expired takes part in expiry cleanup
+	CapIdentity      = "identity"       // GET /cluster/identity answers with machine ID and clock
+	CapZstd          = "zstd"           // /replicate accepts zstd-compressed bodies
+	CapBatch         = "batch"          // /replicate accepts several records per request
+	CapStream        = "grpc-stream"    // Accepts records on a gRPC stream at the advertised port
+	CapHashes        = "hashes"         // Reads records hashed with any INTEGRITY_HASH algorithm
+	CapMetadataOps   = "metadata-ops"   // POST /cluster/metadata-ops applies blob metadata changes
+	CapLocate        = "locate"         // GET /cluster/locate/{blobID} describes the local copy of a blob's container
+)
+
+const (
+	helloRefresh = 10 * time.Minute // How long a successful handshake is trusted
+	helloTimeout = 10 * time.Second
+)
+
+// localCapabilities is what this build supports
+var localCapabilities = []string{CapRecordFraming, CapWrappedKeys, CapContainerData, CapManifests, CapExpiry, CapIdentity, CapZstd, CapBatch, CapStream, CapHashes, CapMetadataOps, CapLocate}
+
+// legacyCapabilities is what nodes from before the handshake are known to support
+var legacyCapabilities = []string{CapRecordFraming, CapWrappedKeys, CapContainerData}
+
+// PeerHello - Body and response of POST /cluster/hello
+type PeerHello struct {
+	HostID       string   `json:"host_id"`
+	MachineID    uint32   `json:"machine_id"`
+	Version      int      `json:"version"`
+	MinVersion   int      `json:"min_version"`
+	Capabilities []string `json:"capabilities"`
+	StreamPort   int      `json:"stream_port,omitempty"` // Port of the replication stream listener
+	Region       string   `json:"region,omitempty"`      // NODE_REGION
+}
+
+// PeerProtocol - What was negotiated with one peer
+type PeerProtocol struct {
+	Peer         string    `json:"peer"`
+	HostID       string    `json:"host_id,omitempty"`
+	MachineID    uint32    `json:"machine_id,omitempty"`
+	Version      int       `json:"version"`               // Highest version both sides speak; 0 if none
+	Capabilities []string  `json:"capabilities"`          // Supported by both sides
+	Legacy       bool      `json:"legacy"`                // The peer predates the handshake
+	Incompatible bool      `json:"incompatible"`          // No version in common; nothing is sent to it
+	StreamAddr   string    `json:"stream_addr,omitempty"` // Where records are streamed to; empty posts them
+	Region       string    `json:"region,omitempty"`      // The peer's NODE_REGION, for tenant replication scopes
+	CheckedAt    time.Time `json:"checked_at"`
+	Error        string    `json:"error,omitempty"` // Handshake failure, retried on the next request
+}
+
+// compatible reports whether the handshake succeeded with a common version
+func (p *PeerProtocol) compatible() bool {
+	return p.Error == "" && !p.Incompatible
+}
+
+// sendVersion is the version to send requests with; unknown peers get the oldest
+func (p *PeerProtocol) sendVersion() int {
+	if p.compatible() {
+		return p.Version
+	}
+	return MinProtocolVersion
+}
+
+// supports reports whether both sides support a capability
+func (p *PeerProtocol) supports(capability string) bool {
+	return p.compatible() && slices.Contains(p.Capabilities, capability)
+}
+
+// protocolState - Negotiated protocol per peer address
+type protocolState struct {
+	mu    sync.Mutex
+	peers map[string]*PeerProtocol
+}
+
+// localHello describes this node for the handshake; streaming is only
+// advertised when the stream listener is configured
+func (fb *FileBox) localHello() PeerHello {
+	hello := PeerHello{
+		HostID:       fb.hostID,
+		MachineID:    fb.machineID,
+		Version:      ProtocolVersion,
+		MinVersion:   MinProtocolVersion,
+		Capabilities: localCapabilities,
+		StreamPort:   fb.replication.streamPort(),
+		Region:       fb.region,
+	}
+	if hello.StreamPort == 0 {
+		hello.Capabilities = slices.DeleteFunc(slices.Clone(localCapabilities), func(c string) bool { return c == CapStream })
+	}
+	return hello
+}
+
+// negotiate settles the version and capabilities to use with a peer from its hello
+func negotiate(peer string, hello PeerHello) *PeerProtocol {
+	result := &PeerProtocol{Peer: peer, HostID: hello.HostID, MachineID: hello.MachineID, Region: hello.Region, Capabilities: []string{}, CheckedAt: timeNow().UTC()}
+
+	version := min(ProtocolVersion, hello.Version)
+	if version < max(MinProtocolVersion, hello.MinVersion) {
+		result.Incompatible = true
+		result.Error = fmt.Sprintf("no common protocol version (we speak %d-%d, peer %d-%d)",
+			MinProtocolVersion, ProtocolVersion, hello.MinVersion, hello.Version)
+		return result
+	}
+	result.Version = version
+	for _, capability := range hello.Capabilities {
+		if slices.Contains(localCapabilities, capability) {
+			result.Capabilities = append(result.Capabilities, capability)
+		}
+	}
+	return result
+}
+
+// peerProtocol returns what was negotiated with a peer, shaking hands first
+// if nothing is known, the last result is stale or the peer was unreachable
+func (fb *FileBox) peerProtocol(ctx context.Context, peer string) *PeerProtocol {
+	fb.protocols.mu.Lock()
+	known, ok := fb.protocols.peers[peer]
+	fb.protocols.mu.Unlock()
+	if ok && (known.Error == "" || known.Incompatible) && timeNow().Sub(known.CheckedAt) < helloRefresh {
+		return known
+	}
+
+	result := fb.hello(ctx, peer)
+	if result.Error != "" && (!ok || known.Error != result.Error) {
+		log.Printf("Protocol handshake with %s failed: %s", peer, result.Error)
+	} else if result.Error == "" && (!ok || known.Version != result.Version || known.Legacy != result.Legacy) {
+		log.Printf("Speaking replication protocol v%d with %s (capabilities: %v)", result.Version, peer, result.Capabilities)
+	}
+
+	fb.protocols.mu.Lock()
+	fb.protocols.peers[peer] = result
+	fb.protocols.mu.Unlock()
+	return result
+}
+
+// forgetPeerProtocol drops a negotiated result so the next request shakes hands again
+func (fb *FileBox) forgetPeerProtocol(peer string) {
+	fb.protocols.mu.Lock()
+	delete(fb.protocols.peers, peer)
+	fb.protocols.mu.Unlock()
+}
+
+// hello exchanges hellos with a peer. Peers without the endpoint are older
+// nodes and are assumed to speak version 1 with the legacy capabilities.
+func (fb *FileBox) hello(ctx context.Context, peer string) *PeerProtocol {
+	failed := func(err error) *PeerProtocol {
+		return &PeerProtocol{Peer: peer, Capabilities: []string{}, CheckedAt: timeNow().UTC(), Error: err.Error()}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, helloTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(fb.localHello())
+	if err != nil {
+		return failed(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://%s/cluster/hello", peer), bytes.NewReader(body))
+	if err != nil {
+		return failed(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := fb.replicaClient.Do(req)
+	if err != nil {
+		return failed(err)
+	}
+	defer resp.Body.Close()
+
+	var hello PeerHello
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&hello); err != nil {
+			return failed(err)
+		}
+	case http.StatusNotFound:
+		hello = PeerHello{Version: 1, MinVersion: 1, Capabilities: legacyCapabilities}
+	default:
+		return failed(fmt.Errorf("status %s", resp.Status))
+	}
+
+	result := negotiate(peer, hello)
+	result.Legacy = resp.StatusCode == http.StatusNotFound
+	if result.supports(CapStream) && hello.StreamPort > 0 {
+		if host, _, err := net.SplitHostPort(peer); err == nil {
+			result.StreamAddr = net.JoinHostPort(host, strconv.Itoa(hello.StreamPort))
+		}
+	}
+	return result
+}
+
+// helloPeers shakes hands with every replica at startup so mismatches show up early
+func (fb *FileBox) helloPeers() {
+	for _, replica := range fb.replicas {
+		protocol := fb.peerProtocol(context.Background(), replica)
+		if fb.integrity != "" && fb.integrity != containerformat.CRC32C && protocol.compatible() && !protocol.supports(CapHashes) {
+			log.Printf("Replica %s cannot read %s records; its fsck and recovery will treat them as torn", replica, fb.integrity)
+		}
+	}
+}
+
+// requestProtocol reads the version a peer request was sent with; requests
+// without the header come from nodes that predate it and speak version 1
+func requestProtocol(r *http.Request) (int, error) {
+	return parseProtocolVersion(r.Header.Get(protocolHeader))
+}
+
+// parseProtocolVersion checks a version sent by a peer; empty means version 1
+func parseProtocolVersion(value string) (int, error) {
+	if value == "" {
+		return 1, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s header %q", protocolHeader, value)
+	}
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return version, fmt.Errorf("protocol version %d is not supported (we speak %d-%d)", version, MinProtocolVersion, ProtocolVersion)
+	}
+	return version, nil
+}
+
+// requireProtocol rejects peer requests sent with a version this node does not speak
+func requireProtocol(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := requestProtocol(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUpgradeRequired)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleClusterHello serves POST /cluster/hello: it records the caller's
+// hello and answers with this node's own
+func (fb *FileBox) handleClusterHello(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var hello PeerHello
+	if err := json.NewDecoder(r.Body).Decode(&hello); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if result := negotiate(hello.HostID, hello); result.Error != "" {
+		log.Printf("Peer %s (%s) has no protocol version in common with us: %s", hello.HostID, r.RemoteAddr, result.Error)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.localHello())
+}
+
+// PeerStatus - One replica in GET /admin/peers
+type PeerStatus struct {
+	*PeerProtocol
+	Health PeerHealth `json:"health"`
+}
+
+// handlePeers serves GET /admin/peers: the protocol negotiated with each
+// replica and its replication health
+func (fb *FileBox) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	peers := make([]PeerStatus, 0, len(fb.replicas))
+	for _, replica := range fb.replicas {
+		peers = append(peers, PeerStatus{PeerProtocol: fb.peerProtocol(r.Context(), replica), Health: fb.health.snapshot(replica)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Local PeerHello    `json:"local"`
+		Peers []PeerStatus `json:"peers"`
+	}{fb.localHello(), peers})
+}
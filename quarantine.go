@@ -0,0 +1,334 @@
+// Quarantine and repair of corrupted containers for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// QuarantinedError - Returned for reads from a quarantined container
+type QuarantinedError struct {
+	FileID string
+	Reason string
+}
+
+func (e *QuarantinedError) Error() string {
+	return fmt.Sprintf("container %s is quarantined: %s", e.FileID, e.Reason)
+}
+
+// RepairResponse - Response for repair operations
+type RepairResponse struct {
+	FileID string `json:"file_id"`
+	Source string `json:"source,omitempty"` // Replica host or "s3"
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// quarantineContainer marks a container as corrupted and schedules a repair
+func (fb *FileBox) quarantineContainer(containerFile *ContainerFile, reason string) {
+	fb.fileLock.Lock()
+	alreadyQuarantined := containerFile.Quarantined
+	containerFile.Quarantined = true
+	containerFile.QuarantineReason = reason
+	fb.fileLock.Unlock()
+
+	if alreadyQuarantined {
+		return
+	}
+	fb.saveManifest(containerFile)
+
+	log.Printf("Quarantined container %s: %s", containerFile.FID.String(), reason)
+	go fb.repairContainer(containerFile)
+}
+
+// repairContainer restores a quarantined container from a replica or S3
+func (fb *FileBox) repairContainer(containerFile *ContainerFile) RepairResponse {
+	fileID := containerFile.FID.String()
+
+	fb.fileLock.Lock()
+	if containerFile.repairing {
+		fb.fileLock.Unlock()
+		return RepairResponse{FileID: fileID, Status: "in_progress"}
+	}
+	containerFile.repairing = true
+	fb.fileLock.Unlock()
+
+	defer func() {
+		fb.fileLock.Lock()
+		containerFile.repairing = false
+		fb.fileLock.Unlock()
+	}()
+
+	var lastErr error
+	for _, replica := range fb.replicas {
+		url := fmt.Sprintf("http://%s/container/%s", replica, fileID)
+		if lastErr = fb.repairFromURL(containerFile, url); lastErr == nil {
+			return fb.finishRepair(containerFile, replica)
+		}
+		log.Printf("Repair of %s from %s failed: %v", fileID, replica, lastErr)
+	}
+
+	fb.fileLock.RLock()
+	uploaded := containerFile.Uploaded
+	fb.fileLock.RUnlock()
+
+	if uploaded && fb.s3Client != nil {
+		if lastErr = fb.repairFromS3(context.Background(), containerFile); lastErr == nil {
+			return fb.finishRepair(containerFile, "s3")
+		}
+		log.Printf("Repair of %s from S3 failed: %v", fileID, lastErr)
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no replica or S3 copy available")
+	}
+	log.Printf("Container %s remains quarantined: %v", fileID, lastErr)
+	return RepairResponse{FileID: fileID, Status: "failed", Error: lastErr.Error()}
+}
+
+// finishRepair lifts the quarantine after a successful repair
+func (fb *FileBox) finishRepair(containerFile *ContainerFile, source string) RepairResponse {
+	fb.fileLock.Lock()
+	containerFile.Quarantined = false
+	containerFile.QuarantineReason = ""
+	fb.fileLock.Unlock()
+	fb.saveManifest(containerFile)
+
+	log.Printf("Repaired container %s from %s", containerFile.FID.String(), source)
+	return RepairResponse{FileID: containerFile.FID.String(), Source: source, Status: "repaired"}
+}
+
+// repairFromURL downloads a peer's copy of the container
+func (fb *FileBox) repairFromURL(containerFile *ContainerFile, url string) error {
+	resp, err := fb.replicaClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("fetch failed: %s", strings.TrimSpace(string(body)))
+	}
+
+	return fb.replaceContainerData(containerFile, resp.Body)
+}
+
+// repairFromS3 downloads the uploaded copy of the container
+func (fb *FileBox) repairFromS3(ctx context.Context, containerFile *ContainerFile) error {
+	resp, err := fb.s3Client.GetObject(withUsageTenant(ctx, containerFile.Tenant), &s3.GetObjectInput{
+		Bucket: aws.String(fb.bucket),
+		Key:    aws.String(fb.containerS3Key(containerFile)),
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return fb.replaceContainerData(containerFile, resp.Body)
+}
+
+// replaceContainerData stages a candidate copy, verifies every known blob
+// checksum against it and atomically swaps it in for the local file
+func (fb *FileBox) replaceContainerData(containerFile *ContainerFile, src io.Reader) error {
+	// Staged on the container's own volume so the swap is a rename
+	filePath := fb.filePathOf(containerFile)
+	repairDir := filepath.Join(fb.volumeRoot(filePath), "repair")
+	if err := os.MkdirAll(repairDir, 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(repairDir, containerFile.FID.String()+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		return fmt.Errorf("error staging copy: %v", err)
+	}
+
+	fb.fileLock.RLock()
+	size, blobs := fb.containerContents(containerFile)
+	blobs = append([]BlobInfo(nil), blobs...)
+	fb.fileLock.RUnlock()
+
+	stat, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < size {
+		return fmt.Errorf("copy is truncated: %d of %d bytes", stat.Size(), size)
+	}
+
+	for _, blob := range blobs {
+		data := make([]byte, blob.Length)
+		if _, err := tmp.ReadAt(data, blob.Offset); err != nil {
+			return fmt.Errorf("error reading blob %s from copy: %v", blob.ID, err)
+		}
+		if !verifyBlob(blob, data) {
+			return fmt.Errorf("copy is also corrupted at blob %s", blob.ID)
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return err
+	}
+	fb.mmap.forget(filePath)
+
+	// A repaired evicted container is served locally again
+	fb.fileLock.Lock()
+	containerFile.Evicted = false
+	fb.fileLock.Unlock()
+	return nil
+}
+
+// verifyContainer checks every indexed blob in the local container file
+func (fb *FileBox) verifyContainer(containerFile *ContainerFile) error {
+	fb.fileLock.RLock()
+	blobs := append([]BlobInfo(nil), fb.containerBlobs(containerFile)...)
+	fb.fileLock.RUnlock()
+
+	file, err := os.Open(fb.filePathOf(containerFile))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for _, blob := range blobs {
+		data := make([]byte, blob.Length)
+		if _, err := file.ReadAt(data, blob.Offset); err != nil {
+			return fmt.Errorf("error reading blob %s: %v", blob.ID, err)
+		}
+		if !verifyBlob(blob, data) {
+			return fmt.Errorf("checksum mismatch on blob %s", blob.ID)
+		}
+	}
+	return nil
+}
+
+// handleContainerData serves a raw container file to peers repairing their copy
+func (fb *FileBox) handleContainerData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileID := r.URL.Path[len("/container/"):]
+
+	fb.fileLock.RLock()
+	containerFile, exists := fb.files.get(fileID)
+	var quarantined bool
+	var filePath string
+	if exists {
+		quarantined, filePath = containerFile.Quarantined, containerFile.FilePath
+	}
+	fb.fileLock.RUnlock()
+
+	if !exists {
+		http.Error(w, "Container file not found", http.StatusNotFound)
+		return
+	}
+	if quarantined {
+		http.Error(w, "Container file is quarantined", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, filePath)
+}
+
+// handleAdminContainers dispatches /admin/containers/{fid}/... operations
+func (fb *FileBox) handleAdminContainers(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path[len("/admin/containers/"):], "/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	fileID, action := parts[0], parts[1]
+
+	fb.fileLock.RLock()
+	containerFile, exists := fb.files.get(fileID)
+	fb.fileLock.RUnlock()
+
+	if !exists {
+		http.Error(w, "Container file not found", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "repair":
+		fb.handleRepair(w, r, containerFile)
+	case "hold":
+		fb.handleContainerHold(w, r, containerFile)
+	case "upload":
+		fb.handleContainerUpload(w, r, containerFile)
+	case "manifest":
+		fb.handleContainerManifest(w, r, containerFile)
+	case "conflict":
+		fb.handleContainerConflict(w, r, containerFile)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleRepair triggers a repair; healthy containers are only repaired with ?force=true
+func (fb *FileBox) handleRepair(w http.ResponseWriter, r *http.Request, containerFile *ContainerFile) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fb.fileLock.RLock()
+	quarantined := containerFile.Quarantined
+	fb.fileLock.RUnlock()
+
+	response := RepairResponse{FileID: containerFile.FID.String(), Status: "healthy"}
+	if !quarantined && r.URL.Query().Get("force") != "true" {
+		// Re-verify before deciding the container is healthy
+		if err := fb.verifyContainer(containerFile); err != nil {
+			fb.fileLock.Lock()
+			containerFile.Quarantined = true
+			containerFile.QuarantineReason = err.Error()
+			fb.fileLock.Unlock()
+			quarantined = true
+		}
+	} else if !quarantined {
+		fb.fileLock.Lock()
+		containerFile.Quarantined = true
+		containerFile.QuarantineReason = "forced repair"
+		fb.fileLock.Unlock()
+		quarantined = true
+	}
+
+	if quarantined {
+		response = fb.repairContainer(containerFile)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if response.Status == "failed" {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,817 @@
+// Raft-replicated metadata for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// Without consensus each node keeps its own key -> blob index, and two
+// nodes can point one named key at different blobs. With RAFT_ADDR set, a
+// set of nodes runs a Raft group whose replicated state is the named-key
+// namespace and the admin tenant policies. Key writes are committed through
+// the leader before an upload, copy or compose with a key is acknowledged,
+// so they are linearizable and can be made conditional on the key's version
+// (the log index of its last write). Followers forward writes to the leader.
+// Reads are answered from the local state, which may lag the leader by a
+// few entries, unless they ask for a consistent read.
+//
+// A node's Raft ID is the address its peers and clients reach its HTTP API
+// at, so any member can forward to the leader without another lookup.
+
+const (
+	raftDir             = "raft" // Under the storage directory
+	raftApplyTimeout    = 10 * time.Second
+	raftTenantPrefix    = "tenant/" // Config entries holding tenant policies
+	raftKeyVersionHdr   = "X-FileBox-Key-Version"
+	raftLogKeyPrefix    = "l/" // Pebble keys of log entries, by big-endian index
+	raftStableKeyPrefix = "s/"
+)
+
+// Replicated commands
+const (
+	RaftSetKey       = "set-key"
+	RaftSetConfig    = "set-config"
+	RaftDeleteConfig = "delete-config"
+)
+
+var errNoRaftLeader = errors.New("metadata consensus has no leader; retry shortly")
+
+// KeyVersionError - A conditional key write whose expected version did not match
+type KeyVersionError struct {
+	Key      string
+	Expected uint64
+	Current  uint64 // 0 if the key does not exist
+}
+
+func (e *KeyVersionError) Error() string {
+	return fmt.Sprintf("key %q is at version %d, not %d", e.Key, e.Current, e.Expected)
+}
+
+// RaftConfig - Membership and addresses of this node in the Raft group
+type RaftConfig struct {
+	NodeID          string            `json:"node_id"` // HTTP address of this node, as peers reach it
+	BindAddr        string            `json:"bind_addr"`
+	AdvertiseAddr   string            `json:"advertise_addr"`
+	Peers           map[string]string `json:"peers,omitempty"` // Node ID -> Raft address, for bootstrapping
+	Bootstrap       bool              `json:"bootstrap"`
+	ConsistentReads bool              `json:"consistent_reads"`
+}
+
+// loadRaftConfig reads RAFT_ADDR, RAFT_ADVERTISE, RAFT_NODE_ID, RAFT_PEERS,
+// RAFT_BOOTSTRAP and RAFT_CONSISTENT_READS; nil unless RAFT_ADDR is set
+func loadRaftConfig() (*RaftConfig, error) {
+	bind := os.Getenv("RAFT_ADDR")
+	if bind == "" {
+		return nil, nil
+	}
+	config := &RaftConfig{
+		BindAddr:        bind,
+		AdvertiseAddr:   getEnvOrDefault("RAFT_ADVERTISE", bind),
+		NodeID:          os.Getenv("RAFT_NODE_ID"),
+		Peers:           make(map[string]string),
+		Bootstrap:       getEnvBool("RAFT_BOOTSTRAP", false),
+		ConsistentReads: getEnvBool("RAFT_CONSISTENT_READS", false),
+	}
+	if config.NodeID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		config.NodeID = net.JoinHostPort(hostname, getEnvOrDefault("PORT", "8080"))
+	}
+	if host, _, err := net.SplitHostPort(config.AdvertiseAddr); err != nil || host == "" || net.ParseIP(host).IsUnspecified() {
+		return nil, fmt.Errorf("RAFT_ADVERTISE %q must be a host:port peers can dial", config.AdvertiseAddr)
+	}
+	for _, entry := range strings.Split(os.Getenv("RAFT_PEERS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		id, address, ok := strings.Cut(entry, "=")
+		if !ok || id == "" || address == "" {
+			return nil, fmt.Errorf("RAFT_PEERS entries must be <http address>=<raft address>, got %q", entry)
+		}
+		config.Peers[id] = address
+	}
+	return config, nil
+}
+
+// raftCommand - One replicated change
+type raftCommand struct {
+	Op        string          `json:"op"`
+	Key       string          `json:"key"`
+	BlobID    string          `json:"blob_id,omitempty"`
+	IfVersion *uint64         `json:"if_version,omitempty"` // 0 requires the key not to exist
+	Value     json.RawMessage `json:"value,omitempty"`
+}
+
+// raftResult - Outcome of applying a command
+type raftResult struct {
+	Version  uint64 `json:"version"`            // Log index of the write
+	Current  uint64 `json:"current"`            // Key version found, when a condition failed
+	Conflict bool   `json:"conflict,omitempty"` // IfVersion did not match
+	Error    string `json:"error,omitempty"`
+}
+
+// NamespaceEntry - Where a named key points
+type NamespaceEntry struct {
+	Key       string    `json:"key"`
+	BlobID    string    `json:"blob_id"`
+	Version   uint64    `json:"version"` // Log index of the last write
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// namespaceFSM - The replicated state: named keys and configuration
+type namespaceFSM struct {
+	mu     sync.RWMutex
+	keys   map[string]NamespaceEntry
+	config map[string]json.RawMessage
+
+	onConfig func(key string, value json.RawMessage) // Called with nil when an entry is deleted
+}
+
+// fsmState - Snapshot of the replicated state
+type fsmState struct {
+	Keys   map[string]NamespaceEntry  `json:"keys"`
+	Config map[string]json.RawMessage `json:"config"`
+}
+
+// Apply implements raft.FSM
+func (f *namespaceFSM) Apply(entry *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return raftResult{Error: err.Error()}
+	}
+
+	f.mu.Lock()
+	switch cmd.Op {
+	case RaftSetKey:
+		current := f.keys[cmd.Key].Version
+		if cmd.IfVersion != nil && *cmd.IfVersion != current {
+			f.mu.Unlock()
+			return raftResult{Current: current, Conflict: true}
+		}
+		f.keys[cmd.Key] = NamespaceEntry{Key: cmd.Key, BlobID: cmd.BlobID, Version: entry.Index, UpdatedAt: entry.AppendedAt.UTC()}
+	case RaftSetConfig:
+		f.config[cmd.Key] = cmd.Value
+	case RaftDeleteConfig:
+		delete(f.config, cmd.Key)
+	default:
+		f.mu.Unlock()
+		return raftResult{Error: fmt.Sprintf("unknown command %q", cmd.Op)}
+	}
+	f.mu.Unlock()
+
+	if cmd.Op != RaftSetKey && f.onConfig != nil {
+		f.onConfig(cmd.Key, cmd.Value)
+	}
+	return raftResult{Version: entry.Index}
+}
+
+// Snapshot implements raft.FSM
+func (f *namespaceFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	state := fsmState{Keys: make(map[string]NamespaceEntry, len(f.keys)), Config: make(map[string]json.RawMessage, len(f.config))}
+	for key, entry := range f.keys {
+		state.Keys[key] = entry
+	}
+	for key, value := range f.config {
+		state.Config[key] = value
+	}
+	return &state, nil
+}
+
+// Restore implements raft.FSM
+func (f *namespaceFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+	var state fsmState
+	if err := json.NewDecoder(snapshot).Decode(&state); err != nil {
+		return err
+	}
+	if state.Keys == nil {
+		state.Keys = make(map[string]NamespaceEntry)
+	}
+	if state.Config == nil {
+		state.Config = make(map[string]json.RawMessage)
+	}
+
+	f.mu.Lock()
+	previous := f.config
+	f.keys, f.config = state.Keys, state.Config
+	f.mu.Unlock()
+
+	if f.onConfig != nil {
+		for key := range previous {
+			if _, kept := state.Config[key]; !kept {
+				f.onConfig(key, nil)
+			}
+		}
+		for key, value := range state.Config {
+			f.onConfig(key, value)
+		}
+	}
+	return nil
+}
+
+// Persist implements raft.FSMSnapshot
+func (s *fsmState) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release implements raft.FSMSnapshot
+func (s *fsmState) Release() {}
+
+// lookup returns a key's entry from the local state
+func (f *namespaceFSM) lookup(key string) (NamespaceEntry, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	entry, ok := f.keys[key]
+	return entry, ok
+}
+
+// withPrefix returns the local entries of keys starting with prefix
+func (f *namespaceFSM) withPrefix(prefix string) []NamespaceEntry {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var entries []NamespaceEntry
+	for key, entry := range f.keys {
+		if strings.HasPrefix(key, prefix) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// raftLogStore - Raft's log and stable store in a Pebble database
+type raftLogStore struct {
+	db *pebble.DB
+}
+
+func raftLogKey(index uint64) []byte {
+	key := make([]byte, len(raftLogKeyPrefix)+8)
+	copy(key, raftLogKeyPrefix)
+	binary.BigEndian.PutUint64(key[len(raftLogKeyPrefix):], index)
+	return key
+}
+
+// logBounds returns the smallest and largest log entry indexes
+func (s *raftLogStore) logBounds(last bool) (uint64, error) {
+	iter, err := s.db.NewIter(&pebble.IterOptions{LowerBound: raftLogKey(0), UpperBound: raftLogKey(math.MaxUint64)})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	valid := iter.First()
+	if last {
+		valid = iter.Last()
+	}
+	if !valid {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(iter.Key()[len(raftLogKeyPrefix):]), nil
+}
+
+// FirstIndex implements raft.LogStore
+func (s *raftLogStore) FirstIndex() (uint64, error) { return s.logBounds(false) }
+
+// LastIndex implements raft.LogStore
+func (s *raftLogStore) LastIndex() (uint64, error) { return s.logBounds(true) }
+
+// GetLog implements raft.LogStore
+func (s *raftLogStore) GetLog(index uint64, entry *raft.Log) error {
+	value, closer, err := s.db.Get(raftLogKey(index))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return raft.ErrLogNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	return json.Unmarshal(value, entry)
+}
+
+// StoreLog implements raft.LogStore
+func (s *raftLogStore) StoreLog(entry *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{entry})
+}
+
+// StoreLogs implements raft.LogStore
+func (s *raftLogStore) StoreLogs(entries []*raft.Log) error {
+	batch := s.db.NewBatch()
+	defer batch.Close()
+	for _, entry := range entries {
+		value, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := batch.Set(raftLogKey(entry.Index), value, nil); err != nil {
+			return err
+		}
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// DeleteRange implements raft.LogStore
+func (s *raftLogStore) DeleteRange(min, max uint64) error {
+	end := raftLogKey(math.MaxUint64)
+	if max < math.MaxUint64 {
+		end = raftLogKey(max + 1)
+	}
+	return s.db.DeleteRange(raftLogKey(min), end, pebble.Sync)
+}
+
+// Set implements raft.StableStore
+func (s *raftLogStore) Set(key, value []byte) error {
+	return s.db.Set(append([]byte(raftStableKeyPrefix), key...), value, pebble.Sync)
+}
+
+// Get implements raft.StableStore; raft expects "not found" for missing keys
+func (s *raftLogStore) Get(key []byte) ([]byte, error) {
+	value, closer, err := s.db.Get(append([]byte(raftStableKeyPrefix), key...))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, errors.New("not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	return bytes.Clone(value), nil
+}
+
+// SetUint64 implements raft.StableStore
+func (s *raftLogStore) SetUint64(key []byte, value uint64) error {
+	return s.Set(key, binary.BigEndian.AppendUint64(nil, value))
+}
+
+// GetUint64 implements raft.StableStore
+func (s *raftLogStore) GetUint64(key []byte) (uint64, error) {
+	value, err := s.Get(key)
+	if err != nil || len(value) != 8 {
+		return 0, nil
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+// raftMeta - This node's member of the Raft group
+type raftMeta struct {
+	config *RaftConfig
+	raft   *raft.Raft
+	fsm    *namespaceFSM
+}
+
+// startRaft joins or bootstraps the Raft group configured with RAFT_ADDR;
+// nil if it is unset
+func (fb *FileBox) startRaft() *raftMeta {
+	config, err := loadRaftConfig()
+	if err != nil {
+		log.Fatalf("Error configuring metadata consensus: %v", err)
+	}
+	if config == nil {
+		return nil
+	}
+
+	dir := filepath.Join(fb.storageDir, raftDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Error creating %s: %v", dir, err)
+	}
+	db, err := pebble.Open(filepath.Join(dir, "log"), &pebble.Options{})
+	if err != nil {
+		log.Fatalf("Error opening Raft log: %v", err)
+	}
+	store := &raftLogStore{db: db}
+
+	logger := hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Warn, Output: log.Writer()})
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(dir, 2, logger)
+	if err != nil {
+		log.Fatalf("Error opening Raft snapshots: %v", err)
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", config.AdvertiseAddr)
+	if err != nil {
+		log.Fatalf("Error resolving RAFT_ADVERTISE: %v", err)
+	}
+	transport, err := raft.NewTCPTransportWithLogger(config.BindAddr, advertise, 3, 10*time.Second, logger)
+	if err != nil {
+		log.Fatalf("Error listening for Raft on %s: %v", config.BindAddr, err)
+	}
+
+	fsm := &namespaceFSM{keys: make(map[string]NamespaceEntry), config: make(map[string]json.RawMessage), onConfig: fb.applyRaftConfig}
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(config.NodeID)
+	raftConfig.Logger = logger
+
+	existing, err := raft.HasExistingState(store, store, snapshots)
+	if err != nil {
+		log.Fatalf("Error reading Raft state: %v", err)
+	}
+	node, err := raft.NewRaft(raftConfig, fsm, store, store, snapshots, transport)
+	if err != nil {
+		log.Fatalf("Error starting Raft: %v", err)
+	}
+	if config.Bootstrap && !existing {
+		servers := []raft.Server{{ID: raftConfig.LocalID, Address: transport.LocalAddr()}}
+		for id, address := range config.Peers {
+			if id != config.NodeID {
+				servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(address)})
+			}
+		}
+		if err := node.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			log.Printf("Error bootstrapping Raft group: %v", err)
+		} else {
+			log.Printf("Bootstrapped Raft group of %d nodes", len(servers))
+		}
+	}
+	log.Printf("Metadata consensus on %s as %s (state restored: %v)", config.AdvertiseAddr, config.NodeID, existing)
+	return &raftMeta{config: config, raft: node, fsm: fsm}
+}
+
+// applyRaftConfig makes a committed configuration entry take effect on this node
+func (fb *FileBox) applyRaftConfig(key string, value json.RawMessage) {
+	tenant, ok := strings.CutPrefix(key, raftTenantPrefix)
+	if !ok {
+		return
+	}
+	if value == nil {
+		if _, err := fb.tenantPolicies.remove(tenant); err != nil {
+			log.Printf("Error saving tenant policies: %v", err)
+		}
+		return
+	}
+	var policy TenantPolicy
+	if err := json.Unmarshal(value, &policy); err != nil {
+		log.Printf("Ignoring replicated policy for tenant %q: %v", tenant, err)
+		return
+	}
+	if err := fb.tenantPolicies.set(tenant, policy); err != nil {
+		log.Printf("Error saving tenant policies: %v", err)
+	}
+}
+
+// leader returns the leader's HTTP address, or "" if there is none
+func (m *raftMeta) leader() string {
+	_, id := m.raft.LeaderWithID()
+	return string(id)
+}
+
+// propose commits a command through the leader, forwarding it if this
+// node is a follower
+func (fb *FileBox) propose(ctx context.Context, cmd raftCommand) (raftResult, error) {
+	var result raftResult
+	if fb.raft.raft.State() == raft.Leader {
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			return result, err
+		}
+		future := fb.raft.raft.Apply(data, raftApplyTimeout)
+		if err := future.Error(); err != nil {
+			if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+				return result, errNoRaftLeader
+			}
+			return result, err
+		}
+		result = future.Response().(raftResult)
+	} else {
+		leader := fb.raft.leader()
+		if leader == "" || leader == fb.raft.config.NodeID {
+			return result, errNoRaftLeader
+		}
+		if err := fb.forwardToLeader(ctx, leader, "POST", "/cluster/raft/apply", cmd, &result); err != nil {
+			return result, fmt.Errorf("%w (leader %s: %v)", errNoRaftLeader, leader, err)
+		}
+	}
+
+	if result.Error != "" {
+		return result, errors.New(result.Error)
+	}
+	if result.Conflict {
+		return result, &KeyVersionError{Key: cmd.Key, Expected: *cmd.IfVersion, Current: result.Current}
+	}
+	return result, nil
+}
+
+// forwardToLeader sends a signed request to the leader and decodes its answer
+func (fb *FileBox) forwardToLeader(ctx context.Context, leader, method, path string, body, v any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	ctx, cancel := context.WithTimeout(ctx, raftApplyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://%s%s", leader, path), reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := fb.replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errKeyNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+var errKeyNotFound = errors.New("key not found")
+
+// lookupKey resolves a named key from the replicated namespace. Consistent
+// reads confirm the leader still leads, asking it when this node follows.
+func (fb *FileBox) lookupKey(ctx context.Context, key string, consistent bool) (NamespaceEntry, bool, error) {
+	if !consistent {
+		entry, ok := fb.raft.fsm.lookup(key)
+		return entry, ok, nil
+	}
+	if fb.raft.raft.State() == raft.Leader {
+		if err := fb.raft.raft.VerifyLeader().Error(); err != nil {
+			return NamespaceEntry{}, false, errNoRaftLeader
+		}
+		entry, ok := fb.raft.fsm.lookup(key)
+		return entry, ok, nil
+	}
+
+	leader := fb.raft.leader()
+	if leader == "" || leader == fb.raft.config.NodeID {
+		return NamespaceEntry{}, false, errNoRaftLeader
+	}
+	var entry NamespaceEntry
+	err := fb.forwardToLeader(ctx, leader, "GET", "/cluster/raft/key/"+url.PathEscape(key), nil, &entry)
+	if errors.Is(err, errKeyNotFound) {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, fmt.Errorf("%w (leader %s: %v)", errNoRaftLeader, leader, err)
+	}
+	return entry, true, nil
+}
+
+// resolveKey finds the blob a named key points to: from the replicated
+// namespace with consensus, from the local index without
+func (fb *FileBox) resolveKey(r *http.Request, key string) (string, bool, error) {
+	if fb.raft == nil {
+		fb.fileLock.RLock()
+		defer fb.fileLock.RUnlock()
+		blobID, exists := fb.keys[key]
+		return blobID, exists, nil
+	}
+
+	consistent := fb.raft.config.ConsistentReads || r.URL.Query().Get("consistent") == "true"
+	entry, exists, err := fb.lookupKey(r.Context(), key, consistent)
+	return entry.BlobID, exists, err
+}
+
+// publishKey commits an acknowledged upload's, copy's or compose's named
+// key to the replicated namespace. X-FileBox-Key-Version makes the write
+// conditional: 0 requires a new key, anything else the key's current version.
+func (fb *FileBox) publishKey(r *http.Request, response *BlobResponse) error {
+	if fb.raft == nil || response.Key == "" {
+		return nil
+	}
+	cmd := raftCommand{Op: RaftSetKey, Key: response.Key, BlobID: response.ID}
+	if header := r.Header.Get(raftKeyVersionHdr); header != "" {
+		version, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", raftKeyVersionHdr, header)
+		}
+		cmd.IfVersion = &version
+	}
+
+	result, err := fb.propose(r.Context(), cmd)
+	if err != nil {
+		return err
+	}
+	response.KeyVersion = result.Version
+	return nil
+}
+
+// keyErrorStatus maps a failed key write or lookup to a status code
+func keyErrorStatus(err error) int {
+	var conflict *KeyVersionError
+	switch {
+	case errors.As(err, &conflict):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errNoRaftLeader):
+		return http.StatusServiceUnavailable
+	case strings.HasPrefix(err.Error(), "invalid "+raftKeyVersionHdr):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// proxyKeyRead passes a key read whose blob this node does not hold to a
+// replica owning the blob's machine ID. It returns false if this node
+// should serve the read itself.
+func (fb *FileBox) proxyKeyRead(w http.ResponseWriter, r *http.Request, blobID string) bool {
+	if fb.raft == nil {
+		return false
+	}
+	fb.fileLock.RLock()
+	_, _, held := fb.lookupBlob(blobID)
+	fb.fileLock.RUnlock()
+	fileID, _, err := parseBlobID(blobID)
+	if held || err != nil {
+		return false
+	}
+	fid, err := ParseFID(fileID)
+	if err != nil {
+		return false
+	}
+
+	for _, peer := range fb.replicas {
+		if fb.peerProtocol(r.Context(), peer).MachineID != fid.MachineID {
+			continue
+		}
+		proxy := &httputil.ReverseProxy{Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(&url.URL{Scheme: "http", Host: peer})
+			pr.Out.URL.Path, pr.Out.URL.RawPath = "/blob/"+blobID, ""
+			pr.SetXForwarded()
+		}}
+		proxy.ServeHTTP(w, r)
+		return true
+	}
+	return false
+}
+
+// RaftStatus - Response of GET /admin/raft
+type RaftStatus struct {
+	Config       RaftConfig        `json:"config"`
+	State        string            `json:"state"`
+	Leader       string            `json:"leader,omitempty"`
+	Servers      []raft.Server     `json:"servers"`
+	AppliedIndex uint64            `json:"applied_index"`
+	Keys         int               `json:"keys"`
+	ConfigKeys   []string          `json:"config_keys"`
+	Stats        map[string]string `json:"stats"`
+}
+
+// RaftPeerRequest - Body of POST /admin/raft/peers
+type RaftPeerRequest struct {
+	ID      string `json:"id"`      // HTTP address of the node
+	Address string `json:"address"` // Its RAFT_ADVERTISE address
+}
+
+// handleRaft serves GET /admin/raft, POST /admin/raft/peers and
+// DELETE /admin/raft/peers/{id}; membership changes go to the leader
+func (fb *FileBox) handleRaft(w http.ResponseWriter, r *http.Request) {
+	if fb.raft == nil {
+		http.Error(w, "Metadata consensus is not enabled (set RAFT_ADDR)", http.StatusNotFound)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/admin/raft")
+
+	switch {
+	case path == "" && r.Method == "GET":
+		status := RaftStatus{
+			Config:       *fb.raft.config,
+			State:        fb.raft.raft.State().String(),
+			Leader:       fb.raft.leader(),
+			Servers:      []raft.Server{},
+			AppliedIndex: fb.raft.raft.AppliedIndex(),
+			ConfigKeys:   []string{},
+			Stats:        fb.raft.raft.Stats(),
+		}
+		if future := fb.raft.raft.GetConfiguration(); future.Error() == nil {
+			status.Servers = future.Configuration().Servers
+		}
+		fb.raft.fsm.mu.RLock()
+		status.Keys = len(fb.raft.fsm.keys)
+		for key := range fb.raft.fsm.config {
+			status.ConfigKeys = append(status.ConfigKeys, key)
+		}
+		fb.raft.fsm.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case path == "/peers" && r.Method == "POST":
+		var req RaftPeerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" || req.Address == "" {
+			http.Error(w, "Body must be {\"id\": <http address>, \"address\": <raft address>}", http.StatusBadRequest)
+			return
+		}
+		if !fb.raftLeaderOnly(w) {
+			return
+		}
+		if err := fb.raft.raft.AddVoter(raft.ServerID(req.ID), raft.ServerAddress(req.Address), 0, raftApplyTimeout).Error(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Added %s (%s) to the Raft group", req.ID, req.Address)
+		w.WriteHeader(http.StatusNoContent)
+
+	case strings.HasPrefix(path, "/peers/") && r.Method == "DELETE":
+		if !fb.raftLeaderOnly(w) {
+			return
+		}
+		id := path[len("/peers/"):]
+		if err := fb.raft.raft.RemoveServer(raft.ServerID(id), 0, raftApplyTimeout).Error(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Removed %s from the Raft group", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// raftLeaderOnly answers 421 naming the leader when this node does not lead
+func (fb *FileBox) raftLeaderOnly(w http.ResponseWriter) bool {
+	if fb.raft.raft.State() == raft.Leader {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("Not the Raft leader; send this to %q", fb.raft.leader()), http.StatusMisdirectedRequest)
+	return false
+}
+
+// handleClusterRaftApply serves POST /cluster/raft/apply: a follower
+// forwarding a command to the leader
+func (fb *FileBox) handleClusterRaftApply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if fb.raft == nil || fb.raft.raft.State() != raft.Leader {
+		http.Error(w, "Not the Raft leader", http.StatusServiceUnavailable)
+		return
+	}
+	var cmd raftCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	future := fb.raft.raft.Apply(data, raftApplyTimeout)
+	if err := future.Error(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(future.Response().(raftResult))
+}
+
+// handleClusterRaftKey serves GET /cluster/raft/key/{key}: a consistent
+// read forwarded by a follower
+func (fb *FileBox) handleClusterRaftKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if fb.raft == nil || fb.raft.raft.State() != raft.Leader {
+		http.Error(w, "Not the Raft leader", http.StatusServiceUnavailable)
+		return
+	}
+	key := r.URL.Path[len("/cluster/raft/key/"):]
+	entry, exists, err := fb.lookupKey(r.Context(), key, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !exists {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
@@ -0,0 +1,104 @@
+// Parallel ranged S3 reads for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// RangeReadConfig - How large blobs are split across concurrent S3 GETs
+type RangeReadConfig struct {
+	Threshold   int64 // Blobs at least this large are fetched in parts
+	PartSize    int64
+	Concurrency int // Parts in flight per blob
+}
+
+// loadRangeReadConfig reads S3_PARALLEL_THRESHOLD, S3_PART_SIZE and S3_READ_CONCURRENCY
+func loadRangeReadConfig() RangeReadConfig {
+	cfg := RangeReadConfig{
+		Threshold:   getEnvInt("S3_PARALLEL_THRESHOLD", 10*1024*1024),
+		PartSize:    getEnvInt("S3_PART_SIZE", 4*1024*1024),
+		Concurrency: int(getEnvInt("S3_READ_CONCURRENCY", 4)),
+	}
+	if cfg.PartSize <= 0 {
+		log.Printf("Invalid S3_PART_SIZE %d, using 4MB", cfg.PartSize)
+		cfg.PartSize = 4 * 1024 * 1024
+	}
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	return cfg
+}
+
+// readS3Range fills dst with the object's bytes starting at offset. Large
+// ranges are split into parts fetched concurrently straight into dst.
+func (fb *FileBox) readS3Range(ctx context.Context, s3Key string, offset int64, dst []byte) error {
+	length := int64(len(dst))
+	if length < fb.rangeReads.Threshold || length <= fb.rangeReads.PartSize || fb.rangeReads.Concurrency == 1 {
+		return fb.getS3Range(ctx, s3Key, offset, dst)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parts := make(chan int64)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := 0; i < fb.rangeReads.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range parts {
+				end := min(start+fb.rangeReads.PartSize, length)
+				if err := fb.getS3Range(ctx, s3Key, offset+start, dst[start:end]); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel() // Stop the other parts
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for start := int64(0); start < length; start += fb.rangeReads.PartSize {
+		select {
+		case parts <- start:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(parts)
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+// getS3Range fills dst with one ranged GET
+func (fb *FileBox) getS3Range(ctx context.Context, s3Key string, offset int64, dst []byte) error {
+	resp, err := fb.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(fb.bucket),
+		Key:    aws.String(s3Key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(dst))-1)),
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.ReadFull(resp.Body, dst)
+	return err
+}
@@ -0,0 +1,223 @@
+// Sequential read detection and readahead for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// readStreamIdle is how long a container's read pattern is remembered without reads
+const readStreamIdle = time.Minute
+
+// readStream - Recent reads of one container
+type readStream struct {
+	next       int // Blob index a sequential reader would fetch next
+	streak     int // Consecutive sequential reads so far
+	prefetched int // Blobs below this index have already been read ahead
+	lastRead   time.Time
+}
+
+// readahead - Detects clients walking a container blob by blob and fetches
+// the following region before they ask for it
+type readahead struct {
+	trigger int   // Sequential reads before readahead starts
+	window  int64 // Bytes fetched ahead of the reader
+
+	mu      sync.Mutex
+	streams map[string]*readStream // Keyed by container file ID
+
+	triggered atomic.Int64
+	blobs     atomic.Int64
+	bytes     atomic.Int64
+}
+
+// loadReadahead reads READAHEAD_TRIGGER and READAHEAD_BYTES (0 disables readahead)
+func loadReadahead() *readahead {
+	return &readahead{
+		trigger: int(getEnvInt("READAHEAD_TRIGGER", 2)),
+		window:  getEnvInt("READAHEAD_BYTES", 4*1024*1024),
+		streams: make(map[string]*readStream),
+	}
+}
+
+// observe records a read of blob index in a container and returns the first
+// blob index that should be read ahead, or -1
+func (r *readahead) observe(fileID string, index int) int {
+	if r.window <= 0 {
+		return -1
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := timeNow()
+	for id, stream := range r.streams {
+		if now.Sub(stream.lastRead) > readStreamIdle {
+			delete(r.streams, id)
+		}
+	}
+
+	stream, ok := r.streams[fileID]
+	if !ok {
+		stream = &readStream{}
+		r.streams[fileID] = stream
+	}
+	if ok && index == stream.next {
+		stream.streak++
+	} else {
+		stream.streak = 1
+		stream.prefetched = 0
+	}
+	stream.next = index + 1
+	stream.lastRead = now
+
+	if stream.streak < r.trigger {
+		return -1
+	}
+	from := index + 1
+	if stream.prefetched > from {
+		from = stream.prefetched
+	}
+	return from
+}
+
+// markPrefetched records how far a container has been read ahead
+func (r *readahead) markPrefetched(fileID string, through int) {
+	r.mu.Lock()
+	if stream, ok := r.streams[fileID]; ok && through > stream.prefetched {
+		stream.prefetched = through
+	}
+	r.mu.Unlock()
+}
+
+// noteRead feeds a served blob into sequential read detection and starts a
+// readahead when the client is walking the container
+func (fb *FileBox) noteRead(blobID string) {
+	fileID, index, err := parseBlobID(blobID)
+	if err != nil {
+		return
+	}
+	from := fb.readahead.observe(fileID, index)
+	if from < 0 {
+		return
+	}
+
+	fb.fileLock.RLock()
+	containerFile, exists := fb.files.get(fileID)
+	var entries, blobs []BlobInfo
+	if exists {
+		entries = fb.containerBlobs(containerFile)
+	}
+	if from < len(entries) {
+		// Take blobs until the region covering them would exceed the window
+		var start, end int64
+		for _, blob := range entries[from:] {
+			if len(blob.Segments) > 0 || blob.Uncommitted {
+				continue // Composed blobs have no bytes here; uncommitted ones are not readable yet
+			}
+			blobStart, blobEnd := blob.Offset, blob.Offset+blob.Length
+			if len(blobs) > 0 {
+				blobStart, blobEnd = min(start, blobStart), max(end, blobEnd)
+				if blobEnd-blobStart > fb.readahead.window {
+					break
+				}
+			}
+			start, end = blobStart, blobEnd
+			blobs = append(blobs, blob)
+		}
+	}
+	fb.fileLock.RUnlock()
+	if len(blobs) == 0 {
+		return
+	}
+
+	// Claim the region now so concurrent reads do not fetch it twice
+	fb.readahead.markPrefetched(fileID, from+len(blobs))
+	go fb.prefetchBlobs(containerFile, blobs)
+}
+
+// prefetchBlobs fetches a run of blobs in one read. Local containers are
+// read through the page cache; S3-served containers are read with a single
+// ranged GET and split into the blob cache.
+func (fb *FileBox) prefetchBlobs(containerFile *ContainerFile, blobs []BlobInfo) {
+	start, end := blobs[0].Offset, blobs[0].Offset+blobs[0].Length
+	for _, blob := range blobs[1:] {
+		start, end = min(start, blob.Offset), max(end, blob.Offset+blob.Length)
+	}
+
+	fb.fileLock.RLock()
+	evicted, federated := containerFile.Evicted, containerFile.Federated
+	fb.fileLock.RUnlock()
+	if federated {
+		return // Reads go to the federated cluster, which does its own readahead
+	}
+
+	var err error
+	if evicted {
+		err = fb.prefetchFromS3(containerFile, blobs, start, end)
+	} else {
+		fb.fileLock.RLock()
+		filePath := containerFile.FilePath
+		fb.fileLock.RUnlock()
+		err = prefetchLocal(filePath, start, end)
+	}
+	if err != nil {
+		log.Printf("Readahead of %s failed: %v", containerFile.FID.String(), err)
+		return
+	}
+
+	fb.readahead.triggered.Add(1)
+	fb.readahead.blobs.Add(int64(len(blobs)))
+	fb.readahead.bytes.Add(end - start)
+}
+
+// prefetchLocal reads a region of a container file so the OS caches it
+func prefetchLocal(path string, start, end int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(io.Discard, io.NewSectionReader(file, start, end-start))
+	return err
+}
+
+// prefetchFromS3 fetches a run of blobs in one ranged GET and caches each one
+func (fb *FileBox) prefetchFromS3(containerFile *ContainerFile, blobs []BlobInfo, start, end int64) error {
+	if fb.cache.capacity <= 0 {
+		return nil // Nowhere to keep the data
+	}
+
+	resp, err := fb.s3Client.GetObject(withUsageTenant(context.Background(), containerFile.Tenant), &s3.GetObjectInput{
+		Bucket: aws.String(fb.bucket),
+		Key:    aws.String(fb.containerS3Key(containerFile)),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	region := make([]byte, end-start)
+	if _, err := io.ReadFull(resp.Body, region); err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		offset := blob.Offset - start
+		fb.cache.prefetched(blob.ID, append([]byte(nil), region[offset:offset+blob.Length]...))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Blob record index rebuilding for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"log"
+	"os"
+
+	"filebox/pkg/containerformat"
+)
+
+// Size of the header framing each blob record in a container file
+const recordHeaderSize = containerformat.HeaderSize
+
+// adoptTrailingRecords scans a container past its indexed size, adds every
+// complete record to the blob index and returns the number adopted. Callers
+// must not hold fb.fileLock; the container must not be receiving writes.
+func (fb *FileBox) adoptTrailingRecords(containerFile *ContainerFile, fileSize int64) int {
+	if fileSize <= containerFile.Size {
+		return 0
+	}
+
+	file, err := os.Open(containerFile.FilePath)
+	if err != nil {
+		log.Printf("Error scanning container %s: %v", containerFile.FID.String(), err)
+		return 0
+	}
+	defer file.Close()
+
+	records, end := containerformat.NewReader(file, fileSize).Scan(containerFile.Size)
+
+	fb.fileLock.Lock()
+	for _, rec := range records {
+		size := rec.Length
+		if containerFile.Encrypted {
+			size -= encryptedOverhead
+		}
+		blob := BlobInfo{
+			ID:     formatBlobID(containerFile.FID.String(), len(containerFile.Blobs)),
+			Offset: rec.Offset,
+			Length: rec.Length,
+			Size:   size,
+		}
+		setDigest(&blob, rec.Algorithm, rec.Digest)
+		containerFile.Blobs = append(containerFile.Blobs, blob)
+	}
+	containerFile.Size = end
+	fb.fileLock.Unlock()
+
+	if len(records) > 0 {
+		log.Printf("Rebuilt %d blob index entries for %s from record headers", len(records), containerFile.FID.String())
+	}
+	return len(records)
+}
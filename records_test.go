@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRebuildKeepsOverlappingUploadIDs lets a later upload finish before an
+// earlier one still writing to the same container, then rebuilds the index
+// from record headers alone: every ID must still return its own bytes
+func TestRebuildKeepsOverlappingUploadIDs(t *testing.T) {
+	dir := t.TempDir()
+	fb := newTestFileBox(t, dir)
+
+	// The first upload reserves its range, then stalls on a slow disk
+	fb.faults = newFaultInjector()
+	fb.faults.faults[FaultDisk] = &InjectedFault{Kind: FaultDisk, Delay: 200 * time.Millisecond}
+	first := []byte("written first, finished last")
+	type result struct {
+		resp *BlobResponse
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := fb.AddBlob(first, BlobOptions{})
+		done <- result{resp, err}
+	}()
+	for reserved := false; !reserved; {
+		time.Sleep(time.Millisecond)
+		fb.fileLock.Lock()
+		for _, containerFile := range fb.files.all() {
+			reserved = reserved || containerFile.Size > 0
+		}
+		fb.fileLock.Unlock()
+	}
+
+	// The second reserves the next range and finishes while the first waits
+	fb.faults.mu.Lock()
+	delete(fb.faults.faults, FaultDisk)
+	fb.faults.mu.Unlock()
+	second := []byte("written second, finished first")
+	secondResp, err := fb.AddBlob(second, BlobOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstResult := <-done
+	if firstResult.err != nil {
+		t.Fatal(firstResult.err)
+	}
+	if firstResult.resp.FileID != secondResp.FileID {
+		t.Fatalf("uploads went to containers %s and %s, want one", firstResult.resp.FileID, secondResp.FileID)
+	}
+	blobs := map[string][]byte{firstResult.resp.ID: first, secondResp.ID: second}
+
+	// Lose every manifest, so the restart numbers records in file order
+	fb.meta.Close()
+	if err := os.RemoveAll(filepath.Join(dir, manifestDirName)); err != nil {
+		t.Fatal(err)
+	}
+	fb = newTestFileBox(t, dir)
+
+	for blobID, want := range blobs {
+		got, err := fb.GetBlob(context.Background(), blobID)
+		if err != nil {
+			t.Errorf("reading %s after the rebuild: %v", blobID, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s returned %q after the rebuild, want %q", blobID, got, want)
+		}
+	}
+}
+
+// TestRebuildRefusesIndexOnlyEntries loses the manifest of a container
+// holding a copy or a composed blob: the restart must quarantine it rather
+// than hand the record after that entry its ID
+func TestRebuildRefusesIndexOnlyEntries(t *testing.T) {
+	entries := map[string]func(fb *FileBox, sourceID string) (*BlobResponse, error){
+		"copy": func(fb *FileBox, sourceID string) (*BlobResponse, error) {
+			return fb.CopyBlob(sourceID, BlobOptions{})
+		},
+		"compose": func(fb *FileBox, sourceID string) (*BlobResponse, error) {
+			return fb.ComposeBlob([]string{sourceID, sourceID}, BlobOptions{})
+		},
+	}
+	for name, add := range entries {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			fb := newTestFileBox(t, dir)
+
+			source, err := fb.AddBlob([]byte("source"), BlobOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			indexOnly, err := add(fb, source.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			later, err := fb.AddBlob([]byte("uploaded after the "+name), BlobOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if indexOnly.FileID != later.FileID {
+				t.Fatalf("%s and later upload went to containers %s and %s, want one", name, indexOnly.FileID, later.FileID)
+			}
+
+			fb.meta.Close()
+			if err := os.RemoveAll(filepath.Join(dir, manifestDirName)); err != nil {
+				t.Fatal(err)
+			}
+			fb = newTestFileBox(t, dir)
+
+			if refused := fb.recovery.RebuildsRefused; len(refused) != 1 || refused[0] != later.FileID {
+				t.Errorf("rebuilds refused: %v, want [%s]", refused, later.FileID)
+			}
+			for _, blobID := range []string{source.ID, indexOnly.ID, later.ID} {
+				var quarantined *QuarantinedError
+				if _, err := fb.GetBlob(context.Background(), blobID); !errors.As(err, &quarantined) {
+					t.Errorf("reading %s after the restart returned %v, want a quarantine error", blobID, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Startup recovery report for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ForeignFile - A container file in the storage directory owned by another machine
+type ForeignFile struct {
+	FileID    string `json:"file_id"`
+	MachineID uint32 `json:"machine_id"`
+	Size      int64  `json:"size"`
+	Action    string `json:"action"` // The FOREIGN_FILES policy applied
+}
+
+// RecoveryReport - What startup recovery found in the storage directory
+type RecoveryReport struct {
+	Started          time.Time     `json:"started"`
+	Duration         time.Duration `json:"duration"`
+	ContainersFound  int           `json:"containers_found"`  // Container files owned by this node
+	ManifestsLoaded  int           `json:"manifests_loaded"`  // Containers whose blob index came from metadata
+	FromCheckpoint   int           `json:"from_checkpoint"`   // Of those, read from the metadata checkpoint instead of the store
+	IndexesRebuilt   []string      `json:"indexes_rebuilt"`   // Containers with no manifest, indexed from record headers
+	RebuildsRefused  []string      `json:"rebuilds_refused"`  // Containers with no manifest holding copies or composed blobs; quarantined
+	RecordsReplayed  int           `json:"records_replayed"`  // Blobs written after the manifest was last saved, or left uncommitted with a complete record
+	AbortedUploads   []string      `json:"aborted_uploads"`   // Uncommitted blobs whose record did not survive; never readable
+	TornWrites       []TornWrite   `json:"torn_writes"`       // Unindexed bytes at the end of a container
+	EvictedRecovered int           `json:"evicted_recovered"` // Containers only present in S3
+	Foreign          []ForeignFile `json:"foreign"`           // Files created by other machines
+	InvalidFiles     []string      `json:"invalid_files"`     // Names that are not FIDs
+	LostContainers   []string      `json:"lost_containers"`   // Containers on an unavailable volume, read from S3 or repaired
+	UploadsQueued    int           `json:"uploads_queued"`
+	Fsck             *FsckReport   `json:"fsck,omitempty"` // Present when started with --fsck
+}
+
+// newRecoveryReport starts an empty report
+func newRecoveryReport() *RecoveryReport {
+	return &RecoveryReport{
+		Started:         timeNow().UTC(),
+		IndexesRebuilt:  []string{},
+		RebuildsRefused: []string{},
+		AbortedUploads:  []string{},
+		TornWrites:      []TornWrite{},
+		Foreign:         []ForeignFile{},
+		InvalidFiles:    []string{},
+		LostContainers:  []string{},
+	}
+}
+
+// log summarizes the recovery, listing anything that needs attention
+func (r *RecoveryReport) log() {
+	log.Printf("Recovery: %d containers (%d from manifests, %d of them via the checkpoint, %d indexes rebuilt, %d records replayed), %d evicted, %d uploads queued in %s",
+		r.ContainersFound, r.ManifestsLoaded, r.FromCheckpoint, len(r.IndexesRebuilt), r.RecordsReplayed, r.EvictedRecovered, r.UploadsQueued, r.Duration)
+	for _, torn := range r.TornWrites {
+		log.Printf("Recovery: container %s has %d unindexed bytes after offset %d (torn write?)",
+			torn.FileID, torn.FileSize-torn.ValidSize, torn.ValidSize)
+	}
+	for _, fileID := range r.RebuildsRefused {
+		log.Printf("Recovery: quarantined %s: %s", fileID, indexOnlyRebuildReason)
+	}
+	if len(r.AbortedUploads) > 0 {
+		log.Printf("Recovery: %d uploads never committed and their records are incomplete", len(r.AbortedUploads))
+	}
+	for _, foreign := range r.Foreign {
+		log.Printf("Recovery: %s created by machine %d (%d bytes): %s", foreign.FileID, foreign.MachineID, foreign.Size, foreign.Action)
+	}
+	if len(r.LostContainers) > 0 {
+		log.Printf("Recovery: %d containers were on an unavailable volume", len(r.LostContainers))
+	}
+	for _, name := range r.InvalidFiles {
+		log.Printf("Recovery: ignored %s (not a FID)", name)
+	}
+}
+
+// handleRecovery serves GET /admin/recovery
+func (fb *FileBox) handleRecovery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.recovery)
+}
@@ -0,0 +1,162 @@
+// Container registry and per-container locks for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Locking works at two levels. fb.fileLock still guards the global indexes
+// (keys, tags, segment references) and every container field, but the
+// fields the upload and download paths touch on each request (Size, Blobs
+// and writers) are changed under a read hold of fb.fileLock plus the
+// container's own lock. Uploads to different containers therefore no longer
+// wait for each other, and downloads only wait for the container they read.
+//
+// The rules that follow:
+//   - Size, Blobs, writers and OpSequence may be changed with fb.fileLock held
+//     exclusively, or with a read hold plus the container's lock.
+//   - They may be read with fb.fileLock held exclusively, or with a read hold
+//     plus the container's lock held for reading.
+//   - Every other field is changed only with fb.fileLock held exclusively.
+//   - fb.fileLock is always taken before a container's lock, and a
+//     container's lock is never held while taking another's.
+//
+// Only appends, and filling in an uncommitted entry, change Blobs without
+// the exclusive lock. Readers skip uncommitted entries, so an entry read
+// under a container's lock stays valid after it is released.
+
+// registryShards is how many independently locked maps the registry is split into
+const registryShards = 32
+
+// containerRegistry - The containers this node holds, by ID. It is safe for
+// concurrent use; lookups in different shards never contend.
+type containerRegistry struct {
+	shards [registryShards]registryShard
+	locks  sync.Map // *ContainerFile -> *sync.RWMutex
+}
+
+type registryShard struct {
+	mu    sync.RWMutex
+	files map[string]*ContainerFile
+}
+
+// shard returns the shard holding fileID
+func (r *containerRegistry) shard(fileID string) *registryShard {
+	h := fnv.New32a()
+	h.Write([]byte(fileID))
+	return &r.shards[h.Sum32()%registryShards]
+}
+
+// get returns the container with the given ID
+func (r *containerRegistry) get(fileID string) (*ContainerFile, bool) {
+	shard := r.shard(fileID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	containerFile, exists := shard.files[fileID]
+	return containerFile, exists
+}
+
+// put registers a container under its ID, replacing any held before
+func (r *containerRegistry) put(containerFile *ContainerFile) {
+	fileID := containerFile.FID.String()
+	shard := r.shard(fileID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if shard.files == nil {
+		shard.files = make(map[string]*ContainerFile)
+	}
+	if previous, exists := shard.files[fileID]; exists && previous != containerFile {
+		r.locks.Delete(previous)
+	}
+	shard.files[fileID] = containerFile
+}
+
+// remove forgets the container with the given ID
+func (r *containerRegistry) remove(fileID string) {
+	shard := r.shard(fileID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if containerFile, exists := shard.files[fileID]; exists {
+		r.locks.Delete(containerFile)
+		delete(shard.files, fileID)
+	}
+}
+
+// len returns how many containers are registered
+func (r *containerRegistry) len() int {
+	n := 0
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mu.RLock()
+		n += len(shard.files)
+		shard.mu.RUnlock()
+	}
+	return n
+}
+
+// all returns the registered containers in no particular order. Containers
+// registered or removed while it runs may or may not be included.
+func (r *containerRegistry) all() []*ContainerFile {
+	var files []*ContainerFile
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mu.RLock()
+		for _, containerFile := range shard.files {
+			files = append(files, containerFile)
+		}
+		shard.mu.RUnlock()
+	}
+	return files
+}
+
+// lock returns a container's own lock
+func (r *containerRegistry) lock(containerFile *ContainerFile) *sync.RWMutex {
+	if mu, ok := r.locks.Load(containerFile); ok {
+		return mu.(*sync.RWMutex)
+	}
+	mu, _ := r.locks.LoadOrStore(containerFile, new(sync.RWMutex))
+	return mu.(*sync.RWMutex)
+}
+
+// containerBlobs returns a container's index entries. They stay valid for
+// as long as fb.fileLock is held. Callers must hold fb.fileLock.
+func (fb *FileBox) containerBlobs(containerFile *ContainerFile) []BlobInfo {
+	mu := fb.files.lock(containerFile)
+	mu.RLock()
+	defer mu.RUnlock()
+	return containerFile.Blobs
+}
+
+// containerSize returns how many bytes of a container are reserved.
+// Callers must hold fb.fileLock.
+func (fb *FileBox) containerSize(containerFile *ContainerFile) int64 {
+	mu := fb.files.lock(containerFile)
+	mu.RLock()
+	defer mu.RUnlock()
+	return containerFile.Size
+}
+
+// blobEntry returns a container's committed index entry at blobIndex.
+// Callers must hold fb.fileLock.
+func (fb *FileBox) blobEntry(containerFile *ContainerFile, blobIndex int) (BlobInfo, bool) {
+	mu := fb.files.lock(containerFile)
+	mu.RLock()
+	defer mu.RUnlock()
+	if blobIndex < 0 || blobIndex >= len(containerFile.Blobs) || containerFile.Blobs[blobIndex].Uncommitted {
+		return BlobInfo{}, false
+	}
+	return containerFile.Blobs[blobIndex], true
+}
+
+// containerContents returns a container's Size and Blobs as of one moment.
+// Callers must hold fb.fileLock.
+func (fb *FileBox) containerContents(containerFile *ContainerFile) (int64, []BlobInfo) {
+	mu := fb.files.lock(containerFile)
+	mu.RLock()
+	defer mu.RUnlock()
+	return containerFile.Size, containerFile.Blobs
+}
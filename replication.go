@@ -0,0 +1,372 @@
+// Replication batching and compression for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"filebox/pkg/containerformat"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// replicateQueueLength bounds the blobs waiting for one replica; writers
+// block once it is full
+const replicateQueueLength = 1024
+
+// ReplicationConfig - How records are sent to replicas
+type ReplicationConfig struct {
+	Compress   bool  // zstd-compress request bodies and streams for peers that support it
+	BatchBytes int64 // Stop adding blobs to a request past this size; 0 sends one blob per request
+	BatchBlobs int   // Most blobs in one request
+	Senders    int   // Requests in flight per replica
+
+	StreamAddr   string // gRPC listener for replication streams from peers; empty disables streaming
+	StreamWindow int    // Records sent on a stream but not yet acknowledged
+}
+
+// loadReplicationConfig reads REPLICATION_COMPRESSION, REPLICATION_BATCH_BYTES,
+// REPLICATION_BATCH_BLOBS, REPLICATION_SENDERS, REPLICATION_STREAM_ADDR and
+// REPLICATION_STREAM_WINDOW
+func loadReplicationConfig() ReplicationConfig {
+	config := ReplicationConfig{
+		Compress:   getEnvBool("REPLICATION_COMPRESSION", true),
+		BatchBytes: getEnvInt("REPLICATION_BATCH_BYTES", 256*1024),
+		BatchBlobs: int(max(getEnvInt("REPLICATION_BATCH_BLOBS", 64), 1)),
+		Senders:    int(max(getEnvInt("REPLICATION_SENDERS", 4), 1)),
+
+		StreamAddr:   getEnvOrDefault("REPLICATION_STREAM_ADDR", ":9080"),
+		StreamWindow: int(max(getEnvInt("REPLICATION_STREAM_WINDOW", 64), 1)),
+	}
+	if config.StreamAddr == "off" {
+		config.StreamAddr = ""
+	}
+	return config
+}
+
+// replicationItem - A record waiting to be sent to one replica
+type replicationItem struct {
+	containerFile *ContainerFile
+	data          []byte
+	offset        int64
+	length        int64
+	seq, seqBase  uint64 // Per-container operation number and the container's first; 0 for replays
+	done          chan<- error
+	sentAt        time.Time // When a sender picked it up, for peer latency
+}
+
+// replicaEntry - Where one record of a batch goes on the replica
+type replicaEntry struct {
+	FileID     string `json:"file_id"`
+	Offset     int64  `json:"offset"`
+	Length     int64  `json:"length"`
+	Tenant     string `json:"tenant,omitempty"`
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+	KeyID      string `json:"key_id,omitempty"`
+	Seq        uint64 `json:"seq,omitempty"`      // Per-container operation number; 0 if unnumbered
+	SeqBase    uint64 `json:"seq_base,omitempty"` // The container's first operation number
+	Checksum   string `json:"checksum,omitempty"` // CRC32-C of the record bytes; empty from older senders
+}
+
+// replicaChecksum is the checksum replicated records are sent with, as 8 hex digits
+func replicaChecksum(data []byte) string {
+	return fmt.Sprintf("%08x", containerformat.Checksum(data))
+}
+
+// verifyReplicaPayload refuses a record whose bytes do not match the length
+// and checksum its sender declared, so a transfer corrupted on the way is
+// never written
+func verifyReplicaPayload(entry replicaEntry, data []byte) error {
+	if int64(len(data)) != entry.Length {
+		return fmt.Errorf("record declares %d bytes but carries %d", entry.Length, len(data))
+	}
+	if entry.Checksum != "" && entry.Checksum != replicaChecksum(data) {
+		return fmt.Errorf("record checksum %s does not match its bytes (%s)", entry.Checksum, replicaChecksum(data))
+	}
+	return nil
+}
+
+// replicationStats - Traffic sent to one replica since startup
+type replicationStats struct {
+	requests     atomic.Int64
+	blobs        atomic.Int64
+	payloadBytes atomic.Int64 // Request bodies before compression
+	wireBytes    atomic.Int64 // Request bodies as sent
+}
+
+// replicator - Per-replica send queues, streams and traffic counters
+type replicator struct {
+	config  ReplicationConfig
+	queues  map[string]chan *replicationItem
+	streams map[string]*peerStream
+	stats   map[string]*replicationStats
+	encoder *zstd.Encoder // EncodeAll is safe for concurrent use
+
+	queuedBytes atomic.Int64 // Record bytes queued or in flight to any replica, for admission control
+}
+
+func newReplicator(config ReplicationConfig, replicas []string) *replicator {
+	encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	r := &replicator{
+		config:  config,
+		queues:  make(map[string]chan *replicationItem, len(replicas)),
+		streams: make(map[string]*peerStream, len(replicas)),
+		stats:   make(map[string]*replicationStats, len(replicas)),
+		encoder: encoder,
+	}
+	for _, replica := range replicas {
+		r.queues[replica] = make(chan *replicationItem, replicateQueueLength)
+		r.stats[replica] = &replicationStats{}
+		r.streams[replica] = newPeerStream(replica, config.StreamWindow)
+	}
+	return r
+}
+
+// startReplicationSenders starts the senders draining each replica's queue
+func (fb *FileBox) startReplicationSenders() {
+	for replica, queue := range fb.replication.queues {
+		for i := 0; i < fb.replication.config.Senders; i++ {
+			go fb.runReplicationSender(replica, queue)
+		}
+	}
+}
+
+// runReplicationSender sends queued records to a replica, on its gRPC stream
+// when it has one. Otherwise a record is posted as soon as a sender is free;
+// records queued while all senders were busy go together in the next
+// request, so small blobs are batched only under load.
+func (fb *FileBox) runReplicationSender(host string, queue chan *replicationItem) {
+	for item := range queue {
+		fb.sendReplicationItem(host, queue, item)
+	}
+}
+
+// sendReplicationItem sends one record taken from a replica's queue, with
+// any records queued behind it when it goes in a batch
+func (fb *FileBox) sendReplicationItem(host string, queue chan *replicationItem, item *replicationItem) {
+	config := fb.replication.config
+	// A peer behind an open breaker gets hints instead, replayed once it recovers
+	if !fb.health.allow(host) {
+		fb.health.hint(host, item.containerFile.FID.String(), item.offset, item.length)
+		fb.replication.queuedBytes.Add(-item.length)
+		item.done <- errCircuitOpen
+		return
+	}
+
+	fb.replicationLimiter().wait(item.length)
+	item.sentAt = timeNow()
+	if fb.streamRecord(host, item) {
+		return
+	}
+
+	batch := []*replicationItem{item}
+	size := item.length
+	if config.BatchBytes > 0 && size < config.BatchBytes &&
+		fb.peerProtocol(context.Background(), host).supports(CapBatch) {
+	collect:
+		for len(batch) < config.BatchBlobs && size < config.BatchBytes {
+			select {
+			case next := <-queue:
+				fb.replicationLimiter().wait(next.length)
+				next.sentAt = timeNow()
+				batch = append(batch, next)
+				size += next.length
+			default:
+				break collect
+			}
+		}
+	}
+
+	var err error
+	if len(batch) == 1 {
+		err = fb.sendBlobToReplica(host, item.containerFile, item.data, item.offset, item.length, item.seq, item.seqBase)
+	} else {
+		err = fb.sendBatchToReplica(host, batch)
+	}
+	for _, item := range batch {
+		fb.finishReplication(host, item, err)
+	}
+}
+
+// finishReplication records a replica's answer for a record and passes it
+// to the writer; records the replica missed are hinted for a later replay
+func (fb *FileBox) finishReplication(host string, item *replicationItem, err error) {
+	fb.health.record(host, err, timeNow().Sub(item.sentAt))
+	if err != nil {
+		log.Printf("Failed to replicate blob to %s: %v", host, err)
+		fb.health.hint(host, item.containerFile.FID.String(), item.offset, item.length)
+	} else {
+		log.Printf("Successfully replicated blob to %s", host)
+		fb.recordReplicaAck(item.containerFile, host, item.offset+item.length)
+	}
+	fb.replication.queuedBytes.Add(-item.length)
+	item.done <- err
+}
+
+// replicaEntryFor describes a record of a container for the replica
+func (fb *FileBox) replicaEntryFor(containerFile *ContainerFile, data []byte, offset, length int64, seq, seqBase uint64) replicaEntry {
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+
+	return replicaEntry{
+		FileID:     containerFile.FID.String(),
+		Offset:     offset,
+		Length:     length,
+		Tenant:     containerFile.Tenant,
+		WrappedKey: containerFile.WrappedKey,
+		KeyID:      containerFile.KeyID,
+		Seq:        seq,
+		SeqBase:    seqBase,
+		Checksum:   replicaChecksum(data),
+	}
+}
+
+// sendBatchToReplica sends several records in one request: a "batch" field
+// lists their entries and the "blob" parts follow in the same order
+func (fb *FileBox) sendBatchToReplica(host string, batch []*replicationItem) error {
+	protocol := fb.peerProtocol(context.Background(), host)
+	if protocol.Incompatible {
+		return fmt.Errorf("replica %s: %s", host, protocol.Error)
+	}
+
+	entries := make([]replicaEntry, len(batch))
+	for i, item := range batch {
+		entries[i] = fb.replicaEntryFor(item.containerFile, item.data, item.offset, item.length, item.seq, item.seqBase)
+	}
+	entriesJSON, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	writer.WriteField("host_id", fb.hostID)
+	writer.WriteField("machine_id", fmt.Sprintf("%d", fb.machineID))
+	writer.WriteField("batch", string(entriesJSON))
+	for _, item := range batch {
+		part, err := writer.CreateFormFile("blob", "data")
+		if err != nil {
+			return err
+		}
+		part.Write(item.data)
+	}
+	writer.Close()
+
+	return fb.postReplicate(host, protocol, buf.Bytes(), writer.FormDataContentType(), len(batch))
+}
+
+// postReplicate sends a /replicate request body, compressing it when the
+// peer supports zstd and compression actually shrinks it
+func (fb *FileBox) postReplicate(host string, protocol *PeerProtocol, body []byte, contentType string, blobs int) error {
+	payloadBytes := len(body)
+	encoding := ""
+	if fb.replication.config.Compress && protocol.supports(CapZstd) {
+		if compressed := fb.replication.encoder.EncodeAll(body, nil); len(compressed) < len(body) {
+			body, encoding = compressed, "zstd"
+		}
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/replicate", host), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(protocolHeader, strconv.Itoa(protocol.sendVersion()))
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	resp, err := fb.replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if stats := fb.replication.stats[host]; stats != nil {
+		stats.requests.Add(1)
+		stats.blobs.Add(int64(blobs))
+		stats.payloadBytes.Add(int64(payloadBytes))
+		stats.wireBytes.Add(int64(len(body)))
+	}
+
+	if resp.StatusCode == http.StatusUpgradeRequired {
+		fb.forgetPeerProtocol(host) // The peer changed versions; shake hands again next time
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("replication failed: %s", string(body))
+	}
+	return nil
+}
+
+// decodeReplicateBody undoes the Content-Encoding of a /replicate request
+func decodeReplicateBody(r *http.Request) (func(), error) {
+	switch r.Header.Get("Content-Encoding") {
+	case "":
+		return func() {}, nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		r.Body = io.NopCloser(decoder)
+		r.Header.Del("Content-Encoding")
+		return decoder.Close, nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", r.Header.Get("Content-Encoding"))
+	}
+}
+
+// handleReplicateBatch stores every record of a batched /replicate request
+func (fb *FileBox) handleReplicateBatch(w http.ResponseWriter, r *http.Request) {
+	var entries []replicaEntry
+	if err := json.Unmarshal([]byte(r.FormValue("batch")), &entries); err != nil {
+		http.Error(w, "Invalid batch", http.StatusBadRequest)
+		return
+	}
+	parts := r.MultipartForm.File["blob"]
+	if len(parts) != len(entries) {
+		http.Error(w, fmt.Sprintf("Batch lists %d entries but carries %d blobs", len(entries), len(parts)), http.StatusBadRequest)
+		return
+	}
+
+	hostID := r.FormValue("host_id")
+	if err := fb.checkSenderMachine(hostID, r.FormValue("machine_id")); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	for i, entry := range entries {
+		file, err := parts[i].Open()
+		if err != nil {
+			http.Error(w, "Error getting blob", http.StatusBadRequest)
+			return
+		}
+		blobData, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			http.Error(w, "Error reading blob data", http.StatusBadRequest)
+			return
+		}
+		if status, err := fb.storeReplica(auditEventFor(r, AuditReplicate), hostID, entry, blobData); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// testForeignFID is a container of machine 99, which test nodes (machine 1) hold as a replica
+const testForeignFID = "000000636ad318d2000000017a8fb45f"
+
+// postReplica sends one record to a node's /replicate as a peer would
+func postReplica(t *testing.T, fb *FileBox, fileID string, offset int64, data []byte, checksum string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("blob", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	writer.WriteField("file_id", fileID)
+	writer.WriteField("offset", strconv.FormatInt(offset, 10))
+	writer.WriteField("length", strconv.Itoa(len(data)))
+	writer.WriteField("host_id", "peer")
+	writer.WriteField("machine_id", "99")
+	if checksum != "" {
+		writer.WriteField("checksum", checksum)
+	}
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/replicate", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	fb.handleReplicate(rec, req)
+	return rec
+}
+
+// TestReplicateRetryIsIdempotent sends a record twice, then different bytes
+// for the same place in the container
+func TestReplicateRetryIsIdempotent(t *testing.T) {
+	fb := newTestFileBox(t, t.TempDir())
+	record := []byte("first record of the container")
+
+	if rec := postReplica(t, fb, testForeignFID, 0, record, ""); rec.Code != http.StatusOK {
+		t.Fatalf("first write got %d: %s", rec.Code, rec.Body)
+	}
+	containerFile, ok := fb.files.get(testForeignFID)
+	if !ok {
+		t.Fatal("container not registered after the first write")
+	}
+	written := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(containerFile.FilePath, written, written); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := postReplica(t, fb, testForeignFID, 0, record, ""); rec.Code != http.StatusOK {
+		t.Fatalf("retry got %d: %s", rec.Code, rec.Body)
+	}
+	stat, err := os.Stat(containerFile.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.ModTime().Equal(written) {
+		t.Error("the retry rewrote the container file")
+	}
+
+	different := bytes.Clone(record)
+	different[0] ^= 0xff
+	if rec := postReplica(t, fb, testForeignFID, 0, different, ""); rec.Code != http.StatusConflict {
+		t.Fatalf("different bytes for the same record got %d, want 409: %s", rec.Code, rec.Body)
+	}
+	data, err := os.ReadFile(containerFile.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, record) {
+		t.Errorf("container holds %q after the refused write, want %q", data, record)
+	}
+}
+
+// postReplicaBatch sends records to a node's /replicate in one batched request
+func postReplicaBatch(t *testing.T, fb *FileBox, entries []replicaEntry, data [][]byte) *httptest.ResponseRecorder {
+	t.Helper()
+	entriesJSON, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("host_id", "peer")
+	writer.WriteField("machine_id", "99")
+	writer.WriteField("batch", string(entriesJSON))
+	for _, record := range data {
+		part, err := writer.CreateFormFile("blob", "data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(record)
+	}
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/replicate", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	fb.handleReplicate(rec, req)
+	return rec
+}
+
+// testServerStream - A replication stream fed from a list of records
+type testServerStream struct {
+	ctx     context.Context
+	records []*streamRecord
+	acks    []streamAck
+}
+
+func (s *testServerStream) SetHeader(metadata.MD) error  { return nil }
+func (s *testServerStream) SendHeader(metadata.MD) error { return nil }
+func (s *testServerStream) SetTrailer(metadata.MD)       {}
+func (s *testServerStream) Context() context.Context     { return s.ctx }
+
+func (s *testServerStream) SendMsg(m any) error {
+	s.acks = append(s.acks, *m.(*streamAck))
+	return nil
+}
+
+func (s *testServerStream) RecvMsg(m any) error {
+	if len(s.records) == 0 {
+		return io.EOF
+	}
+	*m.(*streamRecord), s.records = *s.records[0], s.records[1:]
+	return nil
+}
+
+// streamReplica sends one record to a node over a replication stream and
+// returns the HTTP status it was refused with, or 200
+func streamReplica(t *testing.T, fb *FileBox, entry replicaEntry, data []byte) int {
+	t.Helper()
+	stream := &testServerStream{
+		ctx:     metadata.NewIncomingContext(context.Background(), metadata.Pairs(streamHostKey, "peer", streamMachineKey, "99")),
+		records: []*streamRecord{{Seq: 1, Entry: entry, Data: data}},
+	}
+	if err := fb.handleReplicationStream(stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.acks) != 1 {
+		t.Fatalf("got %d acks for one record", len(stream.acks))
+	}
+	if ack := stream.acks[0]; ack.Error != "" {
+		return ack.Status
+	}
+	return http.StatusOK
+}
+
+// TestReplicateRefusesCorruptRecord flips one byte of a record after its
+// checksum was computed and sends it over each replication path
+func TestReplicateRefusesCorruptRecord(t *testing.T) {
+	record := []byte("a record damaged on its way to the replica")
+	checksum := replicaChecksum(record)
+	corrupt := bytes.Clone(record)
+	corrupt[len(corrupt)/2] ^= 0x01
+	entry := replicaEntry{FileID: testForeignFID, Offset: 0, Length: int64(len(record)), Checksum: checksum}
+
+	paths := []struct {
+		name string
+		send func(t *testing.T, fb *FileBox, data []byte) int
+	}{
+		{"form", func(t *testing.T, fb *FileBox, data []byte) int {
+			return postReplica(t, fb, testForeignFID, 0, data, checksum).Code
+		}},
+		{"batch", func(t *testing.T, fb *FileBox, data []byte) int {
+			return postReplicaBatch(t, fb, []replicaEntry{entry}, [][]byte{data}).Code
+		}},
+		{"stream", func(t *testing.T, fb *FileBox, data []byte) int {
+			return streamReplica(t, fb, entry, data)
+		}},
+	}
+	for _, path := range paths {
+		t.Run(path.name, func(t *testing.T) {
+			fb := newTestFileBox(t, t.TempDir())
+
+			if status := path.send(t, fb, corrupt); status != http.StatusBadRequest {
+				t.Fatalf("corrupt record got %d, want 400", status)
+			}
+			if containerFile, ok := fb.files.get(testForeignFID); ok {
+				if stat, err := os.Stat(containerFile.FilePath); err == nil && stat.Size() > 0 {
+					t.Fatal("the corrupt record was written")
+				}
+			}
+
+			if status := path.send(t, fb, record); status != http.StatusOK {
+				t.Fatalf("intact record got %d, want 200", status)
+			}
+			containerFile, _ := fb.files.get(testForeignFID)
+			data, err := os.ReadFile(containerFile.FilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, record) {
+				t.Errorf("container holds %q, want %q", data, record)
+			}
+		})
+	}
+}
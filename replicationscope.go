@@ -0,0 +1,114 @@
+// Per-tenant replication scopes for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A tenant policy can limit which peers its records replicate to, for
+// example to keep a PII tenant within one region. replicate_to lists the
+// peers allowed and no_replicate_to the peers refused; each entry is a peer
+// address as written in REPLICAS or "region:<name>", matched against the
+// NODE_REGION a peer reports in its hello. Senders leave refused peers out
+// when picking replicas. Receivers check the region entries against their
+// own NODE_REGION and refuse records they should not hold; address entries
+// are only enforced by senders, since a node does not know the address its
+// peers use for it.
+
+const regionScopePrefix = "region:"
+
+// validateReplicationScope checks the entries of replicate_to or no_replicate_to
+func validateReplicationScope(field string, entries []string) error {
+	for _, entry := range entries {
+		if entry == "" || entry == regionScopePrefix {
+			return fmt.Errorf("%s entries must be a peer address or region:<name>", field)
+		}
+	}
+	return nil
+}
+
+// scopeMatches reports whether an entry names a peer, by address or region
+func scopeMatches(entry, peer, region string) bool {
+	if name, ok := strings.CutPrefix(entry, regionScopePrefix); ok {
+		return region != "" && name == region
+	}
+	return entry == peer
+}
+
+// hasRegionScope reports whether any entry names a region
+func hasRegionScope(entries []string) bool {
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, regionScopePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsPeer reports whether a tenant's records may be sent to a peer.
+// region is empty when the peer's region is not known yet; a policy
+// refusing regions then refuses the peer until it is.
+func (p TenantPolicy) allowsPeer(peer, region string) bool {
+	if region == "" && hasRegionScope(p.NoReplicateTo) {
+		return false
+	}
+	for _, entry := range p.NoReplicateTo {
+		if scopeMatches(entry, peer, region) {
+			return false
+		}
+	}
+	if len(p.ReplicateTo) == 0 {
+		return true
+	}
+	for _, entry := range p.ReplicateTo {
+		if scopeMatches(entry, peer, region) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsRegion reports whether a node in a region may hold a tenant's
+// records, as far as the region entries tell
+func (p TenantPolicy) allowsRegion(region string) bool {
+	for _, entry := range p.NoReplicateTo {
+		if name, ok := strings.CutPrefix(entry, regionScopePrefix); ok && (region == "" || name == region) {
+			return false
+		}
+	}
+	if len(p.ReplicateTo) == 0 {
+		return true
+	}
+	for _, entry := range p.ReplicateTo {
+		name, ok := strings.CutPrefix(entry, regionScopePrefix)
+		if !ok || (region != "" && name == region) {
+			return true // An address entry may name this node
+		}
+	}
+	return false
+}
+
+// peerRegion is the region a peer reported in its last hello, without shaking hands
+func (fb *FileBox) peerRegion(peer string) string {
+	fb.protocols.mu.Lock()
+	defer fb.protocols.mu.Unlock()
+	if known, ok := fb.protocols.peers[peer]; ok {
+		return known.Region
+	}
+	return ""
+}
+
+// checkReplicaTenant refuses records of a tenant whose policy keeps them out of this node's region
+func (fb *FileBox) checkReplicaTenant(tenant string) error {
+	if fb.tenantPolicies.policy(tenant).allowsRegion(fb.region) {
+		return nil
+	}
+	if fb.region == "" {
+		return fmt.Errorf("tenant %q replicates only to named regions and this node has no NODE_REGION", tenant)
+	}
+	return fmt.Errorf("tenant %q does not replicate to region %q", tenant, fb.region)
+}
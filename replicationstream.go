@@ -0,0 +1,447 @@
+// Replication over gRPC streams for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// replicationStreamMethod is the full gRPC method name of the replication stream
+const replicationStreamMethod = "/filebox.Replication/Stream"
+
+const (
+	streamMaxRecord  = 16 << 20         // Larger records are posted over HTTP instead
+	streamRetryDelay = 30 * time.Second // Wait after a failed dial before streaming again
+)
+
+// Stream metadata; gRPC lowercases keys
+const (
+	streamHostKey    = "x-filebox-host"
+	streamMachineKey = "x-filebox-machine"
+)
+
+// replicationServiceDesc describes the service by hand: records travel in
+// replicationCodec frames, so no generated protobuf code is needed
+var replicationServiceDesc = grpc.ServiceDesc{
+	ServiceName: "filebox.Replication",
+	HandlerType: (*any)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Stream",
+		Handler:       serveReplicationStream,
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+}
+
+func init() {
+	encoding.RegisterCompressor(zstdCompressor{})
+}
+
+// streamRecord - One record sent on a replication stream
+type streamRecord struct {
+	Seq       uint64       `json:"seq"`
+	Entry     replicaEntry `json:"entry"`
+	Signature string       `json:"signature,omitempty"` // Over the stream timestamp, sequence, entry and data
+	Data      []byte       `json:"-"`
+}
+
+// streamAck - The replica's answer to one record
+type streamAck struct {
+	Seq    uint64 `json:"seq"`
+	Error  string `json:"error,omitempty"`
+	Status int    `json:"status,omitempty"` // HTTP status /replicate would have refused the record with
+}
+
+// replicationCodec frames records as a length-prefixed JSON header followed
+// by the raw record bytes, and acks as plain JSON
+type replicationCodec struct{}
+
+func (replicationCodec) Name() string { return "filebox-replication" }
+
+func (replicationCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case *streamRecord:
+		header, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		frame := make([]byte, 4, 4+len(header)+len(m.Data))
+		binary.BigEndian.PutUint32(frame, uint32(len(header)))
+		frame = append(frame, header...)
+		return append(frame, m.Data...), nil
+	case *streamAck:
+		return json.Marshal(m)
+	}
+	return nil, fmt.Errorf("replication codec cannot marshal %T", v)
+}
+
+func (replicationCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *streamRecord:
+		if len(data) < 4 {
+			return errors.New("short record frame")
+		}
+		headerLen := uint64(binary.BigEndian.Uint32(data))
+		if headerLen > uint64(len(data)-4) {
+			return errors.New("record header overruns frame")
+		}
+		if err := json.Unmarshal(data[4:4+headerLen], m); err != nil {
+			return err
+		}
+		m.Data = append([]byte(nil), data[4+headerLen:]...)
+		return nil
+	case *streamAck:
+		return json.Unmarshal(data, m)
+	}
+	return fmt.Errorf("replication codec cannot unmarshal %T", v)
+}
+
+// zstdCompressor lets gRPC compress streams with zstd, matching the
+// compression of HTTP replication requests
+type zstdCompressor struct{}
+
+func (zstdCompressor) Name() string { return "zstd" }
+
+func (zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+}
+
+func (zstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+}
+
+// signStreamRecord signs a record for the stream opened at timestamp
+func signStreamRecord(secret []byte, timestamp string, record *streamRecord) string {
+	entry, _ := json.Marshal(record.Entry)
+	return signClusterRequest(secret, "RECORD", replicationStreamMethod,
+		timestamp+"/"+strconv.FormatUint(record.Seq, 10), append(entry, record.Data...))
+}
+
+// streamPort is the port peers should stream records to; 0 when streaming is off
+func (r *replicator) streamPort() int {
+	if r == nil || r.config.StreamAddr == "" {
+		return 0
+	}
+	_, port, err := net.SplitHostPort(r.config.StreamAddr)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// peerStream - The replication stream to one replica. window bounds the
+// records awaiting acks, so a slow replica pushes back on the senders and,
+// through the queue, on writers.
+type peerStream struct {
+	host   string
+	window chan struct{}
+
+	mu        sync.Mutex // Serializes sends; gRPC streams take one sender at a time
+	conn      *grpc.ClientConn
+	connAddr  string
+	session   *streamSession
+	retryAt   time.Time // Set after a failed dial; records are posted until then
+	lastError string
+}
+
+// streamSession - One opened stream and the records it has not yet acknowledged
+type streamSession struct {
+	stream    grpc.ClientStream
+	cancel    context.CancelFunc
+	timestamp string // Signed when the stream was opened; records are signed with it
+	seq       uint64
+
+	mu      sync.Mutex
+	pending map[uint64]*replicationItem
+}
+
+func newPeerStream(host string, window int) *peerStream {
+	return &peerStream{host: host, window: make(chan struct{}, window)}
+}
+
+// streamRecord sends a record on the replica's stream, opening it if needed.
+// It reports false when the record was not taken and should be posted instead;
+// once taken, the record is finished when its ack arrives or the stream breaks.
+func (fb *FileBox) streamRecord(host string, item *replicationItem) bool {
+	ps := fb.replication.streams[host]
+	if ps == nil || item.length > streamMaxRecord || fb.faults.partitioned(host) {
+		return false
+	}
+	protocol := fb.peerProtocol(context.Background(), host)
+	if protocol.StreamAddr == "" {
+		return false
+	}
+
+	ps.window <- struct{}{}
+	ps.mu.Lock()
+	if ps.session == nil {
+		if timeNow().Before(ps.retryAt) {
+			ps.mu.Unlock()
+			<-ps.window
+			return false
+		}
+		if err := fb.openStream(ps, protocol); err != nil {
+			if ps.lastError != err.Error() {
+				log.Printf("Replication stream to %s unavailable, posting records instead: %v", host, err)
+			}
+			ps.lastError, ps.retryAt = err.Error(), timeNow().Add(streamRetryDelay)
+			ps.mu.Unlock()
+			<-ps.window
+			return false
+		}
+	}
+
+	session := ps.session
+	session.seq++
+	record := &streamRecord{Seq: session.seq, Entry: fb.replicaEntryFor(item.containerFile, item.data, item.offset, item.length, item.seq, item.seqBase), Data: item.data}
+	if len(fb.clusterAuth.Secret) > 0 {
+		record.Signature = signStreamRecord(fb.clusterAuth.Secret, session.timestamp, record)
+	}
+	session.mu.Lock()
+	session.pending[record.Seq] = item
+	session.mu.Unlock()
+	err := session.stream.SendMsg(record)
+	ps.mu.Unlock()
+
+	if stats := fb.replication.stats[host]; stats != nil {
+		stats.blobs.Add(1)
+	}
+	if err != nil {
+		fb.closeStream(ps, session, err)
+	}
+	return true
+}
+
+// openStream dials the replica if needed and opens a signed stream to it.
+// Callers must hold ps.mu.
+func (fb *FileBox) openStream(ps *peerStream, protocol *PeerProtocol) error {
+	if ps.conn != nil && ps.connAddr != protocol.StreamAddr {
+		ps.conn.Close()
+		ps.conn = nil
+	}
+	if ps.conn == nil {
+		conn, err := grpc.Dial(protocol.StreamAddr,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithStatsHandler(&streamStatsHandler{stats: fb.replication.stats[ps.host]}))
+		if err != nil {
+			return err
+		}
+		ps.conn, ps.connAddr = conn, protocol.StreamAddr
+	}
+
+	timestamp := strconv.FormatInt(timeNow().Unix(), 10)
+	md := metadata.Pairs(
+		protocolHeader, strconv.Itoa(protocol.sendVersion()),
+		clusterTimestampHeader, timestamp,
+		streamHostKey, fb.hostID,
+		streamMachineKey, strconv.FormatUint(uint64(fb.machineID), 10),
+	)
+	if len(fb.clusterAuth.Secret) > 0 {
+		md.Set(clusterSignatureHeader, signClusterRequest(fb.clusterAuth.Secret, "STREAM", replicationStreamMethod, timestamp, nil))
+	}
+
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(context.Background(), md))
+	options := []grpc.CallOption{grpc.ForceCodec(replicationCodec{})}
+	if fb.replication.config.Compress && protocol.supports(CapZstd) {
+		options = append(options, grpc.UseCompressor(zstdCompressor{}.Name()))
+	}
+	stream, err := ps.conn.NewStream(ctx, &replicationServiceDesc.Streams[0], replicationStreamMethod, options...)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	session := &streamSession{stream: stream, cancel: cancel, timestamp: timestamp, pending: make(map[uint64]*replicationItem)}
+	ps.session, ps.lastError = session, ""
+	log.Printf("Opened replication stream to %s at %s", ps.host, protocol.StreamAddr)
+	go fb.receiveAcks(ps, session)
+	return nil
+}
+
+// receiveAcks finishes records as the replica acknowledges them
+func (fb *FileBox) receiveAcks(ps *peerStream, session *streamSession) {
+	for {
+		var ack streamAck
+		if err := session.stream.RecvMsg(&ack); err != nil {
+			fb.closeStream(ps, session, err)
+			return
+		}
+
+		session.mu.Lock()
+		item, ok := session.pending[ack.Seq]
+		delete(session.pending, ack.Seq)
+		session.mu.Unlock()
+		if !ok {
+			continue
+		}
+		<-ps.window
+
+		var err error
+		if ack.Error != "" {
+			err = errors.New(ack.Error)
+		}
+		fb.finishReplication(ps.host, item, err)
+	}
+}
+
+// closeStream tears down a broken stream and fails the records still awaiting
+// acks; the next record opens a new stream
+func (fb *FileBox) closeStream(ps *peerStream, session *streamSession, cause error) {
+	ps.mu.Lock()
+	if ps.session == session {
+		ps.session = nil
+		log.Printf("Replication stream to %s closed: %v", ps.host, cause)
+	}
+	ps.mu.Unlock()
+	session.cancel()
+
+	if status.Code(cause) == codes.FailedPrecondition {
+		fb.forgetPeerProtocol(ps.host) // The peer changed versions; shake hands again
+	}
+
+	session.mu.Lock()
+	pending := session.pending
+	session.pending = make(map[uint64]*replicationItem)
+	session.mu.Unlock()
+	for _, item := range pending {
+		<-ps.window
+		fb.finishReplication(ps.host, item, fmt.Errorf("replication stream closed: %v", cause))
+	}
+}
+
+// streamStatsHandler counts the bytes records take on the wire
+type streamStatsHandler struct {
+	stats *replicationStats
+}
+
+func (h *streamStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h *streamStatsHandler) HandleRPC(_ context.Context, s stats.RPCStats) {
+	if out, ok := s.(*stats.OutPayload); ok && h.stats != nil {
+		h.stats.payloadBytes.Add(int64(out.Length))
+		h.stats.wireBytes.Add(int64(out.WireLength))
+	}
+}
+
+func (h *streamStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *streamStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+// serveReplicationStreams accepts replication streams from peers on addr
+func (fb *FileBox) serveReplicationStreams(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening for replication streams on %s: %v", addr, err)
+	}
+	server := grpc.NewServer(
+		grpc.ForceServerCodec(replicationCodec{}),
+		grpc.MaxRecvMsgSize(streamMaxRecord+64*1024),
+	)
+	server.RegisterService(&replicationServiceDesc, fb)
+	log.Printf("Serving replication streams on %s", addr)
+	return server.Serve(listener)
+}
+
+func serveReplicationStream(srv any, stream grpc.ServerStream) error {
+	return srv.(*FileBox).handleReplicationStream(stream)
+}
+
+// handleReplicationStream authenticates a peer's stream like requireClusterPeer
+// does for /replicate, then stores and acknowledges records in order
+func (fb *FileBox) handleReplicationStream(stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	event := AuditEvent{Method: "STREAM", Path: replicationStreamMethod}
+	remoteAddr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+		event.SourceIP = remoteAddr
+		if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+			event.SourceIP = host
+		}
+	}
+	deny := func(reason string, code codes.Code) error {
+		log.Printf("Rejected replication stream from %s: %s", remoteAddr, reason)
+		denied := event
+		denied.Action, denied.Outcome, denied.Detail = AuditPeerDeny, "denied", reason
+		fb.audit.record(denied)
+		return status.Error(code, reason)
+	}
+
+	if !fb.clusterAuth.allowsAddr(remoteAddr) {
+		return deny("source not allowed", codes.PermissionDenied)
+	}
+	timestamp := get(clusterTimestampHeader)
+	if len(fb.clusterAuth.Secret) > 0 {
+		if err := fb.clusterAuth.verifySignature("STREAM", replicationStreamMethod, timestamp, get(clusterSignatureHeader), nil); err != nil {
+			return deny(err.Error(), codes.Unauthenticated)
+		}
+	}
+	if _, err := parseProtocolVersion(get(protocolHeader)); err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	hostID := get(streamHostKey)
+	if err := fb.checkSenderMachine(hostID, get(streamMachineKey)); err != nil {
+		return deny(err.Error(), codes.FailedPrecondition)
+	}
+	event.Action = AuditReplicate
+	for {
+		var record streamRecord
+		if err := stream.RecvMsg(&record); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		ack := streamAck{Seq: record.Seq}
+		if len(fb.clusterAuth.Secret) > 0 &&
+			!hmac.Equal([]byte(signStreamRecord(fb.clusterAuth.Secret, timestamp, &record)), []byte(record.Signature)) {
+			return deny("bad record signature", codes.Unauthenticated)
+		}
+		if err := fb.writeRefusal(); err != nil {
+			ack.Error = err.Error()
+		} else if status, err := fb.storeReplica(event, hostID, record.Entry, record.Data); err != nil {
+			ack.Error, ack.Status = err.Error(), status
+		}
+		if err := stream.SendMsg(&ack); err != nil {
+			return err
+		}
+	}
+}
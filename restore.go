@@ -0,0 +1,187 @@
+// Glacier restore workflow for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// RestoreStatus - Tracks an S3 restore request for an archived container
+type RestoreStatus struct {
+	S3Key        string    `json:"s3_key"`
+	FileID       string    `json:"file_id"`
+	Tier         string    `json:"tier"`
+	Requested    time.Time `json:"requested"`
+	EstimatedAt  time.Time `json:"estimated_at"`
+	Completed    bool      `json:"completed"`
+	StorageClass string    `json:"storage_class,omitempty"`
+}
+
+// RestoreInProgressError - Returned when a blob lives in an archived object
+// that has not been restored yet
+type RestoreInProgressError struct {
+	Status     RestoreStatus
+	RetryAfter time.Duration
+}
+
+func (e *RestoreInProgressError) Error() string {
+	return fmt.Sprintf("container %s is being restored from %s, retry after %s",
+		e.Status.FileID, e.Status.StorageClass, e.RetryAfter)
+}
+
+// restoreEstimate returns the typical restore time for a storage class and tier
+func restoreEstimate(storageClass, tier string) time.Duration {
+	if storageClass == StorageClassDeepArch {
+		if tier == string(types.TierBulk) {
+			return 48 * time.Hour
+		}
+		return 12 * time.Hour
+	}
+	switch types.Tier(tier) {
+	case types.TierExpedited:
+		return 5 * time.Minute
+	case types.TierBulk:
+		return 12 * time.Hour
+	default:
+		return 5 * time.Hour
+	}
+}
+
+// readBlobFromS3 reads a blob's byte range from the uploaded container object
+func (fb *FileBox) readBlobFromS3(ctx context.Context, containerFile *ContainerFile, blobInfo BlobInfo) ([]byte, error) {
+	s3Key := fb.containerS3Key(containerFile)
+	ctx = withUsageTenant(ctx, containerFile.Tenant)
+
+	blobData := make([]byte, blobInfo.Length)
+	err := fb.readS3Range(ctx, s3Key, blobInfo.Offset, blobData)
+	if s3ErrorCode(err) == "InvalidObjectState" {
+		return nil, fb.requestRestore(ctx, containerFile, s3Key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading blob from S3: %v", err)
+	}
+
+	// A successful read means any earlier restore has finished
+	fb.restoreLock.Lock()
+	if status, ok := fb.restores[s3Key]; ok && !status.Completed {
+		status.Completed = true
+		log.Printf("Restore of %s completed", s3Key)
+	}
+	fb.restoreLock.Unlock()
+
+	return blobData, nil
+}
+
+// requestRestore starts (or reports) a restore of an archived container object
+func (fb *FileBox) requestRestore(ctx context.Context, containerFile *ContainerFile, s3Key string) error {
+	fb.restoreLock.Lock()
+	defer fb.restoreLock.Unlock()
+
+	// Restore already requested by this node
+	if status, ok := fb.restores[s3Key]; ok && !status.Completed {
+		return &RestoreInProgressError{Status: *status, RetryAfter: retryAfter(status.EstimatedAt)}
+	}
+
+	fb.fileLock.RLock()
+	storageClass := containerFile.StorageClass
+	fb.fileLock.RUnlock()
+
+	tier := getEnvOrDefault("RESTORE_TIER", string(types.TierStandard))
+	days := int32(1)
+	fmt.Sscanf(getEnvOrDefault("RESTORE_DAYS", "1"), "%d", &days)
+
+	_, err := fb.s3Client.RestoreObject(withUsageTenant(ctx, containerFile.Tenant), &s3.RestoreObjectInput{
+		Bucket: aws.String(fb.bucket),
+		Key:    aws.String(s3Key),
+		RestoreRequest: &types.RestoreRequest{
+			Days:                 aws.Int32(days),
+			GlacierJobParameters: &types.GlacierJobParameters{Tier: types.Tier(tier)},
+		},
+	})
+	if s3ErrorCode(err) == "RestoreAlreadyInProgress" {
+		err = nil // Requested by another node or before a restart
+	}
+	if err != nil {
+		return fmt.Errorf("error requesting restore of %s: %v", s3Key, err)
+	}
+
+	now := timeNow()
+	status := &RestoreStatus{
+		S3Key:        s3Key,
+		FileID:       containerFile.FID.String(),
+		Tier:         tier,
+		Requested:    now,
+		EstimatedAt:  now.Add(restoreEstimate(storageClass, tier)),
+		StorageClass: storageClass,
+	}
+	fb.restores[s3Key] = status
+
+	log.Printf("Requested %s restore of %s (estimated ready %s)", tier, s3Key, status.EstimatedAt.Format(time.RFC3339))
+	return &RestoreInProgressError{Status: *status, RetryAfter: retryAfter(status.EstimatedAt)}
+}
+
+// retryAfter returns how long a client should wait before retrying, at least a minute
+func retryAfter(estimatedAt time.Time) time.Duration {
+	wait := time.Until(estimatedAt).Round(time.Second)
+	if wait < time.Minute {
+		return time.Minute
+	}
+	return wait
+}
+
+// refreshRestoreStatus checks S3 for the progress of a tracked restore
+func (fb *FileBox) refreshRestoreStatus(ctx context.Context, status *RestoreStatus) {
+	head, err := fb.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(fb.bucket),
+		Key:    aws.String(status.S3Key),
+	})
+	if err != nil {
+		log.Printf("Error checking restore status of %s: %v", status.S3Key, err)
+		return
+	}
+
+	// x-amz-restore: ongoing-request="false", expiry-date="..."
+	if head.Restore != nil && strings.Contains(*head.Restore, `ongoing-request="false"`) {
+		status.Completed = true
+	}
+}
+
+// writeRestoreInProgress answers a read with 202 Accepted and a Retry-After estimate
+func writeRestoreInProgress(w http.ResponseWriter, err *RestoreInProgressError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(err.RetryAfter.Seconds())))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(err.Status)
+}
+
+func (fb *FileBox) handleRestores(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fb.restoreLock.Lock()
+	restores := make([]RestoreStatus, 0, len(fb.restores))
+	for _, status := range fb.restores {
+		if !status.Completed && fb.s3Client != nil {
+			fb.refreshRestoreStatus(r.Context(), status)
+		}
+		restores = append(restores, *status)
+	}
+	fb.restoreLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(restores)
+}
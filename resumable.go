@@ -0,0 +1,483 @@
+// Resumable chunked uploads for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable upload defaults
+const (
+	uploadSessionDirName    = "uploads"
+	defaultUploadChunkSize  = 8 << 20
+	maxUploadChunkSize      = 64 << 20
+	defaultUploadSessionTTL = 24 * time.Hour
+)
+
+// UploadSession - A chunked upload in progress
+type UploadSession struct {
+	ID        string      `json:"id"`
+	Length    int64       `json:"length"`     // Total blob size announced by the client
+	ChunkSize int64       `json:"chunk_size"` // Every chunk but the last has exactly this size
+	Options   BlobOptions `json:"options"`
+	TokenID   string      `json:"token_id,omitempty"` // Upload token claimed when the session started
+	Created   time.Time   `json:"created"`
+	ExpiresAt time.Time   `json:"expires_at"`
+
+	received   []bool // Chunks stored so far
+	completing bool   // Set once assembly starts; no more chunks are accepted
+}
+
+// UploadProgress - Response for GET /upload/{id} and every chunk write
+type UploadProgress struct {
+	ID                string    `json:"id"`
+	Length            int64     `json:"length"`
+	ChunkSize         int64     `json:"chunk_size"`
+	BytesReceived     int64     `json:"bytes_received"`
+	ChunksTotal       int       `json:"chunks_total"`
+	ChunksReceived    int       `json:"chunks_received"`
+	ChunksOutstanding []int     `json:"chunks_outstanding"`
+	ExpiresAt         time.Time `json:"expires_at"`
+	Complete          bool      `json:"complete"` // All chunks received; ready for /complete
+}
+
+// uploadSessions - Open chunked uploads, persisted under STORAGE_DIR/uploads
+type uploadSessions struct {
+	dir       string
+	chunkSize int64
+	ttl       time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*UploadSession
+}
+
+// loadUploadSessions reads UPLOAD_CHUNK_SIZE and UPLOAD_SESSION_TTL and
+// reopens sessions left over from before a restart
+func loadUploadSessions(storageDir string) *uploadSessions {
+	u := &uploadSessions{
+		dir:       filepath.Join(storageDir, uploadSessionDirName),
+		chunkSize: getEnvInt("UPLOAD_CHUNK_SIZE", defaultUploadChunkSize),
+		ttl:       getEnvDuration("UPLOAD_SESSION_TTL", defaultUploadSessionTTL),
+		sessions:  make(map[string]*UploadSession),
+	}
+	if u.chunkSize <= 0 || u.chunkSize > maxUploadChunkSize {
+		log.Printf("Invalid UPLOAD_CHUNK_SIZE %d, using %d", u.chunkSize, defaultUploadChunkSize)
+		u.chunkSize = defaultUploadChunkSize
+	}
+
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return u
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(u.dir, entry.Name(), "session.json"))
+		if err != nil {
+			continue
+		}
+		var session UploadSession
+		if err := json.Unmarshal(data, &session); err != nil {
+			log.Printf("Error reading upload session %s: %v", entry.Name(), err)
+			continue
+		}
+		session.received = make([]bool, session.chunks())
+		for i := range session.received {
+			stat, err := os.Stat(u.chunkPath(session.ID, i))
+			session.received[i] = err == nil && stat.Size() == session.chunkLength(i)
+		}
+		u.sessions[session.ID] = &session
+	}
+	if len(u.sessions) > 0 {
+		log.Printf("Recovered %d upload sessions", len(u.sessions))
+	}
+	return u
+}
+
+// chunks is the number of chunks the upload is split into
+func (s *UploadSession) chunks() int {
+	if s.Length == 0 {
+		return 1
+	}
+	return int((s.Length + s.ChunkSize - 1) / s.ChunkSize)
+}
+
+// chunkLength is the exact size chunk i must have
+func (s *UploadSession) chunkLength(i int) int64 {
+	start := int64(i) * s.ChunkSize
+	if remaining := s.Length - start; remaining < s.ChunkSize {
+		return remaining
+	}
+	return s.ChunkSize
+}
+
+// progress summarizes a session. Callers must hold uploadSessions.mu.
+func (s *UploadSession) progress() UploadProgress {
+	progress := UploadProgress{
+		ID:                s.ID,
+		Length:            s.Length,
+		ChunkSize:         s.ChunkSize,
+		ChunksTotal:       len(s.received),
+		ChunksOutstanding: []int{},
+		ExpiresAt:         s.ExpiresAt,
+	}
+	for i, received := range s.received {
+		if received {
+			progress.ChunksReceived++
+			progress.BytesReceived += s.chunkLength(i)
+		} else {
+			progress.ChunksOutstanding = append(progress.ChunksOutstanding, i)
+		}
+	}
+	progress.Complete = len(progress.ChunksOutstanding) == 0
+	return progress
+}
+
+func (u *uploadSessions) sessionDir(id string) string {
+	return filepath.Join(u.dir, id)
+}
+
+func (u *uploadSessions) chunkPath(id string, chunk int) string {
+	return filepath.Join(u.sessionDir(id), fmt.Sprintf("chunk-%06d", chunk))
+}
+
+// get returns an unexpired session
+func (u *uploadSessions) get(id string) (*UploadSession, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	session, exists := u.sessions[id]
+	if !exists || timeNow().After(session.ExpiresAt) {
+		return nil, false
+	}
+	return session, true
+}
+
+// remove forgets a session and deletes its chunks
+func (u *uploadSessions) remove(id string) {
+	u.mu.Lock()
+	delete(u.sessions, id)
+	u.mu.Unlock()
+	if err := os.RemoveAll(u.sessionDir(id)); err != nil {
+		log.Printf("Error removing upload session %s: %v", id, err)
+	}
+}
+
+// expireUploadSessions drops sessions past their expiry along with their chunks
+func (fb *FileBox) expireUploadSessions() {
+	now := timeNow()
+	fb.uploads.mu.Lock()
+	expired := make(map[string]int64)
+	for id, session := range fb.uploads.sessions {
+		if now.After(session.ExpiresAt) && !session.completing {
+			expired[id] = session.progress().BytesReceived
+		}
+	}
+	fb.uploads.mu.Unlock()
+
+	for id, received := range expired {
+		fb.uploads.remove(id)
+		log.Printf("Upload session %s expired with %d bytes received", id, received)
+	}
+}
+
+// runUploadSessionExpiry periodically removes abandoned uploads
+func (fb *FileBox) runUploadSessionExpiry() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fb.expireUploadSessions()
+	}
+}
+
+// handleUploadSessions dispatches the resumable upload protocol:
+//
+//	POST   /upload/start              start a session (X-FileBox-Upload-Length)
+//	PUT    /upload/{id}/{chunk}       store one chunk
+//	GET    /upload/{id}               progress
+//	POST   /upload/{id}/complete      assemble the blob
+//	DELETE /upload/{id}               abort
+func (fb *FileBox) handleUploadSessions(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path[len("/upload/"):], "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "start":
+		fb.handleStartUpload(w, r)
+	case len(parts) == 1 && parts[0] != "":
+		switch r.Method {
+		case "GET":
+			fb.handleUploadProgress(w, parts[0])
+		case "DELETE":
+			fb.handleAbortUpload(w, parts[0])
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case len(parts) == 2 && parts[1] == "complete":
+		fb.handleCompleteUpload(w, r, parts[0])
+	case len(parts) == 2:
+		fb.handleUploadChunk(w, r, parts[0], parts[1])
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleStartUpload serves POST /upload/start
+func (fb *FileBox) handleStartUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, ok := fb.parseUploadRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// The session is persisted, so the key is only accepted when completing it
+	if req.opts.customerKey != nil {
+		http.Error(w, fmt.Sprintf("Send %s with the request completing the upload, not when starting it", customerKeyHeader), http.StatusBadRequest)
+		return
+	}
+
+	// Chunks are not sniffed, so a restricted token needs the type up front
+	if req.claims != nil && req.claims.ContentType != "" && req.opts.ContentType == "" {
+		http.Error(w, "Content-Type header required by upload token", http.StatusBadRequest)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("X-FileBox-Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "X-FileBox-Upload-Length header required", http.StatusBadRequest)
+		return
+	}
+	maxSize := fb.maxBlobSize()
+	if req.claims != nil && req.claims.MaxSize < maxSize {
+		maxSize = req.claims.MaxSize
+	}
+	if limit := fb.tenantPolicies.policy(req.opts.Tenant).MaxBlobSize; limit > 0 && limit < maxSize {
+		maxSize = limit
+	}
+	if length > maxSize {
+		http.Error(w, fmt.Sprintf("Upload length %d exceeds maximum blob size %d", length, maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	chunkSize := fb.uploads.chunkSize
+	if value := r.Header.Get("X-FileBox-Chunk-Size"); value != "" {
+		chunkSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || chunkSize <= 0 || chunkSize > maxUploadChunkSize {
+			http.Error(w, fmt.Sprintf("X-FileBox-Chunk-Size must be between 1 and %d", maxUploadChunkSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The token is used up by starting the session, not by completing it
+	if !fb.claimUploadToken(w, req) {
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	now := timeNow().UTC()
+	session := &UploadSession{
+		ID:        hex.EncodeToString(id),
+		Length:    length,
+		ChunkSize: chunkSize,
+		Options:   req.opts,
+		Created:   now,
+		ExpiresAt: now.Add(fb.uploads.ttl),
+	}
+	if req.claims != nil {
+		session.TokenID = req.claims.ID
+	}
+	session.received = make([]bool, session.chunks())
+
+	data, _ := json.Marshal(session)
+	if err := os.MkdirAll(fb.uploads.sessionDir(session.ID), 0755); err == nil {
+		err = os.WriteFile(filepath.Join(fb.uploads.sessionDir(session.ID), "session.json"), data, 0644)
+	}
+	if err != nil {
+		fb.releaseUploadToken(req)
+		http.Error(w, "Error creating upload session", http.StatusInternalServerError)
+		return
+	}
+
+	fb.uploads.mu.Lock()
+	fb.uploads.sessions[session.ID] = session
+	progress := session.progress()
+	fb.uploads.mu.Unlock()
+
+	log.Printf("Started upload session %s (%d bytes in %d chunks)", session.ID, length, progress.ChunksTotal)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(progress)
+}
+
+// handleUploadChunk serves PUT /upload/{id}/{chunk}. Chunks may arrive in
+// any order and may be sent again.
+func (fb *FileBox) handleUploadChunk(w http.ResponseWriter, r *http.Request, id, chunkStr string) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, exists := fb.uploads.get(id)
+	if !exists {
+		http.Error(w, "Upload session not found or expired", http.StatusNotFound)
+		return
+	}
+	chunk, err := strconv.Atoi(chunkStr)
+	if err != nil || chunk < 0 || chunk >= session.chunks() {
+		http.Error(w, "Invalid chunk index", http.StatusBadRequest)
+		return
+	}
+
+	expected := session.chunkLength(chunk)
+	release, err := fb.admit(r.Context(), expected)
+	if err != nil {
+		writeAdmissionError(w, err)
+		return
+	}
+	defer release()
+	data, err := io.ReadAll(io.LimitReader(r.Body, expected+1))
+	if err != nil {
+		http.Error(w, "Error reading chunk", http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) != expected {
+		http.Error(w, fmt.Sprintf("Chunk %d must be %d bytes, got %d", chunk, expected, len(data)), http.StatusBadRequest)
+		return
+	}
+
+	fb.uploads.mu.Lock()
+	completing := session.completing
+	fb.uploads.mu.Unlock()
+	if completing {
+		http.Error(w, "Upload is being completed", http.StatusConflict)
+		return
+	}
+
+	// Write then rename so a chunk is either entirely present or absent
+	path := fb.uploads.chunkPath(id, chunk)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		http.Error(w, "Error storing chunk", http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		http.Error(w, "Error storing chunk", http.StatusInternalServerError)
+		return
+	}
+
+	fb.uploads.mu.Lock()
+	session.received[chunk] = true
+	progress := session.progress()
+	fb.uploads.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(progress)
+}
+
+// handleUploadProgress serves GET /upload/{id}
+func (fb *FileBox) handleUploadProgress(w http.ResponseWriter, id string) {
+	session, exists := fb.uploads.get(id)
+	if !exists {
+		http.Error(w, "Upload session not found or expired", http.StatusNotFound)
+		return
+	}
+
+	fb.uploads.mu.Lock()
+	progress := session.progress()
+	fb.uploads.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(progress)
+}
+
+// handleCompleteUpload serves POST /upload/{id}/complete
+func (fb *FileBox) handleCompleteUpload(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, exists := fb.uploads.get(id)
+	if !exists {
+		http.Error(w, "Upload session not found or expired", http.StatusNotFound)
+		return
+	}
+
+	fb.uploads.mu.Lock()
+	progress := session.progress()
+	if !progress.Complete || session.completing {
+		fb.uploads.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Upload incomplete: %d chunks outstanding", len(progress.ChunksOutstanding)), http.StatusConflict)
+		return
+	}
+	session.completing = true
+	fb.uploads.mu.Unlock()
+
+	var blobData bytes.Buffer
+	blobData.Grow(int(session.Length))
+	for i := 0; i < session.chunks(); i++ {
+		chunk, err := os.ReadFile(fb.uploads.chunkPath(id, i))
+		if err != nil {
+			fb.uploads.mu.Lock()
+			session.completing = false
+			session.received[i] = false
+			fb.uploads.mu.Unlock()
+			http.Error(w, fmt.Sprintf("Chunk %d is missing, upload it again", i), http.StatusConflict)
+			return
+		}
+		blobData.Write(chunk)
+	}
+
+	req := &uploadRequest{opts: session.Options}
+	if session.TokenID != "" {
+		req.claims = &UploadTokenClaims{ID: session.TokenID}
+	}
+	customerKey, err := customerKeyFrom(r)
+	if err != nil {
+		fb.uploads.mu.Lock()
+		session.completing = false
+		fb.uploads.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.opts.customerKey = customerKey
+	response, err := fb.storeUpload(r, req, blobData.Bytes())
+	if err != nil {
+		fb.uploads.mu.Lock()
+		session.completing = false
+		fb.uploads.mu.Unlock()
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+	fb.uploads.remove(id)
+
+	setCustomerKeyHeaders(w, customerKey)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleAbortUpload serves DELETE /upload/{id}
+func (fb *FileBox) handleAbortUpload(w http.ResponseWriter, id string) {
+	if _, exists := fb.uploads.get(id); !exists {
+		http.Error(w, "Upload session not found or expired", http.StatusNotFound)
+		return
+	}
+	fb.uploads.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,91 @@
+// S3 client configuration for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+)
+
+// loadAWSConfig loads the shared AWS configuration from the environment.
+//
+// Credentials come from the SDK's default chain: static
+// AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY, a shared config profile
+// (AWS_PROFILE, including SSO profiles), web identity federation and IRSA
+// (AWS_WEB_IDENTITY_TOKEN_FILE with AWS_ROLE_ARN), then ECS or EC2 instance
+// roles. Retries are configured with S3_MAX_ATTEMPTS (attempts per request,
+// including the first; default 3) and S3_MAX_BACKOFF (default 20s).
+func loadAWSConfig(ctx context.Context) (aws.Config, error) {
+	maxAttempts := int(getEnvInt("S3_MAX_ATTEMPTS", int64(retry.DefaultMaxAttempts)))
+	maxBackoff := getEnvDuration("S3_MAX_BACKOFF", retry.DefaultMaxBackoff)
+
+	opts := []func(*config.LoadOptions) error{
+		config.WithRetryer(func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.MaxAttempts = maxAttempts
+				o.MaxBackoff = maxBackoff
+			})
+		}),
+	}
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("error loading AWS config: %v", err)
+	}
+	return cfg, nil
+}
+
+// newS3Client builds an S3 client, applying S3-only overrides to the shared config:
+//
+//	S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY, S3_SESSION_TOKEN  static keys used only for S3
+//	S3_ROLE_ARN          role assumed with the resolved credentials
+//	S3_ENDPOINT          custom endpoint for S3-compatible stores
+//	S3_FORCE_PATH_STYLE  bucket in the path instead of the host name
+//
+// optFns are applied after these settings.
+func newS3Client(cfg aws.Config, optFns ...func(*s3.Options)) *s3.Client {
+	if keyID := os.Getenv("S3_ACCESS_KEY_ID"); keyID != "" {
+		cfg.Credentials = credentials.NewStaticCredentialsProvider(
+			keyID, os.Getenv("S3_SECRET_ACCESS_KEY"), os.Getenv("S3_SESSION_TOKEN"))
+	}
+
+	if roleARN := os.Getenv("S3_ROLE_ARN"); roleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "filebox-" + generateHostID()
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	optFns = append([]func(*s3.Options){func(o *s3.Options) {
+		if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = getEnvBool("S3_FORCE_PATH_STYLE", false)
+	}}, optFns...)
+	return s3.NewFromConfig(cfg, optFns...)
+}
+
+// s3ErrorCode returns the S3 error code of err, or "" if it has none
+func s3ErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
@@ -0,0 +1,398 @@
+// S3 key layout for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// defaultS3KeyTemplate is the layout every container was uploaded under
+// before S3_KEY_TEMPLATE, and still the default
+const defaultS3KeyTemplate = "files/{machine}/{fid}"
+
+// S3 key template placeholders
+const (
+	keyPlaceholderMachine   = "{machine}"   // Machine ID of the container's creator, in decimal
+	keyPlaceholderFID       = "{fid}"       // The container's FID; required, last
+	keyPlaceholderTenant    = "{tenant}"    // Tenant, path-escaped; "_default" for none
+	keyPlaceholderDate      = "{date}"      // YYYY/MM/DD the FID was created, UTC
+	keyPlaceholderTimestamp = "{timestamp}" // Unix time the FID was created
+)
+
+// keyNoTenant stands in for the empty tenant in keys
+const keyNoTenant = "_default"
+
+// s3KeyLayout - Where containers go in the bucket, from a key template
+type s3KeyLayout struct {
+	template string
+	pattern  *regexp.Regexp // Matches the keys the template generates
+	prefix   string         // Literal start shared by every key
+}
+
+// legacyS3Keys is the layout of containers uploaded before keys were recorded
+var legacyS3Keys = mustS3KeyLayout(defaultS3KeyTemplate)
+
+// parseS3KeyTemplate validates a template such as "files/{date}/{tenant}/{fid}"
+func parseS3KeyTemplate(template string) (*s3KeyLayout, error) {
+	if !strings.HasSuffix(template, "/"+keyPlaceholderFID) && template != keyPlaceholderFID {
+		return nil, fmt.Errorf("must end with /%s", keyPlaceholderFID)
+	}
+	if strings.Count(template, keyPlaceholderFID) != 1 {
+		return nil, fmt.Errorf("must contain %s once", keyPlaceholderFID)
+	}
+	if strings.Count(template, keyPlaceholderTenant) > 1 {
+		return nil, fmt.Errorf("must contain %s at most once", keyPlaceholderTenant)
+	}
+	if strings.HasPrefix(template, "/") || strings.Contains(template, "//") {
+		return nil, fmt.Errorf("must not start with / or contain empty path segments")
+	}
+
+	groups := map[string]string{
+		keyPlaceholderMachine:   `[0-9]+`,
+		keyPlaceholderFID:       `(?P<fid>[0-9a-f]+)`,
+		keyPlaceholderTenant:    `(?P<tenant>[^/]+)`,
+		keyPlaceholderDate:      `[0-9]{4}/[0-9]{2}/[0-9]{2}`,
+		keyPlaceholderTimestamp: `-?[0-9]+`,
+	}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	prefix, rest, literal := "", template, true
+	for rest != "" {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			start = len(rest)
+		}
+		pattern.WriteString(regexp.QuoteMeta(rest[:start]))
+		if literal {
+			prefix += rest[:start]
+		}
+		rest = rest[start:]
+		if rest == "" {
+			break
+		}
+		end := strings.IndexByte(rest, '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in %q", rest)
+		}
+		group, ok := groups[rest[:end+1]]
+		if !ok {
+			return nil, fmt.Errorf("unknown placeholder %s", rest[:end+1])
+		}
+		pattern.WriteString(group)
+		literal = false
+		rest = rest[end+1:]
+	}
+	pattern.WriteString("$")
+
+	return &s3KeyLayout{template: template, pattern: regexp.MustCompile(pattern.String()), prefix: prefix}, nil
+}
+
+// mustS3KeyLayout parses a template known to be valid
+func mustS3KeyLayout(template string) *s3KeyLayout {
+	layout, err := parseS3KeyTemplate(template)
+	if err != nil {
+		panic(err)
+	}
+	return layout
+}
+
+// loadS3KeyLayout reads S3_KEY_TEMPLATE
+func loadS3KeyLayout() *s3KeyLayout {
+	template := getEnvOrDefault("S3_KEY_TEMPLATE", defaultS3KeyTemplate)
+	layout, err := parseS3KeyTemplate(template)
+	if err != nil {
+		log.Printf("Invalid S3_KEY_TEMPLATE %q (%v), using %q", template, err, defaultS3KeyTemplate)
+		return legacyS3Keys
+	}
+	return layout
+}
+
+// key returns where the layout puts a container
+func (l *s3KeyLayout) key(fid *FID, tenant string) string {
+	if tenant == "" {
+		tenant = keyNoTenant
+	}
+	created := time.Unix(fid.Timestamp, 0).UTC()
+	return strings.NewReplacer(
+		keyPlaceholderMachine, strconv.FormatUint(uint64(fid.MachineID), 10),
+		keyPlaceholderFID, fid.String(),
+		keyPlaceholderTenant, url.PathEscape(tenant),
+		keyPlaceholderDate, created.Format("2006/01/02"),
+		keyPlaceholderTimestamp, strconv.FormatInt(fid.Timestamp, 10),
+	).Replace(l.template)
+}
+
+// match reports whether the layout could have generated a key
+func (l *s3KeyLayout) match(objectKey string) bool {
+	m := l.pattern.FindStringSubmatch(objectKey)
+	if m == nil {
+		return false
+	}
+	fid, err := ParseFID(m[l.pattern.SubexpIndex("fid")])
+	if err != nil {
+		return false
+	}
+	tenant := ""
+	if i := l.pattern.SubexpIndex("tenant"); i >= 0 {
+		if tenant, err = url.PathUnescape(m[i]); err != nil {
+			return false
+		}
+		if tenant == keyNoTenant {
+			tenant = ""
+		}
+	}
+	return l.key(fid, tenant) == objectKey
+}
+
+// s3Layout returns the configured layout
+func (fb *FileBox) s3Layout() *s3KeyLayout {
+	if fb.s3Keys == nil {
+		return legacyS3Keys
+	}
+	return fb.s3Keys
+}
+
+// containerS3Key returns the S3 key a container file is uploaded under: the
+// key recorded at its upload, or where S3_KEY_TEMPLATE puts it. Containers
+// uploaded before keys were recorded are under the original layout.
+func (fb *FileBox) containerS3Key(containerFile *ContainerFile) string {
+	switch {
+	case containerFile.S3Key != "":
+		return containerFile.S3Key
+	case containerFile.Uploaded:
+		return legacyS3Keys.key(containerFile.FID, containerFile.Tenant)
+	default:
+		return fb.s3Layout().key(containerFile.FID, containerFile.Tenant)
+	}
+}
+
+// s3ListPrefix is the prefix to list for every container object, under the
+// configured layout and under the original one
+func (fb *FileBox) s3ListPrefix() string {
+	current, legacy := fb.s3Layout().prefix, legacyS3Keys.prefix
+	n := 0
+	for n < len(current) && n < len(legacy) && current[n] == legacy[n] {
+		n++
+	}
+	return current[:n]
+}
+
+// isContainerKey reports whether FileBox could have uploaded a container
+// under a key, with the configured layout or the original one
+func (fb *FileBox) isContainerKey(objectKey string) bool {
+	return fb.s3Layout().match(objectKey) || legacyS3Keys.match(objectKey)
+}
+
+// errS3KeyMigrationRunning is returned when a migration is requested while one is in progress
+var errS3KeyMigrationRunning = errors.New("S3 key migration already running")
+
+// S3KeyMigrationReport - Outcome of moving containers to the configured key layout
+type S3KeyMigrationReport struct {
+	Started  time.Time   `json:"started"`
+	Finished time.Time   `json:"finished"`
+	DryRun   bool        `json:"dry_run"`
+	Template string      `json:"template"`
+	Checked  int         `json:"checked"`  // Uploaded containers this node owns
+	InPlace  int         `json:"in_place"` // Already under the configured layout
+	Moved    []S3KeyMove `json:"moved"`    // Copied to their new key (or, in a dry run, would be)
+	Errors   []string    `json:"errors,omitempty"`
+}
+
+// S3KeyMove - One container object relocated by a migration
+type S3KeyMove struct {
+	FileID string `json:"file_id"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// s3KeyMigrationState - Serializes migrations and keeps the last report
+type s3KeyMigrationState struct {
+	mu      sync.Mutex
+	running bool
+	last    *S3KeyMigrationReport
+}
+
+// migrateS3Keys copies every uploaded container this node owns whose key
+// differs from the configured layout to its new key, records the new key
+// and deletes the old object. Escrowed data keys move with their container.
+// Objects in archive storage classes must be restored first.
+func (fb *FileBox) migrateS3Keys(ctx context.Context, dryRun bool) (*S3KeyMigrationReport, error) {
+	fb.s3KeyMigration.mu.Lock()
+	if fb.s3KeyMigration.running {
+		fb.s3KeyMigration.mu.Unlock()
+		return nil, errS3KeyMigrationRunning
+	}
+	fb.s3KeyMigration.running = true
+	fb.s3KeyMigration.mu.Unlock()
+	defer func() {
+		fb.s3KeyMigration.mu.Lock()
+		fb.s3KeyMigration.running = false
+		fb.s3KeyMigration.mu.Unlock()
+	}()
+
+	report := &S3KeyMigrationReport{Started: timeNow().UTC(), DryRun: dryRun, Template: fb.s3Layout().template, Moved: []S3KeyMove{}}
+
+	var containers []*ContainerFile
+	fb.fileLock.RLock()
+	for _, containerFile := range fb.files.all() {
+		if containerFile.Uploaded && !containerFile.Federated && !fb.isForeign(containerFile) {
+			containers = append(containers, containerFile)
+		}
+	}
+	fb.fileLock.RUnlock()
+
+	for _, containerFile := range containers {
+		report.Checked++
+		fb.fileLock.RLock()
+		from, to := fb.containerS3Key(containerFile), fb.s3Layout().key(containerFile.FID, containerFile.Tenant)
+		recorded, encrypted := containerFile.S3Key != "", containerFile.Encrypted
+		fb.fileLock.RUnlock()
+
+		if from == to {
+			report.InPlace++
+			if !recorded && !dryRun {
+				fb.recordS3Key(containerFile, to)
+			}
+			continue
+		}
+		move := S3KeyMove{FileID: containerFile.FID.String(), From: from, To: to}
+		if dryRun {
+			report.Moved = append(report.Moved, move)
+			continue
+		}
+
+		if err := fb.moveContainerObject(ctx, containerFile, from, to, encrypted); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", move.FileID, err))
+			continue
+		}
+		report.Moved = append(report.Moved, move)
+	}
+
+	report.Finished = timeNow().UTC()
+	fb.s3KeyMigration.mu.Lock()
+	fb.s3KeyMigration.last = report
+	fb.s3KeyMigration.mu.Unlock()
+	return report, nil
+}
+
+// moveContainerObject copies a container object (and its escrowed key) to a
+// new key, switches the container over, then deletes the old objects
+func (fb *FileBox) moveContainerObject(ctx context.Context, containerFile *ContainerFile, from, to string, encrypted bool) error {
+	ctx = withUsageTenant(ctx, containerFile.Tenant)
+	fb.fileLock.RLock()
+	storageClass := containerFile.StorageClass
+	fb.fileLock.RUnlock()
+	if storageClass == "" {
+		storageClass = StorageClassStandard
+	}
+
+	suffixes := []string{""}
+	if encrypted {
+		suffixes = append(suffixes, keyEscrowSuffix)
+	}
+	for _, suffix := range suffixes {
+		_, err := fb.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:            aws.String(fb.bucket),
+			Key:               aws.String(to + suffix),
+			CopySource:        aws.String(fb.bucket + "/" + from + suffix),
+			StorageClass:      types.StorageClass(storageClass),
+			MetadataDirective: types.MetadataDirectiveCopy,
+		})
+		if s3ErrorCode(err) == "InvalidObjectState" {
+			return fmt.Errorf("object is archived in %s; restore it first", storageClass)
+		}
+		if err != nil {
+			return fmt.Errorf("error copying %s: %v", from+suffix, err)
+		}
+	}
+
+	if err := fb.recordS3Key(containerFile, to); err != nil {
+		return fmt.Errorf("error saving manifest, old objects kept: %v", err)
+	}
+
+	for _, suffix := range suffixes {
+		_, err := fb.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(fb.bucket),
+			Key:    aws.String(from + suffix),
+		})
+		if err != nil {
+			// The container is readable at its new key; garbage collection removes the leftover
+			log.Printf("Error deleting %s after moving it to %s: %v", from+suffix, to+suffix, err)
+		}
+	}
+	log.Printf("Moved container %s from %s to %s", containerFile.FID.String(), from, to)
+	return nil
+}
+
+// recordS3Key pins a container to its S3 key in memory and in its manifest.
+// If the manifest cannot be saved the old key stays, so a restart and garbage
+// collection agree on which object is the container.
+func (fb *FileBox) recordS3Key(containerFile *ContainerFile, key string) error {
+	fb.fileLock.Lock()
+	previous := containerFile.S3Key
+	containerFile.S3Key = key
+	fb.fileLock.Unlock()
+
+	if err := fb.persistManifest(containerFile); err != nil {
+		fb.fileLock.Lock()
+		containerFile.S3Key = previous
+		fb.fileLock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// handleS3Keys reports the key layout and last migration (GET) or migrates
+// containers to the configured layout (POST /admin/s3-keys; dry run unless ?dry_run=false)
+func (fb *FileBox) handleS3Keys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		fb.s3KeyMigration.mu.Lock()
+		status := struct {
+			Template      string                `json:"template"`
+			LastMigration *S3KeyMigrationReport `json:"last_migration,omitempty"`
+		}{fb.s3Layout().template, fb.s3KeyMigration.last}
+		fb.s3KeyMigration.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case "POST":
+		if fb.s3Client == nil {
+			http.Error(w, "S3 is not configured", http.StatusServiceUnavailable)
+			return
+		}
+		report, err := fb.migrateS3Keys(r.Context(), r.URL.Query().Get("dry_run") != "false")
+		if err == errS3KeyMigrationRunning {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("S3 key migration to %q: %d containers checked, %d moved, %d already in place, %d errors (dry run: %v)",
+			report.Template, report.Checked, len(report.Moved), report.InPlace, len(report.Errors), report.DryRun)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
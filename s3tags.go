@@ -0,0 +1,60 @@
+// S3 object tags for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Tags set on every uploaded container object, for lifecycle rules, cost
+// allocation and tools that work on the bucket directly
+const (
+	s3TagMachine   = "filebox-machine-id"
+	s3TagFID       = "filebox-fid"
+	s3TagBlobCount = "filebox-blob-count" // Index entries when uploaded; nothing is appended afterwards
+	s3TagCreated   = "filebox-created"    // RFC 3339, UTC
+	s3TagTenant    = "filebox-tenant"     // Left out for the default tenant
+)
+
+// s3TagValueLimit is the longest tag value S3 accepts
+const s3TagValueLimit = 256
+
+// containerTagging returns a container object's tag set, encoded for the
+// Tagging field of PutObject, or nil with S3_OBJECT_TAGGING off. Callers
+// must hold fb.fileLock.
+func (fb *FileBox) containerTagging(containerFile *ContainerFile) *string {
+	if !fb.s3Tagging {
+		return nil
+	}
+	tags := url.Values{}
+	tags.Set(s3TagMachine, strconv.FormatUint(uint64(containerFile.FID.MachineID), 10))
+	tags.Set(s3TagFID, containerFile.FID.String())
+	tags.Set(s3TagBlobCount, strconv.Itoa(len(fb.containerBlobs(containerFile))))
+	tags.Set(s3TagCreated, containerFile.Created.UTC().Format(time.RFC3339))
+	if containerFile.Tenant != "" {
+		tags.Set(s3TagTenant, s3TagValue(containerFile.Tenant))
+	}
+	tagging := tags.Encode()
+	return &tagging
+}
+
+// s3TagValue replaces the characters S3 does not allow in tag values with
+// underscores and cuts the value to the longest S3 accepts
+func s3TagValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) || strings.ContainsRune("_.:/=+-@", r) {
+			return r
+		}
+		return '_'
+	}, value)
+	if runes := []rune(value); len(runes) > s3TagValueLimit {
+		value = string(runes[:s3TagValueLimit])
+	}
+	return value
+}
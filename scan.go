@@ -0,0 +1,269 @@
+// Content scanning for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Scan states recorded on blobs
+const (
+	ScanPending  = "pending"  // Stored but not yet scanned; reads are refused
+	ScanClean    = "clean"    // Scanned and available
+	ScanInfected = "infected" // Quarantined; reads are refused for good
+	ScanFailed   = "error"    // The scanner could not be reached; reads are refused
+)
+
+// scanAttempts is how often a scan is tried before the blob is marked ScanFailed
+const scanAttempts = 3
+
+// ScanResult - Scan state and verdict stored with a blob
+type ScanResult struct {
+	Status    string     `json:"status"`
+	Verdict   string     `json:"verdict,omitempty"` // Signature name or scanner error
+	Scanner   string     `json:"scanner,omitempty"`
+	ScannedAt *time.Time `json:"scanned_at,omitempty"`
+}
+
+// ScanVerdict - What a scanner found in a blob
+type ScanVerdict struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner - Checks blob content for malware or policy violations
+type Scanner interface {
+	Name() string
+	Scan(ctx context.Context, data []byte) (ScanVerdict, error)
+}
+
+// ScanError - The blob is not available because of its scan state
+type ScanError struct {
+	BlobID string
+	Result ScanResult
+}
+
+func (e *ScanError) Error() string {
+	switch e.Result.Status {
+	case ScanInfected:
+		return fmt.Sprintf("blob %s is quarantined: %s", e.BlobID, e.Result.Verdict)
+	case ScanFailed:
+		return fmt.Sprintf("blob %s could not be scanned: %s", e.BlobID, e.Result.Verdict)
+	}
+	return fmt.Sprintf("blob %s is waiting for a content scan", e.BlobID)
+}
+
+// StatusCode maps a scan state to the HTTP status returned for reads
+func (e *ScanError) StatusCode() int {
+	if e.Result.Status == ScanInfected {
+		return http.StatusUnavailableForLegalReasons
+	}
+	return http.StatusLocked
+}
+
+// loadScanner reads SCAN_CLAMAV_ADDR or SCAN_WEBHOOK_URL, plus SCAN_TIMEOUT;
+// it returns nil when scanning is disabled
+func loadScanner() Scanner {
+	timeout := getEnvDuration("SCAN_TIMEOUT", 30*time.Second)
+	if addr := os.Getenv("SCAN_CLAMAV_ADDR"); addr != "" {
+		log.Printf("Scanning new blobs with ClamAV at %s", addr)
+		return &clamavScanner{addr: addr, timeout: timeout}
+	}
+	if url := os.Getenv("SCAN_WEBHOOK_URL"); url != "" {
+		log.Printf("Scanning new blobs with webhook %s", url)
+		return &webhookScanner{url: url, client: &http.Client{Timeout: timeout}}
+	}
+	return nil
+}
+
+// clamavScanner - Streams blobs to clamd with the INSTREAM command
+type clamavScanner struct {
+	addr    string
+	timeout time.Duration
+}
+
+func (c *clamavScanner) Name() string {
+	return "clamav"
+}
+
+func (c *clamavScanner) Scan(ctx context.Context, data []byte) (ScanVerdict, error) {
+	dialer := net.Dialer{Timeout: c.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(timeNow().Add(c.timeout))
+
+	// Chunks are length-prefixed; a zero-length chunk ends the stream
+	writer := bufio.NewWriter(conn)
+	writer.WriteString("zINSTREAM\x00")
+	for start := 0; start < len(data); start += 64 << 10 {
+		end := start + 64<<10
+		if end > len(data) {
+			end = len(data)
+		}
+		binary.Write(writer, binary.BigEndian, uint32(end-start))
+		writer.Write(data[start:end])
+	}
+	binary.Write(writer, binary.BigEndian, uint32(0))
+	if err := writer.Flush(); err != nil {
+		return ScanVerdict{}, err
+	}
+
+	// Replies look like "stream: OK" or "stream: Eicar-Signature FOUND"
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return ScanVerdict{}, err
+	}
+	reply = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(reply, "stream:"), "\x00"))
+	switch {
+	case reply == "OK":
+		return ScanVerdict{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanVerdict{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	}
+	return ScanVerdict{}, fmt.Errorf("clamd: %s", reply)
+}
+
+// webhookScanner - POSTs blobs to an HTTP service answering {"infected": bool, "verdict": "..."}
+type webhookScanner struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookScanner) Name() string {
+	return "webhook"
+}
+
+func (s *webhookScanner) Scan(ctx context.Context, data []byte) (ScanVerdict, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(data))
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return ScanVerdict{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ScanVerdict{}, fmt.Errorf("scan webhook returned %s", resp.Status)
+	}
+
+	var result struct {
+		Infected bool   `json:"infected"`
+		Verdict  string `json:"verdict"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return ScanVerdict{}, fmt.Errorf("invalid scan webhook response: %v", err)
+	}
+	return ScanVerdict{Infected: result.Infected, Signature: result.Verdict}, nil
+}
+
+// scanBlob scans a new blob, records the verdict and, if it is clean,
+// hands it to the upload hooks
+func (fb *FileBox) scanBlob(blob BlobInfo, tenant string, data []byte) {
+	var verdict ScanVerdict
+	var err error
+	for attempt := 1; attempt <= scanAttempts; attempt++ {
+		verdict, err = fb.scanner.Scan(context.Background(), data)
+		if err == nil {
+			break
+		}
+		log.Printf("Scan of blob %s failed (attempt %d/%d): %v", blob.ID, attempt, scanAttempts, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+
+	now := timeNow().UTC()
+	result := ScanResult{Status: ScanClean, Scanner: fb.scanner.Name(), ScannedAt: &now}
+	switch {
+	case err != nil:
+		result.Status, result.Verdict = ScanFailed, err.Error()
+	case verdict.Infected:
+		result.Status, result.Verdict = ScanInfected, verdict.Signature
+		log.Printf("Blob %s quarantined by %s: %s", blob.ID, fb.scanner.Name(), verdict.Signature)
+	}
+	if err := fb.setScanResult(blob.ID, result); err != nil {
+		log.Printf("Error recording scan of blob %s: %v", blob.ID, err)
+		return
+	}
+
+	if result.Status == ScanClean && len(fb.uploadHooks) > 0 && !blob.CustomerKey {
+		fb.runUploadHooks(blob, tenant, data)
+	}
+}
+
+// setScanResult stores a blob's scan state
+func (fb *FileBox) setScanResult(blobID string, result ScanResult) error {
+	containerFile, index, err := fb.findBlob(blobID)
+	if err != nil {
+		return err
+	}
+
+	fb.fileLock.Lock()
+	containerFile.Blobs[index].Scan = &result
+	fb.fileLock.Unlock()
+
+	fb.saveBlobMetadata(containerFile, index)
+	fb.logBlobChange(MetaOpScan, containerFile, index)
+	return nil
+}
+
+// resumePendingScans rescans blobs whose scan was cut short by a restart
+func (fb *FileBox) resumePendingScans() {
+	if fb.scanner == nil {
+		return
+	}
+
+	type pendingScan struct {
+		containerFile *ContainerFile
+		blob          BlobInfo
+	}
+	var pending []pendingScan
+	fb.fileLock.RLock()
+	for _, containerFile := range fb.files.all() {
+		for _, blob := range fb.containerBlobs(containerFile) {
+			if !blob.Uncommitted && blob.Scan != nil && blob.Scan.Status == ScanPending {
+				pending = append(pending, pendingScan{containerFile, blob})
+			}
+		}
+	}
+	fb.fileLock.RUnlock()
+
+	for _, p := range pending {
+		// The customer's key was only held in memory for the upload, so the
+		// blob can never be read to scan it; settle it instead of leaving it pending
+		if p.blob.CustomerKey {
+			now := timeNow().UTC()
+			result := ScanResult{Status: ScanFailed, Verdict: "customer key not available to scan after a restart", Scanner: fb.scanner.Name(), ScannedAt: &now}
+			if err := fb.setScanResult(p.blob.ID, result); err != nil {
+				log.Printf("Error recording scan of blob %s: %v", p.blob.ID, err)
+			}
+			continue
+		}
+		data, err := fb.readBlobPlaintext(context.Background(), p.containerFile, p.blob)
+		if err != nil {
+			log.Printf("Cannot rescan blob %s: %v", p.blob.ID, err)
+			continue
+		}
+		fb.fileLock.RLock()
+		tenant := p.containerFile.Tenant
+		fb.fileLock.RUnlock()
+		fb.scanBlob(p.blob, tenant, data)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// testScanner - Passes everything, or blocks every scan while hold is open
+type testScanner struct {
+	hold    chan struct{}
+	scanned [][]byte
+}
+
+func (s *testScanner) Name() string { return "test" }
+
+func (s *testScanner) Scan(ctx context.Context, data []byte) (ScanVerdict, error) {
+	if s.hold != nil {
+		<-s.hold
+	}
+	s.scanned = append(s.scanned, data)
+	return ScanVerdict{}, nil
+}
+
+func scanStatus(t *testing.T, fb *FileBox, blobID string) ScanResult {
+	t.Helper()
+	containerFile, index, err := fb.findBlob(blobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+	if scan := containerFile.Blobs[index].Scan; scan != nil {
+		return *scan
+	}
+	return ScanResult{}
+}
+
+// TestResumePendingScansAfterRestart restarts a node while its scans are
+// stuck: plain blobs are scanned again, customer-key blobs are settled
+func TestResumePendingScansAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	fb := newTestFileBox(t, dir)
+	fb.scanner = &testScanner{hold: make(chan struct{})} // Never released: the node "crashes" mid-scan
+
+	plain, err := fb.AddBlob([]byte("plain content"), BlobOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	customerKey := bytes.Repeat([]byte{7}, 32)
+	sealed, err := fb.AddBlob([]byte("customer content"), BlobOptions{customerKey: customerKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blobID := range []string{plain.ID, sealed.ID} {
+		if status := scanStatus(t, fb, blobID).Status; status != ScanPending {
+			t.Fatalf("blob %s scan is %q before the restart, want %q", blobID, status, ScanPending)
+		}
+	}
+
+	fb.meta.Close()
+	fb = newTestFileBox(t, dir)
+	scanner := &testScanner{}
+	fb.scanner = scanner
+	fb.resumePendingScans()
+
+	if status := scanStatus(t, fb, plain.ID).Status; status != ScanClean {
+		t.Errorf("plain blob scan is %q after the restart, want %q", status, ScanClean)
+	}
+	result := scanStatus(t, fb, sealed.ID)
+	if result.Status != ScanFailed || result.Verdict == "" {
+		t.Errorf("customer-key blob scan is %+v after the restart, want %q with a verdict", result, ScanFailed)
+	}
+	if len(scanner.scanned) != 1 || string(scanner.scanned[0]) != "plain content" {
+		t.Errorf("scanner saw %q, want only the plain blob", scanner.scanned)
+	}
+
+	// Reads get the settled verdict instead of waiting on a scan that cannot run
+	_, err = fb.GetBlob(withCustomerKey(context.Background(), customerKey), sealed.ID)
+	var scanErr *ScanError
+	if !errors.As(err, &scanErr) || scanErr.Result.Status != ScanFailed || scanErr.StatusCode() != http.StatusLocked {
+		t.Errorf("reading the customer-key blob returned %v, want a %q scan error", err, ScanFailed)
+	}
+}
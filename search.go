@@ -0,0 +1,237 @@
+// Blob search by metadata for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tagIndex - Secondary index from "key=value" to the blob IDs carrying that tag
+type tagIndex map[string]map[string]struct{}
+
+// add indexes every tag of a blob
+func (idx tagIndex) add(blob BlobInfo) {
+	for k, v := range blob.Tags {
+		term := k + "=" + v
+		if idx[term] == nil {
+			idx[term] = make(map[string]struct{})
+		}
+		idx[term][blob.ID] = struct{}{}
+	}
+}
+
+// remove drops every tag of a blob from the index
+func (idx tagIndex) remove(blob BlobInfo) {
+	for k, v := range blob.Tags {
+		term := k + "=" + v
+		delete(idx[term], blob.ID)
+		if len(idx[term]) == 0 {
+			delete(idx, term)
+		}
+	}
+}
+
+// parseTagHeaders parses X-FileBox-Tag headers; each is "k=v", optionally comma-separated
+func parseTagHeaders(values []string) map[string]string {
+	var tags map[string]string
+	for _, value := range values {
+		for _, pair := range strings.Split(value, ",") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || k == "" {
+				continue
+			}
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// SearchQuery - Filters for GET /search; zero values match everything
+type SearchQuery struct {
+	Tags          map[string]string
+	ContentType   string
+	Tenant        string
+	MinSize       int64
+	MaxSize       int64
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Cursor        string // Return results with blob IDs after this one
+	Limit         int
+}
+
+// SearchResult - A blob matching a search
+type SearchResult struct {
+	ID          string            `json:"id"`
+	Key         string            `json:"key,omitempty"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"content_type,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Created     time.Time         `json:"created"`
+	Tenant      string            `json:"tenant,omitempty"`
+}
+
+// SearchResponse - A page of search results
+type SearchResponse struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// Search returns one page of blobs matching the query, ordered by blob ID
+func (fb *FileBox) Search(q SearchQuery) SearchResponse {
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+
+	var matches []SearchResult
+	now := timeNow()
+	addMatch := func(containerFile *ContainerFile, blob BlobInfo) {
+		if q.Tenant != "" && containerFile.Tenant != q.Tenant {
+			return
+		}
+		if blob.Uncommitted || blob.DeletedAt != nil || expired(containerFile, blob, now) || blob.VariantOf != "" || blob.ID <= q.Cursor || !fb.matchesSearch(blob, q) {
+			return
+		}
+		matches = append(matches, SearchResult{
+			ID:          blob.ID,
+			Key:         blob.Key,
+			Size:        blob.Size,
+			ContentType: blob.ContentType,
+			Tags:        blob.Tags,
+			Created:     blob.Created,
+			Tenant:      containerFile.Tenant,
+		})
+	}
+
+	if candidates := fb.tagCandidates(q.Tags); candidates != nil {
+		// Tag filters narrow the search to the smallest posting list
+		for blobID := range candidates {
+			if containerFile, blob, ok := fb.lookupBlob(blobID); ok {
+				addMatch(containerFile, blob)
+			}
+		}
+	} else {
+		for _, containerFile := range fb.files.all() {
+			for _, blob := range fb.containerBlobs(containerFile) {
+				addMatch(containerFile, blob)
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+
+	response := SearchResponse{Results: matches}
+	if q.Limit > 0 && len(matches) > q.Limit {
+		response.Results = matches[:q.Limit]
+		response.NextCursor = matches[q.Limit-1].ID
+	}
+	if response.Results == nil {
+		response.Results = []SearchResult{}
+	}
+	return response
+}
+
+// tagCandidates returns the smallest set of blob IDs carrying one of the
+// queried tags, or nil when the query has no tag filters
+// Callers must hold fb.fileLock.
+func (fb *FileBox) tagCandidates(tags map[string]string) map[string]struct{} {
+	var smallest map[string]struct{}
+	for k, v := range tags {
+		postings := fb.tagIndex[k+"="+v]
+		if postings == nil {
+			return map[string]struct{}{} // No blob has this tag
+		}
+		if smallest == nil || len(postings) < len(smallest) {
+			smallest = postings
+		}
+	}
+	return smallest
+}
+
+// matchesSearch applies every filter of a query to a blob
+// Callers must hold fb.fileLock.
+func (fb *FileBox) matchesSearch(blob BlobInfo, q SearchQuery) bool {
+	for k, v := range q.Tags {
+		if _, ok := fb.tagIndex[k+"="+v][blob.ID]; !ok {
+			return false
+		}
+	}
+	if q.ContentType != "" && !strings.HasPrefix(blob.ContentType, q.ContentType) {
+		return false
+	}
+	if q.MinSize > 0 && blob.Size < q.MinSize {
+		return false
+	}
+	if q.MaxSize > 0 && blob.Size > q.MaxSize {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && !blob.Created.After(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !blob.Created.Before(q.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+func (fb *FileBox) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	q := SearchQuery{
+		ContentType: params.Get("content_type"),
+		Tenant:      params.Get("tenant"),
+		Cursor:      params.Get("cursor"),
+		Limit:       100,
+	}
+
+	for _, tag := range params["tag"] {
+		k, v, ok := strings.Cut(tag, ":")
+		if !ok {
+			http.Error(w, "tag must be key:value", http.StatusBadRequest)
+			return
+		}
+		if q.Tags == nil {
+			q.Tags = make(map[string]string)
+		}
+		q.Tags[k] = v
+	}
+
+	var err error
+	for name, dst := range map[string]*int64{"min_size": &q.MinSize, "max_size": &q.MaxSize} {
+		if v := params.Get(name); v != "" {
+			if *dst, err = strconv.ParseInt(v, 10, 64); err != nil {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	for name, dst := range map[string]*time.Time{"created_after": &q.CreatedAfter, "created_before": &q.CreatedBefore} {
+		if v := params.Get(name); v != "" {
+			if *dst, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "Invalid "+name+", expected RFC 3339", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 || q.Limit > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.Search(q))
+}
@@ -0,0 +1,128 @@
+// HTTP server configuration for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ServerConfig - Connection limits and per-endpoint timeouts for the HTTP listeners
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration // Default for requests without an endpoint timeout
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// Per-endpoint limits on the whole request, replacing ReadTimeout and WriteTimeout
+	UploadTimeout   time.Duration // POST /upload and resumable upload chunks
+	DownloadTimeout time.Duration // GET /blob/ and /key/
+	PeerTimeout     time.Duration // Replication and container transfers between nodes
+	AdminTimeout    time.Duration // /admin/ and /debug/ (snapshots, exports, profiles)
+	APITimeout      time.Duration // Everything else: listings, search, metadata changes
+
+	CertFile       string // Serve TLS (and HTTP/2) when set
+	KeyFile        string
+	CleartextHTTP2 bool // Accept HTTP/2 without TLS (h2c)
+}
+
+// loadServerConfig reads the HTTP_* settings, TLS_CERT_FILE and TLS_KEY_FILE
+func loadServerConfig() ServerConfig {
+	return ServerConfig{
+		ReadHeaderTimeout: getEnvDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       getEnvDuration("HTTP_READ_TIMEOUT", time.Minute),
+		WriteTimeout:      getEnvDuration("HTTP_WRITE_TIMEOUT", time.Minute),
+		IdleTimeout:       getEnvDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+		MaxHeaderBytes:    int(getEnvInt("HTTP_MAX_HEADER_BYTES", 64*1024)),
+
+		UploadTimeout:   getEnvDuration("HTTP_UPLOAD_TIMEOUT", 15*time.Minute),
+		DownloadTimeout: getEnvDuration("HTTP_DOWNLOAD_TIMEOUT", 15*time.Minute),
+		PeerTimeout:     getEnvDuration("HTTP_PEER_TIMEOUT", 30*time.Minute),
+		AdminTimeout:    getEnvDuration("HTTP_ADMIN_TIMEOUT", 30*time.Minute),
+		APITimeout:      getEnvDuration("HTTP_API_TIMEOUT", 30*time.Second),
+
+		CertFile:       os.Getenv("TLS_CERT_FILE"),
+		KeyFile:        os.Getenv("TLS_KEY_FILE"),
+		CleartextHTTP2: getEnvBool("HTTP2_CLEARTEXT", false),
+	}
+}
+
+// endpointTimeout picks the time limit for a request by endpoint
+func (cfg ServerConfig) endpointTimeout(r *http.Request) time.Duration {
+	switch endpointClass(r) {
+	case EndpointAdmin:
+		return cfg.AdminTimeout
+	case EndpointPeer:
+		return cfg.PeerTimeout
+	case EndpointUpload:
+		return cfg.UploadTimeout
+	case EndpointDownload:
+		return cfg.DownloadTimeout
+	}
+	return cfg.APITimeout
+}
+
+// withEndpointTimeouts replaces the server-wide read and write deadlines with
+// the endpoint's own limit, and cancels the request context when it passes,
+// so large transfers get time without letting slow clients hold small requests open
+func (cfg ServerConfig) withEndpointTimeouts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := cfg.endpointTimeout(r)
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		deadline := timeNow().Add(timeout)
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("Error setting read deadline: %v", err)
+		}
+		if err := rc.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("Error setting write deadline: %v", err)
+		}
+
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// newHTTPServer builds a hardened server for one of the listeners
+func newHTTPServer(cfg ServerConfig, handler http.Handler) *http.Server {
+	handler = cfg.withEndpointTimeouts(handler)
+
+	server := &http.Server{
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+
+	// With TLS, HTTP/2 is negotiated automatically; without it only on request
+	if cfg.CertFile == "" && cfg.CleartextHTTP2 {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: cfg.IdleTimeout})
+	}
+	server.Handler = handler
+	return server
+}
+
+// serve runs a server on a listener, with TLS if a certificate is configured
+func serve(cfg ServerConfig, server *http.Server, listener net.Listener) error {
+	if cfg.CertFile != "" {
+		return server.ServeTLS(listener, cfg.CertFile, cfg.KeyFile)
+	}
+	return server.Serve(listener)
+}
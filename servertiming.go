@@ -0,0 +1,106 @@
+// Server-Timing response headers for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Steps reported in the Server-Timing header, in the order they run
+const (
+	timingLock        = "lock"        // Waiting for the index lock or a free container
+	timingWrite       = "write"       // Appending the record to the container file
+	timingFsync       = "fsync"       // Flushing the append with FSYNC_WRITES
+	timingIndex       = "index"       // Adding the blob to the index and saving the manifest
+	timingReplication = "replication" // Waiting for replica acknowledgements
+	timingRead        = "read"        // Reading the blob from the local container file
+	timingS3          = "s3"          // Reading the blob from S3 or the blob cache
+	timingRemote      = "remote"      // Reading the blob from the federated cluster
+	timingVerify      = "verify"      // Checking the blob's integrity hash
+	timingDecrypt     = "decrypt"     // Opening encrypted and customer-key blobs
+	timingTotal       = "total"       // Everything until the response headers were sent
+)
+
+// timingDescriptions label the steps in browser developer tools
+var timingDescriptions = map[string]string{
+	timingLock:        "Lock wait",
+	timingWrite:       "Disk write",
+	timingFsync:       "Fsync",
+	timingIndex:       "Index update",
+	timingReplication: "Replication wait",
+	timingRead:        "Disk read",
+	timingS3:          "S3 read",
+	timingRemote:      "Federated read",
+	timingVerify:      "Integrity check",
+	timingDecrypt:     "Decryption",
+	timingTotal:       "Total",
+}
+
+// timingStep - Time one request spent on one step
+type timingStep struct {
+	name string
+	d    time.Duration
+}
+
+// step records time spent on a named step for the Server-Timing header;
+// repeated steps add up. A nil trace ignores it.
+func (t *requestTrace) step(name string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.steps {
+		if t.steps[i].name == name {
+			t.steps[i].d += d
+			return
+		}
+	}
+	t.steps = append(t.steps, timingStep{name: name, d: d})
+}
+
+// serverTiming formats the recorded steps and the total as a Server-Timing header value
+func (t *requestTrace) serverTiming(total time.Duration) string {
+	t.mu.Lock()
+	steps := append(slices.Clone(t.steps), timingStep{name: timingTotal, d: total})
+	t.mu.Unlock()
+
+	entries := make([]string, len(steps))
+	for i, step := range steps {
+		entries[i] = fmt.Sprintf("%s;dur=%.3f;desc=%q", step.name, millis(step.d), timingDescriptions[step.name])
+	}
+	return strings.Join(entries, ", ")
+}
+
+// serverTimingWriter adds the Server-Timing header just before the response headers go out
+type serverTimingWriter struct {
+	http.ResponseWriter
+	trace   *requestTrace
+	started time.Time
+	sent    bool
+}
+
+func (s *serverTimingWriter) setHeader() {
+	if !s.sent {
+		s.sent = true
+		s.Header().Set("Server-Timing", s.trace.serverTiming(timeNow().Sub(s.started)))
+	}
+}
+
+// WriteHeader implements http.ResponseWriter
+func (s *serverTimingWriter) WriteHeader(status int) {
+	s.setHeader()
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (s *serverTimingWriter) Write(data []byte) (int, error) {
+	s.setHeader()
+	return s.ResponseWriter.Write(data)
+}
@@ -0,0 +1,186 @@
+// Storage directory sharding for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Container files live two directory levels down, in ab/cd/<fid>, so no
+// directory holds more than a few hundred entries even with millions of
+// containers. The shard comes from the FID's hash, since the leading
+// characters (machine ID, timestamp) are the same for most files on a node.
+
+// shardedPath returns where a container file is kept under storageDir.
+// Names that are not FIDs stay at the top level.
+func shardedPath(storageDir, fileID string) string {
+	if !isShardedName(fileID) {
+		return filepath.Join(storageDir, fileID)
+	}
+	hash := fileID[len(fileID)-8:]
+	return filepath.Join(storageDir, hash[0:2], hash[2:4], fileID)
+}
+
+// newContainerPath returns where a new container file of about size bytes
+// goes, on the volume with the most room, creating its shard directories.
+// A failure shows up when the file is opened.
+func (fb *FileBox) newContainerPath(fileID string, size int64) string {
+	path := shardedPath(fb.pickVolume(size), fileID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("Error creating shard directory for %s: %v", fileID, err)
+	}
+	return path
+}
+
+// filePathOf returns where a container file is now. It changes when the
+// container's volume goes offline, so callers not holding fb.fileLock read
+// it through here.
+func (fb *FileBox) filePathOf(containerFile *ContainerFile) string {
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+	return containerFile.FilePath
+}
+
+// containerFileExists reports whether a container file is on any volume,
+// or cannot be checked
+func (fb *FileBox) containerFileExists(fileID string) bool {
+	for _, root := range fb.volumeRoots() {
+		if _, err := os.Stat(shardedPath(root, fileID)); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// isShardedName reports whether a name is as long as a FID
+func isShardedName(fileID string) bool {
+	return len(fileID) == fidLength || len(fileID) == wideFIDLength
+}
+
+// isShardDir reports whether a directory name is a shard level: two hex digits
+func isShardDir(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	for _, c := range name {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// containerFileEntry - A file found in the storage directory
+type containerFileEntry struct {
+	name string
+	path string
+}
+
+// listContainerFiles returns every file in the shard directories of every
+// volume. Files left at the top level by older versions, or in the wrong
+// shard, are moved into place on their volume first; a crash part way
+// through just leaves the rest for the next start. Files that are not FIDs
+// are listed where they are. A file on two volumes is used from the first.
+// Only the primary volume failing to list is an error; other volumes are
+// marked unhealthy and skipped.
+func (fb *FileBox) listContainerFiles() ([]containerFileEntry, error) {
+	var files []containerFileEntry
+	listed := make(map[string]string) // Moved files can turn up again in a shard not walked yet
+	list := func(name, path string) {
+		switch listed[name] {
+		case "":
+			listed[name] = path
+			files = append(files, containerFileEntry{name: name, path: path})
+		case path:
+		default:
+			log.Printf("WARNING: %s is also at %s; leaving the copy at %s alone", name, listed[name], path)
+		}
+	}
+	migrated := 0
+	place := func(root, name, path string) {
+		target := shardedPath(root, name)
+		if _, err := ParseFID(name); err != nil || target == path {
+			list(name, path)
+			return
+		}
+		if listed[name] != "" {
+			list(name, path)
+			return
+		}
+		if _, err := os.Stat(target); err == nil {
+			log.Printf("WARNING: %s is also at %s; leaving the copy at %s alone", name, target, path)
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+			if err = os.Rename(path, target); err == nil {
+				migrated++
+				list(name, target)
+				return
+			}
+		}
+		log.Printf("Error moving %s into its shard directory; using it in place", path)
+		list(name, path)
+	}
+
+	if err := listVolume(fb.storageDir, place); err != nil {
+		return nil, err
+	}
+	for _, v := range fb.volumes[min(1, len(fb.volumes)):] {
+		if !v.isHealthy() {
+			continue
+		}
+		if err := listVolume(v.path, place); err != nil {
+			v.fail(err)
+		}
+	}
+
+	if migrated > 0 {
+		log.Printf("Moved %d container files into shard directories", migrated)
+	}
+	return files, nil
+}
+
+// listVolume calls place for every file at the top level and in the shard
+// directories of one volume
+func listVolume(root string, place func(root, name, path string)) error {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			if entry.Name() != volumeProbeFile {
+				place(root, entry.Name(), filepath.Join(root, entry.Name()))
+			}
+			continue
+		}
+		if !isShardDir(entry.Name()) {
+			continue // manifests, node state, staging areas
+		}
+		level1 := filepath.Join(root, entry.Name())
+		subdirs, err := os.ReadDir(level1)
+		if err != nil {
+			return err
+		}
+		for _, subdir := range subdirs {
+			if !subdir.IsDir() || !isShardDir(subdir.Name()) {
+				continue
+			}
+			level2 := filepath.Join(level1, subdir.Name())
+			shardEntries, err := os.ReadDir(level2)
+			if err != nil {
+				return err
+			}
+			for _, shardEntry := range shardEntries {
+				if !shardEntry.IsDir() {
+					place(root, shardEntry.Name(), filepath.Join(level2, shardEntry.Name()))
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Blob signatures for delta downloads in FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// A signature lets a client holding an older version of a blob fetch only
+// what changed, as rsync does. It lists a weak rolling checksum and a
+// strong hash for each fixed-size block of the blob. The client slides a
+// window of the block size over its old copy one byte at a time, updating
+// the weak checksum cheaply; where it matches a block's weak checksum and
+// the strong hash agrees, the client already has that block. The blocks
+// it found nowhere are fetched with Range requests.
+
+const (
+	defaultSignatureBlock = 8 * 1024
+	minSignatureBlock     = 512
+	maxSignatureBlock     = 1024 * 1024
+)
+
+// BlobSignature - Response for GET /blob/{id}/signature
+type BlobSignature struct {
+	ID         string           `json:"id"` // Fetch ranges from this blob; a key may move on
+	Size       int64            `json:"size"`
+	BlockSize  int              `json:"block_size"` // The last block may be shorter
+	WeakHash   string           `json:"weak_hash"`
+	StrongHash string           `json:"strong_hash"`
+	Blocks     []SignatureBlock `json:"blocks"`
+}
+
+// SignatureBlock - Checksums of one block; block i starts at i*BlockSize
+type SignatureBlock struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// weakChecksum is rsync's rolling checksum: with a the sum of the bytes
+// and b the sum of each byte times its distance from the end of the block,
+// both mod 2^16, it is a | b<<16. Sliding the window by one byte updates
+// a and b without rereading the block.
+func weakChecksum(block []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | (b&0xffff)<<16
+}
+
+// strongChecksum is the first 16 bytes of the block's SHA-256
+func strongChecksum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:16])
+}
+
+// blobSignature computes the signature of a blob's plaintext
+func blobSignature(blobID string, data []byte, blockSize int) BlobSignature {
+	signature := BlobSignature{
+		ID:         blobID,
+		Size:       int64(len(data)),
+		BlockSize:  blockSize,
+		WeakHash:   "rsync",
+		StrongHash: "sha256-128",
+		Blocks:     make([]SignatureBlock, 0, (len(data)+blockSize-1)/blockSize),
+	}
+	for start := 0; start < len(data); start += blockSize {
+		block := data[start:min(start+blockSize, len(data))]
+		signature.Blocks = append(signature.Blocks, SignatureBlock{Weak: weakChecksum(block), Strong: strongChecksum(block)})
+	}
+	return signature
+}
+
+// handleSignature serves GET /blob/{id}/signature and GET /key/{key}/signature
+func (fb *FileBox) handleSignature(w http.ResponseWriter, r *http.Request, blobID string) {
+	blockSize := defaultSignatureBlock
+	if value := r.URL.Query().Get("block_size"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < minSignatureBlock || n > maxSignatureBlock {
+			http.Error(w, "Invalid block_size (want 512 to 1048576 bytes)", http.StatusBadRequest)
+			return
+		}
+		blockSize = n
+	}
+	customerKey, err := customerKeyFrom(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	blobData, err := fb.GetBlob(withCustomerKey(r.Context(), customerKey), blobID)
+	if writeReadError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blobSignature(blobID, blobData, blockSize))
+}
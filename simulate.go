@@ -0,0 +1,605 @@
+// Deterministic cluster simulation for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// `filebox simulate` runs a whole cluster inside one process, on one
+// goroutine, from a seed. Every node is a FileBox with its own storage
+// directory; nothing runs in the background. Time is a virtual clock
+// that only moves when the simulator moves it, the network is an
+// in-process transport that calls the peer's handlers directly, and every
+// choice (what to write, which node to crash, which request to drop) comes
+// from one seeded random source. The same seed therefore replays the same
+// history, so a run that breaks an invariant can be replayed and traced
+// until the bug is understood.
+//
+// Crashes are process crashes: the node is dropped without shutting down,
+// and whatever it had written to its files survives. Half the time the
+// crash also leaves a torn record at the end of the node's newest
+// container, as if it died mid-append.
+
+// simStart is the virtual time every simulation starts at
+var simStart = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// simBlob - An acknowledged write and what reading it must return
+type simBlob struct {
+	id     string
+	node   *simNode
+	digest [sha256.Size]byte
+}
+
+// simNode - One simulated node; fb is nil while it is down
+type simNode struct {
+	name      string
+	addr      string
+	machineID uint32
+	dir       string
+	replicas  []string
+	fb        *FileBox
+	handler   http.Handler
+	blobs     []*simBlob // Acknowledged by this node
+}
+
+// simulation - The cluster, the virtual clock, the network and the history
+type simulation struct {
+	rng      *mathrand.Rand
+	now      time.Time
+	nodes    []*simNode
+	cut      map[string]bool // "from>to" pairs whose requests fail
+	dropRate float64         // Chance a peer request or its reply is lost
+	trace    bool
+
+	blobs      []*simBlob
+	history    []string
+	violations []string
+	counts     map[string]int
+}
+
+// runSimulate implements `filebox simulate`: a reproducible cluster history from a seed
+func runSimulate(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	seed := flags.Int64("seed", 0, "Seed for every random choice; 0 picks one")
+	nodes := flags.Int("nodes", 3, "Nodes in the cluster, each replicating to all the others")
+	steps := flags.Int("steps", 500, "Operations to run")
+	faults := flags.Float64("faults", 0.05, "Chance a peer request or its reply is lost (0-1)")
+	trace := flags.Bool("trace", false, "Print the history as it happens")
+	verbose := flags.Bool("verbose", false, "Print the nodes' logs")
+	keep := flags.Bool("keep", false, "Keep the nodes' storage directories")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: filebox simulate [--seed N] [--nodes N] [--steps N] [--faults RATE] [--trace] [--verbose] [--keep]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 || *nodes < 2 || *nodes > 9 || *steps < 0 || *faults < 0 || *faults > 1 {
+		flags.Usage()
+		return 2
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	dir, err := os.MkdirTemp("", "filebox-simulate-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating storage directory: %v\n", err)
+		return 1
+	}
+	if *keep {
+		defer fmt.Printf("Storage directories kept in %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+	if err := setSimulationEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up the environment: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Simulating %d nodes for %d steps with seed %d\n", *nodes, *steps, *seed)
+	s := simulate(dir, *seed, *nodes, *steps, *faults, *trace)
+
+	fmt.Printf("Ran %s\n", s.summary())
+	fmt.Printf("History %s (%d events, %s of virtual time); the same seed replays it exactly\n",
+		s.historyHash(), len(s.history), s.now.Sub(simStart).Round(time.Millisecond))
+	if len(s.violations) > 0 {
+		fmt.Printf("%d invariant violations:\n", len(s.violations))
+		for _, violation := range s.violations {
+			fmt.Printf("  %s\n", violation)
+		}
+		fmt.Printf("Replay with: filebox simulate --seed %d --nodes %d --steps %d --faults %g --trace\n", *seed, *nodes, *steps, *faults)
+		return 1
+	}
+	fmt.Println("All invariants held")
+	return 0
+}
+
+// simulate runs a cluster of nodes under dir for a number of steps from a
+// seed, then lets it settle. The environment must already be set up with
+// setSimulationEnv.
+func simulate(dir string, seed int64, nodes, steps int, faults float64, trace bool) *simulation {
+	s := &simulation{
+		rng:      mathrand.New(mathrand.NewSource(seed)),
+		now:      simStart,
+		cut:      make(map[string]bool),
+		dropRate: faults,
+		trace:    trace,
+		counts:   make(map[string]int),
+	}
+	timeNow = func() time.Time { return s.now }
+	defer func() { timeNow = time.Now }()
+
+	// The nodes share one FID clock; a fresh one keeps an earlier run in
+	// the same process from shifting this run's FIDs
+	clock := fidClock
+	fidClock = &hybridClock{maxAhead: clock.maxAhead}
+	defer func() { fidClock = clock }()
+
+	for i := 1; i <= nodes; i++ {
+		name := fmt.Sprintf("n%d", i)
+		s.nodes = append(s.nodes, &simNode{
+			name:      name,
+			addr:      name + ":8080",
+			machineID: uint32(i),
+			dir:       filepath.Join(dir, name),
+		})
+	}
+	for _, node := range s.nodes {
+		for _, peer := range s.nodes {
+			if peer != node {
+				node.replicas = append(node.replicas, peer.addr)
+			}
+		}
+		s.start(node)
+	}
+
+	for step := 0; step < steps; step++ {
+		s.now = s.now.Add(time.Duration(1+s.rng.Intn(1000)) * time.Millisecond)
+		s.step()
+	}
+	s.settle()
+	return s
+}
+
+// historyHash identifies a run's history; runs with the same seed share it
+func (s *simulation) historyHash() string {
+	sum := sha256.Sum256([]byte(strings.Join(s.history, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// setSimulationEnv replaces the environment with the settings the
+// simulated nodes run with, so nothing outside the seed changes a run
+func setSimulationEnv() error {
+	kept := make(map[string]string)
+	for _, key := range demoEnvKeep {
+		if value, ok := os.LookupEnv(key); ok {
+			kept[key] = value
+		}
+	}
+	os.Clearenv()
+	for key, value := range kept {
+		os.Setenv(key, value)
+	}
+	settings := map[string]string{
+		"METADATA_BACKEND":          "manifest",
+		"DURABILITY_MODE":           "async",
+		"REPLICATION_STREAM_ADDR":   "off",
+		"MAX_CONTAINER_SIZE":        "64KB",
+		"PEER_BREAKER_FAILURES":     "3",
+		"AWS_REGION":                "us-east-1",
+		"AWS_EC2_METADATA_DISABLED": "true",
+	}
+	for key, value := range settings {
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record adds an event to the history
+func (s *simulation) record(source, format string, args ...any) {
+	line := fmt.Sprintf("%10.3fs  %-3s %s", s.now.Sub(simStart).Seconds(), source, fmt.Sprintf(format, args...))
+	s.history = append(s.history, line)
+	if s.trace {
+		fmt.Println(line)
+	}
+}
+
+// violate records a broken invariant
+func (s *simulation) violate(format string, args ...any) {
+	violation := fmt.Sprintf("at %.3fs: %s", s.now.Sub(simStart).Seconds(), fmt.Sprintf(format, args...))
+	s.violations = append(s.violations, violation)
+	s.record("!!", "VIOLATION %s", fmt.Sprintf(format, args...))
+}
+
+// pick returns a random node matching up, or nil
+func (s *simulation) pick(up bool) *simNode {
+	var matching []*simNode
+	for _, node := range s.nodes {
+		if (node.fb != nil) == up {
+			matching = append(matching, node)
+		}
+	}
+	if len(matching) == 0 {
+		return nil
+	}
+	return matching[s.rng.Intn(len(matching))]
+}
+
+// step runs one randomly chosen operation
+func (s *simulation) step() {
+	switch roll := s.rng.Intn(100); {
+	case roll < 45:
+		s.write()
+	case roll < 70:
+		s.read()
+	case roll < 80:
+		s.probe()
+	case roll < 84:
+		if up := s.pick(true); up != nil && s.upCount() > 1 {
+			s.crash(up)
+		}
+	case roll < 92:
+		if down := s.pick(false); down != nil {
+			s.start(down)
+		}
+	case roll < 96:
+		s.partition()
+	default:
+		s.heal()
+	}
+}
+
+func (s *simulation) upCount() int {
+	up := 0
+	for _, node := range s.nodes {
+		if node.fb != nil {
+			up++
+		}
+	}
+	return up
+}
+
+// start boots a node on its storage directory, checking that it recovered
+// every blob it acknowledged before
+func (s *simulation) start(node *simNode) {
+	os.Setenv("MACHINE_ID", strconv.FormatUint(uint64(node.machineID), 10))
+	fb := NewFileBox(Config{StorageDir: node.dir, Bucket: "simulated", Replicas: node.replicas, Simulated: true})
+	fb.replicaClient = &http.Client{Transport: &simTransport{sim: s, from: node}}
+	mux := http.NewServeMux()
+	fb.registerClusterHandlers(mux)
+	node.fb, node.handler = fb, mux
+	s.counts["start"]++
+	s.record(node.name, "start: %d containers, %d torn writes", fb.recovery.ContainersFound, len(fb.recovery.TornWrites))
+
+	for _, blob := range node.blobs {
+		s.verify(blob, "after restart")
+	}
+}
+
+// crash drops a node without shutting it down, sometimes tearing the
+// record it was writing
+func (s *simulation) crash(node *simNode) {
+	node.fb.meta.Close()
+	node.fb, node.handler = nil, nil
+	s.counts["crash"]++
+
+	torn := ""
+	if s.rng.Intn(2) == 0 {
+		if path := s.newestContainer(node); path != "" {
+			garbage := make([]byte, 1+s.rng.Intn(64))
+			s.rng.Read(garbage)
+			if file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+				file.Write(garbage)
+				file.Close()
+				torn = fmt.Sprintf(", leaving %d torn bytes in %s", len(garbage), filepath.Base(path))
+			}
+		}
+	}
+	s.record(node.name, "crash%s", torn)
+}
+
+// newestContainer returns the path of the node's own most recent container
+func (s *simulation) newestContainer(node *simNode) string {
+	newest := ""
+	for _, blob := range node.blobs {
+		if fileID, _, ok := strings.Cut(blob.id, "-"); ok && fileID > newest {
+			newest = fileID
+		}
+	}
+	if newest == "" {
+		return ""
+	}
+	return shardedPath(node.dir, newest)
+}
+
+// write stores a random blob on a random node and sends its replication
+func (s *simulation) write() {
+	node := s.pick(true)
+	data := make([]byte, 1+s.rng.Intn(8192))
+	s.rng.Read(data)
+	key := fmt.Sprintf("key-%02d", s.rng.Intn(32))
+	s.counts["write"]++
+
+	response, err := node.fb.AddBlob(data, BlobOptions{Key: key})
+	if err != nil {
+		s.record(node.name, "write %s (%d bytes) failed: %v", key, len(data), err)
+		return
+	}
+	blob := &simBlob{id: response.ID, node: node, digest: sha256.Sum256(data)}
+	node.blobs = append(node.blobs, blob)
+	s.blobs = append(s.blobs, blob)
+	s.record(node.name, "write %s (%d bytes) -> %s", key, len(data), response.ID)
+	s.replicate(node)
+}
+
+// replicate sends everything queued on a node's replication queues, the
+// way its senders would
+func (s *simulation) replicate(node *simNode) {
+	for _, replica := range node.replicas {
+		queue := node.fb.replication.queues[replica]
+		for drained := false; !drained; {
+			select {
+			case item := <-queue:
+				node.fb.sendReplicationItem(replica, queue, item)
+			default:
+				drained = true
+			}
+		}
+	}
+}
+
+// read checks a random acknowledged blob on the node that took it
+func (s *simulation) read() {
+	var readable []*simBlob
+	for _, blob := range s.blobs {
+		if blob.node.fb != nil {
+			readable = append(readable, blob)
+		}
+	}
+	if len(readable) == 0 {
+		return
+	}
+	blob := readable[s.rng.Intn(len(readable))]
+	s.counts["read"]++
+	if s.verify(blob, "on read") {
+		s.record(blob.node.name, "read %s ok", blob.id)
+	}
+}
+
+// verify reads a blob back from the node that acknowledged it
+func (s *simulation) verify(blob *simBlob, when string) bool {
+	data, err := blob.node.fb.GetBlob(context.Background(), blob.id)
+	switch {
+	case err != nil:
+		s.violate("%s lost acknowledged blob %s %s: %v", blob.node.name, blob.id, when, err)
+		return false
+	case sha256.Sum256(data) != blob.digest:
+		s.violate("%s returned the wrong bytes for blob %s %s", blob.node.name, blob.id, when)
+		return false
+	}
+	return true
+}
+
+// probe runs one round of breaker probes and hint replays on every node
+func (s *simulation) probe() {
+	s.counts["probe"]++
+	for _, node := range s.nodes {
+		if node.fb == nil {
+			continue
+		}
+		var states []string
+		node.fb.probePeers(node.fb.replayHints)
+		for _, replica := range node.replicas {
+			health := node.fb.health.snapshot(replica)
+			if health.State != BreakerClosed || health.HintedBytes > 0 {
+				states = append(states, fmt.Sprintf("%s %s with %d hinted bytes", s.nameOf(replica), health.State, health.HintedBytes))
+			}
+		}
+		if len(states) > 0 {
+			s.record(node.name, "probe: %s", strings.Join(states, ", "))
+		}
+	}
+}
+
+// partition cuts requests from one node to another
+func (s *simulation) partition() {
+	from, to := s.nodes[s.rng.Intn(len(s.nodes))], s.nodes[s.rng.Intn(len(s.nodes))]
+	if from == to || s.cut[from.name+">"+to.name] {
+		return
+	}
+	s.cut[from.name+">"+to.name] = true
+	s.counts["partition"]++
+	s.record(from.name, "partitioned from %s", to.name)
+}
+
+// heal restores every cut link
+func (s *simulation) heal() {
+	if len(s.cut) == 0 {
+		return
+	}
+	s.counts["heal"]++
+	s.record("--", "healed %d cut links", len(s.cut))
+	clear(s.cut)
+}
+
+// settle heals the network, restarts every node and replays hints until
+// none are left, then checks every replica holds all of its peers' blobs
+func (s *simulation) settle() {
+	s.record("--", "settling: heal, restart, replay")
+	s.dropRate = 0
+	clear(s.cut)
+	for _, node := range s.nodes {
+		if node.fb == nil {
+			s.start(node)
+		}
+	}
+	for round := 0; round < 20 && s.hinted(); round++ {
+		s.now = s.now.Add(time.Second)
+		s.probe()
+	}
+	if s.hinted() {
+		s.violate("hints were still pending after 20 probe rounds")
+	}
+
+	for _, node := range s.nodes {
+		for _, blob := range node.blobs {
+			s.verify(blob, "at the end")
+		}
+		for _, blob := range node.blobs {
+			s.checkReplicas(node, blob)
+		}
+	}
+}
+
+// checkReplicas checks every replica holds an acknowledged blob's record
+// at the same offset as the node that took it. Copies are compared byte
+// for byte rather than by size: a torn tail left by a crash stays in the
+// container but is never replicated.
+func (s *simulation) checkReplicas(node *simNode, blob *simBlob) {
+	node.fb.fileLock.RLock()
+	containerFile, info, ok := node.fb.lookupBlob(blob.id)
+	var path string
+	if ok {
+		path = containerFile.FilePath
+	}
+	node.fb.fileLock.RUnlock()
+	if !ok {
+		return // Already reported by verify
+	}
+	start, length := info.Offset-recordHeaderSize, recordHeaderSize+info.Length
+	want, err := readFileRange(path, start, length)
+	if err != nil {
+		s.violate("%s cannot read its own record of blob %s: %v", node.name, blob.id, err)
+		return
+	}
+	for _, replica := range node.replicas {
+		peer := s.node(replica)
+		got, err := readFileRange(shardedPath(peer.dir, filepath.Base(path)), start, length)
+		switch {
+		case err != nil:
+			s.violate("%s is missing %s's blob %s: %v", peer.name, node.name, blob.id, err)
+		case !bytes.Equal(got, want):
+			s.violate("%s's copy of %s's blob %s differs", peer.name, node.name, blob.id)
+		}
+	}
+}
+
+// readFileRange reads length bytes at start
+func readFileRange(path string, start, length int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, start); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// hinted reports whether any node still owes a replica data
+func (s *simulation) hinted() bool {
+	for _, node := range s.nodes {
+		for _, replica := range node.replicas {
+			if node.fb.health.snapshot(replica).HintedBytes > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// node finds a node by address
+func (s *simulation) node(addr string) *simNode {
+	for _, node := range s.nodes {
+		if node.addr == addr {
+			return node
+		}
+	}
+	return nil
+}
+
+// nameOf returns a node's name for its address
+func (s *simulation) nameOf(addr string) string {
+	if node := s.node(addr); node != nil {
+		return node.name
+	}
+	return addr
+}
+
+// summary lists how many of each operation ran
+func (s *simulation) summary() string {
+	var parts []string
+	for _, op := range []string{"write", "read", "probe", "crash", "start", "partition", "heal"} {
+		parts = append(parts, fmt.Sprintf("%d %s", s.counts[op], op))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// simTransport - Delivers a node's peer requests straight to the peer's
+// handlers, losing them when the peer is down, the link is cut or the
+// dice say so. Each request takes 1-20ms of virtual time.
+type simTransport struct {
+	sim  *simulation
+	from *simNode
+}
+
+func (t *simTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := t.sim
+	s.now = s.now.Add(time.Duration(1+s.rng.Intn(20)) * time.Millisecond)
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+
+	to := s.node(req.URL.Host)
+	switch {
+	case to == nil:
+		return nil, fmt.Errorf("simulated network: no such host %s", req.URL.Host)
+	case to.fb == nil:
+		return nil, fmt.Errorf("simulated network: %s is down", to.name)
+	case s.cut[t.from.name+">"+to.name]:
+		return nil, fmt.Errorf("simulated network: %s is partitioned from %s", t.from.name, to.name)
+	case s.rng.Float64() < s.dropRate:
+		s.record(t.from.name, "lost request %s to %s", req.URL.Path, to.name)
+		return nil, fmt.Errorf("simulated network: request to %s lost", to.name)
+	}
+
+	serverReq := req.Clone(req.Context())
+	serverReq.RemoteAddr = "127.0.0.1:1"
+	serverReq.RequestURI = req.URL.RequestURI()
+	if serverReq.Body == nil {
+		serverReq.Body = http.NoBody
+	}
+	recorder := httptest.NewRecorder()
+	to.handler.ServeHTTP(recorder, serverReq)
+
+	// The peer acted on it, but the sender never hears back
+	if s.rng.Float64() < s.dropRate {
+		s.record(t.from.name, "lost reply to %s from %s", req.URL.Path, to.name)
+		return nil, fmt.Errorf("simulated network: reply from %s lost", to.name)
+	}
+	return recorder.Result(), nil
+}
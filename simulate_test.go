@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestSimulationIsDeterministic runs the same short simulation twice and
+// expects the same history with every invariant held
+func TestSimulationIsDeterministic(t *testing.T) {
+	env := os.Environ()
+	out := log.Writer()
+	t.Cleanup(func() {
+		os.Clearenv()
+		for _, entry := range env {
+			key, value, _ := strings.Cut(entry, "=")
+			os.Setenv(key, value)
+		}
+		log.SetOutput(out)
+	})
+	log.SetOutput(io.Discard)
+	if err := setSimulationEnv(); err != nil {
+		t.Fatal(err)
+	}
+
+	const seed, nodes, steps, faults = 42, 3, 150, 0.05
+	first := simulate(t.TempDir(), seed, nodes, steps, faults, false)
+	second := simulate(t.TempDir(), seed, nodes, steps, faults, false)
+
+	for _, s := range []*simulation{first, second} {
+		for _, violation := range s.violations {
+			t.Errorf("invariant violated %s", violation)
+		}
+	}
+	if len(first.history) == 0 {
+		t.Fatal("the simulation recorded no history")
+	}
+	if first.historyHash() != second.historyHash() {
+		t.Errorf("seed %d replayed history %s, then %s", seed, first.historyHash(), second.historyHash())
+	}
+}
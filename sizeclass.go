@@ -0,0 +1,161 @@
+// Container size classes for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SizeClass - A container size used for blobs up to a given size
+type SizeClass struct {
+	Name          string `json:"name"`
+	ContainerSize int64  `json:"container_size"` // Containers are closed for upload at this size
+	MaxBlobSize   int64  `json:"max_blob_size"`  // Largest blob placed in this class; 0 takes any blob that fits
+}
+
+const defaultContainerSize = 100 * 1024 * 1024 // 100MB
+
+// loadSizeClasses reads CONTAINER_SIZE_CLASSES, falling back to a single
+// class of MAX_CONTAINER_SIZE
+func loadSizeClasses() []SizeClass {
+	containerSize := int64(defaultContainerSize)
+	if value := os.Getenv("MAX_CONTAINER_SIZE"); value != "" {
+		n, err := parseByteSize(value)
+		if err != nil || n <= recordHeaderSize {
+			log.Printf("Invalid MAX_CONTAINER_SIZE %q, using %d", value, containerSize)
+		} else {
+			containerSize = n
+		}
+	}
+
+	spec := os.Getenv("CONTAINER_SIZE_CLASSES")
+	if spec == "" {
+		return []SizeClass{{Name: "default", ContainerSize: containerSize}}
+	}
+
+	classes, err := parseSizeClasses(spec)
+	if err != nil {
+		log.Fatalf("Invalid CONTAINER_SIZE_CLASSES: %v", err)
+	}
+	for _, class := range classes {
+		if class.MaxBlobSize > 0 {
+			log.Printf("Size class %s: %d byte containers for blobs up to %d bytes", class.Name, class.ContainerSize, class.MaxBlobSize)
+		} else {
+			log.Printf("Size class %s: %d byte containers", class.Name, class.ContainerSize)
+		}
+	}
+	return classes
+}
+
+// parseSizeClasses parses "small:8MB:1MB;large:256MB". Each class is
+// name:containerSize[:maxBlobSize]; blobs go to the first class they fit.
+func parseSizeClasses(spec string) ([]SizeClass, error) {
+	var classes []SizeClass
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("class %q must be name:containerSize[:maxBlobSize]", entry)
+		}
+
+		class := SizeClass{Name: parts[0]}
+		var err error
+		if class.ContainerSize, err = parseByteSize(parts[1]); err != nil {
+			return nil, fmt.Errorf("class %s: %v", class.Name, err)
+		}
+		if len(parts) == 3 {
+			if class.MaxBlobSize, err = parseByteSize(parts[2]); err != nil {
+				return nil, fmt.Errorf("class %s: %v", class.Name, err)
+			}
+		}
+		if class.ContainerSize <= recordHeaderSize || class.MaxBlobSize+recordHeaderSize > class.ContainerSize {
+			return nil, fmt.Errorf("class %s: container size must exceed its largest blob", class.Name)
+		}
+		classes = append(classes, class)
+	}
+
+	if len(classes) == 0 {
+		return nil, fmt.Errorf("no size classes")
+	}
+	return classes, nil
+}
+
+// parseByteSize parses a byte count with an optional KB, MB or GB suffix (powers of 1024)
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSuffix(s, unit.suffix)
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// sizeClassFor picks the first class that takes a record of the given size
+func (fb *FileBox) sizeClassFor(requiredSpace int64) (SizeClass, bool) {
+	for _, class := range fb.sizeClasses {
+		if class.MaxBlobSize > 0 && requiredSpace-recordHeaderSize > class.MaxBlobSize {
+			continue
+		}
+		if requiredSpace <= class.ContainerSize {
+			return class, true
+		}
+	}
+	return SizeClass{}, false
+}
+
+// hasSizeClass reports whether a class of that name is configured
+func (fb *FileBox) hasSizeClass(name string) bool {
+	for _, class := range fb.sizeClasses {
+		if class.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// maxBlobSize is the largest blob any class accepts
+func (fb *FileBox) maxBlobSize() int64 {
+	var largest int64
+	for _, class := range fb.sizeClasses {
+		limit := class.ContainerSize - recordHeaderSize
+		if class.MaxBlobSize > 0 && class.MaxBlobSize < limit {
+			limit = class.MaxBlobSize
+		}
+		if limit > largest {
+			largest = limit
+		}
+	}
+	return largest
+}
+
+// classContainerSize returns the container size of a size class; 0 if it is not configured
+func (fb *FileBox) classContainerSize(name string) int64 {
+	for _, class := range fb.sizeClasses {
+		if class.Name == name {
+			return class.ContainerSize
+		}
+	}
+	return 0
+}
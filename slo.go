@@ -0,0 +1,366 @@
+// Latency SLO tracking and slow-request logging for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Endpoint classes used for SLO targets, timeouts and the "endpoint" label
+const (
+	EndpointUpload   = "upload"   // POST /upload and resumable upload chunks
+	EndpointDownload = "download" // GET /blob/ and /key/
+	EndpointPeer     = "peer"     // Replication and container transfers between nodes
+	EndpointAdmin    = "admin"    // /admin/, /debug/ and /metrics
+	EndpointAPI      = "api"      // Listings, search, metadata changes
+)
+
+var endpointClasses = []string{EndpointUpload, EndpointDownload, EndpointPeer, EndpointAdmin, EndpointAPI}
+
+// endpointClass classifies a request by endpoint
+func endpointClass(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/admin/"), strings.HasPrefix(path, "/debug/"), path == "/metrics":
+		return EndpointAdmin
+	case path == "/replicate", strings.HasPrefix(path, "/container/"), strings.HasPrefix(path, "/cluster/"):
+		return EndpointPeer
+	case path == "/upload", strings.HasPrefix(path, "/upload/") && r.Method != "GET":
+		return EndpointUpload
+	case (strings.HasPrefix(path, "/blob/") || strings.HasPrefix(path, "/key/")) && r.Method == "GET":
+		return EndpointDownload
+	}
+	return EndpointAPI
+}
+
+// latencyBounds are the upper bounds of the latency histogram buckets, in
+// milliseconds; a last bucket holds everything slower
+var latencyBounds = [...]float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// Windows SLO burn is reported over; percentiles use the shortest
+var sloWindows = []struct {
+	Name    string
+	Minutes int
+}{
+	{"5m", 5},
+	{"1h", 60},
+}
+
+const latencySlots = 60 // One-minute slots, covering the longest window
+
+// SLOConfig - Latency targets per endpoint class and the slow-request log threshold
+type SLOConfig struct {
+	Targets       map[string]time.Duration // Requests slower than their endpoint's target miss the SLO
+	Objective     float64                  // Fraction of requests that should meet their target
+	SlowThreshold time.Duration            // Requests slower than this are logged with a breakdown; 0 disables
+	ServerTiming  bool                     // Send a Server-Timing header with each response's steps
+}
+
+// loadSLOConfig reads SLO_TARGETS ("upload=500ms,download=200ms"), SLO_OBJECTIVE,
+// SLOW_REQUEST_THRESHOLD and SERVER_TIMING
+func loadSLOConfig() SLOConfig {
+	cfg := SLOConfig{
+		Targets: map[string]time.Duration{
+			EndpointUpload:   500 * time.Millisecond,
+			EndpointDownload: 200 * time.Millisecond,
+			EndpointPeer:     time.Second,
+			EndpointAdmin:    5 * time.Second,
+			EndpointAPI:      100 * time.Millisecond,
+		},
+		Objective:     getEnvFloat("SLO_OBJECTIVE", 0.99),
+		SlowThreshold: getEnvDuration("SLOW_REQUEST_THRESHOLD", 2*time.Second),
+		ServerTiming:  getEnvBool("SERVER_TIMING", false),
+	}
+	if cfg.Objective <= 0 || cfg.Objective >= 1 {
+		log.Printf("Warning: SLO_OBJECTIVE must be between 0 and 1, using 0.99")
+		cfg.Objective = 0.99
+	}
+
+	for _, entry := range strings.Split(os.Getenv("SLO_TARGETS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		target, err := time.ParseDuration(strings.TrimSpace(value))
+		name = strings.TrimSpace(name)
+		if _, known := cfg.Targets[name]; !ok || !known || err != nil || target <= 0 {
+			log.Printf("Warning: ignoring SLO_TARGETS entry %q (want <endpoint>=<duration>, endpoints %v)", entry, endpointClasses)
+			continue
+		}
+		cfg.Targets[name] = target
+	}
+	return cfg
+}
+
+// Phases a request's time is broken down into in the slow-request log
+const (
+	phaseDisk        = iota // Reading and writing container files, fsyncs and manifests
+	phaseLockWait           // Waiting for the index lock or a free container
+	phaseReplication        // Waiting for replicas to acknowledge
+	phaseCount
+)
+
+var phaseNames = [phaseCount]string{"disk", "lock wait", "replication"}
+
+// requestTrace - Time one request spent in each phase, filled in as it runs
+type requestTrace struct {
+	phases [phaseCount]atomic.Int64
+
+	mu    sync.Mutex
+	steps []timingStep // Finer steps for the Server-Timing header
+}
+
+type requestTraceContextKey struct{}
+
+// traceFrom returns the request's trace, or nil outside of a traced request
+func traceFrom(ctx context.Context) *requestTrace {
+	trace, _ := ctx.Value(requestTraceContextKey{}).(*requestTrace)
+	return trace
+}
+
+// add charges time to a phase; a nil trace ignores it
+func (t *requestTrace) add(phase int, d time.Duration) {
+	if t != nil {
+		t.phases[phase].Add(int64(d))
+	}
+}
+
+// since charges the time since started to a phase and a Server-Timing step
+func (t *requestTrace) since(phase int, step string, started time.Time) {
+	d := timeNow().Sub(started)
+	t.add(phase, d)
+	t.step(step, d)
+}
+
+// breakdown describes where a request of the given duration spent its time
+func (t *requestTrace) breakdown(total time.Duration) string {
+	parts := make([]string, 0, phaseCount+1)
+	rest := total
+	for phase, name := range phaseNames {
+		d := time.Duration(t.phases[phase].Load())
+		rest -= d
+		parts = append(parts, fmt.Sprintf("%s %s", name, d.Round(time.Microsecond)))
+	}
+	parts = append(parts, fmt.Sprintf("other %s", max(rest, 0).Round(time.Microsecond)))
+	return strings.Join(parts, ", ")
+}
+
+// latencySlot - Requests of one endpoint class that finished in one minute
+type latencySlot struct {
+	minute int64
+	counts [len(latencyBounds) + 1]int64
+	total  int64
+	missed int64
+}
+
+// endpointLatency - Recent latencies of one endpoint class
+type endpointLatency struct {
+	target time.Duration
+	slots  [latencySlots]latencySlot
+
+	requests int64 // Since startup
+	missed   int64
+}
+
+// sloTracker - Request latencies per endpoint class against their targets
+type sloTracker struct {
+	config SLOConfig
+
+	mu        sync.Mutex
+	endpoints map[string]*endpointLatency
+}
+
+func newSLOTracker(config SLOConfig) *sloTracker {
+	t := &sloTracker{config: config, endpoints: make(map[string]*endpointLatency, len(endpointClasses))}
+	for _, class := range endpointClasses {
+		t.endpoints[class] = &endpointLatency{target: config.Targets[class]}
+	}
+	return t
+}
+
+// observe records a finished request
+func (t *sloTracker) observe(class string, d time.Duration, now time.Time) {
+	ms := millis(d)
+	bucket := len(latencyBounds)
+	for i, bound := range latencyBounds {
+		if ms <= bound {
+			bucket = i
+			break
+		}
+	}
+	minute := now.Unix() / 60
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.endpoints[class]
+	slot := &e.slots[minute%latencySlots]
+	if slot.minute != minute {
+		*slot = latencySlot{minute: minute}
+	}
+	slot.counts[bucket]++
+	slot.total++
+	e.requests++
+	if d > e.target {
+		slot.missed++
+		e.missed++
+	}
+}
+
+// window sums the slots of the last minutes. Callers must hold t.mu.
+func (e *endpointLatency) window(minutes int, now time.Time) latencySlot {
+	var sum latencySlot
+	current := now.Unix() / 60
+	for i := range e.slots {
+		slot := &e.slots[i]
+		if slot.total == 0 || slot.minute <= current-int64(minutes) || slot.minute > current {
+			continue
+		}
+		for bucket, n := range slot.counts {
+			sum.counts[bucket] += n
+		}
+		sum.total += slot.total
+		sum.missed += slot.missed
+	}
+	return sum
+}
+
+// percentile estimates a latency percentile in milliseconds from the
+// histogram, interpolating within the bucket it falls in
+func (s latencySlot) percentile(p float64) float64 {
+	if s.total == 0 {
+		return 0
+	}
+	rank := p * float64(s.total)
+	var seen float64
+	for bucket, n := range s.counts {
+		if n == 0 || seen+float64(n) < rank {
+			seen += float64(n)
+			continue
+		}
+		lower := 0.0
+		if bucket > 0 {
+			lower = latencyBounds[bucket-1]
+		}
+		if bucket == len(latencyBounds) {
+			return lower // Slower than the last bound; report the bound
+		}
+		return lower + (latencyBounds[bucket]-lower)*(rank-seen)/float64(n)
+	}
+	return latencyBounds[len(latencyBounds)-1]
+}
+
+// EndpointSLO - One endpoint class in GET /admin/slo
+type EndpointSLO struct {
+	Endpoint string             `json:"endpoint"`
+	TargetMS float64            `json:"target_ms"`
+	Recent   int64              `json:"recent_requests"` // In the percentile window
+	P50MS    float64            `json:"p50_ms"`
+	P95MS    float64            `json:"p95_ms"`
+	P99MS    float64            `json:"p99_ms"`
+	Burn     map[string]float64 `json:"burn_rate"` // By window: 1 spends the error budget exactly as fast as allowed
+	Requests int64              `json:"requests"`  // Since startup
+	Missed   int64              `json:"missed"`    // Since startup, slower than the target
+}
+
+// SLOStatus - Response for GET /admin/slo
+type SLOStatus struct {
+	Objective       float64       `json:"objective"`
+	SlowThresholdMS float64       `json:"slow_threshold_ms"`
+	PercentileOver  string        `json:"percentile_window"`
+	Endpoints       []EndpointSLO `json:"endpoints"`
+}
+
+// status reports percentiles and burn rates per endpoint class
+func (t *sloTracker) status(now time.Time) SLOStatus {
+	status := SLOStatus{
+		Objective:       t.config.Objective,
+		SlowThresholdMS: millis(t.config.SlowThreshold),
+		PercentileOver:  sloWindows[0].Name,
+		Endpoints:       make([]EndpointSLO, 0, len(endpointClasses)),
+	}
+	budget := 1 - t.config.Objective
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, class := range endpointClasses {
+		e := t.endpoints[class]
+		recent := e.window(sloWindows[0].Minutes, now)
+		endpoint := EndpointSLO{
+			Endpoint: class,
+			TargetMS: millis(e.target),
+			Recent:   recent.total,
+			P50MS:    recent.percentile(0.50),
+			P95MS:    recent.percentile(0.95),
+			P99MS:    recent.percentile(0.99),
+			Burn:     make(map[string]float64, len(sloWindows)),
+			Requests: e.requests,
+			Missed:   e.missed,
+		}
+		for _, w := range sloWindows {
+			if sum := e.window(w.Minutes, now); sum.total > 0 {
+				endpoint.Burn[w.Name] = float64(sum.missed) / float64(sum.total) / budget
+			} else {
+				endpoint.Burn[w.Name] = 0
+			}
+		}
+		status.Endpoints = append(status.Endpoints, endpoint)
+	}
+	return status
+}
+
+// trackLatency times every request against its endpoint's SLO target and
+// logs slow ones with the time spent on disk, waiting for locks and waiting
+// for replicas. With SERVER_TIMING the steps are also sent back to the client.
+func (fb *FileBox) trackLatency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fb.slo == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		trace := &requestTrace{}
+		started := timeNow()
+		if fb.slo.config.ServerTiming {
+			w = &serverTimingWriter{ResponseWriter: w, trace: trace, started: started}
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestTraceContextKey{}, trace)))
+		elapsed := timeNow().Sub(started)
+
+		class := endpointClass(r)
+		fb.slo.observe(class, elapsed, timeNow())
+		if threshold := fb.slo.config.SlowThreshold; threshold > 0 && elapsed > threshold {
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			log.Printf("Slow request: %s %s (%s) took %s, status %d [%s]",
+				r.Method, r.URL.Path, class, elapsed.Round(time.Microsecond), status, trace.breakdown(elapsed))
+		}
+	})
+}
+
+// handleSLO serves GET /admin/slo
+func (fb *FileBox) handleSLO(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if fb.slo == nil {
+		http.Error(w, "SLO tracking is not running", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.slo.status(timeNow()))
+}
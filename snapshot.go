@@ -0,0 +1,224 @@
+// Metadata snapshot and restore for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SnapshotHeader - First entry of a snapshot archive
+type SnapshotHeader struct {
+	HostID     string    `json:"host_id"`
+	MachineID  uint32    `json:"machine_id"`
+	Created    time.Time `json:"created"`
+	CopiedAt   time.Time `json:"copied_at"` // Wall-clock time the metadata was copied, comparable with file modification times
+	Containers int       `json:"containers"`
+	Blobs      int       `json:"blobs"`
+}
+
+// Archive layout: snapshot.json, then containers/<fid>.json per container
+const (
+	snapshotHeaderName   = "snapshot.json"
+	snapshotContainerDir = "containers/"
+)
+
+// snapshotContainers copies all container metadata at a single point in
+// time, returned with the wall-clock time of the copy
+func (fb *FileBox) snapshotContainers() ([]*ContainerFile, time.Time) {
+	// Holding manifestLock stops metadata writes; fileLock, held exclusively,
+	// stops in-memory updates, including appends under container locks
+	fb.manifestLock.Lock()
+	defer fb.manifestLock.Unlock()
+	fb.fileLock.Lock()
+	defer fb.fileLock.Unlock()
+
+	copiedAt := time.Now()
+	files := fb.files.all()
+	containers := make([]*ContainerFile, 0, len(files))
+	for _, file := range files {
+		containers = append(containers, fb.snapshotContainer(file))
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].FID.String() < containers[j].FID.String()
+	})
+	return containers, copiedAt
+}
+
+// writeSnapshot writes a gzipped tar archive of container metadata
+func (fb *FileBox) writeSnapshot(w io.Writer, containers []*ContainerFile, copiedAt time.Time) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	header := SnapshotHeader{
+		HostID:     fb.hostID,
+		MachineID:  fb.machineID,
+		Created:    timeNow(),
+		CopiedAt:   copiedAt,
+		Containers: len(containers),
+	}
+	for _, c := range containers {
+		header.Blobs += len(c.Blobs)
+	}
+
+	writeEntry := func(name string, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: header.Created,
+		}); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+
+	if err := writeEntry(snapshotHeaderName, header); err != nil {
+		return err
+	}
+	for _, c := range containers {
+		if err := writeEntry(snapshotContainerDir+c.FID.String()+".json", c); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readSnapshot parses a snapshot archive
+func readSnapshot(r io.Reader) (*SnapshotHeader, []*ContainerFile, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer gz.Close()
+
+	var header *SnapshotHeader
+	var containers []*ContainerFile
+	tr := tar.NewReader(gz)
+	for {
+		entry, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch {
+		case entry.Name == snapshotHeaderName:
+			header = &SnapshotHeader{}
+			if err := json.NewDecoder(tr).Decode(header); err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", entry.Name, err)
+			}
+		case strings.HasPrefix(entry.Name, snapshotContainerDir):
+			var c ContainerFile
+			if err := json.NewDecoder(tr).Decode(&c); err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", entry.Name, err)
+			}
+			fid, err := ParseFID(strings.TrimSuffix(path.Base(entry.Name), ".json"))
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", entry.Name, err)
+			}
+			c.FID = fid
+			containers = append(containers, &c)
+		}
+	}
+
+	if header == nil {
+		return nil, nil, fmt.Errorf("archive has no %s", snapshotHeaderName)
+	}
+	return header, containers, nil
+}
+
+func (fb *FileBox) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	containers, copiedAt := fb.snapshotContainers()
+	name := fmt.Sprintf("filebox-%d-%s.tar.gz", fb.machineID, timeNow().UTC().Format("20060102T150405Z"))
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if err := fb.writeSnapshot(w, containers, copiedAt); err != nil {
+		log.Printf("Error writing snapshot: %v", err)
+		return
+	}
+
+	log.Printf("Wrote metadata snapshot %s (%d containers)", name, len(containers))
+}
+
+// runRestoreSnapshot implements `filebox restore-snapshot [--storage-dir DIR] <archive>`
+//
+// It writes every container in the archive into the configured metadata
+// backend. Run it while the node is stopped; the next start recovers from it.
+func runRestoreSnapshot(args []string) int {
+	flags := flag.NewFlagSet("restore-snapshot", flag.ExitOnError)
+	storageDir := flags.String("storage-dir", getEnvOrDefault("STORAGE_DIR", "./files"), "Storage directory of the node to restore")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: filebox restore-snapshot [--storage-dir DIR] <archive.tar.gz>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore-snapshot: %v\n", err)
+		return 1
+	}
+	defer file.Close()
+
+	header, containers, err := readSnapshot(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore-snapshot: %v\n", err)
+		return 1
+	}
+
+	meta, err := newMetadataStore(*storageDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore-snapshot: %v\n", err)
+		return 1
+	}
+	defer meta.Close()
+
+	for _, c := range containers {
+		c.FilePath = shardedPath(*storageDir, c.FID.String())
+		c.Uploading = false
+		if err := meta.SaveContainer(c); err != nil {
+			fmt.Fprintf(os.Stderr, "restore-snapshot: %s: %v\n", c.FID.String(), err)
+			return 1
+		}
+	}
+
+	fmt.Printf("Restored %d containers (%d blobs) from snapshot of %s taken %s\n",
+		len(containers), header.Blobs, header.HostID, header.Created.Format(time.RFC3339))
+	return 0
+}
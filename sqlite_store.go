@@ -0,0 +1,464 @@
+// SQLite metadata backend for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS containers (
+	file_id           TEXT PRIMARY KEY,
+	machine_id        INTEGER NOT NULL,
+	timestamp         INTEGER NOT NULL,
+	sequence          INTEGER NOT NULL,
+	file_path         TEXT NOT NULL,
+	size              INTEGER NOT NULL,
+	created           TEXT NOT NULL,
+	uploaded          INTEGER NOT NULL,
+	tenant            TEXT NOT NULL DEFAULT '',
+	storage_class     TEXT NOT NULL DEFAULT '',
+	quarantined       INTEGER NOT NULL DEFAULT 0,
+	quarantine_reason TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS blobs (
+	id           TEXT PRIMARY KEY,
+	file_id      TEXT NOT NULL REFERENCES containers(file_id),
+	idx          INTEGER NOT NULL,
+	offset       INTEGER NOT NULL,
+	length       INTEGER NOT NULL,
+	size         INTEGER NOT NULL,
+	checksum     INTEGER NOT NULL,
+	key          TEXT NOT NULL DEFAULT '',
+	content_type TEXT NOT NULL DEFAULT '',
+	created      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS blobs_file_id ON blobs(file_id, idx);
+CREATE INDEX IF NOT EXISTS blobs_key ON blobs(key) WHERE key != '';
+CREATE TABLE IF NOT EXISTS tags (
+	blob_id TEXT NOT NULL REFERENCES blobs(id),
+	k       TEXT NOT NULL,
+	v       TEXT NOT NULL,
+	PRIMARY KEY (blob_id, k)
+);
+CREATE INDEX IF NOT EXISTS tags_kv ON tags(k, v);
+CREATE TABLE IF NOT EXISTS replication (
+	file_id TEXT NOT NULL,
+	replica TEXT NOT NULL,
+	size    INTEGER NOT NULL,
+	updated TEXT NOT NULL,
+	PRIMARY KEY (file_id, replica)
+);
+`
+
+// Columns added after the original schema; "duplicate column" errors mean already applied
+var sqliteMigrations = []string{
+	`ALTER TABLE containers ADD COLUMN uploaded_at TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE containers ADD COLUMN size_class TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE containers ADD COLUMN encrypted INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE containers ADD COLUMN wrapped_key BLOB`,
+	`ALTER TABLE containers ADD COLUMN key_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blobs ADD COLUMN deleted_at TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blobs ADD COLUMN legal_hold INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE containers ADD COLUMN legal_hold INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE blobs ADD COLUMN variant_of TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blobs ADD COLUMN variants TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blobs ADD COLUMN scan TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE containers ADD COLUMN evicted INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE blobs ADD COLUMN access_count INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE blobs ADD COLUMN last_access TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE containers ADD COLUMN dr_replicated_at TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE containers ADD COLUMN provenance TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blobs ADD COLUMN expires_at TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blobs ADD COLUMN hash_algorithm TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blobs ADD COLUMN digest TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blobs ADD COLUMN customer_key INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE blobs ADD COLUMN compression TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blobs ADD COLUMN remote_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE containers ADD COLUMN federated INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE blobs ADD COLUMN copy_of TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blobs ADD COLUMN segments TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blobs ADD COLUMN chunk_hash TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE blobs ADD COLUMN uncommitted INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE containers ADD COLUMN s3_key TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE containers ADD COLUMN op_sequence TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE containers ADD COLUMN conflict TEXT NOT NULL DEFAULT ''`,
+}
+
+// sqliteStore - Stores containers, blobs, tags and replication state in one SQLite file
+type sqliteStore struct {
+	db   *sql.DB
+	path string
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // SQLite allows one writer; serialize in the pool instead of retrying
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, migration := range sqliteMigrations {
+		if _, err := db.Exec(migration); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteStore{db: db, path: path}, nil
+}
+
+// SaveContainer writes the container row and its blob index in one transaction
+func (s *sqliteStore) SaveContainer(containerFile *ContainerFile) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var provenance, opSequence, conflict []byte
+	if containerFile.Provenance != nil {
+		if provenance, err = json.Marshal(containerFile.Provenance); err != nil {
+			return err
+		}
+	}
+	if containerFile.OpSequence != nil {
+		if opSequence, err = json.Marshal(containerFile.OpSequence); err != nil {
+			return err
+		}
+	}
+	if containerFile.Conflict != nil {
+		if conflict, err = json.Marshal(containerFile.Conflict); err != nil {
+			return err
+		}
+	}
+
+	fileID := containerFile.FID.String()
+	_, err = tx.Exec(`INSERT INTO containers (file_id, machine_id, timestamp, sequence, file_path, size, created,
+			uploaded, tenant, storage_class, quarantined, quarantine_reason, uploaded_at, size_class,
+			encrypted, wrapped_key, key_id, legal_hold, evicted, dr_replicated_at, provenance, federated, s3_key, op_sequence, conflict)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(file_id) DO UPDATE SET file_path = excluded.file_path, size = excluded.size,
+			uploaded = excluded.uploaded, tenant = excluded.tenant, storage_class = excluded.storage_class,
+			quarantined = excluded.quarantined, quarantine_reason = excluded.quarantine_reason,
+			uploaded_at = excluded.uploaded_at, size_class = excluded.size_class,
+			encrypted = excluded.encrypted, wrapped_key = excluded.wrapped_key, key_id = excluded.key_id,
+			legal_hold = excluded.legal_hold, evicted = excluded.evicted,
+			dr_replicated_at = excluded.dr_replicated_at, provenance = excluded.provenance,
+			federated = excluded.federated, s3_key = excluded.s3_key, op_sequence = excluded.op_sequence,
+			conflict = excluded.conflict`,
+		fileID, containerFile.FID.MachineID, containerFile.FID.Timestamp, containerFile.FID.Sequence,
+		containerFile.FilePath, containerFile.Size, containerFile.Created.Format(time.RFC3339Nano),
+		containerFile.Uploaded, containerFile.Tenant, containerFile.StorageClass,
+		containerFile.Quarantined, containerFile.QuarantineReason, formatOptionalTime(containerFile.UploadedAt),
+		containerFile.SizeClass, containerFile.Encrypted, containerFile.WrappedKey, containerFile.KeyID,
+		containerFile.LegalHold, containerFile.Evicted, formatOptionalTime(containerFile.DRReplicatedAt), string(provenance),
+		containerFile.Federated, containerFile.S3Key, string(opSequence), string(conflict))
+	if err != nil {
+		return err
+	}
+
+	blobStmt, err := tx.Prepare(`INSERT INTO blobs (id, file_id, idx, offset, length, size, checksum, key, content_type, created,
+			deleted_at, legal_hold, variant_of, variants, scan, access_count, last_access, expires_at,
+			hash_algorithm, digest, customer_key, compression, remote_id, copy_of, segments, chunk_hash, uncommitted)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET offset = excluded.offset, length = excluded.length, size = excluded.size,
+			checksum = excluded.checksum, key = excluded.key, content_type = excluded.content_type,
+			deleted_at = excluded.deleted_at, legal_hold = excluded.legal_hold,
+			variant_of = excluded.variant_of, variants = excluded.variants, scan = excluded.scan,
+			access_count = excluded.access_count, last_access = excluded.last_access,
+			expires_at = excluded.expires_at, hash_algorithm = excluded.hash_algorithm, digest = excluded.digest,
+			customer_key = excluded.customer_key, compression = excluded.compression, remote_id = excluded.remote_id,
+			copy_of = excluded.copy_of, segments = excluded.segments,
+			chunk_hash = excluded.chunk_hash, uncommitted = excluded.uncommitted`)
+	if err != nil {
+		return err
+	}
+	defer blobStmt.Close()
+
+	tagStmt, err := tx.Prepare(`INSERT OR REPLACE INTO tags (blob_id, k, v) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer tagStmt.Close()
+
+	for i, blob := range containerFile.Blobs {
+		var deletedAt time.Time
+		if blob.DeletedAt != nil {
+			deletedAt = *blob.DeletedAt
+		}
+		var variants []byte
+		if len(blob.Variants) > 0 {
+			if variants, err = json.Marshal(blob.Variants); err != nil {
+				return err
+			}
+		}
+		var lastAccess time.Time
+		if blob.LastAccess != nil {
+			lastAccess = *blob.LastAccess
+		}
+		var expiresAt time.Time
+		if blob.ExpiresAt != nil {
+			expiresAt = *blob.ExpiresAt
+		}
+		var scan []byte
+		if blob.Scan != nil {
+			if scan, err = json.Marshal(blob.Scan); err != nil {
+				return err
+			}
+		}
+		var segments []byte
+		if len(blob.Segments) > 0 {
+			if segments, err = json.Marshal(blob.Segments); err != nil {
+				return err
+			}
+		}
+		if _, err := blobStmt.Exec(blob.ID, fileID, i, blob.Offset, blob.Length, blob.Size, blob.Checksum,
+			blob.Key, blob.ContentType, blob.Created.Format(time.RFC3339Nano), formatOptionalTime(deletedAt),
+			blob.LegalHold, blob.VariantOf, string(variants), string(scan),
+			blob.AccessCount, formatOptionalTime(lastAccess), formatOptionalTime(expiresAt),
+			blob.HashAlgorithm, blob.Digest, blob.CustomerKey, blob.Compression, blob.RemoteID, blob.CopyOf, string(segments), blob.ChunkHash,
+			blob.Uncommitted); err != nil {
+			return err
+		}
+		for k, v := range blob.Tags {
+			if _, err := tagStmt.Exec(blob.ID, k, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) LoadContainer(fileID string) (*ContainerFile, error) {
+	containerFile := &ContainerFile{FID: &FID{}}
+	var created, uploadedAt, drReplicatedAt, provenance, opSequence, conflict string
+	err := s.db.QueryRow(`SELECT machine_id, timestamp, sequence, file_path, size, created, uploaded,
+			tenant, storage_class, quarantined, quarantine_reason, uploaded_at, size_class,
+			encrypted, wrapped_key, key_id, legal_hold, evicted, dr_replicated_at, provenance, federated, s3_key, op_sequence, conflict
+		FROM containers WHERE file_id = ?`, fileID).Scan(
+		&containerFile.FID.MachineID, &containerFile.FID.Timestamp, &containerFile.FID.Sequence,
+		&containerFile.FilePath, &containerFile.Size, &created, &containerFile.Uploaded,
+		&containerFile.Tenant, &containerFile.StorageClass, &containerFile.Quarantined, &containerFile.QuarantineReason,
+		&uploadedAt, &containerFile.SizeClass,
+		&containerFile.Encrypted, &containerFile.WrappedKey, &containerFile.KeyID, &containerFile.LegalHold,
+		&containerFile.Evicted, &drReplicatedAt, &provenance, &containerFile.Federated, &containerFile.S3Key, &opSequence, &conflict)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	containerFile.Created, _ = time.Parse(time.RFC3339Nano, created)
+	containerFile.UploadedAt, _ = time.Parse(time.RFC3339Nano, uploadedAt)
+	containerFile.DRReplicatedAt, _ = time.Parse(time.RFC3339Nano, drReplicatedAt)
+	if provenance != "" {
+		if err := json.Unmarshal([]byte(provenance), &containerFile.Provenance); err != nil {
+			return nil, err
+		}
+	}
+	if opSequence != "" {
+		if err := json.Unmarshal([]byte(opSequence), &containerFile.OpSequence); err != nil {
+			return nil, err
+		}
+	}
+	if conflict != "" {
+		if err := json.Unmarshal([]byte(conflict), &containerFile.Conflict); err != nil {
+			return nil, err
+		}
+	}
+
+	replicaRows, err := s.db.Query(`SELECT replica, size FROM replication WHERE file_id = ?`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer replicaRows.Close()
+	for replicaRows.Next() {
+		var replica string
+		var size int64
+		if err := replicaRows.Scan(&replica, &size); err != nil {
+			return nil, err
+		}
+		if containerFile.Replicated == nil {
+			containerFile.Replicated = make(map[string]int64)
+		}
+		containerFile.Replicated[replica] = size
+	}
+	if err := replicaRows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT id, offset, length, size, checksum, key, content_type, created, deleted_at, legal_hold,
+			variant_of, variants, scan, access_count, last_access, expires_at, hash_algorithm, digest,
+			customer_key, compression, remote_id, copy_of, segments, chunk_hash, uncommitted
+		FROM blobs WHERE file_id = ? ORDER BY idx`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[string]int)
+	containerFile.Blobs = make([]BlobInfo, 0)
+	for rows.Next() {
+		var blob BlobInfo
+		var deletedAt, variants, scan, lastAccess, expiresAt, segments string
+		if err := rows.Scan(&blob.ID, &blob.Offset, &blob.Length, &blob.Size, &blob.Checksum,
+			&blob.Key, &blob.ContentType, &created, &deletedAt, &blob.LegalHold,
+			&blob.VariantOf, &variants, &scan, &blob.AccessCount, &lastAccess, &expiresAt,
+			&blob.HashAlgorithm, &blob.Digest, &blob.CustomerKey, &blob.Compression, &blob.RemoteID, &blob.CopyOf, &segments, &blob.ChunkHash,
+			&blob.Uncommitted); err != nil {
+			return nil, err
+		}
+		if scan != "" {
+			if err := json.Unmarshal([]byte(scan), &blob.Scan); err != nil {
+				return nil, err
+			}
+		}
+		if variants != "" {
+			if err := json.Unmarshal([]byte(variants), &blob.Variants); err != nil {
+				return nil, err
+			}
+		}
+		if segments != "" {
+			if err := json.Unmarshal([]byte(segments), &blob.Segments); err != nil {
+				return nil, err
+			}
+		}
+		blob.Created, _ = time.Parse(time.RFC3339Nano, created)
+		if t, err := time.Parse(time.RFC3339Nano, deletedAt); err == nil {
+			blob.DeletedAt = &t
+		}
+		if t, err := time.Parse(time.RFC3339Nano, lastAccess); err == nil {
+			blob.LastAccess = &t
+		}
+		if t, err := time.Parse(time.RFC3339Nano, expiresAt); err == nil {
+			blob.ExpiresAt = &t
+		}
+		byID[blob.ID] = len(containerFile.Blobs)
+		containerFile.Blobs = append(containerFile.Blobs, blob)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tagRows, err := s.db.Query(`SELECT t.blob_id, t.k, t.v FROM tags t JOIN blobs b ON b.id = t.blob_id
+		WHERE b.file_id = ?`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer tagRows.Close()
+
+	for tagRows.Next() {
+		var blobID, k, v string
+		if err := tagRows.Scan(&blobID, &k, &v); err != nil {
+			return nil, err
+		}
+		if i, ok := byID[blobID]; ok {
+			if containerFile.Blobs[i].Tags == nil {
+				containerFile.Blobs[i].Tags = make(map[string]string)
+			}
+			containerFile.Blobs[i].Tags[k] = v
+		}
+	}
+	return containerFile, tagRows.Err()
+}
+
+func (s *sqliteStore) ListContainers() ([]string, error) {
+	rows, err := s.db.Query(`SELECT file_id FROM containers ORDER BY file_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fileIDs []string
+	for rows.Next() {
+		var fileID string
+		if err := rows.Scan(&fileID); err != nil {
+			return nil, err
+		}
+		fileIDs = append(fileIDs, fileID)
+	}
+	return fileIDs, rows.Err()
+}
+
+// UpdateBlobs re-upserts the container; unchanged rows are rewritten as-is
+func (s *sqliteStore) UpdateBlobs(containerFile *ContainerFile, indexes ...int) error {
+	return s.SaveContainer(containerFile)
+}
+
+func (s *sqliteStore) RecordReplication(fileID, replica string, size int64) error {
+	_, err := s.db.Exec(`INSERT INTO replication (file_id, replica, size, updated) VALUES (?, ?, ?, ?)
+		ON CONFLICT(file_id, replica) DO UPDATE SET size = MAX(size, excluded.size), updated = excluded.updated`,
+		fileID, replica, size, timeNow().Format(time.RFC3339Nano))
+	return err
+}
+
+func (s *sqliteStore) DeleteContainer(fileID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		`DELETE FROM tags WHERE blob_id IN (SELECT id FROM blobs WHERE file_id = ?)`,
+		`DELETE FROM blobs WHERE file_id = ?`,
+		`DELETE FROM replication WHERE file_id = ?`,
+		`DELETE FROM containers WHERE file_id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, fileID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// formatOptionalTime stores the zero time as an empty string
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func (s *sqliteStore) Durable() bool {
+	return true
+}
+
+// Compact copies the write-ahead log into the database and truncates it to zero bytes
+func (s *sqliteStore) Compact() (int64, error) {
+	var walSize int64
+	if info, err := os.Stat(s.path + "-wal"); err == nil {
+		walSize = info.Size()
+	}
+	var busy, logPages, checkpointed int64
+	if err := s.db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logPages, &checkpointed); err != nil {
+		return 0, err
+	}
+	if busy != 0 {
+		return 0, fmt.Errorf("database busy, write-ahead log not truncated")
+	}
+	return walSize, nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
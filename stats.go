@@ -0,0 +1,338 @@
+// Blob and container statistics for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// GET /admin/stats shows how blobs and containers are shaped on this node,
+// as a guide to tuning. Blob sizes against MAX_CONTAINER_SIZE and
+// CONTAINER_SIZE_CLASSES show whether classes fit the workload. Fill ratios
+// show how many containers are stranded part full, with too little room
+// left for the blobs that arrive. Dead space (records of blobs that
+// expired or left the trash) shows how much compaction at a given
+// threshold would reclaim. Only containers this node owns are counted;
+// replica copies belong to their owners' statistics.
+
+// Histogram bucket upper bounds; the last bucket of each is unbounded
+var (
+	statsSizeBounds = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10,
+		1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+	statsAgeBounds = []float64{
+		time.Hour.Seconds(), 6 * time.Hour.Seconds(), 24 * time.Hour.Seconds(), 7 * 24 * time.Hour.Seconds(),
+		30 * 24 * time.Hour.Seconds(), 90 * 24 * time.Hour.Seconds(), 365 * 24 * time.Hour.Seconds()}
+	statsRatioBounds = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1}
+)
+
+// Dead-space ratios the reclaimable summary is given at
+var statsReclaimThresholds = []float64{0.25, 0.5, 0.75, 1}
+
+// HistogramBucket - Values up to LE, and above the previous bucket's LE
+type HistogramBucket struct {
+	LE    string  `json:"le"` // "+Inf" for the last bucket
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"` // Of the values in the bucket, e.g. the bytes of the blobs
+}
+
+// Histogram - Distribution of one statistic
+type Histogram struct {
+	Count   int               `json:"count"`
+	Sum     float64           `json:"sum"`
+	Min     float64           `json:"min"`
+	Max     float64           `json:"max"`
+	Mean    float64           `json:"mean"`
+	P50     float64           `json:"p50"`
+	P90     float64           `json:"p90"`
+	P99     float64           `json:"p99"`
+	Buckets []HistogramBucket `json:"buckets"`
+}
+
+// statsHistogram collects values for a Histogram
+type statsHistogram struct {
+	bounds []float64
+	label  func(float64) string
+	values []float64
+}
+
+func (h *statsHistogram) add(v float64) {
+	h.values = append(h.values, v)
+}
+
+// histogram buckets the values and works out exact percentiles
+func (h *statsHistogram) histogram() Histogram {
+	histogram := Histogram{Count: len(h.values), Buckets: make([]HistogramBucket, len(h.bounds)+1)}
+	for i, bound := range h.bounds {
+		histogram.Buckets[i].LE = h.label(bound)
+	}
+	histogram.Buckets[len(h.bounds)].LE = "+Inf"
+	if len(h.values) == 0 {
+		return histogram
+	}
+
+	sort.Float64s(h.values)
+	for _, v := range h.values {
+		i := sort.SearchFloat64s(h.bounds, v) // First bound >= v
+		histogram.Buckets[i].Count++
+		histogram.Buckets[i].Sum += v
+		histogram.Sum += v
+	}
+	percentile := func(p float64) float64 {
+		return h.values[int(math.Ceil(p*float64(len(h.values))))-1]
+	}
+	histogram.Min, histogram.Max = h.values[0], h.values[len(h.values)-1]
+	histogram.Mean = histogram.Sum / float64(len(h.values))
+	histogram.P50, histogram.P90, histogram.P99 = percentile(0.5), percentile(0.9), percentile(0.99)
+	return histogram
+}
+
+func newSizeHistogram() *statsHistogram {
+	return &statsHistogram{bounds: statsSizeBounds, label: statsSizeLabel}
+}
+
+func newAgeHistogram() *statsHistogram {
+	return &statsHistogram{bounds: statsAgeBounds, label: statsAgeLabel}
+}
+
+func newRatioHistogram() *statsHistogram {
+	return &statsHistogram{bounds: statsRatioBounds, label: func(v float64) string { return fmt.Sprintf("%.0f%%", v*100) }}
+}
+
+// statsSizeLabel writes a power-of-two byte count as 256B, 4KB, 1MB...
+func statsSizeLabel(v float64) string {
+	for _, unit := range []struct {
+		suffix string
+		size   float64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}} {
+		if v >= unit.size {
+			return fmt.Sprintf("%g%s", v/unit.size, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%gB", v)
+}
+
+// statsAgeLabel writes seconds as 1h, 6h, 1d, 7d...
+func statsAgeLabel(v float64) string {
+	if hours := v / 3600; hours < 24 {
+		return fmt.Sprintf("%gh", hours)
+	}
+	return fmt.Sprintf("%gd", v/86400)
+}
+
+// BlobStats - Live blobs: not deleted and not expired
+type BlobStats struct {
+	Count int       `json:"count"`
+	Bytes int64     `json:"bytes"`
+	Sizes Histogram `json:"sizes"` // Bytes
+	Ages  Histogram `json:"ages"`  // Seconds since upload
+}
+
+// ContainerStats - Containers owned by this node
+type ContainerStats struct {
+	Count      int       `json:"count"`
+	Open       int       `json:"open"`   // Still taking writes
+	Sealed     int       `json:"sealed"` // Uploaded or uploading
+	Bytes      int64     `json:"bytes"`
+	LiveBytes  int64     `json:"live_bytes"`  // Records a live blob reads, with their headers
+	DeadBytes  int64     `json:"dead_bytes"`  // Everything else: expired and purged records, torn tails
+	TrashBytes int64     `json:"trash_bytes"` // Live records of deleted blobs that can still be undeleted
+	Sizes      Histogram `json:"sizes"`       // Bytes
+	Ages       Histogram `json:"ages"`        // Seconds since creation
+	Fill       Histogram `json:"fill"`        // Size over their class's container size
+	DeadSpace  Histogram `json:"dead_space"`  // Dead bytes over size; bucket sums are ratios, see Reclaimable for bytes
+}
+
+// SizeClassStats - How one size class's containers fill up
+type SizeClassStats struct {
+	Name          string  `json:"name"`
+	ContainerSize int64   `json:"container_size"`
+	Containers    int     `json:"containers"`
+	Sealed        int     `json:"sealed"`
+	MeanFill      float64 `json:"mean_fill"`
+	Blobs         int     `json:"blobs"`
+}
+
+// ReclaimableAt - What compacting every container at least Threshold dead would free
+type ReclaimableAt struct {
+	Threshold  float64 `json:"threshold"`
+	Containers int     `json:"containers"`
+	DeadBytes  int64   `json:"dead_bytes"`
+	LiveBytes  int64   `json:"live_bytes"` // To be rewritten
+}
+
+// StatsReport - Response of GET /admin/stats
+type StatsReport struct {
+	GeneratedAt time.Time        `json:"generated_at"`
+	Tenant      string           `json:"tenant,omitempty"`
+	Blobs       BlobStats        `json:"blobs"`
+	Containers  ContainerStats   `json:"containers"`
+	SizeClasses []SizeClassStats `json:"size_classes"`
+	Reclaimable []ReclaimableAt  `json:"reclaimable"`
+}
+
+// recordLiveness splits a container's bytes into records live blobs read,
+// records only deleted blobs still in the trash read, and the rest. Copies
+// share their source's record; chunks and segments are live while a live
+// composed blob reads them. blobs are the container's index entries.
+// Callers must hold fb.fileLock.
+func (fb *FileBox) recordLiveness(containerFile *ContainerFile, blobs []BlobInfo, liveSegments map[string]bool, now time.Time) (live, trash int64) {
+	type record struct{ live, trash bool }
+	records := make(map[int64]*record)
+	lengths := make(map[int64]int64)
+	for _, blob := range blobs {
+		if len(blob.Segments) > 0 {
+			continue // Composed blobs have no record of their own
+		}
+		r := records[blob.Offset]
+		if r == nil {
+			r = &record{}
+			records[blob.Offset], lengths[blob.Offset] = r, blob.Length
+		}
+		switch {
+		case liveSegments[blob.ID]:
+			r.live = true
+		case blob.ChunkHash != "", blob.Uncommitted:
+		case expired(containerFile, blob, now) || fb.purgeable(containerFile, blob, now):
+		case blob.DeletedAt != nil:
+			r.trash = true
+		default:
+			r.live = true
+		}
+	}
+	for offset, r := range records {
+		size := recordHeaderSize + lengths[offset]
+		if r.live {
+			live += size
+		} else if r.trash {
+			trash += size
+		}
+	}
+	return live, trash
+}
+
+// statsReport gathers the statistics of this node's containers, or one tenant's
+func (fb *FileBox) statsReport(tenant string, filterTenant bool) *StatsReport {
+	now := timeNow()
+	report := &StatsReport{GeneratedAt: now.UTC(), Tenant: tenant}
+	blobSizes, blobAges := newSizeHistogram(), newAgeHistogram()
+	containerSizes, containerAges := newSizeHistogram(), newAgeHistogram()
+	fill, deadSpace := newRatioHistogram(), newRatioHistogram()
+
+	classes := make(map[string]*SizeClassStats, len(fb.sizeClasses))
+	for _, class := range fb.sizeClasses {
+		stats := SizeClassStats{Name: class.Name, ContainerSize: class.ContainerSize}
+		report.SizeClasses = append(report.SizeClasses, stats)
+	}
+	for i := range report.SizeClasses {
+		classes[report.SizeClasses[i].Name] = &report.SizeClasses[i]
+	}
+	report.Reclaimable = make([]ReclaimableAt, len(statsReclaimThresholds))
+	for i, threshold := range statsReclaimThresholds {
+		report.Reclaimable[i].Threshold = threshold
+	}
+
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+
+	liveSegments := make(map[string]bool)
+	for _, containerFile := range fb.files.all() {
+		for _, blob := range fb.containerBlobs(containerFile) {
+			if len(blob.Segments) > 0 && blob.DeletedAt == nil && !expired(containerFile, blob, now) {
+				for _, segment := range blob.Segments {
+					liveSegments[segment] = true
+				}
+			}
+		}
+	}
+
+	for _, containerFile := range fb.files.all() {
+		if fb.isForeign(containerFile) || (filterTenant && containerFile.Tenant != tenant) {
+			continue
+		}
+		size, blobs := fb.containerContents(containerFile)
+		containers := &report.Containers
+		containers.Count++
+		containers.Bytes += size
+		containerSizes.add(float64(size))
+		containerAges.add(now.Sub(containerFile.Created).Seconds())
+
+		class := classes[containerFile.SizeClass]
+		if class == nil && containerFile.SizeClass == "" && len(report.SizeClasses) > 0 {
+			class = &report.SizeClasses[0]
+		}
+		sealed := containerFile.Uploaded || containerFile.Uploading
+		if sealed {
+			containers.Sealed++
+		} else {
+			containers.Open++
+		}
+		if class != nil {
+			class.Containers++
+			if sealed {
+				class.Sealed++
+			}
+			ratio := float64(size) / float64(class.ContainerSize)
+			class.MeanFill += ratio
+			fill.add(ratio)
+		}
+
+		for _, blob := range blobs {
+			if blob.Uncommitted || blob.DeletedAt != nil || blob.ChunkHash != "" || expired(containerFile, blob, now) {
+				continue
+			}
+			report.Blobs.Count++
+			report.Blobs.Bytes += blob.Size
+			blobSizes.add(float64(blob.Size))
+			blobAges.add(now.Sub(blob.Created).Seconds())
+			if class != nil {
+				class.Blobs++
+			}
+		}
+
+		live, trash := fb.recordLiveness(containerFile, blobs, liveSegments, now)
+		dead := max(size-live-trash, 0)
+		containers.LiveBytes += live
+		containers.TrashBytes += trash
+		containers.DeadBytes += dead
+		if size > 0 {
+			ratio := float64(dead) / float64(size)
+			deadSpace.add(ratio)
+			for i := range report.Reclaimable {
+				if at := &report.Reclaimable[i]; dead > 0 && ratio >= at.Threshold {
+					at.Containers++
+					at.DeadBytes += dead
+					at.LiveBytes += live + trash
+				}
+			}
+		}
+	}
+
+	for i := range report.SizeClasses {
+		if class := &report.SizeClasses[i]; class.Containers > 0 {
+			class.MeanFill /= float64(class.Containers)
+		}
+	}
+	report.Blobs.Sizes, report.Blobs.Ages = blobSizes.histogram(), blobAges.histogram()
+	report.Containers.Sizes, report.Containers.Ages = containerSizes.histogram(), containerAges.histogram()
+	report.Containers.Fill, report.Containers.DeadSpace = fill.histogram(), deadSpace.histogram()
+	return report
+}
+
+// handleStats serves GET /admin/stats[?tenant=...]
+func (fb *FileBox) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenant, filterTenant := r.URL.Query().Get("tenant"), r.URL.Query().Has("tenant")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.statsReport(tenant, filterTenant))
+}
@@ -0,0 +1,394 @@
+// Per-tenant default upload policies for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const tenantPoliciesFile = "node/tenant_policies.json"
+
+// Blob compression algorithms
+const (
+	CompressionNone = ""
+	CompressionZstd = "zstd"
+)
+
+// Where a tenant policy came from
+const (
+	PolicySourceConfig = "config" // TENANT_POLICIES
+	PolicySourceAdmin  = "admin"  // PUT /admin/tenants/{tenant}, persisted on this node
+)
+
+// Blob compression is stateless, so one encoder and decoder serve every upload
+var (
+	blobEncoder, _ = zstd.NewWriter(nil)
+	blobDecoder, _ = zstd.NewReader(nil)
+)
+
+// TenantPolicy - Defaults applied to every upload in a tenant. Unset fields
+// keep the node-wide behavior.
+type TenantPolicy struct {
+	TTL               string `json:"ttl,omitempty"`                // Expiry for uploads that set no X-FileBox-TTL, e.g. "720h"
+	Compression       string `json:"compression,omitempty"`        // "zstd" compresses blobs when it saves space
+	Encryption        *bool  `json:"encryption,omitempty"`         // Encrypt new containers; needs a master key when true
+	ReplicationFactor *int   `json:"replication_factor,omitempty"` // Replicas each blob is sent to; 0 keeps it local
+	StorageClass      string `json:"storage_class,omitempty"`      // S3 class when no tiering rule matches
+	MaxBlobSize       int64  `json:"max_blob_size,omitempty"`      // Largest upload accepted, in bytes
+
+	// Peers records may replicate to, by address or "region:<name>" (see replicationscope.go)
+	ReplicateTo   []string `json:"replicate_to,omitempty"`
+	NoReplicateTo []string `json:"no_replicate_to,omitempty"`
+
+	ttl time.Duration
+}
+
+// TenantPolicyStatus - One entry of GET /admin/tenants
+type TenantPolicyStatus struct {
+	Tenant string       `json:"tenant"`
+	Source string       `json:"source"`
+	Policy TenantPolicy `json:"policy"`
+}
+
+// BlobTooLargeError - An upload is larger than its tenant or the node allows
+type BlobTooLargeError struct {
+	Size  int64
+	Limit int64
+}
+
+func (e *BlobTooLargeError) Error() string {
+	return fmt.Sprintf("blob size %d exceeds maximum blob size %d", e.Size, e.Limit)
+}
+
+// tenantPolicies - Policies from the config, overridden per tenant by the admin API
+type tenantPolicies struct {
+	mu        sync.RWMutex
+	path      string
+	config    map[string]TenantPolicy
+	overrides map[string]TenantPolicy
+}
+
+// loadTenantPolicies reads TENANT_POLICIES, a JSON object from tenant name
+// to policy, and the overrides saved by the admin API
+func loadTenantPolicies(storageDir string, encryptionAvailable bool) *tenantPolicies {
+	p := &tenantPolicies{
+		path:      filepath.Join(storageDir, tenantPoliciesFile),
+		config:    make(map[string]TenantPolicy),
+		overrides: make(map[string]TenantPolicy),
+	}
+
+	load := func(source string, data []byte, into map[string]TenantPolicy) {
+		var policies map[string]TenantPolicy
+		if err := json.Unmarshal(data, &policies); err != nil {
+			log.Printf("Ignoring tenant policies from %s: %v", source, err)
+			return
+		}
+		for tenant, policy := range policies {
+			if err := policy.validate(encryptionAvailable); err != nil {
+				log.Printf("Ignoring %s policy for tenant %q: %v", source, tenant, err)
+				continue
+			}
+			into[tenant] = policy
+		}
+	}
+	if value := os.Getenv("TENANT_POLICIES"); value != "" {
+		load("TENANT_POLICIES", []byte(value), p.config)
+	}
+	if data, err := os.ReadFile(p.path); err == nil {
+		load(p.path, data, p.overrides)
+	}
+	if n := len(p.config) + len(p.overrides); n > 0 {
+		log.Printf("Loaded %d tenant policies", n)
+	}
+	return p
+}
+
+// validate checks a policy and parses its TTL
+func (p *TenantPolicy) validate(encryptionAvailable bool) error {
+	p.ttl = 0
+	if p.TTL != "" {
+		d, err := time.ParseDuration(p.TTL)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("ttl must be a positive duration such as 720h")
+		}
+		p.ttl = d
+	}
+	if p.Compression != CompressionNone && p.Compression != CompressionZstd {
+		return fmt.Errorf("compression must be %q or empty", CompressionZstd)
+	}
+	if p.Encryption != nil && *p.Encryption && !encryptionAvailable {
+		return errors.New("encryption needs ENCRYPTION_MASTER_KEY or ENCRYPTION_KMS_KEY_ID")
+	}
+	if p.ReplicationFactor != nil && *p.ReplicationFactor < 0 {
+		return errors.New("replication_factor cannot be negative")
+	}
+	if _, ok := storageClassRank[p.StorageClass]; p.StorageClass != "" && !ok {
+		return fmt.Errorf("unknown storage class %q", p.StorageClass)
+	}
+	if p.MaxBlobSize < 0 {
+		return errors.New("max_blob_size cannot be negative")
+	}
+	if err := validateReplicationScope("replicate_to", p.ReplicateTo); err != nil {
+		return err
+	}
+	if err := validateReplicationScope("no_replicate_to", p.NoReplicateTo); err != nil {
+		return err
+	}
+	return nil
+}
+
+// get returns a tenant's effective policy; an admin override replaces the configured one
+func (p *tenantPolicies) get(tenant string) (TenantPolicy, string) {
+	if p == nil {
+		return TenantPolicy{}, ""
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if policy, ok := p.overrides[tenant]; ok {
+		return policy, PolicySourceAdmin
+	}
+	if policy, ok := p.config[tenant]; ok {
+		return policy, PolicySourceConfig
+	}
+	return TenantPolicy{}, ""
+}
+
+// policy returns a tenant's effective policy
+func (p *tenantPolicies) policy(tenant string) TenantPolicy {
+	policy, _ := p.get(tenant)
+	return policy
+}
+
+// set stores an admin override and saves the overrides
+func (p *tenantPolicies) set(tenant string, policy TenantPolicy) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.overrides[tenant] = policy
+	return p.save()
+}
+
+// remove drops an admin override, falling back to the configured policy
+func (p *tenantPolicies) remove(tenant string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.overrides[tenant]; !ok {
+		return false, nil
+	}
+	delete(p.overrides, tenant)
+	return true, p.save()
+}
+
+// list returns every effective policy, sorted by tenant
+func (p *tenantPolicies) list() []TenantPolicyStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	statuses := make([]TenantPolicyStatus, 0, len(p.config)+len(p.overrides))
+	for tenant, policy := range p.overrides {
+		statuses = append(statuses, TenantPolicyStatus{Tenant: tenant, Source: PolicySourceAdmin, Policy: policy})
+	}
+	for tenant, policy := range p.config {
+		if _, overridden := p.overrides[tenant]; !overridden {
+			statuses = append(statuses, TenantPolicyStatus{Tenant: tenant, Source: PolicySourceConfig, Policy: policy})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Tenant < statuses[j].Tenant })
+	return statuses
+}
+
+// save writes the overrides to disk; callers must hold p.mu
+func (p *tenantPolicies) save() error {
+	data, err := json.MarshalIndent(p.overrides, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+		return err
+	}
+	tmpPath := p.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, p.path)
+}
+
+// encryptsTenant reports whether new containers of a tenant are encrypted
+func (fb *FileBox) encryptsTenant(tenant string) bool {
+	if encryption := fb.tenantPolicies.policy(tenant).Encryption; encryption != nil {
+		return *encryption && fb.keyWrapper != nil
+	}
+	return fb.keyWrapper != nil
+}
+
+// replicasFor picks the replicas a container's blobs are sent to: every
+// replica its tenant's scope allows, or without a replication factor that
+// many of them, spread by rendezvous hashing so tenants do not all land on
+// the same peers.
+func (fb *FileBox) replicasFor(containerFile *ContainerFile) []string {
+	fb.fileLock.RLock()
+	tenant, fileID := containerFile.Tenant, containerFile.FID.String()
+	fb.fileLock.RUnlock()
+
+	policy := fb.tenantPolicies.policy(tenant)
+	replicas := fb.replicas
+	if len(policy.ReplicateTo) > 0 || len(policy.NoReplicateTo) > 0 {
+		replicas = make([]string, 0, len(fb.replicas))
+		for _, replica := range fb.replicas {
+			if policy.allowsPeer(replica, fb.peerRegion(replica)) {
+				replicas = append(replicas, replica)
+			}
+		}
+	}
+	factor := policy.ReplicationFactor
+	if factor == nil || *factor >= len(replicas) {
+		return replicas
+	}
+
+	weight := func(replica string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(fileID + "/" + replica))
+		return h.Sum64()
+	}
+	replicas = append([]string(nil), replicas...)
+	sort.Slice(replicas, func(i, j int) bool { return weight(replicas[i]) > weight(replicas[j]) })
+	return replicas[:*factor]
+}
+
+// storageClassFor picks a container's storage class: the first matching
+// tiering rule, else the tenant's class, else the tiering default.
+// Callers must hold fb.fileLock.
+func (fb *FileBox) storageClassFor(containerFile *ContainerFile) string {
+	size, blobs := fb.containerContents(containerFile)
+	if class, ok := fb.tiering.matchRule(containerFile, size, blobs); ok {
+		return class
+	}
+	if class := fb.tenantPolicies.policy(containerFile.Tenant).StorageClass; class != "" {
+		return class
+	}
+	return fb.tiering.DefaultClass
+}
+
+// compressBlob compresses blob data when the policy asks for it and it saves space
+func compressBlob(policy TenantPolicy, blobData []byte) ([]byte, string) {
+	if policy.Compression != CompressionZstd {
+		return blobData, CompressionNone
+	}
+	if compressed := blobEncoder.EncodeAll(blobData, nil); len(compressed) < len(blobData) {
+		return compressed, CompressionZstd
+	}
+	return blobData, CompressionNone
+}
+
+// decompressBlob undoes compressBlob
+func decompressBlob(blobInfo BlobInfo, stored []byte) ([]byte, error) {
+	switch blobInfo.Compression {
+	case CompressionNone:
+		return stored, nil
+	case CompressionZstd:
+		blobData, err := blobDecoder.DecodeAll(stored, make([]byte, 0, blobInfo.Size))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing blob %s: %v", blobInfo.ID, err)
+		}
+		return blobData, nil
+	}
+	return nil, fmt.Errorf("blob %s uses unknown compression %q", blobInfo.ID, blobInfo.Compression)
+}
+
+// setTenantPolicy stores a validated admin policy, through the Raft log
+// when metadata consensus is on
+func (fb *FileBox) setTenantPolicy(ctx context.Context, tenant string, policy TenantPolicy) error {
+	if fb.raft != nil {
+		value, _ := json.Marshal(policy)
+		if _, err := fb.propose(ctx, raftCommand{Op: RaftSetConfig, Key: raftTenantPrefix + tenant, Value: value}); err != nil {
+			return err
+		}
+	} else if err := fb.tenantPolicies.set(tenant, policy); err != nil {
+		log.Printf("Error saving tenant policies: %v", err)
+	}
+	log.Printf("Policy for tenant %q set", tenant)
+	return nil
+}
+
+// handleTenantPolicies serves GET /admin/tenants and GET, PUT and DELETE
+// /admin/tenants/{tenant}
+func (fb *FileBox) handleTenantPolicies(w http.ResponseWriter, r *http.Request) {
+	tenant := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/tenants"), "/")
+	if tenant == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fb.tenantPolicies.list())
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		policy, source := fb.tenantPolicies.get(tenant)
+		if source == "" {
+			http.Error(w, "No policy for tenant", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TenantPolicyStatus{Tenant: tenant, Source: source, Policy: policy})
+
+	case "PUT":
+		var policy TenantPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := policy.validate(fb.keyWrapper != nil); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := fb.setTenantPolicy(r.Context(), tenant, policy); err != nil {
+			http.Error(w, err.Error(), keyErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TenantPolicyStatus{Tenant: tenant, Source: PolicySourceAdmin, Policy: policy})
+
+	case "DELETE":
+		if fb.raft != nil {
+			if _, source := fb.tenantPolicies.get(tenant); source != PolicySourceAdmin {
+				http.Error(w, "No admin policy for tenant", http.StatusNotFound)
+				return
+			}
+			if _, err := fb.propose(r.Context(), raftCommand{Op: RaftDeleteConfig, Key: raftTenantPrefix + tenant}); err != nil {
+				http.Error(w, err.Error(), keyErrorStatus(err))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		removed, err := fb.tenantPolicies.remove(tenant)
+		if err != nil {
+			log.Printf("Error saving tenant policies: %v", err)
+		}
+		if !removed {
+			http.Error(w, "No admin policy for tenant", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
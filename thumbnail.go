@@ -0,0 +1,148 @@
+// Image thumbnailer for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	_ "image/gif" // Register the GIF decoder
+)
+
+// maxThumbnailPixels bounds the images that are decoded at all (decompression bombs)
+const maxThumbnailPixels = 50_000_000
+
+// ThumbnailSize - One derivative: the image is scaled to fit MaxDimension on its longer side
+type ThumbnailSize struct {
+	Name         string
+	MaxDimension int
+}
+
+// thumbnailer - Upload hook storing scaled-down copies of images as variant blobs
+type thumbnailer struct {
+	sizes []ThumbnailSize
+}
+
+// loadThumbnailer reads THUMBNAIL_SIZES ("thumb:128,medium:512"); unset disables thumbnails
+func loadThumbnailer() *thumbnailer {
+	value := os.Getenv("THUMBNAIL_SIZES")
+	if value == "" {
+		return nil
+	}
+
+	t := &thumbnailer{}
+	for _, entry := range strings.Split(value, ",") {
+		name, dimension, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		size, err := strconv.Atoi(dimension)
+		if !ok || name == "" || err != nil || size <= 0 {
+			log.Printf("Invalid THUMBNAIL_SIZES entry %q, expected name:pixels", entry)
+			continue
+		}
+		t.sizes = append(t.sizes, ThumbnailSize{Name: name, MaxDimension: size})
+	}
+	if len(t.sizes) == 0 {
+		return nil
+	}
+	log.Printf("Generating image thumbnails: %s", value)
+	return t
+}
+
+func (t *thumbnailer) Name() string {
+	return "thumbnail"
+}
+
+// Process stores one scaled copy of an image blob per configured size
+func (t *thumbnailer) Process(fb *FileBox, blob BlobInfo, tenant string, data []byte) error {
+	if !strings.HasPrefix(blob.ContentType, "image/") {
+		return nil
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil // Not a format we can decode
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return fmt.Errorf("image is %dx%d, too large to thumbnail", config.Width, config.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error decoding %s image: %v", format, err)
+	}
+
+	for _, size := range t.sizes {
+		var out bytes.Buffer
+		contentType := "image/png"
+		scaled := scaleToFit(src, size.MaxDimension)
+		if format == "jpeg" {
+			contentType = "image/jpeg"
+			err = jpeg.Encode(&out, scaled, &jpeg.Options{Quality: 85})
+		} else {
+			err = png.Encode(&out, scaled)
+		}
+		if err != nil {
+			return fmt.Errorf("error encoding %s variant: %v", size.Name, err)
+		}
+
+		response, err := fb.AddBlob(out.Bytes(), BlobOptions{
+			Tenant:      tenant,
+			ContentType: contentType,
+			VariantOf:   blob.ID,
+		})
+		if err != nil {
+			return fmt.Errorf("error storing %s variant: %v", size.Name, err)
+		}
+		if err := fb.linkVariant(blob.ID, size.Name, response.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scaleToFit shrinks an image so its longer side is at most maxDimension,
+// averaging each block of source pixels. Smaller images are returned as-is.
+func scaleToFit(src image.Image, maxDimension int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxDimension && height <= maxDimension {
+		return src
+	}
+
+	dstWidth, dstHeight := maxDimension, height*maxDimension/width
+	if height > width {
+		dstWidth, dstHeight = width*maxDimension/height, maxDimension
+	}
+	if dstWidth < 1 {
+		dstWidth = 1
+	}
+	if dstHeight < 1 {
+		dstHeight = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0, y1 := bounds.Min.Y+y*height/dstHeight, bounds.Min.Y+(y+1)*height/dstHeight
+		for x := 0; x < dstWidth; x++ {
+			x0, x1 := bounds.Min.X+x*width/dstWidth, bounds.Min.X+(x+1)*width/dstWidth
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
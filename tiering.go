@@ -0,0 +1,260 @@
+// Storage-class tiering for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3 storage classes supported by the tiering policy, warmest first
+const (
+	StorageClassStandard   = "STANDARD"
+	StorageClassStandardIA = "STANDARD_IA"
+	StorageClassGlacierIR  = "GLACIER_IR"
+	StorageClassGlacier    = "GLACIER" // Requires a restore before reads
+	StorageClassDeepArch   = "DEEP_ARCHIVE"
+)
+
+// storageClassRank orders storage classes from warm to cold
+var storageClassRank = map[string]int{
+	StorageClassStandard:   0,
+	StorageClassStandardIA: 1,
+	StorageClassGlacierIR:  2,
+	StorageClassGlacier:    3,
+	StorageClassDeepArch:   4,
+}
+
+// Blob size classes used by tiering rules
+const (
+	SizeClassSmall = "small"
+	SizeClassLarge = "large"
+)
+
+// TieringRule - Selects a storage class when all of its conditions match
+type TieringRule struct {
+	MinAge       time.Duration `json:"min_age,omitempty"`    // Container age at least this old
+	MinIdle      time.Duration `json:"min_idle,omitempty"`   // No blob in the container read for this long
+	SizeClass    string        `json:"size_class,omitempty"` // "small" or "large" by average blob size
+	Tenant       string        `json:"tenant,omitempty"`     // Container tenant
+	StorageClass string        `json:"storage_class"`
+}
+
+// TieringPolicy - Ordered storage-class rules; the first matching rule wins
+type TieringPolicy struct {
+	Rules              []TieringRule
+	DefaultClass       string
+	SmallBlobThreshold int64
+	TransitionInterval time.Duration
+}
+
+// loadTieringPolicy builds the tiering policy from the environment
+//
+// TIERING_RULES is a ';'-separated list of rules, each "cond,cond:CLASS" where a
+// condition is one of age=<duration>, idle=<duration>, size=small|large or
+// tenant=<name>, e.g. "tenant=logs:STANDARD_IA;age=720h,idle=168h:GLACIER_IR".
+func loadTieringPolicy() *TieringPolicy {
+	policy := &TieringPolicy{
+		DefaultClass:       getEnvOrDefault("TIERING_DEFAULT_CLASS", StorageClassStandard),
+		SmallBlobThreshold: 1024 * 1024, // 1MB
+		TransitionInterval: time.Hour,
+	}
+
+	if _, ok := storageClassRank[policy.DefaultClass]; !ok {
+		log.Printf("Unknown TIERING_DEFAULT_CLASS %s, using %s", policy.DefaultClass, StorageClassStandard)
+		policy.DefaultClass = StorageClassStandard
+	}
+
+	if v := getEnvOrDefault("TIERING_SMALL_BLOB_BYTES", ""); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			policy.SmallBlobThreshold = n
+		} else {
+			log.Printf("Invalid TIERING_SMALL_BLOB_BYTES %q, using %d", v, policy.SmallBlobThreshold)
+		}
+	}
+
+	if v := getEnvOrDefault("TIERING_INTERVAL", ""); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			policy.TransitionInterval = d
+		} else {
+			log.Printf("Invalid TIERING_INTERVAL %q, using %s", v, policy.TransitionInterval)
+		}
+	}
+
+	rules, err := parseTieringRules(getEnvOrDefault("TIERING_RULES", ""))
+	if err != nil {
+		log.Printf("Ignoring TIERING_RULES: %v", err)
+	} else {
+		policy.Rules = rules
+	}
+
+	return policy
+}
+
+// parseTieringRules parses the TIERING_RULES format
+func parseTieringRules(spec string) ([]TieringRule, error) {
+	var rules []TieringRule
+	for _, ruleStr := range strings.Split(spec, ";") {
+		ruleStr = strings.TrimSpace(ruleStr)
+		if ruleStr == "" {
+			continue
+		}
+
+		sep := strings.LastIndex(ruleStr, ":")
+		if sep == -1 {
+			return nil, fmt.Errorf("rule %q has no storage class", ruleStr)
+		}
+
+		rule := TieringRule{StorageClass: strings.TrimSpace(ruleStr[sep+1:])}
+		if _, ok := storageClassRank[rule.StorageClass]; !ok {
+			return nil, fmt.Errorf("rule %q has unknown storage class %s", ruleStr, rule.StorageClass)
+		}
+
+		for _, cond := range strings.Split(ruleStr[:sep], ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(cond), "=")
+			if !ok {
+				return nil, fmt.Errorf("rule %q has invalid condition %q", ruleStr, cond)
+			}
+			switch key {
+			case "age":
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					return nil, fmt.Errorf("rule %q has invalid age: %v", ruleStr, err)
+				}
+				rule.MinAge = d
+			case "idle":
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					return nil, fmt.Errorf("rule %q has invalid idle time: %v", ruleStr, err)
+				}
+				rule.MinIdle = d
+			case "size":
+				if value != SizeClassSmall && value != SizeClassLarge {
+					return nil, fmt.Errorf("rule %q has invalid size class %s", ruleStr, value)
+				}
+				rule.SizeClass = value
+			case "tenant":
+				rule.Tenant = value
+			default:
+				return nil, fmt.Errorf("rule %q has unknown condition %s", ruleStr, key)
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// sizeClass classifies a container of size bytes by its average blob size
+func (p *TieringPolicy) sizeClass(size int64, blobs []BlobInfo) string {
+	if len(blobs) == 0 {
+		return "" // Unknown until the blob index is available
+	}
+	if size/int64(len(blobs)) < p.SmallBlobThreshold {
+		return SizeClassSmall
+	}
+	return SizeClassLarge
+}
+
+// StorageClassFor returns the storage class a container should be stored
+// in, given its size and index entries. Callers must hold fb.fileLock.
+func (p *TieringPolicy) StorageClassFor(containerFile *ContainerFile, size int64, blobs []BlobInfo) string {
+	if class, ok := p.matchRule(containerFile, size, blobs); ok {
+		return class
+	}
+	return p.DefaultClass
+}
+
+// matchRule returns the storage class of the first rule matching a container
+// Callers must hold fb.fileLock.
+func (p *TieringPolicy) matchRule(containerFile *ContainerFile, size int64, blobs []BlobInfo) (string, bool) {
+	age := timeNow().Sub(containerFile.Created)
+	idle := timeNow().Sub(lastContainerAccess(containerFile, blobs))
+	sizeClass := p.sizeClass(size, blobs)
+
+	for _, rule := range p.Rules {
+		if rule.MinAge > 0 && age < rule.MinAge {
+			continue
+		}
+		if rule.MinIdle > 0 && idle < rule.MinIdle {
+			continue
+		}
+		if rule.SizeClass != "" && rule.SizeClass != sizeClass {
+			continue
+		}
+		if rule.Tenant != "" && rule.Tenant != containerFile.Tenant {
+			continue
+		}
+		return rule.StorageClass, true
+	}
+	return "", false
+}
+
+// runTieringTransitions periodically moves uploaded containers to colder classes
+func (fb *FileBox) runTieringTransitions() {
+	if fb.s3Client == nil || len(fb.tiering.Rules) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(fb.tiering.TransitionInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fb.transitionStorageClasses()
+	}
+}
+
+// transitionStorageClasses re-evaluates the policy for every uploaded container
+// and copies objects in place when the policy now selects a colder class
+func (fb *FileBox) transitionStorageClasses() {
+	type transition struct {
+		containerFile *ContainerFile
+		target        string
+	}
+
+	var pending []transition
+	fb.fileLock.RLock()
+	for _, file := range fb.files.all() {
+		if !file.Uploaded {
+			continue
+		}
+		target := fb.storageClassFor(file)
+		if storageClassRank[target] > storageClassRank[file.StorageClass] {
+			pending = append(pending, transition{containerFile: file, target: target})
+		}
+	}
+	fb.fileLock.RUnlock()
+
+	for _, t := range pending {
+		s3Key := fb.containerS3Key(t.containerFile)
+		_, err := fb.s3Client.CopyObject(withUsageTenant(context.Background(), t.containerFile.Tenant), &s3.CopyObjectInput{
+			Bucket:            aws.String(fb.bucket),
+			Key:               aws.String(s3Key),
+			CopySource:        aws.String(fb.bucket + "/" + s3Key),
+			StorageClass:      types.StorageClass(t.target),
+			MetadataDirective: types.MetadataDirectiveCopy,
+		})
+		if err != nil {
+			log.Printf("Error transitioning %s to %s: %v", s3Key, t.target, err)
+			continue
+		}
+
+		fb.fileLock.Lock()
+		t.containerFile.StorageClass = t.target
+		fb.fileLock.Unlock()
+
+		fb.saveManifest(t.containerFile)
+
+		log.Printf("Transitioned %s to storage class %s", s3Key, t.target)
+	}
+}
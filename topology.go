@@ -0,0 +1,99 @@
+// Cluster topology for smart clients of FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// topologyTimeout bounds the handshakes GET /topology makes with peers it
+// has not heard from yet
+const topologyTimeout = 3 * time.Second
+
+// TopologyPeer - One replica as this node sees it
+type TopologyPeer struct {
+	Address   string `json:"address"` // As configured in REPLICAS
+	HostID    string `json:"host_id,omitempty"`
+	MachineID uint32 `json:"machine_id,omitempty"` // Known once a handshake succeeded
+	Region    string `json:"region,omitempty"`
+	Reachable bool   `json:"reachable"`
+	Breaker   string `json:"breaker"` // Replication circuit breaker state
+}
+
+// ClusterTopology - Response of GET /topology
+type ClusterTopology struct {
+	HostID     string         `json:"host_id"`
+	MachineIDs []uint32       `json:"machine_ids"` // Own machine ID first, then adopted ones
+	Region     string         `json:"region,omitempty"`
+	Mode       string         `json:"mode"`
+	Peers      []TopologyPeer `json:"peers"` // Where this node replicates to
+	Time       time.Time      `json:"time"`
+}
+
+// ownedMachines lists the machine IDs whose containers this node writes
+func (fb *FileBox) ownedMachines() []uint32 {
+	fb.bootstrap.mu.Lock()
+	adopted := make([]uint32, 0, len(fb.bootstrap.adopted))
+	for id := range fb.bootstrap.adopted {
+		if id != fb.machineID {
+			adopted = append(adopted, id)
+		}
+	}
+	fb.bootstrap.mu.Unlock()
+	slices.Sort(adopted)
+	return append([]uint32{fb.machineID}, adopted...)
+}
+
+// topology describes this node and its replicas, shaking hands with peers
+// not heard from recently
+func (fb *FileBox) topology(ctx context.Context) ClusterTopology {
+	ctx, cancel := context.WithTimeout(ctx, topologyTimeout)
+	defer cancel()
+
+	peers := make([]TopologyPeer, len(fb.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range fb.replicas {
+		wg.Add(1)
+		go func(i int, replica string) {
+			defer wg.Done()
+			protocol := fb.peerProtocol(ctx, replica)
+			peers[i] = TopologyPeer{
+				Address:   replica,
+				HostID:    protocol.HostID,
+				MachineID: protocol.MachineID,
+				Region:    protocol.Region,
+				Reachable: protocol.compatible(),
+				Breaker:   fb.health.snapshot(replica).State,
+			}
+		}(i, replica)
+	}
+	wg.Wait()
+
+	return ClusterTopology{
+		HostID:     fb.hostID,
+		MachineIDs: fb.ownedMachines(),
+		Region:     fb.region,
+		Mode:       fb.mode.get().Mode,
+		Peers:      peers,
+		Time:       timeNow().UTC(),
+	}
+}
+
+// handleTopology serves GET /topology, which smart clients use to send
+// requests straight to the node owning a blob
+func (fb *FileBox) handleTopology(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.topology(r.Context()))
+}
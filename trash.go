@@ -0,0 +1,228 @@
+// Soft delete and undelete for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// defaultUndeleteWindow is how long a deleted blob can be restored
+const defaultUndeleteWindow = 24 * time.Hour
+
+// DeletedError - The blob was deleted; it may still be in the trash
+type DeletedError struct {
+	BlobID    string
+	DeletedAt time.Time
+	Expired   bool // Removed by its TTL rather than deleted
+}
+
+func (e *DeletedError) Error() string {
+	if e.Expired {
+		return fmt.Sprintf("blob %s expired at %s", e.BlobID, e.DeletedAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("blob %s was deleted at %s", e.BlobID, e.DeletedAt.Format(time.RFC3339))
+}
+
+// DeleteResponse - Response for DELETE /blob/{id} and POST /blob/{id}/undelete
+type DeleteResponse struct {
+	ID         string     `json:"id"`
+	Deleted    bool       `json:"deleted"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+	PurgeAfter *time.Time `json:"purge_after,omitempty"` // Undelete is possible until then
+}
+
+// loadUndeleteWindow reads UNDELETE_WINDOW
+func loadUndeleteWindow() time.Duration {
+	window := getEnvDuration("UNDELETE_WINDOW", defaultUndeleteWindow)
+	if window < 0 {
+		log.Printf("Invalid UNDELETE_WINDOW %v, using %v", window, defaultUndeleteWindow)
+		window = defaultUndeleteWindow
+	}
+	return window
+}
+
+// purgeAfter is when a deleted blob leaves the trash
+func (fb *FileBox) purgeAfter(blob BlobInfo) time.Time {
+	return blob.DeletedAt.Add(fb.undeleteWindow)
+}
+
+// purgeable reports whether a blob's tombstone is past the undelete window
+// and its data may be reclaimed by compaction. Held blobs never are.
+// Callers must hold fb.fileLock.
+func (fb *FileBox) purgeable(containerFile *ContainerFile, blob BlobInfo, now time.Time) bool {
+	return blob.DeletedAt != nil && heldBy(containerFile, blob) == "" && !now.Before(fb.purgeAfter(blob))
+}
+
+// expired reports whether a blob's TTL has passed. Held blobs never expire.
+// Callers must hold fb.fileLock.
+func expired(containerFile *ContainerFile, blob BlobInfo, now time.Time) bool {
+	return blob.ExpiresAt != nil && heldBy(containerFile, blob) == "" && !now.Before(*blob.ExpiresAt)
+}
+
+// deleteResponse describes a blob's trash state
+func (fb *FileBox) deleteResponse(blob BlobInfo) DeleteResponse {
+	response := DeleteResponse{ID: blob.ID, Deleted: blob.DeletedAt != nil}
+	if blob.DeletedAt != nil {
+		deletedAt, purgeAfter := *blob.DeletedAt, fb.purgeAfter(blob)
+		response.DeletedAt, response.PurgeAfter = &deletedAt, &purgeAfter
+	}
+	return response
+}
+
+// DeleteBlob moves a blob to the trash. Deleting a deleted blob is a no-op.
+func (fb *FileBox) DeleteBlob(blobID string) (DeleteResponse, error) {
+	containerFile, index, err := fb.findBlob(blobID)
+	if err != nil {
+		return DeleteResponse{}, err
+	}
+	if fb.isForeign(containerFile) {
+		return DeleteResponse{}, &ForeignError{BlobID: blobID, MachineID: containerFile.FID.MachineID}
+	}
+
+	fb.fileLock.Lock()
+	blob := &containerFile.Blobs[index]
+	if scope := heldBy(containerFile, *blob); scope != "" {
+		fb.fileLock.Unlock()
+		return DeleteResponse{}, &HeldError{BlobID: blobID, Scope: scope}
+	}
+	changed := blob.DeletedAt == nil
+	if changed {
+		now := timeNow().UTC()
+		blob.DeletedAt = &now
+	}
+	response := fb.deleteResponse(*blob)
+	fb.fileLock.Unlock()
+
+	if changed {
+		fb.saveBlobMetadata(containerFile, index)
+		fb.logBlobChange(MetaOpDelete, containerFile, index)
+		log.Printf("Deleted blob %s (undelete possible until %s)", blobID, response.PurgeAfter.Format(time.RFC3339))
+	}
+	return response, nil
+}
+
+// UndeleteBlob restores a blob from the trash while the undelete window is open
+func (fb *FileBox) UndeleteBlob(blobID string) (DeleteResponse, error) {
+	containerFile, index, err := fb.findBlob(blobID)
+	if err != nil {
+		return DeleteResponse{}, err
+	}
+	if fb.isForeign(containerFile) {
+		return DeleteResponse{}, &ForeignError{BlobID: blobID, MachineID: containerFile.FID.MachineID}
+	}
+
+	fb.fileLock.Lock()
+	blob := &containerFile.Blobs[index]
+	if fb.purgeable(containerFile, *blob, timeNow()) {
+		deletedAt := *blob.DeletedAt
+		fb.fileLock.Unlock()
+		return DeleteResponse{}, &DeletedError{BlobID: blobID, DeletedAt: deletedAt}
+	}
+	changed := blob.DeletedAt != nil
+	blob.DeletedAt = nil
+	response := fb.deleteResponse(*blob)
+	fb.fileLock.Unlock()
+
+	if changed {
+		fb.saveBlobMetadata(containerFile, index)
+		fb.logBlobChange(MetaOpUndelete, containerFile, index)
+		log.Printf("Undeleted blob %s", blobID)
+	}
+	return response, nil
+}
+
+// findBlob resolves a blob ID to its container and index
+func (fb *FileBox) findBlob(blobID string) (*ContainerFile, int, error) {
+	fileID, blobIndex, err := parseBlobID(blobID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+
+	containerFile, exists := fb.files.get(fileID)
+	if !exists {
+		return nil, 0, fmt.Errorf("blob not found: %s", blobID)
+	}
+	if _, ok := fb.blobEntry(containerFile, blobIndex); !ok {
+		return nil, 0, fmt.Errorf("blob not found: %s", blobID)
+	}
+	return containerFile, blobIndex, nil
+}
+
+// saveBlobMetadata persists changes to existing blob entries
+func (fb *FileBox) saveBlobMetadata(containerFile *ContainerFile, indexes ...int) {
+	fb.manifestLock.Lock()
+	defer fb.manifestLock.Unlock()
+
+	fb.fileLock.RLock()
+	snapshot := fb.snapshotContainer(containerFile)
+	fb.fileLock.RUnlock()
+
+	if err := fb.meta.UpdateBlobs(snapshot, indexes...); err != nil {
+		log.Printf("Error saving blobs of %s: %v", snapshot.FID.String(), err)
+	}
+}
+
+// handleDeleteBlob serves DELETE /blob/{id}
+func (fb *FileBox) handleDeleteBlob(w http.ResponseWriter, r *http.Request, blobID string) {
+	response, err := fb.DeleteBlob(blobID)
+
+	event := auditEventFor(r, AuditDelete)
+	event.BlobID = blobID
+	if err != nil {
+		event.Outcome, event.Detail = "error", err.Error()
+		fb.audit.record(event)
+		switch err.(type) {
+		case *HeldError, *ForeignError:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	event.Outcome = "ok"
+	fb.audit.record(event)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleUndeleteBlob serves POST /blob/{id}/undelete
+func (fb *FileBox) handleUndeleteBlob(w http.ResponseWriter, r *http.Request, blobID string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response, err := fb.UndeleteBlob(blobID)
+
+	event := auditEventFor(r, AuditUndelete)
+	event.BlobID = blobID
+	if err != nil {
+		event.Outcome, event.Detail = "error", err.Error()
+		fb.audit.record(event)
+		switch err.(type) {
+		case *DeletedError:
+			http.Error(w, "Undelete window has expired", http.StatusGone)
+			return
+		case *ForeignError:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	event.Outcome = "ok"
+	fb.audit.record(event)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
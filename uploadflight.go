@@ -0,0 +1,160 @@
+// Deduplication of concurrent container uploads for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// What started a container upload
+const (
+	UploadTriggerFull      = "full"      // The last write into a full container ended
+	UploadTriggerRecovery  = "recovery"  // Found not yet uploaded at startup
+	UploadTriggerBootstrap = "bootstrap" // Copied from a peer and missing from S3
+	UploadTriggerExpiry    = "expiry"    // Put back after a legal hold stopped its expiry
+	UploadTriggerAdmin     = "admin"     // POST /admin/containers/{fid}/upload
+)
+
+// UploadBlockedError - A container cannot be uploaded to S3 right now
+type UploadBlockedError struct {
+	FileID string
+	Reason string
+}
+
+func (e *UploadBlockedError) Error() string {
+	return fmt.Sprintf("container %s not uploaded: %s", e.FileID, e.Reason)
+}
+
+// InflightUpload - A container upload to S3 in progress
+type InflightUpload struct {
+	FileID       string    `json:"file_id"`
+	Tenant       string    `json:"tenant,omitempty"`
+	Size         int64     `json:"size"`
+	StorageClass string    `json:"storage_class,omitempty"`
+	Trigger      string    `json:"trigger"` // What started it; see UploadTrigger*
+	Started      time.Time `json:"started"`
+	Joined       int       `json:"joined"` // Later requests that waited for it instead of uploading again
+}
+
+// uploadFlight - One upload and the callers waiting for it
+type uploadFlight struct {
+	info InflightUpload
+	done chan struct{}
+	err  error
+}
+
+// uploadFlights - Container uploads in flight by file ID; at most one per container
+type uploadFlights struct {
+	mu      sync.Mutex
+	flights map[string]*uploadFlight
+}
+
+// do runs upload unless an upload of the container is already in flight,
+// in which case it waits for that one and returns its error
+func (u *uploadFlights) do(fileID, trigger string, upload func(*InflightUpload) error) error {
+	u.mu.Lock()
+	if flight, ok := u.flights[fileID]; ok {
+		flight.info.Joined++
+		u.mu.Unlock()
+		<-flight.done
+		return flight.err
+	}
+	if u.flights == nil {
+		u.flights = make(map[string]*uploadFlight)
+	}
+	flight := &uploadFlight{
+		info: InflightUpload{FileID: fileID, Trigger: trigger, Started: timeNow().UTC()},
+		done: make(chan struct{}),
+	}
+	u.flights[fileID] = flight
+	u.mu.Unlock()
+
+	flight.err = upload(&flight.info)
+
+	u.mu.Lock()
+	delete(u.flights, fileID)
+	u.mu.Unlock()
+	close(flight.done)
+	return flight.err
+}
+
+// describe records what an in-flight upload is sending
+func (u *uploadFlights) describe(info *InflightUpload, tenant string, size int64, storageClass string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	info.Tenant, info.Size, info.StorageClass = tenant, size, storageClass
+}
+
+// list returns the uploads in flight, oldest first
+func (u *uploadFlights) list() []InflightUpload {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	uploads := make([]InflightUpload, 0, len(u.flights))
+	for _, flight := range u.flights {
+		uploads = append(uploads, flight.info)
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		if !uploads[i].Started.Equal(uploads[j].Started) {
+			return uploads[i].Started.Before(uploads[j].Started)
+		}
+		return uploads[i].FileID < uploads[j].FileID
+	})
+	return uploads
+}
+
+// handleInflightUploads serves GET /admin/uploads
+func (fb *FileBox) handleInflightUploads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.uploadFlights.list())
+}
+
+// ContainerUploadResponse - Response of POST /admin/containers/{fid}/upload
+type ContainerUploadResponse struct {
+	FileID       string    `json:"file_id"`
+	Uploaded     bool      `json:"uploaded"`
+	UploadedAt   time.Time `json:"uploaded_at"`
+	StorageClass string    `json:"storage_class,omitempty"`
+}
+
+// handleContainerUpload uploads a container to S3 now, or waits for the
+// upload already in flight. Uploaded containers are left alone.
+func (fb *FileBox) handleContainerUpload(w http.ResponseWriter, r *http.Request, containerFile *ContainerFile) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileID := containerFile.FID.String()
+	if err := fb.uploadContainerFile(fileID, UploadTriggerAdmin); err != nil {
+		if _, blocked := err.(*UploadBlockedError); blocked {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	fb.fileLock.RLock()
+	response := ContainerUploadResponse{
+		FileID:       fileID,
+		Uploaded:     containerFile.Uploaded,
+		UploadedAt:   containerFile.UploadedAt,
+		StorageClass: containerFile.StorageClass,
+	}
+	fb.fileLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
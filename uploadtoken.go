@@ -0,0 +1,280 @@
+// Signed upload tokens for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upload token lifetimes
+const (
+	defaultUploadTokenTTL = 15 * time.Minute
+	defaultMaxUploadTTL   = 24 * time.Hour
+)
+
+// usedUploadTokensFile keeps the IDs of used tokens until they expire, so
+// a restart does not make them usable again
+const usedUploadTokensFile = "node/upload-tokens-used.json"
+
+// UploadTokenClaims - What a token allows its holder to upload
+type UploadTokenClaims struct {
+	ID          string    `json:"id"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Key         string    `json:"key,omitempty"`          // Named key the upload is stored under
+	MaxSize     int64     `json:"max_size"`               // Largest accepted blob in bytes
+	ContentType string    `json:"content_type,omitempty"` // Required Content-Type; a trailing "/" allows a family, e.g. "image/"
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// UploadTokenRequest - Body of POST /admin/upload-tokens
+type UploadTokenRequest struct {
+	Tenant      string `json:"tenant"`
+	Key         string `json:"key"`
+	MaxSize     int64  `json:"max_size"`
+	ContentType string `json:"content_type"`
+	TTL         string `json:"ttl"` // Go duration, default 15m
+}
+
+// UploadTokenResponse - A freshly issued token
+type UploadTokenResponse struct {
+	Token string `json:"token"`
+	UploadTokenClaims
+}
+
+// uploadTokens - Signs upload tokens and remembers which ones were used
+type uploadTokens struct {
+	secret  []byte
+	maxTTL  time.Duration
+	require bool // Reject uploads that carry no token
+
+	mu     sync.Mutex
+	used   map[string]time.Time // Token ID -> expiry, so entries can be pruned
+	path   string
+	saveMu sync.Mutex // Orders saves so an older list never overwrites a newer one
+}
+
+// loadUploadTokens reads UPLOAD_TOKEN_SECRET, UPLOAD_TOKEN_MAX_TTL and
+// REQUIRE_UPLOAD_TOKEN, and the tokens used before the last restart
+func loadUploadTokens(storageDir string) *uploadTokens {
+	tokens := &uploadTokens{
+		secret:  []byte(os.Getenv("UPLOAD_TOKEN_SECRET")),
+		maxTTL:  getEnvDuration("UPLOAD_TOKEN_MAX_TTL", defaultMaxUploadTTL),
+		require: getEnvBool("REQUIRE_UPLOAD_TOKEN", false),
+		used:    make(map[string]time.Time),
+		path:    filepath.Join(storageDir, usedUploadTokensFile),
+	}
+	if data, err := os.ReadFile(tokens.path); err == nil {
+		if err := json.Unmarshal(data, &tokens.used); err != nil {
+			log.Printf("Ignoring used upload tokens in %s: %v", tokens.path, err)
+		}
+		now := timeNow()
+		for id, expiry := range tokens.used {
+			if now.After(expiry) {
+				delete(tokens.used, id)
+			}
+		}
+	}
+	if len(tokens.secret) == 0 {
+		// Tokens still work, but only on this node and until it restarts
+		tokens.secret = make([]byte, 32)
+		rand.Read(tokens.secret)
+		if tokens.require {
+			log.Printf("WARNING: REQUIRE_UPLOAD_TOKEN is set without UPLOAD_TOKEN_SECRET; tokens are only valid on this node until restart")
+		}
+	}
+	return tokens
+}
+
+// sign returns the token's MAC over its encoded claims
+func (t *uploadTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issue creates a signed token for the given constraints
+func (t *uploadTokens) issue(claims UploadTokenClaims) (UploadTokenResponse, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return UploadTokenResponse{}, err
+	}
+	claims.ID = hex.EncodeToString(id)
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return UploadTokenResponse{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return UploadTokenResponse{Token: payload + "." + t.sign(payload), UploadTokenClaims: claims}, nil
+}
+
+// parse verifies a token's signature and expiry without using it up
+func (t *uploadTokens) parse(token string) (UploadTokenClaims, error) {
+	var claims UploadTokenClaims
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(t.sign(payload))) {
+		return claims, fmt.Errorf("invalid upload token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return claims, fmt.Errorf("invalid upload token")
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return claims, fmt.Errorf("invalid upload token")
+	}
+	if timeNow().After(claims.ExpiresAt) {
+		return claims, fmt.Errorf("upload token expired")
+	}
+	return claims, nil
+}
+
+// claim marks a token used; it fails if the token was already used, or
+// if its use cannot be saved and would be forgotten by a restart
+func (t *uploadTokens) claim(claims UploadTokenClaims) error {
+	t.mu.Lock()
+	now := timeNow()
+	for id, expiry := range t.used {
+		if now.After(expiry) {
+			delete(t.used, id)
+		}
+	}
+
+	if _, used := t.used[claims.ID]; used {
+		t.mu.Unlock()
+		return fmt.Errorf("upload token already used")
+	}
+	t.used[claims.ID] = claims.ExpiresAt
+	t.mu.Unlock()
+
+	if err := t.save(); err != nil {
+		log.Printf("Error saving used upload tokens: %v", err)
+		t.mu.Lock()
+		delete(t.used, claims.ID)
+		t.mu.Unlock()
+		return fmt.Errorf("upload token could not be recorded")
+	}
+	return nil
+}
+
+// release makes a claimed token usable again after a failed upload
+func (t *uploadTokens) release(claims UploadTokenClaims) {
+	t.mu.Lock()
+	delete(t.used, claims.ID)
+	t.mu.Unlock()
+	if err := t.save(); err != nil {
+		log.Printf("Error saving used upload tokens: %v", err)
+	}
+}
+
+// save writes the used tokens to node/upload-tokens-used.json
+func (t *uploadTokens) save() error {
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	t.mu.Lock()
+	data, err := json.Marshal(t.used)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return err
+	}
+	tmpPath := t.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, t.path)
+}
+
+// allowsContentType checks an upload's Content-Type against the token
+func (c UploadTokenClaims) allowsContentType(contentType string) bool {
+	if c.ContentType == "" {
+		return true
+	}
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	if strings.HasSuffix(c.ContentType, "/") {
+		return strings.HasPrefix(mediaType, c.ContentType)
+	}
+	return strings.EqualFold(mediaType, c.ContentType)
+}
+
+// uploadTokenFrom returns the token sent as a bearer token or ?token= parameter
+func uploadTokenFrom(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return ""
+}
+
+// handleUploadTokens serves POST /admin/upload-tokens
+func (fb *FileBox) handleUploadTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req UploadTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ttl := defaultUploadTokenTTL
+	if req.TTL != "" {
+		parsed, err := time.ParseDuration(req.TTL)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+	if ttl > fb.uploadTokens.maxTTL {
+		http.Error(w, fmt.Sprintf("ttl exceeds maximum of %v", fb.uploadTokens.maxTTL), http.StatusBadRequest)
+		return
+	}
+
+	maxSize := fb.maxBlobSize()
+	if req.MaxSize < 0 || req.MaxSize > maxSize {
+		http.Error(w, fmt.Sprintf("max_size must be between 1 and %d", maxSize), http.StatusBadRequest)
+		return
+	}
+	if req.MaxSize > 0 {
+		maxSize = req.MaxSize
+	}
+
+	claims := UploadTokenClaims{
+		Tenant:      req.Tenant,
+		Key:         req.Key,
+		MaxSize:     maxSize,
+		ContentType: req.ContentType,
+		ExpiresAt:   timeNow().Add(ttl).UTC().Truncate(time.Second),
+	}
+	response, err := fb.uploadTokens.issue(claims)
+	if err != nil {
+		http.Error(w, "Error issuing token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUploadTokenUsedAcrossRestart checks that a used token stays used
+// when the node restarts, and that a released one can be used again
+func TestUploadTokenUsedAcrossRestart(t *testing.T) {
+	t.Setenv("UPLOAD_TOKEN_SECRET", "test secret")
+	dir := t.TempDir()
+
+	tokens := loadUploadTokens(dir)
+	issued, err := tokens.issue(UploadTokenClaims{MaxSize: 1024, ExpiresAt: timeNow().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	released, err := tokens.issue(UploadTokenClaims{MaxSize: 1024, ExpiresAt: timeNow().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []UploadTokenResponse{issued, released} {
+		if err := tokens.claim(token.UploadTokenClaims); err != nil {
+			t.Fatalf("first use of token %s: %v", token.ID, err)
+		}
+	}
+	tokens.release(released.UploadTokenClaims)
+
+	restarted := loadUploadTokens(dir)
+	claims, err := restarted.parse(issued.Token)
+	if err != nil {
+		t.Fatalf("token no longer parses after a restart: %v", err)
+	}
+	if err := restarted.claim(claims); err == nil {
+		t.Error("a token used before the restart was accepted again")
+	}
+	if err := restarted.claim(released.UploadTokenClaims); err != nil {
+		t.Errorf("a token released before the restart was refused: %v", err)
+	}
+}
+
+// TestUploadTokenExpiredDropped checks that used tokens past their expiry
+// are not kept across restarts
+func TestUploadTokenExpiredDropped(t *testing.T) {
+	dir := t.TempDir()
+	tokens := loadUploadTokens(dir)
+	if err := tokens.claim(UploadTokenClaims{ID: "old", ExpiresAt: timeNow().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.claim(UploadTokenClaims{ID: "new", ExpiresAt: timeNow().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := loadUploadTokens(dir)
+	if _, kept := restarted.used["old"]; kept {
+		t.Error("an expired token was kept across the restart")
+	}
+	if _, kept := restarted.used["new"]; !kept {
+		t.Error("an unexpired token was forgotten across the restart")
+	}
+}
+
+// TestUploadTokenRequiredForCopyAndCompose checks that with
+// REQUIRE_UPLOAD_TOKEN set, copies and composes need a token, use it up,
+// and hand it back when they fail
+func TestUploadTokenRequiredForCopyAndCompose(t *testing.T) {
+	fb := newTestFileBox(t, t.TempDir())
+	fb.uploadTokens.require = true
+	source, err := fb.AddBlob([]byte("0123456789"), BlobOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := map[string]func(token string) *http.Request{
+		"copy": func(token string) *http.Request {
+			return httptest.NewRequest("POST", "/blob/"+source.ID+"/copy?token="+token, nil)
+		},
+		"compose": func(token string) *http.Request {
+			body := `{"sources": ["` + source.ID + `", "` + source.ID + `"]}`
+			return httptest.NewRequest("POST", "/compose?token="+token, strings.NewReader(body))
+		},
+	}
+	serve := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		if strings.HasPrefix(r.URL.Path, "/compose") {
+			fb.handleCompose(w, r)
+		} else {
+			fb.handleCopy(w, r, source.ID)
+		}
+		return w.Code
+	}
+	for name, request := range requests {
+		t.Run(name, func(t *testing.T) {
+			if status := serve(request("")); status != http.StatusUnauthorized {
+				t.Errorf("without a token: status %d, want %d", status, http.StatusUnauthorized)
+			}
+
+			small, err := fb.uploadTokens.issue(UploadTokenClaims{MaxSize: 5, ExpiresAt: timeNow().Add(time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status := serve(request(small.Token)); status != http.StatusRequestEntityTooLarge {
+				t.Errorf("past the token's size limit: status %d, want %d", status, http.StatusRequestEntityTooLarge)
+			}
+			if _, used := fb.uploadTokens.used[small.ID]; used {
+				t.Error("a token was kept used after the request failed")
+			}
+
+			token, err := fb.uploadTokens.issue(UploadTokenClaims{MaxSize: 1024, ExpiresAt: timeNow().Add(time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status := serve(request(token.Token)); status != http.StatusCreated {
+				t.Fatalf("with a token: status %d, want %d", status, http.StatusCreated)
+			}
+			if status := serve(request(token.Token)); status != http.StatusUnauthorized {
+				t.Errorf("reusing the token: status %d, want %d", status, http.StatusUnauthorized)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Cost and usage reporting for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// Default S3 prices in USD (us-east-1 list prices); override with S3_PRICES,
+// S3_PRICE_PUT_PER_1000 and S3_PRICE_GET_PER_1000
+var defaultStoragePrices = map[string]float64{ // Per GB-month
+	StorageClassStandard:   0.023,
+	StorageClassStandardIA: 0.0125,
+	StorageClassGlacierIR:  0.004,
+	StorageClassGlacier:    0.0036,
+	StorageClassDeepArch:   0.00099,
+}
+
+const (
+	defaultPutPricePer1000 = 0.005  // PUT, COPY, POST and LIST requests
+	defaultGetPricePer1000 = 0.0004 // GET, HEAD and everything else that is not free
+	bytesPerGB             = 1 << 30
+	hoursPerMonth          = 730
+)
+
+// S3 operations priced as PUT-class requests, and the ones that are free
+var (
+	putClassOperations = map[string]bool{
+		"PutObject": true, "CopyObject": true, "ListObjectsV2": true, "RestoreObject": true,
+		"CreateMultipartUpload": true, "UploadPart": true, "CompleteMultipartUpload": true,
+	}
+	freeOperations = map[string]bool{"DeleteObject": true, "AbortMultipartUpload": true}
+)
+
+// UsagePricing - Prices the cost estimates are based on
+type UsagePricing struct {
+	StoragePerGBMonth map[string]float64 `json:"storage_per_gb_month"`
+	PutPer1000        float64            `json:"put_per_1000"`
+	GetPer1000        float64            `json:"get_per_1000"`
+}
+
+// loadUsagePricing reads S3_PRICES ("CLASS=price,...") and the request prices
+func loadUsagePricing() UsagePricing {
+	pricing := UsagePricing{
+		StoragePerGBMonth: make(map[string]float64, len(defaultStoragePrices)),
+		PutPer1000:        getEnvFloat("S3_PRICE_PUT_PER_1000", defaultPutPricePer1000),
+		GetPer1000:        getEnvFloat("S3_PRICE_GET_PER_1000", defaultGetPricePer1000),
+	}
+	for class, price := range defaultStoragePrices {
+		pricing.StoragePerGBMonth[class] = price
+	}
+	for _, pair := range strings.Split(getEnvOrDefault("S3_PRICES", ""), ",") {
+		class, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		price, err := strconv.ParseFloat(value, 64)
+		if err != nil || price < 0 {
+			log.Printf("Invalid S3_PRICES entry %q", pair)
+			continue
+		}
+		pricing.StoragePerGBMonth[class] = price
+	}
+	return pricing
+}
+
+// usageTenantKey carries the tenant an S3 request is made for
+type usageTenantKey struct{}
+
+// withUsageTenant attributes the S3 requests made with ctx to a tenant
+func withUsageTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, usageTenantKey{}, tenant)
+}
+
+// usageMeter - Counts S3 requests by tenant and operation since startup
+type usageMeter struct {
+	since   time.Time
+	pricing UsagePricing
+
+	mu           sync.Mutex
+	requests     map[string]map[string]int64 // Tenant -> operation -> count
+	unattributed map[string]int64            // Cluster jobs (GC, listings, bootstraps) by operation
+}
+
+func newUsageMeter() *usageMeter {
+	return &usageMeter{
+		since:        timeNow().UTC(),
+		pricing:      loadUsagePricing(),
+		requests:     make(map[string]map[string]int64),
+		unattributed: make(map[string]int64),
+	}
+}
+
+// s3Option adds a middleware to an S3 client counting every operation once,
+// however many times it is retried
+func (m *usageMeter) s3Option(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("FileBoxUsage",
+			func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (
+				middleware.InitializeOutput, middleware.Metadata, error) {
+				tenant, attributed := ctx.Value(usageTenantKey{}).(string)
+				m.count(tenant, attributed, awsmiddleware.GetOperationName(ctx))
+				return next.HandleInitialize(ctx, in)
+			}), middleware.After)
+	})
+}
+
+// count records one S3 request
+func (m *usageMeter) count(tenant string, attributed bool, operation string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !attributed {
+		m.unattributed[operation]++
+		return
+	}
+	if m.requests[tenant] == nil {
+		m.requests[tenant] = make(map[string]int64)
+	}
+	m.requests[tenant][operation]++
+}
+
+// requestCost extrapolates the requests counted so far to a month; the
+// first hour counts as a whole hour so a fresh node does not project wildly
+func (m *usageMeter) requestCost(requests map[string]int64, now time.Time) float64 {
+	hours := max(now.Sub(m.since).Hours(), 1)
+	var cost float64
+	for operation, n := range requests {
+		switch {
+		case freeOperations[operation]:
+		case putClassOperations[operation]:
+			cost += float64(n) / 1000 * m.pricing.PutPer1000
+		default:
+			cost += float64(n) / 1000 * m.pricing.GetPer1000
+		}
+	}
+	return cost * hoursPerMonth / hours
+}
+
+// MonthlyCost - Estimated S3 bill for a month at the current size and request rate
+type MonthlyCost struct {
+	Storage  float64 `json:"storage"`
+	Requests float64 `json:"requests"`
+	Total    float64 `json:"total"`
+}
+
+// TenantUsage - What one tenant stores on this node and in S3
+type TenantUsage struct {
+	Tenant        string           `json:"tenant"`
+	Containers    int              `json:"containers"`
+	Blobs         int              `json:"blobs"`
+	LiveBytes     int64            `json:"live_bytes"`     // Blob bytes still readable
+	StoredBytes   int64            `json:"stored_bytes"`   // Container bytes, including record headers and dead blobs
+	PackingRatio  float64          `json:"packing_ratio"`  // Live bytes per stored byte
+	LocalBytes    int64            `json:"local_bytes"`    // Container files on this node's disk
+	S3Bytes       map[string]int64 `json:"s3_bytes"`       // Uploaded container bytes by storage class
+	S3Requests    map[string]int64 `json:"s3_requests"`    // Since startup, by operation
+	EstimatedCost MonthlyCost      `json:"estimated_cost"` // USD per month
+}
+
+// UsageReport - Response of GET /admin/usage
+type UsageReport struct {
+	Since        time.Time        `json:"since"` // Request counts start here
+	Pricing      UsagePricing     `json:"pricing"`
+	Tenants      []*TenantUsage   `json:"tenants"`
+	Total        TenantUsage      `json:"total"`
+	Unattributed map[string]int64 `json:"unattributed_s3_requests"` // Cluster jobs not billed to a tenant
+}
+
+// usageReport sums containers and requests per tenant. Replica copies of
+// other machines' containers count towards local bytes only; their owners
+// pay for the S3 copy.
+func (fb *FileBox) usageReport() *UsageReport {
+	now := timeNow()
+	tenants := make(map[string]*TenantUsage)
+	tenantUsage := func(tenant string) *TenantUsage {
+		if tenants[tenant] == nil {
+			tenants[tenant] = &TenantUsage{Tenant: tenant, S3Bytes: make(map[string]int64), S3Requests: make(map[string]int64)}
+		}
+		return tenants[tenant]
+	}
+
+	fb.fileLock.RLock()
+	for _, containerFile := range fb.files.all() {
+		usage := tenantUsage(containerFile.Tenant)
+		size, blobs := fb.containerContents(containerFile)
+		if !containerFile.Evicted {
+			usage.LocalBytes += size
+		}
+		if fb.isForeign(containerFile) {
+			continue
+		}
+		usage.Containers++
+		usage.StoredBytes += size
+		for _, blob := range blobs {
+			if !blob.Uncommitted && blob.DeletedAt == nil && blob.ChunkHash == "" && !expired(containerFile, blob, now) {
+				usage.Blobs++
+				usage.LiveBytes += blob.Size
+			}
+		}
+		if containerFile.Uploaded {
+			class := containerFile.StorageClass
+			if class == "" {
+				class = StorageClassStandard
+			}
+			usage.S3Bytes[class] += size
+		}
+	}
+	fb.fileLock.RUnlock()
+
+	fb.usage.mu.Lock()
+	for tenant, requests := range fb.usage.requests {
+		usage := tenantUsage(tenant)
+		for operation, n := range requests {
+			usage.S3Requests[operation] = n
+		}
+	}
+	report := &UsageReport{
+		Since:        fb.usage.since,
+		Pricing:      fb.usage.pricing,
+		Tenants:      make([]*TenantUsage, 0, len(tenants)),
+		Total:        TenantUsage{S3Bytes: make(map[string]int64), S3Requests: make(map[string]int64)},
+		Unattributed: make(map[string]int64, len(fb.usage.unattributed)),
+	}
+	for operation, n := range fb.usage.unattributed {
+		report.Unattributed[operation] = n
+	}
+	fb.usage.mu.Unlock()
+
+	total := &report.Total
+	for _, usage := range tenants {
+		for class, size := range usage.S3Bytes {
+			usage.EstimatedCost.Storage += float64(size) / bytesPerGB * fb.usage.pricing.StoragePerGBMonth[class]
+			total.S3Bytes[class] += size
+		}
+		usage.EstimatedCost.Requests = fb.usage.requestCost(usage.S3Requests, now)
+		usage.EstimatedCost.Total = usage.EstimatedCost.Storage + usage.EstimatedCost.Requests
+		if usage.StoredBytes > 0 {
+			usage.PackingRatio = float64(usage.LiveBytes) / float64(usage.StoredBytes)
+		}
+
+		total.Containers += usage.Containers
+		total.Blobs += usage.Blobs
+		total.LiveBytes += usage.LiveBytes
+		total.StoredBytes += usage.StoredBytes
+		total.LocalBytes += usage.LocalBytes
+		for operation, n := range usage.S3Requests {
+			total.S3Requests[operation] += n
+		}
+		total.EstimatedCost.Storage += usage.EstimatedCost.Storage
+		report.Tenants = append(report.Tenants, usage)
+	}
+	sort.Slice(report.Tenants, func(i, j int) bool { return report.Tenants[i].Tenant < report.Tenants[j].Tenant })
+
+	for operation, n := range report.Unattributed {
+		total.S3Requests[operation] += n
+	}
+	total.EstimatedCost.Requests = fb.usage.requestCost(total.S3Requests, now)
+	total.EstimatedCost.Total = total.EstimatedCost.Storage + total.EstimatedCost.Requests
+	if total.StoredBytes > 0 {
+		total.PackingRatio = float64(total.LiveBytes) / float64(total.StoredBytes)
+	}
+	return report
+}
+
+// handleUsage serves GET /admin/usage
+func (fb *FileBox) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.usageReport())
+}
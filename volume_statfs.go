@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd
+
+// Volume free space for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import "golang.org/x/sys/unix"
+
+// volumeSpace returns the bytes available to FileBox and the size of the
+// filesystem holding path
+func volumeSpace(path string) (int64, int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), int64(uint64(st.Blocks) * uint64(st.Bsize)), nil
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd)
+
+// Volume free space for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+// volumeSpace is not available here; volumes are placed as if equally full
+func volumeSpace(path string) (int64, int64, error) {
+	return 0, 0, errVolumeStatsUnsupported
+}
@@ -0,0 +1,541 @@
+// Multiple storage directories for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A node can spread its container files over several volumes, one storage
+// directory per disk. STORAGE_DIR is the first and also keeps the
+// metadata; STORAGE_DIRS adds the rest. New containers go to the healthy
+// volume with the most free space. Each volume is checked periodically by
+// writing, syncing and reading back a small file, so a failing disk stops
+// receiving containers. Containers whose volume is gone at startup are
+// served from S3 if uploaded and otherwise repaired from a replica.
+//
+// Reads, writes and checks that fail with a disk error count against the
+// volume. Too many within VOLUME_ERROR_WINDOW take it offline: it stays out
+// of placement even if later checks pass, its containers move to healthy
+// volumes the same way as at startup, and a volume.offline event is sent.
+// POST /admin/volumes brings it back or takes one offline by hand.
+
+const volumeProbeFile = ".filebox-probe"
+
+// lostVolumeReason starts the quarantine reason of containers whose volume
+// was unavailable, so finding the file again later lifts the quarantine
+const lostVolumeReason = "volume unavailable: "
+
+var errVolumeStatsUnsupported = errors.New("free space is not available on this platform")
+
+// VolumeStatus - Health and usage of one storage directory
+type VolumeStatus struct {
+	Path           string     `json:"path"`
+	Healthy        bool       `json:"healthy"`
+	FreeBytes      int64      `json:"free_bytes"`  // 0 where the platform cannot tell
+	TotalBytes     int64      `json:"total_bytes"` // 0 where the platform cannot tell
+	Containers     int        `json:"containers"`
+	ContainerBytes int64      `json:"container_bytes"`
+	ProbeLatency   string     `json:"probe_latency"`
+	LastCheck      time.Time  `json:"last_check"`
+	LastError      string     `json:"last_error,omitempty"`
+	Failures       int64      `json:"failures"`  // Failed checks since startup
+	IOErrors       int64      `json:"io_errors"` // Disk errors on reads, writes and checks since startup
+	Online         bool       `json:"online"`
+	OfflineReason  string     `json:"offline_reason,omitempty"`
+	OfflineSince   *time.Time `json:"offline_since,omitempty"`
+}
+
+// volume - One storage directory and its last check, guarded by mu
+type volume struct {
+	path string
+
+	mu        sync.Mutex
+	healthy   bool
+	free      int64
+	total     int64
+	reserved  int64 // Space promised to containers placed since the last check
+	latency   time.Duration
+	lastCheck time.Time
+	lastError string
+	failures  int64
+
+	maxErrors     int // Disk errors within errorWindow that take the volume offline; 0 never does
+	errorWindow   time.Duration
+	recentErrors  []time.Time
+	ioErrors      int64
+	offline       bool
+	offlineReason string
+	offlineSince  time.Time
+}
+
+// loadVolumes returns STORAGE_DIR followed by the directories in
+// STORAGE_DIRS, each checked once. A volume that fails its first check is
+// kept, marked unhealthy, so it can recover.
+func loadVolumes(storageDir string) []*volume {
+	paths := []string{storageDir}
+	for _, dir := range strings.Split(getEnvOrDefault("STORAGE_DIRS", ""), ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			paths = append(paths, dir)
+		}
+	}
+
+	maxErrors := int(getEnvInt("VOLUME_ERROR_THRESHOLD", 5))
+	errorWindow := getEnvDuration("VOLUME_ERROR_WINDOW", 5*time.Minute)
+
+	var volumes []*volume
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		v := &volume{path: path, maxErrors: maxErrors, errorWindow: errorWindow}
+		if err := os.MkdirAll(path, 0755); err != nil {
+			v.fail(err)
+		} else {
+			v.check()
+		}
+		volumes = append(volumes, v)
+	}
+	if len(volumes) > 1 {
+		for _, v := range volumes {
+			v.mu.Lock()
+			if v.healthy {
+				log.Printf("Storage volume %s: %d of %d bytes free", v.path, v.free, v.total)
+			}
+			v.mu.Unlock()
+		}
+	}
+	return volumes
+}
+
+// check refreshes free space and writes, syncs and reads back a probe file
+func (v *volume) check() error {
+	started := timeNow()
+	probe := filepath.Join(v.path, volumeProbeFile)
+	want := []byte(started.UTC().Format(time.RFC3339Nano))
+	err := func() error {
+		file, err := os.OpenFile(probe, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := file.Write(want); err != nil {
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		got := make([]byte, len(want))
+		if _, err := file.ReadAt(got, 0); err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("probe file read back wrong data")
+		}
+		return nil
+	}()
+	if err != nil {
+		v.fail(err)
+		return err
+	}
+
+	free, total, err := volumeSpace(v.path)
+	if err != nil && !errors.Is(err, errVolumeStatsUnsupported) {
+		v.fail(err)
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.healthy && !v.lastCheck.IsZero() {
+		log.Printf("Storage volume %s is healthy again", v.path)
+	}
+	v.healthy, v.free, v.total, v.reserved = true, free, total, 0
+	v.latency, v.lastCheck, v.lastError = timeNow().Sub(started), timeNow(), ""
+	return nil
+}
+
+// fail records a failed check
+func (v *volume) fail(err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.healthy || v.lastCheck.IsZero() {
+		log.Printf("WARNING: storage volume %s failed its check, no new containers go there: %v", v.path, err)
+	}
+	v.healthy, v.lastCheck, v.lastError = false, timeNow(), err.Error()
+	v.failures++
+}
+
+// isHealthy reports whether the last check passed and the volume is online
+func (v *volume) isHealthy() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.healthy && !v.offline
+}
+
+// recordError counts a disk error and reports whether it takes the volume
+// offline
+func (v *volume) recordError(err error) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := timeNow()
+	v.ioErrors++
+	v.recentErrors = append(v.recentErrors, now)
+	for len(v.recentErrors) > 0 && now.Sub(v.recentErrors[0]) > v.errorWindow {
+		v.recentErrors = v.recentErrors[1:]
+	}
+	if v.offline || v.maxErrors <= 0 || len(v.recentErrors) < v.maxErrors {
+		return false
+	}
+	v.offline, v.offlineSince = true, now
+	v.offlineReason = fmt.Sprintf("%d disk errors within %s, the last: %v", len(v.recentErrors), v.errorWindow, err)
+	return true
+}
+
+// isDiskError reports whether a file operation failed in a way that points
+// at the disk rather than at the file: not a missing file, a short read or
+// a full disk
+func isDiskError(err error) bool {
+	return err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, io.EOF) &&
+		!errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, syscall.ENOSPC)
+}
+
+// noteIOError counts a failed read or write of a container file against
+// its volume
+func (fb *FileBox) noteIOError(path string, err error) {
+	if !isDiskError(err) {
+		return
+	}
+	if v := fb.volumeFor(path); v != nil && v.recordError(err) {
+		fb.volumeWentOffline(v)
+	}
+}
+
+// volumeWentOffline moves the containers off a volume that was just taken
+// offline and tells the webhooks
+func (fb *FileBox) volumeWentOffline(v *volume) {
+	v.mu.Lock()
+	reason := v.offlineReason
+	v.mu.Unlock()
+	log.Printf("WARNING: storage volume %s is offline: %s", v.path, reason)
+
+	evicted, repairs := fb.relocateContainers(v)
+	fb.emit("volume.offline", map[string]any{
+		"volume":    v.path,
+		"reason":    reason,
+		"from_s3":   evicted,
+		"repairing": len(repairs),
+	})
+	go func() {
+		var failed []string
+		for _, containerFile := range repairs {
+			if result := fb.repairContainer(containerFile); result.Status == "failed" {
+				failed = append(failed, containerFile.FID.String())
+			}
+		}
+		log.Printf("Storage volume %s: %d of %d containers repaired", v.path, len(repairs)-len(failed), len(repairs))
+		fb.emit("volume.repaired", map[string]any{
+			"volume":   v.path,
+			"repaired": len(repairs) - len(failed),
+			"failed":   failed,
+		})
+	}()
+}
+
+// relocateContainers gives every container on an offline volume a place on
+// a healthy one. Uploaded containers are read from S3 from then on; the
+// rest are quarantined and returned for repair. Foreign containers are
+// left alone.
+func (fb *FileBox) relocateContainers(v *volume) (int, []*ContainerFile) {
+	var moved []string
+	var repairs []*ContainerFile
+	var changed []*ContainerFile
+	evicted := 0
+	reason := lostVolumeReason + fmt.Sprintf("%s went offline", v.path)
+
+	fb.fileLock.Lock()
+	for _, containerFile := range fb.files.all() {
+		if fb.volumeFor(containerFile.FilePath) != v || fb.isForeign(containerFile) {
+			continue
+		}
+		moved = append(moved, containerFile.FilePath)
+		containerFile.FilePath = shardedPath(fb.pickVolume(containerFile.Size), containerFile.FID.String())
+		changed = append(changed, containerFile)
+		switch {
+		case containerFile.Evicted:
+		case containerFile.Uploaded:
+			containerFile.Evicted = true
+			evicted++
+		default:
+			if !containerFile.Quarantined {
+				containerFile.Quarantined, containerFile.QuarantineReason = true, reason
+			}
+			repairs = append(repairs, containerFile)
+		}
+	}
+	fb.fileLock.Unlock()
+
+	for _, path := range moved {
+		fb.mmap.forget(path)
+		fb.writeMode.forget(path)
+	}
+	for _, containerFile := range changed {
+		fb.saveManifest(containerFile)
+	}
+	return evicted, repairs
+}
+
+// setVolumeOnline takes a volume offline by hand or brings it back. A
+// volume coming back must pass a check first; containers already moved off
+// it stay where they are.
+func (fb *FileBox) setVolumeOnline(v *volume, online bool) error {
+	if online {
+		if err := v.check(); err != nil {
+			return fmt.Errorf("volume failed its check: %v", err)
+		}
+		v.mu.Lock()
+		wasOffline := v.offline
+		v.offline, v.offlineReason, v.offlineSince, v.recentErrors = false, "", time.Time{}, nil
+		v.mu.Unlock()
+		if wasOffline {
+			log.Printf("Storage volume %s is online again", v.path)
+			fb.emit("volume.online", map[string]any{"volume": v.path})
+		}
+		return nil
+	}
+
+	v.mu.Lock()
+	if v.offline {
+		v.mu.Unlock()
+		return nil
+	}
+	v.offline, v.offlineSince, v.offlineReason = true, timeNow(), "taken offline by an administrator"
+	v.mu.Unlock()
+	fb.volumeWentOffline(v)
+	return nil
+}
+
+// runVolumeChecks checks every volume each VOLUME_CHECK_INTERVAL
+func (fb *FileBox) runVolumeChecks() {
+	interval := getEnvDuration("VOLUME_CHECK_INTERVAL", 30*time.Second)
+	if interval <= 0 || len(fb.volumes) == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, v := range fb.volumes {
+			if err := v.check(); err != nil && v.recordError(err) {
+				fb.volumeWentOffline(v)
+			}
+		}
+	}
+}
+
+// pickVolume returns the healthy volume with the most free space left
+// after what was already promised to new containers, and promises it size
+// more. Without healthy volumes it falls back to the first one, so the
+// failure shows up when the container is written.
+func (fb *FileBox) pickVolume(size int64) string {
+	if len(fb.volumes) == 0 {
+		return fb.storageDir
+	}
+	var best *volume
+	var bestRoom int64
+	for _, v := range fb.volumes {
+		v.mu.Lock()
+		healthy, room := v.healthy && !v.offline, v.free-v.reserved
+		v.mu.Unlock()
+		if healthy && (best == nil || room > bestRoom) {
+			best, bestRoom = v, room
+		}
+	}
+	if best == nil {
+		return fb.volumes[0].path
+	}
+	best.mu.Lock()
+	best.reserved += size
+	best.mu.Unlock()
+	return best.path
+}
+
+// volumeFor returns the volume a container file is on, or nil if none of
+// the configured volumes holds that path
+func (fb *FileBox) volumeFor(path string) *volume {
+	path = filepath.Clean(path)
+	var found *volume
+	for _, v := range fb.volumes {
+		if strings.HasPrefix(path, v.path+string(filepath.Separator)) && (found == nil || len(v.path) > len(found.path)) {
+			found = v
+		}
+	}
+	return found
+}
+
+// volumeRoot returns the storage directory a container file is on, for
+// staging replacements on the same filesystem
+func (fb *FileBox) volumeRoot(path string) string {
+	if v := fb.volumeFor(path); v != nil {
+		return v.path
+	}
+	return fb.storageDir
+}
+
+// volumeRoots returns every configured storage directory
+func (fb *FileBox) volumeRoots() []string {
+	if len(fb.volumes) == 0 {
+		return []string{fb.storageDir}
+	}
+	roots := make([]string, len(fb.volumes))
+	for i, v := range fb.volumes {
+		roots[i] = v.path
+	}
+	return roots
+}
+
+// recoverLostContainers registers containers that have metadata but whose
+// volume is unhealthy or no longer configured. Each gets a place on a
+// healthy volume: uploaded ones are read from S3 like evicted containers,
+// the rest are quarantined and repaired from a replica. Containers simply
+// missing from a healthy volume are left to --fsck. It returns the IDs.
+func (fb *FileBox) recoverLostContainers() []string {
+	fileIDs, err := fb.meta.ListContainers()
+	if err != nil {
+		log.Printf("Error listing containers: %v", err)
+		return nil
+	}
+
+	var lost []string
+	var repairs []*ContainerFile
+	for _, fileID := range fileIDs {
+		if _, exists := fb.files.get(fileID); exists {
+			continue
+		}
+		containerFile, err := fb.loadManifest(fileID)
+		if err != nil || containerFile == nil || containerFile.Evicted {
+			continue
+		}
+		fid, err := ParseFID(fileID)
+		if err != nil || !fb.ownsMachine(fid.MachineID) {
+			continue
+		}
+		v := fb.volumeFor(containerFile.FilePath)
+		if v != nil && v.isHealthy() {
+			continue
+		}
+
+		reason := lostVolumeReason + fmt.Sprintf("%s is not on a configured volume", containerFile.FilePath)
+		if v != nil {
+			reason = lostVolumeReason + fmt.Sprintf("%s failed its check", v.path)
+		}
+		containerFile.FID = fid
+		containerFile.FilePath = fb.newContainerPath(fileID, 0)
+		if containerFile.Uploaded {
+			containerFile.Evicted = true
+			log.Printf("Container %s: %s; reading it from S3", fileID, reason)
+		} else {
+			containerFile.Quarantined, containerFile.QuarantineReason = true, reason
+			repairs = append(repairs, containerFile)
+			log.Printf("Container %s: %s; repairing it from a replica", fileID, reason)
+		}
+		fb.registerContainer(containerFile)
+		fb.saveManifest(containerFile)
+		lost = append(lost, fileID)
+	}
+
+	for _, containerFile := range repairs {
+		go fb.repairContainer(containerFile)
+	}
+	return lost
+}
+
+// volumeStatus reports every volume's health and the containers on it
+func (fb *FileBox) volumeStatus() []VolumeStatus {
+	statuses := make([]VolumeStatus, len(fb.volumes))
+	index := make(map[*volume]int, len(fb.volumes))
+	for i, v := range fb.volumes {
+		index[v] = i
+		v.mu.Lock()
+		statuses[i] = VolumeStatus{
+			Path:          v.path,
+			Healthy:       v.healthy,
+			FreeBytes:     v.free,
+			TotalBytes:    v.total,
+			ProbeLatency:  v.latency.String(),
+			LastCheck:     v.lastCheck,
+			LastError:     v.lastError,
+			Failures:      v.failures,
+			IOErrors:      v.ioErrors,
+			Online:        !v.offline,
+			OfflineReason: v.offlineReason,
+		}
+		if v.offline {
+			since := v.offlineSince
+			statuses[i].OfflineSince = &since
+		}
+		v.mu.Unlock()
+	}
+
+	fb.fileLock.RLock()
+	for _, containerFile := range fb.files.all() {
+		if containerFile.Evicted {
+			continue
+		}
+		if v := fb.volumeFor(containerFile.FilePath); v != nil {
+			statuses[index[v]].Containers++
+			statuses[index[v]].ContainerBytes += fb.containerSize(containerFile)
+		}
+	}
+	fb.fileLock.RUnlock()
+	return statuses
+}
+
+// handleVolumes serves GET /admin/volumes and POST /admin/volumes?path=<dir>&online=<bool>
+func (fb *FileBox) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var v *volume
+		for _, candidate := range fb.volumes {
+			if candidate.path == filepath.Clean(r.URL.Query().Get("path")) {
+				v = candidate
+			}
+		}
+		if v == nil {
+			http.Error(w, "Unknown volume", http.StatusNotFound)
+			return
+		}
+		online, err := strconv.ParseBool(r.URL.Query().Get("online"))
+		if err != nil {
+			http.Error(w, "online must be true or false", http.StatusBadRequest)
+			return
+		}
+		if err := fb.setVolumeOnline(v, online); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fb.volumeStatus())
+}
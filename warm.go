@@ -0,0 +1,293 @@
+// Cache warming for FileBox
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultWarmHold = time.Hour
+
+// WarmRequest - Body of POST /admin/warm
+type WarmRequest struct {
+	Blobs     []string `json:"blobs,omitempty"`     // Blob IDs to warm
+	Keys      []string `json:"keys,omitempty"`      // Named keys to warm
+	Container string   `json:"container,omitempty"` // FID; warms every live blob in it
+	Local     bool     `json:"local,omitempty"`     // Download evicted containers back to local disk
+	Hold      string   `json:"hold,omitempty"`      // With local, keep downloaded containers from eviction this long (default 1h)
+}
+
+// WarmJob - Progress of a warm request
+type WarmJob struct {
+	JobInfo
+	BlobsTotal int      `json:"blobs_total"`
+	Warmed     int      `json:"warmed"`     // Blobs now in the page cache, blob cache or edge cache
+	Restoring  int      `json:"restoring"`  // Blobs in archived containers whose restore was requested
+	Downloaded int      `json:"downloaded"` // Evicted containers brought back to local disk
+	Bytes      int64    `json:"bytes"`
+	Errors     []string `json:"errors,omitempty"`
+
+	request WarmRequest
+	hold    time.Duration
+}
+
+func (j *WarmJob) progress() (int64, int64) {
+	return int64(j.Warmed + j.Restoring + len(j.Errors)), int64(j.BlobsTotal)
+}
+
+// warmTarget - Blobs of one container to warm
+type warmTarget struct {
+	containerFile *ContainerFile
+	blobs         []BlobInfo
+}
+
+// startWarm validates a request and warms its blobs in the background
+func (fb *FileBox) startWarm(req WarmRequest) (*WarmJob, error) {
+	if len(req.Blobs) == 0 && len(req.Keys) == 0 && req.Container == "" {
+		return nil, fmt.Errorf("blobs, keys or container required")
+	}
+	hold := defaultWarmHold
+	if req.Hold != "" {
+		var err error
+		if hold, err = time.ParseDuration(req.Hold); err != nil || hold < 0 {
+			return nil, fmt.Errorf("invalid hold %q (want a duration such as 2h)", req.Hold)
+		}
+	}
+	if req.Container != "" {
+		fb.fileLock.RLock()
+		_, exists := fb.files.get(req.Container)
+		fb.fileLock.RUnlock()
+		if !exists {
+			return nil, fmt.Errorf("container file not found: %s", req.Container)
+		}
+	}
+
+	job := &WarmJob{request: req, hold: hold}
+	fb.jobs.submit(JobWarm, job, func(ctx context.Context) error {
+		return fb.runWarm(ctx, job)
+	})
+	return job, nil
+}
+
+// warmTargets groups the requested blobs by container, in request order.
+// Blob IDs and keys this node does not know are returned separately, as
+// the paths they are read at.
+func (fb *FileBox) warmTargets(req WarmRequest) ([]*warmTarget, []string) {
+	var targets []*warmTarget
+	byContainer := make(map[*ContainerFile]*warmTarget)
+	var unknown []string
+	seen := make(map[string]bool)
+	now := timeNow()
+
+	fb.fileLock.RLock()
+	defer fb.fileLock.RUnlock()
+	var add func(containerFile *ContainerFile, blob BlobInfo, segment bool)
+	add = func(containerFile *ContainerFile, blob BlobInfo, segment bool) {
+		if seen[blob.ID] || blob.Uncommitted || !segment && (blob.DeletedAt != nil || expired(containerFile, blob, now)) {
+			return
+		}
+		seen[blob.ID] = true
+		if len(blob.Segments) > 0 {
+			// Composed blobs are warmed through their segments, which are read trashed or not
+			for _, segmentID := range blob.Segments {
+				if segmentIn, segmentBlob, ok := fb.lookupBlob(segmentID); ok {
+					add(segmentIn, segmentBlob, true)
+				}
+			}
+			return
+		}
+		target, ok := byContainer[containerFile]
+		if !ok {
+			target = &warmTarget{containerFile: containerFile}
+			byContainer[containerFile] = target
+			targets = append(targets, target)
+		}
+		target.blobs = append(target.blobs, blob)
+	}
+
+	if containerFile, ok := fb.files.get(req.Container); ok {
+		for _, blob := range fb.containerBlobs(containerFile) {
+			add(containerFile, blob, false)
+		}
+	}
+	for _, blobID := range req.Blobs {
+		containerFile, blob, ok := fb.lookupBlob(blobID)
+		if !ok {
+			unknown = append(unknown, "/blob/"+blobID)
+			continue
+		}
+		add(containerFile, blob, false)
+	}
+	for _, key := range req.Keys {
+		containerFile, blob, ok := fb.lookupBlob(fb.keys[key])
+		if !ok {
+			unknown = append(unknown, "/key/"+key)
+			continue
+		}
+		add(containerFile, blob, false)
+	}
+	return targets, unknown
+}
+
+// runWarm reads every requested blob once so later reads are served from
+// memory or local disk. Local containers are read into the page cache.
+// Blobs of evicted containers go into the blob cache, or their whole
+// container is downloaded with local (or without a blob cache). Edge nodes
+// pull blobs and keys into their edge cache.
+func (fb *FileBox) runWarm(ctx context.Context, job *WarmJob) error {
+	targets, unknown := fb.warmTargets(job.request)
+
+	fb.jobs.mu.Lock()
+	job.BlobsTotal = len(unknown)
+	for _, target := range targets {
+		job.BlobsTotal += len(target.blobs)
+	}
+	fb.jobs.mu.Unlock()
+
+	record := func(id string, size int64, err error) {
+		fb.jobs.mu.Lock()
+		defer fb.jobs.mu.Unlock()
+		var restoreErr *RestoreInProgressError
+		switch {
+		case errors.As(err, &restoreErr):
+			job.Restoring++
+		case err != nil:
+			job.Errors = append(job.Errors, fmt.Sprintf("%s: %v", id, err))
+		default:
+			job.Warmed++
+			job.Bytes += size
+		}
+	}
+
+	for _, path := range unknown {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if fb.edge == nil {
+			record(path, 0, fmt.Errorf("not found"))
+			continue
+		}
+		size, err := fb.edge.warm(ctx, path)
+		record(path, size, err)
+	}
+
+	for _, target := range targets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		containerFile := target.containerFile
+		fb.fileLock.RLock()
+		evicted, federated, quarantined := containerFile.Evicted, containerFile.Federated, containerFile.Quarantined
+		fb.fileLock.RUnlock()
+
+		switch {
+		case quarantined:
+			record(containerFile.FID.String(), 0, fmt.Errorf("container is quarantined; repair it first"))
+			continue
+		case federated:
+			record(containerFile.FID.String(), 0, fmt.Errorf("container was offloaded to the federated cluster; warm it there"))
+			continue
+		case evicted && (job.request.Local || fb.cache.capacity <= 0):
+			if err := fb.downloadEvictedContainer(ctx, containerFile, job.hold); err != nil {
+				record(containerFile.FID.String(), 0, err)
+				continue
+			}
+			fb.jobs.mu.Lock()
+			job.Downloaded++
+			fb.jobs.mu.Unlock()
+			evicted = false
+		}
+
+		for _, blob := range target.blobs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if evicted {
+				blobData, err := fb.readBlobFromS3(ctx, containerFile, blob)
+				if err == nil {
+					fb.cache.prefetched(blob.ID, blobData)
+				}
+				record(blob.ID, int64(len(blobData)), err)
+				continue
+			}
+			blobData, err := fb.readBlobData(ctx, containerFile, blob)
+			record(blob.ID, int64(len(blobData)), err)
+		}
+	}
+
+	fb.jobs.mu.Lock()
+	defer fb.jobs.mu.Unlock()
+	log.Printf("Warm %s finished: %d of %d blobs warmed (%d bytes), %d containers downloaded, %d restoring, %d errors",
+		job.ID, job.Warmed, job.BlobsTotal, job.Bytes, job.Downloaded, job.Restoring, len(job.Errors))
+	if len(job.Errors) > 0 {
+		return fmt.Errorf("%d blobs failed to warm", len(job.Errors))
+	}
+	return nil
+}
+
+// downloadEvictedContainer brings an evicted container back to local disk,
+// verified blob by blob, and keeps eviction away from it for hold
+func (fb *FileBox) downloadEvictedContainer(ctx context.Context, containerFile *ContainerFile, hold time.Duration) error {
+	if fb.s3Client == nil {
+		return fmt.Errorf("S3 is not configured")
+	}
+	fb.fileLock.Lock()
+	if containerFile.repairing {
+		fb.fileLock.Unlock()
+		return fmt.Errorf("container is being repaired")
+	}
+	containerFile.repairing = true
+	fb.fileLock.Unlock()
+
+	err := fb.repairFromS3(ctx, containerFile)
+
+	fb.fileLock.Lock()
+	containerFile.repairing = false
+	if err == nil {
+		containerFile.warmUntil = timeNow().Add(hold)
+	}
+	fb.fileLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("error downloading container: %v", err)
+	}
+	fb.saveManifest(containerFile)
+	log.Printf("Downloaded evicted container %s for warming; not evicted again for %s", containerFile.FID.String(), hold)
+	return nil
+}
+
+// handleWarm starts warming (POST /admin/warm), or reports (GET) or cancels
+// (DELETE) a job at /admin/warm/{id}
+func (fb *FileBox) handleWarm(w http.ResponseWriter, r *http.Request) {
+	jobID := r.URL.Path[len("/admin/warm"):]
+
+	switch {
+	case len(jobID) > 1:
+		fb.jobs.serveJob(w, r, jobID[1:], JobWarm)
+
+	case r.Method == "POST":
+		var req WarmRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid warm request", http.StatusBadRequest)
+			return
+		}
+
+		job, err := fb.startWarm(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fb.jobs.writeJob(w, http.StatusAccepted, job)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+// Container append write modes for FileBox (Linux)
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import "golang.org/x/sys/unix"
+
+const (
+	directIOSupported = true
+	openDirect        = unix.O_DIRECT
+	openDsync         = unix.O_DSYNC
+)
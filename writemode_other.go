@@ -0,0 +1,16 @@
+//go:build !linux
+
+// Container append write modes for FileBox (platforms without O_DIRECT)
+//
+// This is part of an educational toy application for learning blob storage concepts.
+// WARNING: This is NOT production-ready software.
+package main
+
+import "os"
+
+// O_SYNC also flushes metadata, a superset of what O_DSYNC promises
+const (
+	directIOSupported = false
+	openDirect        = 0
+	openDsync         = os.O_SYNC
+)